@@ -0,0 +1,155 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/DataDrake/waterlog"
+	"github.com/GZGavinZhao/autobuild/common"
+	"github.com/GZGavinZhao/autobuild/push"
+	st "github.com/GZGavinZhao/autobuild/state"
+	"github.com/GZGavinZhao/autobuild/utils"
+)
+
+// abiCheck compares the shared libraries of the packages of a push before and
+// after they were rebuilt, with --abi-check.
+type abiCheck struct {
+	// tpath is the binary state of the repository that the packages are
+	// indexed into.
+	tpath string
+	// dir holds the libraries extracted from the packages, under old and
+	// new.
+	dir string
+	// oldLibs holds, by package name, the libraries that the packages of
+	// the push shipped before, see st.BinaryState.ExtractLibraries.
+	oldLibs map[string]map[string]string
+}
+
+// newABICheck extracts the shared libraries that the packages of `order`
+// ship in the repository at `tpath` before they are replaced, and exits if it
+// isn't a binary state or abidiff can't be found.
+func newABICheck(tpath string, order pushOrder) *abiCheck {
+	if _, err := exec.LookPath(st.ABIDiff); err != nil {
+		waterlog.Fatalf("--abi-check needs abidiff from libabigail: %s\n", err)
+	}
+	state, err := st.LoadState(tpath)
+	if err != nil {
+		waterlog.Fatalf("Failed to load the repository to check the ABI against: %s\n", err)
+	}
+	old, ok := state.(*st.BinaryState)
+	if !ok {
+		waterlog.Fatalf("--abi-check needs the binary index of the repository, such as repo:unstable, not %s\n", tpath)
+	}
+	dir, err := os.MkdirTemp("", "autobuild-abi-*")
+	if err != nil {
+		waterlog.Fatalf("Failed to create a directory for the libraries: %s\n", err)
+	}
+
+	c := &abiCheck{tpath: tpath, dir: dir, oldLibs: make(map[string]map[string]string)}
+	timings.start("extracting the libraries to check the ABI of", true)
+	defer timings.end()
+	for _, pkg := range order.packages {
+		// New packages have no ABI to break.
+		oldIdx, ok := old.NameToSrcIdx()[pkg.Name]
+		if !ok {
+			continue
+		}
+		libs, err := old.ExtractLibraries(oldIdx, filepath.Join(dir, "old", pkg.Name))
+		if err != nil {
+			waterlog.Warnf("Skipping the ABI check of %s: %s\n", pkg.Name, err)
+			continue
+		}
+		if len(libs) != 0 {
+			c.oldLibs[pkg.Name] = libs
+		}
+	}
+	return c
+}
+
+// run compares the shared libraries of the packages of `order` that were
+// indexed on every target with the ones they replaced, and lists the packages
+// that link against the libraries whose ABI broke, which need to be rebuilt
+// too. It returns the code to exit with: exitABIBroken if any ABI broke, or
+// else exitFailure if any package failed to be checked, or else exitOK.
+func (c *abiCheck) run(order pushOrder, results []push.Result) (code int) {
+	defer os.RemoveAll(c.dir)
+	state, err := st.LoadState(c.tpath)
+	if err != nil {
+		fatalf(exitServer, "Failed to reload the repository to check the ABI against: %s\n", err)
+	}
+	cur := state.(*st.BinaryState)
+
+	// rebuilds maps the names of the packages to rebuild to the packages
+	// whose ABI they depend on.
+	rebuilds := make(map[string][]string)
+	checked := 0
+	for idx, pkg := range order.packages {
+		oldLibs, ok := c.oldLibs[pkg.Name]
+		if !ok || slices.ContainsFunc(results, func(result push.Result) bool {
+			return idx >= len(result.Outcomes) || result.Outcomes[idx] != push.Succeeded
+		}) {
+			continue
+		}
+		curIdx, ok := cur.NameToSrcIdx()[pkg.Name]
+		if !ok || cur.Packages()[curIdx].Release != pkg.Release {
+			waterlog.Warnf("Skipping the ABI check of %s, whose release %d isn't in %s yet\n", pkg.Name, pkg.Release, c.tpath)
+			continue
+		}
+
+		newLibs, err := cur.ExtractLibraries(curIdx, filepath.Join(c.dir, "new", pkg.Name))
+		var breaks []st.ABIBreak
+		if err == nil {
+			breaks, err = st.ABIBreaks(oldLibs, newLibs)
+		}
+		checked++
+		if err != nil {
+			waterlog.Errorf("Failed to check the ABI of %s: %s\n", pkg.Name, err)
+			code = max(code, exitFailure)
+			continue
+		}
+		if len(breaks) == 0 {
+			continue
+		}
+
+		code = exitABIBroken
+		waterlog.Warnf("The ABI of %s broke:\n", pkg.Name)
+		for _, b := range breaks {
+			if b.Removed {
+				waterlog.Printf("    %s was removed\n", b.Library)
+			} else {
+				waterlog.Printf("    %s\n", b.Library)
+				waterlog.Debugf("%s\n", b.Report)
+			}
+		}
+		for _, dep := range cur.Dependents(curIdx) {
+			name := cur.Packages()[dep].Name
+			// Packages of the push were already rebuilt against the new ABI.
+			if slices.ContainsFunc(order.packages, func(p common.Package) bool { return p.Name == name }) {
+				continue
+			}
+			rebuilds[name] = append(rebuilds[name], pkg.Name)
+		}
+	}
+	waterlog.Infof("Checked the ABI of %d package(s)\n", checked)
+
+	if len(rebuilds) != 0 {
+		rows := make([]string, 0, len(rebuilds))
+		for _, name := range utils.SortedKeys(rebuilds) {
+			rows = append(rows, fmt.Sprintf("    %s (%s)", name, strings.Join(rebuilds[name], ", ")))
+		}
+		waterlog.Warnf("%d package(s) link against the broken ABI, and need to be rebuilt:\n%s\n", len(rebuilds), strings.Join(rows, "\n"))
+		if order.newTPath != "" {
+			waterlog.Infoln("Bump their release, and push them, with:")
+			fmt.Println(strings.Join(append([]string{"autobuild", "bump", shellQuote(order.newTPath)}, utils.SortedKeys(rebuilds)...), " "))
+		}
+	}
+	return code
+}
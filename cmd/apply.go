@@ -0,0 +1,110 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package cmd
+
+import (
+	"github.com/DataDrake/waterlog"
+	"github.com/GZGavinZhao/autobuild/push"
+	"github.com/GZGavinZhao/autobuild/state"
+	"github.com/spf13/cobra"
+)
+
+var (
+	applyState string
+	applyForce bool
+	cmdApply   = &cobra.Command{
+		Use:   "apply <plan>",
+		Short: "Publish the packages of a plan made by \"autobuild plan\"",
+		Long: `Publish exactly the packages recorded in a plan, in its build order, to its build
+server. Fails if the recipes no longer match the plan, or if the build server
+of its backend is configured differently.`,
+		Run:  runApply,
+		Args: cobra.ExactArgs(1),
+	}
+)
+
+func init() {
+	cmdApply.Flags().StringVar(&applyState, "state", "", "TPath to load the recipes from (default the new TPath of the plan)")
+	cmdApply.Flags().BoolVarP(&applyForce, "force", "f", false, "publish to the configured build server even if it differs from the plan")
+	publishFlags(cmdApply)
+	pinFlag(cmdApply)
+}
+
+func runApply(cmd *cobra.Command, args []string) {
+	plan, err := push.LoadPlan(args[0])
+	if err != nil {
+		waterlog.Fatalf("Failed to load plan: %s\n", err)
+	}
+	waterlog.Goodln(msg("plan.loaded", "plan", args[0], "created", plan.Created.Format("2006-01-02 15:04:05 MST")))
+
+	if len(plan.Packages) == 0 {
+		waterlog.Infoln(msg("push.nothing"))
+		return
+	}
+
+	tpath := plan.New
+	if applyState != "" {
+		tpath = applyState
+	}
+	checkoutOnly(tpath)
+	newState, err := state.LoadState(tpath)
+	if err != nil {
+		waterlog.Fatalf("Failed to load state %s: %s\n", tpath, err)
+	}
+	waterlog.Goodln(msg("state.parsed", "tpath", tpath))
+
+	// The recipes must not have changed since the plan was reviewed.
+	// Packages planned with --auto-bump are still at their previous release.
+	order := pushOrder{autoBumped: make(map[string]bool)}
+	stale := false
+	for _, ppkg := range plan.Packages {
+		pkg, idx := state.GetPackage(newState, ppkg.Name)
+		if idx < 0 || pkg.Name != ppkg.Name {
+			waterlog.Errorf("%s is in the plan but not in %s\n", ppkg.Name, tpath)
+			stale = true
+			continue
+		}
+		release := pkg.Release
+		if ppkg.AutoBump {
+			release++
+			order.autoBumped[pkg.Name] = true
+		}
+		if pkg.Version != ppkg.Version || release != ppkg.Release {
+			waterlog.Errorf("%s is planned as %s-%d but is now %s-%d\n", ppkg.Name, ppkg.Version, ppkg.Release, pkg.Version, pkg.Release)
+			stale = true
+		}
+		pkg.Release = release
+
+		order.packages = append(order.packages, pkg)
+		order.deps = append(order.deps, ppkg.Deps)
+		order.streams = append(order.streams, ppkg.Stream)
+		order.old = append(order.old, ppkg.Old)
+	}
+	if stale {
+		waterlog.Errorln(msg("plan.stale"))
+		exit(1)
+	}
+	// Packages may have been pinned since the plan was made.
+	getPins(cmd).check(order.packages, "publish", "make a new plan without them")
+	printOrder(order)
+
+	userConfig, err := loadConfig()
+	if err != nil {
+		waterlog.Fatalf("Failed to load configuration: %s\n", err)
+	}
+	builder, err := singleBuilder(plan.Backend, userConfig.Push)
+	if err != nil {
+		waterlog.Fatalf("Failed to set up build server backend: %s\n", err)
+	}
+	if builder.Target() != plan.Target {
+		if !applyForce {
+			waterlog.Fatalf("The plan publishes to %s, but the %s backend is configured to publish to %s\n", plan.Target, plan.Backend, builder.Target())
+		}
+		waterlog.Warnf("The plan publishes to %s, but publishing to %s instead\n", plan.Target, builder.Target())
+	}
+
+	order.oldTPath, order.newTPath = plan.Old, plan.New
+	publishOrder(cmd, []pushTarget{{builder: builder}}, userConfig, order)
+}
@@ -0,0 +1,376 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/bits"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/DataDrake/waterlog"
+	"github.com/GZGavinZhao/autobuild/push"
+	"github.com/spf13/cobra"
+)
+
+var (
+	bisectSessionPath string
+	cmdBisect         = &cobra.Command{
+		Use:   "bisect-rebuild",
+		Short: "Find the package of a mass rebuild that introduced a regression",
+		Long: `Bisect over the packages published by a push, in the order they were
+published, to find the one whose rebuild broke something at runtime, like git
+bisect does over commits. Every step asks to test the system with the new
+releases of the first packages of the push installed, and the old releases of
+the others, and to report whether it is good or bad. For example:
+autobuild bisect-rebuild start --batch 20240101T120000Z-1a2b3c
+eopkg install $(autobuild bisect-rebuild list)
+autobuild bisect-rebuild bad
+
+"bisect-rebuild run" automates the steps with a command. Without a subcommand,
+the current step is printed.`,
+		Run:  runBisectStatus,
+		Args: cobra.NoArgs,
+	}
+	cmdBisectStart = &cobra.Command{
+		Use:   "start",
+		Short: "Start bisecting the packages of a push",
+		Long: `Start bisecting the packages published by a push of the history, the latest
+one by default, or recorded in a push journal with --from-journal. The system
+without any of them is assumed to be good, and with all of them bad.`,
+		Run:  runBisectStart,
+		Args: cobra.NoArgs,
+	}
+	cmdBisectGood = &cobra.Command{
+		Use:   "good",
+		Short: "Mark the current step as good",
+		Run:   func(cmd *cobra.Command, args []string) { markBisect(bisectGood) },
+		Args:  cobra.NoArgs,
+	}
+	cmdBisectBad = &cobra.Command{
+		Use:   "bad",
+		Short: "Mark the current step as bad",
+		Run:   func(cmd *cobra.Command, args []string) { markBisect(bisectBad) },
+		Args:  cobra.NoArgs,
+	}
+	cmdBisectSkip = &cobra.Command{
+		Use:   "skip",
+		Short: "Skip the current step, e.g. if it can't be tested",
+		Run:   func(cmd *cobra.Command, args []string) { markBisect(bisectSkip) },
+		Args:  cobra.NoArgs,
+	}
+	cmdBisectList = &cobra.Command{
+		Use:   "list",
+		Short: "List the packages to install the new releases of for the current step",
+		Long: `List the packages to install the new releases of for the current step, one per
+line, or with --revert the ones to keep at, or downgrade to, their old release.`,
+		Run:  runBisectList,
+		Args: cobra.NoArgs,
+	}
+	cmdBisectRun = &cobra.Command{
+		Use:   "run <command> [args]...",
+		Short: "Bisect automatically by running a command at every step",
+		Long: `Run the command at every step until the culprit is found. The command gets the
+paths to the files listing the packages to install the new and the old
+releases of, as "name version-release" lines, in $AUTOBUILD_BISECT_APPLY and
+$AUTOBUILD_BISECT_REVERT, and reports the step like for git bisect run: exit
+code 0 is good, 125 skips the step, 1 to 127 are bad, and anything else stops
+bisecting.`,
+		Run:  runBisectRun,
+		Args: cobra.MinimumNArgs(1),
+	}
+	cmdBisectReset = &cobra.Command{
+		Use:   "reset",
+		Short: "Stop bisecting and remove the session",
+		Run:   runBisectReset,
+		Args:  cobra.NoArgs,
+	}
+)
+
+// bisectMark is how a step of a bisection was marked.
+type bisectMark int
+
+const (
+	bisectGood bisectMark = iota
+	bisectBad
+	bisectSkip
+)
+
+// bisectSession is the state of a bisection over the packages of a push, kept
+// between invocations. Applying the first `Good` packages is known to work,
+// and applying the first `Bad` ones to break, so the culprit is among the
+// packages from Good to Bad.
+type bisectSession struct {
+	// Source is the batch or journal the packages come from.
+	Source   string          `json:"source"`
+	Packages []bisectPackage `json:"packages"`
+	Good     int             `json:"good"`
+	Bad      int             `json:"bad"`
+	// Skipped are the steps that couldn't be tested, by number of packages
+	// applied.
+	Skipped []int `json:"skipped"`
+}
+
+type bisectPackage struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Release int    `json:"release"`
+	// Old is the release that the package replaced, if known.
+	Old *push.PlanVersion `json:"old,omitempty"`
+}
+
+func init() {
+	cmdBisect.PersistentFlags().StringVar(&bisectSessionPath, "session", ".autobuild-bisect.json", "file holding the state of the bisection")
+	cmdBisectStart.Flags().String("batch", "", "batch ID of the push in the history to bisect (default the latest push)")
+	cmdBisectStart.Flags().String("from-journal", "", "bisect the packages recorded in this push journal instead")
+	cmdBisectStart.MarkFlagsMutuallyExclusive("batch", "from-journal")
+	// The flags of the command are its own.
+	cmdBisectRun.Flags().SetInterspersed(false)
+	cmdBisectList.Flags().Bool("revert", false, "list the packages to keep at their old release instead")
+	cmdBisect.AddCommand(cmdBisectStart, cmdBisectGood, cmdBisectBad, cmdBisectSkip, cmdBisectList, cmdBisectRun, cmdBisectReset)
+}
+
+// next returns the number of packages to apply for the next step, or false
+// if the culprit is found, or every remaining step was skipped. It picks the
+// untested step closest to the middle.
+func (s *bisectSession) next() (int, bool) {
+	mid := (s.Good + s.Bad) / 2
+	for offset := 0; offset < s.Bad-s.Good; offset++ {
+		for _, step := range []int{mid - offset, mid + offset} {
+			if step > s.Good && step < s.Bad && !slices.Contains(s.Skipped, step) {
+				return step, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// mark records the outcome of testing with the first `step` packages applied.
+func (s *bisectSession) mark(step int, mark bisectMark) {
+	switch mark {
+	case bisectGood:
+		s.Good = step
+	case bisectBad:
+		s.Bad = step
+	default:
+		s.Skipped = append(s.Skipped, step)
+	}
+}
+
+func loadBisect() (session bisectSession) {
+	raw, err := os.ReadFile(bisectSessionPath)
+	if errors.Is(err, os.ErrNotExist) {
+		waterlog.Fatalln("Not bisecting, start with `autobuild bisect-rebuild start`")
+	} else if err != nil {
+		waterlog.Fatalf("Failed to read bisect session %s: %s\n", bisectSessionPath, err)
+	}
+	if err = json.Unmarshal(raw, &session); err != nil {
+		waterlog.Fatalf("Failed to parse bisect session %s: %s\n", bisectSessionPath, err)
+	}
+	return
+}
+
+func saveBisect(session bisectSession) {
+	raw, err := json.MarshalIndent(session, "", "  ")
+	if err == nil {
+		err = os.WriteFile(bisectSessionPath, append(raw, '\n'), 0644)
+	}
+	if err != nil {
+		waterlog.Fatalf("Failed to write bisect session %s: %s\n", bisectSessionPath, err)
+	}
+}
+
+func runBisectStart(cmd *cobra.Command, args []string) {
+	batch, _ := cmd.Flags().GetString("batch")
+	journalPath, _ := cmd.Flags().GetString("from-journal")
+	if _, err := os.Stat(bisectSessionPath); err == nil {
+		waterlog.Fatalf("Already bisecting, see %s, or stop with `autobuild bisect-rebuild reset`\n", bisectSessionPath)
+	}
+
+	var session bisectSession
+	if journalPath != "" {
+		entries, err := push.ReadJournal(journalPath)
+		if err != nil {
+			waterlog.Fatalf("Failed to read journal: %s\n", err)
+		}
+		session.Source = journalPath
+		for _, entry := range entries {
+			// Retried jobs are recorded again.
+			if slices.ContainsFunc(session.Packages, func(pkg bisectPackage) bool { return pkg.Name == entry.Package }) {
+				continue
+			}
+			session.Packages = append(session.Packages, bisectPackage{Name: entry.Package, Version: entry.Version, Release: entry.Release})
+		}
+	} else {
+		path, err := push.HistoryPath()
+		if err != nil {
+			waterlog.Fatalf("Failed to find the history: %s\n", err)
+		}
+		records, err := push.LoadHistory(path)
+		if err != nil {
+			waterlog.Fatalf("Failed to load the history: %s\n", err)
+		}
+		idx := slices.IndexFunc(records, func(record push.HistoryRecord) bool { return record.Batch == batch })
+		if batch == "" {
+			idx = len(records) - 1
+		}
+		if idx < 0 {
+			waterlog.Fatalf("No push of batch %s in the history\n", batch)
+		}
+		record := records[idx]
+		session.Source = record.Batch
+		for _, pkg := range record.Packages {
+			// Packages that were never published can't be the culprit.
+			if !slices.ContainsFunc(pkg.Jobs, func(job push.HistoryJob) bool { return job.ID != 0 }) {
+				continue
+			}
+			session.Packages = append(session.Packages, bisectPackage{Name: pkg.Name, Version: pkg.Version, Release: pkg.Release, Old: pkg.Old})
+		}
+	}
+	if len(session.Packages) == 0 {
+		waterlog.Fatalf("No packages were published by %s\n", session.Source)
+	}
+
+	session.Bad = len(session.Packages)
+	saveBisect(session)
+	waterlog.Goodf("Bisecting the %d packages published by %s\n", len(session.Packages), session.Source)
+	printBisectStep(session)
+}
+
+func markBisect(mark bisectMark) {
+	session := loadBisect()
+	step, ok := session.next()
+	if !ok {
+		printBisectStep(session)
+		return
+	}
+	session.mark(step, mark)
+	saveBisect(session)
+	printBisectStep(session)
+}
+
+func runBisectStatus(cmd *cobra.Command, args []string) {
+	printBisectStep(loadBisect())
+}
+
+// printBisectStep prints what to test next, or the culprit once it is found.
+func printBisectStep(session bisectSession) {
+	step, ok := session.next()
+	if ok {
+		left := session.Bad - session.Good
+		waterlog.Infof("%d candidates left, about %d step(s)\n", left, bits.Len(uint(left-1)))
+		last := session.Packages[step-1]
+		waterlog.Infof("Test with the new releases of the first %d of %d packages, up to %s %s-%d, and the old releases of the others\n", step, len(session.Packages), last.Name, last.Version, last.Release)
+		waterlog.Infoln("List them with `autobuild bisect-rebuild list`, then mark the step with `autobuild bisect-rebuild good` or `bad`")
+		return
+	}
+
+	if session.Bad-session.Good == 1 {
+		culprit := session.Packages[session.Bad-1]
+		waterlog.Goodf("The regression was introduced by %s %s-%d\n", culprit.Name, culprit.Version, culprit.Release)
+		return
+	}
+	var candidates []string
+	for _, pkg := range session.Packages[session.Good:session.Bad] {
+		candidates = append(candidates, pkg.Name)
+	}
+	waterlog.Warnf("Every step left was skipped, the regression was introduced by one of: %s\n", strings.Join(candidates, " "))
+}
+
+// bisectSplit returns the packages applied and reverted at the current step.
+func bisectSplit(session bisectSession) (apply []bisectPackage, revert []bisectPackage) {
+	step, ok := session.next()
+	if !ok {
+		waterlog.Fatalln("Bisecting is done, see `autobuild bisect-rebuild`")
+	}
+	return session.Packages[:step], session.Packages[step:]
+}
+
+func runBisectList(cmd *cobra.Command, args []string) {
+	apply, revert := bisectSplit(loadBisect())
+	if reverted, _ := cmd.Flags().GetBool("revert"); reverted {
+		apply = revert
+	}
+	for _, pkg := range apply {
+		fmt.Println(pkg.Name)
+	}
+}
+
+func runBisectRun(cmd *cobra.Command, args []string) {
+	dir, err := os.MkdirTemp("", "autobuild-bisect-")
+	if err != nil {
+		waterlog.Fatalf("Failed to create temporary directory: %s\n", err)
+	}
+	defer os.RemoveAll(dir)
+	applyPath, revertPath := filepath.Join(dir, "apply"), filepath.Join(dir, "revert")
+
+	session := loadBisect()
+	for {
+		step, ok := session.next()
+		if !ok {
+			break
+		}
+		apply, revert := bisectSplit(session)
+		var applyList, revertList strings.Builder
+		for _, pkg := range apply {
+			fmt.Fprintf(&applyList, "%s %s-%d\n", pkg.Name, pkg.Version, pkg.Release)
+		}
+		for _, pkg := range revert {
+			if pkg.Old != nil {
+				fmt.Fprintf(&revertList, "%s %s-%d\n", pkg.Name, pkg.Old.Version, pkg.Old.Release)
+			} else {
+				fmt.Fprintln(&revertList, pkg.Name)
+			}
+		}
+		if err = os.WriteFile(applyPath, []byte(applyList.String()), 0644); err == nil {
+			err = os.WriteFile(revertPath, []byte(revertList.String()), 0644)
+		}
+		if err != nil {
+			waterlog.Fatalf("Failed to write package lists: %s\n", err)
+		}
+
+		waterlog.Infof("Testing with the first %d of %d packages\n", step, len(session.Packages))
+		test := exec.Command(args[0], args[1:]...)
+		test.Stdin, test.Stdout, test.Stderr = os.Stdin, os.Stdout, os.Stderr
+		test.Env = append(os.Environ(), "AUTOBUILD_BISECT_APPLY="+applyPath, "AUTOBUILD_BISECT_REVERT="+revertPath)
+		err = test.Run()
+
+		var exitErr *exec.ExitError
+		code := 0
+		if errors.As(err, &exitErr) {
+			code = exitErr.ExitCode()
+		} else if err != nil {
+			waterlog.Fatalf("Failed to run %s: %s\n", args[0], err)
+		}
+		switch {
+		case code == 0:
+			session.mark(step, bisectGood)
+			waterlog.Goodln("Good")
+		case code == 125:
+			session.mark(step, bisectSkip)
+			waterlog.Warnln("Skipped")
+		case code > 0 && code < 128:
+			session.mark(step, bisectBad)
+			waterlog.Errorln("Bad")
+		default:
+			saveBisect(session)
+			waterlog.Fatalf("%s exited with %d, stopping\n", args[0], code)
+		}
+		saveBisect(session)
+	}
+	printBisectStep(session)
+}
+
+func runBisectReset(cmd *cobra.Command, args []string) {
+	if err := os.Remove(bisectSessionPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		waterlog.Fatalf("Failed to remove bisect session %s: %s\n", bisectSessionPath, err)
+	}
+	waterlog.Goodln("Stopped bisecting")
+}
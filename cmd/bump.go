@@ -0,0 +1,123 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package cmd
+
+import (
+	"path/filepath"
+	"slices"
+
+	"github.com/DataDrake/waterlog"
+	st "github.com/GZGavinZhao/autobuild/state"
+	"github.com/GZGavinZhao/autobuild/ypkg"
+	"github.com/spf13/cobra"
+)
+
+var (
+	bumpFromFile  string
+	bumpSince     string
+	bumpCommit    bool
+	bumpReason    string
+	bumpChangelog string
+	bumpDryRun    bool
+	cmdBump       = &cobra.Command{
+		Use:   "bump [src:path] [packages]",
+		Short: "Increment the release number of the given packages",
+		Long: `Increment the release number in the package.yml of the given packages, for example
+to rebuild them: autobuild bump src:../packages glib gtk3 --commit
+
+Packages can also be read from a file with --from-file, one per line, with #
+comments, and --since adds the packages whose recipe changed since the given
+source state without a new release. --commit creates a git commit per package,
+with --changelog as the body of its message.`,
+		Run:               runBump,
+		ValidArgsFunction: completePackages,
+		Args:              cobra.MinimumNArgs(1),
+	}
+)
+
+func init() {
+	cmdBump.Flags().StringVar(&bumpFromFile, "from-file", "", "read the packages from the given file, one per line")
+	cmdBump.Flags().StringVar(&bumpSince, "since", "", "also bump the packages whose recipe changed since this source state without a new release")
+	cmdBump.Flags().BoolVar(&bumpCommit, "commit", false, "create a git commit per package")
+	cmdBump.Flags().StringVar(&bumpReason, "reason", "a rebuild", "why the packages are bumped, for the commit messages")
+	cmdBump.Flags().StringVar(&bumpChangelog, "changelog", "", "changelog entry to add to the commit messages")
+	cmdBump.Flags().BoolVarP(&bumpDryRun, "dry-run", "n", false, "only print the packages that would be bumped")
+}
+
+func runBump(cmd *cobra.Command, args []string) {
+	tpath := args[0]
+	names := args[1:]
+
+	if bumpChangelog != "" && !bumpCommit {
+		waterlog.Fatalln("--changelog only goes into commits, pass --commit too")
+	}
+
+	if bumpFromFile != "" {
+		fromFile, err := readPatterns(bumpFromFile)
+		if err != nil {
+			waterlog.Fatalf("Failed to read packages from %s: %s\n", bumpFromFile, err)
+		}
+		names = append(names, fromFile...)
+	}
+	if len(names) == 0 && bumpSince == "" {
+		waterlog.Fatalln("No packages given, pass them as arguments, with --from-file or with --since")
+	}
+
+	state, err := st.LoadState(tpath)
+	if err != nil {
+		waterlog.Fatalf("Failed to parse state: %s\n", err)
+	}
+	if _, ok := state.(*st.SourceState); !ok {
+		waterlog.Fatalf("Can only bump packages of source states, not %s\n", tpath)
+	}
+
+	bumps := packageIdxs(state, names)
+
+	if bumpSince != "" {
+		oldState, err := st.LoadState(bumpSince)
+		if err != nil {
+			waterlog.Fatalf("Failed to parse state %s: %s\n", bumpSince, err)
+		}
+		unbumped, err := st.Unbumped(&oldState, &state, nil)
+		if err != nil {
+			waterlog.Fatalf("Failed to find unbumped packages: %s\n", err)
+		}
+		for _, diff := range unbumped {
+			bumps = append(bumps, diff.Idx)
+		}
+	}
+	slices.Sort(bumps)
+	bumps = slices.Compact(bumps)
+
+	var errs errorSummary
+	bumpPackages(state, bumps, bumpCommit, bumpReason, bumpChangelog, bumpDryRun, &errs)
+	errs.exit()
+}
+
+// bumpPackages bumps the packages of `state` at `idxs`, which must be a source
+// state, and commits each of them if `commit` is set, see bumpRecipe. Packages
+// that fail to be bumped are added to `errs`, and the others are still bumped.
+func bumpPackages(state st.State, idxs []int, commit bool, reason string, changelog string, dryRun bool, errs *errorSummary) {
+	for _, idx := range idxs {
+		pkg := state.Packages()[idx]
+		if dryRun {
+			waterlog.Infof("Would bump %s to release %d\n", pkg.Name, pkg.Release+1)
+			continue
+		}
+
+		var release int
+		var err error
+		if commit {
+			release, err = bumpRecipe(pkg, reason, changelog)
+		} else {
+			release, err = ypkg.BumpRelease(filepath.Join(pkg.Path, "package.yml"))
+		}
+		if err != nil {
+			errs.add(exitFailure, "Failed to bump %s: %s\n", pkg.Name, err)
+			continue
+		}
+		waterlog.Goodf("Bumped %s to release %d\n", pkg.Name, release)
+	}
+}
@@ -0,0 +1,189 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package cmd
+
+import (
+	"cmp"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/DataDrake/waterlog"
+	"github.com/GZGavinZhao/autobuild/common"
+	st "github.com/GZGavinZhao/autobuild/state"
+	"github.com/GZGavinZhao/autobuild/utils"
+	"github.com/spf13/cobra"
+)
+
+var (
+	changelogOutput string
+	changelogTitle  string
+	cmdChangelog    = &cobra.Command{
+		Use:   "changelog <[src|bin|repo]:path-to-old> <[src|bin|repo]:path-to-new>",
+		Short: "Aggregate the history of the bumped packages into release notes",
+		Long: `Collect the history entries of the packages bumped between two states, and
+write them as one Markdown document, grouped by component and in chronological
+order, e.g. for sync announcements. For example:
+autobuild changelog repo:shannon repo:unstable -o notes.md`,
+		Run:  runChangelog,
+		Args: defaultStatesArgs(2),
+	}
+)
+
+// changelogEntry is an update of a package in the release notes.
+type changelogEntry struct {
+	pkg    common.Package
+	update common.Update
+	isNew  bool
+}
+
+// uncategorized is the heading of the packages without a component.
+const uncategorized = "Uncategorized"
+
+func init() {
+	cmdChangelog.Flags().StringVarP(&changelogOutput, "output", "o", "", "write the release notes to the given file instead of stdout")
+	cmdChangelog.Flags().StringVar(&changelogTitle, "title", "", "title of the release notes (default derived from the states)")
+	filterFlags(cmdChangelog)
+	commitFlags(cmdChangelog)
+}
+
+func runChangelog(cmd *cobra.Command, args []string) {
+	args = defaultStates(cmd, args)
+	// Keep stdout clean for the release notes themselves.
+	if changelogOutput == "" {
+		setLogOutput(os.Stderr)
+	}
+	filter := getFilter(cmd)
+
+	oldState, err := st.LoadState(args[0])
+	if err != nil {
+		waterlog.Fatalf("Failed to load old state %s: %s\n", args[0], err)
+	}
+	newState, err := st.LoadState(args[1])
+	if err != nil {
+		waterlog.Fatalf("Failed to load new state %s: %s\n", args[1], err)
+	}
+	waterlog.Goodln("Successfully parsed states!")
+
+	components := make(map[string][]changelogEntry)
+	var removed []string
+	updated, security := 0, 0
+	for _, diff := range st.Changed(&oldState, &newState) {
+		if diff.IsRemoved() {
+			if pkg := oldState.Packages()[diff.OldIdx]; filter.match(pkg) {
+				removed = append(removed, pkg.Name)
+			}
+			continue
+		}
+		pkg := newState.Packages()[diff.Idx]
+		if !diff.Kind().Bumped() || !filter.match(pkg) {
+			continue
+		}
+
+		changes := pkg.Changes(diff.OldRelNum)
+		if len(changes) == 0 {
+			waterlog.Warnf("%s was bumped without a history entry\n", pkg.Name)
+			changes = []common.Update{{Release: pkg.Release, Version: pkg.Version}}
+		}
+		component := pkg.Component
+		if component == "" {
+			component = uncategorized
+		}
+		for _, update := range changes {
+			components[component] = append(components[component], changelogEntry{pkg: pkg, update: update, isNew: diff.IsNew()})
+		}
+		updated++
+		if slices.ContainsFunc(changes, func(u common.Update) bool { return u.Type == "security" }) {
+			security++
+		}
+	}
+
+	title := changelogTitle
+	if title == "" {
+		title = fmt.Sprintf("Changes from %s to %s", args[0], args[1])
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s\n\n", title)
+	fmt.Fprintf(&b, "Updated packages: %d (%d with security fixes). Removed packages: %d.\n", updated, security, len(removed))
+
+	for _, component := range utils.SortedKeys(components) {
+		entries := components[component]
+		// Entries without a date come last.
+		slices.SortStableFunc(entries, func(a, b changelogEntry) int {
+			if (a.update.Date == "") != (b.update.Date == "") {
+				return strings.Compare(b.update.Date, a.update.Date)
+			}
+			if c := strings.Compare(a.update.Date, b.update.Date); c != 0 {
+				return c
+			}
+			if c := strings.Compare(a.pkg.Name, b.pkg.Name); c != 0 {
+				return c
+			}
+			return cmp.Compare(a.update.Release, b.update.Release)
+		})
+
+		fmt.Fprintf(&b, "\n## %s\n\n", component)
+		for _, entry := range entries {
+			writeChangelogEntry(&b, entry)
+		}
+	}
+
+	if len(removed) != 0 {
+		slices.Sort(removed)
+		b.WriteString("\n## Removed\n\n")
+		for _, name := range removed {
+			fmt.Fprintf(&b, "- **%s**\n", name)
+		}
+	}
+
+	var w io.Writer = os.Stdout
+	if changelogOutput != "" {
+		f, err := os.Create(changelogOutput)
+		if err != nil {
+			waterlog.Fatalf("Failed to create %s: %s\n", changelogOutput, err)
+		}
+		defer f.Close()
+		w = f
+	}
+	if _, err = io.WriteString(w, b.String()); err != nil {
+		waterlog.Fatalf("Failed to write release notes: %s\n", err)
+	}
+	waterlog.Goodf("Wrote the release notes of %d packages\n", updated)
+}
+
+// writeChangelogEntry writes `entry` as a Markdown list item. The first line
+// of its comment follows the package, and the others are indented below.
+func writeChangelogEntry(b *strings.Builder, entry changelogEntry) {
+	update := entry.update
+	if update.Date != "" {
+		fmt.Fprintf(b, "- %s **%s** %s-%d", update.Date, entry.pkg.Name, update.Version, update.Release)
+	} else {
+		fmt.Fprintf(b, "- **%s** %s-%d", entry.pkg.Name, update.Version, update.Release)
+	}
+
+	var tags []string
+	if entry.isNew {
+		tags = append(tags, "new")
+	}
+	if update.Type == "security" {
+		tags = append(tags, "security")
+	}
+	if len(tags) != 0 {
+		fmt.Fprintf(b, " (%s)", strings.Join(tags, ", "))
+	}
+
+	lines := strings.Split(strings.TrimSpace(update.Comment), "\n")
+	if lines[0] != "" {
+		fmt.Fprintf(b, ": %s", strings.TrimSpace(lines[0]))
+	}
+	b.WriteString("\n")
+	for _, line := range lines[1:] {
+		if line = strings.TrimSpace(line); line != "" {
+			fmt.Fprintf(b, "  %s\n", line)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package cmd
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/DataDrake/waterlog"
+	"github.com/GZGavinZhao/autobuild/state"
+	"github.com/spf13/cobra"
+)
+
+// sameChecks are the checks of packages that kept their release number, see
+// state.SameCheck.
+type sameChecks struct {
+	enabled []string
+	// forced are the checks whose failures don't fail the push.
+	forced []string
+}
+
+// checkFlags adds the flags of sameChecks to `cmd`.
+func checkFlags(cmd *cobra.Command) {
+	cmd.Flags().StringSlice("check", state.SameCheckNames(), fmt.Sprintf("checks of packages with the same release number, among %q", state.SameCheckNames()))
+	cmd.Flags().StringSlice("force-check", nil, "report failures of these checks without failing")
+}
+
+func getChecks(cmd *cobra.Command) (c sameChecks) {
+	c.enabled, _ = cmd.Flags().GetStringSlice("check")
+	c.forced, _ = cmd.Flags().GetStringSlice("force-check")
+	for _, name := range append(slices.Clone(c.enabled), c.forced...) {
+		if !slices.Contains(state.SameCheckNames(), name) {
+			waterlog.Fatalf("Unknown check %s\n", name)
+		}
+	}
+	return
+}
+
+// isForced reports whether all the `failed` checks are forced.
+func (c sameChecks) isForced(failed []string) bool {
+	return !slices.ContainsFunc(failed, func(name string) bool { return !slices.Contains(c.forced, name) })
+}
@@ -0,0 +1,95 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"slices"
+
+	"github.com/DataDrake/waterlog"
+	"github.com/GZGavinZhao/autobuild/push"
+	"github.com/spf13/cobra"
+)
+
+var (
+	ciProvider string
+	ciBuild    string
+	ciPerWave  bool
+	ciOutput   string
+	ciForce    bool
+	cmdCI      = &cobra.Command{
+		Use:   "ci <[src|bin|repo]:path-to-old> <[src|bin|repo]:path-to-new>",
+		Short: "Write a CI pipeline that builds the changed packages",
+		Long: `Write a workflow of GitHub Actions, or a pipeline of GitLab CI, that builds the
+changed packages in build order, for distributions without a build server. For
+example, as a child pipeline of GitLab:
+autobuild ci src:old src:new --provider gitlab -o autobuild.yml
+
+Every package is built by its own job, which needs the jobs of the packages it
+depends on, or with --per-wave, every wave is built by a matrix job, which needs
+the wave before. The jobs call the reusable workflow of --build with the package
+as its inputs on GitHub, and extend the .autobuild-build job of the --build file
+with the package in AUTOBUILD_* variables on GitLab.`,
+		Run:  runCI,
+		Args: defaultStatesArgs(2),
+	}
+)
+
+func init() {
+	cmdCI.Flags().StringVar(&ciProvider, "provider", "github", fmt.Sprintf("CI service to write the pipeline for, one of %q", push.CIProviders))
+	cmdCI.Flags().StringVar(&ciBuild, "build", "", fmt.Sprintf("reusable workflow that builds a package on GitHub (default %s), or file defining %s on GitLab (default %s)", push.DefaultGitHubBuild, push.GitLabBuildJob, push.DefaultGitLabBuild))
+	cmdCI.Flags().BoolVar(&ciPerWave, "per-wave", false, "build every wave in one matrix job instead of every package in its own job")
+	cmdCI.Flags().StringVarP(&ciOutput, "output", "o", "", "write the pipeline to the given file instead of stdout")
+	cmdCI.Flags().BoolVarP(&ciForce, "force", "f", false, "whether to ignore safety checks")
+	filterFlags(cmdCI)
+	commitFlags(cmdCI)
+	downgradeFlags(cmdCI)
+	checkFlags(cmdCI)
+	pinFlag(cmdCI)
+}
+
+func runCI(cmd *cobra.Command, args []string) {
+	// Keep stdout clean for the pipeline itself.
+	if ciOutput == "" {
+		setLogOutput(os.Stderr)
+	}
+	if !slices.Contains(push.CIProviders, ciProvider) {
+		waterlog.Fatalf("Unknown provider %s, use one of %q\n", ciProvider, push.CIProviders)
+	}
+	args = defaultStates(cmd, args)
+
+	opts := diffOptions{filter: getFilter(cmd), downgrades: getDowngradePolicy(cmd), checks: getChecks(cmd), pins: getPins(cmd)}
+	order, ok := changedOrder(args[0], args[1], ciForce, opts)
+	if !ok {
+		return
+	}
+
+	pipeline := push.CIPipeline{
+		Provider: ciProvider,
+		Build:    ciBuild,
+		Packages: order.packages,
+		Deps:     order.deps,
+		PerWave:  ciPerWave,
+		Comment:  fmt.Sprintf("Generated by autobuild %s from %s and %s, regenerate it instead of editing it.", Version, args[0], args[1]),
+	}
+
+	var w io.Writer = os.Stdout
+	if ciOutput != "" {
+		f, err := os.Create(ciOutput)
+		if err != nil {
+			waterlog.Fatalf("Failed to create %s: %s\n", ciOutput, err)
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := pipeline.Write(w); err != nil {
+		waterlog.Fatalf("Failed to write the pipeline: %s\n", err)
+	}
+	if ciOutput != "" {
+		waterlog.Goodf("Wrote the pipeline to build %d package(s) to %s\n", len(order.packages), ciOutput)
+	}
+}
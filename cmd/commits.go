@@ -0,0 +1,95 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package cmd
+
+import (
+	"strings"
+
+	"github.com/DataDrake/waterlog"
+	st "github.com/GZGavinZhao/autobuild/state"
+	"github.com/spf13/cobra"
+)
+
+// commitFlags adds --since and --commits to `cmd`, which take the old and new
+// states from the git history of a source tree instead, see commitStates.
+func commitFlags(cmd *cobra.Command) {
+	cmd.Flags().String("since", "", "compare the source tree with its recipes at this git revision, instead of with an old state")
+	cmd.Flags().String("commits", "", "compare the recipes of the source tree between the ends of this git range, like main..topic, or main...topic from their merge base")
+	cmd.MarkFlagsMutuallyExclusive("since", "commits")
+}
+
+// commitRange returns the value of --since or --commits, and whether it is a
+// range, if `cmd` has them and one is given.
+func commitRange(cmd *cobra.Command) (rev string, isRange bool) {
+	if cmd.Flags().Lookup("commits") == nil {
+		return "", false
+	}
+	if rev, _ = cmd.Flags().GetString("commits"); rev != "" {
+		return rev, true
+	}
+	rev, _ = cmd.Flags().GetString("since")
+	return rev, false
+}
+
+// commitStates returns the TPaths of the old and new states of --since or
+// --commits, in the source tree of `args`, or of defaults.new if it is a
+// source tree, or else the current directory. The states are the tree at git
+// revisions, see state.LoadSourceAt, except that the revision that HEAD is at
+// is the tree itself, so that its packages can be pushed.
+func commitStates(cmd *cobra.Command, args []string) []string {
+	rev, isRange := commitRange(cmd)
+	tpath := "src:."
+	if len(args) != 0 {
+		tpath = args[0]
+	} else if userConfig, err := loadConfig(); err == nil && strings.HasPrefix(userConfig.Defaults.New, "src:") {
+		tpath = userConfig.Defaults.New
+	}
+	kind, dir, _ := strings.Cut(tpath, ":")
+	if kind != "src" {
+		waterlog.Fatalf("--since and --commits compare revisions of a source tree, not %s\n", tpath)
+	}
+	if !isRange {
+		return []string{tpath + "@" + rev, tpath}
+	}
+
+	from, to, ok := strings.Cut(rev, "..")
+	threeDots := strings.HasPrefix(to, ".")
+	to = strings.TrimPrefix(to, ".")
+	if !ok || from == "" {
+		waterlog.Fatalf("Invalid --commits %s, expected a range like main..topic or main...topic\n", rev)
+	}
+	if to == "" {
+		to = "HEAD"
+	}
+	if threeDots {
+		base, err := st.MergeBase(dir, from, to)
+		if err != nil {
+			waterlog.Fatalf("Failed to find where %s and %s diverged: %s\n", from, to, err)
+		}
+		from = base
+	}
+
+	head, err := st.ResolveRevision(dir, "HEAD")
+	if err != nil {
+		waterlog.Fatalf("Failed to resolve HEAD: %s\n", err)
+	}
+	end, err := st.ResolveRevision(dir, to)
+	if err != nil {
+		waterlog.Fatalf("Invalid --commits %s: %s\n", rev, err)
+	}
+	if end == head {
+		return []string{tpath + "@" + from, tpath}
+	}
+	return []string{tpath + "@" + from, tpath + "@" + to}
+}
+
+// checkoutOnly exits if `tpath` is a source tree at a git revision, which
+// can't be published since it isn't checked out.
+func checkoutOnly(tpath string) {
+	kind, dir, _ := strings.Cut(tpath, ":")
+	if _, rev, ok := st.SplitRevision(dir); kind == "src" && ok {
+		waterlog.Fatalf("Packages are only published from the checkout, check out %s instead of pushing %s\n", rev, tpath)
+	}
+}
@@ -4,11 +4,25 @@
 
 package cmd
 
-import "github.com/spf13/cobra"
+import (
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/DataDrake/waterlog"
+	"github.com/GZGavinZhao/autobuild/config"
+	"github.com/GZGavinZhao/autobuild/push"
+	st "github.com/GZGavinZhao/autobuild/state"
+	"github.com/GZGavinZhao/autobuild/utils"
+	"github.com/spf13/cobra"
+)
 
 var (
 	quiet       bool
-	verbose     bool
+	verbose     int
+	profile     string
 	sourcesPath string
 	indexPath   string
 )
@@ -19,3 +33,111 @@ func pathsInit(cmd *cobra.Command) {
 	cmd.Flags().StringVarP(&indexPath, "index", "i", "", "path to the eopkg binary index to compare against")
 	cmd.MarkFlagRequired("index")
 }
+
+// packageIdxs returns the indices of the packages called `names` in `state`,
+// see st.GetPackage. It exits if any are unknown, after reporting all of them.
+func packageIdxs(state st.State, names []string) (idxs []int) {
+	var unknown []string
+	for _, name := range names {
+		if _, idx := st.GetPackage(state, name); idx < 0 {
+			unknown = append(unknown, name)
+		} else {
+			idxs = append(idxs, idx)
+		}
+	}
+	if len(unknown) == 1 {
+		waterlog.Fatalf("Unable to find package %s\n", unknown[0])
+	} else if len(unknown) > 1 {
+		waterlog.Fatalf("Unable to find packages %s\n", strings.Join(unknown, ", "))
+	}
+	return
+}
+
+// tieredOrder computes the tiered build order of the lifted graph. If there is
+// none, it dumps the cycles of the lifted graph and exits.
+func tieredOrder(state st.State, lifted *utils.Subgraph) [][]int {
+	order, ok := utils.TieredTopSort(lifted)
+	if !ok {
+		// Try to dump cycles if topological sort failed.
+		reportCycles(state, lifted)
+		fatalf(exitCycles, "Failed to get topological sort order: lifted graph has cycles!\n")
+	}
+	return order
+}
+
+// resolveBackend returns the push backend to use: `flag` if set, otherwise the
+// configured backend, otherwise the Solus build server.
+func resolveBackend(flag string, cfg config.UserConfig) string {
+	if flag != "" {
+		return flag
+	}
+	if cfg.Push.Backend != "" {
+		return cfg.Push.Backend
+	}
+	return "solus"
+}
+
+// singleBuilder returns the builder of `backend` when publishing to a single
+// build server rather than to targets, whose address $AUTOBUILD_SERVER
+// overrides, and whose API token $AUTOBUILD_TOKEN is.
+func singleBuilder(backend string, cfg config.PushConfig) (push.Builder, error) {
+	selectBackend(backend)
+	return push.NewBuilder(backend, cfg.WithServer(backend, os.Getenv(config.ServerEnv)))
+}
+
+// selectBackend makes $AUTOBUILD_TOKEN the API token of `backend`, and warns
+// if the backend doesn't authenticate with one.
+func selectBackend(backend string) {
+	config.SelectBackend(backend)
+	if os.Getenv(config.TokenAnyEnv) != "" && !slices.Contains(tokenBackends, backend) {
+		waterlog.Warnf("$%s is ignored, the %s backend doesn't authenticate with an API token\n", config.TokenAnyEnv, backend)
+	}
+}
+
+// loadStates loads the old and new states at the same time, and exits if
+// either fails to load. When both are source trees, the recipes they have in
+// common are only parsed once, see st.ParseCache.
+func loadStates(oldTPath string, newTPath string) (oldState st.State, newState st.State) {
+	var cache *st.ParseCache
+	if strings.HasPrefix(oldTPath, "src:") && strings.HasPrefix(newTPath, "src:") {
+		cache = st.NewParseCache()
+	}
+
+	// The phases of both loads would end each other, so they are timed as
+	// one, counting the recipes of both.
+	progress := st.Progress
+	var count atomic.Int64
+	st.Progress.Phase = nil
+	if progress.Parsed != nil {
+		st.Progress.Parsed = func(int) { progress.Parsed(int(count.Add(1))) }
+	}
+	timings.start("loading the old and new states", true)
+
+	var wg sync.WaitGroup
+	var oldErr, newErr error
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		oldState, oldErr = st.LoadStateCached(oldTPath, cache)
+	}()
+	go func() {
+		defer wg.Done()
+		newState, newErr = st.LoadStateCached(newTPath, cache)
+	}()
+	wg.Wait()
+	timings.end()
+	st.Progress = progress
+
+	if oldErr != nil {
+		waterlog.Fatalf("Failed to load old state %s: %s\n", oldTPath, oldErr)
+	}
+	waterlog.Goodln(msg("state.parsed-old", "tpath", oldTPath))
+	if newErr != nil {
+		waterlog.Fatalf("Failed to load new state %s: %s\n", newTPath, newErr)
+	}
+	waterlog.Goodln(msg("state.parsed-new", "tpath", newTPath))
+	if cache != nil {
+		waterlog.Debugf("Reused %d recipes parsed for the other state\n", cache.Hits())
+	}
+	return
+}
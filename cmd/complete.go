@@ -0,0 +1,153 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/GZGavinZhao/autobuild/config"
+	st "github.com/GZGavinZhao/autobuild/state"
+	"github.com/GZGavinZhao/autobuild/utils"
+	"github.com/spf13/cobra"
+)
+
+// completionStateEnv names the environment variable holding the state that
+// package names are completed from when none is given on the command line.
+const completionStateEnv = "AUTOBUILD_COMPLETION_STATE"
+
+// completionTTL is how long the package names of a state stay cached for
+// completion.
+const completionTTL = time.Hour
+
+// nameCache holds the package names of a state, cached for completion.
+type nameCache struct {
+	TPath  string    `json:"tpath"`
+	Loaded time.Time `json:"loaded"`
+	Names  []string  `json:"names"`
+}
+
+// completePackages completes the arguments of commands taking package names
+// with the names of the packages of the state being completed, see
+// completionState. Paths are left to the shell, since recipe directories are
+// accepted as well.
+func completePackages(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if strings.ContainsAny(toComplete, "/:") || strings.HasPrefix(toComplete, ".") {
+		return nil, cobra.ShellCompDirectiveDefault
+	}
+
+	var res []string
+	for _, name := range cachedNames(completionState(args)) {
+		if strings.HasPrefix(name, toComplete) && !slices.Contains(args, name) {
+			res = append(res, name)
+		}
+	}
+	return res, cobra.ShellCompDirectiveNoFileComp
+}
+
+// completePackageList completes flags taking comma-separated package names,
+// like completePackages.
+func completePackageList(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	done, last := "", toComplete
+	if i := strings.LastIndex(toComplete, ","); i >= 0 {
+		done, last = toComplete[:i+1], toComplete[i+1:]
+	}
+	names, directive := completePackages(cmd, append(slices.Clone(args), strings.Split(done, ",")...), last)
+	for i := range names {
+		names[i] = done + names[i]
+	}
+	return names, directive
+}
+
+// completionState returns the state that package names are completed from:
+// the last state given in `args`, or else the one in $AUTOBUILD_COMPLETION_STATE,
+// or else the recipes in the working directory if it is a git tree. It returns
+// an empty string if there is none.
+func completionState(args []string) string {
+	for i := len(args) - 1; i >= 0; i-- {
+		if st.ValidTPath(args[i]) {
+			return args[i]
+		}
+	}
+	if tpath := os.Getenv(completionStateEnv); tpath != "" {
+		return tpath
+	}
+	// Walking an arbitrary directory on every completion is too slow.
+	if utils.PathExists(".git") {
+		return "src:."
+	}
+	return ""
+}
+
+// cachedNames returns the sorted package names of the state at `tpath`. They
+// are cached in the user cache directory, and only loaded again once the cache
+// is older than completionTTL, or than the state itself. Completion must never
+// fail, so errors result in no names.
+func cachedNames(tpath string) []string {
+	if !st.ValidTPath(tpath) {
+		return nil
+	}
+	kind, path, _ := strings.Cut(tpath, ":")
+	if kind != "repo" {
+		if abs, err := filepath.Abs(path); err == nil {
+			path = abs
+		}
+	}
+	tpath = kind + ":" + path
+
+	cachePath := ""
+	if dir, err := config.CacheDir(); err == nil {
+		sum := sha256.Sum256([]byte(tpath))
+		cachePath = filepath.Join(dir, "completion", hex.EncodeToString(sum[:8])+".json")
+	}
+
+	var cache nameCache
+	if raw, err := os.ReadFile(cachePath); err == nil && json.Unmarshal(raw, &cache) == nil && cache.TPath == tpath {
+		if time.Since(cache.Loaded) < completionTTL && !stateModified(kind, path, cache.Loaded) {
+			return cache.Names
+		}
+	}
+
+	// Loading the state must not garble the completions.
+	setLogOutput(io.Discard)
+	state, err := st.LoadState(tpath)
+	if err != nil {
+		return nil
+	}
+	cache = nameCache{TPath: tpath, Loaded: time.Now()}
+	for _, pkg := range state.Packages() {
+		cache.Names = append(cache.Names, pkg.Name)
+	}
+	slices.Sort(cache.Names)
+
+	if cachePath != "" && os.MkdirAll(filepath.Dir(cachePath), 0755) == nil {
+		if raw, err := json.Marshal(cache); err == nil {
+			os.WriteFile(cachePath, raw, 0644)
+		}
+	}
+	return cache.Names
+}
+
+// stateModified reports whether the local state at `path` changed since
+// `since`, as far as cheaply known: for a git tree of recipes, a commit or
+// checkout updates its index.
+func stateModified(kind string, path string, since time.Time) bool {
+	if kind == "repo" {
+		return false
+	}
+	for _, file := range []string{path, filepath.Join(path, ".git", "index")} {
+		if info, err := os.Stat(file); err == nil && info.ModTime().After(since) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,320 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package cmd
+
+import (
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/DataDrake/waterlog"
+	"github.com/GZGavinZhao/autobuild/config"
+	st "github.com/GZGavinZhao/autobuild/state"
+	"github.com/GZGavinZhao/autobuild/utils"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	cmdConfig = &cobra.Command{
+		Use:   "config",
+		Short: "Inspect the configuration of autobuild",
+	}
+	cmdConfigShow = &cobra.Command{
+		Use:   "show",
+		Short: "Print the effective configuration",
+		Long: `Print the configuration that commands run with: the configuration file of
+autobuild, overridden by the .autobuild.yaml of the repository of recipes that
+the working directory is in, and the defaults of the values that neither sets.
+
+Header values and the paths of hook and notification URLs are redacted, and
+API tokens are only listed by where they were found, see login.`,
+		Run:  runConfigShow,
+		Args: cobra.NoArgs,
+	}
+)
+
+// defaultedFlags lists, for the flags whose default can be configured, the
+// commands that it applies to.
+var defaultedFlags = map[string][]string{
+	"force":       {"push", "plan", "tui", "ci"},
+	"dry-run":     {"push"},
+	"exclude":     {"push", "plan", "tui", "diff", "report", "changelog", "sync-check", "outdated", "security-report", "sbom", "ci"},
+	"ignore-file": {"push", "plan", "tui", "diff", "report", "changelog", "sync-check", "outdated", "security-report", "sbom", "ci"},
+	// Only from the environment, see config.JobsEnv.
+	"submit-concurrency": {"push", "apply", "repush", "tui"},
+}
+
+// configReport is the output of config show.
+type configReport struct {
+	Files []string `yaml:"files"`
+	// Profile is the profile selected by --profile.
+	Profile           string `yaml:"profile,omitempty"`
+	config.UserConfig `yaml:",inline"`
+	// Credentials maps the backends to where their API token was found.
+	Credentials map[string]string `yaml:"credentials,omitempty"`
+}
+
+func init() {
+	cmdConfig.AddCommand(cmdConfigShow)
+	cmdConfig.AddCommand(cmdConfigMessages)
+}
+
+// loadConfig loads the configuration of autobuild, with the profile selected by
+// --profile if any.
+func loadConfig() (config.UserConfig, error) {
+	userConfig, err := config.LoadUser()
+	if err != nil || profile == "" {
+		return userConfig, err
+	}
+	return userConfig.WithProfile(profile)
+}
+
+// completeProfiles completes --profile with the names of the configured
+// profiles.
+func completeProfiles(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	userConfig, err := config.LoadUser()
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	var names []string
+	for _, p := range userConfig.Profiles {
+		if strings.HasPrefix(p.Name, toComplete) {
+			names = append(names, p.Name)
+		}
+	}
+	return names, cobra.ShellCompDirectiveNoFileComp
+}
+
+// applyDefaults sets the flags of `cmd` that weren't given on the command line
+// to their configured defaults. A configuration that fails to load is only
+// warned about here, the commands using it fail on their own.
+func applyDefaults(cmd *cobra.Command) {
+	if env := os.Getenv(config.ProfileEnv); env != "" && profile == "" {
+		profile = env
+	}
+	userConfig, err := loadConfig()
+	if err != nil {
+		waterlog.Warnf("Failed to load configuration: %s\n", err)
+		return
+	}
+	setMessages(userConfig.Messages, userConfig.Locales, userLocale(userConfig.Locale))
+	setIndexCache(userConfig.IndexCache)
+
+	defaults := userConfig.Defaults
+	values := make(map[string]string)
+	if defaults.Force != nil {
+		values["force"] = strconv.FormatBool(*defaults.Force)
+	}
+	if defaults.DryRun != nil {
+		values["dry-run"] = strconv.FormatBool(*defaults.DryRun)
+	}
+	if len(defaults.Exclude) != 0 {
+		values["exclude"] = strings.Join(defaults.Exclude, ",")
+	}
+	if defaults.IgnoreFile != "" {
+		values["ignore-file"] = defaults.IgnoreFile
+	}
+	if jobs := os.Getenv(config.JobsEnv); jobs != "" {
+		values["submit-concurrency"] = jobs
+	}
+
+	for _, name := range utils.SortedKeys(values) {
+		value := values[name]
+		flag := cmd.Flags().Lookup(name)
+		if flag == nil || flag.Changed || !slices.Contains(defaultedFlags[name], cmd.Name()) {
+			continue
+		}
+		if err := flag.Value.Set(value); err != nil && name == "submit-concurrency" {
+			waterlog.Fatalf("Invalid $%s: %s\n", config.JobsEnv, err)
+		} else if err != nil {
+			waterlog.Fatalf("Invalid default of --%s in the configuration: %s\n", name, err)
+		}
+	}
+}
+
+// defaultStatesArgs accepts the old and new states as the first two of at most
+// `max` arguments, or no arguments at all if defaults.old and defaults.new are
+// configured, see defaultStates. With --since or --commits, it accepts the
+// source tree instead, if any.
+func defaultStatesArgs(max int) cobra.PositionalArgs {
+	return func(cmd *cobra.Command, args []string) error {
+		if rev, _ := commitRange(cmd); rev != "" {
+			return cobra.MaximumNArgs(1)(cmd, args)
+		}
+		if len(args) != 0 {
+			return cobra.RangeArgs(2, max)(cmd, args)
+		}
+		userConfig, err := loadConfig()
+		if err != nil {
+			return err
+		}
+		if userConfig.Defaults.Old == "" || userConfig.Defaults.New == "" {
+			return errors.New("requires the old and new states, or defaults.old and defaults.new in the configuration")
+		}
+		return nil
+	}
+}
+
+// defaultStates returns `args`, or the configured old and new states if it is
+// empty, or the states of --since or --commits, see commitStates.
+func defaultStates(cmd *cobra.Command, args []string) []string {
+	if rev, _ := commitRange(cmd); rev != "" {
+		return commitStates(cmd, args)
+	}
+	if len(args) != 0 {
+		return args
+	}
+	// Validated by defaultStatesArgs.
+	userConfig, _ := loadConfig()
+	waterlog.Debugf("Comparing the configured states %s and %s\n", userConfig.Defaults.Old, userConfig.Defaults.New)
+	return []string{userConfig.Defaults.Old, userConfig.Defaults.New}
+}
+
+func runConfigShow(cmd *cobra.Command, args []string) {
+	setLogOutput(os.Stderr)
+
+	userConfig, err := loadConfig()
+	if err != nil {
+		waterlog.Fatalf("Failed to load configuration: %s\n", err)
+	}
+
+	report := configReport{Profile: profile}
+	if path, err := config.UserConfigPath(); err == nil && utils.PathExists(path) {
+		report.Files = append(report.Files, path)
+	}
+	if path := config.RepoConfigPath(); path != "" {
+		report.Files = append(report.Files, path)
+	}
+
+	// The defaults of the flags are the effective values when unset.
+	defaults := &userConfig.Defaults
+	if defaults.Force == nil {
+		force, _ := cmdPush.Flags().GetBool("force")
+		defaults.Force = &force
+	}
+	if defaults.DryRun == nil {
+		dryRun, _ := cmdPush.Flags().GetBool("dry-run")
+		defaults.DryRun = &dryRun
+	}
+	if defaults.IgnoreFile == "" {
+		defaults.IgnoreFile = cmdPush.Flags().Lookup("ignore-file").DefValue
+	}
+	userConfig.Push.Backend = resolveBackend("", userConfig)
+	config.SelectBackend(userConfig.Push.Backend)
+	userConfig.Push = userConfig.Push.WithServer(userConfig.Push.Backend, os.Getenv(config.ServerEnv))
+
+	pushConfig := &userConfig.Push
+	for _, headers := range []*map[string]string{&pushConfig.Summit.Headers, &pushConfig.Webhook.Headers, &pushConfig.GitHub.Headers, &pushConfig.GitLab.Headers} {
+		*headers = redactHeaders(*headers)
+	}
+	for i := range pushConfig.Targets {
+		redactTarget(&pushConfig.Targets[i])
+	}
+	for _, hooks := range [][]config.HookConfig{pushConfig.Hooks.PrePublish, pushConfig.Hooks.PostPublish, pushConfig.Hooks.BatchStart, pushConfig.Hooks.BatchEnd, pushConfig.Hooks.WaveEnd} {
+		for i := range hooks {
+			hooks[i].URL = redactURL(hooks[i].URL)
+			hooks[i].Headers = redactHeaders(hooks[i].Headers)
+		}
+	}
+	redactNotify(pushConfig.Notify)
+	for i := range userConfig.Profiles {
+		redactNotify(userConfig.Profiles[i].Notify)
+		redactTarget(&userConfig.Profiles[i].TargetConfig)
+	}
+	report.UserConfig = userConfig
+
+	for _, backend := range tokenBackends {
+		_, source, err := config.LookupToken(backend)
+		if err != nil {
+			waterlog.Warnf("Failed to look up the API token of %s: %s\n", backend, err)
+		} else if source != "" {
+			if report.Credentials == nil {
+				report.Credentials = make(map[string]string)
+			}
+			report.Credentials[backend] = source
+		}
+	}
+
+	enc := yaml.NewEncoder(os.Stdout)
+	enc.SetIndent(2)
+	if err := enc.Encode(report); err != nil {
+		waterlog.Fatalf("Failed to write configuration: %s\n", err)
+	}
+	if err := enc.Close(); err != nil {
+		waterlog.Fatalf("Failed to write configuration: %s\n", err)
+	}
+}
+
+// redactTarget redacts the header values of the build servers of `target`.
+func redactTarget(target *config.TargetConfig) {
+	target.Summit.Headers = redactHeaders(target.Summit.Headers)
+	target.Webhook.Headers = redactHeaders(target.Webhook.Headers)
+	target.GitHub.Headers = redactHeaders(target.GitHub.Headers)
+	target.GitLab.Headers = redactHeaders(target.GitLab.Headers)
+}
+
+// redactNotify redacts the URLs of `rooms`, since the incoming webhook of
+// Slack is a credential.
+func redactNotify(rooms []config.NotifyConfig) {
+	for i := range rooms {
+		rooms[i].URL = redactURL(rooms[i].URL)
+	}
+}
+
+// redactURL returns `rawURL` with its user info, path and query replaced,
+// since they may hold credentials, such as the secret path of an incoming
+// webhook. URLs that don't parse are redacted entirely.
+func redactURL(rawURL string) string {
+	if rawURL == "" {
+		return rawURL
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return "<redacted>"
+	}
+	if u.User == nil && strings.Trim(u.Path, "/") == "" && u.RawQuery == "" && u.Fragment == "" {
+		return rawURL
+	}
+	return u.Scheme + "://" + u.Host + "/<redacted>"
+}
+
+// redactHeaders returns `headers` with their values replaced, since they
+// usually hold credentials.
+func redactHeaders(headers map[string]string) map[string]string {
+	if len(headers) == 0 {
+		return headers
+	}
+	res := make(map[string]string, len(headers))
+	for key := range headers {
+		res[key] = "<redacted>"
+	}
+	return res
+}
+
+// setIndexCache sets up the cache of parsed indexes that `conf` configures.
+func setIndexCache(conf config.IndexCacheConfig) {
+	if conf.MaxSize < 0 {
+		return
+	}
+	dir := conf.Dir
+	if dir == "" {
+		cacheDir, err := config.CacheDir()
+		if err != nil {
+			waterlog.Debugf("Not caching parsed indexes: %s\n", err)
+			return
+		}
+		dir = filepath.Join(cacheDir, "indexes")
+	}
+	size := conf.MaxSize
+	if size == 0 {
+		size = config.DefaultIndexCacheSize
+	}
+	st.IndexCache = &st.BinaryCache{Dir: dir, MaxSize: int64(size) << 20}
+}
@@ -0,0 +1,215 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/DataDrake/waterlog"
+	"github.com/GZGavinZhao/autobuild/common"
+	st "github.com/GZGavinZhao/autobuild/state"
+	"github.com/GZGavinZhao/autobuild/utils"
+	"github.com/yourbasic/graph"
+)
+
+const (
+	liftedDotPath   = "lifted.gv"
+	cyclesDotPath   = "cycles.gv"
+	cyclesJSONPath  = "cycles.json"
+	indirectDepKind = "indirect"
+)
+
+var depKindColors = map[string]string{
+	common.BuildDep.String(): "black",
+	common.CheckDep.String(): "blue",
+	common.RunDep.String():   "darkgreen",
+	indirectDepKind:          "gray",
+}
+
+type cycleReport struct {
+	Cycles []cycleEntry `json:"cycles"`
+}
+
+type cycleEntry struct {
+	Message  string         `json:"message"`
+	Packages []cyclePackage `json:"packages"`
+	Edges    []cycleEdge    `json:"edges"`
+	Chain    []string       `json:"chain"`
+}
+
+type cyclePackage struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Release int    `json:"release"`
+	File    string `json:"file,omitempty"`
+}
+
+type cycleEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	Kind string `json:"kind"`
+}
+
+// edgeKind returns the kind of the dependency that the edge from `v` to `w`
+// in the lifted graph stems from. Lifted edges that do not exist in the
+// dependency graph go through packages that are not part of the selection.
+func edgeKind(depGraph *graph.Immutable, v, w int) string {
+	if c, ok := utils.EdgeCost(depGraph, v, w); ok {
+		return common.DepKind(c).String()
+	}
+	return indirectDepKind
+}
+
+// reportCycles dumps the cycles of the lifted graph to the log. It also writes
+// the lifted graph to `lifted.gv`, only the offending cycles to `cycles.gv`,
+// and a JSON report of the cycles to `cycles.json`, all in the current
+// directory.
+func reportCycles(state st.State, lifted *utils.Subgraph) {
+	depGraph := state.DepGraph()
+	pkg := func(v int) common.Package { return state.Packages()[lifted.Nodes[v]] }
+
+	cycles := graph.StrongComponents(lifted.Immutable)
+	cycles = utils.Filter(cycles, func(cycle []int) bool { return len(cycle) > 1 })
+	if len(cycles) == 0 {
+		waterlog.Fatalln("No cycles detected ?!?")
+	}
+
+	report := cycleReport{}
+	inCycle := make(map[int]int)
+
+	for cycleIdx, cycle := range cycles {
+		entry := cycleEntry{}
+
+		waterlog.Warnf("Cycle %d:", cycleIdx+1)
+		for _, nodeIdx := range cycle {
+			inCycle[nodeIdx] = cycleIdx
+			p := pkg(nodeIdx)
+			waterlog.Printf(" %s", p.Name)
+
+			entry.Packages = append(entry.Packages, cyclePackage{
+				Name:    p.Name,
+				Version: p.Version,
+				Release: p.Release,
+				File:    p.Path,
+			})
+		}
+		waterlog.Println()
+
+		for _, nodeIdx := range cycle {
+			lifted.Visit(nodeIdx, func(adj int, _ int64) (skip bool) {
+				if idx, ok := inCycle[adj]; ok && idx == cycleIdx {
+					edge := cycleEdge{
+						From: pkg(nodeIdx).Name,
+						To:   pkg(adj).Name,
+						Kind: edgeKind(depGraph, lifted.Nodes[nodeIdx], lifted.Nodes[adj]),
+					}
+					utils.Tracef("Cycle %d: %s is needed by %s (%s)\n", cycleIdx+1, edge.From, edge.To, edge.Kind)
+					entry.Edges = append(entry.Edges, edge)
+				}
+				return
+			})
+		}
+
+		// the order in `cycle` may not be deterministic, so we have to
+		// deterministically choose a starting node by ourselves
+		startIdx := 0
+		for idx, nodeIdx := range cycle {
+			if nodeIdx < cycle[startIdx] {
+				startIdx = idx
+			}
+		}
+		nextIdx := (startIdx + 1) % len(cycle)
+
+		// We always want the longer shortest path
+		path1, dist := graph.ShortestPath(lifted.Immutable, cycle[startIdx], cycle[nextIdx])
+		if dist == -1 {
+			waterlog.Errorf("Failed to calculate dependency chain that formed this cycle: unreachable\n")
+		}
+		path2, dist := graph.ShortestPath(lifted.Immutable, cycle[nextIdx], cycle[startIdx])
+		if dist == -1 {
+			waterlog.Errorf("Failed to calculate dependency chain that formed this cycle: unreachable\n")
+		}
+
+		if len(path1) < len(path2) {
+			path1 = path2
+		}
+
+		if len(path1) > 0 {
+			waterlog.Warnln("One of the dependency chains that led to this cycle:")
+			for _, pidx := range path1 {
+				waterlog.Printf("%s -> ", pkg(pidx).Name)
+				entry.Chain = append(entry.Chain, pkg(pidx).Name)
+			}
+			waterlog.Println(pkg(path1[0]).Name)
+			entry.Chain = append(entry.Chain, pkg(path1[0]).Name)
+		}
+
+		entry.Message = fmt.Sprintf("Dependency cycle between %d packages: %s", len(cycle), strings.Join(entry.Chain, " -> "))
+		report.Cycles = append(report.Cycles, entry)
+	}
+
+	nodeAttrs := func(v int) utils.DOTAttrs {
+		return utils.DOTAttrs{
+			"label": fmt.Sprintf("%s\n%s-%d", pkg(v).Name, pkg(v).Version, pkg(v).Release),
+		}
+	}
+
+	all := func(int) bool { return true }
+	if err := writeDOTFile(liftedDotPath, lifted, all, nodeAttrs, nil); err != nil {
+		waterlog.Errorf("Failed to write lifted graph to %s: %s\n", liftedDotPath, err)
+	}
+
+	inAnyCycle := func(v int) bool {
+		_, ok := inCycle[v]
+		return ok
+	}
+	edgeAttrs := func(v, w int, _ int64) utils.DOTAttrs {
+		if inCycle[v] != inCycle[w] {
+			return nil
+		}
+
+		kind := edgeKind(depGraph, lifted.Nodes[v], lifted.Nodes[w])
+		attrs := utils.DOTAttrs{"color": depKindColors[kind], "label": kind}
+		if kind == indirectDepKind {
+			attrs["style"] = "dashed"
+		}
+		return attrs
+	}
+	if err := writeDOTFile(cyclesDotPath, lifted, inAnyCycle, nodeAttrs, edgeAttrs); err != nil {
+		waterlog.Errorf("Failed to write cycles to %s: %s\n", cyclesDotPath, err)
+	}
+
+	if err := writeJSONFile(cyclesJSONPath, report); err != nil {
+		waterlog.Errorf("Failed to write cycle report to %s: %s\n", cyclesJSONPath, err)
+	}
+
+	waterlog.Infof("Cycle artifacts written to %s, %s and %s\n", liftedDotPath, cyclesDotPath, cyclesJSONPath)
+}
+
+func writeDOTFile(path string, g graph.Iterator, include func(int) bool, node func(int) utils.DOTAttrs, edge func(int, int, int64) utils.DOTAttrs) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return utils.WriteDOT(f, g, include, node, edge)
+}
+
+func writeJSONFile(path string, v any) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	return enc.Encode(v)
+}
@@ -0,0 +1,207 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/DataDrake/waterlog"
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+)
+
+// deselectMode is how the packages to update are reviewed before they are
+// ordered, to leave some out without crafting --exclude patterns.
+type deselectMode int
+
+const (
+	// deselectNone keeps all the packages.
+	deselectNone deselectMode = iota
+	// deselectPrompt asks on the terminal which packages to leave out.
+	deselectPrompt
+	// deselectEdit opens the list of packages in the editor of the user,
+	// where the ones to leave out are deleted.
+	deselectEdit
+)
+
+// deselectFlags adds the flags to choose the deselectMode to `cmd`.
+func deselectFlags(cmd *cobra.Command) {
+	cmd.Flags().BoolP("interactive", "i", false, "ask which of the packages to update to leave out before ordering them")
+	cmd.Flags().Bool("edit", false, "open the packages to update in $EDITOR, to leave out the ones whose lines are deleted")
+	cmd.MarkFlagsMutuallyExclusive("interactive", "edit")
+}
+
+func getDeselectMode(cmd *cobra.Command) deselectMode {
+	if interactive, _ := cmd.Flags().GetBool("interactive"); interactive {
+		return deselectPrompt
+	}
+	if edit, _ := cmd.Flags().GetBool("edit"); edit {
+		return deselectEdit
+	}
+	return deselectNone
+}
+
+// deselect returns the names of the packages of `rows` to leave out,
+// according to `mode`.
+func (mode deselectMode) deselect(rows []packageRow) []string {
+	if mode == deselectNone || len(rows) == 0 {
+		return nil
+	}
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		waterlog.Fatalln("--interactive and --edit need a terminal")
+	}
+
+	if mode == deselectPrompt {
+		return promptDeselect(rows)
+	}
+	return editDeselect(rows)
+}
+
+// promptDeselect lists the packages of `rows` by number, and asks for the
+// ones to leave out until the answer is valid.
+func promptDeselect(rows []packageRow) []string {
+	w := tabwriter.NewWriter(os.Stderr, 0, 0, 2, ' ', 0)
+	for idx, row := range rows {
+		old, cur := row.versions()
+		fmt.Fprintf(w, "  %d\t%s\t%s\t→\t%s\n", idx+1, row.Name, old, cur)
+	}
+	w.Flush()
+
+	in := bufio.NewReader(os.Stdin)
+	for {
+		fmt.Fprint(os.Stderr, "Packages to leave out, by number, range or name (e.g. 1 3-5 python-*), or nothing to keep them all: ")
+		answer, err := in.ReadString('\n')
+		if err != nil && (err != io.EOF || answer == "") {
+			waterlog.Fatalln("Stopped before the packages to leave out were chosen")
+		}
+		dropped, err := parseDeselection(rows, answer)
+		if err == nil {
+			return dropped
+		}
+		waterlog.Errorf("%s\n", err)
+	}
+}
+
+// parseDeselection returns the names of the packages of `rows` that `answer`
+// selects, see promptDeselect, in the order of `rows`.
+func parseDeselection(rows []packageRow, answer string) ([]string, error) {
+	selected := make([]bool, len(rows))
+	for _, field := range strings.FieldsFunc(answer, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' || r == '\n' || r == '\r' }) {
+		if first, last, isRange := strings.Cut(field, "-"); isNumber(first) && (!isRange || isNumber(last)) {
+			from, _ := strconv.Atoi(first)
+			to := from
+			if isRange {
+				to, _ = strconv.Atoi(last)
+			}
+			if from < 1 || to > len(rows) || from > to {
+				return nil, fmt.Errorf("No packages numbered %s, they go from 1 to %d", field, len(rows))
+			}
+			for idx := from - 1; idx < to; idx++ {
+				selected[idx] = true
+			}
+			continue
+		}
+
+		if _, err := path.Match(field, ""); err != nil {
+			return nil, fmt.Errorf("Invalid package pattern %q: %s", field, err)
+		}
+		found := false
+		for idx, row := range rows {
+			if matchAny([]string{field}, row.Name) {
+				selected[idx], found = true, true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("No package to update matches %s", field)
+		}
+	}
+
+	var dropped []string
+	for idx, row := range rows {
+		if selected[idx] {
+			dropped = append(dropped, row.Name)
+		}
+	}
+	return dropped, nil
+}
+
+func isNumber(s string) bool {
+	_, err := strconv.Atoi(s)
+	return err == nil
+}
+
+const deselectHelp = `
+# Delete the lines of the packages to leave out of the push, then save and
+# quit. Only the first word of every line matters, and lines starting with #
+# are ignored. Deleting every line leaves nothing to push.
+`
+
+// editDeselect opens the packages of `rows` in the editor of the user, and
+// returns the ones whose lines were deleted.
+func editDeselect(rows []packageRow) []string {
+	f, err := os.CreateTemp("", "autobuild-push-*.txt")
+	if err != nil {
+		waterlog.Fatalf("Failed to create the list of packages to edit: %s\n", err)
+	}
+	defer os.Remove(f.Name())
+
+	w := tabwriter.NewWriter(f, 0, 0, 2, ' ', 0)
+	for _, row := range rows {
+		old, cur := row.versions()
+		fmt.Fprintf(w, "%s\t%s\t→\t%s\n", row.Name, old, cur)
+	}
+	w.Flush()
+	io.WriteString(f, deselectHelp)
+	if err = f.Close(); err != nil {
+		waterlog.Fatalf("Failed to write the list of packages to edit: %s\n", err)
+	}
+
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = "vi"
+	}
+	// Editors are commonly set with arguments, e.g. "code --wait".
+	edit := exec.Command("sh", "-c", editor+` "$1"`, "sh", f.Name())
+	edit.Stdin, edit.Stdout, edit.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err = edit.Run(); err != nil {
+		waterlog.Fatalf("Failed to edit the packages to update with %s: %s\n", editor, err)
+	}
+
+	edited, err := os.ReadFile(f.Name())
+	if err != nil {
+		waterlog.Fatalf("Failed to read the edited packages: %s\n", err)
+	}
+	var names []string
+	for _, line := range strings.Split(string(edited), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if !slices.ContainsFunc(rows, func(row packageRow) bool { return row.Name == fields[0] }) {
+			waterlog.Fatalf("%s isn't one of the packages to update, only delete lines from the list\n", fields[0])
+		}
+		names = append(names, fields[0])
+	}
+
+	var dropped []string
+	for _, row := range rows {
+		if !slices.Contains(names, row.Name) {
+			dropped = append(dropped, row.Name)
+		}
+	}
+	return dropped
+}
@@ -4,52 +4,431 @@
 
 package cmd
 
-// import (
-// 	"github.com/DataDrake/waterlog"
-// 	"github.com/GZGavinZhao/autobuild/state"
-// 	"github.com/spf13/cobra"
-// )
-// 
-// var (
-// 	cmdDiff = &cobra.Command{
-// 		Use:   "diff <[src|bin|repo]:path-to-old> <[src|bin|repo]:path-to-new>",
-// 		Short: "Diff the packages between binary indices or sources or a mix of them",
-// 		Run:   runDiff,
-// 		Args:  cobra.ExactArgs(2),
-// 	}
-// )
-// 
-// func init() {
-// }
-// 
-// func runDiff(cmd *cobra.Command, args []string) {
-// 	oldTPath := args[0]
-// 	newTPath := args[1]
-// 
-// 	var oldState, newState state.State
-// 
-// 	oldState, err := state.LoadState(oldTPath)
-// 	if err != nil {
-// 		waterlog.Fatalf("Failed to load old state %s: %s\n", oldTPath, err)
-// 	}
-// 	waterlog.Goodln("Successfully parsed old state!")
-// 
-// 	newState, err = state.LoadState(newTPath)
-// 	if err != nil {
-// 		waterlog.Fatalf("Failed to load new state %s: %s\n", newTPath, err)
-// 	}
-// 	waterlog.Goodln("Successfully parsed new state!")
-// 
-// 	waterlog.Infoln("Diffing...")
-// 	for _, diff := range state.Changed(&oldState, &newState) {
-// 		name := newState.Packages()[diff.Idx].Name
-// 
-// 		if diff.OldRelNum == 0 {
-// 			waterlog.Infof("New: %s: %s-%d\n", name, diff.Ver, diff.RelNum)
-// 		} else if diff.Ver != diff.OldVer {
-// 			waterlog.Infof("Update: %s: %s-%d -> %s-%d\n", name, diff.OldVer, diff.OldRelNum, diff.Ver, diff.RelNum)
-// 		} else if diff.RelNum > diff.OldRelNum {
-// 			waterlog.Infof("Rebuild/Change: %s: %s-%d -> %s-%d\n", name, diff.OldVer, diff.OldRelNum, diff.Ver, diff.RelNum)
-// 		}
-// 	}
-// }
+import (
+	"cmp"
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/DataDrake/waterlog"
+	"github.com/GZGavinZhao/autobuild/common"
+	"github.com/GZGavinZhao/autobuild/push"
+	"github.com/GZGavinZhao/autobuild/state"
+	"github.com/GZGavinZhao/autobuild/utils"
+	"github.com/spf13/cobra"
+)
+
+var (
+	diffOutput string
+	diffABI    bool
+	diffStream bool
+	diffExit   bool
+	cmdDiff    = &cobra.Command{
+		Use:   "diff <[src|bin|repo]:path-to-old> <[src|bin|repo]:path-to-new> | diff <tpath> <unstable-tpath> <stable-tpath>",
+		Short: "Diff the packages between binary indices or sources or a mix of them",
+		Long: `Diff the packages between binary indices or sources or a mix of them.
+
+Every changed package is classified, and its impact is the number of packages
+that depend on it, directly or not. The "md" format is Markdown, e.g. for
+merge requests.
+
+With three TPaths, usually a source tree and the unstable and stable
+repositories, every package is instead placed in the pipeline: new, not built
+in unstable yet, or built and pending sync to stable.
+
+With --stream, the packages of two binary states are diffed one at a time
+while the indices are read, which takes little memory even for huge
+repositories. Binary packages are then diffed instead of source packages.
+
+Between binary states, --abi also compares the sonames shipped by the bumped
+packages, and reports the packages that depend on removed sonames as needing
+a rebuild.`,
+		Run:  runDiff,
+		Args: defaultStatesArgs(3),
+	}
+)
+
+func init() {
+	formatFlag(cmdDiff, withReports("text", "md", "html")...)
+	cmdDiff.Flags().StringVarP(&diffOutput, "output", "o", "", "write the report to the given file instead of stdout")
+	cmdDiff.Flags().BoolVar(&diffABI, "abi", false, "compare the sonames of bumped packages between binary states, downloading them if needed")
+	cmdDiff.Flags().BoolVar(&diffStream, "stream", false, "diff binary indices while reading them, for huge repositories, writing json as one package per line")
+	cmdDiff.Flags().BoolVar(&diffExit, "exit-code", false, "exit with code 2 if packages differ, like diff(1)")
+	filterFlags(cmdDiff)
+	commitFlags(cmdDiff)
+}
+
+// diffABIChange is the kind of packages that didn't change but need a rebuild
+// for a soname change, on top of the kinds of state.Kind.
+const diffABIChange = "abi"
+
+// diffKinds lists the kinds of changes of a package, in the order they are
+// reported in.
+var diffKinds = func() (kinds []string) {
+	for _, kind := range state.Kinds {
+		kinds = append(kinds, kind.String())
+		if kind == state.KindRebuild {
+			kinds = append(kinds, diffABIChange)
+		}
+	}
+	return
+}()
+
+// diffReport describes the changes between two states, for reviewers.
+type diffReport struct {
+	Old      string        `json:"old"`
+	New      string        `json:"new"`
+	Packages []diffPackage `json:"packages"`
+}
+
+type diffPackage struct {
+	Name string `json:"name"`
+	Kind string `json:"kind"`
+	// Reason describes the change, see state.Diff.Reason.
+	Reason string `json:"reason"`
+	// Old is omitted for new packages, and New for removed ones.
+	Old       *push.PlanVersion `json:"old,omitempty"`
+	New       *push.PlanVersion `json:"new,omitempty"`
+	Component string            `json:"component,omitempty"`
+	// Impact is the number of packages that depend on the package, directly
+	// or not, in the new state, or in the old one for removed packages.
+	Impact int `json:"impact"`
+	// Changelog holds the new entries of the history of the package, for
+	// states with histories.
+	Changelog []common.Update `json:"changelog,omitempty"`
+	// Sonames is set for bumped packages whose sonames changed, with --abi.
+	Sonames *diffSonames `json:"sonames,omitempty"`
+	// Needs lists the packages whose removed sonames an abi package depends
+	// on.
+	Needs []string `json:"needs,omitempty"`
+}
+
+type diffSonames struct {
+	Removed []string `json:"removed"`
+	Added   []string `json:"added"`
+}
+
+// Notes returns what the report knows about the package beyond its kind, for
+// humans.
+func (p diffPackage) Notes() (notes []string) {
+	if p.Sonames != nil && len(p.Sonames.Removed) != 0 {
+		notes = append(notes, "removed sonames: "+strings.Join(p.Sonames.Removed, ", "))
+	}
+	if p.Sonames != nil && len(p.Sonames.Added) != 0 {
+		notes = append(notes, "added sonames: "+strings.Join(p.Sonames.Added, ", "))
+	}
+	if len(p.Needs) != 0 {
+		notes = append(notes, "depends on removed sonames of: "+strings.Join(p.Needs, ", "))
+	}
+	return
+}
+
+// Title returns the description of the kind of change of the package.
+func (p diffPackage) Title() string {
+	if p.Kind == diffABIChange {
+		return "Needs a rebuild for a soname change"
+	}
+	for _, kind := range state.Kinds {
+		if kind.String() == p.Kind {
+			return kind.Title()
+		}
+	}
+	return p.Kind
+}
+
+// impact returns the number of packages that depend on `idx` in `s`.
+func impact(s state.State, idx int) (n int) {
+	depGraph := s.DepGraph()
+	if depGraph == nil {
+		return 0
+	}
+	utils.BFSWithDepth(depGraph, idx, func(int, int) bool {
+		n++
+		return false
+	})
+	return n - 1
+}
+
+func runDiff(cmd *cobra.Command, args []string) {
+	args = defaultStates(cmd, args)
+	oldTPath := args[0]
+	newTPath := args[1]
+	filter := getFilter(cmd)
+
+	format := getFormat(cmd)
+	// Keep stdout clean for the report itself.
+	if diffOutput == "" {
+		setLogOutput(os.Stderr)
+	}
+	if diffStream {
+		if diffABI || len(args) == 3 {
+			waterlog.Fatalln("--stream only works with two binary states, without --abi")
+		}
+		exitIfChanged(runStreamDiff(oldTPath, newTPath, format, filter))
+		return
+	}
+	if len(args) == 3 {
+		if diffABI {
+			waterlog.Fatalln("--abi only works with two states")
+		}
+		exitIfChanged(runPipelineDiff(args, format, filter))
+		return
+	}
+
+	oldState, newState := loadStates(oldTPath, newTPath)
+
+	waterlog.Infoln(msg("diff.diffing"))
+	report, err := newDiffReport(oldState, newState, oldTPath, newTPath, filter)
+	if err != nil {
+		waterlog.Fatalf("Failed to compare recipes: %s\n", err)
+	}
+	if diffABI {
+		report.Packages = addSonameChanges(report.Packages, oldState, newState, state.Changed(&oldState, &newState), filter)
+		sortDiffPackages(report.Packages)
+	}
+
+	w, done := diffWriter()
+
+	switch format {
+	case "json", "yaml":
+		err = writeReport(w, format, "diff", report)
+	case "md":
+		err = writeDiffMarkdown(w, report)
+	case "html":
+		err = diffHTML.Execute(w, report)
+	default:
+		err = writeDiffText(w, report)
+	}
+	if err != nil {
+		waterlog.Fatalf("Failed to write the diff: %s\n", err)
+	}
+	done()
+	exitIfChanged(len(report.Packages))
+}
+
+// exitIfChanged exits with exitChanged if `changed` packages differ and
+// --exit-code is given.
+func exitIfChanged(changed int) {
+	if diffExit && changed != 0 {
+		exit(exitChanged)
+	}
+}
+
+// newDiffReport returns the report of the changes between `oldState` and
+// `newState` of the packages selected by `filter`, sorted by kind and name.
+func newDiffReport(oldState state.State, newState state.State, oldTPath string, newTPath string, filter pushFilter) (report diffReport, err error) {
+	diffs := state.Changed(&oldState, &newState)
+	unbumped, err := state.Unbumped(&oldState, &newState, filter.match)
+	if err != nil {
+		return
+	}
+
+	report = diffReport{Old: oldTPath, New: newTPath, Packages: []diffPackage{}}
+	for _, diff := range append(diffs, unbumped...) {
+		entry := diffPackage{Kind: diff.Kind().String(), Reason: diff.Reason()}
+		if diff.IsRemoved() {
+			pkg := oldState.Packages()[diff.OldIdx]
+			if !filter.match(pkg) {
+				continue
+			}
+			entry.Name, entry.Component = pkg.Name, pkg.Component
+			entry.Impact = impact(oldState, diff.OldIdx)
+		} else {
+			pkg := newState.Packages()[diff.Idx]
+			if !filter.match(pkg) {
+				continue
+			}
+			entry.Name, entry.Component = pkg.Name, pkg.Component
+			entry.New = &push.PlanVersion{Version: diff.Ver, Release: diff.RelNum}
+			entry.Impact = impact(newState, diff.Idx)
+		}
+		if !diff.IsNew() {
+			entry.Old = &push.PlanVersion{Version: diff.OldVer, Release: diff.OldRelNum}
+		}
+		if !diff.IsRemoved() {
+			entry.Changelog = push.Changelog(newState.Packages()[diff.Idx], entry.Old)
+		}
+		report.Packages = append(report.Packages, entry)
+	}
+	sortDiffPackages(report.Packages)
+	return
+}
+
+// sortDiffPackages sorts the packages of a report by kind, then by name.
+func sortDiffPackages(pkgs []diffPackage) {
+	slices.SortFunc(pkgs, func(a, b diffPackage) int {
+		if c := cmp.Compare(slices.Index(diffKinds, a.Kind), slices.Index(diffKinds, b.Kind)); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Name, b.Name)
+	})
+}
+
+// addSonameChanges compares the sonames of the bumped packages of `diffs`
+// selected by `filter`, which must be between binary states, and returns
+// `entries` with their changes, along with an abi entry for every unchanged
+// package that depends on removed sonames.
+func addSonameChanges(entries []diffPackage, oldState state.State, newState state.State, diffs []state.Diff, filter pushFilter) []diffPackage {
+	oldBin, oldOk := oldState.(*state.BinaryState)
+	newBin, newOk := newState.(*state.BinaryState)
+	if !oldOk || !newOk {
+		waterlog.Fatalln("Sonames can only be compared between binary states")
+	}
+
+	waterlog.Infoln("Comparing sonames...")
+	changes, err := state.SonameChanges(oldBin, newBin, slices.DeleteFunc(slices.Clone(diffs), func(diff state.Diff) bool {
+		return diff.IsRemoved() || !filter.match(newState.Packages()[diff.Idx])
+	}))
+	if err != nil {
+		waterlog.Fatalf("Failed to compare sonames: %s\n", err)
+	}
+
+	byName := make(map[string]int)
+	for idx, entry := range entries {
+		byName[entry.Name] = idx
+	}
+	pkgs := newState.Packages()
+	for _, change := range changes {
+		name := pkgs[change.Idx].Name
+		entries[byName[name]].Sonames = &diffSonames{Removed: change.Removed, Added: change.Added}
+		if !change.Breaking() {
+			continue
+		}
+
+		for _, dependent := range newBin.Dependents(change.Idx) {
+			pkg := pkgs[dependent]
+			if !filter.match(pkg) {
+				continue
+			}
+			// Packages that are in the report already either get rebuilt
+			// anyway, or have bigger problems.
+			if idx, ok := byName[pkg.Name]; ok {
+				if entries[idx].Kind == diffABIChange {
+					entries[idx].Needs = append(entries[idx].Needs, name)
+				}
+				continue
+			}
+			version := &push.PlanVersion{Version: pkg.Version, Release: pkg.Release}
+			byName[pkg.Name] = len(entries)
+			entries = append(entries, diffPackage{Name: pkg.Name, Kind: diffABIChange, Reason: "depends on removed sonames", Old: version, New: version, Component: pkg.Component, Needs: []string{name}})
+		}
+	}
+	return entries
+}
+
+// diffWriter returns where to write the report to, and a function to call once
+// it is written.
+func diffWriter() (io.Writer, func()) {
+	if diffOutput == "" {
+		return os.Stdout, func() {}
+	}
+	f, err := os.Create(diffOutput)
+	if err != nil {
+		waterlog.Fatalf("Failed to create %s: %s\n", diffOutput, err)
+	}
+	return f, func() { f.Close() }
+}
+
+// versionString formats `v` as version-release, or "-" if it is nil.
+func versionString(v *push.PlanVersion) string {
+	if v == nil {
+		return "-"
+	}
+	return fmt.Sprintf("%s-%d", v.Version, v.Release)
+}
+
+func writeDiffText(w io.Writer, report diffReport) error {
+	for _, pkg := range report.Packages {
+		_, err := fmt.Fprintf(w, "%s: %s: %s -> %s (impact %d)\n", pkg.Title(), pkg.Name, versionString(pkg.Old), versionString(pkg.New), pkg.Impact)
+		if err != nil {
+			return err
+		}
+		for _, note := range pkg.Notes() {
+			if _, err = fmt.Fprintf(w, "    %s\n", note); err != nil {
+				return err
+			}
+		}
+		for _, update := range pkg.Changelog {
+			comment := strings.ReplaceAll(update.Comment, "\n", "\n      ")
+			if _, err = fmt.Fprintf(w, "    %s-%d: %s\n", update.Version, update.Release, comment); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func writeDiffMarkdown(w io.Writer, report diffReport) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "## Changes from `%s` to `%s`\n\n", report.Old, report.New)
+	if len(report.Packages) == 0 {
+		b.WriteString("No changes.\n")
+	} else {
+		b.WriteString("| Package | Change | Old | New | Impact |\n")
+		b.WriteString("| --- | --- | --- | --- | ---: |\n")
+		for _, pkg := range report.Packages {
+			fmt.Fprintf(&b, "| %s | %s | %s | %s | %d |\n", pkg.Name, pkg.Title(), versionString(pkg.Old), versionString(pkg.New), pkg.Impact)
+		}
+	}
+
+	// Notes and changelogs don't fit in table cells, since they may span
+	// lines.
+	header := false
+	for _, pkg := range report.Packages {
+		if len(pkg.Notes()) == 0 && len(pkg.Changelog) == 0 {
+			continue
+		}
+		if !header {
+			b.WriteString("\n### Details\n")
+			header = true
+		}
+		fmt.Fprintf(&b, "\n#### %s\n\n", pkg.Name)
+		for _, note := range pkg.Notes() {
+			fmt.Fprintf(&b, "- %s\n", note)
+		}
+		for _, update := range pkg.Changelog {
+			comment := strings.ReplaceAll(update.Comment, "\n", "\n  ")
+			fmt.Fprintf(&b, "- %s-%d: %s\n", update.Version, update.Release, comment)
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+var diffHTML = template.Must(template.New("diff").Funcs(template.FuncMap{"version": versionString}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Changes from {{.Old}} to {{.New}}</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 0.25em 0.75em; text-align: left; }
+td.impact { text-align: right; }
+td.changelog { white-space: pre-line; }
+tr.bad, tr.unbumped, tr.outdated { background: #fdd; }
+tr.downgrade, tr.removed, tr.abi { background: #ffd; }
+</style>
+</head>
+<body>
+<h2>Changes from <code>{{.Old}}</code> to <code>{{.New}}</code></h2>
+{{- if .Packages}}
+<table>
+<tr><th>Package</th><th>Change</th><th>Old</th><th>New</th><th>Impact</th><th>Details</th></tr>
+{{- range .Packages}}
+<tr class="{{.Kind}}"><td>{{.Name}}</td><td>{{.Title}}</td><td>{{version .Old}}</td><td>{{version .New}}</td><td class="impact">{{.Impact}}</td><td class="changelog">
+{{- range .Notes}}{{.}}
+{{end}}
+{{- range .Changelog}}{{.Version}}-{{.Release}}: {{.Comment}}
+{{end}}</td></tr>
+{{- end}}
+</table>
+{{- else}}
+<p>No changes.</p>
+{{- end}}
+</body>
+</html>
+`))
@@ -0,0 +1,530 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/DataDrake/waterlog"
+	"github.com/GZGavinZhao/autobuild/config"
+	"github.com/GZGavinZhao/autobuild/push"
+	"github.com/GZGavinZhao/autobuild/state"
+	"github.com/GZGavinZhao/autobuild/utils"
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	doctorMaxAge  time.Duration
+	doctorOffline bool
+	cmdDoctor     = &cobra.Command{
+		Use:   "doctor [tpath...]",
+		Short: "Check that autobuild is set up correctly",
+		Long: `Check the configuration, the build servers it publishes to, and the given
+states: that binary indexes exist and are recent enough, that repositories can be
+fetched, and that source trees are healthy git repositories. Every problem comes
+with a way to fix it, and the command fails if any check failed.`,
+		Run: runDoctor,
+	}
+)
+
+func init() {
+	cmdDoctor.Flags().DurationVar(&doctorMaxAge, "max-age", 24*time.Hour, "warn about binary indexes older than this")
+	cmdDoctor.Flags().BoolVar(&doctorOffline, "offline", false, "don't connect to the build servers and repositories")
+	backendFlag(cmdDoctor)
+	targetFlag(cmdDoctor)
+}
+
+// doctor prints the outcome of every check as it goes, and counts them.
+type doctor struct {
+	warnings int
+	failures int
+}
+
+func (d *doctor) ok(format string, a ...any) {
+	fmt.Printf("%s %s\n", color.GreenString("[ OK ]"), fmt.Sprintf(format, a...))
+}
+
+// warn reports a problem that doesn't prevent autobuild from working, along
+// with how to `fix` it.
+func (d *doctor) warn(fix string, format string, a ...any) {
+	d.warnings++
+	fmt.Printf("%s %s\n", color.YellowString("[WARN]"), fmt.Sprintf(format, a...))
+	d.fix(fix)
+}
+
+// fail reports a problem that autobuild can't work with, along with how to
+// `fix` it.
+func (d *doctor) fail(fix string, format string, a ...any) {
+	d.failures++
+	fmt.Printf("%s %s\n", color.RedString("[FAIL]"), fmt.Sprintf(format, a...))
+	d.fix(fix)
+}
+
+func (d *doctor) fix(fix string) {
+	if fix != "" {
+		fmt.Printf("       -> %s\n", fix)
+	}
+}
+
+// doctorTarget is a build server to check, with its configuration.
+type doctorTarget struct {
+	// name is the name of the target in the configuration, or empty for the
+	// backend chosen by --backend or the configuration.
+	name    string
+	backend string
+	cfg     config.PushConfig
+}
+
+func (t doctorTarget) label() string {
+	if t.name == "" {
+		return fmt.Sprintf("backend %s", t.backend)
+	}
+	return fmt.Sprintf("target %s (%s)", t.name, t.backend)
+}
+
+func runDoctor(cmd *cobra.Command, args []string) {
+	for _, tpath := range args {
+		if !state.ValidTPath(tpath) || !strings.Contains(tpath, ":") {
+			waterlog.Fatalf("Invalid TPath %s\n", tpath)
+		}
+	}
+
+	d := &doctor{}
+	fmt.Println("Configuration")
+	userConfig, ok := d.checkConfig()
+
+	fmt.Println("\nBuild servers")
+	if ok {
+		for _, target := range doctorTargets(cmd, d, userConfig) {
+			d.checkTarget(target)
+		}
+	} else {
+		d.warn("", "Skipped, the configuration can't be loaded")
+	}
+
+	if len(args) != 0 {
+		fmt.Println("\nStates")
+	}
+	for _, tpath := range args {
+		kind, path, _ := strings.Cut(tpath, ":")
+		switch kind {
+		case "src":
+			path, _, _ = state.SplitRevision(path)
+			d.checkSource(path)
+		case "bin":
+			d.checkIndex(path)
+		case "repo":
+			d.checkRepo(path)
+		}
+	}
+
+	fmt.Printf("\n%d warnings, %d failures\n", d.warnings, d.failures)
+	if d.failures != 0 {
+		exit(1)
+	}
+}
+
+// checkConfig checks that the configuration file can be loaded, and that its
+// values make sense. It returns the configuration, and whether it was loaded.
+func (d *doctor) checkConfig() (userConfig config.UserConfig, ok bool) {
+	path, err := config.UserConfigPath()
+	if err != nil {
+		d.fail("Set $HOME or $XDG_CONFIG_HOME", "Failed to find the configuration directory: %s", err)
+		return
+	}
+
+	userConfig, err = config.LoadUser()
+	if err != nil {
+		d.fail(fmt.Sprintf("Fix the syntax of %s, or move it away to start from the defaults", path), "Failed to load %s: %s", path, err)
+		return
+	}
+	files := []string{path}
+	if !utils.PathExists(path) {
+		d.ok("No configuration file at %s, using the defaults", path)
+		files = nil
+	} else {
+		d.ok("Loaded %s", path)
+	}
+	if repoPath := config.RepoConfigPath(); repoPath != "" {
+		d.ok("Loaded %s", repoPath)
+		files = append(files, repoPath)
+	}
+
+	// The configuration is loaded leniently, so typos go unnoticed.
+	for _, file := range files {
+		raw, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		dec := yaml.NewDecoder(bytes.NewReader(raw))
+		dec.KnownFields(true)
+		var strict config.UserConfig
+		if err := dec.Decode(&strict); err != nil && !errors.Is(err, io.EOF) {
+			d.warn("Check the spelling of the keys against the User configuration section of the README, they are ignored", "%s has unknown keys: %s", file, err)
+		}
+		if file == path {
+			continue
+		}
+		if ignored, err := config.RepoIgnoredKeys(raw); err == nil && len(ignored) != 0 {
+			d.warn(fmt.Sprintf("Move them to %s if you trust the repository", path), "%s can't set %s, they are ignored", file, strings.Join(ignored, ", "))
+		}
+	}
+
+	defaults := userConfig.Defaults
+	for _, tpath := range []struct{ key, tpath string }{{"defaults.old", defaults.Old}, {"defaults.new", defaults.New}} {
+		if tpath.tpath != "" && !state.ValidTPath(tpath.tpath) {
+			d.fail("Use a TPath like src:path, bin:path or repo:name", "Invalid %s %s", tpath.key, tpath.tpath)
+		}
+	}
+	if (defaults.Old == "") != (defaults.New == "") {
+		d.warn("Set both defaults.old and defaults.new, or neither", "Only one of defaults.old and defaults.new is set, so it is unused")
+	}
+	for _, pattern := range defaults.Exclude {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			d.fail("Fix the glob pattern", "Invalid pattern %q in defaults.exclude: %s", pattern, err)
+		}
+	}
+
+	pushConfig := userConfig.Push
+	if pushConfig.Backend != "" && !slices.Contains(push.Backends, pushConfig.Backend) {
+		d.fail(fmt.Sprintf("Set push.backend to one of %q", push.Backends), "Unknown push.backend %s", pushConfig.Backend)
+	}
+
+	names := make(map[string]bool)
+	for i, target := range pushConfig.Targets {
+		switch {
+		case target.Name == "":
+			d.fail("Give every target a name, which --target selects it by", "push.targets[%d] has no name", i)
+		case names[target.Name]:
+			d.fail("Rename one of the targets", "There are several push.targets named %s", target.Name)
+		}
+		names[target.Name] = true
+
+		if !slices.Contains(push.Backends, target.Backend) {
+			d.fail(fmt.Sprintf("Set the backend of the target to one of %q", push.Backends), "push.targets[%d] has unknown backend %q", i, target.Backend)
+		}
+	}
+
+	for _, event := range []struct {
+		name  string
+		hooks []config.HookConfig
+	}{
+		{"pre-publish", pushConfig.Hooks.PrePublish},
+		{"post-publish", pushConfig.Hooks.PostPublish},
+		{"batch-start", pushConfig.Hooks.BatchStart},
+		{"batch-end", pushConfig.Hooks.BatchEnd},
+		{"wave-end", pushConfig.Hooks.WaveEnd},
+	} {
+		for i, hook := range event.hooks {
+			if (hook.Command == "") == (hook.URL == "") {
+				d.fail("Set either the command or the url of the hook", "push.hooks.%s[%d] must have either a command or an url", event.name, i)
+			}
+		}
+	}
+
+	checkNotify := func(key string, cfgs []config.NotifyConfig) {
+		for i, cfg := range cfgs {
+			if _, err := push.NewNotifier(cfg); err != nil {
+				d.fail("See the Notifications section of the README", "Invalid %s[%d]: %s", key, i, err)
+			}
+			for _, event := range cfg.Events {
+				if !slices.Contains(push.NotifyEvents, event) {
+					d.fail(fmt.Sprintf("Use events of %q", push.NotifyEvents), "%s[%d] has unknown event %q", key, i, event)
+				}
+			}
+		}
+	}
+	checkNotify("push.notify", pushConfig.Notify)
+	for i, p := range userConfig.Profiles {
+		checkNotify(fmt.Sprintf("profiles[%d].notify", i), p.Notify)
+	}
+
+	retry := pushConfig.Retry
+	if (retry.Retries != nil && *retry.Retries < 0) || retry.Backoff < 0 || retry.MaxBackoff < 0 {
+		d.fail("Use positive values, or remove them to keep the defaults", "push.retry has negative values")
+	}
+
+	if pushConfig.SigningKey != "" && !utils.PathExists(pushConfig.SigningKey) {
+		d.fail("Fix push.signing-key, or generate a key with ssh-keygen -t ed25519", "The signing key %s doesn't exist", pushConfig.SigningKey)
+	}
+
+	names = make(map[string]bool)
+	for i, p := range userConfig.Profiles {
+		switch {
+		case p.Name == "":
+			d.fail("Give every profile a name, which --profile selects it by", "profiles[%d] has no name", i)
+		case names[p.Name]:
+			d.fail("Rename one of the profiles", "There are several profiles named %s", p.Name)
+		}
+		names[p.Name] = true
+
+		if p.Backend != "" && !slices.Contains(push.Backends, p.Backend) {
+			d.fail(fmt.Sprintf("Set the backend of the profile to one of %q", push.Backends), "profiles[%d] has unknown backend %q", i, p.Backend)
+		}
+	}
+	if profile != "" {
+		if userConfig, err = userConfig.WithProfile(profile); err != nil {
+			d.fail("Add the profile to profiles, or fix its name", "Unknown profile %s", profile)
+			return userConfig, false
+		}
+		d.ok("Using profile %s", profile)
+	}
+
+	return userConfig, true
+}
+
+// doctorTargets returns the build servers to check: the ones selected by the
+// flags of `cmd` if any, otherwise the default backend and every configured
+// target.
+func doctorTargets(cmd *cobra.Command, d *doctor, userConfig config.UserConfig) (targets []doctorTarget) {
+	backend, _ := cmd.Flags().GetString("backend")
+	names, _ := cmd.Flags().GetStringSlice("target")
+
+	if len(names) == 0 {
+		backend = resolveBackend(backend, userConfig)
+		selectBackend(backend)
+		targets = append(targets, doctorTarget{backend: backend, cfg: userConfig.Push.WithServer(backend, os.Getenv(config.ServerEnv))})
+	}
+	for _, target := range userConfig.Push.Targets {
+		if (len(names) == 0 && backend == "") || slices.Contains(names, target.Name) {
+			targets = append(targets, doctorTarget{name: target.Name, backend: target.Backend, cfg: target.PushConfig(userConfig.Push)})
+		}
+	}
+	for _, name := range names {
+		if !slices.ContainsFunc(targets, func(t doctorTarget) bool { return t.name == name }) {
+			d.fail("Add the target to push.targets, or fix its name", "Unknown target %s", name)
+		}
+	}
+	if len(names) != 0 && os.Getenv(config.ServerEnv) != "" {
+		d.warn(fmt.Sprintf("Unset $%s, or set the build server in push.targets", config.ServerEnv), "$%s is ignored, since targets keep the build servers of their configuration", config.ServerEnv)
+	}
+	return
+}
+
+// checkTarget checks that the build server of `target` is configured, and
+// that it can be reached with the configured credentials.
+func (d *doctor) checkTarget(target doctorTarget) {
+	label := target.label()
+	if !slices.Contains(push.Backends, target.backend) {
+		d.fail(fmt.Sprintf("Use one of %q", push.Backends), "%s: unknown backend", label)
+		return
+	}
+
+	switch target.backend {
+	case "local":
+		// NewBuilder would create the directories of the local backend.
+		d.checkLocal(label, target.cfg.Local)
+		return
+	case "solus":
+		if _, err := exec.LookPath("ssh"); err != nil {
+			d.fail("Install OpenSSH", "%s: ssh isn't installed", label)
+			return
+		}
+		identity := target.cfg.Solus.Identity
+		if key, ok := os.LookupEnv("AUTOBUILD_SSHKEY"); ok {
+			identity = key
+		}
+		if identity != "" && !utils.PathExists(identity) {
+			d.fail("Fix push.solus.identity or $AUTOBUILD_SSHKEY", "%s: the SSH key %s doesn't exist", label, identity)
+			return
+		}
+	case "summit", "webhook", "github", "gitlab":
+		headers := map[string]map[string]string{
+			"summit":  target.cfg.Summit.Headers,
+			"webhook": target.cfg.Webhook.Headers,
+			"github":  target.cfg.GitHub.Headers,
+			"gitlab":  target.cfg.GitLab.Headers,
+		}[target.backend]
+		hasAuth := slices.ContainsFunc(utils.SortedKeys(headers), func(k string) bool { return http.CanonicalHeaderKey(k) == "Authorization" })
+		token, source, err := config.LookupToken(target.backend)
+		if err != nil {
+			d.fail("Fix or remove the credentials file", "%s: failed to look up the API token: %s", label, err)
+			return
+		}
+		if token == "" && !hasAuth {
+			d.warn(fmt.Sprintf("Run `autobuild login %s`, or set $%s", target.backend, config.TokenEnv(target.backend)), "%s: no API token", label)
+		} else if token != "" && !hasAuth {
+			d.ok("%s: API token from %s", label, source)
+		}
+	}
+
+	builder, err := push.NewBuilder(target.backend, target.cfg)
+	if err != nil {
+		d.fail("Complete the configuration of the backend", "%s: %s", label, err)
+		return
+	}
+	if doctorOffline {
+		d.ok("%s: %s is configured", label, builder.Target())
+		return
+	}
+
+	if solus, ok := builder.(*push.SolusBuilder); ok {
+		if err := solus.Ping(); err != nil {
+			d.fail("Check your network, and that your SSH key is authorized on the build server", "%s: %s", label, err)
+			return
+		}
+		d.ok("%s: connected to %s", label, builder.Target())
+		return
+	}
+
+	caps, err := push.QueryCapabilities(builder)
+	if err != nil {
+		d.fail("Check the URL of the build server and your network", "%s: %s", label, err)
+		return
+	} else if caps.Unreported {
+		d.warn("Update the build server to one that reports its capabilities", "%s: %s doesn't report its capabilities, so push leaves out all the optional features", label, builder.Target())
+	}
+	// Capabilities don't always need authentication, but the queue does.
+	if queuer, ok := builder.(push.Queuer); ok {
+		_, err := queuer.Queue()
+		var status *push.StatusError
+		if errors.As(err, &status) && (status.StatusCode == http.StatusUnauthorized || status.StatusCode == http.StatusForbidden) {
+			d.fail(fmt.Sprintf("Run `autobuild login %s` with a valid token", target.backend), "%s: %s rejected the credentials: %s", label, builder.Target(), err)
+			return
+		} else if err != nil {
+			d.warn("", "%s: failed to list the queue of %s: %s", label, builder.Target(), err)
+			return
+		}
+	}
+	d.ok("%s: connected to %s", label, builder.Target())
+}
+
+// checkLocal checks that the tools of the local backend are installed, and
+// that its repository is indexed.
+func (d *doctor) checkLocal(label string, cfg config.LocalConfig) {
+	tools := slices.DeleteFunc([]string{"solbuild", "boulder"}, func(tool string) bool {
+		_, err := exec.LookPath(tool)
+		return err != nil
+	})
+	if len(tools) == 0 {
+		d.fail("Install solbuild to build package.yml recipes, or boulder to build stone.yaml ones", "%s: neither solbuild nor boulder is installed", label)
+	} else {
+		d.ok("%s: %s installed", label, strings.Join(tools, " and "))
+	}
+
+	repo := cfg.Repo
+	if repo == "" {
+		repo = push.DefaultLocalRepo
+	}
+	if !utils.PathExists(repo) {
+		d.warn("It is created by the first push, make sure the solbuild or boulder profile uses it as a local repository", "%s: the local repository %s doesn't exist yet", label, repo)
+		return
+	}
+	for _, index := range []string{"eopkg-index.xml", "stone.index"} {
+		if info, err := os.Stat(filepath.Join(repo, index)); err == nil {
+			d.ok("%s: %s was indexed %s ago", label, repo, time.Since(info.ModTime()).Round(time.Minute))
+			return
+		}
+	}
+	d.warn("It is indexed by the first build, or run `eopkg index` in it", "%s: the local repository %s has no index", label, repo)
+}
+
+// checkIndex checks that the binary index at `path` exists, can be loaded
+// and is recent enough.
+func (d *doctor) checkIndex(path string) {
+	info, err := os.Stat(path)
+	if err != nil {
+		d.fail("Download the index of the repository, e.g. https://packages.getsol.us/unstable/eopkg-index.xml.xz, and decompress it", "bin:%s: %s", path, err)
+		return
+	}
+	if _, err := state.LoadBinary(path); err != nil {
+		d.fail("Download the index again", "bin:%s: failed to load the index: %s", path, err)
+		return
+	}
+	if age := time.Since(info.ModTime()); age > doctorMaxAge {
+		d.warn("Download the index again, or diff against repo: to always use the latest one", "bin:%s is %s old", path, age.Round(time.Hour))
+		return
+	}
+	d.ok("bin:%s was updated %s ago", path, time.Since(info.ModTime()).Round(time.Minute))
+}
+
+// checkRepo checks that the index of the repository `name` can be fetched.
+func (d *doctor) checkRepo(name string) {
+	url := state.RepoIndexURL(name)
+	if doctorOffline {
+		d.ok("repo:%s is fetched from %s, not checked with --offline", name, url)
+		return
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Head(url)
+	if err != nil {
+		d.fail("Check your network", "repo:%s: %s", name, err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		d.fail("Check the name of the repository, e.g. unstable or shannon", "repo:%s: %s answered %s", name, url, resp.Status)
+		return
+	}
+	d.ok("repo:%s can be fetched from %s", name, url)
+}
+
+// checkSource checks that the source tree at `path` can be loaded, and that
+// its git repository is in a state packages can be published from.
+func (d *doctor) checkSource(path string) {
+	src, err := state.LoadSource(path)
+	if err != nil {
+		d.fail("Fix the recipe, or mark its package as ignored in its autobuild.yaml", "src:%s: %s", path, err)
+		return
+	}
+	d.ok("src:%s has %d packages", path, len(src.Packages()))
+
+	if !src.IsGit() {
+		d.fail("Clone the packages repository instead of using a copy", "src:%s isn't a git repository, packages can't be published from it", path)
+		return
+	}
+
+	git := func(args ...string) (string, error) {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = path
+		output, err := cmd.Output()
+		return strings.TrimSpace(string(output)), err
+	}
+
+	if branch, err := git("symbolic-ref", "--short", "HEAD"); err != nil {
+		d.fail("Run `git switch main`", "src:%s has a detached HEAD, packages are only published from main", path)
+	} else if branch != "main" {
+		d.fail("Run `git switch main`", "src:%s is on branch %s, packages are only published from main", path, branch)
+	}
+
+	if status, err := git("status", "--porcelain"); err != nil {
+		d.fail("Check the repository with `git status`", "src:%s: git status failed: %s", path, err)
+	} else if status != "" {
+		d.warn("Commit or stash them, they are diffed but not pushed", "src:%s has uncommitted changes to %d files", path, len(strings.Split(status, "\n")))
+	}
+
+	upstream, err := git("rev-parse", "--abbrev-ref", "@{upstream}")
+	if err != nil {
+		d.warn("Run `git branch --set-upstream-to origin/main`", "src:%s has no upstream branch, `push` can't git push it", path)
+		return
+	}
+	counts, err := git("rev-list", "--left-right", "--count", "HEAD...@{upstream}")
+	var ahead, behind int
+	if err == nil {
+		_, err = fmt.Sscanf(counts, "%d %d", &ahead, &behind)
+	}
+	switch {
+	case err != nil:
+		d.warn("", "src:%s: failed to compare with %s: %s", path, upstream, err)
+	case behind != 0:
+		d.warn("Run `git pull --rebase`, and `git fetch` regularly", "src:%s is %d commits behind %s as of the last fetch", path, behind, upstream)
+	case ahead != 0:
+		d.ok("src:%s is %d commits ahead of %s, which `push` git pushes", path, ahead, upstream)
+	default:
+		d.ok("src:%s is up to date with %s as of the last fetch", path, upstream)
+	}
+}
@@ -0,0 +1,85 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package cmd
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/DataDrake/waterlog"
+	"github.com/spf13/cobra"
+)
+
+// The downgrade policies, see downgradePolicy.
+const (
+	downgradesForbid = "forbid"
+	downgradesWarn   = "warn"
+	downgradesAllow  = "allow"
+)
+
+var downgradePolicies = []string{downgradesForbid, downgradesWarn, downgradesAllow}
+
+// downgradePolicy decides what happens to outdated and downgraded packages,
+// i.e. packages whose release or version went backwards.
+type downgradePolicy struct {
+	mode string
+	// allowed are the package names or glob patterns that may be downgraded
+	// whatever the mode is.
+	allowed []string
+}
+
+// downgradeFlags adds the flags of downgradePolicy to `cmd`.
+func downgradeFlags(cmd *cobra.Command) {
+	cmd.Flags().String("downgrades", downgradesWarn, fmt.Sprintf("what to do with packages with an older release or version, one of %q", downgradePolicies))
+	cmd.Flags().String("downgrade-allowlist", "", "file listing the packages that may be downgraded anyway, one name or glob pattern per line")
+}
+
+func getDowngradePolicy(cmd *cobra.Command) (p downgradePolicy) {
+	p.mode, _ = cmd.Flags().GetString("downgrades")
+	if !slices.Contains(downgradePolicies, p.mode) {
+		waterlog.Fatalf("Unknown downgrade policy %s\n", p.mode)
+	}
+
+	allowlist, _ := cmd.Flags().GetString("downgrade-allowlist")
+	if allowlist == "" {
+		return
+	}
+	var err error
+	if p.allowed, err = readPatterns(allowlist); err != nil {
+		waterlog.Fatalf("Failed to read downgrade allowlist %s: %s\n", allowlist, err)
+	}
+	return
+}
+
+// allows reports whether the package called `name` may be downgraded without
+// complaint.
+func (p downgradePolicy) allows(name string) bool {
+	return p.mode == downgradesAllow || matchAny(p.allowed, name)
+}
+
+// report logs the packages of `pkgs` that the policy doesn't allow after
+// `m`, as errors if it forbids them, and returns the names of the forbidden
+// ones.
+func (p downgradePolicy) report(pkgs []manifestPackage, m message) (forbidden []string) {
+	var reported []manifestPackage
+	for _, pkg := range pkgs {
+		if !p.allows(pkg.Name) {
+			reported = append(reported, pkg)
+		}
+	}
+	if len(reported) == 0 {
+		return
+	}
+
+	log := waterlog.Warn
+	if p.mode == downgradesForbid {
+		log = waterlog.Error
+		for _, pkg := range reported {
+			forbidden = append(forbidden, pkg.Name)
+		}
+	}
+	logPackages(log, m, packageRows(reported, downgradeColor))
+	return
+}
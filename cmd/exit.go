@@ -0,0 +1,87 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/DataDrake/waterlog"
+)
+
+// Exit codes, for scripts to tell the classes of failures apart. Failures
+// without a class of their own, including invalid arguments, exit with
+// exitFailure.
+const (
+	exitOK      = 0
+	exitFailure = 1
+	// exitChanged is returned by diff --exit-code when packages differ.
+	exitChanged = 2
+	// exitUnresolved is returned when packages have unresolved dependencies.
+	exitUnresolved = 3
+	// exitCycles is returned when dependency cycles prevent a build order.
+	exitCycles = 4
+	// exitServer is returned when the build server can't be reached, or
+	// rejects a request.
+	exitServer = 5
+	// exitBuildFailed is returned when jobs failed to build.
+	exitBuildFailed = 6
+	// exitABIBroken is returned by push --abi-check when the ABI of a rebuilt
+	// package broke, and packages linking against it need to be rebuilt.
+	exitABIBroken = 7
+)
+
+// exit exits with `code`, printing the timings first if --timings was given,
+// and writing the profiles of the profiling flags.
+func exit(code int) {
+	timings.finish()
+	stopProfiling()
+	os.Exit(code)
+}
+
+// fatalf logs an error like waterlog.Fatalf, but exits with `code`.
+func fatalf(code int, format string, a ...any) {
+	waterlog.Errorf(format, a...)
+	exit(code)
+}
+
+// errorSummary collects the errors of a command that carries on past them, to
+// summarize them once it is done.
+type errorSummary struct {
+	errs  []string
+	codes []int
+}
+
+// add logs an error right away, and records it for the summary. `code` is the
+// exit code of the error, see exit.
+func (s *errorSummary) add(code int, format string, a ...any) {
+	msg := strings.TrimRight(fmt.Sprintf(format, a...), "\n")
+	waterlog.Errorln(msg)
+	s.errs = append(s.errs, msg)
+	s.codes = append(s.codes, code)
+}
+
+// exit summarizes the errors and exits, if there were any. The exit code is
+// the one of the errors if they have the same, or else exitFailure.
+func (s *errorSummary) exit() {
+	if len(s.errs) == 0 {
+		return
+	}
+	// The errors may have been logged long before, among many other lines.
+	if len(s.errs) > 1 {
+		waterlog.Errorf("%d errors occurred:\n", len(s.errs))
+		for _, err := range s.errs {
+			waterlog.Errorf("  %s\n", err)
+		}
+	}
+
+	code := s.codes[0]
+	if slices.ContainsFunc(s.codes, func(c int) bool { return c != code }) {
+		code = exitFailure
+	}
+	exit(code)
+}
@@ -0,0 +1,191 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package cmd
+
+import (
+	"bufio"
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/DataDrake/waterlog"
+	"github.com/GZGavinZhao/autobuild/common"
+	"github.com/GZGavinZhao/autobuild/push"
+	"github.com/GZGavinZhao/autobuild/state"
+	"github.com/GZGavinZhao/autobuild/utils"
+	"github.com/spf13/cobra"
+)
+
+// pushFilter selects the packages that a diff considers, and thereby the
+// bumped packages that a push publishes.
+type pushFilter struct {
+	only       []string
+	exclude    []string
+	components []string
+}
+
+// filterFlags adds the flags of pushFilter to `cmd`.
+func filterFlags(cmd *cobra.Command) {
+	cmd.Flags().StringSlice("only", nil, "only consider these packages (glob patterns allowed)")
+	cmd.Flags().StringSlice("exclude", nil, "ignore these packages (glob patterns allowed)")
+	cmd.RegisterFlagCompletionFunc("only", completePackageList)
+	cmd.RegisterFlagCompletionFunc("exclude", completePackageList)
+	cmd.Flags().StringSlice("component", nil, "only consider packages in these components or their subcomponents, e.g. system.devel")
+	cmd.Flags().String("ignore-file", ".autobuildignore", "file listing packages to ignore, like --exclude, one name or glob pattern per line (skipped if missing)")
+}
+
+func getFilter(cmd *cobra.Command) (f pushFilter) {
+	f.only, _ = cmd.Flags().GetStringSlice("only")
+	f.exclude, _ = cmd.Flags().GetStringSlice("exclude")
+	f.components, _ = cmd.Flags().GetStringSlice("component")
+
+	f.only, f.exclude = recipeNames(f.only), recipeNames(f.exclude)
+	checkPatterns(f.only)
+	checkPatterns(f.exclude)
+
+	// The ignore file lists packages that are meant to differ between the
+	// states. It is optional unless given explicitly.
+	ignoreFile, _ := cmd.Flags().GetString("ignore-file")
+	if ignoreFile == "" {
+		return
+	}
+	ignored, err := readPatterns(ignoreFile)
+	if errors.Is(err, fs.ErrNotExist) && !cmd.Flags().Changed("ignore-file") {
+		return
+	} else if err != nil {
+		waterlog.Fatalf("Failed to read ignore file %s: %s\n", ignoreFile, err)
+	}
+	f.exclude = append(f.exclude, ignored...)
+	return
+}
+
+// recipeNames replaces the paths to recipes among `args` with the names of
+// their packages, see state.RecipeName.
+func recipeNames(args []string) []string {
+	res := slices.Clone(args)
+	for i, arg := range res {
+		if name, ok := state.RecipeName(arg); ok {
+			res[i] = name
+		}
+	}
+	return res
+}
+
+// checkPatterns exits if any of the package name patterns is invalid.
+func checkPatterns(patterns []string) {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			waterlog.Fatalf("Invalid package pattern %q: %s\n", pattern, err)
+		}
+	}
+}
+
+// readPatterns reads package names or glob patterns from the file at `path`,
+// one per line. Blank lines and lines starting with # are ignored, and paths
+// to recipes are replaced with the names of their packages, see recipeNames.
+func readPatterns(path string) (patterns []string, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	patterns = recipeNames(patterns)
+	checkPatterns(patterns)
+	return
+}
+
+func (f pushFilter) empty() bool {
+	return len(f.only) == 0 && len(f.exclude) == 0 && len(f.components) == 0
+}
+
+func matchAny(patterns []string, name string) bool {
+	return slices.ContainsFunc(patterns, func(pattern string) bool {
+		ok, _ := path.Match(pattern, name)
+		return ok
+	})
+}
+
+func (f pushFilter) match(pkg common.Package) bool {
+	if len(f.only) != 0 && !matchAny(f.only, pkg.Name) {
+		return false
+	}
+	if matchAny(f.exclude, pkg.Name) {
+		return false
+	}
+	if len(f.components) != 0 && !slices.ContainsFunc(f.components, func(component string) bool {
+		return pkg.Component == component || strings.HasPrefix(pkg.Component, component+".")
+	}) {
+		return false
+	}
+	return true
+}
+
+// filterChanges returns the bumped packages of `changes` (see diffStates)
+// selected by the filter, and the names of the ones it skipped. It warns
+// about selected packages that depend on skipped ones, or the other way
+// around, since filtering splits their dependency chain.
+func filterChanges(newState state.State, changes map[int]*push.PlanVersion, f pushFilter) (selected map[int]*push.PlanVersion, skipped []string) {
+	if f.empty() {
+		return changes, nil
+	}
+
+	pkgs := newState.Packages()
+	selected = make(map[int]*push.PlanVersion)
+	for idx, old := range changes {
+		if f.match(pkgs[idx]) {
+			selected[idx] = old
+		} else {
+			skipped = append(skipped, pkgs[idx].Name)
+		}
+	}
+	slices.Sort(skipped)
+
+	if len(skipped) == 0 {
+		return
+	}
+	waterlog.Infof("Skipping %d of the %d bumped packages:", len(skipped), len(changes))
+	for _, name := range skipped {
+		waterlog.Printf(" %s", name)
+	}
+	waterlog.Println()
+
+	depGraph := newState.DepGraph()
+	if depGraph == nil {
+		return
+	}
+
+	// Dependencies between bumped packages, including indirect ones through
+	// packages that weren't bumped.
+	lifted := utils.LiftSelection(depGraph, utils.SortedKeys(changes))
+	for v := range lifted.Nodes {
+		lifted.Visit(v, func(w int, _ int64) (skip bool) {
+			dep, pkg := lifted.Nodes[v], lifted.Nodes[w]
+			_, depSelected := selected[dep]
+			_, pkgSelected := selected[pkg]
+			if pkgSelected && !depSelected {
+				waterlog.Warnf("%s depends on %s, which is skipped and so won't be rebuilt before it\n", pkgs[pkg].Name, pkgs[dep].Name)
+			} else if depSelected && !pkgSelected {
+				waterlog.Warnf("%s depends on %s, but is skipped and so won't be rebuilt against it\n", pkgs[pkg].Name, pkgs[dep].Name)
+			}
+			return
+		})
+	}
+	return
+}
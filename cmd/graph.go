@@ -0,0 +1,99 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package cmd
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/DataDrake/waterlog"
+	"github.com/GZGavinZhao/autobuild/common"
+	st "github.com/GZGavinZhao/autobuild/state"
+	"github.com/GZGavinZhao/autobuild/utils"
+	"github.com/spf13/cobra"
+)
+
+var (
+	graphOutput string
+	graphGzip   bool
+	cmdGraph    = &cobra.Command{
+		Use:   "graph [src|bin|repo:path]",
+		Short: "Output the dependency graph for external tooling",
+		Long: `Output the full dependency graph of the given state.
+
+Supported formats are "json-adjacency" (see the README for the schema) and "dot".
+The graph is written as it is walked, and compressed with gzip with --gzip or
+when the output file ends with .gz, so that the graph of a whole repository
+doesn't need to fit in memory, nor on disk uncompressed.`,
+		Run:  runGraph,
+		Args: cobra.ExactArgs(1),
+	}
+)
+
+func init() {
+	formatFlag(cmdGraph, "json-adjacency", "dot")
+	cmdGraph.Flags().StringVarP(&graphOutput, "output", "o", "", "write the graph to the given file instead of stdout")
+	cmdGraph.Flags().BoolVar(&graphGzip, "gzip", false, "compress the graph with gzip (default if the output file ends with .gz)")
+}
+
+func runGraph(cmd *cobra.Command, args []string) {
+	tpath := args[0]
+
+	// Keep stdout clean for the graph itself.
+	if graphOutput == "" {
+		setLogOutput(os.Stderr)
+	}
+
+	format := getFormat(cmd)
+
+	state, err := st.LoadState(tpath)
+	if err != nil {
+		waterlog.Fatalf("Failed to parse state: %s\n", err)
+	}
+	waterlog.Goodln(msg("state.parsed", "tpath", tpath))
+
+	depGraph := state.DepGraph()
+	if depGraph == nil {
+		waterlog.Fatalf("Failed to obtain dependency graph of state %s\n", tpath)
+	}
+
+	var out io.WriteCloser = os.Stdout
+	if graphOutput != "" {
+		if out, err = os.Create(graphOutput); err != nil {
+			waterlog.Fatalf("Failed to create %s: %s\n", graphOutput, err)
+		}
+	}
+	w := io.Writer(out)
+	var zw *gzip.Writer
+	if graphGzip || strings.HasSuffix(graphOutput, ".gz") {
+		zw = gzip.NewWriter(out)
+		w = zw
+	}
+
+	if format == "dot" {
+		pkgs := state.Packages()
+		err = utils.WriteDOT(w, depGraph, func(int) bool { return true }, func(v int) utils.DOTAttrs {
+			return utils.DOTAttrs{"label": fmt.Sprintf("%s\n%s-%d", pkgs[v].Name, pkgs[v].Version, pkgs[v].Release)}
+		}, func(_, _ int, c int64) utils.DOTAttrs {
+			kind := common.DepKind(c).String()
+			return utils.DOTAttrs{"color": depKindColors[kind], "label": kind}
+		})
+	} else {
+		err = st.WriteGraph(w, state)
+	}
+	if err == nil && zw != nil {
+		err = zw.Close()
+	}
+	if err == nil && graphOutput != "" {
+		err = out.Close()
+	}
+
+	if err != nil {
+		waterlog.Fatalf("Failed to write graph: %s\n", err)
+	}
+}
@@ -0,0 +1,176 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/DataDrake/waterlog"
+	"github.com/GZGavinZhao/autobuild/push"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdHistory = &cobra.Command{
+		Use:   "history [packages]",
+		Short: "Show past pushes",
+		Long: `Show past pushes, newest first. When packages are given, only the pushes that
+published them are shown, along with the other packages they came with.
+
+Every push is recorded in ~/.local/share/autobuild/history.jsonl.`,
+		Run:               runHistory,
+		ValidArgsFunction: completePackages,
+	}
+)
+
+func init() {
+	cmdHistory.Flags().IntP("limit", "l", 20, "maximum number of pushes to show, or 0 for all")
+	cmdHistory.Flags().Duration("since", 0, "only show pushes that started within this long, e.g. 720h")
+	cmdHistory.Flags().Bool("json", false, "print the matching records as JSON lines")
+}
+
+// recordHistory appends the push of `order` to the history. Failing to is not
+// fatal, since the packages were already published.
+func recordHistory(started time.Time, batch string, targets []pushTarget, order pushOrder, results []push.Result, errs []error) {
+	record := push.HistoryRecord{
+		Batch:    batch,
+		Started:  started.UTC(),
+		Finished: time.Now().UTC(),
+		Old:      order.oldTPath,
+		New:      order.newTPath,
+	}
+	if u, err := user.Current(); err == nil {
+		record.User = u.Username
+	} else {
+		record.User = os.Getenv("USER")
+	}
+
+	for tIdx, target := range targets {
+		entry := push.HistoryTarget{Name: target.name, Backend: target.builder.Name(), Target: target.builder.Target()}
+		if errs[tIdx] != nil {
+			entry.Error = errs[tIdx].Error()
+		} else if results[tIdx].Stopped {
+			entry.Error = "stopped after too many failures"
+		}
+		record.Targets = append(record.Targets, entry)
+	}
+	for idx, pkg := range order.packages {
+		entry := push.HistoryPackage{Name: pkg.Name, Version: pkg.Version, Release: pkg.Release, Old: order.old[idx]}
+		for tIdx := range targets {
+			job := push.HistoryJob{Outcome: push.Pending.String()}
+			if results[tIdx].Outcomes != nil {
+				job.Outcome = results[tIdx].Outcomes[idx].String()
+				job.ID, job.Status = results[tIdx].Jobs[idx].ID, results[tIdx].Jobs[idx].Status
+			}
+			entry.Jobs = append(entry.Jobs, job)
+		}
+		record.Packages = append(record.Packages, entry)
+	}
+
+	path, err := push.HistoryPath()
+	if err == nil {
+		err = push.AppendHistory(path, record)
+	}
+	if err != nil {
+		waterlog.Warnf("Failed to record the push in the history: %s\n", err)
+	}
+}
+
+func runHistory(cmd *cobra.Command, args []string) {
+	args = recipeNames(args)
+	limit, _ := cmd.Flags().GetInt("limit")
+	since, _ := cmd.Flags().GetDuration("since")
+	asJSON, _ := cmd.Flags().GetBool("json")
+
+	path, err := push.HistoryPath()
+	if err != nil {
+		waterlog.Fatalf("Failed to find the history: %s\n", err)
+	}
+	records, err := push.LoadHistory(path)
+	if err != nil {
+		waterlog.Fatalf("Failed to load the history: %s\n", err)
+	}
+
+	var matches []push.HistoryRecord
+	for i := len(records) - 1; i >= 0 && (limit <= 0 || len(matches) < limit); i-- {
+		record := records[i]
+		if since > 0 && time.Since(record.Started) > since {
+			continue
+		}
+		if len(args) != 0 && !slices.ContainsFunc(record.Packages, func(pkg push.HistoryPackage) bool {
+			return slices.Contains(args, pkg.Name)
+		}) {
+			continue
+		}
+		matches = append(matches, record)
+	}
+
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		for _, record := range matches {
+			if err = enc.Encode(record); err != nil {
+				waterlog.Fatalf("Failed to write history: %s\n", err)
+			}
+		}
+		return
+	}
+
+	if len(matches) == 0 {
+		waterlog.Infoln("No matching pushes in the history")
+		return
+	}
+	for _, record := range matches {
+		printRecord(record, args)
+	}
+}
+
+// printRecord prints a push of the history. When `queries` is not empty, the
+// queried packages are shown with their jobs, and the rest as what they came
+// with.
+func printRecord(record push.HistoryRecord, queries []string) {
+	var targets []string
+	for _, target := range record.Targets {
+		name := fmt.Sprintf("%s (%s)", target.Backend, target.Target)
+		if target.Name != "" {
+			name = target.Name
+		}
+		if target.Error != "" {
+			name += ", " + target.Error
+		}
+		targets = append(targets, name)
+	}
+	waterlog.Goodf("%s batch %s by %s: %s -> %s, %d package(s) to %s\n",
+		record.Started.Local().Format(time.DateTime), record.Batch, record.User, record.Old, record.New, len(record.Packages), strings.Join(targets, "; "))
+
+	var others []string
+	for _, pkg := range record.Packages {
+		if len(queries) != 0 && !slices.Contains(queries, pkg.Name) {
+			others = append(others, pkg.Name)
+			continue
+		}
+
+		var jobs []string
+		for tIdx, job := range pkg.Jobs {
+			desc := job.Outcome
+			if job.ID != 0 {
+				desc = fmt.Sprintf("job %d %s", job.ID, job.Outcome)
+			}
+			if len(record.Targets) > 1 && tIdx < len(record.Targets) {
+				desc = fmt.Sprintf("%s: %s", record.Targets[tIdx].Name, desc)
+			}
+			jobs = append(jobs, desc)
+		}
+		waterlog.Printf("  %s %s-%d: %s\n", pkg.Name, pkg.Version, pkg.Release, strings.Join(jobs, ", "))
+	}
+	if len(others) != 0 {
+		waterlog.Printf("  with: %s\n", strings.Join(others, " "))
+	}
+}
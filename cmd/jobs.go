@@ -0,0 +1,169 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package cmd
+
+import (
+	"errors"
+	"os"
+	"strconv"
+
+	"github.com/DataDrake/waterlog"
+	"github.com/GZGavinZhao/autobuild/common"
+	"github.com/GZGavinZhao/autobuild/push"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdJobs = &cobra.Command{
+		Use:   "jobs",
+		Short: "Manage jobs on the build server",
+	}
+	cmdJobsCancel = &cobra.Command{
+		Use:   "cancel [id|batch]...",
+		Short: "Cancel jobs on the build server",
+		Long: `Cancel jobs on the build server. Arguments are either job IDs, or batch IDs of
+a push, in which case all the jobs of the batch recorded in the journal are
+cancelled.`,
+		Run:  runJobsCancel,
+		Args: cobra.MinimumNArgs(1),
+	}
+	cmdJobsRetry = &cobra.Command{
+		Use:   "retry [id]...",
+		Short: "Retry jobs on the build server",
+		Long: `Retry jobs on the build server. Jobs recorded in the journal are replaced by
+their retries, so that resuming the push waits for the retries instead.`,
+		Run:  runJobsRetry,
+		Args: cobra.MinimumNArgs(1),
+	}
+)
+
+func init() {
+	for _, cmd := range []*cobra.Command{cmdJobsCancel, cmdJobsRetry} {
+		backendFlag(cmd)
+		cmd.Flags().String("journal", "push-journal.jsonl", "journal of the push the jobs belong to")
+		cmdJobs.AddCommand(cmd)
+	}
+}
+
+// jobsBuilder returns the builder selected by the flags of `cmd`, and the
+// journal given to it if it exists.
+func jobsBuilder(cmd *cobra.Command) (builder push.Builder, journal *push.Journal) {
+	backend, _ := cmd.Flags().GetString("backend")
+	journalPath, _ := cmd.Flags().GetString("journal")
+
+	userConfig, err := loadConfig()
+	if err != nil {
+		waterlog.Fatalf("Failed to load user config: %s\n", err)
+	}
+	if builder, err = singleBuilder(resolveBackend(backend, userConfig), userConfig.Push); err != nil {
+		waterlog.Fatalf("Failed to set up backend: %s\n", err)
+	}
+
+	if journal, err = push.LoadJournal(journalPath); err != nil {
+		if !errors.Is(err, os.ErrNotExist) || cmd.Flags().Changed("journal") {
+			waterlog.Fatalf("Failed to load journal: %s\n", err)
+		}
+		journal = nil
+	}
+	return
+}
+
+func runJobsCancel(cmd *cobra.Command, args []string) {
+	builder, journal := jobsBuilder(cmd)
+	if journal != nil {
+		defer journal.Close()
+	}
+
+	caps, err := push.QueryCapabilities(builder)
+	if err != nil {
+		fatalf(exitServer, "Failed to negotiate with the build server: %s\n", err)
+	}
+	canceller, ok := builder.(push.Canceller)
+	if !ok || !caps.Cancel {
+		waterlog.Fatalf("The build server %s doesn't support cancelling jobs\n", builder.Target())
+	}
+
+	var ids []int
+	for _, arg := range args {
+		if id, err := strconv.Atoi(arg); err == nil {
+			ids = append(ids, id)
+			continue
+		}
+		if journal == nil {
+			waterlog.Fatalf("%s isn't a job ID, and there is no journal to look up batches in\n", arg)
+		}
+		entries := journal.Batch(arg)
+		if len(entries) == 0 {
+			waterlog.Fatalf("No jobs of batch %s are recorded in the journal\n", arg)
+		}
+		for _, entry := range entries {
+			ids = append(ids, entry.JobID)
+		}
+	}
+
+	failed := false
+	for _, id := range ids {
+		job, err := canceller.Cancel(id)
+		if err != nil {
+			waterlog.Errorf("Failed to cancel job %d: %s\n", id, err)
+			failed = true
+			continue
+		}
+		waterlog.Goodf("Job %d (%s) is %s\n", job.ID, job.Pkg, job.Phase())
+	}
+	if failed {
+		exit(1)
+	}
+}
+
+func runJobsRetry(cmd *cobra.Command, args []string) {
+	builder, journal := jobsBuilder(cmd)
+	if journal != nil {
+		defer journal.Close()
+	}
+
+	caps, err := push.QueryCapabilities(builder)
+	if err != nil {
+		fatalf(exitServer, "Failed to negotiate with the build server: %s\n", err)
+	}
+	requeuer, ok := builder.(push.Requeuer)
+	if !ok || !caps.Retry {
+		waterlog.Fatalf("The build server %s doesn't support retrying jobs\n", builder.Target())
+	}
+
+	var ids []int
+	for _, arg := range args {
+		id, err := strconv.Atoi(arg)
+		if err != nil {
+			waterlog.Fatalf("Invalid job ID %q\n", arg)
+		}
+		ids = append(ids, id)
+	}
+
+	failed := false
+	for _, id := range ids {
+		job, err := requeuer.Requeue(id)
+		if err != nil {
+			waterlog.Errorf("Failed to retry job %d: %s\n", id, err)
+			failed = true
+			continue
+		}
+		waterlog.Goodf("Retrying job %d (%s) as job %d, which is %s\n", id, job.Pkg, job.ID, job.Phase())
+
+		if journal == nil {
+			continue
+		}
+		if entry, ok := journal.FindJob(id); ok {
+			pkg := common.Package{Name: entry.Package, Version: entry.Version, Release: entry.Release}
+			if err = journal.Record(pkg, job, entry.Batch); err != nil {
+				waterlog.Errorf("Failed to record job %d in the journal: %s\n", job.ID, err)
+				failed = true
+			}
+		}
+	}
+	if failed {
+		exit(1)
+	}
+}
@@ -0,0 +1,133 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/DataDrake/waterlog"
+	st "github.com/GZGavinZhao/autobuild/state"
+	"github.com/spf13/cobra"
+)
+
+var (
+	lintRules  []string
+	lintOutput string
+	lintStrict bool
+	cmdLint    = &cobra.Command{
+		Use:     "lint [src:path]",
+		Aliases: []string{"validate"},
+		Short:   "Find problems in the recipes of a source tree",
+		Long: `Find problems in the recipes of a source tree, such as dependencies no
+package provides or malformed versions. For example: autobuild lint src:../packages
+
+Every problem has the ID of the rule that found it and a severity, and the
+command fails if there are errors, or warnings too with --strict, with exit
+code 3 if dependencies are unresolved. The json format is meant for CI.`,
+		Run:  runLint,
+		Args: cobra.ExactArgs(1),
+	}
+)
+
+// lintProblem is a problem in the JSON report of lint.
+type lintProblem struct {
+	Rule     string `json:"rule"`
+	Severity string `json:"severity"`
+	Package  string `json:"package"`
+	File     string `json:"file"`
+	Message  string `json:"message"`
+}
+
+type lintReport struct {
+	Problems []lintProblem `json:"problems"`
+	Errors   int           `json:"errors"`
+	Warnings int           `json:"warnings"`
+}
+
+func init() {
+	cmdLint.Flags().StringSliceVar(&lintRules, "rule", st.LintRuleNames(), fmt.Sprintf("rules to check, among %q", st.LintRuleNames()))
+	formatFlag(cmdLint, withReports("text")...)
+	cmdLint.Flags().StringVarP(&lintOutput, "output", "o", "", "write the problems to the given file instead of stdout")
+	cmdLint.Flags().BoolVar(&lintStrict, "strict", false, "fail on warnings too")
+}
+
+func runLint(cmd *cobra.Command, args []string) {
+	tpath := args[0]
+
+	// Keep stdout clean for the problems themselves.
+	if lintOutput == "" {
+		setLogOutput(os.Stderr)
+	}
+
+	format := getFormat(cmd)
+	for _, rule := range lintRules {
+		if !slices.Contains(st.LintRuleNames(), rule) {
+			waterlog.Fatalf("Unknown rule %s\n", rule)
+		}
+	}
+
+	state, err := st.LoadState(tpath)
+	if err != nil {
+		waterlog.Fatalf("Failed to parse state: %s\n", err)
+	}
+	srcState, ok := state.(*st.SourceState)
+	if !ok {
+		waterlog.Fatalf("Can only lint source states, not %s\n", tpath)
+	}
+
+	report := lintReport{Problems: []lintProblem{}}
+	for _, problem := range st.Lint(srcState, lintRules) {
+		pkg := srcState.Packages()[problem.Idx]
+		report.Problems = append(report.Problems, lintProblem{
+			Rule:     problem.Rule,
+			Severity: problem.Severity.String(),
+			Package:  pkg.Name,
+			File:     filepath.Join(pkg.Path, "package.yml"),
+			Message:  problem.Message,
+		})
+		if problem.Severity == st.SeverityError {
+			report.Errors++
+		} else {
+			report.Warnings++
+		}
+	}
+
+	var w io.Writer = os.Stdout
+	if lintOutput != "" {
+		f, err := os.Create(lintOutput)
+		if err != nil {
+			waterlog.Fatalf("Failed to create %s: %s\n", lintOutput, err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	if format != "text" {
+		err = writeReport(w, format, "lint", report)
+	} else {
+		var b strings.Builder
+		for _, problem := range report.Problems {
+			fmt.Fprintf(&b, "%s: %s: %s [%s]\n", problem.File, problem.Severity, problem.Message, problem.Rule)
+		}
+		_, err = io.WriteString(w, b.String())
+	}
+	if err != nil {
+		waterlog.Fatalf("Failed to write problems: %s\n", err)
+	}
+
+	if report.Errors > 0 || lintStrict && report.Warnings > 0 {
+		code := exitFailure
+		if slices.ContainsFunc(report.Problems, func(p lintProblem) bool { return p.Rule == "unresolved-dep" }) {
+			code = exitUnresolved
+		}
+		fatalf(code, "Found %d errors and %d warnings\n", report.Errors, report.Warnings)
+	}
+	waterlog.Goodf("Found %d errors and %d warnings\n", report.Errors, report.Warnings)
+}
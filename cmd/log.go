@@ -0,0 +1,133 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/DataDrake/waterlog"
+	"github.com/DataDrake/waterlog/format"
+	"github.com/fatih/color"
+	"golang.org/x/term"
+)
+
+// logFormats are the formats of log messages selected by --log-format.
+var logFormats = []string{"auto", "color", "plain", "json"}
+
+// logFormat is the format of log messages, one of logFormats. auto is color
+// when colors are used, see useColors, and plain otherwise.
+var logFormat string
+
+// noColor disables colors, like $NO_COLOR.
+var noColor bool
+
+// logEntry is a log message in the json format, one per line.
+type logEntry struct {
+	Time    time.Time `json:"time"`
+	Level   string    `json:"level"`
+	Message string    `json:"msg"`
+	// ID and Fields are those of messages, see message.
+	ID     string         `json:"id,omitempty"`
+	Fields map[string]any `json:"fields,omitempty"`
+}
+
+// setupLogging sets the format of log messages to `logFormat`.
+func setupLogging() {
+	if !slices.Contains(logFormats, logFormat) {
+		waterlog.SetFormat(plainFormat)
+		waterlog.Fatalf("Unknown log format %s, use one of %q\n", logFormat, logFormats)
+	}
+	setLogOutput(os.Stdout)
+}
+
+// setLogOutput writes log messages to `w`. Commands call it instead of
+// waterlog.SetOutput, so that json messages stay one per line, and colors are
+// only used if `w` can show them.
+func setLogOutput(w io.Writer) {
+	colored := useColors(w)
+	// Tables of packages and summaries are colored along with the messages.
+	color.NoColor = !colored
+	switch {
+	case logFormat == "json":
+		waterlog.SetFormat(jsonFormat)
+		w = lineWriter{w}
+	case colored:
+		waterlog.SetFormat(format.Min)
+	default:
+		waterlog.SetFormat(plainFormat)
+	}
+	waterlog.SetOutput(statusWriter{w})
+}
+
+// useColors tells whether to color what is written to `w`. --log-format color
+// always does, unless --no-color is given, and the auto format only does when
+// `w` is a terminal and $NO_COLOR isn't set, for logs captured by CI to be free
+// of escape sequences.
+func useColors(w io.Writer) bool {
+	switch {
+	case noColor || logFormat == "plain" || logFormat == "json":
+		return false
+	case logFormat == "color":
+		return true
+	case os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb":
+		return false
+	}
+	f, ok := w.(*os.File)
+	return ok && term.IsTerminal(int(f.Fd()))
+}
+
+// plainFormat formats log messages without colors or symbols, for logs that
+// aren't read in a terminal.
+func plainFormat(s format.Style, _ string, v ...any) string {
+	return fmt.Sprintf("%-7s %s", s.Msg, fmt.Sprint(v...))
+}
+
+// jsonFormat formats log messages as logEntry.
+func jsonFormat(s format.Style, _ string, v ...any) string {
+	entry := logEntry{
+		Time:    time.Now().UTC(),
+		Level:   logLevel(s),
+		Message: strings.TrimRight(fmt.Sprint(v...), "\n"),
+	}
+	if len(v) != 0 {
+		if m, ok := v[0].(message); ok {
+			entry.ID, entry.Fields = m.id, m.fields
+		}
+	}
+	raw, _ := json.Marshal(entry)
+	return string(raw)
+}
+
+// logLevel returns the name of the level of messages styled with `s`.
+func logLevel(s format.Style) string {
+	levels := []format.Style{format.Debug, format.Info, format.Good, format.Warn, format.Error, format.Fatal, format.Panic}
+	names := []string{"debug", "info", "good", "warn", "error", "fatal", "panic"}
+	if idx := slices.IndexFunc(levels, func(l format.Style) bool { return l.Level == s.Level }); idx >= 0 {
+		return names[idx]
+	}
+	return strings.ToLower(s.Msg)
+}
+
+// lineWriter ends every write with exactly one newline. Log messages are
+// written at once, with or without a newline depending on how they were
+// logged.
+type lineWriter struct {
+	w io.Writer
+}
+
+func (l lineWriter) Write(p []byte) (int, error) {
+	line := append(slices.Clone(bytes.TrimRight(p, "\n")), '\n')
+	if _, err := l.w.Write(line); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
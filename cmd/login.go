@@ -0,0 +1,94 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/DataDrake/waterlog"
+	"github.com/GZGavinZhao/autobuild/config"
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+)
+
+var (
+	loginTokenStdin bool
+	loginNoKeyring  bool
+	cmdLogin        = &cobra.Command{
+		Use:   "login [backend]",
+		Short: "Store the API token of a push backend",
+		Long: `Store the API token of a push backend (default from config) for later pushes.
+
+The token is stored in the OS keyring when one is available through secret-tool,
+and in the credentials file otherwise. The solus backend authenticates over SSH
+instead, see push.solus.identity in the configuration.`,
+		Run:  runLogin,
+		Args: cobra.MaximumNArgs(1),
+	}
+)
+
+// tokenBackends are the push backends that authenticate with an API token.
+var tokenBackends = []string{"summit", "webhook", "github", "gitlab"}
+
+func init() {
+	cmdLogin.Flags().BoolVar(&loginTokenStdin, "token-stdin", false, "read the token from stdin instead of prompting for it")
+	cmdLogin.Flags().BoolVar(&loginNoKeyring, "no-keyring", false, "store the token in the credentials file even if a keyring is available")
+}
+
+func runLogin(cmd *cobra.Command, args []string) {
+	userConfig, err := loadConfig()
+	if err != nil {
+		waterlog.Fatalf("Failed to load configuration: %s\n", err)
+	}
+
+	backend := ""
+	if len(args) == 1 {
+		backend = args[0]
+	}
+	backend = resolveBackend(backend, userConfig)
+
+	if !slices.Contains(tokenBackends, backend) {
+		waterlog.Fatalf("The %s backend doesn't use API tokens, only %q do\n", backend, tokenBackends)
+	}
+
+	var token string
+	if !loginTokenStdin && term.IsTerminal(int(os.Stdin.Fd())) {
+		fmt.Fprintf(os.Stderr, "API token for %s: ", backend)
+		raw, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			waterlog.Fatalf("Failed to read token: %s\n", err)
+		}
+		token = string(raw)
+	} else {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			waterlog.Fatalf("Failed to read token from stdin: %s\n", err)
+		}
+		token = line
+	}
+
+	token = strings.TrimSpace(token)
+	if token == "" {
+		waterlog.Fatalln("Refusing to store an empty token")
+	}
+
+	where, err := config.StoreToken(backend, token, !loginNoKeyring)
+	if err != nil {
+		waterlog.Fatalf("Failed to store token: %s\n", err)
+	}
+	waterlog.Goodf("Stored the token of %s in %s\n", backend, where)
+
+	for _, env := range config.TokenEnvs(backend) {
+		if os.Getenv(env) != "" {
+			waterlog.Warnf("%s is set and takes precedence over the stored token\n", env)
+			break
+		}
+	}
+}
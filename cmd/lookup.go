@@ -0,0 +1,152 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/DataDrake/waterlog"
+	"github.com/GZGavinZhao/autobuild/common"
+	st "github.com/GZGavinZhao/autobuild/state"
+)
+
+// queryDep is a build dependency of a looked up package, with the source
+// package providing it, if any.
+type queryDep struct {
+	Name     string `json:"name"`
+	Kind     string `json:"kind"`
+	Provider string `json:"provider,omitempty"`
+}
+
+// queryPackage is everything known about a looked up package.
+type queryPackage struct {
+	Name        string     `json:"name"`
+	Version     string     `json:"version"`
+	Release     int        `json:"release"`
+	Component   string     `json:"component"`
+	Path        string     `json:"path,omitempty"`
+	BuildDeps   []queryDep `json:"builddeps"`
+	Unresolved  []queryDep `json:"unresolved"`
+	RunDeps     []string   `json:"rundeps"`
+	Provides    []string   `json:"provides"`
+	Subpackages []string   `json:"subpackages"`
+	// Dependents counts the packages that depend on this one.
+	Dependents int `json:"dependents"`
+}
+
+// runLookup prints everything known about the package `name` of `tpath`, in
+// `format`.
+func runLookup(name string, tpath string, format string) {
+	// Keep stdout clean for the package itself.
+	setLogOutput(os.Stderr)
+
+	state, err := st.LoadState(tpath)
+	if err != nil {
+		waterlog.Fatalf("Failed to parse state: %s\n", err)
+	}
+	res, ok := lookupPackage(state, name)
+	if !ok {
+		waterlog.Fatalf("Unable to find package %s\n", name)
+	}
+	if res.Name != name {
+		if recipe, _ := st.RecipeName(name); recipe == res.Name {
+			waterlog.Infof("%s is the recipe of %s\n", name, res.Name)
+		} else {
+			waterlog.Infof("%s is provided by %s\n", name, res.Name)
+		}
+	}
+
+	if format != "text" {
+		err = writeReport(os.Stdout, format, "package", res)
+	} else {
+		err = writeLookupText(res)
+	}
+	if err != nil {
+		waterlog.Fatalf("Failed to write package: %s\n", err)
+	}
+}
+
+// lookupPackage returns everything known about the package `name` of
+// `state`, or false if there is no such package.
+func lookupPackage(state st.State, name string) (res queryPackage, ok bool) {
+	pkg, idx := st.GetPackage(state, name)
+	if idx < 0 {
+		return
+	}
+
+	res = queryPackage{
+		Name:        pkg.Name,
+		Version:     pkg.Version,
+		Release:     pkg.Release,
+		Component:   pkg.Component,
+		Path:        pkg.Path,
+		BuildDeps:   []queryDep{},
+		Unresolved:  []queryDep{},
+		RunDeps:     []string{},
+		Provides:    slices.DeleteFunc(slices.Clone(pkg.Provides), func(p string) bool { return p == pkg.Name }),
+		Subpackages: pkg.Subpackages,
+	}
+	// Source states mix the rundeps of package.yml into the build
+	// dependencies, since they are needed to build dependents too.
+	for _, dep := range pkg.BuildDeps {
+		kind := pkg.DepKind(dep)
+		if kind == common.RunDep {
+			res.RunDeps = append(res.RunDeps, dep)
+			continue
+		}
+		if depIdx, ok := state.NameToSrcIdx()[dep]; ok {
+			res.BuildDeps = append(res.BuildDeps, queryDep{Name: dep, Kind: kind.String(), Provider: state.Packages()[depIdx].Name})
+		} else {
+			res.Unresolved = append(res.Unresolved, queryDep{Name: dep, Kind: kind.String()})
+		}
+	}
+
+	if binState, ok := state.(*st.BinaryState); ok {
+		res.RunDeps = append(res.RunDeps, binState.RunDeps(idx)...)
+		res.Dependents = len(binState.Dependents(idx))
+	} else if srcState, ok := state.(*st.SourceState); ok {
+		res.Dependents = len(srcState.Dependents(idx))
+	}
+	slices.Sort(res.RunDeps)
+	res.RunDeps = slices.Compact(res.RunDeps)
+	if res.Provides == nil {
+		res.Provides = []string{}
+	}
+	if res.Subpackages == nil {
+		res.Subpackages = []string{}
+	}
+	return res, true
+}
+
+func writeLookupText(pkg queryPackage) error {
+	deps := func(deps []queryDep) string {
+		var parts []string
+		for _, dep := range deps {
+			part := fmt.Sprintf("%s (%s)", dep.Name, dep.Kind)
+			if dep.Provider != "" && dep.Provider != dep.Name {
+				part = fmt.Sprintf("%s (%s, from %s)", dep.Name, dep.Kind, dep.Provider)
+			}
+			parts = append(parts, part)
+		}
+		return strings.Join(parts, ", ")
+	}
+
+	_, err := fmt.Printf(`Name: %s
+Version: %s-%d
+Component: %s
+Path: %s
+Build dependencies: %s
+Unresolved build dependencies: %s
+Runtime dependencies: %s
+Provides: %s
+Subpackages: %s
+Dependents: %d
+`, pkg.Name, pkg.Version, pkg.Release, pkg.Component, pkg.Path, deps(pkg.BuildDeps), deps(pkg.Unresolved),
+		strings.Join(pkg.RunDeps, ", "), strings.Join(pkg.Provides, ", "), strings.Join(pkg.Subpackages, ", "), pkg.Dependents)
+	return err
+}
@@ -0,0 +1,225 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package cmd
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"slices"
+
+	"github.com/GZGavinZhao/autobuild/common"
+	"github.com/GZGavinZhao/autobuild/push"
+	"github.com/GZGavinZhao/autobuild/state"
+	"gopkg.in/yaml.v3"
+)
+
+// pushManifest describes the changes between two states and their build
+// order, for CI gates and bots.
+type pushManifest struct {
+	Bumped   []manifestPackage `json:"bumped" yaml:"bumped"`
+	Outdated []manifestPackage `json:"outdated" yaml:"outdated"`
+	// Bad packages have the same release number, but fail some of the checks
+	// of sameChecks, e.g. because they have a new version.
+	Bad []manifestBad `json:"bad" yaml:"bad"`
+	// Downgraded packages are bumped packages with an older version.
+	Downgraded []manifestPackage `json:"downgraded" yaml:"downgraded"`
+	// Added packages are bumped packages that are new.
+	Added []manifestPackage `json:"added" yaml:"added"`
+	// Unbumped packages have a changed recipe but the same version and
+	// release, unless --auto-bump is given.
+	Unbumped []manifestPackage `json:"unbumped" yaml:"unbumped"`
+	// AutoBumped lists the packages of Bumped that --auto-bump bumps, whose
+	// next release is only committed to their recipe when they are published.
+	AutoBumped []string `json:"auto-bumped" yaml:"auto-bumped"`
+	// Removed packages are gone from the new state, with their old version.
+	Removed    []manifestPackage    `json:"removed" yaml:"removed"`
+	Unresolved []manifestUnresolved `json:"unresolved" yaml:"unresolved"`
+	// Forbidden lists the outdated and downgraded packages that the
+	// downgrade policy blocks.
+	Forbidden []string `json:"forbidden" yaml:"forbidden"`
+	// Rebuilds lists the packages that weren't bumped but build-depend on
+	// bumped packages with a new version, with --suggest-rebuilds.
+	Rebuilds []manifestRebuild `json:"rebuilds" yaml:"rebuilds"`
+	// Skipped lists the bumped packages that were filtered out.
+	Skipped []string `json:"skipped" yaml:"skipped"`
+	// Order lists the bumped packages to publish in build order.
+	Order []manifestOrdered `json:"order" yaml:"order"`
+	// Streams lists the independent streams of Order by package name.
+	Streams [][]string `json:"streams" yaml:"streams"`
+}
+
+type manifestPackage struct {
+	Name    string            `json:"name" yaml:"name"`
+	Version string            `json:"version" yaml:"version"`
+	Release int               `json:"release" yaml:"release"`
+	Old     *push.PlanVersion `json:"old,omitempty" yaml:"old,omitempty"`
+	Path    string            `json:"path" yaml:"path"`
+	// Reason describes the change of the package, see state.Diff.Reason.
+	Reason string `json:"reason,omitempty" yaml:"reason,omitempty"`
+	// Security is set when the release is a security fix, see
+	// common.Package.Security.
+	Security bool `json:"security,omitempty" yaml:"security,omitempty"`
+}
+
+type manifestUnresolved struct {
+	manifestPackage `yaml:",inline"`
+	Missing         []string `json:"missing" yaml:"missing"`
+	// Deps details Missing, in the same order.
+	Deps []manifestMissing `json:"deps" yaml:"deps"`
+}
+
+// manifestMissing is a build dependency that no package provides.
+type manifestMissing struct {
+	Name string `json:"name" yaml:"name"`
+	// Kind is build, check or run.
+	Kind string `json:"kind" yaml:"kind"`
+	// Closest is the closest name that a package provides, if any is close
+	// enough to be a typo of Name.
+	Closest string `json:"closest,omitempty" yaml:"closest,omitempty"`
+}
+
+type manifestBad struct {
+	manifestPackage `yaml:",inline"`
+	// Checks lists the checks that the package failed.
+	Checks []string `json:"checks" yaml:"checks"`
+	// Forced is set when all of them are forced with --force-check.
+	Forced bool `json:"forced" yaml:"forced"`
+}
+
+type manifestRebuild struct {
+	manifestPackage `yaml:",inline"`
+	// Needs lists the bumped packages that the package build-depends on.
+	Needs []string `json:"needs" yaml:"needs"`
+}
+
+type manifestOrdered struct {
+	Name   string   `json:"name" yaml:"name"`
+	Stream int      `json:"stream" yaml:"stream"`
+	Deps   []string `json:"deps" yaml:"deps"`
+}
+
+func newManifestPackage(pkg common.Package, old *push.PlanVersion) manifestPackage {
+	return manifestPackage{
+		Name:     pkg.Name,
+		Version:  pkg.Version,
+		Release:  pkg.Release,
+		Old:      old,
+		Path:     pkg.Path,
+		Security: pkg.Security,
+	}
+}
+
+// newManifestDiff returns the entry of the package that `diff` is about, which
+// is `pkg` in the new state, or in the old state if it was removed.
+func newManifestDiff(pkg common.Package, diff state.Diff) manifestPackage {
+	var old *push.PlanVersion
+	if !diff.IsNew() && !diff.IsRemoved() {
+		old = &push.PlanVersion{Version: diff.OldVer, Release: diff.OldRelNum}
+	}
+	entry := newManifestPackage(pkg, old)
+	entry.Reason = diff.Reason()
+	return entry
+}
+
+func (m *pushManifest) setOrder(order pushOrder) {
+	for idx, pkg := range order.packages {
+		entry := manifestOrdered{Name: pkg.Name, Stream: order.streams[idx], Deps: []string{}}
+		for _, dep := range order.deps[idx] {
+			entry.Deps = append(entry.Deps, order.packages[dep].Name)
+		}
+		m.Order = append(m.Order, entry)
+
+		for len(m.Streams) <= entry.Stream {
+			m.Streams = append(m.Streams, []string{})
+		}
+		m.Streams[entry.Stream] = append(m.Streams[entry.Stream], pkg.Name)
+	}
+}
+
+// autoBumped returns the set of AutoBumped, see pushOrder.autoBumped.
+func (m *pushManifest) autoBumped() map[string]bool {
+	set := make(map[string]bool, len(m.AutoBumped))
+	for _, name := range m.AutoBumped {
+		set[name] = true
+	}
+	return set
+}
+
+// check exits if there are bad packages whose checks aren't forced, or
+// unbumped, unresolved or forbidden packages, unless `force` is set.
+// Unresolved packages exit with exitUnresolved, the rest with exitFailure.
+func (m *pushManifest) check(force bool) {
+	if force {
+		return
+	}
+	if len(m.Unresolved) != 0 {
+		exit(exitUnresolved)
+	}
+	bad := slices.ContainsFunc(m.Bad, func(pkg manifestBad) bool { return !pkg.Forced })
+	if bad || len(m.Unbumped) != 0 || len(m.Forbidden) != 0 {
+		exit(exitFailure)
+	}
+}
+
+// save writes the manifest in `format` to the file at `path`, or to stdout if
+// `path` is empty.
+func (m *pushManifest) save(path string, format string) error {
+	if path == "" {
+		return m.write(os.Stdout, format)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err = m.write(f, format); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (m *pushManifest) write(w io.Writer, format string) error {
+	// Always output lists, even when empty, so consumers don't need to
+	// handle nulls.
+	for _, list := range []*[]manifestPackage{&m.Bumped, &m.Outdated, &m.Downgraded, &m.Added, &m.Unbumped, &m.Removed} {
+		if *list == nil {
+			*list = []manifestPackage{}
+		}
+	}
+	if m.Bad == nil {
+		m.Bad = []manifestBad{}
+	}
+	if m.Unresolved == nil {
+		m.Unresolved = []manifestUnresolved{}
+	}
+	if m.Rebuilds == nil {
+		m.Rebuilds = []manifestRebuild{}
+	}
+	for _, list := range []*[]string{&m.AutoBumped, &m.Forbidden, &m.Skipped} {
+		if *list == nil {
+			*list = []string{}
+		}
+	}
+	if m.Order == nil {
+		m.Order = []manifestOrdered{}
+	}
+	if m.Streams == nil {
+		m.Streams = [][]string{}
+	}
+
+	if format == "yaml" {
+		enc := yaml.NewEncoder(w)
+		enc.SetIndent(2)
+		if err := enc.Encode(m); err != nil {
+			return err
+		}
+		return enc.Close()
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(m)
+}
@@ -0,0 +1,238 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package cmd
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/DataDrake/waterlog"
+	"github.com/GZGavinZhao/autobuild/utils"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	cmdConfigMessages = &cobra.Command{
+		Use:   "messages",
+		Short: "Print the templates of the messages that the configuration can reword",
+		Long: `Print the templates of the messages that the messages section of the
+configuration can reword, by ID, as YAML to copy into it. Templates are Go
+templates, given the fields that the defaults use.`,
+		Run:  runConfigMessages,
+		Args: cobra.NoArgs,
+	}
+)
+
+// messageTemplates are the default templates of the user-facing messages, by
+// ID. Distributions reword them, e.g. to name their own build server, in the
+// messages section of the configuration.
+var messageTemplates = map[string]string{
+	"state.parsed":     "Successfully parsed state!",
+	"state.parsed-old": "Successfully parsed old state!",
+	"state.parsed-new": "Successfully parsed new state!",
+	"diff.diffing":     "Diffing...",
+
+	"push.unbumped":         "The following packages changed without a new release number:",
+	"push.bad":              "The following packages have the same release number, but differ in ways that need a new one:",
+	"push.new":              "The following packages are new:",
+	"push.removed":          "The following packages were removed:",
+	"push.downgraded":       "The following packages have new release numbers but older versions:",
+	"push.outdated":         "The following packages have older release numbers:",
+	"push.unresolved":       "The following packages have nonexistent build dependencies:",
+	"push.updated":          "The following packages will be updated:",
+	"push.nothing":          "No packages to update. Exiting...",
+	"push.nothing-filtered": "No packages left to update after filtering. Exiting...",
+	"push.security-only":    "The following {{.count}} packages are security fixes:",
+	"push.order":            "Here's the build order:",
+	"push.order-streams":    "Here's the build order, split into {{.streams}} independent streams:",
+	"push.stream":           "Stream {{.stream}}:",
+	"push.confirm":          "Publish {{.count}} packages{{if .removing}} and drop {{.removing}} removed packages{{end}} to {{.servers}}? [y/N] ",
+	"push.unconfirmed":      "Refusing to publish without confirmation, pass --yes to publish from scripts",
+	"push.declined":         "Not publishing anything",
+	"push.auto-bump":        "{{.package}} will be bumped to release {{.release}} when it is published, since its recipe changed",
+	"push.bumped":           "Bumped the release of {{.package}} to {{.release}}, since its recipe changed",
+	"push.queued":           "{{.target}}{{.count}} package(s) are already queued or building, tracking their jobs instead: {{.packages}}",
+	"push.resuming":         "{{.target}}Resuming push from {{.journal}}, {{.count}} package(s) were already published",
+	"push.batch":            "Publishing as batch {{.batch}}",
+	"push.security":         "Publishing {{.count}} package(s) as security fixes",
+	"push.signed":           "Signed the provenance of the push with {{.key}}",
+	"push.retrying":         "{{.target}}Attempt {{.attempt}} of {{.attempts}} for {{.package}} failed, retrying in {{.delay}}: {{.error}}",
+	"push.published":        "All packages were published successfully!",
+	"push.indexed":          "All packages were built and indexed successfully!",
+	"push.stopped":          "{{.target}}Stopped the push, since {{.failed}} of its {{.count}} jobs failed",
+	"push.repush":           "Once the failures are fixed, re-push the rest with:",
+
+	"plan.written": "Wrote the plan to publish {{.count}} package(s) to {{.backend}} ({{.target}}) to {{.path}}",
+	"plan.loaded":  "Loaded plan {{.plan}} created at {{.created}}",
+	"plan.stale":   "The plan is out of date, please make a new one",
+
+	"repush.nothing": "No jobs of the push failed, nothing to publish",
+	"repush.failed":  "{{.failed}} package(s) failed, publishing them with their dependents, {{.count}} package(s) in total",
+
+	"server.no-capabilities":  "{{.target}}The build server doesn't report its capabilities, so batches, cancelling, retries, duplicate jobs, removals, priorities, wave hints and signatures are all left out",
+	"server.no-batches":       "{{.target}}The build server doesn't support batches, the push will only stop once {{.max_failures}} of its jobs failed",
+	"server.no-priorities":    "{{.target}}The build server doesn't support priorities, they will only order submissions",
+	"server.no-signatures":    "{{.target}}The build server doesn't verify signatures",
+	"server.drops-signatures": "{{.target}}The {{.backend}} backend can't send the signed provenance, the jobs are published without it",
+	"server.rate-limited":     "{{.target}}The build server is rate limiting, pausing submissions for {{.delay}}",
+	"server.no-removal":       "{{.target}}The build server doesn't support removing packages, they have to be dropped by hand",
+	"server.batch":            "{{.target}}Registered batch {{.batch}} of {{.count}} package(s)",
+	"server.removed":          "{{.target}}Removed {{.package}} {{.version}}-{{.release}}",
+
+	"notify.push":         "Pushed {{.count}} packages to {{.servers}} as batch {{.batch}} in {{.duration}}: {{.outcomes}}",
+	"notify.batch":        "{{.target}}Batch {{.batch}} is done on {{.server}}: {{.outcomes}}",
+	"notify.build-failed": "{{.target}}{{.package}} {{.version}}-{{.release}} failed to build on {{.server}} (job {{.job}} of batch {{.batch}})",
+	"notify.push-failed":  "{{.target}}Failed to publish batch {{.batch}} to {{.server}}: {{.error}}",
+}
+
+var (
+	messagesMu sync.Mutex
+	// customMessages are the templates of the configuration, see
+	// setMessages.
+	customMessages = map[string]*template.Template{}
+)
+
+// message is a user-facing message, rendered from its template once it is
+// logged or printed. In the json log format, its ID and fields are logged
+// along with it, for programs not to parse its text.
+type message struct {
+	id     string
+	fields map[string]any
+	// suffix is appended to the rendered message, for details that aren't
+	// part of its template.
+	suffix string
+}
+
+// msg returns the message `id` with the fields of `kv`, which holds pairs of
+// names and values, like the attributes of log/slog. Errors are kept as their
+// text, for the json log format. Every ID must be one of messageTemplates,
+// which TestMessageIDs checks.
+func msg(id string, kv ...any) message {
+	m := message{id: id, fields: make(map[string]any, len(kv)/2)}
+	for i := 0; i+1 < len(kv); i += 2 {
+		value := kv[i+1]
+		if err, ok := value.(error); ok && err != nil {
+			value = err.Error()
+		}
+		m.fields[fmt.Sprint(kv[i])] = value
+	}
+	return m
+}
+
+func (m message) String() string {
+	messagesMu.Lock()
+	tmpl := customMessages[m.id]
+	messagesMu.Unlock()
+
+	var b strings.Builder
+	// A custom template that uses fields the message doesn't have falls
+	// back to the default, rather than printing half a message.
+	if tmpl == nil || tmpl.Execute(&b, m.fields) != nil {
+		b.Reset()
+		text, ok := messageTemplates[m.id]
+		if !ok {
+			// An unknown message still tells what happened.
+			return m.fallback() + m.suffix
+		}
+		template.Must(newMessageTemplate(m.id, text)).Execute(&b, m.fields)
+	}
+	return b.String() + m.suffix
+}
+
+// fallback renders the message without a template, as its ID followed by its
+// fields.
+func (m message) fallback() string {
+	var b strings.Builder
+	b.WriteString(m.id)
+	for _, name := range utils.SortedKeys(m.fields) {
+		fmt.Fprintf(&b, " %s=%v", name, m.fields[name])
+	}
+	return b.String()
+}
+
+func newMessageTemplate(id string, text string) (*template.Template, error) {
+	return template.New(id).Option("missingkey=error").Parse(text)
+}
+
+// userLocale returns the locale of the messages, `configured` or else the one
+// of the environment, looked up like gettext does.
+func userLocale(configured string) string {
+	if configured != "" {
+		return configured
+	}
+	for _, name := range []string{"LC_ALL", "LC_MESSAGES", "LANG"} {
+		if locale := os.Getenv(name); locale != "" {
+			return locale
+		}
+	}
+	return ""
+}
+
+// localeNames returns the names that the translations of `locale` can be
+// found under, the most specific first, e.g. de_DE and de for de_DE.UTF-8.
+func localeNames(locale string) (names []string) {
+	locale, _, _ = strings.Cut(locale, ".")
+	locale, _, _ = strings.Cut(locale, "@")
+	if locale == "" || locale == "C" || locale == "POSIX" {
+		return nil
+	}
+	names = append(names, locale)
+	if lang, _, ok := strings.Cut(locale, "_"); ok {
+		names = append(names, lang)
+	}
+	return
+}
+
+// setMessages replaces the templates of the messages with the translations of
+// `locales` for `locale`, see localeNames, and then with `custom`, by ID,
+// warning about unknown IDs and invalid templates.
+func setMessages(custom map[string]string, locales map[string]map[string]string, locale string) {
+	// The configuration lowercases the names of locales.
+	byName := make(map[string]map[string]string, len(locales))
+	for name, messages := range locales {
+		byName[strings.ToLower(name)] = messages
+	}
+	templates := make(map[string]string)
+	names := localeNames(locale)
+	for i := len(names) - 1; i >= 0; i-- {
+		maps.Copy(templates, byName[strings.ToLower(names[i])])
+	}
+	maps.Copy(templates, custom)
+
+	messagesMu.Lock()
+	defer messagesMu.Unlock()
+	for _, id := range utils.SortedKeys(templates) {
+		if _, ok := messageTemplates[id]; !ok {
+			waterlog.Warnf("Unknown message %s in the configuration, see autobuild config messages\n", id)
+			continue
+		}
+		tmpl, err := newMessageTemplate(id, templates[id])
+		if err != nil {
+			waterlog.Warnf("Invalid template of message %s in the configuration: %s\n", id, err)
+			continue
+		}
+		customMessages[id] = tmpl
+	}
+}
+
+func runConfigMessages(cmd *cobra.Command, args []string) {
+	node := &yaml.Node{Kind: yaml.MappingNode}
+	for _, id := range utils.SortedKeys(messageTemplates) {
+		node.Content = append(node.Content,
+			&yaml.Node{Kind: yaml.ScalarNode, Value: id},
+			&yaml.Node{Kind: yaml.ScalarNode, Value: messageTemplates[id], Style: yaml.DoubleQuotedStyle})
+	}
+	enc := yaml.NewEncoder(os.Stdout)
+	enc.SetIndent(2)
+	if err := enc.Encode(map[string]*yaml.Node{"messages": node}); err != nil {
+		waterlog.Fatalf("Failed to write messages: %s\n", err)
+	}
+	enc.Close()
+}
@@ -0,0 +1,124 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package cmd
+
+import (
+	"errors"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"text/template"
+)
+
+// TestMessageIDs checks that every message that the commands log has a
+// default template, and that the templates parse.
+func TestMessageIDs(t *testing.T) {
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, ".", func(info fs.FileInfo) bool { return !strings.HasSuffix(info.Name(), "_test.go") }, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls := 0
+	for _, pkg := range pkgs {
+		ast.Inspect(pkg, func(node ast.Node) bool {
+			call, ok := node.(*ast.CallExpr)
+			if !ok {
+				return true
+			}
+			if fun, ok := call.Fun.(*ast.Ident); !ok || fun.Name != "msg" || len(call.Args) == 0 {
+				return true
+			}
+			calls++
+			lit, ok := call.Args[0].(*ast.BasicLit)
+			if !ok || lit.Kind != token.STRING {
+				t.Errorf("%s: the ID of the message isn't a string literal", fset.Position(call.Pos()))
+				return true
+			}
+			id, _ := strconv.Unquote(lit.Value)
+			if _, ok := messageTemplates[id]; !ok {
+				t.Errorf("%s: unknown message %s", fset.Position(call.Pos()), id)
+			}
+			return true
+		})
+	}
+	if calls == 0 {
+		t.Error("found no messages")
+	}
+
+	for id, text := range messageTemplates {
+		if _, err := newMessageTemplate(id, text); err != nil {
+			t.Errorf("invalid template of %s: %s", id, err)
+		}
+	}
+}
+
+func TestMessageString(t *testing.T) {
+	tests := []struct {
+		message message
+		want    string
+	}{
+		{msg("push.stream", "stream", 2), "Stream 2:"},
+		{msg("push.retrying", "target", "", "attempt", 1, "attempts", 3, "package", "glib", "delay", "1s", "error", errors.New("timeout")), "Attempt 1 of 3 for glib failed, retrying in 1s: timeout"},
+		{msg("push.unknown", "count", 2, "batch", "b1"), "push.unknown batch=b1 count=2"},
+		{msg("push.unknown"), "push.unknown"},
+	}
+	for _, tt := range tests {
+		if got := tt.message.String(); got != tt.want {
+			t.Errorf("msg(%s) = %q, want %q", tt.message.id, got, tt.want)
+		}
+	}
+}
+
+func TestLocaleNames(t *testing.T) {
+	tests := []struct {
+		locale string
+		want   []string
+	}{
+		{"", nil},
+		{"C", nil},
+		{"POSIX", nil},
+		{"C.UTF-8", nil},
+		{"de", []string{"de"}},
+		{"de_DE", []string{"de_DE", "de"}},
+		{"de_DE.UTF-8", []string{"de_DE", "de"}},
+		{"ca_ES@valencia", []string{"ca_ES", "ca"}},
+		{"sr_RS.UTF-8@latin", []string{"sr_RS", "sr"}},
+	}
+	for _, tt := range tests {
+		if got := localeNames(tt.locale); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("localeNames(%q) = %q, want %q", tt.locale, got, tt.want)
+		}
+	}
+}
+
+func TestSetMessages(t *testing.T) {
+	defer func() { customMessages = map[string]*template.Template{} }()
+	locales := map[string]map[string]string{
+		"de":    {"push.nothing": "Nichts zu tun", "push.order": "Reihenfolge:", "push.stream": "Strom {{.stream}}:"},
+		"de_AT": {"push.order": "Reihenfolge, bitte:"},
+	}
+	custom := map[string]string{"push.stream": "Lane {{.stream}}:"}
+	setMessages(custom, locales, "de_AT.UTF-8")
+
+	tests := []struct {
+		message message
+		want    string
+	}{
+		{msg("push.nothing"), "Nichts zu tun"},
+		{msg("push.order"), "Reihenfolge, bitte:"},
+		{msg("push.stream", "stream", 1), "Lane 1:"},
+		{msg("push.declined"), messageTemplates["push.declined"]},
+	}
+	for _, tt := range tests {
+		if got := tt.message.String(); got != tt.want {
+			t.Errorf("msg(%s) = %q, want %q", tt.message.id, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DataDrake/waterlog"
+	"github.com/GZGavinZhao/autobuild/push"
+	"github.com/GZGavinZhao/autobuild/utils"
+)
+
+// serveMetrics holds what the server measures besides the states and the
+// pushes, which /metrics reads when it is scraped.
+type serveMetrics struct {
+	mu sync.Mutex
+	// diffs holds the number of packages of every kind in the last diff
+	// answered between two states.
+	diffs map[[2]string]map[string]int
+	// probes holds the last probe of every build server.
+	probes []builderProbe
+}
+
+// builderProbe is the last request timed to a build server, see probeBuilder.
+type builderProbe struct {
+	target  pushTarget
+	time    time.Time
+	latency time.Duration
+	err     error
+}
+
+// recordDiff records `report` as the last diff between its states.
+func (m *serveMetrics) recordDiff(report diffReport) {
+	kinds := make(map[string]int)
+	for _, pkg := range report.Packages {
+		kinds[pkg.Kind]++
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.diffs[[2]string{report.Old, report.New}] = kinds
+}
+
+// probeTargets returns the build servers that pushes publish to by default:
+// the configured targets, or the build server of the configured backend.
+func probeTargets() (targets []pushTarget) {
+	userConfig, err := loadConfig()
+	if err != nil {
+		waterlog.Warnf("Failed to load the configuration, the build servers aren't probed: %s\n", err)
+		return nil
+	}
+	if len(userConfig.Push.Targets) == 0 {
+		builder, err := singleBuilder(resolveBackend("", userConfig), userConfig.Push)
+		if err != nil {
+			waterlog.Warnf("Failed to set up the build server backend, it isn't probed: %s\n", err)
+			return nil
+		}
+		return []pushTarget{{builder: builder}}
+	}
+	for _, target := range userConfig.Push.Targets {
+		builder, err := push.NewBuilder(target.Backend, target.PushConfig(userConfig.Push))
+		if err != nil {
+			waterlog.Warnf("Failed to set up the build server backend of target %s, it isn't probed: %s\n", target.Name, err)
+			continue
+		}
+		targets = append(targets, pushTarget{name: target.Name, builder: builder})
+	}
+	return
+}
+
+// probeBuilder sends a request that changes nothing to the build server of
+// `builder`: it asks servers for their capabilities, and checks that the
+// Solus build server can be reached. It returns false for backends without
+// a server to ask, such as local builds.
+func probeBuilder(builder push.Builder) (ok bool, err error) {
+	switch b := builder.(type) {
+	case push.Negotiator:
+		_, err = b.Capabilities()
+	case *push.SolusBuilder:
+		err = b.Ping()
+	default:
+		return false, nil
+	}
+	return true, err
+}
+
+// probe times a request to every build server of `targets` every
+// `interval`, starting right away.
+func (m *serveMetrics) probe(targets []pushTarget, interval time.Duration) {
+	for ; ; time.Sleep(interval) {
+		var probes []builderProbe
+		for _, target := range targets {
+			start := time.Now()
+			ok, err := probeBuilder(target.builder)
+			if !ok {
+				continue
+			}
+			if err != nil {
+				waterlog.Warnf("%sFailed to probe the build server %s: %s\n", target.label(), target.builder.Target(), err)
+			}
+			probes = append(probes, builderProbe{target: target, time: start, latency: time.Since(start), err: err})
+		}
+		m.mu.Lock()
+		m.probes = probes
+		m.mu.Unlock()
+	}
+}
+
+// metricsWriter writes metrics in the text format of Prometheus.
+type metricsWriter struct {
+	w io.Writer
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// family describes the metric `name`, whose `kind` is counter or gauge.
+func (m metricsWriter) family(name string, kind string, help string) {
+	fmt.Fprintf(m.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// sample writes a value of the metric `name`, with `labels` given as pairs of
+// a name and a value.
+func (m metricsWriter) sample(name string, value float64, labels ...string) {
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", labels[i], labelEscaper.Replace(labels[i+1])))
+	}
+	if len(pairs) != 0 {
+		name += "{" + strings.Join(pairs, ",") + "}"
+	}
+	fmt.Fprintf(m.w, "%s %s\n", name, strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+// seconds returns `t` as seconds since the epoch.
+func seconds(t time.Time) float64 {
+	return float64(t.UnixNano()) / 1e9
+}
+
+// writeMetrics answers /metrics with the freshness of the states, the
+// durations of their last loads, the sizes of the last diffs, the pushes by
+// status and the latency of the build servers.
+func (s *server) writeMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m := metricsWriter{w}
+
+	s.states.mu.RLock()
+	m.family("autobuild_state_loaded_timestamp_seconds", "gauge", "When the state was last loaded.")
+	for _, tpath := range serveStates {
+		if cached, ok := s.states.states[tpath]; ok {
+			m.sample("autobuild_state_loaded_timestamp_seconds", seconds(cached.loaded), "state", tpath)
+		}
+	}
+	m.family("autobuild_state_load_duration_seconds", "gauge", "How long the last load of the state took.")
+	for _, tpath := range serveStates {
+		if cached, ok := s.states.states[tpath]; ok {
+			m.sample("autobuild_state_load_duration_seconds", cached.took.Seconds(), "state", tpath)
+		}
+	}
+	m.family("autobuild_state_packages", "gauge", "Number of packages of the state.")
+	for _, tpath := range serveStates {
+		if cached, ok := s.states.states[tpath]; ok {
+			m.sample("autobuild_state_packages", float64(len(cached.state.Packages())), "state", tpath)
+		}
+	}
+	m.family("autobuild_state_load_failures_total", "counter", "Number of reloads of the state that failed.")
+	for _, tpath := range serveStates {
+		m.sample("autobuild_state_load_failures_total", float64(s.states.failures[tpath]), "state", tpath)
+	}
+	s.states.mu.RUnlock()
+
+	s.metrics.mu.Lock()
+	m.family("autobuild_diff_packages", "gauge", "Number of packages of every kind in the last diff answered between the states.")
+	diffs := make([][2]string, 0, len(s.metrics.diffs))
+	for states := range s.metrics.diffs {
+		diffs = append(diffs, states)
+	}
+	slices.SortFunc(diffs, func(a, b [2]string) int {
+		if c := strings.Compare(a[0], b[0]); c != 0 {
+			return c
+		}
+		return strings.Compare(a[1], b[1])
+	})
+	for _, states := range diffs {
+		kinds := s.metrics.diffs[states]
+		for _, kind := range utils.SortedKeys(kinds) {
+			m.sample("autobuild_diff_packages", float64(kinds[kind]), "old", states[0], "new", states[1], "kind", kind)
+		}
+	}
+	m.family("autobuild_build_server_up", "gauge", "Whether the last probe of the build server succeeded.")
+	for _, probe := range s.metrics.probes {
+		up := 1.0
+		if probe.err != nil {
+			up = 0
+		}
+		m.sample("autobuild_build_server_up", up, probeLabels(probe)...)
+	}
+	m.family("autobuild_build_server_latency_seconds", "gauge", "How long the last probe of the build server took.")
+	for _, probe := range s.metrics.probes {
+		m.sample("autobuild_build_server_latency_seconds", probe.latency.Seconds(), probeLabels(probe)...)
+	}
+	m.family("autobuild_build_server_probe_timestamp_seconds", "gauge", "When the build server was last probed.")
+	for _, probe := range s.metrics.probes {
+		m.sample("autobuild_build_server_probe_timestamp_seconds", seconds(probe.time), probeLabels(probe)...)
+	}
+	s.metrics.mu.Unlock()
+
+	s.mu.Lock()
+	statuses := map[string]int{"running": 0, "succeeded": 0, "failed": 0}
+	for _, job := range s.jobs {
+		statuses[job.Status]++
+	}
+	s.mu.Unlock()
+	m.family("autobuild_pushes_running", "gauge", "Number of pushes running.")
+	m.sample("autobuild_pushes_running", float64(statuses["running"]))
+	m.family("autobuild_pushes_total", "counter", "Number of pushes that finished, by status.")
+	for _, status := range []string{"succeeded", "failed"} {
+		m.sample("autobuild_pushes_total", float64(statuses[status]), "status", status)
+	}
+}
+
+// probeLabels returns the labels of the metrics of `probe`.
+func probeLabels(probe builderProbe) []string {
+	labels := []string{"backend", probe.target.builder.Name(), "server", probe.target.builder.Target()}
+	if probe.target.name != "" {
+		labels = append(labels, "target", probe.target.name)
+	}
+	return labels
+}
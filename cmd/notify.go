@@ -0,0 +1,93 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package cmd
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/DataDrake/waterlog"
+	"github.com/GZGavinZhao/autobuild/config"
+	"github.com/GZGavinZhao/autobuild/push"
+)
+
+// chatRoom is a chat room that a push posts to, along with the events it is
+// posted about.
+type chatRoom struct {
+	kind     string
+	notifier push.Notifier
+	events   []string
+}
+
+// notifiers post the events of a push to the chat rooms of the configuration,
+// in the background so that a slow chat doesn't hold up the push.
+type notifiers struct {
+	rooms []chatRoom
+	// log prints the warnings of failed posts, e.g. through the progress
+	// line.
+	log func(func())
+	wg  sync.WaitGroup
+}
+
+// newNotifiers sets up the chat rooms of `cfgs`, and exits if one is invalid.
+func newNotifiers(cfgs []config.NotifyConfig) *notifiers {
+	n := &notifiers{log: func(log func()) { log() }}
+	for i, cfg := range cfgs {
+		notifier, err := push.NewNotifier(cfg)
+		if err != nil {
+			waterlog.Fatalf("Invalid push.notify[%d]: %s\n", i, err)
+		}
+		events := cfg.Events
+		if len(events) == 0 {
+			events = []string{push.NotifyPush, push.NotifyFailure}
+		}
+		for _, event := range events {
+			if !slices.Contains(push.NotifyEvents, event) {
+				waterlog.Fatalf("Invalid push.notify[%d]: unknown event %q, expected one of %q\n", i, event, push.NotifyEvents)
+			}
+		}
+		n.rooms = append(n.rooms, chatRoom{kind: cfg.Kind, notifier: notifier, events: events})
+	}
+	return n
+}
+
+// notify posts `m` to the chat rooms that are posted about `event`.
+func (n *notifiers) notify(event string, m message) {
+	text := m.String()
+	for _, room := range n.rooms {
+		if !slices.Contains(room.events, event) {
+			continue
+		}
+		n.wg.Add(1)
+		go func(room chatRoom) {
+			defer n.wg.Done()
+			if err := room.notifier.Notify(text); err != nil {
+				n.log(func() { waterlog.Warnf("Failed to post the %s notification to %s: %s\n", event, room.kind, err) })
+			}
+		}(room)
+	}
+}
+
+// wait waits for the posts to be done.
+func (n *notifiers) wait() {
+	n.wg.Wait()
+}
+
+// outcomeCounts summarizes `result` as the number of packages of every
+// outcome, e.g. "12 succeeded, 1 failed, 3 blocked".
+func outcomeCounts(result push.Result) string {
+	var counts []string
+	for _, outcome := range []push.Outcome{push.Succeeded, push.Published, push.Failed, push.Blocked, push.Pending} {
+		if n := len(result.Select(outcome)); n != 0 {
+			counts = append(counts, fmt.Sprintf("%d %s", n, outcome))
+		}
+	}
+	if len(counts) == 0 {
+		return "nothing to publish"
+	}
+	return strings.Join(counts, ", ")
+}
@@ -0,0 +1,231 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/DataDrake/waterlog"
+	"github.com/GZGavinZhao/autobuild/common"
+	st "github.com/GZGavinZhao/autobuild/state"
+	"github.com/GZGavinZhao/autobuild/utils"
+	"github.com/spf13/cobra"
+)
+
+var (
+	orderFromFile string
+	orderOutput   string
+	orderExplain  bool
+	cmdOrder      = &cobra.Command{
+		Use:   "order [src|bin|repo:path] [packages]",
+		Short: "Print the build order of exactly the given packages",
+		Long: `Print the build order of exactly the given packages, without pulling in their
+dependencies or dependents. For example: autobuild order src:../packages glib gtk3
+
+Packages can also be read from a file with --from-file, one per line, with #
+comments. Every line of the text output is a tier of packages that can be
+built at once, after the packages of the previous lines.
+
+With --explain, every package is printed on its own line along with the given
+packages it waits on, and tiers are separated by blank lines:
+gtk4 ← after: glib2, pango`,
+		Run:               runOrder,
+		ValidArgsFunction: completePackages,
+		Args:              cobra.MinimumNArgs(1),
+	}
+)
+
+// orderReport is the JSON output of order.
+type orderReport struct {
+	Order []string   `json:"order"`
+	Tiers [][]string `json:"tiers"`
+	// After maps every package to the packages of the order it waits on, and
+	// is only set with --explain.
+	After map[string][]orderWait `json:"after,omitempty"`
+}
+
+// orderWait is a package of the order that another one waits on. Kind is how
+// the latter depends on it, or "indirect" if it goes through packages outside
+// of the order.
+type orderWait struct {
+	Name string `json:"name"`
+	Kind string `json:"kind"`
+}
+
+func init() {
+	cmdOrder.Flags().StringVar(&orderFromFile, "from-file", "", "read the packages from the given file, one per line")
+	formatFlag(cmdOrder, withReports("text", "dot")...)
+	cmdOrder.Flags().StringVarP(&orderOutput, "output", "o", "", "write the order to the given file instead of stdout")
+	cmdOrder.Flags().BoolVar(&orderExplain, "explain", false, "annotate every package with the packages of the order it waits on")
+}
+
+func runOrder(cmd *cobra.Command, args []string) {
+	tpath := args[0]
+	names := args[1:]
+
+	// Keep stdout clean for the order itself.
+	if orderOutput == "" {
+		setLogOutput(os.Stderr)
+	}
+
+	format := getFormat(cmd)
+
+	if orderFromFile != "" {
+		fromFile, err := readPatterns(orderFromFile)
+		if err != nil {
+			waterlog.Fatalf("Failed to read packages from %s: %s\n", orderFromFile, err)
+		}
+		names = append(names, fromFile...)
+	}
+	if len(names) == 0 {
+		waterlog.Fatalln("No packages given, pass them as arguments or with --from-file")
+	}
+
+	state, err := st.LoadState(tpath)
+	if err != nil {
+		waterlog.Fatalf("Failed to parse state: %s\n", err)
+	}
+	waterlog.Goodln(msg("state.parsed", "tpath", tpath))
+
+	depGraph := state.DepGraph()
+	if depGraph == nil {
+		waterlog.Fatalf("Failed to obtain dependency graph of state %s\n", tpath)
+	}
+
+	qset := map[int]bool{}
+	for _, idx := range packageIdxs(state, names) {
+		qset[idx] = true
+	}
+
+	lifted := utils.LiftSelection(depGraph, utils.SortedKeys(qset))
+	order := tieredOrder(state, lifted)
+	pkgs := state.Packages()
+	pkg := func(liftedIdx int) common.Package { return pkgs[lifted.Nodes[liftedIdx]] }
+
+	var w io.Writer = os.Stdout
+	if orderOutput != "" {
+		f, err := os.Create(orderOutput)
+		if err != nil {
+			waterlog.Fatalf("Failed to create %s: %s\n", orderOutput, err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	switch format {
+	case "dot":
+		err = utils.WriteDOT(w, lifted, func(int) bool { return true }, func(v int) utils.DOTAttrs {
+			return utils.DOTAttrs{"label": fmt.Sprintf("%s\n%s-%d", pkg(v).Name, pkg(v).Version, pkg(v).Release)}
+		}, func(v, w int, _ int64) utils.DOTAttrs {
+			kind := edgeKind(depGraph, lifted.Nodes[v], lifted.Nodes[w])
+			attrs := utils.DOTAttrs{"color": depKindColors[kind], "label": kind}
+			if kind == indirectDepKind {
+				attrs["style"] = "dashed"
+			}
+			return attrs
+		})
+	case "json", "yaml":
+		report := newOrderReport(state, lifted, order)
+		if orderExplain {
+			report.After = orderWaits(state, lifted, order)
+		}
+		err = writeReport(w, format, "order", report)
+	default:
+		if orderExplain {
+			_, err = io.WriteString(w, explainOrder(state, lifted, order))
+			break
+		}
+		for _, names := range newOrderReport(state, lifted, order).Tiers {
+			if _, err = fmt.Fprintln(w, strings.Join(names, " ")); err != nil {
+				break
+			}
+		}
+	}
+
+	if err != nil {
+		waterlog.Fatalf("Failed to write order: %s\n", err)
+	}
+}
+
+// newOrderReport returns the names of the packages of the tiered order of
+// `lifted`, a selection of the packages of `state`.
+func newOrderReport(state st.State, lifted *utils.Subgraph, order [][]int) (report orderReport) {
+	report.Order = []string{}
+	for _, tier := range order {
+		var names []string
+		for _, liftedIdx := range tier {
+			names = append(names, state.Packages()[lifted.Nodes[liftedIdx]].Name)
+		}
+		report.Order = append(report.Order, names...)
+		report.Tiers = append(report.Tiers, names)
+	}
+	return
+}
+
+// orderWaits returns, for every package of the tiered order of `lifted`, the
+// packages of the order that it waits on, in build order.
+func orderWaits(state st.State, lifted *utils.Subgraph, order [][]int) map[string][]orderWait {
+	pkgs := state.Packages()
+	position := make(map[int]int)
+	for _, tier := range order {
+		for _, v := range tier {
+			position[v] = len(position)
+		}
+	}
+
+	preds := make(map[int][]int)
+	for v := 0; v < lifted.Order(); v++ {
+		lifted.Visit(v, func(w int, _ int64) (skip bool) {
+			if w != v {
+				preds[w] = append(preds[w], v)
+			}
+			return
+		})
+	}
+
+	res := make(map[string][]orderWait)
+	for v := range position {
+		waits := []orderWait{}
+		slices.SortFunc(preds[v], func(a, b int) int { return position[a] - position[b] })
+		for _, u := range preds[v] {
+			waits = append(waits, orderWait{Name: pkgs[lifted.Nodes[u]].Name, Kind: edgeKind(state.DepGraph(), lifted.Nodes[u], lifted.Nodes[v])})
+		}
+		res[pkgs[lifted.Nodes[v]].Name] = waits
+	}
+	return res
+}
+
+// explainOrder formats the tiered order of `lifted` with a package per line,
+// along with the packages it waits on, e.g. "gtk4 ← after: glib2, pango".
+func explainOrder(state st.State, lifted *utils.Subgraph, order [][]int) string {
+	waits := orderWaits(state, lifted, order)
+	var b strings.Builder
+	for i, names := range newOrderReport(state, lifted, order).Tiers {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		for _, name := range names {
+			b.WriteString(name)
+			if len(waits[name]) == 0 {
+				b.WriteString("\n")
+				continue
+			}
+			var after []string
+			for _, wait := range waits[name] {
+				if wait.Kind == indirectDepKind {
+					after = append(after, wait.Name+" (indirect)")
+				} else {
+					after = append(after, wait.Name)
+				}
+			}
+			fmt.Fprintf(&b, " ← after: %s\n", strings.Join(after, ", "))
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,130 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/DataDrake/waterlog"
+	st "github.com/GZGavinZhao/autobuild/state"
+	"github.com/spf13/cobra"
+)
+
+var (
+	orphansOutput     string
+	orphansComponents []string
+	cmdOrphans        = &cobra.Command{
+		Use:   "orphans <src:path> [bin|repo:path]",
+		Short: "Find packages that nothing needs anymore",
+		Long: `Find the source packages of a tree that no other package build-, check- or
+run-depends on, and, given a binary state, the binary packages of the
+repository whose source package no longer exists in the tree or doesn't build
+them anymore. For example: autobuild orphans src:../packages repo:unstable
+
+Applications are usually needed without anything depending on them, and can be
+left out by component with --exclude-component.`,
+		Run:  runOrphans,
+		Args: cobra.RangeArgs(1, 2),
+	}
+)
+
+// orphanPackage is a source package that nothing depends on, in the report of
+// orphans.
+type orphanPackage struct {
+	Name      string `json:"name"`
+	Component string `json:"component"`
+	Path      string `json:"path"`
+}
+
+type orphansReport struct {
+	Packages []orphanPackage `json:"packages"`
+	// Binaries is only set with a binary state.
+	Binaries []st.Orphan `json:"binaries,omitempty"`
+}
+
+func init() {
+	formatFlag(cmdOrphans, withReports("text")...)
+	cmdOrphans.Flags().StringVarP(&orphansOutput, "output", "o", "", "write the orphans to the given file instead of stdout")
+	cmdOrphans.Flags().StringSliceVar(&orphansComponents, "exclude-component", nil, "leave out packages in these components or their subcomponents, e.g. desktop")
+}
+
+func runOrphans(cmd *cobra.Command, args []string) {
+	// Keep stdout clean for the orphans themselves.
+	if orphansOutput == "" {
+		setLogOutput(os.Stderr)
+	}
+
+	format := getFormat(cmd)
+
+	state, err := st.LoadState(args[0])
+	if err != nil {
+		waterlog.Fatalf("Failed to parse state: %s\n", err)
+	}
+	if _, ok := state.(*st.SourceState); !ok {
+		waterlog.Fatalf("Can only find orphans in source states, not %s\n", args[0])
+	}
+
+	excluded := pushFilter{components: orphansComponents}
+	report := orphansReport{Packages: []orphanPackage{}}
+	for _, idx := range st.Orphans(state) {
+		pkg := state.Packages()[idx]
+		if len(orphansComponents) != 0 && excluded.match(pkg) {
+			continue
+		}
+		report.Packages = append(report.Packages, orphanPackage{Name: pkg.Name, Component: pkg.Component, Path: pkg.Path})
+	}
+	slices.SortFunc(report.Packages, func(a, b orphanPackage) int { return strings.Compare(a.Name, b.Name) })
+
+	if len(args) == 2 {
+		binState, err := st.LoadState(args[1])
+		if err != nil {
+			waterlog.Fatalf("Failed to parse state %s: %s\n", args[1], err)
+		}
+		bin, ok := binState.(*st.BinaryState)
+		if !ok {
+			waterlog.Fatalf("Can only find stale binaries in binary states, not %s\n", args[1])
+		}
+		report.Binaries = st.StaleBinaries(bin, state)
+	}
+	waterlog.Goodln("Successfully parsed states!")
+
+	var w io.Writer = os.Stdout
+	if orphansOutput != "" {
+		f, err := os.Create(orphansOutput)
+		if err != nil {
+			waterlog.Fatalf("Failed to create %s: %s\n", orphansOutput, err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	if format != "text" {
+		err = writeReport(w, format, "orphans", report)
+	} else {
+		var b strings.Builder
+		fmt.Fprintf(&b, "Source packages nothing depends on (%d):\n", len(report.Packages))
+		for _, pkg := range report.Packages {
+			if pkg.Component == "" {
+				fmt.Fprintf(&b, "  %s\n", pkg.Name)
+			} else {
+				fmt.Fprintf(&b, "  %s (%s)\n", pkg.Name, pkg.Component)
+			}
+		}
+		if len(args) == 2 {
+			fmt.Fprintf(&b, "\nBinary packages without a source (%d):\n", len(report.Binaries))
+			for _, orphan := range report.Binaries {
+				fmt.Fprintf(&b, "  %s (from %s)\n", orphan.Name, orphan.Source)
+			}
+		}
+		_, err = io.WriteString(w, b.String())
+	}
+	if err != nil {
+		waterlog.Fatalf("Failed to write orphans: %s\n", err)
+	}
+}
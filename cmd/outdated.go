@@ -0,0 +1,177 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/DataDrake/waterlog"
+	st "github.com/GZGavinZhao/autobuild/state"
+	"github.com/GZGavinZhao/autobuild/upstream"
+	"github.com/GZGavinZhao/autobuild/utils"
+	"github.com/spf13/cobra"
+)
+
+var (
+	outdatedOutput  string
+	outdatedMonitor string
+	outdatedURL     string
+	outdatedJobs    int
+	cmdOutdated     = &cobra.Command{
+		Use:   "outdated <src:path>",
+		Short: "Find the packages that are behind their latest release upstream",
+		Long: `Look up the latest release of every package of a source tree upstream, and
+report the packages whose recipe has an older version. For example:
+autobuild outdated src:../packages --format json -o outdated.json
+
+Packages are looked up on release-monitoring.org (Anitya) by the project ID in
+their monitoring.yaml, or else by their name in Solus, or with --monitor
+repology, by their name in the Solus repository of Repology. The packages that
+the monitor doesn't know are listed as unknown.`,
+		Run:  runOutdated,
+		Args: cobra.ExactArgs(1),
+	}
+)
+
+// outdatedPackage is a package that is behind upstream, in the report of
+// outdated.
+type outdatedPackage struct {
+	Name      string `json:"name"`
+	Component string `json:"component,omitempty"`
+	Version   string `json:"version"`
+	Latest    string `json:"latest"`
+	// URL is the page of the project on the monitor.
+	URL  string `json:"url,omitempty"`
+	Path string `json:"path"`
+}
+
+type outdatedReport struct {
+	Monitor string `json:"monitor"`
+	// Checked is the number of packages that were looked up.
+	Checked  int               `json:"checked"`
+	Packages []outdatedPackage `json:"packages"`
+	// Unknown lists the packages that the monitor doesn't know, or whose
+	// latest version can't be compared.
+	Unknown []string `json:"unknown"`
+}
+
+func init() {
+	formatFlag(cmdOutdated, withReports("text")...)
+	cmdOutdated.Flags().StringVarP(&outdatedOutput, "output", "o", "", "write the report to the given file instead of stdout")
+	cmdOutdated.Flags().StringVar(&outdatedMonitor, "monitor", "anitya", fmt.Sprintf("where to look up releases, one of %q", upstream.Monitors))
+	cmdOutdated.Flags().StringVar(&outdatedURL, "monitor-url", "", "URL of a self-hosted instance of the monitor")
+	cmdOutdated.Flags().IntVarP(&outdatedJobs, "jobs", "j", 8, "number of packages looked up at the same time")
+	filterFlags(cmdOutdated)
+}
+
+func runOutdated(cmd *cobra.Command, args []string) {
+	// Keep stdout clean for the report itself.
+	if outdatedOutput == "" {
+		setLogOutput(os.Stderr)
+	}
+	format := getFormat(cmd)
+	filter := getFilter(cmd)
+	monitor, err := upstream.New(outdatedMonitor, outdatedURL)
+	if err != nil {
+		waterlog.Fatalf("Invalid --monitor: %s\n", err)
+	}
+	upstream.UserAgent = "autobuild/" + Version
+
+	state, err := st.LoadState(args[0])
+	if err != nil {
+		waterlog.Fatalf("Failed to parse state: %s\n", err)
+	}
+	if _, ok := state.(*st.SourceState); !ok {
+		waterlog.Fatalf("Can only compare source states with upstream, not %s\n", args[0])
+	}
+	waterlog.Goodln(msg("state.parsed", "tpath", args[0]))
+
+	var idxs []int
+	for idx, pkg := range state.Packages() {
+		if filter.match(pkg) {
+			idxs = append(idxs, idx)
+		}
+	}
+	waterlog.Infof("Looking up %d packages on %s\n", len(idxs), monitor.Name())
+
+	releases := make([]upstream.Release, len(idxs))
+	found := make([]bool, len(idxs))
+	errs := make([]error, len(idxs))
+	utils.ParallelForLimit(len(idxs), outdatedJobs, func(i int) {
+		releases[i], found[i], errs[i] = monitor.Latest(state.Packages()[idxs[i]])
+	})
+
+	var summary errorSummary
+	// Monitors that list all packages at once fail all of them with the same
+	// error, which is only reported once.
+	var lastErr error
+	report := outdatedReport{Monitor: monitor.Name(), Packages: []outdatedPackage{}, Unknown: []string{}}
+	for i, idx := range idxs {
+		pkg := state.Packages()[idx]
+		if errs[i] != nil {
+			if errs[i] != lastErr {
+				summary.add(exitServer, "Failed to look up %s: %s\n", pkg.Name, errs[i])
+			}
+			lastErr = errs[i]
+			continue
+		}
+		report.Checked++
+		if !found[i] {
+			report.Unknown = append(report.Unknown, pkg.Name)
+			continue
+		}
+		cmp, err := upstream.Compare(pkg.Version, releases[i])
+		if errors.Is(err, upstream.ErrUnknown) {
+			waterlog.Debugf("The latest version %s of %s can't be compared\n", releases[i].Version, pkg.Name)
+			report.Unknown = append(report.Unknown, pkg.Name)
+			continue
+		}
+		if cmp < 0 {
+			report.Packages = append(report.Packages, outdatedPackage{
+				Name:      pkg.Name,
+				Component: pkg.Component,
+				Version:   pkg.Version,
+				Latest:    releases[i].Version,
+				URL:       releases[i].URL,
+				Path:      pkg.Path,
+			})
+		}
+	}
+
+	var w io.Writer = os.Stdout
+	if outdatedOutput != "" {
+		f, err := os.Create(outdatedOutput)
+		if err != nil {
+			waterlog.Fatalf("Failed to create %s: %s\n", outdatedOutput, err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	if format != "text" {
+		err = writeReport(w, format, "outdated", report)
+	} else {
+		var b strings.Builder
+		fmt.Fprintf(&b, "Packages behind upstream (%d of %d):\n", len(report.Packages), report.Checked)
+		for _, pkg := range report.Packages {
+			fmt.Fprintf(&b, "  %s: %s -> %s\n", pkg.Name, pkg.Version, pkg.Latest)
+		}
+		if len(report.Unknown) != 0 {
+			fmt.Fprintf(&b, "\nPackages unknown to %s (%d):\n", report.Monitor, len(report.Unknown))
+			for _, name := range report.Unknown {
+				fmt.Fprintf(&b, "  %s\n", name)
+			}
+		}
+		_, err = io.WriteString(w, b.String())
+	}
+	if err != nil {
+		waterlog.Fatalf("Failed to write the report: %s\n", err)
+	}
+	summary.exit()
+}
@@ -0,0 +1,184 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/DataDrake/waterlog"
+	"github.com/GZGavinZhao/autobuild/common"
+	st "github.com/GZGavinZhao/autobuild/state"
+	"github.com/GZGavinZhao/autobuild/utils"
+	"github.com/spf13/cobra"
+)
+
+var (
+	pathFrom   []string
+	pathTo     []string
+	pathK      int
+	pathKinds  []string
+	pathOutput string
+	cmdPath    = &cobra.Command{
+		Use:   "path [src:path] --from packages --to packages",
+		Short: "Print the dependency paths between two sets of packages",
+		Long: `Print the dependency paths from the --from packages to the --to packages, i.e.
+the chains of packages through which the --to packages depend on the --from
+ones, shortest first. For example, to find out why gtk3 is rebuilt for zlib:
+autobuild path src:../packages --from zlib --to gtk3 --kind build
+
+Only the 10 shortest paths are printed unless -k says otherwise, since there
+can be exponentially many of them, and -k 0 prints them all. Paths don't go
+through other --from or --to packages, since those contain shorter paths.`,
+		Run:  runPath,
+		Args: cobra.ExactArgs(1),
+	}
+)
+
+// defaultPathK is the default of -k. Densely connected packages have far too
+// many paths between them to find them all.
+const defaultPathK = 10
+
+// pathStep is a package on a path, in the JSON output of path. Kind is how the
+// package depends on the previous one, and is empty for the first one.
+type pathStep struct {
+	Name string `json:"name"`
+	Kind string `json:"kind,omitempty"`
+}
+
+func init() {
+	cmdPath.Flags().StringSliceVar(&pathFrom, "from", nil, "packages the paths start from, which the others depend on")
+	cmdPath.Flags().StringSliceVar(&pathTo, "to", nil, "packages the paths end at")
+	cmdPath.Flags().IntVarP(&pathK, "k", "k", defaultPathK, "only print the k shortest paths, or all of them with 0, which can take exponentially long")
+	cmdPath.Flags().StringSliceVar(&pathKinds, "kind", []string{common.BuildDep.String(), common.CheckDep.String(), common.RunDep.String()}, "kinds of dependencies to follow")
+	formatFlag(cmdPath, "text", "json", "dot")
+	cmdPath.Flags().StringVarP(&pathOutput, "output", "o", "", "write the paths to the given file instead of stdout")
+	cmdPath.MarkFlagRequired("from")
+	cmdPath.MarkFlagRequired("to")
+	cmdPath.RegisterFlagCompletionFunc("from", completePackageList)
+	cmdPath.RegisterFlagCompletionFunc("to", completePackageList)
+}
+
+func runPath(cmd *cobra.Command, args []string) {
+	tpath := args[0]
+
+	// Keep stdout clean for the paths themselves.
+	if pathOutput == "" {
+		setLogOutput(os.Stderr)
+	}
+
+	format := getFormat(cmd)
+	var kinds []int64
+	for _, name := range pathKinds {
+		idx := slices.IndexFunc([]common.DepKind{common.BuildDep, common.CheckDep, common.RunDep}, func(kind common.DepKind) bool { return kind.String() == name })
+		if idx < 0 {
+			waterlog.Fatalf("Unknown dependency kind %s\n", name)
+		}
+		kinds = append(kinds, int64(idx)+int64(common.BuildDep))
+	}
+
+	state, err := st.LoadState(tpath)
+	if err != nil {
+		waterlog.Fatalf("Failed to parse state: %s\n", err)
+	}
+	depGraph := state.DepGraph()
+	if depGraph == nil {
+		waterlog.Fatalf("%s has no dependency graph to find paths in\n", tpath)
+	}
+	waterlog.Goodln(msg("state.parsed", "tpath", tpath))
+
+	from, to := packageIdxs(state, pathFrom), packageIdxs(state, pathTo)
+
+	follow := func(_, _ int, cost int64) bool { return slices.Contains(kinds, cost) }
+	if pathK < 0 {
+		waterlog.Fatalf("-k must be positive, or 0 for all the paths, got %d\n", pathK)
+	}
+	// One more path tells whether some were left out.
+	limit := pathK
+	if limit != 0 {
+		limit++
+	}
+	paths := utils.Paths(depGraph, from, to, limit, follow)
+	if pathK != 0 && len(paths) > pathK {
+		paths = paths[:pathK]
+		waterlog.Infof("Only printing the %d shortest paths, -k 0 prints all of them\n", pathK)
+	}
+	if len(paths) == 0 {
+		// The sets are easily mixed up.
+		if len(utils.Paths(depGraph, to, from, 1, follow)) != 0 {
+			waterlog.Fatalln("No --to package depends on a --from package, but the other way around: swap --from and --to")
+		}
+		waterlog.Fatalln("No --to package depends on a --from package")
+	}
+
+	var w io.Writer = os.Stdout
+	if pathOutput != "" {
+		f, err := os.Create(pathOutput)
+		if err != nil {
+			waterlog.Fatalf("Failed to create %s: %s\n", pathOutput, err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	pkgs := state.Packages()
+	switch format {
+	case "dot":
+		onPath, edges := make(map[int]bool), make(map[[2]int]bool)
+		for _, path := range paths {
+			for i, v := range path {
+				onPath[v] = true
+				if i > 0 {
+					edges[[2]int{path[i-1], v}] = true
+				}
+			}
+		}
+		err = utils.WriteDOT(w, depGraph, func(v int) bool { return onPath[v] }, func(v int) utils.DOTAttrs {
+			attrs := utils.DOTAttrs{"label": pkgs[v].Name}
+			if slices.Contains(from, v) || slices.Contains(to, v) {
+				attrs["style"] = "bold"
+			}
+			return attrs
+		}, func(v, w int, _ int64) utils.DOTAttrs {
+			if !edges[[2]int{v, w}] {
+				return nil
+			}
+			kind := edgeKind(depGraph, v, w)
+			return utils.DOTAttrs{"color": depKindColors[kind], "label": kind}
+		})
+	case "json":
+		res := make([][]pathStep, len(paths))
+		for pIdx, path := range paths {
+			for i, v := range path {
+				step := pathStep{Name: pkgs[v].Name}
+				if i > 0 {
+					step.Kind = edgeKind(depGraph, path[i-1], v)
+				}
+				res[pIdx] = append(res[pIdx], step)
+			}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(res)
+	default:
+		var b strings.Builder
+		for _, path := range paths {
+			b.WriteString(pkgs[path[0]].Name)
+			for i, v := range path[1:] {
+				fmt.Fprintf(&b, " -[%s]-> %s", edgeKind(depGraph, path[i], v), pkgs[v].Name)
+			}
+			b.WriteString("\n")
+		}
+		_, err = io.WriteString(w, b.String())
+	}
+	if err != nil {
+		waterlog.Fatalf("Failed to write paths: %s\n", err)
+	}
+	waterlog.Goodf("Found %d paths\n", len(paths))
+}
@@ -0,0 +1,187 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package cmd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/DataDrake/waterlog"
+	"github.com/GZGavinZhao/autobuild/common"
+	"github.com/spf13/cobra"
+)
+
+// defaultPinFile is the pin file that is read unless another one is given.
+const defaultPinFile = ".autobuildpins"
+
+var (
+	pinFile string
+	cmdPin  = &cobra.Command{
+		Use:   "pin [packages]",
+		Short: "Pin packages so that they are never pushed or rebuilt",
+		Long: `Add the given packages (glob patterns allowed) to the pin file, or list the
+pinned packages without arguments. push, plan, apply, tui and rebuild refuse to
+include pinned packages, e.g. the toolchain during a freeze, until they are
+unpinned or explicitly excluded with --exclude.`,
+		Run:               runPin,
+		ValidArgsFunction: completePackages,
+	}
+	cmdUnpin = &cobra.Command{
+		Use:               "unpin <packages>",
+		Short:             "Unpin packages pinned with \"autobuild pin\"",
+		Run:               runUnpin,
+		ValidArgsFunction: completePins,
+		Args:              cobra.MinimumNArgs(1),
+	}
+)
+
+func init() {
+	cmdPin.Flags().StringVar(&pinFile, "pin-file", defaultPinFile, "file listing the pinned packages")
+	cmdUnpin.Flags().StringVar(&pinFile, "pin-file", defaultPinFile, "file listing the pinned packages")
+}
+
+// pinFlag adds the flag to choose the pin file to `cmd`.
+func pinFlag(cmd *cobra.Command) {
+	cmd.Flags().String("pin-file", defaultPinFile, "file listing packages that must not be included, one name or glob pattern per line (skipped if missing)")
+}
+
+// pinList holds the patterns of the packages that must not be included.
+type pinList struct {
+	file     string
+	patterns []string
+}
+
+// getPins reads the pin file chosen by the flags of `cmd`. It is optional
+// unless given explicitly, and an empty path disables pins.
+func getPins(cmd *cobra.Command) (pins pinList) {
+	pins.file, _ = cmd.Flags().GetString("pin-file")
+	if pins.file == "" {
+		return
+	}
+	patterns, err := readPatterns(pins.file)
+	if errors.Is(err, fs.ErrNotExist) && !cmd.Flags().Changed("pin-file") {
+		return
+	} else if err != nil {
+		waterlog.Fatalf("Failed to read pin file %s: %s\n", pins.file, err)
+	}
+	pins.patterns = patterns
+	return
+}
+
+// check exits if any of `pkgs` is pinned, listing the pinned packages that
+// prevent the operation, e.g. "push". `leaveOut` tells how to leave pinned
+// packages out of the operation, if possible.
+func (p pinList) check(pkgs []common.Package, operation string, leaveOut string) {
+	var pinned []string
+	for _, pkg := range pkgs {
+		idx := slices.IndexFunc(p.patterns, func(pattern string) bool {
+			ok, _ := path.Match(pattern, pkg.Name)
+			return ok
+		})
+		if idx < 0 {
+			continue
+		}
+		if p.patterns[idx] == pkg.Name {
+			pinned = append(pinned, pkg.Name)
+		} else {
+			pinned = append(pinned, fmt.Sprintf("%s (pinned by %s)", pkg.Name, p.patterns[idx]))
+		}
+	}
+	if len(pinned) == 0 {
+		return
+	}
+
+	waterlog.Errorf("Refusing to %s pinned packages, see %s:\n", operation, p.file)
+	for _, name := range pinned {
+		waterlog.Errorf("  %s\n", name)
+	}
+	if leaveOut == "" {
+		waterlog.Fatalln("Unpin them with `autobuild unpin` first")
+	}
+	waterlog.Fatalf("Unpin them with `autobuild unpin`, or %s\n", leaveOut)
+}
+
+func runPin(cmd *cobra.Command, args []string) {
+	pins, err := readPatterns(pinFile)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		waterlog.Fatalf("Failed to read pin file %s: %s\n", pinFile, err)
+	}
+
+	if len(args) == 0 {
+		for _, pin := range pins {
+			fmt.Println(pin)
+		}
+		return
+	}
+
+	args = recipeNames(args)
+	checkPatterns(args)
+	f, err := os.OpenFile(pinFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		waterlog.Fatalf("Failed to open pin file %s: %s\n", pinFile, err)
+	}
+	defer f.Close()
+	for _, pin := range args {
+		if slices.Contains(pins, pin) {
+			waterlog.Infof("%s is already pinned\n", pin)
+			continue
+		}
+		if _, err := fmt.Fprintln(f, pin); err != nil {
+			waterlog.Fatalf("Failed to write pin file %s: %s\n", pinFile, err)
+		}
+		pins = append(pins, pin)
+		waterlog.Goodf("Pinned %s\n", pin)
+	}
+}
+
+// completePins completes the arguments of unpin with the pinned packages.
+func completePins(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	pins, _ := readPatterns(pinFile)
+	return slices.DeleteFunc(pins, func(pin string) bool { return slices.Contains(args, pin) }), cobra.ShellCompDirectiveNoFileComp
+}
+
+func runUnpin(cmd *cobra.Command, args []string) {
+	raw, err := os.ReadFile(pinFile)
+	if err != nil {
+		waterlog.Fatalf("Failed to read pin file %s: %s\n", pinFile, err)
+	}
+
+	// Comments and other pins are kept as they are.
+	var lines []string
+	unpinned := make(map[string]bool)
+	scanner := bufio.NewScanner(strings.NewReader(string(raw)))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if pin := strings.TrimSpace(line); slices.Contains(args, pin) {
+			unpinned[pin] = true
+			continue
+		}
+		lines = append(lines, line)
+	}
+
+	for _, pin := range args {
+		if !unpinned[pin] {
+			waterlog.Warnf("%s isn't pinned\n", pin)
+		}
+	}
+	content := strings.Join(lines, "\n")
+	if len(lines) != 0 {
+		content += "\n"
+	}
+	if err := os.WriteFile(pinFile, []byte(content), 0644); err != nil {
+		waterlog.Fatalf("Failed to write pin file %s: %s\n", pinFile, err)
+	}
+	for _, pin := range args {
+		if unpinned[pin] {
+			waterlog.Goodf("Unpinned %s\n", pin)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package cmd
+
+import (
+	"cmp"
+	"fmt"
+	"html/template"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/DataDrake/waterlog"
+	"github.com/GZGavinZhao/autobuild/common"
+	"github.com/GZGavinZhao/autobuild/push"
+	"github.com/GZGavinZhao/autobuild/state"
+	"github.com/GZGavinZhao/autobuild/version"
+)
+
+// The stages of the pipeline from a source tree to the stable repository that
+// a package can be in, in the order they are reported in.
+const (
+	// stageNew packages are only in the source tree.
+	stageNew = "new"
+	// stageUnbuilt packages have a newer release in the source tree than in
+	// unstable.
+	stageUnbuilt = "unbuilt"
+	// stagePendingSync packages are built in unstable, but stable has an
+	// older release.
+	stagePendingSync = "pending-sync"
+	// stageOutdated packages have an older release in the source tree than
+	// in unstable.
+	stageOutdated = "outdated"
+	// stageBad packages have the same release in the source tree as in
+	// unstable, but a different version.
+	stageBad = "bad"
+	// stageRemoved packages are gone from the source tree, but not from the
+	// repositories.
+	stageRemoved = "removed"
+)
+
+var pipelineStages = []string{stageNew, stageUnbuilt, stagePendingSync, stageOutdated, stageBad, stageRemoved}
+
+var pipelineStageTitles = map[string]string{
+	stageNew:         "New",
+	stageUnbuilt:     "Not built in unstable yet",
+	stagePendingSync: "Pending sync to stable",
+	stageOutdated:    "Older release than unstable",
+	stageBad:         "Same release as unstable, different version",
+	stageRemoved:     "Removed",
+}
+
+// pipelineReport places the packages of a source tree in the pipeline to the
+// stable repository.
+type pipelineReport struct {
+	Source   string            `json:"source"`
+	Unstable string            `json:"unstable"`
+	Stable   string            `json:"stable"`
+	Packages []pipelinePackage `json:"packages"`
+}
+
+type pipelinePackage struct {
+	Name  string `json:"name"`
+	Stage string `json:"stage"`
+	// The versions are omitted for states without the package.
+	Source    *push.PlanVersion `json:"source,omitempty"`
+	Unstable  *push.PlanVersion `json:"unstable,omitempty"`
+	Stable    *push.PlanVersion `json:"stable,omitempty"`
+	Component string            `json:"component,omitempty"`
+}
+
+// Title returns the description of the stage of the package.
+func (p pipelinePackage) Title() string {
+	return pipelineStageTitles[p.Stage]
+}
+
+// pipelineStage returns the stage of a package from its versions in the
+// source tree, unstable and stable, or "" if it has gone all the way through.
+func pipelineStage(source, unstable, stable *push.PlanVersion) string {
+	switch {
+	case source == nil:
+		return stageRemoved
+	case unstable == nil && stable == nil:
+		return stageNew
+	case unstable == nil || source.Release > unstable.Release:
+		return stageUnbuilt
+	case source.Release < unstable.Release:
+		return stageOutdated
+	case version.Compare(source.Version, unstable.Version) != 0:
+		return stageBad
+	case stable == nil || stable.Release < unstable.Release:
+		return stagePendingSync
+	}
+	return ""
+}
+
+// stateVersions returns the version of every package of `s` by name, along
+// with the packages themselves.
+func stateVersions(s state.State) (versions map[string]*push.PlanVersion, pkgs map[string]common.Package) {
+	versions = make(map[string]*push.PlanVersion)
+	pkgs = make(map[string]common.Package)
+	for _, pkg := range s.Packages() {
+		versions[pkg.Name] = &push.PlanVersion{Version: pkg.Version, Release: pkg.Release}
+		pkgs[pkg.Name] = pkg
+	}
+	return
+}
+
+// runPipelineDiff diffs a source tree against the unstable and stable
+// repositories, given as the TPaths of `args` in that order, and writes the
+// report in `format`. It returns the number of packages that aren't synced to
+// stable yet.
+func runPipelineDiff(args []string, format string, filter pushFilter) (changed int) {
+	var versions [3]map[string]*push.PlanVersion
+	var pkgs [3]map[string]common.Package
+	for i, tpath := range args {
+		s, err := state.LoadState(tpath)
+		if err != nil {
+			waterlog.Fatalf("Failed to load state %s: %s\n", tpath, err)
+		}
+		waterlog.Goodf("Successfully parsed state %s!\n", tpath)
+		versions[i], pkgs[i] = stateVersions(s)
+	}
+
+	waterlog.Infoln(msg("diff.diffing"))
+	names := make(map[string]bool)
+	for i := range pkgs {
+		for name := range pkgs[i] {
+			names[name] = true
+		}
+	}
+
+	report := pipelineReport{Source: args[0], Unstable: args[1], Stable: args[2], Packages: []pipelinePackage{}}
+	for name := range names {
+		entry := pipelinePackage{Name: name, Source: versions[0][name], Unstable: versions[1][name], Stable: versions[2][name]}
+		if entry.Stage = pipelineStage(entry.Source, entry.Unstable, entry.Stable); entry.Stage == "" {
+			continue
+		}
+
+		// Describe the package as in the newest state that has it.
+		var pkg common.Package
+		for i := range pkgs {
+			var ok bool
+			if pkg, ok = pkgs[i][name]; ok {
+				break
+			}
+		}
+		if !filter.match(pkg) {
+			continue
+		}
+		entry.Component = pkg.Component
+		report.Packages = append(report.Packages, entry)
+	}
+	slices.SortFunc(report.Packages, func(a, b pipelinePackage) int {
+		if c := cmp.Compare(slices.Index(pipelineStages, a.Stage), slices.Index(pipelineStages, b.Stage)); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	w, done := diffWriter()
+	defer done()
+
+	var err error
+	switch format {
+	case "json", "yaml":
+		err = writeReport(w, format, "pipeline-diff", report)
+	case "md":
+		err = writePipelineMarkdown(w, report)
+	case "html":
+		err = pipelineHTML.Execute(w, report)
+	default:
+		err = writePipelineText(w, report)
+	}
+	if err != nil {
+		waterlog.Fatalf("Failed to write the diff: %s\n", err)
+	}
+	return len(report.Packages)
+}
+
+func writePipelineText(w io.Writer, report pipelineReport) error {
+	for _, pkg := range report.Packages {
+		_, err := fmt.Fprintf(w, "%s: %s: source %s, unstable %s, stable %s\n", pkg.Title(), pkg.Name, versionString(pkg.Source), versionString(pkg.Unstable), versionString(pkg.Stable))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writePipelineMarkdown(w io.Writer, report pipelineReport) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "## Changes of `%s` against `%s` and `%s`\n\n", report.Source, report.Unstable, report.Stable)
+	if len(report.Packages) == 0 {
+		b.WriteString("No changes.\n")
+	} else {
+		b.WriteString("| Package | Stage | Source | Unstable | Stable |\n")
+		b.WriteString("| --- | --- | --- | --- | --- |\n")
+		for _, pkg := range report.Packages {
+			fmt.Fprintf(&b, "| %s | %s | %s | %s | %s |\n", pkg.Name, pkg.Title(), versionString(pkg.Source), versionString(pkg.Unstable), versionString(pkg.Stable))
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+var pipelineHTML = template.Must(template.New("pipeline").Funcs(template.FuncMap{"version": versionString}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Changes of {{.Source}} against {{.Unstable}} and {{.Stable}}</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+th, td { border: 1px solid #ccc; padding: 0.25em 0.75em; text-align: left; }
+tr.outdated, tr.bad { background: #fdd; }
+tr.removed { background: #ffd; }
+</style>
+</head>
+<body>
+<h2>Changes of <code>{{.Source}}</code> against <code>{{.Unstable}}</code> and <code>{{.Stable}}</code></h2>
+{{- if .Packages}}
+<table>
+<tr><th>Package</th><th>Stage</th><th>Source</th><th>Unstable</th><th>Stable</th></tr>
+{{- range .Packages}}
+<tr class="{{.Stage}}"><td>{{.Name}}</td><td>{{.Title}}</td><td>{{version .Source}}</td><td>{{version .Unstable}}</td><td>{{version .Stable}}</td></tr>
+{{- end}}
+</table>
+{{- else}}
+<p>No changes.</p>
+{{- end}}
+</body>
+</html>
+`))
@@ -0,0 +1,88 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package cmd
+
+import (
+	"time"
+
+	"github.com/DataDrake/waterlog"
+	"github.com/GZGavinZhao/autobuild/push"
+	"github.com/spf13/cobra"
+)
+
+var (
+	planOutput   string
+	planForce    bool
+	planAutoBump bool
+	planSuggest  bool
+	cmdPlan      = &cobra.Command{
+		Use:   "plan <[src|bin|repo]:path-to-old> <[src|bin|repo]:path-to-new>",
+		Short: "Record a push to be reviewed and applied later",
+		Long: `Record the changed packages, their build order, and the build server to publish
+them to in a plan file, without publishing anything. Once reviewed, the plan is
+executed with "autobuild apply".`,
+		Run:  runPlan,
+		Args: defaultStatesArgs(2),
+	}
+)
+
+func init() {
+	cmdPlan.Flags().StringVarP(&planOutput, "output", "o", "plan.json", "file to write the plan to")
+	cmdPlan.Flags().BoolVarP(&planForce, "force", "f", false, "whether to ignore safety checks")
+	cmdPlan.Flags().BoolVar(&planAutoBump, "auto-bump", false, "plan to bump and commit the release of packages whose recipe changed without one, which apply does")
+	backendFlag(cmdPlan)
+	filterFlags(cmdPlan)
+	commitFlags(cmdPlan)
+	cmdPlan.Flags().BoolVar(&planSuggest, "suggest-rebuilds", false, "list the packages that weren't bumped but build-depend on packages with a new version")
+	downgradeFlags(cmdPlan)
+	checkFlags(cmdPlan)
+	pinFlag(cmdPlan)
+}
+
+func runPlan(cmd *cobra.Command, args []string) {
+	args = defaultStates(cmd, args)
+	checkoutOnly(args[1])
+	backend, _ := cmd.Flags().GetString("backend")
+
+	opts := diffOptions{autoBump: planAutoBump, filter: getFilter(cmd), downgrades: getDowngradePolicy(cmd), checks: getChecks(cmd), suggestRebuilds: planSuggest, pins: getPins(cmd)}
+	order, ok := changedOrder(args[0], args[1], planForce, opts)
+	if !ok {
+		return
+	}
+
+	userConfig, err := loadConfig()
+	if err != nil {
+		waterlog.Fatalf("Failed to load configuration: %s\n", err)
+	}
+	builder, err := singleBuilder(resolveBackend(backend, userConfig), userConfig.Push)
+	if err != nil {
+		waterlog.Fatalf("Failed to set up build server backend: %s\n", err)
+	}
+
+	plan := push.Plan{
+		Version: push.PlanSchemaVersion,
+		Created: time.Now().UTC(),
+		Old:     args[0],
+		New:     args[1],
+		Backend: builder.Name(),
+		Target:  builder.Target(),
+	}
+	for idx, pkg := range order.packages {
+		plan.Packages = append(plan.Packages, push.PlanPackage{
+			Name:     pkg.Name,
+			Version:  pkg.Version,
+			Release:  pkg.Release,
+			Old:      order.old[idx],
+			Deps:     append([]int{}, order.deps[idx]...),
+			Stream:   order.streams[idx],
+			AutoBump: order.autoBumped[pkg.Name],
+		})
+	}
+
+	if err = plan.Save(planOutput); err != nil {
+		waterlog.Fatalf("Failed to save plan: %s\n", err)
+	}
+	waterlog.Goodln(msg("plan.written", "count", len(plan.Packages), "backend", plan.Backend, "target", plan.Target, "path", planOutput))
+}
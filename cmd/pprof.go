@@ -0,0 +1,78 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package cmd
+
+import (
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+
+	"github.com/DataDrake/waterlog"
+)
+
+// The files of the hidden --cpuprofile, --memprofile and --trace flags, to
+// diagnose slow parsing, lifting or sorting on the trees where it happens.
+var (
+	cpuProfile string
+	memProfile string
+	traceFile  string
+)
+
+var cpuProfileFile, traceOutFile *os.File
+
+// startProfiling starts the CPU profile and the execution trace that the flags
+// ask for.
+func startProfiling() {
+	var err error
+	if cpuProfile != "" {
+		if cpuProfileFile, err = os.Create(cpuProfile); err != nil {
+			waterlog.Fatalf("Failed to create CPU profile: %s\n", err)
+		}
+		if err = pprof.StartCPUProfile(cpuProfileFile); err != nil {
+			waterlog.Fatalf("Failed to start CPU profile: %s\n", err)
+		}
+	}
+	if traceFile != "" {
+		if traceOutFile, err = os.Create(traceFile); err != nil {
+			waterlog.Fatalf("Failed to create trace: %s\n", err)
+		}
+		if err = trace.Start(traceOutFile); err != nil {
+			waterlog.Fatalf("Failed to start trace: %s\n", err)
+		}
+	}
+}
+
+// stopProfiling writes the profiles and the trace that the flags ask for. It
+// is called once the command is done, see exit, and does nothing the second
+// time.
+func stopProfiling() {
+	if cpuProfileFile != nil {
+		pprof.StopCPUProfile()
+		cpuProfileFile.Close()
+		cpuProfileFile = nil
+	}
+	if traceOutFile != nil {
+		trace.Stop()
+		traceOutFile.Close()
+		traceOutFile = nil
+	}
+	if memProfile != "" {
+		f, err := os.Create(memProfile)
+		memProfile = ""
+		if err != nil {
+			waterlog.Errorf("Failed to create memory profile: %s\n", err)
+			return
+		}
+		defer f.Close()
+		// Once the command is done, little of what it loaded is still live,
+		// so the profile is the one of every allocation, whose sizes
+		// `go tool pprof -sample_index=alloc_space` shows.
+		runtime.GC()
+		if err = pprof.Lookup("allocs").WriteTo(f, 0); err != nil {
+			waterlog.Errorf("Failed to write memory profile: %s\n", err)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/GZGavinZhao/autobuild/push"
+	"golang.org/x/term"
+)
+
+// progressLine keeps the progress of every target on the last line of the
+// terminal, below the log lines.
+type progressLine struct {
+	mu       sync.Mutex
+	targets  []pushTarget
+	progress []push.Progress
+	started  time.Time
+	drawn    bool
+	// finished is set once the push is done, after which log lines are
+	// printed without the line, such as the warnings of late notifications.
+	finished bool
+}
+
+// newProgressLine returns the progress line of a push to `targets`, or nil if
+// stdout isn't a terminal to draw it on.
+func newProgressLine(targets []pushTarget) *progressLine {
+	// JSON logs are parsed by programs, not read.
+	if !term.IsTerminal(int(os.Stdout.Fd())) || logFormat == "json" {
+		return nil
+	}
+	return &progressLine{
+		targets:  targets,
+		progress: make([]push.Progress, len(targets)),
+		started:  time.Now(),
+	}
+}
+
+// update sets the progress of the target at `tIdx`.
+func (l *progressLine) update(tIdx int, progress push.Progress) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.progress[tIdx] = progress
+	l.clear()
+	l.draw()
+}
+
+// log calls `fn`, which prints log lines, above the progress line. Without a
+// progress line, `fn` is just called.
+func (l *progressLine) log(fn func()) {
+	if l == nil {
+		fn()
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.clear()
+	fn()
+	l.draw()
+}
+
+// done removes the progress line for good, if any.
+func (l *progressLine) done() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.clear()
+	l.finished = true
+}
+
+func (l *progressLine) clear() {
+	if l.drawn {
+		fmt.Print("\r\033[K")
+		l.drawn = false
+	}
+}
+
+func (l *progressLine) draw() {
+	if l.finished {
+		return
+	}
+	var parts []string
+	for tIdx, target := range l.targets {
+		progress := l.progress[tIdx]
+		part := fmt.Sprintf("%s%d/%d submitted, wave %d/%d, %d succeeded", target.label(), progress.Submitted, progress.Total, progress.Wave, progress.Waves, progress.Succeeded)
+		if progress.Failed != 0 {
+			part += fmt.Sprintf(", %d failed", progress.Failed)
+		}
+		if progress.Blocked != 0 {
+			part += fmt.Sprintf(", %d blocked", progress.Blocked)
+		}
+		parts = append(parts, part)
+	}
+	line := fmt.Sprintf("%s | %s", strings.Join(parts, " | "), time.Since(l.started).Round(time.Second))
+
+	// A wrapped line can't be cleared anymore.
+	if width, _, err := term.GetSize(int(os.Stdout.Fd())); err == nil && width > 1 {
+		if runes := []rune(line); len(runes) >= width {
+			line = string(runes[:width-2]) + "…"
+		}
+	}
+	fmt.Print(line)
+	l.drawn = true
+}
+
+// printSummary prints how many packages of the push ended up with which
+// outcome on every target.
+func printSummary(targets []pushTarget, results []push.Result, elapsed time.Duration) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TARGET\tTOTAL\tSUCCEEDED\tFAILED\tBLOCKED\tUNFINISHED\tNOT PUBLISHED")
+	for tIdx, target := range targets {
+		name := target.name
+		if name == "" {
+			name = target.builder.Target()
+		}
+		result := results[tIdx]
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%d\t%d\n", name, len(result.Outcomes),
+			len(result.Select(push.Succeeded)), len(result.Select(push.Failed)), len(result.Select(push.Blocked)),
+			len(result.Select(push.Published)), len(result.Select(push.Pending)))
+	}
+	w.Flush()
+	fmt.Printf("Took %s\n", elapsed.Round(time.Second))
+}
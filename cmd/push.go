@@ -4,237 +4,1130 @@
 
 package cmd
 
-// import (
-// 	"fmt"
-// 	"os"
-// 	"time"
-// 
-// 	"github.com/DataDrake/waterlog"
-// 	"github.com/GZGavinZhao/autobuild/common"
-// 	"github.com/GZGavinZhao/autobuild/push"
-// 	"github.com/GZGavinZhao/autobuild/state"
-// 	"github.com/GZGavinZhao/autobuild/utils"
-// 	"github.com/briandowns/spinner"
-// 	"github.com/dominikbraun/graph"
-// 	"github.com/dominikbraun/graph/draw"
-// 	"github.com/fatih/color"
-// 	"github.com/spf13/cobra"
-// )
-// 
-// var (
-// 	cmdPush = &cobra.Command{
-// 		Use:   "push <[src|bin|repo]:path-to-old> <[src|bin|repo]:path-to-new>",
-// 		Short: "Push package changes to the build server",
-// 		Run:   runPush,
-// 		Args:  cobra.ExactArgs(2),
-// 	}
-// )
-// 
-// func init() {
-// 	cmdPush.Flags().BoolP("force", "f", false, "whether to ignore safety checks")
-// 	cmdPush.Flags().BoolP("dry-run", "n", true, "don't publish anything")
-// 	cmdPush.Flags().BoolP("push", "p", true, "git push packages before publishing")
-// }
-// 
-// func runPush(cmd *cobra.Command, args []string) {
-// 	oldTPath := args[0]
-// 	newTPath := args[1]
-// 
-// 	var oldState, newState state.State
-// 
-// 	oldState, err := state.LoadState(oldTPath)
-// 	if err != nil {
-// 		waterlog.Fatalf("Failed to load old state %s: %s\n", oldTPath, err)
-// 	}
-// 	waterlog.Goodln("Successfully parsed old state!")
-// 
-// 	newState, err = state.LoadState(newTPath)
-// 	if err != nil {
-// 		waterlog.Fatalf("Failed to load new state %s: %s\n", newTPath, err)
-// 	}
-// 	waterlog.Goodln("Successfully parsed new state!")
-// 
-// 	waterlog.Infoln("Diffing...")
-// 	changes := state.Changed(&oldState, &newState)
-// 
-// 	bumped := []common.Package{}
-// 	bset := make(map[int]bool)
-// 	outdated := []common.Package{}
-// 	bad := []common.Package{}
-// 
-// 	for _, diff := range changes {
-// 		pkg := newState.Packages()[diff.Idx]
-// 		if diff.IsNewRel() {
-// 			bumped = append(bumped, pkg)
-// 			bset[diff.Idx] = true
-// 		} else if diff.IsSameRel() && !diff.IsSame() {
-// 			bad = append(bad, pkg)
-// 		} else if diff.IsDowngrade() {
-// 			outdated = append(outdated, pkg)
-// 		}
-// 	}
-// 
-// 	force, _ := cmd.Flags().GetBool("force")
-// 	dryRun, _ := cmd.Flags().GetBool("dry-run")
-// 	prePush, _ := cmd.Flags().GetBool("push")
-// 
-// 	if len(bad) != 0 {
-// 		waterlog.Warnf("The following packages have the same release number but different version:")
-// 		for _, pkg := range bad {
-// 			waterlog.Printf(" %s", pkg.Name)
-// 		}
-// 		waterlog.Println()
-// 		if !force {
-// 			os.Exit(1)
-// 		}
-// 	}
-// 
-// 	if len(outdated) != 0 {
-// 		waterlog.Warnf("The following packages have older release numbers:")
-// 		for _, pkg := range outdated {
-// 			waterlog.Printf(" %s", pkg.Name)
-// 		}
-// 		waterlog.Println()
-// 	}
-// 
-// 	if len(bumped) == 0 {
-// 		waterlog.Infoln("No packages to update. Exiting...")
-// 		return
-// 	}
-// 
-// 	// Check that the dependencies of every package already exist
-// 	var unresolved []common.Package
-// 	for _, pkg := range bumped {
-// 		// TODO: we should probably just be able to call pkg.Resolved?
-// 		if len(pkg.Resolve(newState.NameToSrcIdx(), newState.Packages())) > 0 {
-// 			unresolved = append(unresolved, pkg)
-// 		}
-// 	}
-// 	if len(unresolved) != 0 {
-// 		// waterlog.Errorf("The following packages have nonexistent build dependencies:")
-// 		waterlog.Errorln("The following packages have nonexistent build dependencies:")
-// 		for _, pkg := range unresolved {
-// 			// waterlog.Printf(" %s", pkg.Name)
-// 			waterlog.Errorf("%s:", pkg.Name)
-// 			for _, dep := range pkg.BuildDeps {
-// 				if _, ok := newState.NameToSrcIdx()[dep]; !ok {
-// 					waterlog.Printf(" %s", dep)
-// 				}
-// 			}
-// 			waterlog.Println()
-// 		}
-// 
-// 		// waterlog.Println()
-// 		if !force {
-// 			os.Exit(1)
-// 		}
-// 	}
-// 
-// 	waterlog.Goodf("The following packages will be updated:")
-// 	for _, pkg := range bumped {
-// 		waterlog.Printf(" %s", pkg.Name)
-// 	}
-// 	waterlog.Println()
-// 
-// 	depGraph := newState.DepGraph()
-// 	waterlog.Goodln("Successfully generated dependency graph!")
-// 
-// 	lifted, err := utils.LiftGraph(depGraph, func(i int) bool { return bset[i] })
-// 	if err != nil {
-// 		waterlog.Fatalf("Failed to lift updated packages from dependency graph: %s\n", err)
-// 	}
-// 	waterlog.Goodln("Successfully isolated packages to update!")
-// 
-// 	order, err := graph.TopologicalSort(lifted)
-// 	if err != nil {
-// 		fingDot, _ := os.Create("lifted.gv")
-// 		_ = draw.DOT(lifted, fingDot)
-// 
-// 		if cycles, err := graph.StronglyConnectedComponents(lifted); err == nil {
-// 			cycleIdx := 0
-// 
-// 			for _, cycle := range cycles {
-// 				if len(cycle) <= 1 {
-// 					continue
-// 				}
-// 
-// 				waterlog.Debugf("Cycle %d:", cycleIdx+1)
-// 				cycleIdx++
-// 
-// 				for _, nodeIdx := range cycle {
-// 					waterlog.Printf(" %s", newState.Packages()[nodeIdx].Name)
-// 				}
-// 				waterlog.Println()
-// 			}
-// 		}
-// 
-// 		waterlog.Fatalf("Failed to compute build order: %s\n", err)
-// 	}
-// 
-// 	waterlog.Goodln("Here's the build order:")
-// 	for _, idx := range order {
-// 		waterlog.Println(newState.Packages()[idx].Name)
-// 	}
-// 
-// 	if dryRun {
-// 		return
-// 	}
-// 
-// 	red := color.New(color.FgRed).SprintFunc()
-// 	green := color.New(color.FgGreen).SprintFunc()
-// 	for _, idx := range order {
-// 		s := spinner.New(spinner.CharSets[14], 100*time.Millisecond)
-// 		defer s.Stop()
-// 		pkg := newState.Packages()[idx]
-// 
-// 		s.Prefix = " "
-// 		s.Suffix = fmt.Sprintf("  Publishing %s", pkg.Name)
-// 		s.Color("white")
-// 		s.Restart()
-// 
-// 		job, err := push.Publish(pkg, prePush)
-// 		jobid := job.ID
-// 		if err != nil {
-// 			s.FinalMSG = fmt.Sprintf("%s failed to publish %s: %s", red("[x]"), pkg.Name, err)
-// 			s.Stop()
-// 			os.Exit(1)
-// 		}
-// 
-// 		s.Color("yellow")
-// 		s.Suffix = fmt.Sprintf("  Package %s (%d) is waiting to be claimed", pkg.Name, jobid)
-// 		s.Restart()
-// 		for job.Status == "UNCLAIMED" {
-// 			job, err = push.Query(jobid)
-// 			time.Sleep(1 * time.Second)
-// 		}
-// 
-// 		s.Suffix = fmt.Sprintf("  Package %s (%d) is claimed, waiting to be built", pkg.Name, jobid)
-// 		for job.Status == "CLAIMED" {
-// 			job, err = push.Query(jobid)
-// 			time.Sleep(1 * time.Second)
-// 		}
-// 
-// 		if job.Status == "BUILDING" {
-// 			s.Color("green")
-// 			s.Suffix = fmt.Sprintf("  Package %s (%d) is building", pkg.Name, jobid)
-// 			s.Restart()
-// 		}
-// 		for job.Status == "BUILDING" {
-// 			job, err = push.Query(jobid)
-// 			time.Sleep(15 * time.Second)
-// 		}
-// 
-// 		if job.Status == "OK" {
-// 			s.FinalMSG = fmt.Sprintf("%s %s (%d) built successfully!\n", green("[✓]"), pkg.Name, jobid)
-// 			s.Stop()
-// 		} else {
-// 			if job.Status == "FAILED" {
-// 				s.FinalMSG = fmt.Sprintf("%s %s (%d) failed to build\n", red("[x]"), pkg.Name, jobid)
-// 			} else {
-// 				s.FinalMSG = fmt.Sprintf("%s %s (%d) has unknown status %s\n", red("[x]"), pkg.Name, jobid, job.Status)
-// 			}
-// 			s.Stop()
-// 			os.Exit(1)
-// 		}
-// 	}
-// }
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DataDrake/waterlog"
+	"github.com/GZGavinZhao/autobuild/common"
+	"github.com/GZGavinZhao/autobuild/config"
+	"github.com/GZGavinZhao/autobuild/push"
+	"github.com/GZGavinZhao/autobuild/state"
+	"github.com/GZGavinZhao/autobuild/upstream"
+	"github.com/GZGavinZhao/autobuild/utils"
+	"github.com/GZGavinZhao/autobuild/ypkg"
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"golang.org/x/term"
+)
+
+var (
+	cmdPush = &cobra.Command{
+		Use:   "push <[src|bin|repo]:path-to-old> <[src|bin|repo]:path-to-new>",
+		Short: "Push package changes to the build server",
+		Run:   runPush,
+		Args:  defaultStatesArgs(2),
+	}
+)
+
+func init() {
+	cmdPush.Flags().BoolP("force", "f", false, "whether to ignore safety checks")
+	cmdPush.Flags().BoolP("dry-run", "n", true, "don't publish anything, unless --publish is given")
+	cmdPush.Flags().Bool("publish", false, "publish the packages to the build server, after confirming")
+	cmdPush.MarkFlagsMutuallyExclusive("publish", "dry-run")
+	cmdPush.Flags().BoolP("yes", "y", false, "publish without asking for confirmation, e.g. in CI")
+	formatFlag(cmdPush, "text", "json", "yaml")
+	cmdPush.Flags().StringP("output", "o", "", "write the changes and the build order to the given file instead of stdout, as json unless --format is given")
+	cmdPush.Flags().Bool("auto-bump", false, "bump and commit the release of packages whose recipe changed without one, when they are published")
+	cmdPush.Flags().Bool("drop-removed", false, "ask the build server to drop the packages that were removed")
+	cmdPush.Flags().Bool("suggest-rebuilds", false, "list the packages that weren't bumped but build-depend on packages with a new version")
+	cmdPush.Flags().Bool("security-only", false, "only push the packages that fix vulnerabilities known to osv.dev, or are security fixes by --security or their release")
+	osvFlag(cmdPush)
+	backendFlag(cmdPush)
+	targetFlag(cmdPush)
+	filterFlags(cmdPush)
+	commitFlags(cmdPush)
+	downgradeFlags(cmdPush)
+	checkFlags(cmdPush)
+	publishFlags(cmdPush)
+	pinFlag(cmdPush)
+	deselectFlags(cmdPush)
+}
+
+// backendFlag adds the flag to choose the push backend to `cmd`.
+func backendFlag(cmd *cobra.Command) {
+	cmd.Flags().String("backend", "", fmt.Sprintf("build server backend to publish to, one of %q (default from config, or solus)", push.Backends))
+}
+
+// publishFlags adds the flags controlling how packages are published to `cmd`.
+func publishFlags(cmd *cobra.Command) {
+	cmd.Flags().BoolP("push", "p", true, "git push packages before publishing")
+	cmd.Flags().String("journal", "push-journal.jsonl", "file to record published packages and their job IDs in")
+	cmd.Flags().String("resume", "", "resume an interrupted push from the given journal")
+	cmd.Flags().Bool("fresh", false, "replace the journal of a push that didn't finish, instead of refusing to")
+	cmd.MarkFlagsMutuallyExclusive("journal", "resume")
+	cmd.MarkFlagsMutuallyExclusive("fresh", "resume")
+	cmd.Flags().BoolP("wait", "w", false, "wait for jobs to be indexed, and only publish packages once their dependencies are indexed")
+	cmd.Flags().Duration("poll-interval", push.DefaultPollInterval, "how often to query the status of jobs in wait mode")
+	cmd.Flags().String("submit-rate", "", "maximum rate of submissions, e.g. 10/m (default unlimited)")
+	cmd.Flags().Int("submit-concurrency", 0, "maximum number of jobs that are submitted but not finished at any time (default unlimited)")
+	cmd.Flags().String("reason", "", "why the packages are published, shown by the build server (default derived from the version change)")
+	cmd.Flags().String("mr-url", "", "URL of the merge request the packages originate from")
+	cmd.Flags().String("batch-id", "", "ID to group the published jobs by (default generated)")
+	cmd.Flags().String("priority", push.PriorityRegular, fmt.Sprintf("priority of the published jobs, one of %q", push.Priorities))
+	cmd.Flags().StringSlice("security", nil, "publish these packages as security fixes (glob patterns allowed), in addition to the ones whose release mentions a CVE")
+	cmd.RegisterFlagCompletionFunc("security", completePackageList)
+	cmd.Flags().Int("retries", push.DefaultRetryPolicy.Attempts-1, "how many times to retry requests that fail with transient errors (default from config)")
+	cmd.Flags().Bool("transaction", false, "register the push with the build server as one batch, and stop once --max-failures of its jobs failed (implies --wait)")
+	cmd.Flags().Float64("max-failures", 0.2, "fraction of the jobs of a transaction that may fail before the push stops")
+	cmd.Flags().Bool("sign", false, "sign the provenance of the push, and publish the signature along with every job")
+	cmd.Flags().String("signing-key", "", "SSH key to sign with (default from config)")
+	cmd.Flags().Bool("progress", true, "show the progress of the push on the last line of the terminal, and only log failed jobs")
+	cmd.Flags().Bool("force-requeue", false, "publish packages even if a job for their release is already queued or building")
+	cmd.Flags().String("abi-check", "", "once the jobs are indexed, check the ABI of their shared libraries against the ones they replaced in this binary state, e.g. repo:unstable, with abidiff (implies --wait)")
+	cmd.Flags().String("wait-index", "", "after every wave, wait for this binary state, e.g. repo:unstable, to hold its packages before publishing the next wave (implies --wait)")
+	cmd.Flags().Duration("index-timeout", 30*time.Minute, "how long --wait-index waits for every wave to be indexed")
+}
+
+// pushOrder is the list of packages to publish, in build order.
+type pushOrder struct {
+	packages []common.Package
+	// deps holds, for every package, the indices of the packages it depends on.
+	deps [][]int
+	// streams holds, for every package, the index of the independent stream
+	// it belongs to.
+	streams []int
+	// old holds, for every package, its version in the old state, or nil if
+	// it is new.
+	old []*push.PlanVersion
+	// oldTPath and newTPath are the TPaths of the states that were diffed.
+	oldTPath string
+	newTPath string
+	// removed holds the packages of the old state that are gone from the new
+	// one, and were selected by the filter.
+	removed []common.Package
+	// fixes holds, by name, the known vulnerabilities that packages fix, with
+	// --security-only.
+	fixes map[string][]string
+	// autoBumped holds the names of the packages whose release --auto-bump
+	// increments once they are published, see commitAutoBumps. Their release
+	// in `packages` is already the incremented one.
+	autoBumped map[string]bool
+}
+
+func runPush(cmd *cobra.Command, args []string) {
+	args = defaultStates(cmd, args)
+	checkoutOnly(args[1])
+	force, _ := cmd.Flags().GetBool("force")
+	dryRun, _ := cmd.Flags().GetBool("dry-run")
+	if publish, _ := cmd.Flags().GetBool("publish"); publish {
+		dryRun = false
+	}
+	format := getFormat(cmd)
+	output, _ := cmd.Flags().GetString("output")
+	if output != "" && format == "text" {
+		format = "json"
+	}
+	dropRemoved, _ := cmd.Flags().GetBool("drop-removed")
+	opts := diffOptions{filter: getFilter(cmd), downgrades: getDowngradePolicy(cmd), checks: getChecks(cmd), pins: getPins(cmd)}
+	opts.autoBump, _ = cmd.Flags().GetBool("auto-bump")
+	opts.suggestRebuilds, _ = cmd.Flags().GetBool("suggest-rebuilds")
+	opts.deselect = getDeselectMode(cmd)
+	if opts.securityOnly, _ = cmd.Flags().GetBool("security-only"); opts.securityOnly {
+		security, _ := cmd.Flags().GetStringSlice("security")
+		opts.security = recipeNames(security)
+		opts.osv = getOSV(cmd)
+	}
+
+	var order pushOrder
+	var ok bool
+	if format == "text" {
+		if order, ok = changedOrder(args[0], args[1], force, opts); dryRun {
+			return
+		}
+	} else {
+		if opts.deselect != deselectNone {
+			waterlog.Fatalf("--interactive and --edit can't be used with the %s format, which is meant for scripts\n", format)
+		}
+		// Keep stdout clean for the manifest itself.
+		if output == "" {
+			setLogOutput(os.Stderr)
+		}
+
+		newState, manifest, changes, removed := diffStates(args[0], args[1], opts)
+		fixes := opts.leaveOutNonSecurity(newState, changes)
+		changes, manifest.Skipped = filterChanges(newState, changes, opts.filter)
+		if len(changes) != 0 {
+			order = orderChanges(newState, args[1], changes)
+			opts.pins.check(order.packages, "push", "leave them out with --exclude")
+			manifest.setOrder(order)
+		}
+		order.removed, order.fixes = removed, fixes
+		order.autoBumped = manifest.autoBumped()
+		if err := manifest.save(output, format); err != nil {
+			waterlog.Fatalf("Failed to write manifest: %s\n", err)
+		}
+
+		manifest.check(force)
+		if ok = len(changes) != 0; dryRun {
+			return
+		}
+	}
+	if !ok && (!dropRemoved || len(order.removed) == 0) {
+		return
+	}
+
+	userConfig, err := loadConfig()
+	if err != nil {
+		waterlog.Fatalf("Failed to load configuration: %s\n", err)
+	}
+	targets := pushTargets(cmd, userConfig)
+	if yes, _ := cmd.Flags().GetBool("yes"); !yes {
+		removing := 0
+		if dropRemoved {
+			removing = len(order.removed)
+		}
+		confirmPublish(targets, len(order.packages), removing)
+	}
+	if dropRemoved {
+		removePackages(targets, order.removed)
+	}
+	if !ok {
+		return
+	}
+
+	order.oldTPath, order.newTPath = args[0], args[1]
+	publishOrder(cmd, targets, userConfig, order)
+}
+
+// confirmPublish asks on the terminal whether to publish `count` packages and
+// drop `removing` ones on `targets`, and exits unless the answer is yes.
+// Without a terminal to ask on, it refuses to publish, since --yes is how
+// automation confirms.
+func confirmPublish(targets []pushTarget, count int, removing int) {
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		waterlog.Fatalln(msg("push.unconfirmed"))
+	}
+
+	var servers []string
+	for _, target := range targets {
+		servers = append(servers, target.label()+target.builder.Target())
+	}
+	fmt.Fprint(os.Stderr, msg("push.confirm", "count", count, "removing", removing, "servers", strings.Join(servers, ", ")))
+
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	if answer = strings.ToLower(strings.TrimSpace(answer)); answer != "y" && answer != "yes" {
+		waterlog.Fatalln(msg("push.declined"))
+	}
+}
+
+// diffOptions control what diffStates checks and reports.
+type diffOptions struct {
+	// autoBump treats the packages whose recipe changed without a new release
+	// as bumped, with their next release. The recipes are only bumped and
+	// committed when the packages are published, see commitAutoBumps.
+	autoBump bool
+	// filter selects the packages to consider.
+	filter     pushFilter
+	downgrades downgradePolicy
+	checks     sameChecks
+	// pins are the packages that must not be published, nor auto-bumped.
+	pins pinList
+	// suggestRebuilds reports the packages that may need a release bump, see
+	// suggestRebuilds.
+	suggestRebuilds bool
+	// deselect is how the packages to update are reviewed before they are
+	// ordered.
+	deselect deselectMode
+	// securityOnly leaves out the packages that aren't security fixes, the
+	// ones that don't fix vulnerabilities known to osv, aren't marked as
+	// security updates, and don't match the patterns of security.
+	securityOnly bool
+	security     []string
+	osv          *upstream.OSV
+}
+
+// leaveOutNonSecurity excludes the packages of `changes` that aren't security
+// fixes with --security-only, and returns the vulnerabilities that the others
+// fix.
+func (opts *diffOptions) leaveOutNonSecurity(newState state.State, changes map[int]*push.PlanVersion) map[string][]string {
+	if !opts.securityOnly {
+		return nil
+	}
+	fixes, dropped := securityOnly(opts.osv, newState, changes, opts.filter, opts.security)
+	opts.filter.exclude = append(slices.Clone(opts.filter.exclude), dropped...)
+	return fixes
+}
+
+// changedOrder diffs the old and new states, and returns the build order of
+// the packages that were bumped and selected by the filter, along with the
+// selected packages that were removed. It returns false if there is nothing to
+// publish.
+func changedOrder(oldTPath string, newTPath string, force bool, opts diffOptions) (order pushOrder, ok bool) {
+	newState, manifest, changes, removed := diffStates(oldTPath, newTPath, opts)
+	manifest.check(force)
+	order.removed = removed
+
+	if len(manifest.Bumped) == 0 {
+		waterlog.Infoln(msg("push.nothing"))
+		return
+	}
+
+	// Packages left out by hand, or for not being security fixes, are skipped
+	// like excluded ones, with the same warnings about the dependency chains
+	// this splits.
+	fixes := opts.leaveOutNonSecurity(newState, changes)
+	bumped := slices.DeleteFunc(slices.Clone(manifest.Bumped), func(pkg manifestPackage) bool {
+		return matchAny(opts.filter.exclude, pkg.Name)
+	})
+	if dropped := opts.deselect.deselect(packageRows(bumped, bumpColor)); len(dropped) != 0 {
+		opts.filter.exclude = append(slices.Clone(opts.filter.exclude), dropped...)
+	}
+	if changes, _ = filterChanges(newState, changes, opts.filter); len(changes) == 0 {
+		waterlog.Infoln(msg("push.nothing-filtered"))
+		return
+	}
+
+	removed = order.removed
+	order = orderChanges(newState, newTPath, changes)
+	order.removed, order.fixes = removed, fixes
+	order.autoBumped = manifest.autoBumped()
+	opts.pins.check(order.packages, "push", "leave them out with --exclude")
+	printOrder(order)
+	return order, true
+}
+
+// diffStates loads and diffs the old and new states, and reports the changes.
+// `changes` maps the index of every bumped package in the new state to its
+// version in the old state, or nil if it is new. `removed` holds the packages
+// of the old state that are gone from the new one, see diffOptions for the
+// rest. Packages that the filter doesn't select are ignored, except that their
+// bumps are still in `changes`, for filterChanges to report on.
+func diffStates(oldTPath string, newTPath string, opts diffOptions) (newState state.State, manifest pushManifest, changes map[int]*push.PlanVersion, removed []common.Package) {
+	oldState, newState := loadStates(oldTPath, newTPath)
+
+	waterlog.Infoln(msg("diff.diffing"))
+	timings.start("diffing", true)
+	diffs := state.Changed(&oldState, &newState)
+	timings.end()
+
+	bumped := []common.Package{}
+	// bumpedIdxs are the indexes of `bumped` in the new state.
+	var bumpedIdxs []int
+	changes = make(map[int]*push.PlanVersion)
+
+	for _, diff := range diffs {
+		if diff.IsRemoved() {
+			pkg := oldState.Packages()[diff.OldIdx]
+			if !opts.filter.match(pkg) {
+				continue
+			}
+			removed = append(removed, pkg)
+			manifest.Removed = append(manifest.Removed, newManifestDiff(pkg, diff))
+			continue
+		}
+
+		pkg := newState.Packages()[diff.Idx]
+		var old *push.PlanVersion
+		if !diff.IsNew() {
+			old = &push.PlanVersion{Version: diff.OldVer, Release: diff.OldRelNum}
+		}
+		kind := diff.Kind()
+		if !opts.filter.match(pkg) {
+			if kind.Bumped() {
+				changes[diff.Idx] = old
+			}
+			continue
+		}
+
+		if kind.Bumped() {
+			bumped = append(bumped, pkg)
+			bumpedIdxs = append(bumpedIdxs, diff.Idx)
+			changes[diff.Idx] = old
+			manifest.Bumped = append(manifest.Bumped, newManifestDiff(pkg, diff))
+		}
+		switch kind {
+		case state.KindNew:
+			manifest.Added = append(manifest.Added, newManifestDiff(pkg, diff))
+		case state.KindDowngrade:
+			manifest.Downgraded = append(manifest.Downgraded, newManifestDiff(pkg, diff))
+		case state.KindOutdated:
+			manifest.Outdated = append(manifest.Outdated, newManifestDiff(pkg, diff))
+		}
+	}
+
+	for _, pkg := range newState.Packages() {
+		oldIdx, found := oldState.NameToSrcIdx()[pkg.Name]
+		if !found || !opts.filter.match(pkg) {
+			continue
+		}
+		oldPkg := oldState.Packages()[oldIdx]
+		if oldPkg.Release != pkg.Release {
+			continue
+		}
+		if failed := state.FailedChecks(oldPkg, pkg, opts.checks.enabled); len(failed) != 0 {
+			old := &push.PlanVersion{Version: oldPkg.Version, Release: oldPkg.Release}
+			manifest.Bad = append(manifest.Bad, manifestBad{
+				manifestPackage: newManifestPackage(pkg, old),
+				Checks:          failed,
+				Forced:          opts.checks.isForced(failed),
+			})
+		}
+	}
+
+	unbumpedDiffs, err := state.Unbumped(&oldState, &newState, opts.filter.match)
+	if err != nil {
+		waterlog.Fatalf("Failed to compare recipes: %s\n", err)
+	}
+	for _, diff := range unbumpedDiffs {
+		pkg := &newState.Packages()[diff.Idx]
+		old := &push.PlanVersion{Version: diff.OldVer, Release: diff.OldRelNum}
+		if !opts.autoBump || matchAny(opts.pins.patterns, pkg.Name) {
+			manifest.Unbumped = append(manifest.Unbumped, newManifestPackage(*pkg, old))
+			continue
+		}
+
+		pkg.Release++
+		waterlog.Goodln(msg("push.auto-bump", "package", pkg.Name, "release", pkg.Release))
+		bumped = append(bumped, *pkg)
+		bumpedIdxs = append(bumpedIdxs, diff.Idx)
+		changes[diff.Idx] = old
+		manifest.Bumped = append(manifest.Bumped, newManifestPackage(*pkg, old))
+		manifest.AutoBumped = append(manifest.AutoBumped, pkg.Name)
+	}
+
+	logPackages(waterlog.Error, msg("push.unbumped"), packageRows(manifest.Unbumped, badColor))
+
+	var badRows []packageRow
+	for _, pkg := range manifest.Bad {
+		row := packageRow{manifestPackage: pkg.manifestPackage, note: strings.Join(pkg.Checks, ", "), color: badColor}
+		if pkg.Forced {
+			row.note += " (forced)"
+			row.color = downgradeColor
+		}
+		badRows = append(badRows, row)
+	}
+	logPackages(waterlog.Warn, msg("push.bad"), badRows)
+
+	logPackages(waterlog.Info, msg("push.new"), packageRows(manifest.Added, bumpColor))
+
+	removedRows := packageRows(manifest.Removed, downgradeColor)
+	for idx := range removedRows {
+		removedRows[idx].removed = true
+	}
+	logPackages(waterlog.Warn, msg("push.removed"), removedRows)
+
+	manifest.Forbidden = append(manifest.Forbidden, opts.downgrades.report(manifest.Downgraded, msg("push.downgraded"))...)
+	manifest.Forbidden = append(manifest.Forbidden, opts.downgrades.report(manifest.Outdated, msg("push.outdated"))...)
+
+	if opts.suggestRebuilds {
+		manifest.Rebuilds = suggestRebuilds(newState, changes, opts.filter)
+	}
+
+	if len(bumped) == 0 {
+		return
+	}
+
+	// Check that the dependencies of every package already exist
+	var rows []packageRow
+	for i, deps := range state.Unresolved(newState, bumpedIdxs) {
+		if len(deps) == 0 {
+			continue
+		}
+		entry := manifestUnresolved{manifestPackage: newManifestPackage(bumped[i], changes[bumpedIdxs[i]])}
+		var notes []string
+		for _, dep := range deps {
+			entry.Missing = append(entry.Missing, dep.Name)
+			entry.Deps = append(entry.Deps, manifestMissing{Name: dep.Name, Kind: dep.Kind.String(), Closest: dep.Closest})
+			if dep.Closest != "" {
+				notes = append(notes, fmt.Sprintf("%s (did you mean %s?)", dep.Name, dep.Closest))
+			} else {
+				notes = append(notes, dep.Name)
+			}
+		}
+		manifest.Unresolved = append(manifest.Unresolved, entry)
+		rows = append(rows, packageRow{manifestPackage: entry.manifestPackage, note: "missing " + strings.Join(notes, ", "), color: badColor})
+	}
+	if len(rows) != 0 {
+		logPackages(waterlog.Error, msg("push.unresolved"), rows)
+	}
+
+	logPackages(waterlog.Good, msg("push.updated"), packageRows(manifest.Bumped, bumpColor))
+	return
+}
+
+// orderChanges computes the build order of the bumped packages, see
+// diffStates.
+func orderChanges(newState state.State, newTPath string, changes map[int]*push.PlanVersion) (order pushOrder) {
+	depGraph := newState.DepGraph()
+	if depGraph == nil {
+		waterlog.Fatalf("Failed to obtain dependency graph of new state %s\n", newTPath)
+	}
+	waterlog.Goodln("Successfully generated dependency graph!")
+
+	timings.start("lifting the packages to update", true)
+	lifted := utils.LiftSelection(depGraph, utils.SortedKeys(changes))
+	timings.end()
+	waterlog.Goodln("Successfully isolated packages to update!")
+
+	timings.start("ordering the packages to update", true)
+	tiers := tieredOrder(newState, lifted)
+	timings.end()
+
+	liftedOrder := utils.Flatten(tiers)
+	pos := make(map[int]int, len(liftedOrder))
+	for i, liftedIdx := range liftedOrder {
+		pos[liftedIdx] = i
+		order.packages = append(order.packages, newState.Packages()[lifted.Nodes[liftedIdx]])
+		order.old = append(order.old, changes[lifted.Nodes[liftedIdx]])
+	}
+
+	order.deps = make([][]int, len(liftedOrder))
+	for liftedIdx := range lifted.Nodes {
+		lifted.Visit(liftedIdx, func(w int, _ int64) (skip bool) {
+			order.deps[pos[w]] = append(order.deps[pos[w]], pos[liftedIdx])
+			return
+		})
+	}
+
+	// Packages in different weakly connected components of the lifted graph
+	// don't depend on each other, so each component is an independent stream
+	// that can be built concurrently with the others.
+	order.streams = make([]int, len(liftedOrder))
+	for sIdx, component := range utils.Components(lifted) {
+		for _, liftedIdx := range component {
+			order.streams[pos[liftedIdx]] = sIdx
+		}
+	}
+
+	return order
+}
+
+// printOrder prints the build order, split into its independent streams if
+// there are several.
+func printOrder(order pushOrder) {
+	numStreams := 0
+	for _, sIdx := range order.streams {
+		numStreams = max(numStreams, sIdx+1)
+	}
+
+	if numStreams == 1 {
+		waterlog.Goodln(msg("push.order"))
+		for _, pkg := range order.packages {
+			waterlog.Println(pkg.Name)
+		}
+		return
+	}
+
+	waterlog.Goodln(msg("push.order-streams", "streams", numStreams))
+	for sIdx := 0; sIdx < numStreams; sIdx++ {
+		waterlog.Good(msg("push.stream", "stream", sIdx+1))
+		for idx, pkg := range order.packages {
+			if order.streams[idx] == sIdx {
+				waterlog.Printf(" %s", pkg.Name)
+			}
+		}
+		waterlog.Println()
+	}
+}
+
+// publishOrder publishes the packages of `order` to `targets`, as configured
+// by the flags added by publishFlags. It exits if any package fails.
+func publishOrder(cmd *cobra.Command, targets []pushTarget, userConfig config.UserConfig, order pushOrder) {
+	prePush, _ := cmd.Flags().GetBool("push")
+	journalPath, _ := cmd.Flags().GetString("journal")
+	resumePath, _ := cmd.Flags().GetString("resume")
+	fresh, _ := cmd.Flags().GetBool("fresh")
+	wait, _ := cmd.Flags().GetBool("wait")
+	pollInterval, _ := cmd.Flags().GetDuration("poll-interval")
+	retries, _ := cmd.Flags().GetInt("retries")
+	submitRate, _ := cmd.Flags().GetString("submit-rate")
+	submitConcurrency, _ := cmd.Flags().GetInt("submit-concurrency")
+	reason, _ := cmd.Flags().GetString("reason")
+	mrURL, _ := cmd.Flags().GetString("mr-url")
+	batchID, _ := cmd.Flags().GetString("batch-id")
+	priority, _ := cmd.Flags().GetString("priority")
+	security, _ := cmd.Flags().GetStringSlice("security")
+	transaction, _ := cmd.Flags().GetBool("transaction")
+	maxFailures, _ := cmd.Flags().GetFloat64("max-failures")
+	sign, _ := cmd.Flags().GetBool("sign")
+	signingKey, _ := cmd.Flags().GetString("signing-key")
+	forceRequeue, _ := cmd.Flags().GetBool("force-requeue")
+	showProgress, _ := cmd.Flags().GetBool("progress")
+	abiRepo, _ := cmd.Flags().GetString("abi-check")
+	indexRepo, _ := cmd.Flags().GetString("wait-index")
+	indexTimeout, _ := cmd.Flags().GetDuration("index-timeout")
+
+	if !slices.Contains(push.Priorities, priority) {
+		waterlog.Fatalf("Unknown priority %s, expected one of %q\n", priority, push.Priorities)
+	}
+	security = recipeNames(security)
+	checkPatterns(security)
+	if maxFailures <= 0 || maxFailures > 1 {
+		waterlog.Fatalf("--max-failures must be a fraction between 0 and 1, got %g\n", maxFailures)
+	}
+	// Failures are only known when waiting for the jobs to finish.
+	if transaction {
+		wait = true
+	} else {
+		maxFailures = 0
+	}
+	// The repository is loaded before the push, to compare the packages
+	// with once they are replaced.
+	var abi *abiCheck
+	if abiRepo != "" {
+		wait = true
+		abi = newABICheck(abiRepo, order)
+	}
+	if indexRepo != "" {
+		if !state.ValidTPath(indexRepo) {
+			waterlog.Fatalf("Invalid --wait-index %s, use a TPath like repo:unstable\n", indexRepo)
+		}
+		wait = true
+	}
+
+	var rate push.Rate
+	var err error
+	if submitRate != "" {
+		if rate, err = push.ParseRate(submitRate); err != nil {
+			waterlog.Fatalf("Invalid --submit-rate: %s\n", err)
+		}
+	}
+
+	hooks, err := push.NewHooks(userConfig.Push.Hooks)
+	if err != nil {
+		waterlog.Fatalf("Invalid hooks: %s\n", err)
+	}
+	chats := newNotifiers(userConfig.Push.Notify)
+
+	retry, retryConfig := push.DefaultRetryPolicy, userConfig.Push.Retry
+	if retryConfig.Retries != nil {
+		retry.Attempts = *retryConfig.Retries + 1
+	}
+	if retryConfig.Backoff != 0 {
+		retry.Backoff = retryConfig.Backoff
+	}
+	if retryConfig.MaxBackoff != 0 {
+		retry.MaxBackoff = retryConfig.MaxBackoff
+	}
+	if cmd.Flags().Changed("retries") {
+		retry.Attempts = retries + 1
+	}
+
+	// Fail before publishing anything if a build server can't be talked to.
+	timings.start("negotiating with the build server", true)
+	caps := make([]push.Capabilities, len(targets))
+	for tIdx, target := range targets {
+		if caps[tIdx], err = push.QueryCapabilities(target.builder); err != nil {
+			fatalf(exitServer, "%sFailed to negotiate with the build server: %s\n", target.label(), err)
+		} else if caps[tIdx].Unreported {
+			waterlog.Warnln(msg("server.no-capabilities", "target", target.label()))
+		}
+	}
+
+	// Someone else may have published some of the packages already, whose
+	// jobs are tracked instead of queueing duplicates.
+	existing := make([]map[int]push.Job, len(targets))
+	for tIdx, target := range targets {
+		queuer, ok := target.builder.(push.Queuer)
+		if forceRequeue || !ok || !caps[tIdx].Queue {
+			continue
+		}
+		queue, err := queuer.Queue()
+		if err != nil {
+			fatalf(exitServer, "%sFailed to list the queue of the build server: %s\n", target.label(), err)
+		}
+		existing[tIdx] = make(map[int]push.Job)
+		var names []string
+		for idx, pkg := range order.packages {
+			tag := push.SourceTag(pkg)
+			for _, job := range queue {
+				if job.Tag == tag && !job.Indexed() && !job.Failed() {
+					existing[tIdx][idx] = job
+					names = append(names, fmt.Sprintf("%s (%d)", pkg.Name, job.ID))
+					break
+				}
+			}
+		}
+		if len(names) != 0 {
+			waterlog.Warnln(msg("push.queued", "target", target.label(), "count", len(names), "packages", strings.Join(names, ", ")))
+		}
+	}
+	timings.end()
+
+	// Local builds are done one at a time in build order, and there is no
+	// remote that needs the recipes. Waiting makes failed builds block their
+	// dependents instead of building them against missing dependencies.
+	allLocal := true
+	for _, target := range targets {
+		if _, local := target.builder.(*push.LocalBuilder); local {
+			wait = true
+		} else {
+			allLocal = false
+		}
+	}
+	if allLocal {
+		prePush = false
+	}
+
+	journals := make([]*push.Journal, len(targets))
+	for tIdx, target := range targets {
+		if resumePath != "" {
+			if journals[tIdx], err = push.LoadJournal(target.path(resumePath)); err != nil {
+				waterlog.Fatalf("Failed to load journal: %s\n", err)
+			}
+			waterlog.Infoln(msg("push.resuming", "target", target.label(), "journal", target.path(resumePath), "count", len(journals[tIdx].Entries())))
+		} else {
+			// The journal of a push that died is what resuming it needs.
+			unfinished, err := push.JournalUnfinished(target.path(journalPath))
+			if err != nil {
+				waterlog.Fatalf("Failed to check the journal: %s\n", err)
+			} else if unfinished && !fresh {
+				waterlog.Fatalf("%s is the journal of a push that didn't finish: resume it with --resume %s, or replace it with --fresh\n", target.path(journalPath), journalPath)
+			}
+			if journals[tIdx], err = push.CreateJournal(target.path(journalPath)); err != nil {
+				waterlog.Fatalf("Failed to create journal: %s\n", err)
+			}
+		}
+		defer journals[tIdx].Close()
+	}
+
+	commitAutoBumps(order)
+	if prePush {
+		// git prints its own progress.
+		timings.start("git push", false)
+		if err := push.GitPush(order.packages[0].Root); err != nil {
+			waterlog.Fatalf("Failed to push packages: %s\n", err)
+		}
+		timings.end()
+	}
+
+	if batchID == "" {
+		batchID = push.NewBatchID()
+	}
+	waterlog.Infoln(msg("push.batch", "batch", batchID))
+
+	metadata := make([]push.Metadata, len(order.packages))
+	numSecurity := 0
+	for idx, pkg := range order.packages {
+		metadata[idx] = push.Metadata{
+			MergeRequest: mrURL,
+			Reason:       reason,
+			Batch:        batchID,
+			Priority:     priority,
+			Arch:         userConfig.Push.Arch,
+		}
+		if reason == "" {
+			metadata[idx].Reason = push.BumpReason(pkg, order.old[idx])
+		}
+		metadata[idx].Changelog = push.Changelog(pkg, order.old[idx])
+		metadata[idx].Fixes = order.fixes[pkg.Name]
+		if pkg.Security || matchAny(security, pkg.Name) || len(metadata[idx].Fixes) != 0 {
+			metadata[idx].Priority = push.PrioritySecurity
+			numSecurity++
+		}
+	}
+	if numSecurity != 0 {
+		waterlog.Infoln(msg("push.security", "count", numSecurity))
+	}
+
+	var attestation *push.Attestation
+	if sign {
+		if signingKey == "" {
+			signingKey = userConfig.Push.SigningKey
+		}
+		if signingKey == "" {
+			waterlog.Fatalln("No key to sign with, please pass --signing-key or set push.signing-key in the config")
+		}
+
+		provenance, err := push.NewProvenance(order.packages, batchID)
+		if err != nil {
+			waterlog.Fatalf("Failed to compute provenance: %s\n", err)
+		}
+		if attestation, err = provenance.Sign(signingKey); err != nil {
+			waterlog.Fatalf("Failed to sign provenance: %s\n", err)
+		}
+		waterlog.Goodln(msg("push.signed", "key", signingKey))
+	}
+
+	// The signed provenance is registered once with the batch where the
+	// build server supports batches, rather than sent with every job.
+	attested := make([]bool, len(targets))
+	if transaction || attestation != nil {
+		for tIdx, target := range targets {
+			if batcher, ok := target.builder.(push.Batcher); ok && caps[tIdx].Batches {
+				if err = batcher.RegisterBatch(batchID, order.packages, maxFailures, attestation); err != nil {
+					fatalf(exitServer, "%sFailed to register batch: %s\n", target.label(), err)
+				}
+				attested[tIdx] = attestation != nil
+				waterlog.Goodln(msg("server.batch", "target", target.label(), "batch", batchID, "count", len(order.packages)))
+			} else if transaction {
+				waterlog.Warnln(msg("server.no-batches", "target", target.label(), "max_failures", maxFailures))
+			}
+		}
+	}
+
+	// Waves let build servers schedule packages without knowing their
+	// dependencies.
+	waves := push.Waves(order.deps)
+	targetMetadata := make([][]push.Metadata, len(targets))
+	for tIdx, target := range targets {
+		forwards := push.ForwardsAttestations(target.builder)
+		perJob := attestation != nil && !attested[tIdx] && forwards
+		targetMetadata[tIdx] = metadata
+		if caps[tIdx].WaveHints || perJob {
+			targetMetadata[tIdx] = slices.Clone(metadata)
+			for idx := range targetMetadata[tIdx] {
+				if caps[tIdx].WaveHints {
+					targetMetadata[tIdx][idx].Wave = waves[idx]
+				}
+				if perJob {
+					targetMetadata[tIdx][idx].Attestation = attestation
+				}
+			}
+		}
+		if (numSecurity != 0 || priority != push.PriorityRegular) && !caps[tIdx].Priorities {
+			waterlog.Warnln(msg("server.no-priorities", "target", target.label()))
+		}
+		if attestation != nil && !forwards {
+			waterlog.Warnln(msg("server.drops-signatures", "target", target.label(), "backend", target.builder.Name()))
+		} else if attestation != nil && !caps[tIdx].Attestations {
+			waterlog.Warnln(msg("server.no-signatures", "target", target.label()))
+		}
+	}
+
+	red := color.New(color.FgRed).SprintFunc()
+	green := color.New(color.FgGreen).SprintFunc()
+	yellow := color.New(color.FgYellow).SprintFunc()
+
+	builders := make([]push.Builder, len(targets))
+	for tIdx, target := range targets {
+		builders[tIdx] = target.builder
+	}
+	if err = hooks.StartBatch(batchID, builders, order.packages); err != nil {
+		fatalf(exitServer, "Failed to publish packages: %s\n", err)
+	}
+
+	// Every target is published to concurrently, with its own pipeline.
+	started := time.Now()
+	var progress *progressLine
+	if showProgress {
+		progress = newProgressLine(targets)
+	}
+	chats.log = progress.log
+	var waitIndexed func(pkgs []common.Package) error
+	if indexRepo != "" {
+		waiter := &indexWaiter{tpath: indexRepo, interval: pollInterval, timeout: indexTimeout, log: progress.log}
+		waitIndexed = waiter.wait
+	} else if len(hooks.WaveEnd) != 0 && !wait {
+		waterlog.Warnln("The wave-end hooks only run with --wait")
+	}
+	results := make([]push.Result, len(targets))
+	errs := make([]error, len(targets))
+	var wg sync.WaitGroup
+	// The progress line and the job lines take the place of the phase.
+	timings.start("submitting", false)
+	for tIdx, target := range targets {
+		tIdx, target := tIdx, target
+		pipeline := push.Pipeline{
+			Builder:      target.builder,
+			Packages:     order.packages,
+			Deps:         order.deps,
+			Wait:         wait,
+			Journal:      journals[tIdx],
+			Existing:     existing[tIdx],
+			Metadata:     targetMetadata[tIdx],
+			PollInterval: pollInterval,
+			Retry:        retry,
+			SubmitRate:   rate,
+			Concurrency:  submitConcurrency,
+			MaxFailures:  maxFailures,
+			Hooks:        hooks,
+			WaitIndexed:  waitIndexed,
+			OnRetry: func(pkg common.Package, attempt int, delay time.Duration, err error) {
+				var transient *push.TransientError
+				if errors.As(err, &transient) && transient.RateLimited {
+					progress.log(func() {
+						waterlog.Warnln(msg("server.rate-limited", "target", target.label(), "delay", delay))
+					})
+					return
+				}
+				progress.log(func() {
+					waterlog.Warnln(msg("push.retrying", "target", target.label(), "attempt", attempt, "attempts", retry.Attempts, "package", pkg.Name, "delay", delay, "error", err))
+				})
+			},
+			OnStatus: func(pkg common.Package, job push.Job) {
+				if job.Failed() {
+					chats.notify(push.NotifyFailure, msg("notify.build-failed", "target", target.label(), "package", pkg.Name,
+						"version", pkg.Version, "release", pkg.Release, "server", target.builder.Target(), "job", job.ID, "batch", batchID))
+				}
+				// The progress line stands in for jobs that didn't fail.
+				if progress != nil && !job.Failed() {
+					return
+				}
+				progress.log(func() {
+					switch {
+					case job.Failed():
+						fmt.Printf("%s %s%s (%d) %s\n", red("[x]"), target.label(), pkg.Name, job.ID, job.Phase())
+					case job.Indexed():
+						fmt.Printf("%s %s%s (%d) %s\n", green("[✓]"), target.label(), pkg.Name, job.ID, job.Phase())
+					default:
+						fmt.Printf("%s %s%s (%d) %s\n", yellow("[-]"), target.label(), pkg.Name, job.ID, job.Phase())
+					}
+				})
+			},
+		}
+		if progress != nil {
+			pipeline.OnProgress = func(p push.Progress) { progress.update(tIdx, p) }
+		}
+
+		wg.Add(1)
+		go func(tIdx int) {
+			defer wg.Done()
+			results[tIdx], errs[tIdx] = pipeline.Run()
+			if errs[tIdx] != nil {
+				chats.notify(push.NotifyFailure, msg("notify.push-failed", "target", target.label(), "server", target.builder.Target(), "batch", batchID, "error", errs[tIdx]))
+			}
+			chats.notify(push.NotifyBatch, msg("notify.batch", "target", target.label(), "server", target.builder.Target(), "batch", batchID, "outcomes", outcomeCounts(results[tIdx])))
+		}(tIdx)
+	}
+	wg.Wait()
+	timings.end()
+	progress.done()
+	// Targets that stopped on failures are done too: what is left for them
+	// is repushed, not resumed.
+	for tIdx, target := range targets {
+		if errs[tIdx] == nil {
+			if err := journals[tIdx].Finish(); err != nil {
+				waterlog.Warnf("%sFailed to mark the journal as finished: %s\n", target.label(), err)
+			}
+		}
+	}
+	batchErr := hooks.EndBatch(batchID, builders, order.packages, results, errs)
+	recordHistory(started, batchID, targets, order, results, errs)
+
+	var servers, outcomes []string
+	for tIdx, target := range targets {
+		servers = append(servers, target.label()+target.builder.Target())
+		outcomes = append(outcomes, target.label()+outcomeCounts(results[tIdx]))
+	}
+	chats.notify(push.NotifyPush, msg("notify.push", "count", len(order.packages), "servers", strings.Join(servers, ", "),
+		"batch", batchID, "duration", time.Since(started).Round(time.Second), "outcomes", strings.Join(outcomes, "; ")))
+	chats.wait()
+
+	failedTargets := 0
+	for tIdx, target := range targets {
+		if errs[tIdx] != nil {
+			waterlog.Errorf("%sFailed to publish packages: %s\n", target.label(), errs[tIdx])
+			failedTargets++
+		}
+	}
+	if batchErr != nil {
+		waterlog.Errorf("Failed to end the batch: %s\n", batchErr)
+	}
+	if failedTargets == len(targets) {
+		exit(exitServer)
+	}
+
+	if len(targets) > 1 {
+		printMatrix(targets, order, results)
+	}
+	printSummary(targets, results, time.Since(started))
+	if !wait {
+		if failedTargets != 0 || batchErr != nil {
+			exit(exitServer)
+		}
+		waterlog.Goodln(msg("push.published"))
+		return
+	}
+
+	// The failed packages of stopped targets need to be built again, along
+	// with everything that depends on them and everything that wasn't
+	// published.
+	resubmit := make([]bool, len(order.packages))
+	var stopped []pushTarget
+	anyFailed := failedTargets != 0
+	for tIdx, target := range targets {
+		result := results[tIdx]
+		failed := result.Select(push.Failed)
+		blocked := result.Select(push.Blocked)
+		anyFailed = anyFailed || len(failed) > 0 || len(blocked) > 0
+
+		if len(targets) == 1 {
+			printOutcome := func(log func(string, ...interface{}), outcome string, idxs []int) {
+				if len(idxs) == 0 {
+					return
+				}
+				log("%s (%d):", outcome, len(idxs))
+				for _, idx := range idxs {
+					waterlog.Printf(" %s", order.packages[idx].Name)
+				}
+				waterlog.Println()
+			}
+			printOutcome(waterlog.Goodf, "Succeeded", result.Select(push.Succeeded))
+			printOutcome(waterlog.Errorf, "Failed", failed)
+			printOutcome(waterlog.Warnf, "Blocked by failures", blocked)
+			if result.Stopped {
+				printOutcome(waterlog.Warnf, "Still building", result.Select(push.Published))
+				printOutcome(waterlog.Warnf, "Not published", result.Select(push.Pending))
+			}
+		}
+
+		if !result.Stopped {
+			continue
+		}
+		waterlog.Errorln(msg("push.stopped", "target", target.label(), "failed", len(failed), "count", len(order.packages)))
+		stopped = append(stopped, target)
+		for idx := range order.packages {
+			resubmit[idx] = resubmit[idx] || result.Outcomes[idx] == push.Failed || result.Outcomes[idx] == push.Pending ||
+				slices.ContainsFunc(order.deps[idx], func(dep int) bool { return resubmit[dep] })
+		}
+	}
+
+	if len(stopped) != 0 && order.oldTPath != "" {
+		var repush []string
+		for idx, pkg := range order.packages {
+			if resubmit[idx] {
+				repush = append(repush, pkg.Name)
+			}
+		}
+		waterlog.Infoln(msg("push.repush"))
+		fmt.Println(repushCommand(cmd, stopped, order, repush))
+	}
+
+	abiCode := exitOK
+	if abi != nil {
+		abiCode = abi.run(order, results)
+	}
+
+	// Targets that failed as a whole matter more than failed builds, which
+	// matter more than broken ABIs.
+	if failedTargets != 0 || batchErr != nil {
+		exit(exitServer)
+	} else if anyFailed {
+		exit(exitBuildFailed)
+	} else if abiCode != exitOK {
+		exit(abiCode)
+	}
+	waterlog.Goodln(msg("push.indexed"))
+}
+
+// bumpRecipe increments the release number of `pkg` in its package.yml, and
+// commits the change for `reason`, with `changelog` as the body of the commit
+// message if it isn't empty. It returns the new release.
+func bumpRecipe(pkg common.Package, reason string, changelog string) (release int, err error) {
+	recipe := filepath.Join(pkg.Path, "package.yml")
+	if release, err = ypkg.BumpRelease(recipe); err != nil {
+		return
+	}
+	rel, err := filepath.Rel(pkg.Root, recipe)
+	if err != nil {
+		return
+	}
+	message := fmt.Sprintf("%s: Bump release to %d for %s", pkg.Name, release, reason)
+	if changelog != "" {
+		message += "\n\n" + changelog
+	}
+	err = push.GitCommit(pkg.Root, message, rel)
+	return
+}
+
+// commitAutoBumps bumps and commits the release of the packages of `order`
+// that --auto-bump treated as bumped, which is only done once they are about
+// to be published, so that dry runs, plans and manifests leave the recipes
+// alone.
+func commitAutoBumps(order pushOrder) {
+	var errs errorSummary
+	defer errs.exit()
+	for _, pkg := range order.packages {
+		if !order.autoBumped[pkg.Name] {
+			continue
+		}
+		release, err := bumpRecipe(pkg, "recipe changes", "")
+		if err != nil {
+			errs.add(exitFailure, "Failed to bump the release of %s: %s\n", pkg.Name, err)
+			continue
+		} else if release != pkg.Release {
+			errs.add(exitFailure, "Bumped the release of %s to %d instead of %d, its recipe changed since it was diffed\n", pkg.Name, release, pkg.Release)
+			continue
+		}
+		waterlog.Goodln(msg("push.bumped", "package", pkg.Name, "release", release))
+	}
+}
+
+// removePackages asks every target to drop the `removed` packages.
+func removePackages(targets []pushTarget, removed []common.Package) {
+	var errs errorSummary
+	defer errs.exit()
+	for _, target := range targets {
+		caps, err := push.QueryCapabilities(target.builder)
+		if err != nil {
+			errs.add(exitServer, "%sFailed to negotiate with the build server: %s\n", target.label(), err)
+			continue
+		}
+		remover, ok := target.builder.(push.Remover)
+		if !ok || !caps.Remove {
+			waterlog.Warnln(msg("server.no-removal", "target", target.label()))
+			continue
+		}
+
+		for _, pkg := range removed {
+			if err = remover.Remove(pkg); err != nil {
+				errs.add(exitServer, "%sFailed to remove %s: %s\n", target.label(), pkg.Name, err)
+				continue
+			}
+			waterlog.Goodln(msg("server.removed", "target", target.label(), "package", pkg.Name, "version", pkg.Version, "release", pkg.Release))
+		}
+	}
+}
+
+// repushCommand returns the command that pushes only the packages called
+// `names` to `targets`, with the same publishFlags as `cmd` except those
+// identifying the push.
+func repushCommand(cmd *cobra.Command, targets []pushTarget, order pushOrder, names []string) string {
+	publish := &cobra.Command{}
+	publishFlags(publish)
+
+	args := []string{"autobuild", "push", order.oldTPath, order.newTPath, "--publish"}
+	for _, target := range targets {
+		if target.name == "" {
+			args = append(args, "--backend", target.builder.Name())
+		} else {
+			args = append(args, "--target", target.name)
+		}
+	}
+	cmd.Flags().Visit(func(flag *pflag.Flag) {
+		if publish.Flags().Lookup(flag.Name) == nil || slices.Contains([]string{"journal", "resume", "fresh", "batch-id"}, flag.Name) {
+			return
+		}
+		value := flag.Value.String()
+		if slice, ok := flag.Value.(pflag.SliceValue); ok {
+			value = strings.Join(slice.GetSlice(), ",")
+		}
+		args = append(args, fmt.Sprintf("--%s=%s", flag.Name, value))
+	})
+	args = append(args, "--only", strings.Join(names, ","))
+
+	for idx, arg := range args {
+		args[idx] = shellQuote(arg)
+	}
+	return strings.Join(args, " ")
+}
+
+// shellQuote quotes `s` for a POSIX shell, if needed.
+func shellQuote(s string) string {
+	if s != "" && strings.IndexFunc(s, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_./:=,@+%", r))
+	}) < 0 {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
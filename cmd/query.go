@@ -7,6 +7,7 @@ package cmd
 import (
 	"errors"
 	"fmt"
+	"os"
 
 	"github.com/DataDrake/waterlog"
 	st "github.com/GZGavinZhao/autobuild/state"
@@ -21,12 +22,15 @@ var (
 	forward  int
 	reverse  int
 	cmdQuery = &cobra.Command{
-		Use:   "query [src|bin|repo:path] [packages]",
-		Short: "Query the build order of the given packages",
+		Use:   "query [src|bin|repo:path] [packages] | query [package] [src|bin|repo:path]",
+		Short: "Query the build order of the given packages, or look up a package",
 		Long: `Query the build order of the given packages. For example: autobuild query src:../packages rocm-clr pytorch
 
-When no arguments are passed, it tries to compute a build order of all the packages it can find.`,
-		Run: runQuery,
+When no arguments are passed, it tries to compute a build order of all the packages it can find.
+
+When a package is given before the state instead, as in autobuild query glib src:../packages, everything known about it is printed: its version, component, build dependencies (resolved and unresolved), runtime dependencies, what it provides and how many packages depend on it.`,
+		Run:               runQuery,
+		ValidArgsFunction: completePackages,
 		Args: func(cmd *cobra.Command, args []string) error {
 			if len(args) < 1 {
 				return errors.New("expects one arg for path to binary index or source repo")
@@ -41,24 +45,27 @@ func init() {
 	cmdQuery.Flags().BoolVarP(&tiers, "tiers", "t", false, "output tier-ed build order")
 	cmdQuery.Flags().IntVarP(&forward, "forward", "F", 0, "extra level(s) of packages that depends on the list provided")
 	cmdQuery.Flags().IntVarP(&reverse, "reverse", "R", 0, "extra level(s) of packages that the list provided depends on")
+	formatFlag(cmdQuery, withReports("text")...)
 }
 
 func runQuery(cmd *cobra.Command, args []string) {
+	format := getFormat(cmd)
+	if len(args) == 2 && !st.ValidTPath(args[0]) && st.ValidTPath(args[1]) {
+		runLookup(args[0], args[1], format)
+		return
+	}
 	tpath := args[0]
 
+	// Keep stdout clean for the build order itself.
+	if format != "text" {
+		setLogOutput(os.Stderr)
+	}
+
 	state, err := st.LoadState(tpath)
 	if err != nil {
 		waterlog.Fatalf("Failed to parse state: %s\n", err)
 	}
-	waterlog.Goodln("Successfully parsed state!")
-
-	depGraph := state.DepGraph()
-	if depGraph == nil {
-		waterlog.Fatalf("Failed to obtain adjacency map for dependency graph: %s\n", err)
-	}
-	qset := map[int]bool{}
-
-	revGraph := graph.Transpose(depGraph)
+	waterlog.Goodln(msg("state.parsed", "tpath", tpath))
 
 	var queries []string
 	if len(args) < 2 {
@@ -72,17 +79,32 @@ func runQuery(cmd *cobra.Command, args []string) {
 	} else {
 		queries = args[1:]
 	}
+	idxs := packageIdxs(state, queries)
 
-	for _, query := range queries {
-		pkg, idx := st.GetPackage(state, query)
-		if idx < 0 {
-			waterlog.Fatalf("Unable to find package %s\n", query)
-		}
+	// Only the packages that depend on the queried ones need the whole
+	// graph, what they depend on is found from their recipes alone.
+	var depGraph *graph.Immutable
+	if forward > 0 {
+		depGraph = state.DepGraph()
+	} else {
+		depGraph = st.DependencyGraph(state, idxs)
+	}
+	if depGraph == nil {
+		waterlog.Fatalf("Failed to obtain adjacency map for dependency graph: %s\n", err)
+	}
+	qset := map[int]bool{}
 
-		if unresolved := pkg.Resolve(state.NameToSrcIdx(), state.Packages()); len(unresolved) > 0 {
-			waterlog.Warnf("Package %s has unresolved build dependencies, build graph may be incomplete:", pkg.Name)
-			for _, pkg := range unresolved {
-				waterlog.Printf(" %s", pkg)
+	revGraph := graph.Transpose(depGraph)
+
+	unresolved := st.Unresolved(state, idxs)
+	for i, idx := range idxs {
+		if len(unresolved[i]) > 0 {
+			waterlog.Warnf("Package %s has unresolved build dependencies, build graph may be incomplete:", state.Packages()[idx].Name)
+			for _, dep := range unresolved[i] {
+				waterlog.Printf(" %s", dep.Name)
+				if dep.Closest != "" {
+					waterlog.Printf(" (did you mean %s?)", dep.Closest)
+				}
 			}
 			waterlog.Println()
 		}
@@ -109,15 +131,12 @@ func runQuery(cmd *cobra.Command, args []string) {
 	// waterlog.Debugf("qset: %v\n", qset)
 	waterlog.Goodln("Found all requested packages in state!")
 
-	lifted := graph.Sort(utils.LiftGraph(depGraph, func(i int) bool { return qset[i] }))
-	if err != nil {
-		waterlog.Fatalf("Failed to lift final graph from requested nodes: %s\n", err)
-	}
+	lifted := utils.LiftSelection(depGraph, utils.SortedKeys(qset))
 	waterlog.Goodln("Successfully built dependency graph!")
 
 	waterlog.Debugf("depgraph hash: %s\n", utils.GraphHash(depGraph))
 	waterlog.Debugf("depgraph stats: %+v\n", graph.Check(depGraph))
-	waterlog.Debugf("liftgraph hash: %s\n", utils.GraphHash(lifted))
+	waterlog.Debugf("liftgraph hash: %s\n", utils.GraphHash(lifted.Immutable))
 	waterlog.Debugf("liftgraph stats: %+v\n", graph.Check(lifted))
 
 	// {
@@ -147,85 +166,27 @@ func runQuery(cmd *cobra.Command, args []string) {
 	// 	}
 	// }
 
-	order, ok := utils.TieredTopSort(lifted)
-	if !ok {
-		// Try to dump cycles if topological sort failed.
-		// if cycles, err := graph.StrongComponents(lifted); err == nil {
-		cycles := graph.StrongComponents(lifted)
-		cycles = utils.Filter(cycles, func(cycle []int) bool { return len(cycle) > 1 })
-		if len(cycles) == 0 {
-			waterlog.Fatalln("No cycles detected ?!?")
-		}
-
-		for cycleIdx, cycle := range cycles {
-			if len(cycle) <= 1 {
-				continue
-			}
-
-			waterlog.Warnf("Cycle %d:", cycleIdx+1)
-			cycleIdx++
+	order := tieredOrder(state, lifted)
 
-			for _, nodeIdx := range cycle {
-				waterlog.Printf(" %s", state.Packages()[nodeIdx].Name)
-			}
-			waterlog.Println()
-
-			// the order in `cycle` may not be deterministic, so we have to
-			// deterministically choose a starting node by ourselves
-			startIdx := 0
-			for idx, nodeIdx := range cycle {
-				if nodeIdx < cycle[startIdx] {
-					startIdx = idx
-				}
-			}
-			nextIdx := (startIdx + 1) % len(cycle)
-
-			// We always want the longer shortest path
-			path1, dist := graph.ShortestPath(lifted, cycle[startIdx], cycle[nextIdx])
-			if dist == -1 {
-				waterlog.Errorf("Failed to calculate dependency chain that formed this cycle: unreachable\n")
-			}
-			path2, dist := graph.ShortestPath(lifted, cycle[nextIdx], cycle[startIdx])
-			if dist == -1 {
-				waterlog.Errorf("Failed to calculate dependency chain that formed this cycle: unreachale\n")
-			}
-
-			if len(path1) < len(path2) {
-				path1 = path2
-			}
-
-			waterlog.Warnln("One of the dependency chains that led to this cycle:")
-			for _, pidx := range path1 {
-				waterlog.Printf("%s -> ", state.Packages()[pidx].Name)
-			}
-			waterlog.Println(state.Packages()[path1[0]].Name)
+	// Note that the lifted graph only contains the nodes in `qset`, so the
+	// topological sort output has to be mapped back to package indices.
+	if format != "text" {
+		if err = writeReport(os.Stdout, format, "order", newOrderReport(state, lifted, order)); err != nil {
+			waterlog.Fatalf("Failed to write build order: %s\n", err)
 		}
-		// } else {
-		// 	waterlog.Errorf("Failed to get SCC: %s\n", err)
-		// }
-
-		waterlog.Fatalln("Failed to get topological sort order: lifted graph has cycles!")
-	}
-
-	// Note that we still need an extra filter on the tier output,
-	// because due to the limitation of the graph API, the lifted graph
-	// includes nodes [0, n), not just the nodes in `query`/`qset`, so they will
-	// appear in the topological sort output.
-	if tiers {
+	} else if tiers {
 		waterlog.Goodln("Build order:")
 		for tIdx, tier := range order {
-			tier = utils.Filter(tier, func(i int) bool { return qset[i] })
 			waterlog.Goodf("Tier %d: ", tIdx+1)
-			for _, pkgIdx := range tier {
-				fmt.Printf("%s ", state.Packages()[pkgIdx].Name)
+			for _, liftedIdx := range tier {
+				fmt.Printf("%s ", state.Packages()[lifted.Nodes[liftedIdx]].Name)
 			}
 			fmt.Println()
 		}
 	} else {
 		waterlog.Good("Build order: ")
-		tier := utils.Filter(utils.Flatten(order), func(i int) bool { return qset[i] })
-		for _, orderIdx := range tier {
-			fmt.Printf("%s ", state.Packages()[orderIdx].Name)
+		for _, liftedIdx := range utils.Flatten(order) {
+			fmt.Printf("%s ", state.Packages()[lifted.Nodes[liftedIdx]].Name)
 		}
 		fmt.Println()
 	}
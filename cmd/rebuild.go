@@ -0,0 +1,265 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/DataDrake/waterlog"
+	"github.com/GZGavinZhao/autobuild/common"
+	"github.com/GZGavinZhao/autobuild/config"
+	"github.com/GZGavinZhao/autobuild/push"
+	"github.com/GZGavinZhao/autobuild/state"
+	"github.com/GZGavinZhao/autobuild/utils"
+	"github.com/GZGavinZhao/autobuild/version"
+	"github.com/spf13/cobra"
+)
+
+var (
+	rebuildDepth     int
+	rebuildLinks     bool
+	rebuildOutput    string
+	rebuildBump      bool
+	rebuildCommit    bool
+	rebuildChangelog string
+	rebuildPublish   bool
+	cmdRebuild       = &cobra.Command{
+		Use:   "rebuild [package] [src:path]",
+		Short: "Compute the packages to rebuild after updating a package",
+		Long: `Compute the packages that build-depend on the given package, and have to be
+rebuilt after it was updated, along with their build order. For example:
+autobuild rebuild openssl src:../packages
+
+--depth follows the build dependencies of the rebuilt packages further, and
+--links only keeps the packages that link against the ones they are rebuilt
+for, according to their pspec_x86_64.xml. The list format prints one package
+per line in build order, for bump --from-file. --bump bumps the packages right
+away, like bump does, and --publish publishes them afterwards like push does,
+so that a mass rebuild takes a single command:
+autobuild rebuild openssl src:../packages --links --bump --commit --publish`,
+		Run:               runRebuild,
+		ValidArgsFunction: completePackages,
+		Args:              cobra.ExactArgs(2),
+	}
+)
+
+// rebuildReport is the JSON output of rebuild.
+type rebuildReport struct {
+	Trigger string `json:"trigger"`
+	orderReport
+}
+
+func init() {
+	cmdRebuild.Flags().IntVarP(&rebuildDepth, "depth", "d", 1, "level(s) of build dependents to rebuild, negative for all of them")
+	cmdRebuild.Flags().BoolVar(&rebuildLinks, "links", false, "only rebuild the packages that link against the packages they are rebuilt for")
+	formatFlag(cmdRebuild, withReports("text", "list")...)
+	cmdRebuild.Flags().StringVarP(&rebuildOutput, "output", "o", "", "write the rebuild set to the given file instead of stdout")
+	cmdRebuild.Flags().BoolVar(&rebuildBump, "bump", false, "bump the release of the packages to rebuild")
+	cmdRebuild.Flags().BoolVar(&rebuildCommit, "commit", false, "with --bump, create a git commit per package")
+	cmdRebuild.Flags().StringVar(&rebuildChangelog, "changelog", "", "with --commit, changelog entry to add to the commit messages")
+	cmdRebuild.Flags().BoolVar(&rebuildPublish, "publish", false, "with --commit, publish the bumped packages to the build server, after confirming")
+	cmdRebuild.Flags().BoolP("yes", "y", false, "publish without asking for confirmation, e.g. in CI")
+	backendFlag(cmdRebuild)
+	targetFlag(cmdRebuild)
+	publishFlags(cmdRebuild)
+	pinFlag(cmdRebuild)
+}
+
+func runRebuild(cmd *cobra.Command, args []string) {
+	trigger := args[0]
+	tpath := args[1]
+
+	// Keep stdout clean for the rebuild set itself.
+	if rebuildOutput == "" {
+		setLogOutput(os.Stderr)
+	}
+
+	format := getFormat(cmd)
+	if rebuildCommit && !rebuildBump || rebuildChangelog != "" && !rebuildCommit {
+		waterlog.Fatalln("--commit needs --bump, and --changelog needs --commit")
+	}
+	if rebuildPublish && !rebuildCommit {
+		waterlog.Fatalln("--publish needs --commit, the build server only builds committed recipes")
+	}
+
+	srcState, err := state.LoadState(tpath)
+	if err != nil {
+		waterlog.Fatalf("Failed to parse state: %s\n", err)
+	}
+	if _, ok := srcState.(*state.SourceState); !ok {
+		waterlog.Fatalf("Can only compute rebuilds of source states, not %s\n", tpath)
+	}
+	pkg, idx := state.GetPackage(srcState, trigger)
+	if idx < 0 {
+		waterlog.Fatalf("Unable to find package %s\n", trigger)
+	}
+
+	rset := rebuildSet(srcState, idx, rebuildDepth, rebuildLinks)
+	if len(rset) == 0 {
+		waterlog.Goodf("Nothing has to be rebuilt for %s\n", pkg.Name)
+		return
+	}
+	var rpkgs []common.Package
+	for _, rIdx := range rset {
+		rpkgs = append(rpkgs, srcState.Packages()[rIdx])
+	}
+	getPins(cmd).check(rpkgs, "rebuild", "")
+	lifted := utils.LiftSelection(srcState.DepGraph(), rset)
+	order := tieredOrder(srcState, lifted)
+
+	report := rebuildReport{Trigger: pkg.Name, orderReport: newOrderReport(srcState, lifted, order)}
+
+	var w io.Writer = os.Stdout
+	if rebuildOutput != "" {
+		f, err := os.Create(rebuildOutput)
+		if err != nil {
+			waterlog.Fatalf("Failed to create %s: %s\n", rebuildOutput, err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	switch format {
+	case "json", "yaml":
+		err = writeReport(w, format, "rebuild", report)
+	case "list":
+		_, err = fmt.Fprintln(w, strings.Join(report.Order, "\n"))
+	default:
+		_, err = fmt.Fprintf(w, "Rebuild set of %s (%d packages): %s\n", pkg.Name, len(report.Order), strings.Join(report.Order, " "))
+		for tIdx, tier := range report.Tiers {
+			if err == nil {
+				_, err = fmt.Fprintf(w, "Wave %d: %s\n", tIdx+1, strings.Join(tier, " "))
+			}
+		}
+	}
+	if err != nil {
+		waterlog.Fatalf("Failed to write rebuild set: %s\n", err)
+	}
+
+	if !rebuildBump {
+		return
+	}
+
+	// Set up and confirm the push before bumping anything, so that a
+	// declined push doesn't leave commits behind.
+	var userConfig config.UserConfig
+	var targets []pushTarget
+	if rebuildPublish {
+		if userConfig, err = loadConfig(); err != nil {
+			waterlog.Fatalf("Failed to load configuration: %s\n", err)
+		}
+		targets = pushTargets(cmd, userConfig)
+		if yes, _ := cmd.Flags().GetBool("yes"); !yes {
+			confirmPublish(targets, len(rset), 0)
+		}
+	}
+
+	var bumps []int
+	for _, liftedIdx := range utils.Flatten(order) {
+		bumps = append(bumps, lifted.Nodes[liftedIdx])
+	}
+	var errs errorSummary
+	bumpPackages(srcState, bumps, rebuildCommit, "a rebuild against "+pkg.Name, rebuildChangelog, false, &errs)
+	errs.exit()
+	if !rebuildPublish {
+		return
+	}
+
+	// Publish the bumped releases, which only the reloaded state has.
+	newState, err := state.LoadState(tpath)
+	if err != nil {
+		waterlog.Fatalf("Failed to parse state: %s\n", err)
+	}
+	changes := make(map[int]*push.PlanVersion)
+	for _, rpkg := range rpkgs {
+		newIdx, ok := newState.NameToSrcIdx()[rpkg.Name]
+		if !ok {
+			waterlog.Fatalf("Unable to find package %s after bumping it\n", rpkg.Name)
+		}
+		changes[newIdx] = &push.PlanVersion{Version: rpkg.Version, Release: rpkg.Release}
+	}
+	if reason, _ := cmd.Flags().GetString("reason"); reason == "" {
+		cmd.Flags().Set("reason", "Rebuild against "+pkg.Name)
+	}
+	rebuilt := orderChanges(newState, tpath, changes)
+	printOrder(rebuilt)
+	rebuilt.newTPath = tpath
+	publishOrder(cmd, targets, userConfig, rebuilt)
+}
+
+// rebuildSet returns the sorted indices of the packages of `s` that
+// build-depend on the package at `idx`, and on those up to `depth` levels, or
+// all of them if `depth` is negative. With `links`, only the packages that
+// link against the package they depend on are kept, see common.Package.Links.
+func rebuildSet(s state.State, idx int, depth int, links bool) []int {
+	pkgs := s.Packages()
+	rset := map[int]bool{}
+	frontier := []int{idx}
+	for level := 1; len(frontier) > 0 && (depth < 0 || level <= depth); level++ {
+		var next []int
+		for _, node := range frontier {
+			s.DepGraph().Visit(node, func(w int, kind int64) (skip bool) {
+				if rset[w] || w == idx || kind != int64(common.BuildDep) {
+					return
+				}
+				if links && !slices.ContainsFunc(pkgs[w].Links, func(link string) bool {
+					linked, ok := s.NameToSrcIdx()[link]
+					return ok && linked == node
+				}) {
+					return
+				}
+				rset[w] = true
+				next = append(next, w)
+				return
+			})
+		}
+		frontier = next
+	}
+	return utils.SortedKeys(rset)
+}
+
+// suggestRebuilds returns the packages selected by `filter` that weren't
+// bumped, but build-depend directly on bumped packages of `changes` (see
+// diffStates) with a new version, and logs their recipes. Such packages were
+// built against the old version, and may need a release bump to pick up the
+// new one. Release-only bumps don't count, since they rarely change what
+// dependents build against.
+func suggestRebuilds(newState state.State, changes map[int]*push.PlanVersion, filter pushFilter) (res []manifestRebuild) {
+	depGraph := newState.DepGraph()
+	if depGraph == nil {
+		waterlog.Warnln("Can't suggest rebuilds without the dependency graph of the new state")
+		return
+	}
+
+	pkgs := newState.Packages()
+	needs := make(map[int][]string)
+	for _, idx := range utils.SortedKeys(changes) {
+		old := changes[idx]
+		if old == nil || version.Compare(old.Version, pkgs[idx].Version) == 0 {
+			continue
+		}
+		depGraph.Visit(idx, func(w int, kind int64) (skip bool) {
+			if _, bumped := changes[w]; !bumped && kind == int64(common.BuildDep) && filter.match(pkgs[w]) {
+				needs[w] = append(needs[w], pkgs[idx].Name)
+			}
+			return
+		})
+	}
+	if len(needs) == 0 {
+		return
+	}
+
+	waterlog.Infoln("The following recipes build-depend on packages with a new version, and may need a new release to be rebuilt against them:")
+	for _, idx := range utils.SortedKeys(needs) {
+		pkg := pkgs[idx]
+		waterlog.Printf("    %s (%s)\n", pkg.Path, strings.Join(needs[idx], ", "))
+		res = append(res, manifestRebuild{manifestPackage: newManifestPackage(pkg, nil), Needs: needs[idx]})
+	}
+	return
+}
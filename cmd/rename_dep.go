@@ -0,0 +1,191 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/DataDrake/waterlog"
+	"github.com/GZGavinZhao/autobuild/common"
+	"github.com/GZGavinZhao/autobuild/state"
+	"github.com/GZGavinZhao/autobuild/utils"
+	"github.com/GZGavinZhao/autobuild/ypkg"
+	"github.com/spf13/cobra"
+)
+
+var (
+	renameRunDeps   bool
+	renameDryRun    bool
+	renameOutput    string
+	renameBump      bool
+	renameCommit    bool
+	renameChangelog string
+	cmdRenameDep    = &cobra.Command{
+		Use:   "rename-dep <old-name> <new-name> <src:path>",
+		Short: "Rename a dependency in every recipe that build-depends on it",
+		Long: `Rewrite every package.yml that build- or check-depends on old-name to depend
+on new-name instead, keeping the rest of the recipes as they are, and print the
+build order of the rewritten packages, e.g. after a provider was renamed:
+autobuild rename-dep libfoo-devel foo-devel src:../packages
+
+--rundeps renames runtime dependencies as well, and --dry-run only lists the
+packages that would be rewritten. --bump bumps the rewritten packages right
+away, like bump does, to push them afterwards.`,
+		Run:  runRenameDep,
+		Args: cobra.ExactArgs(3),
+	}
+)
+
+// renameReport is the JSON output of rename-dep.
+type renameReport struct {
+	Old string `json:"old"`
+	New string `json:"new"`
+	orderReport
+}
+
+func init() {
+	cmdRenameDep.Flags().BoolVar(&renameRunDeps, "rundeps", false, "rename runtime dependencies as well")
+	cmdRenameDep.Flags().BoolVarP(&renameDryRun, "dry-run", "n", false, "only list the packages that would be rewritten")
+	formatFlag(cmdRenameDep, "text", "json", "list")
+	cmdRenameDep.Flags().StringVarP(&renameOutput, "output", "o", "", "write the rewritten packages to the given file instead of stdout")
+	cmdRenameDep.Flags().BoolVar(&renameBump, "bump", false, "bump the release of the rewritten packages")
+	cmdRenameDep.Flags().BoolVar(&renameCommit, "commit", false, "with --bump, create a git commit per package")
+	cmdRenameDep.Flags().StringVar(&renameChangelog, "changelog", "", "with --commit, changelog entry to add to the commit messages")
+	pinFlag(cmdRenameDep)
+}
+
+func runRenameDep(cmd *cobra.Command, args []string) {
+	oldName, newName, tpath := args[0], args[1], args[2]
+
+	// Keep stdout clean for the rewritten packages themselves.
+	if renameOutput == "" {
+		setLogOutput(os.Stderr)
+	}
+
+	format := getFormat(cmd)
+	if renameCommit && !renameBump || renameChangelog != "" && !renameCommit {
+		waterlog.Fatalln("--commit needs --bump, and --changelog needs --commit")
+	}
+	if oldName == newName {
+		waterlog.Fatalln("The old and new names are the same")
+	}
+
+	srcState, err := state.LoadState(tpath)
+	if err != nil {
+		waterlog.Fatalf("Failed to parse state: %s\n", err)
+	}
+	if _, ok := srcState.(*state.SourceState); !ok {
+		waterlog.Fatalf("Can only rename dependencies in source states, not %s\n", tpath)
+	}
+	if !state.PackageExists(srcState, newName) {
+		waterlog.Warnf("No package of %s provides %s\n", tpath, newName)
+	}
+
+	keys := []string{"builddeps", "checkdeps"}
+	kinds := []common.DepKind{common.BuildDep, common.CheckDep}
+	if renameRunDeps {
+		keys, kinds = append(keys, "rundeps"), append(kinds, common.RunDep)
+	}
+
+	var affected []common.Package
+	for _, pkg := range srcState.Packages() {
+		if !slices.ContainsFunc(pkg.BuildDeps, func(dep string) bool { return dep == oldName && slices.Contains(kinds, pkg.DepKind(dep)) }) {
+			continue
+		}
+		if !utils.PathExists(filepath.Join(pkg.Path, "package.yml")) {
+			waterlog.Warnf("Skipping %s, only package.yml recipes can be rewritten\n", pkg.Name)
+			continue
+		}
+		affected = append(affected, pkg)
+	}
+	if len(affected) == 0 {
+		waterlog.Goodf("Nothing depends on %s\n", oldName)
+		return
+	}
+	if renameBump {
+		getPins(cmd).check(affected, "bump", "")
+	}
+
+	// The recipes that fail to be rewritten are reported once the others are.
+	var errs errorSummary
+	defer errs.exit()
+	rewritten := affected[:0]
+	for _, pkg := range affected {
+		if renameDryRun {
+			waterlog.Infof("Would rename %s to %s in %s\n", oldName, newName, pkg.Name)
+			rewritten = append(rewritten, pkg)
+			continue
+		}
+		if _, err := ypkg.RenameDep(filepath.Join(pkg.Path, "package.yml"), keys, oldName, newName); err != nil {
+			errs.add(exitFailure, "Failed to rewrite %s: %s\n", pkg.Name, err)
+			continue
+		}
+		waterlog.Goodf("Renamed %s to %s in %s\n", oldName, newName, pkg.Name)
+		rewritten = append(rewritten, pkg)
+	}
+	if affected = rewritten; len(affected) == 0 {
+		return
+	}
+
+	// The order is that of the rewritten recipes, which may depend on the
+	// new provider differently.
+	if !renameDryRun {
+		if srcState, err = state.LoadState(tpath); err != nil {
+			waterlog.Fatalf("Failed to parse the rewritten state: %s\n", err)
+		}
+	}
+	var idxs []int
+	for _, pkg := range affected {
+		_, idx := state.GetPackage(srcState, pkg.Name)
+		idxs = append(idxs, idx)
+	}
+	slices.Sort(idxs)
+	lifted := utils.LiftSelection(srcState.DepGraph(), idxs)
+	order := tieredOrder(srcState, lifted)
+	report := renameReport{Old: oldName, New: newName, orderReport: newOrderReport(srcState, lifted, order)}
+
+	var w io.Writer = os.Stdout
+	if renameOutput != "" {
+		f, err := os.Create(renameOutput)
+		if err != nil {
+			waterlog.Fatalf("Failed to create %s: %s\n", renameOutput, err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(report)
+	case "list":
+		_, err = fmt.Fprintln(w, strings.Join(report.Order, "\n"))
+	default:
+		_, err = fmt.Fprintf(w, "Packages depending on %s (%d packages): %s\n", oldName, len(report.Order), strings.Join(report.Order, " "))
+		for tIdx, tier := range report.Tiers {
+			if err == nil {
+				_, err = fmt.Fprintf(w, "Wave %d: %s\n", tIdx+1, strings.Join(tier, " "))
+			}
+		}
+	}
+	if err != nil {
+		waterlog.Fatalf("Failed to write rewritten packages: %s\n", err)
+	}
+
+	if renameBump {
+		var bumps []int
+		for _, liftedIdx := range utils.Flatten(order) {
+			bumps = append(bumps, lifted.Nodes[liftedIdx])
+		}
+		bumpPackages(srcState, bumps, renameCommit, fmt.Sprintf("the rename of %s to %s", oldName, newName), renameChangelog, renameDryRun, &errs)
+	}
+}
@@ -0,0 +1,265 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DataDrake/waterlog"
+	st "github.com/GZGavinZhao/autobuild/state"
+	"github.com/GZGavinZhao/autobuild/utils"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	cmdSchema = &cobra.Command{
+		Use:   "schema [name]",
+		Short: "Print the JSON schemas of the reports of read-only commands",
+		Long: `Print the JSON schema of the report called name, or list the schemas.
+
+The json and yaml formats of query, diff, order, rebuild, stats, lint,
+orphans, outdated and security-report start with the ID of the schema they
+follow, e.g. "schema": "autobuild/order/v1". Fields may be added to a schema,
+but its version changes whenever fields are removed or change meaning.`,
+		Run:  runSchema,
+		Args: cobra.MaximumNArgs(1),
+		ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+			return utils.SortedKeys(reportSchemas), cobra.ShellCompDirectiveNoFileComp
+		},
+	}
+)
+
+// reportFormats are the machine-readable formats of reports, see writeReport.
+var reportFormats = []string{"json", "yaml"}
+
+// reportSchema describes the reports of a command.
+type reportSchema struct {
+	version int
+	// report is an empty report, that the schema is derived from.
+	report any
+	title  string
+}
+
+// reportSchemas maps the names of schemas to their description.
+var reportSchemas = map[string]reportSchema{
+	"package":         {1, queryPackage{}, "A package looked up by query"},
+	"order":           {1, orderReport{}, "The build order of query and order"},
+	"diff":            {1, diffReport{}, "The changes between two states, by diff"},
+	"pipeline-diff":   {1, pipelineReport{}, "The stages of packages between three states, by diff"},
+	"rebuild":         {1, rebuildReport{}, "The packages to rebuild after a package changed, by rebuild"},
+	"stats":           {1, st.Stats{}, "The statistics of a state, by stats"},
+	"lint":            {1, lintReport{}, "The problems found by lint"},
+	"orphans":         {1, orphansReport{}, "The packages nothing depends on, by orphans"},
+	"outdated":        {1, outdatedReport{}, "The packages behind their latest release upstream, by outdated"},
+	"security-report": {1, securityReport{}, "The packages with known vulnerabilities, by security-report"},
+}
+
+// schemaID returns the ID of the schema called `name`.
+func schemaID(name string) string {
+	return fmt.Sprintf("autobuild/%s/v%d", name, reportSchemas[name].version)
+}
+
+// writeReport writes `report`, which follows the schema called `name`, to `w`
+// in `format`, one of reportFormats. The ID of the schema comes first.
+func writeReport(w io.Writer, format string, name string, report any) error {
+	raw, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+	schema := `{"schema":` + strconv.Quote(schemaID(name))
+	if string(raw) == "{}" {
+		raw = []byte(schema + "}")
+	} else {
+		raw = append([]byte(schema+","), raw[1:]...)
+	}
+
+	if format == "json" {
+		var b bytes.Buffer
+		if err = json.Indent(&b, raw, "", "  "); err != nil {
+			return err
+		}
+		b.WriteByte('\n')
+		_, err = b.WriteTo(w)
+		return err
+	}
+
+	// Reports only have json tags. Going through JSON, which is YAML, keeps
+	// the keys and their order the same in both formats.
+	var node yaml.Node
+	if err = yaml.Unmarshal(raw, &node); err != nil {
+		return err
+	}
+	blockStyle(&node)
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err = enc.Encode(&node); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// blockStyle sets `node` and its children to the plain block style, instead
+// of the flow style and quotes of JSON. Strings that would read as something
+// else are still quoted.
+func blockStyle(node *yaml.Node) {
+	node.Style = 0
+	for _, child := range node.Content {
+		blockStyle(child)
+	}
+}
+
+// outputFormat is the --format that every command writes its output in, see
+// formatFlag.
+var outputFormat string
+
+// formatsAnnotation is the annotation of the commands that take --format,
+// listing the formats they write.
+const formatsAnnotation = "autobuild/formats"
+
+// formatFlag makes `cmd` write its output in one of `formats` with the
+// persistent --format, the first one by default, and lists them in its help.
+func formatFlag(cmd *cobra.Command, formats ...string) {
+	if cmd.Annotations == nil {
+		cmd.Annotations = make(map[string]string)
+	}
+	cmd.Annotations[formatsAnnotation] = strings.Join(formats, ",")
+	if cmd.Long == "" {
+		cmd.Long = cmd.Short
+	}
+	cmd.Long += fmt.Sprintf("\n\nThe output is written with --format in one of %q, %s by default.", formats, formats[0])
+}
+
+// withReports returns `formats` followed by reportFormats.
+func withReports(formats ...string) []string {
+	return append(formats, reportFormats...)
+}
+
+// commandFormats returns the formats of --format that `cmd` writes, see
+// formatFlag.
+func commandFormats(cmd *cobra.Command) []string {
+	if formats := cmd.Annotations[formatsAnnotation]; formats != "" {
+		return strings.Split(formats, ",")
+	}
+	return nil
+}
+
+// getFormat returns the --format of `cmd`, or its default one, and exits if
+// `cmd` can't write it.
+func getFormat(cmd *cobra.Command) string {
+	formats := commandFormats(cmd)
+	if outputFormat == "" {
+		return formats[0]
+	}
+	if !slices.Contains(formats, outputFormat) {
+		waterlog.Fatalf("Unknown %s format %s, use one of %q\n", cmd.Name(), outputFormat, formats)
+	}
+	return outputFormat
+}
+
+// checkFormatFlag exits if --format is given to a command that doesn't take
+// it, which would otherwise be silently ignored.
+func checkFormatFlag(cmd *cobra.Command) {
+	if cmd.Flags().Changed("format") && commandFormats(cmd) == nil {
+		waterlog.Fatalf("%s has no output format, --format doesn't apply to it\n", cmd.Name())
+	}
+}
+
+// completeFormats completes --format with the formats of the command.
+func completeFormats(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	return commandFormats(cmd), cobra.ShellCompDirectiveNoFileComp
+}
+
+func runSchema(cmd *cobra.Command, args []string) {
+	if len(args) == 0 {
+		for _, name := range utils.SortedKeys(reportSchemas) {
+			fmt.Printf("%-15s %-28s %s\n", name, schemaID(name), reportSchemas[name].title)
+		}
+		return
+	}
+
+	schema, ok := reportSchemas[args[0]]
+	if !ok {
+		waterlog.Fatalf("Unknown schema %s, use one of %q\n", args[0], utils.SortedKeys(reportSchemas))
+	}
+	doc := jsonSchema(reflect.TypeOf(schema.report))
+	doc["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	doc["$id"] = schemaID(args[0])
+	doc["title"] = schema.title
+	props := doc["properties"].(map[string]any)
+	props["schema"] = map[string]any{"const": schemaID(args[0])}
+	doc["required"] = append([]string{"schema"}, doc["required"].([]string)...)
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		waterlog.Fatalf("Failed to write schema: %s\n", err)
+	}
+}
+
+// jsonSchema returns the JSON schema of the values of `t`, as encoded by
+// encoding/json.
+func jsonSchema(t reflect.Type) map[string]any {
+	if t == reflect.TypeOf(time.Time{}) {
+		return map[string]any{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return jsonSchema(t.Elem())
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		// Nil slices are encoded as null.
+		return map[string]any{"type": []string{"array", "null"}, "items": jsonSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": []string{"object", "null"}, "additionalProperties": jsonSchema(t.Elem())}
+	case reflect.Struct:
+		props, required := make(map[string]any), []string{}
+		addFields(t, props, &required)
+		return map[string]any{"type": "object", "properties": props, "required": required}
+	}
+	return map[string]any{}
+}
+
+// addFields adds the JSON fields of the struct type `t` to `props`, and the
+// ones that are never omitted to `required`, including the fields of embedded
+// structs.
+func addFields(t reflect.Type, props map[string]any, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" || !field.IsExported() && !field.Anonymous {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			addFields(field.Type, props, required)
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		props[name] = jsonSchema(field.Type)
+		if !slices.Contains(strings.Split(opts, ","), "omitempty") {
+			*required = append(*required, name)
+		}
+	}
+}
@@ -0,0 +1,206 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package cmd
+
+import (
+	"path/filepath"
+	"slices"
+
+	"github.com/DataDrake/waterlog"
+	"github.com/GZGavinZhao/autobuild/push"
+	"github.com/GZGavinZhao/autobuild/state"
+	"github.com/GZGavinZhao/autobuild/utils"
+	"github.com/spf13/cobra"
+)
+
+var (
+	cmdRepush = &cobra.Command{
+		Use:   "repush --from-journal <journal>",
+		Short: "Publish the failed packages of a push again, with their dependents",
+		Long: `Publish the failed packages of a push again, with their dependents.
+
+The jobs recorded in the journal are queried from the build server, and only
+the packages that failed, and the packages of the push that depend on them and
+weren't built yet, are published again, in build order. The states the push
+diffed are looked up in the history, unless --state is given.`,
+		Run:  runRepush,
+		Args: cobra.NoArgs,
+	}
+)
+
+func init() {
+	cmdRepush.Flags().String("from-journal", "", "journal of the push to publish the failures of")
+	cmdRepush.MarkFlagRequired("from-journal")
+	cmdRepush.Flags().String("state", "", "TPath of the recipes to publish (default the new state of the push)")
+	backendFlag(cmdRepush)
+	targetFlag(cmdRepush)
+	publishFlags(cmdRepush)
+}
+
+func runRepush(cmd *cobra.Command, args []string) {
+	fromJournal, _ := cmd.Flags().GetString("from-journal")
+	tpath, _ := cmd.Flags().GetString("state")
+	journalPath, _ := cmd.Flags().GetString("journal")
+	resumePath, _ := cmd.Flags().GetString("resume")
+
+	if resumePath == "" && filepath.Clean(journalPath) == filepath.Clean(fromJournal) {
+		waterlog.Fatalf("The journal of the push would overwrite %s, please pass another --journal\n", fromJournal)
+	}
+
+	journal, err := push.LoadJournal(fromJournal)
+	if err != nil {
+		waterlog.Fatalf("Failed to load journal: %s\n", err)
+	}
+	entries := journal.Entries()
+	journal.Close()
+	if len(entries) == 0 {
+		waterlog.Fatalf("No jobs are recorded in %s\n", fromJournal)
+	}
+
+	// The journal only records published packages, while the history has all
+	// the packages of the push, including those that were blocked.
+	var record *push.HistoryRecord
+	if history, err := loadHistory(); err != nil {
+		waterlog.Warnf("Failed to load the history: %s\n", err)
+	} else {
+		batch := entries[len(entries)-1].Batch
+		for i := len(history) - 1; i >= 0 && record == nil && batch != ""; i-- {
+			if history[i].Batch == batch {
+				record = &history[i]
+			}
+		}
+	}
+
+	old := make(map[string]*push.PlanVersion)
+	var names []string
+	if record != nil {
+		for _, pkg := range record.Packages {
+			names = append(names, pkg.Name)
+			old[pkg.Name] = pkg.Old
+		}
+		if tpath == "" {
+			tpath = record.New
+		}
+	} else {
+		waterlog.Warnln("The push isn't in the history, only its published packages are considered")
+		for _, entry := range entries {
+			if !slices.Contains(names, entry.Package) {
+				names = append(names, entry.Package)
+			}
+		}
+	}
+	if tpath == "" {
+		waterlog.Fatalln("Unknown state of the push, please pass --state")
+	}
+
+	userConfig, err := loadConfig()
+	if err != nil {
+		waterlog.Fatalf("Failed to load configuration: %s\n", err)
+	}
+	targets := pushTargets(cmd, userConfig)
+	if len(targets) != 1 {
+		waterlog.Fatalln("A journal belongs to a single target, please pass only one")
+	}
+	builder := targets[0].builder
+
+	newState, err := state.LoadState(tpath)
+	if err != nil {
+		waterlog.Fatalf("Failed to load state %s: %s\n", tpath, err)
+	}
+	depGraph := newState.DepGraph()
+	if depGraph == nil {
+		waterlog.Fatalf("Failed to obtain dependency graph of state %s\n", tpath)
+	}
+
+	// Every package of the push is either built, failed, or neither yet.
+	built := make(map[int]bool)
+	failed := make(map[int]bool)
+	var pushed []int
+	var errs errorSummary
+	for _, name := range names {
+		pkg, idx := state.GetPackage(newState, name)
+		if idx < 0 || pkg.Name != name {
+			waterlog.Warnf("%s is no longer in %s, skipping it\n", name, tpath)
+			continue
+		}
+		pushed = append(pushed, idx)
+
+		entry, ok := latestEntry(entries, name)
+		if !ok {
+			continue
+		}
+		job, err := builder.Query(entry.JobID)
+		if err != nil {
+			errs.add(exitServer, "Failed to query job %d of %s: %s\n", entry.JobID, name, err)
+			continue
+		}
+		built[idx] = job.Indexed()
+		failed[idx] = job.Failed()
+		if failed[idx] && entry.Version == pkg.Version && entry.Release == pkg.Release {
+			waterlog.Warnf("%s failed as %s-%d, which is still its current release\n", name, pkg.Version, pkg.Release)
+		}
+	}
+	// What to re-push is unknown without the outcome of every job.
+	errs.exit()
+	slices.Sort(pushed)
+
+	// Dependencies between the packages of the push, including indirect ones
+	// through packages that aren't part of it.
+	lifted := utils.LiftSelection(depGraph, pushed)
+	changes := make(map[int]*push.PlanVersion)
+	var queue []int
+	numFailed := 0
+	for v, idx := range lifted.Nodes {
+		if failed[idx] {
+			changes[idx] = old[newState.Packages()[idx].Name]
+			queue = append(queue, v)
+			numFailed++
+		}
+	}
+	if numFailed == 0 {
+		waterlog.Goodln(msg("repush.nothing"))
+		return
+	}
+	for len(queue) != 0 {
+		v := queue[0]
+		queue = queue[1:]
+		lifted.Visit(v, func(w int, _ int64) (skip bool) {
+			idx := lifted.Nodes[w]
+			if _, ok := changes[idx]; !ok && !built[idx] {
+				changes[idx] = old[newState.Packages()[idx].Name]
+				queue = append(queue, w)
+			}
+			return
+		})
+	}
+	waterlog.Infoln(msg("repush.failed", "failed", numFailed, "count", len(changes)))
+
+	order := orderChanges(newState, tpath, changes)
+	printOrder(order)
+	if record != nil {
+		order.oldTPath = record.Old
+	}
+	order.newTPath = tpath
+	publishOrder(cmd, targets, userConfig, order)
+}
+
+// loadHistory loads the history of pushes.
+func loadHistory() ([]push.HistoryRecord, error) {
+	path, err := push.HistoryPath()
+	if err != nil {
+		return nil, err
+	}
+	return push.LoadHistory(path)
+}
+
+// latestEntry returns the latest entry of the package called `name`.
+func latestEntry(entries []push.JournalEntry, name string) (entry push.JournalEntry, ok bool) {
+	for _, e := range entries {
+		if e.Package == name {
+			entry, ok = e, true
+		}
+	}
+	return
+}
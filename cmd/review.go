@@ -0,0 +1,139 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/DataDrake/waterlog"
+	"github.com/GZGavinZhao/autobuild/push"
+	st "github.com/GZGavinZhao/autobuild/state"
+	"github.com/spf13/cobra"
+)
+
+var (
+	reportPR  string
+	cmdReport = &cobra.Command{
+		Use:   "report <[src|bin|repo]:path-to-old> <[src|bin|repo]:path-to-new> [--pr url]",
+		Short: "Comment the diff and build order of a pull or merge request on it",
+		Long: `Write the changes between the states, with the impact of every changed
+package, and the order to build them in, as Markdown, and comment it on the
+pull request of GitHub or the merge request of GitLab given with --pr. On
+GitHub Actions and GitLab CI, the request that the job runs for is commented
+on when --pr isn't given. Later runs replace the comment of the first one, so
+that it follows the request as it changes.
+
+The token to comment with is read from $AUTOBUILD_GITHUB_TOKEN or
+$GITHUB_TOKEN, or from $AUTOBUILD_GITLAB_TOKEN or $GITLAB_TOKEN. Without a
+request to comment on, the report is printed.`,
+		Run:  runReport,
+		Args: defaultStatesArgs(2),
+	}
+)
+
+func init() {
+	cmdReport.Flags().StringVar(&reportPR, "pr", "", "URL of the pull or merge request to comment on")
+	filterFlags(cmdReport)
+	commitFlags(cmdReport)
+}
+
+// reportMarker is hidden in the comments of report, to find them again.
+const reportMarker = "<!-- autobuild report -->"
+
+// reviewTokens are the environment variables holding the token of every
+// forge, in order of precedence.
+var reviewTokens = map[string][]string{
+	"github": {"AUTOBUILD_GITHUB_TOKEN", "GITHUB_TOKEN"},
+	"gitlab": {"AUTOBUILD_GITLAB_TOKEN", "GITLAB_TOKEN"},
+}
+
+// writeOrderMarkdown writes the build order of the packages of `report` that
+// are built, in tiers of packages that can be built at the same time.
+func writeOrderMarkdown(b *strings.Builder, newState st.State, report diffReport) {
+	if newState.DepGraph() == nil {
+		return
+	}
+	var idxs []int
+	for _, pkg := range report.Packages {
+		if _, idx := st.GetPackage(newState, pkg.Name); idx >= 0 && pkg.New != nil {
+			idxs = append(idxs, idx)
+		}
+	}
+	if len(idxs) == 0 {
+		return
+	}
+
+	b.WriteString("\n### Build order\n\n")
+	order, err := orderOf(newState, idxs)
+	if err != nil {
+		fmt.Fprintf(b, "The packages can't be ordered: %s.\n", err)
+		return
+	}
+	for i, tier := range order.Tiers {
+		fmt.Fprintf(b, "%d. %s\n", i+1, strings.Join(tier, ", "))
+	}
+}
+
+func runReport(cmd *cobra.Command, args []string) {
+	args = defaultStates(cmd, args)
+	setLogOutput(os.Stderr)
+	filter := getFilter(cmd)
+
+	prURL := reportPR
+	if prURL == "" {
+		if detected, ok := push.DetectReview(); ok {
+			prURL = detected
+			waterlog.Infof("Commenting on %s, which the CI job runs for\n", prURL)
+		}
+	}
+	// The request is checked before loading states, which takes a while.
+	var review *push.Review
+	if prURL != "" {
+		var err error
+		if review, err = push.ParseReview(prURL, ""); err != nil {
+			waterlog.Fatalf("Invalid --pr: %s\n", err)
+		}
+		token := ""
+		for _, env := range reviewTokens[review.Forge] {
+			if token = os.Getenv(env); token != "" {
+				break
+			}
+		}
+		if token == "" {
+			waterlog.Fatalf("No token to comment on %s with, set $%s\n", prURL, reviewTokens[review.Forge][0])
+		}
+		review, _ = push.ParseReview(prURL, token)
+	}
+
+	oldState, newState := loadStates(args[0], args[1])
+	waterlog.Infoln(msg("diff.diffing"))
+	report, err := newDiffReport(oldState, newState, args[0], args[1], filter)
+	if err != nil {
+		waterlog.Fatalf("Failed to compare recipes: %s\n", err)
+	}
+
+	var b strings.Builder
+	b.WriteString(reportMarker + "\n")
+	if err = writeDiffMarkdown(&b, report); err != nil {
+		waterlog.Fatalf("Failed to write the report: %s\n", err)
+	}
+	writeOrderMarkdown(&b, newState, report)
+
+	if review == nil {
+		fmt.Print(b.String())
+		return
+	}
+	updated, err := review.Comment(reportMarker, b.String())
+	if err != nil {
+		waterlog.Fatalf("Failed to comment the report: %s\n", err)
+	}
+	if updated {
+		waterlog.Goodf("Updated the report on %s\n", prURL)
+	} else {
+		waterlog.Goodf("Commented the report on %s\n", prURL)
+	}
+}
@@ -5,14 +5,25 @@
 package cmd
 
 import (
+	"fmt"
+	"os"
 	"runtime/debug"
 
 	"github.com/DataDrake/waterlog"
-	"github.com/DataDrake/waterlog/format"
+	"github.com/DataDrake/waterlog/level"
+	"github.com/GZGavinZhao/autobuild/utils"
 	"github.com/spf13/cobra"
 )
 
 var (
+	// Version is the release of autobuild, which release builds set with
+	// -ldflags "-X github.com/GZGavinZhao/autobuild/cmd.Version=<version>".
+	Version = devVersion
+	// ReleaseSigners are the SSH keys that sign the releases that
+	// self-update installs, in the format of ssh-keygen's allowed signers,
+	// which release builds set like Version.
+	ReleaseSigners = ""
+
 	GitCommit = func() string {
 		if info, ok := debug.ReadBuildInfo(); ok {
 			for _, setting := range info.Settings {
@@ -27,32 +38,109 @@ var (
 	rootCmd = &cobra.Command{
 		Use:   "autobuild",
 		Short: "Automatically query, build, and push packages elegantly.",
-		PersistentPreRun: func(_ *cobra.Command, _ []string) {
-			waterlog.SetFormat(format.Min)
-			if quiet {
-				waterlog.SetLevel(0)
-			} else if verbose {
-				waterlog.SetLevel(7)
-			} else {
-				waterlog.SetLevel(6)
+		PersistentPreRun: func(cmd *cobra.Command, _ []string) {
+			setupLogging()
+			switch {
+			case quiet:
+				waterlog.SetLevel(level.Error)
+			case verbose >= 2:
+				waterlog.SetLevel(utils.TraceLevel)
+			case verbose == 1:
+				waterlog.SetLevel(level.Debug)
+			default:
+				waterlog.SetLevel(level.Info)
+			}
+			if setupFree(cmd) {
+				return
 			}
+			checkFormatFlag(cmd)
+			setupTimings()
+			startProfiling()
+			applyDefaults(cmd)
 		},
-		Version: "0.0.0+" + GitCommit,
+		PersistentPostRun: func(cmd *cobra.Command, _ []string) {
+			if setupFree(cmd) {
+				return
+			}
+			timings.finish()
+			stopProfiling()
+		},
+		Version: Version + "+" + GitCommit,
 	}
 )
 
 func init() {
 	rootCmd.AddCommand(cmdQuery)
-	// rootCmd.AddCommand(cmdDiff)
-	// rootCmd.AddCommand(cmdPush)
+	rootCmd.AddCommand(cmdOrder)
+	rootCmd.AddCommand(cmdPath)
+	rootCmd.AddCommand(cmdLint)
+	rootCmd.AddCommand(cmdBump)
+	rootCmd.AddCommand(cmdRebuild)
+	rootCmd.AddCommand(cmdRenameDep)
+	rootCmd.AddCommand(cmdPin)
+	rootCmd.AddCommand(cmdUnpin)
+	rootCmd.AddCommand(cmdDiff)
+	rootCmd.AddCommand(cmdChangelog)
+	rootCmd.AddCommand(cmdReport)
+	rootCmd.AddCommand(cmdSync)
+	rootCmd.AddCommand(cmdPush)
+	rootCmd.AddCommand(cmdTUI)
+	rootCmd.AddCommand(cmdServe)
+	rootCmd.AddCommand(cmdWeb)
+	rootCmd.AddCommand(cmdPlan)
+	rootCmd.AddCommand(cmdCI)
+	rootCmd.AddCommand(cmdApply)
+	rootCmd.AddCommand(cmdSimulate)
+	rootCmd.AddCommand(cmdGraph)
+	rootCmd.AddCommand(cmdStats)
+	rootCmd.AddCommand(cmdOrphans)
+	rootCmd.AddCommand(cmdOutdated)
+	rootCmd.AddCommand(cmdSecurity)
+	rootCmd.AddCommand(cmdSBOM)
+	rootCmd.AddCommand(cmdSchema)
+	rootCmd.AddCommand(cmdLogin)
+	rootCmd.AddCommand(cmdDoctor)
+	rootCmd.AddCommand(cmdConfig)
+	rootCmd.AddCommand(cmdJobs)
+	rootCmd.AddCommand(cmdHistory)
+	rootCmd.AddCommand(cmdRepush)
+	rootCmd.AddCommand(cmdBisect)
+	rootCmd.AddCommand(cmdSelfUpdate)
 
-	rootCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "verbose output")
-	rootCmd.PersistentFlags().BoolVarP(&quiet, "quiet", "q", false, "quiet output")
+	rootCmd.PersistentFlags().CountVarP(&verbose, "verbose", "v", "print debug messages, and with -vv every dependency and cycle edge as well")
+	rootCmd.PersistentFlags().BoolVarP(&quiet, "quiet", "q", false, "only print errors")
 	rootCmd.MarkFlagsMutuallyExclusive("verbose", "quiet")
+	rootCmd.PersistentFlags().StringVar(&logFormat, "log-format", "auto", fmt.Sprintf("format of log messages, one of %q", logFormats))
+	rootCmd.PersistentFlags().StringVar(&outputFormat, "format", "", "format of the output of the command, see its help for the formats it writes")
+	rootCmd.RegisterFlagCompletionFunc("format", completeFormats)
+	rootCmd.PersistentFlags().BoolVar(&noColor, "no-color", false, "never color the output, like $NO_COLOR (default colors only on terminals)")
+	rootCmd.PersistentFlags().StringVar(&profile, "profile", "", "use the states and build server of this profile of the configuration")
+	rootCmd.RegisterFlagCompletionFunc("profile", completeProfiles)
+	rootCmd.PersistentFlags().BoolVar(&showTimings, "timings", false, "print how long every phase of the command took once it is done")
+	rootCmd.PersistentFlags().StringVar(&cpuProfile, "cpuprofile", "", "write a CPU profile of the command to this file, for go tool pprof")
+	rootCmd.PersistentFlags().StringVar(&memProfile, "memprofile", "", "write a memory profile of the command to this file, for go tool pprof")
+	rootCmd.PersistentFlags().StringVar(&traceFile, "trace", "", "write an execution trace of the command to this file, for go tool trace")
+	for _, name := range []string{"cpuprofile", "memprofile", "trace"} {
+		rootCmd.PersistentFlags().MarkHidden(name)
+	}
+}
+
+// setupFree tells whether `cmd` only prints help or completions, which have no
+// use for the configuration, the timings or the profiles. Completions run on
+// every press of tab, and a configuration that fails to load must not end up
+// among them.
+func setupFree(cmd *cobra.Command) bool {
+	switch cmd.Name() {
+	case "help", cobra.ShellCompRequestCmd, cobra.ShellCompNoDescRequestCmd:
+		return true
+	}
+	return cmd.HasParent() && cmd.Parent().Name() == "completion"
 }
 
 func Execute() {
-	rootCmd.Execute()
+	if err := rootCmd.Execute(); err != nil {
+		os.Exit(exitFailure)
+	}
 	// if err := rootCmd.Execute(); err != nil {
 	// 	waterlog.Fatalf("autobuild failed: %s\n", err)
 	// }
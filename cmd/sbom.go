@@ -0,0 +1,130 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package cmd
+
+import (
+	"io"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/DataDrake/waterlog"
+	"github.com/GZGavinZhao/autobuild/sbom"
+	st "github.com/GZGavinZhao/autobuild/state"
+	"github.com/GZGavinZhao/autobuild/utils"
+	"github.com/spf13/cobra"
+	"github.com/yourbasic/graph"
+)
+
+var (
+	sbomOutput string
+	cmdSBOM    = &cobra.Command{
+		Use:   "sbom <[src|bin|repo]:path> [packages]",
+		Short: "Write a software bill of materials of a state",
+		Long: `Write a software bill of materials of the packages of a state, as an SPDX 2.3 or
+CycloneDX 1.5 document in JSON. For example:
+autobuild sbom src:../packages --format cyclonedx -o sbom.json
+
+When packages are given, the bill of materials holds them and everything they
+depend on, otherwise all the packages of the state. Every package is listed
+with its version, release, component and licenses, and for source states, the
+URLs and hashes of its sources, along with the packages it depends on.`,
+		Run:               runSBOM,
+		ValidArgsFunction: completePackages,
+		Args:              cobra.MinimumNArgs(1),
+	}
+)
+
+func init() {
+	formatFlag(cmdSBOM, sbom.Formats...)
+	cmdSBOM.Flags().StringVarP(&sbomOutput, "output", "o", "", "write the bill of materials to the given file instead of stdout")
+	filterFlags(cmdSBOM)
+}
+
+func runSBOM(cmd *cobra.Command, args []string) {
+	// Keep stdout clean for the bill of materials itself.
+	if sbomOutput == "" {
+		setLogOutput(os.Stderr)
+	}
+	format := getFormat(cmd)
+	filter := getFilter(cmd)
+
+	state, err := st.LoadState(args[0])
+	if err != nil {
+		waterlog.Fatalf("Failed to parse state: %s\n", err)
+	}
+	waterlog.Goodln(msg("state.parsed", "tpath", args[0]))
+
+	// The dependency graph has edges from dependencies to the packages that
+	// depend on them, which are turned around to find what packages depend
+	// on.
+	var deps *graph.Immutable
+	if depGraph := state.DepGraph(); depGraph != nil {
+		deps = graph.Transpose(depGraph)
+	} else {
+		waterlog.Warnln("Failed to build the dependency graph, the bill of materials won't list dependencies")
+	}
+
+	included := make(map[int]bool)
+	if len(args) > 1 {
+		for _, idx := range packageIdxs(state, recipeNames(args[1:])) {
+			included[idx] = true
+			if deps != nil {
+				utils.BFSWithDepth(deps, idx, func(node int, depth int) bool {
+					included[node] = true
+					return false
+				})
+			}
+		}
+	} else {
+		for idx := range state.Packages() {
+			included[idx] = true
+		}
+	}
+	for idx := range included {
+		if !filter.match(state.Packages()[idx]) {
+			delete(included, idx)
+		}
+	}
+
+	doc := sbom.Document{Name: args[0], Tool: "autobuild", ToolVersion: Version, Created: time.Now()}
+	for _, idx := range utils.SortedKeys(included) {
+		pkg := state.Packages()[idx]
+		c := sbom.Component{
+			Name:      pkg.Name,
+			Version:   pkg.Version,
+			Release:   pkg.Release,
+			Component: pkg.Component,
+			Licenses:  pkg.Licenses,
+		}
+		for _, source := range pkg.Sources {
+			c.Sources = append(c.Sources, sbom.ParseSource(source))
+		}
+		if deps != nil {
+			deps.Visit(idx, func(w int, _ int64) bool {
+				if included[w] {
+					c.DependsOn = append(c.DependsOn, state.Packages()[w].Name)
+				}
+				return false
+			})
+			slices.Sort(c.DependsOn)
+		}
+		doc.Components = append(doc.Components, c)
+	}
+	waterlog.Infof("Listing %d packages\n", len(doc.Components))
+
+	var w io.Writer = os.Stdout
+	if sbomOutput != "" {
+		f, err := os.Create(sbomOutput)
+		if err != nil {
+			waterlog.Fatalf("Failed to create %s: %s\n", sbomOutput, err)
+		}
+		defer f.Close()
+		w = f
+	}
+	if err := sbom.Write(w, format, doc); err != nil {
+		waterlog.Fatalf("Failed to write the bill of materials: %s\n", err)
+	}
+}
@@ -0,0 +1,275 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/DataDrake/waterlog"
+	"github.com/GZGavinZhao/autobuild/push"
+	st "github.com/GZGavinZhao/autobuild/state"
+	"github.com/GZGavinZhao/autobuild/upstream"
+	"github.com/GZGavinZhao/autobuild/utils"
+	"github.com/spf13/cobra"
+)
+
+var (
+	securityOutput string
+	securityJobs   int
+	cmdSecurity    = &cobra.Command{
+		Use:   "security-report <[src|bin|repo]:path>",
+		Short: "List the known vulnerabilities of the packages of a state",
+		Long: `Look up the known vulnerabilities of every package of a state at its version
+in the database of osv.dev, and report the packages that have any. For
+example: autobuild security-report src:../packages --format json
+
+Packages are named in osv.dev by the osv section of their autobuild.yaml,
+with an ecosystem and a name, or else by the ecosystem of their name, such as
+PyPI for python-*, or else by the git repository of GitHub or GitLab that
+their sources are downloaded from. The packages that can't be named are listed
+as unknown.`,
+		Run:  runSecurity,
+		Args: cobra.ExactArgs(1),
+	}
+)
+
+// securityPackage is a package with known vulnerabilities, in the report of
+// security-report.
+type securityPackage struct {
+	Name      string `json:"name"`
+	Version   string `json:"version"`
+	Component string `json:"component,omitempty"`
+	// Ecosystem and Package name the package in osv.dev.
+	Ecosystem       string                   `json:"ecosystem"`
+	Package         string                   `json:"package"`
+	Vulnerabilities []upstream.Vulnerability `json:"vulnerabilities"`
+}
+
+type securityReport struct {
+	// Checked is the number of packages that were looked up.
+	Checked  int               `json:"checked"`
+	Packages []securityPackage `json:"packages"`
+	// Unknown lists the packages that can't be named in osv.dev.
+	Unknown []string `json:"unknown"`
+}
+
+func init() {
+	formatFlag(cmdSecurity, withReports("text")...)
+	cmdSecurity.Flags().StringVarP(&securityOutput, "output", "o", "", "write the report to the given file instead of stdout")
+	cmdSecurity.Flags().IntVarP(&securityJobs, "jobs", "j", 8, "number of vulnerabilities looked up at the same time")
+	osvFlag(cmdSecurity)
+	filterFlags(cmdSecurity)
+}
+
+// osvFlag adds --osv-url to `cmd`.
+func osvFlag(cmd *cobra.Command) {
+	cmd.Flags().String("osv-url", "", "URL of the API of osv.dev, e.g. of a mirror (default https://api.osv.dev)")
+}
+
+func getOSV(cmd *cobra.Command) *upstream.OSV {
+	upstream.UserAgent = "autobuild/" + Version
+	osvURL, _ := cmd.Flags().GetString("osv-url")
+	return upstream.NewOSV(osvURL)
+}
+
+// describeVulnerabilities looks up the vulnerabilities with the IDs `ids`,
+// `jobs` at a time. Vulnerabilities that fail to be looked up are only
+// described by their ID, after warning.
+func describeVulnerabilities(osv *upstream.OSV, ids []string, jobs int) map[string]upstream.Vulnerability {
+	vulns := make([]upstream.Vulnerability, len(ids))
+	errs := make([]error, len(ids))
+	utils.ParallelForLimit(len(ids), jobs, func(i int) {
+		vulns[i], errs[i] = osv.Vulnerability(ids[i])
+	})
+	res := make(map[string]upstream.Vulnerability, len(ids))
+	for i, id := range ids {
+		if errs[i] != nil {
+			waterlog.Warnf("Failed to look up %s: %s\n", id, errs[i])
+			vulns[i] = upstream.Vulnerability{ID: id, URL: "https://osv.dev/vulnerability/" + id}
+		}
+		res[id] = vulns[i]
+	}
+	return res
+}
+
+func runSecurity(cmd *cobra.Command, args []string) {
+	// Keep stdout clean for the report itself.
+	if securityOutput == "" {
+		setLogOutput(os.Stderr)
+	}
+	format := getFormat(cmd)
+	filter := getFilter(cmd)
+	osv := getOSV(cmd)
+
+	state, err := st.LoadState(args[0])
+	if err != nil {
+		waterlog.Fatalf("Failed to parse state: %s\n", err)
+	}
+	waterlog.Goodln(msg("state.parsed", "tpath", args[0]))
+
+	report := securityReport{Packages: []securityPackage{}, Unknown: []string{}}
+	var idxs []int
+	var queries []upstream.Query
+	for idx, pkg := range state.Packages() {
+		if !filter.match(pkg) {
+			continue
+		}
+		query, ok := upstream.QueryOf(pkg, pkg.Version)
+		if !ok {
+			report.Unknown = append(report.Unknown, pkg.Name)
+			continue
+		}
+		idxs = append(idxs, idx)
+		queries = append(queries, query)
+	}
+	report.Checked = len(queries)
+
+	waterlog.Infof("Looking up the vulnerabilities of %d packages on osv.dev\n", len(queries))
+	found, err := osv.Vulnerabilities(queries)
+	if err != nil {
+		fatalf(exitServer, "Failed to look up vulnerabilities: %s\n", err)
+	}
+	var ids []string
+	for _, pkgIDs := range found {
+		ids = append(ids, pkgIDs...)
+	}
+	slices.Sort(ids)
+	vulns := describeVulnerabilities(osv, slices.Compact(ids), securityJobs)
+
+	for i, idx := range idxs {
+		if len(found[i]) == 0 {
+			continue
+		}
+		pkg := state.Packages()[idx]
+		entry := securityPackage{Name: pkg.Name, Version: pkg.Version, Component: pkg.Component, Ecosystem: queries[i].Ecosystem, Package: queries[i].Name}
+		for _, id := range found[i] {
+			entry.Vulnerabilities = append(entry.Vulnerabilities, vulns[id])
+		}
+		report.Packages = append(report.Packages, entry)
+	}
+
+	var w io.Writer = os.Stdout
+	if securityOutput != "" {
+		f, err := os.Create(securityOutput)
+		if err != nil {
+			waterlog.Fatalf("Failed to create %s: %s\n", securityOutput, err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	if format != "text" {
+		err = writeReport(w, format, "security-report", report)
+	} else {
+		var b strings.Builder
+		fmt.Fprintf(&b, "Packages with known vulnerabilities (%d of %d):\n", len(report.Packages), report.Checked)
+		for _, pkg := range report.Packages {
+			fmt.Fprintf(&b, "  %s %s (%s %s):\n", pkg.Name, pkg.Version, pkg.Ecosystem, pkg.Package)
+			for _, vuln := range pkg.Vulnerabilities {
+				line := vuln.CVE()
+				if vuln.Severity != "" {
+					line += " (" + vuln.Severity + ")"
+				}
+				if vuln.Summary != "" {
+					line += ": " + vuln.Summary
+				}
+				fmt.Fprintf(&b, "    %s\n", line)
+			}
+		}
+		if len(report.Unknown) != 0 {
+			fmt.Fprintf(&b, "\nPackages that can't be named in osv.dev (%d):\n", len(report.Unknown))
+			for _, name := range report.Unknown {
+				fmt.Fprintf(&b, "  %s\n", name)
+			}
+		}
+		_, err = io.WriteString(w, b.String())
+	}
+	if err != nil {
+		waterlog.Fatalf("Failed to write the report: %s\n", err)
+	}
+}
+
+// securityFixes returns, by name, the vulnerabilities that the bumped packages
+// of `changes` fix: the ones that osv.dev knows of at their old version, but
+// not at their new one. The vulnerabilities are given by their CVE where they
+// have one.
+func securityFixes(osv *upstream.OSV, newState st.State, changes map[int]*push.PlanVersion) map[string][]string {
+	var idxs []int
+	var queries []upstream.Query
+	for _, idx := range utils.SortedKeys(changes) {
+		pkg := newState.Packages()[idx]
+		old := changes[idx]
+		if old == nil || old.Version == pkg.Version {
+			continue
+		}
+		oldQuery, ok := upstream.QueryOf(pkg, old.Version)
+		if !ok {
+			continue
+		}
+		newQuery, _ := upstream.QueryOf(pkg, pkg.Version)
+		idxs = append(idxs, idx)
+		queries = append(queries, oldQuery, newQuery)
+	}
+	if len(queries) == 0 {
+		return nil
+	}
+
+	waterlog.Infof("Looking up the vulnerabilities fixed by %d packages on osv.dev\n", len(idxs))
+	found, err := osv.Vulnerabilities(queries)
+	if err != nil {
+		fatalf(exitServer, "Failed to look up vulnerabilities: %s\n", err)
+	}
+	fixed := make(map[string][]string)
+	var ids []string
+	for i, idx := range idxs {
+		for _, id := range found[2*i] {
+			if !slices.Contains(found[2*i+1], id) {
+				fixed[newState.Packages()[idx].Name] = append(fixed[newState.Packages()[idx].Name], id)
+				ids = append(ids, id)
+			}
+		}
+	}
+	slices.Sort(ids)
+	vulns := describeVulnerabilities(osv, slices.Compact(ids), 8)
+	for name, pkgIDs := range fixed {
+		for i, id := range pkgIDs {
+			pkgIDs[i] = vulns[id].CVE()
+		}
+		slices.Sort(pkgIDs)
+		fixed[name] = slices.Compact(pkgIDs)
+	}
+	return fixed
+}
+
+// securityOnly returns the names of the bumped packages of `changes` selected
+// by `filter` that aren't security fixes, to leave out with --security-only,
+// along with the vulnerabilities that the others fix, see securityFixes.
+// Security fixes are the packages that fix known vulnerabilities, or are marked
+// as security updates, or match `patterns`. They are listed.
+func securityOnly(osv *upstream.OSV, newState st.State, changes map[int]*push.PlanVersion, filter pushFilter, patterns []string) (fixes map[string][]string, dropped []string) {
+	selected := make(map[int]*push.PlanVersion)
+	for idx, old := range changes {
+		if filter.match(newState.Packages()[idx]) {
+			selected[idx] = old
+		}
+	}
+	fixes = securityFixes(osv, newState, selected)
+
+	var rows []packageRow
+	for _, idx := range utils.SortedKeys(selected) {
+		pkg := newState.Packages()[idx]
+		if pkg.Security || len(fixes[pkg.Name]) != 0 || matchAny(patterns, pkg.Name) {
+			rows = append(rows, packageRow{manifestPackage: newManifestPackage(pkg, selected[idx]), note: strings.Join(fixes[pkg.Name], ", "), color: bumpColor})
+		} else {
+			dropped = append(dropped, pkg.Name)
+		}
+	}
+	logPackages(waterlog.Good, msg("push.security-only", "count", len(rows)), rows)
+	return
+}
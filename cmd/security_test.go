@@ -0,0 +1,111 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package cmd
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/GZGavinZhao/autobuild/common"
+	"github.com/GZGavinZhao/autobuild/push"
+	"github.com/GZGavinZhao/autobuild/upstream"
+	"github.com/yourbasic/graph"
+)
+
+// fakeState is a state of the given packages, without dependencies.
+type fakeState []common.Package
+
+func (s fakeState) Packages() []common.Package { return s }
+func (s fakeState) DepGraph() *graph.Immutable { return nil }
+
+func (s fakeState) NameToSrcIdx() map[string]int {
+	res := make(map[string]int, len(s))
+	for idx, pkg := range s {
+		res[pkg.Name] = idx
+	}
+	return res
+}
+
+// fakeOSV serves `vulns`, the IDs of the vulnerabilities of every package at
+// a version, keyed by the name of the package, an @, and the version, and
+// `aliases`, the aliases of every vulnerability.
+func fakeOSV(t *testing.T, vulns map[string][]string, aliases map[string][]string) *upstream.OSV {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id, ok := strings.CutPrefix(r.URL.Path, "/v1/vulns/"); ok {
+			json.NewEncoder(w).Encode(map[string]any{"id": id, "aliases": aliases[id]})
+			return
+		}
+		var req struct {
+			Queries []struct {
+				Package struct{ Name string }
+				Version string
+			}
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("invalid query: %s", err)
+		}
+		type result struct {
+			Vulns []map[string]string `json:"vulns"`
+		}
+		results := make([]result, len(req.Queries))
+		for i, q := range req.Queries {
+			for _, id := range vulns[q.Package.Name+"@"+q.Version] {
+				results[i].Vulns = append(results[i].Vulns, map[string]string{"id": id})
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]any{"results": results})
+	}))
+	t.Cleanup(server.Close)
+	return upstream.NewOSV(server.URL)
+}
+
+func TestSecurityFixes(t *testing.T) {
+	osv := fakeOSV(t, map[string][]string{
+		"a@1.0":                            {"GHSA-1", "PYSEC-2"},
+		"a@1.1":                            {"PYSEC-2"},
+		"b@2.0":                            {"PYSEC-3"},
+		"b@2.1":                            {"PYSEC-3"},
+		"c@3.0":                            {"GHSA-4", "PYSEC-4"},
+		"https://github.com/owner/d@v4.0":  {"OSV-5"},
+		"https://github.com/owner/d@v4.1":  {},
+		"https://github.com/owner/d@4.0":   {},
+		"https://github.com/owner/d@4.1":   {},
+		"https://github.com/owner/e@5.0":   {"OSV-6"},
+		"https://github.com/owner/e@v5.0":  {"OSV-6"},
+		"https://github.com/owner/e@5.0.1": {},
+	}, map[string][]string{
+		"GHSA-1":  {"CVE-2023-1"},
+		"GHSA-4":  {"CVE-2023-4"},
+		"PYSEC-4": {"CVE-2023-4"},
+	})
+	d := common.Package{Name: "d", Version: "4.1", Sources: []string{"https://github.com/owner/d/archive/v4.1.tar.gz : 0123"}}
+	e := common.Package{Name: "e", Version: "5.0.1", Sources: []string{"https://github.com/owner/e/archive/5.0.1.tar.gz : 0123"}}
+	tests := []struct {
+		name string
+		pkg  common.Package
+		old  *push.PlanVersion
+		want map[string][]string
+	}{
+		{"fixes one", common.Package{Name: "python-a", Version: "1.1"}, &push.PlanVersion{Version: "1.0", Release: 1}, map[string][]string{"python-a": {"CVE-2023-1"}}},
+		{"still vulnerable", common.Package{Name: "python-b", Version: "2.1"}, &push.PlanVersion{Version: "2.0", Release: 1}, nil},
+		// A fix known under several IDs is the same CVE.
+		{"aliases", common.Package{Name: "python-c", Version: "3.1"}, &push.PlanVersion{Version: "3.0", Release: 1}, map[string][]string{"python-c": {"CVE-2023-4"}}},
+		{"only a release bump", common.Package{Name: "python-a", Version: "1.0", Release: 2}, &push.PlanVersion{Version: "1.0", Release: 1}, nil},
+		{"new package", common.Package{Name: "python-a", Version: "1.1"}, nil, nil},
+		{"unknown to osv.dev", common.Package{Name: "a", Version: "1.1"}, &push.PlanVersion{Version: "1.0", Release: 1}, nil},
+		{"tags with a v", d, &push.PlanVersion{Version: "4.0", Release: 1}, map[string][]string{"d": {"OSV-5"}}},
+		{"tags without a v", e, &push.PlanVersion{Version: "5.0", Release: 1}, map[string][]string{"e": {"OSV-6"}}},
+	}
+	for _, tt := range tests {
+		got := securityFixes(osv, fakeState{tt.pkg}, map[int]*push.PlanVersion{0: tt.old})
+		if (len(got) != 0 || len(tt.want) != 0) && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("securityFixes(%s) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,323 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/DataDrake/waterlog"
+	"github.com/GZGavinZhao/autobuild/version"
+	"github.com/spf13/cobra"
+)
+
+var (
+	selfUpdateChannel string
+	selfUpdateFeed    string
+	selfUpdateCheck   bool
+	selfUpdateForce   bool
+	cmdSelfUpdate     = &cobra.Command{
+		Use:   "self-update",
+		Short: "Replace autobuild with its latest release",
+		Long: `Replace the running autobuild binary with the latest release of its channel,
+after checking it against the SHA256SUMS of the release, and the signature of
+the sums by the keys of self-update.allowed-signers, or else the keys that the
+release was built with.
+
+The stable channel only has releases, and the edge channel pre-releases as
+well. --check only tells whether there is a newer release. Development builds
+are only replaced with --force.`,
+		Run:  runSelfUpdate,
+		Args: cobra.NoArgs,
+	}
+)
+
+const (
+	// defaultReleaseFeed lists the releases of autobuild.
+	defaultReleaseFeed = "https://api.github.com/repos/GZGavinZhao/autobuild/releases"
+	// releaseSums is the asset of every release holding the SHA256 sums of
+	// the others, which releaseSums+".sig" signs.
+	releaseSums = "SHA256SUMS"
+	// releaseSignatureNamespace is the namespace of the SSH signatures of
+	// releases, see push.SignatureNamespace.
+	releaseSignatureNamespace = "autobuild-release"
+	// devVersion is the version of builds that weren't given one, see
+	// Version.
+	devVersion = "0.0.0"
+)
+
+// releaseChannels are the channels of --channel.
+var releaseChannels = []string{"stable", "edge"}
+
+// feedRelease is a release in the feed, as listed by the GitHub API.
+type feedRelease struct {
+	Tag        string `json:"tag_name"`
+	Draft      bool   `json:"draft"`
+	Prerelease bool   `json:"prerelease"`
+	Assets     []struct {
+		Name string `json:"name"`
+		URL  string `json:"browser_download_url"`
+	} `json:"assets"`
+}
+
+// version returns the version of autobuild that the release holds, as
+// compared by version.Compare, e.g. 1.3.0_rc1 for the tag v1.3.0-rc1.
+func (r feedRelease) version() string {
+	return strings.ReplaceAll(strings.TrimPrefix(r.Tag, "v"), "-", "_")
+}
+
+// asset returns the URL of the asset called `name`, or an empty string.
+func (r feedRelease) asset(name string) string {
+	for _, asset := range r.Assets {
+		if asset.Name == name {
+			return asset.URL
+		}
+	}
+	return ""
+}
+
+func init() {
+	cmdSelfUpdate.Flags().StringVar(&selfUpdateChannel, "channel", "", fmt.Sprintf("release channel to update from, one of %q (default from config, or stable)", releaseChannels))
+	cmdSelfUpdate.Flags().StringVar(&selfUpdateFeed, "feed", "", "URL of the releases, in the format of the GitHub API (default from config, or the releases of autobuild)")
+	cmdSelfUpdate.Flags().BoolVar(&selfUpdateCheck, "check", false, "only tell whether a newer release is available")
+	cmdSelfUpdate.Flags().BoolVar(&selfUpdateForce, "force", false, "install the latest release even if it isn't newer, or over a development build")
+}
+
+func runSelfUpdate(cmd *cobra.Command, args []string) {
+	userConfig, err := loadConfig()
+	if err != nil {
+		waterlog.Fatalf("Failed to load configuration: %s\n", err)
+	}
+	updateConfig := userConfig.SelfUpdate
+	channel := firstNonEmpty(selfUpdateChannel, updateConfig.Channel, "stable")
+	feed := firstNonEmpty(selfUpdateFeed, updateConfig.Feed, defaultReleaseFeed)
+	if !slices.Contains(releaseChannels, channel) {
+		waterlog.Fatalf("Unknown release channel %s, use one of %q\n", channel, releaseChannels)
+	}
+
+	client := &http.Client{Timeout: 5 * time.Minute}
+	raw, err := fetch(client, feed)
+	if err != nil {
+		waterlog.Fatalf("Failed to fetch the releases: %s\n", err)
+	}
+	var releases []feedRelease
+	if err = json.Unmarshal(raw, &releases); err != nil {
+		waterlog.Fatalf("Failed to parse the releases of %s: %s\n", feed, err)
+	}
+	latest, ok := latestRelease(releases, channel)
+	if !ok {
+		waterlog.Fatalf("No releases in the %s channel of %s\n", channel, feed)
+	}
+
+	newer := version.Compare(latest.version(), Version) > 0
+	latestName := strings.TrimPrefix(latest.Tag, "v")
+	// Development builds are older than any release, but are usually newer
+	// than the latest one.
+	if Version == devVersion && !selfUpdateForce {
+		if selfUpdateCheck {
+			waterlog.Infof("This is a development build of autobuild, the latest %s release is %s\n", channel, latestName)
+			return
+		}
+		waterlog.Fatalf("Refusing to replace a development build of autobuild with release %s, pass --force to do it anyway\n", latestName)
+	}
+	if newer && selfUpdateCheck {
+		waterlog.Infof("autobuild %s can be updated to %s, with autobuild self-update --channel %s\n", Version, latestName, channel)
+		return
+	} else if !newer && (selfUpdateCheck || !selfUpdateForce) {
+		waterlog.Goodf("autobuild %s is up to date, the latest %s release is %s\n", Version, channel, latestName)
+		return
+	}
+
+	asset := fmt.Sprintf("autobuild-%s-%s", runtime.GOOS, runtime.GOARCH)
+	binURL, sumsURL := latest.asset(asset), latest.asset(releaseSums)
+	if binURL == "" || sumsURL == "" {
+		waterlog.Fatalf("Release %s has no %s or %s to update with\n", latest.Tag, asset, releaseSums)
+	}
+	sums, err := fetch(client, sumsURL)
+	if err != nil {
+		waterlog.Fatalf("Failed to fetch %s: %s\n", releaseSums, err)
+	}
+	// The sums come from the same place as the binary, so they only mean
+	// something once signed by a key that was known beforehand.
+	if updateConfig.AllowedSigners == "" && ReleaseSigners == "" {
+		waterlog.Fatalf("This build of autobuild has no keys to check the signature of releases with, set self-update.allowed-signers in the configuration\n")
+	}
+	sigURL := latest.asset(releaseSums + ".sig")
+	if sigURL == "" {
+		waterlog.Fatalf("Release %s isn't signed, refusing to update\n", latest.Tag)
+	}
+	sig, err := fetch(client, sigURL)
+	if err != nil {
+		waterlog.Fatalf("Failed to fetch the signature of %s: %s\n", releaseSums, err)
+	}
+	if err = verifyRelease(sums, sig, updateConfig.AllowedSigners); err != nil {
+		waterlog.Fatalf("The signature of release %s doesn't verify: %s\n", latest.Tag, err)
+	}
+	want, ok := checksumOf(sums, asset)
+	if !ok {
+		waterlog.Fatalf("%s of release %s has no checksum for %s\n", releaseSums, latest.Tag, asset)
+	}
+
+	waterlog.Infof("Downloading autobuild %s from the %s channel\n", latestName, channel)
+	bin, err := fetch(client, binURL)
+	if err != nil {
+		waterlog.Fatalf("Failed to download %s: %s\n", asset, err)
+	}
+	if sum := sha256.Sum256(bin); hex.EncodeToString(sum[:]) != want {
+		waterlog.Fatalf("The checksum of %s doesn't match %s, refusing to update\n", asset, releaseSums)
+	}
+
+	exe, err := os.Executable()
+	if err == nil {
+		exe, err = filepath.EvalSymlinks(exe)
+	}
+	if err != nil {
+		waterlog.Fatalf("Failed to find the running binary: %s\n", err)
+	}
+	if err = replaceBinary(exe, bin); err != nil {
+		waterlog.Fatalf("Failed to replace %s, it may be managed by the package manager instead: %s\n", exe, err)
+	}
+	waterlog.Goodf("Updated %s from %s to %s\n", exe, Version, latestName)
+}
+
+// firstNonEmpty returns the first of `values` that isn't empty.
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// latestRelease returns the newest release of `releases` in `channel`, or
+// false if there is none.
+func latestRelease(releases []feedRelease, channel string) (latest feedRelease, ok bool) {
+	for _, release := range releases {
+		if release.Draft || release.Prerelease && channel != "edge" || !version.Valid(release.version()) {
+			continue
+		}
+		if !ok || version.Compare(release.version(), latest.version()) > 0 {
+			latest, ok = release, true
+		}
+	}
+	return
+}
+
+// fetch returns the body of `url`, or an error if the server doesn't answer
+// with 200 OK.
+func fetch(client *http.Client, url string) ([]byte, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s answered %s", url, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// checksumOf returns the SHA256 sum of the file called `name` in `sums`, in
+// the format of sha256sum.
+func checksumOf(sums []byte, name string) (string, bool) {
+	scanner := bufio.NewScanner(bytes.NewReader(sums))
+	for scanner.Scan() {
+		sum, file, ok := strings.Cut(scanner.Text(), " ")
+		// sha256sum marks files read in binary mode with a *.
+		if ok && strings.TrimPrefix(strings.TrimSpace(file), "*") == name {
+			return strings.ToLower(sum), true
+		}
+	}
+	return "", false
+}
+
+// verifyRelease checks that `sig` is an SSH signature of `sums` by one of the
+// keys of the `allowedSigners` file, or of ReleaseSigners if it is empty.
+func verifyRelease(sums []byte, sig []byte, allowedSigners string) error {
+	if allowedSigners == "" {
+		path, err := writeTemp("autobuild-signers-*", []byte(ReleaseSigners+"\n"))
+		if err != nil {
+			return err
+		}
+		defer os.Remove(path)
+		allowedSigners = path
+	}
+	sigPath, err := writeTemp("autobuild-release-*.sig", sig)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(sigPath)
+
+	// ssh-keygen wants the identity of the signer, which the signature
+	// tells once its key is found among the allowed ones.
+	var stdout, stderr bytes.Buffer
+	find := exec.Command("ssh-keygen", "-Y", "find-principals", "-f", allowedSigners, "-s", sigPath)
+	find.Stdout, find.Stderr = &stdout, &stderr
+	if err = find.Run(); err != nil {
+		return fmt.Errorf("no allowed signer made it: %w, stderr: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	principal, _, _ := strings.Cut(strings.TrimSpace(stdout.String()), "\n")
+
+	stderr.Reset()
+	verify := exec.Command("ssh-keygen", "-Y", "verify", "-f", allowedSigners, "-I", principal, "-n", releaseSignatureNamespace, "-s", sigPath)
+	verify.Stdin, verify.Stderr = bytes.NewReader(sums), &stderr
+	if err = verify.Run(); err != nil {
+		return fmt.Errorf("%w, stderr: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// writeTemp writes `data` to a new temporary file named after `pattern`, and
+// returns its path.
+func writeTemp(pattern string, data []byte) (string, error) {
+	file, err := os.CreateTemp("", pattern)
+	if err != nil {
+		return "", err
+	}
+	if _, err = file.Write(data); err == nil {
+		err = file.Close()
+	} else {
+		file.Close()
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+// replaceBinary atomically replaces the executable at `exe` with `bin`, by
+// renaming a copy next to it over it.
+func replaceBinary(exe string, bin []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(exe), ".autobuild-update-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.Write(bin); err == nil {
+		err = tmp.Chmod(0o755)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), exe)
+}
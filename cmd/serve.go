@@ -0,0 +1,656 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package cmd
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DataDrake/waterlog"
+	"github.com/GZGavinZhao/autobuild/common"
+	"github.com/GZGavinZhao/autobuild/push"
+	st "github.com/GZGavinZhao/autobuild/state"
+	"github.com/GZGavinZhao/autobuild/utils"
+	"github.com/spf13/cobra"
+	"github.com/yourbasic/graph"
+)
+
+var (
+	serveListen   string
+	serveStates   []string
+	serveRefresh  time.Duration
+	serveTokenEnv string
+	serveProbe    time.Duration
+	cmdServe      = &cobra.Command{
+		Use:   "serve --state [src|bin|repo:path]...",
+		Short: "Serve diffs, build orders and pushes over HTTP",
+		Long: `Run autobuild as a service that keeps the given states loaded, reloads them
+periodically, and answers queries about them over a JSON API, so that bots and
+web UIs don't have to parse the states again for every request. For example:
+autobuild serve --state repo:unstable --state src:../packages
+
+Only the given states can be queried. Pushes are run as "autobuild push" in
+the background, and are only accepted from clients presenting the token in the
+environment variable named by --token-env. See the README for the endpoints.`,
+		Run:  runServe,
+		Args: cobra.NoArgs,
+	}
+)
+
+func init() {
+	serverFlags(cmdServe)
+}
+
+// serverFlags adds the flags of the API server to `cmd`.
+func serverFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&serveListen, "listen", "127.0.0.1:8080", "address to listen on")
+	cmd.Flags().StringArrayVar(&serveStates, "state", nil, "state to keep loaded and serve, may be repeated")
+	cmd.MarkFlagRequired("state")
+	cmd.Flags().DurationVar(&serveRefresh, "refresh", 15*time.Minute, "how often to reload the states")
+	cmd.Flags().StringVar(&serveTokenEnv, "token-env", "AUTOBUILD_SERVE_TOKEN", "environment variable holding the token that push requests must present, pushes are disabled if it is empty")
+	cmd.Flags().DurationVar(&serveProbe, "probe", time.Minute, "how often to measure the latency of the build servers for /metrics, 0 to never")
+}
+
+// stateCache keeps states loaded, and reloads them periodically.
+type stateCache struct {
+	mu     sync.RWMutex
+	states map[string]cachedState
+	// failures counts the failed loads of every state.
+	failures map[string]int
+}
+
+type cachedState struct {
+	state  st.State
+	loaded time.Time
+	// took is how long loading the state took.
+	took time.Duration
+}
+
+// load loads the state at `tpath` in the cache, replacing the previous one if
+// any.
+func (c *stateCache) load(tpath string) error {
+	start := time.Now()
+	state, err := st.LoadState(tpath)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		c.failures[tpath]++
+		return err
+	}
+	c.states[tpath] = cachedState{state: state, loaded: time.Now().UTC(), took: time.Since(start)}
+	return nil
+}
+
+// get returns the state at `tpath`, if it is served.
+func (c *stateCache) get(tpath string) (st.State, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	cached, ok := c.states[tpath]
+	return cached.state, ok
+}
+
+// refresh reloads all the states every `interval`, keeping the old ones if
+// they fail to load.
+func (c *stateCache) refresh(interval time.Duration) {
+	for range time.Tick(interval) {
+		for _, tpath := range serveStates {
+			if err := c.load(tpath); err != nil {
+				waterlog.Errorf("Failed to reload state %s, keeping the old one: %s\n", tpath, err)
+			} else {
+				waterlog.Goodf("Reloaded state %s\n", tpath)
+			}
+		}
+	}
+}
+
+// serveJob is a push requested over the API.
+type serveJob struct {
+	ID       int        `json:"id"`
+	Args     []string   `json:"args"`
+	Status   string     `json:"status"`
+	ExitCode int        `json:"exit_code"`
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+	// Published is the number of packages published so far, and Latest the
+	// last one of them.
+	Published int                `json:"published"`
+	Latest    *push.JournalEntry `json:"latest,omitempty"`
+	Output    string             `json:"output,omitempty"`
+}
+
+// servePushRequest is the body of push requests.
+type servePushRequest struct {
+	Old    string   `json:"old"`
+	New    string   `json:"new"`
+	Only   []string `json:"only"`
+	Target []string `json:"target"`
+	Reason string   `json:"reason"`
+	Wait   bool     `json:"wait"`
+	Force  bool     `json:"force"`
+}
+
+// server answers the requests of the API.
+type server struct {
+	states  *stateCache
+	metrics *serveMetrics
+	token   string
+	// journals is the directory holding the journals of the pushes.
+	journals string
+
+	mu     sync.Mutex
+	jobs   []*serveJob
+	output []*bytes.Buffer
+}
+
+// apiError is an error with the HTTP status to answer with.
+type apiError struct {
+	status int
+	msg    string
+}
+
+func (e apiError) Error() string {
+	return e.msg
+}
+
+func badRequest(format string, args ...any) error {
+	return apiError{http.StatusBadRequest, fmt.Sprintf(format, args...)}
+}
+
+// handle returns a handler answering with the JSON value or error that `fn`
+// returns for the request.
+func (s *server) handle(method string, fn func(r *http.Request) (any, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		var res any
+		var err error = apiError{http.StatusMethodNotAllowed, "method not allowed"}
+		if r.Method == method {
+			res, err = fn(r)
+		}
+		if err != nil {
+			status := http.StatusInternalServerError
+			var apiErr apiError
+			if errors.As(err, &apiErr) {
+				status = apiErr.status
+			}
+			w.WriteHeader(status)
+			res = map[string]string{"error": err.Error()}
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(res)
+	}
+}
+
+// state returns the served state named by the query parameter `param`.
+func (s *server) state(r *http.Request, param string) (st.State, error) {
+	tpath := r.URL.Query().Get(param)
+	if tpath == "" {
+		return nil, badRequest("missing %s parameter", param)
+	}
+	state, ok := s.states.get(tpath)
+	if !ok {
+		return nil, apiError{http.StatusNotFound, fmt.Sprintf("state %s isn't served", tpath)}
+	}
+	return state, nil
+}
+
+// requestPackages returns the indices in `state` of the packages given with the
+// `package` query parameter.
+func requestPackages(r *http.Request, state st.State) (idxs []int, err error) {
+	names := r.URL.Query()["package"]
+	if len(names) == 0 {
+		return nil, badRequest("missing package parameter")
+	}
+	for _, name := range names {
+		_, idx := st.GetPackage(state, name)
+		if idx < 0 {
+			return nil, apiError{http.StatusNotFound, fmt.Sprintf("unable to find package %s", name)}
+		}
+		idxs = append(idxs, idx)
+	}
+	return
+}
+
+// orderOf returns the build order of exactly the packages at `idxs` of
+// `state`.
+func orderOf(state st.State, idxs []int) (report orderReport, err error) {
+	if state.DepGraph() == nil {
+		return report, badRequest("the state has no dependency graph")
+	}
+	slices.Sort(idxs)
+	lifted := utils.LiftSelection(state.DepGraph(), slices.Compact(idxs))
+	tiers, ok := utils.TieredTopSort(lifted)
+	if !ok {
+		return report, apiError{http.StatusConflict, "the packages have dependency cycles"}
+	}
+	return newOrderReport(state, lifted, tiers), nil
+}
+
+func (s *server) listStates(r *http.Request) (any, error) {
+	s.states.mu.RLock()
+	defer s.states.mu.RUnlock()
+	res := []map[string]any{}
+	for _, tpath := range serveStates {
+		if cached, ok := s.states.states[tpath]; ok {
+			res = append(res, map[string]any{"state": tpath, "packages": len(cached.state.Packages()), "loaded": cached.loaded})
+		}
+	}
+	return res, nil
+}
+
+func (s *server) query(r *http.Request) (any, error) {
+	state, err := s.state(r, "state")
+	if err != nil {
+		return nil, err
+	}
+	name := r.URL.Query().Get("package")
+	if name == "" {
+		return nil, badRequest("missing package parameter")
+	}
+	res, ok := lookupPackage(state, name)
+	if !ok {
+		return nil, apiError{http.StatusNotFound, fmt.Sprintf("unable to find package %s", name)}
+	}
+	return res, nil
+}
+
+// searchLimit is the maximum number of packages answered by a search.
+const searchLimit = 50
+
+func (s *server) search(r *http.Request) (any, error) {
+	state, err := s.state(r, "state")
+	if err != nil {
+		return nil, err
+	}
+	q := strings.ToLower(r.URL.Query().Get("q"))
+	if q == "" {
+		return nil, badRequest("missing q parameter")
+	}
+
+	res := []searchResult{}
+	for _, pkg := range state.Packages() {
+		if strings.Contains(strings.ToLower(pkg.Name), q) {
+			res = append(res, searchResult{Name: pkg.Name, Version: pkg.Version, Release: pkg.Release, Component: pkg.Component})
+		}
+	}
+	// Packages whose name starts with the query come first.
+	slices.SortFunc(res, func(a, b searchResult) int {
+		aPrefix, bPrefix := strings.HasPrefix(strings.ToLower(a.Name), q), strings.HasPrefix(strings.ToLower(b.Name), q)
+		if aPrefix != bPrefix {
+			if aPrefix {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(a.Name, b.Name)
+	})
+	if len(res) > searchLimit {
+		res = res[:searchLimit]
+	}
+	return res, nil
+}
+
+// searchResult is a package matching a search.
+type searchResult struct {
+	Name      string `json:"name"`
+	Version   string `json:"version"`
+	Release   int    `json:"release"`
+	Component string `json:"component,omitempty"`
+}
+
+// graphLimit is the maximum number of packages answered in a graph.
+const graphLimit = 200
+
+// serveGraph is the neighbourhood of a package in the dependency graph.
+// Distance is negative for the dependencies of the package, and positive for
+// its dependents. Edges go from a dependency to its dependent.
+type serveGraph struct {
+	Nodes     []serveNode `json:"nodes"`
+	Edges     []serveEdge `json:"edges"`
+	Truncated bool        `json:"truncated"`
+}
+
+type serveNode struct {
+	searchResult
+	Distance int `json:"distance"`
+}
+
+type serveEdge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	Kind string `json:"kind"`
+}
+
+func (s *server) graph(r *http.Request) (any, error) {
+	state, err := s.state(r, "state")
+	if err != nil {
+		return nil, err
+	}
+	depGraph := state.DepGraph()
+	if depGraph == nil {
+		return nil, badRequest("the state has no dependency graph")
+	}
+	idxs, err := requestPackages(r, state)
+	if err != nil {
+		return nil, err
+	}
+	if len(idxs) != 1 {
+		return nil, badRequest("expected one package")
+	}
+	depth := 1
+	if param := r.URL.Query().Get("depth"); param != "" {
+		if depth, err = strconv.Atoi(param); err != nil || depth < 0 {
+			return nil, badRequest("invalid depth %s", param)
+		}
+	}
+
+	res := serveGraph{Nodes: []serveNode{}, Edges: []serveEdge{}}
+	distances := map[int]int{idxs[0]: 0}
+	// Dependents are searched along the edges, and dependencies against them.
+	for _, dir := range []struct {
+		g    *graph.Immutable
+		sign int
+	}{{depGraph, 1}, {graph.Transpose(depGraph), -1}} {
+		utils.BFSWithDepth(dir.g, idxs[0], func(v int, d int) bool {
+			if d > depth {
+				return true
+			}
+			if _, ok := distances[v]; !ok {
+				if len(distances) == graphLimit {
+					res.Truncated = true
+					return true
+				}
+				distances[v] = dir.sign * d
+			}
+			return false
+		})
+	}
+
+	pkgs := state.Packages()
+	for _, v := range utils.SortedKeys(distances) {
+		pkg := pkgs[v]
+		res.Nodes = append(res.Nodes, serveNode{searchResult{Name: pkg.Name, Version: pkg.Version, Release: pkg.Release, Component: pkg.Component}, distances[v]})
+		depGraph.Visit(v, func(w int, c int64) (skip bool) {
+			if _, ok := distances[w]; ok && w != v {
+				res.Edges = append(res.Edges, serveEdge{From: pkg.Name, To: pkgs[w].Name, Kind: common.DepKind(c).String()})
+			}
+			return
+		})
+	}
+	return res, nil
+}
+
+func (s *server) order(r *http.Request) (any, error) {
+	state, err := s.state(r, "state")
+	if err != nil {
+		return nil, err
+	}
+	idxs, err := requestPackages(r, state)
+	if err != nil {
+		return nil, err
+	}
+	return orderOf(state, idxs)
+}
+
+func (s *server) rdeps(r *http.Request) (any, error) {
+	state, err := s.state(r, "state")
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := state.(*st.SourceState); !ok {
+		return nil, badRequest("reverse dependencies need a source state")
+	}
+	idxs, err := requestPackages(r, state)
+	if err != nil {
+		return nil, err
+	}
+	depth := 1
+	if param := r.URL.Query().Get("depth"); param != "" {
+		if depth, err = strconv.Atoi(param); err != nil {
+			return nil, badRequest("invalid depth %s", param)
+		}
+	}
+	links := r.URL.Query().Get("links") == "true"
+
+	if len(idxs) != 1 {
+		return nil, badRequest("expected one package")
+	}
+	res := rebuildReport{Trigger: state.Packages()[idxs[0]].Name}
+	rset := rebuildSet(state, idxs[0], depth, links)
+	if len(rset) == 0 {
+		res.Order = []string{}
+		return res, nil
+	}
+	res.orderReport, err = orderOf(state, rset)
+	return res, err
+}
+
+func (s *server) diff(r *http.Request) (any, error) {
+	oldState, err := s.state(r, "old")
+	if err != nil {
+		return nil, err
+	}
+	newState, err := s.state(r, "new")
+	if err != nil {
+		return nil, err
+	}
+	query := r.URL.Query()
+	filter := pushFilter{only: query["only"], exclude: query["exclude"], components: query["component"]}
+	report, err := newDiffReport(oldState, newState, query.Get("old"), query.Get("new"), filter)
+	if err == nil {
+		s.metrics.recordDiff(report)
+	}
+	return report, err
+}
+
+// authorize fails unless the request presents the token.
+func (s *server) authorize(r *http.Request) error {
+	if s.token == "" {
+		return apiError{http.StatusForbidden, fmt.Sprintf("pushes are disabled, set %s to enable them", serveTokenEnv)}
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+		return apiError{http.StatusUnauthorized, "invalid token"}
+	}
+	return nil
+}
+
+func (s *server) push(r *http.Request) (any, error) {
+	if err := s.authorize(r); err != nil {
+		return nil, err
+	}
+	var req servePushRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, badRequest("invalid push request: %s", err)
+	}
+	for _, tpath := range []string{req.Old, req.New} {
+		if _, ok := s.states.get(tpath); !ok {
+			return nil, apiError{http.StatusNotFound, fmt.Sprintf("state %s isn't served", tpath)}
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := len(s.jobs) + 1
+	args := []string{"push", req.Old, req.New, "--publish", "--yes", "--progress=false", "--journal", s.journalPath(id)}
+	if len(req.Only) != 0 {
+		args = append(args, "--only", strings.Join(req.Only, ","))
+	}
+	for _, target := range req.Target {
+		args = append(args, "--target", target)
+	}
+	if req.Reason != "" {
+		args = append(args, "--reason", req.Reason)
+	}
+	if req.Wait {
+		args = append(args, "--wait")
+	}
+	if req.Force {
+		args = append(args, "--force")
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	job := &serveJob{ID: id, Args: args, Status: "running", Started: time.Now().UTC()}
+	output := &bytes.Buffer{}
+	pushCmd := exec.Command(self, args...)
+	pushCmd.Stdout, pushCmd.Stderr = &lockedWriter{&s.mu, output}, &lockedWriter{&s.mu, output}
+	if err = pushCmd.Start(); err != nil {
+		return nil, err
+	}
+	s.jobs = append(s.jobs, job)
+	s.output = append(s.output, output)
+	waterlog.Infof("Started push %d: autobuild %s\n", job.ID, strings.Join(args, " "))
+
+	go func() {
+		err := pushCmd.Wait()
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		finished := time.Now().UTC()
+		job.Finished = &finished
+		job.Status, job.ExitCode = "succeeded", pushCmd.ProcessState.ExitCode()
+		if err != nil {
+			job.Status = "failed"
+		}
+		waterlog.Infof("Push %d %s\n", job.ID, job.Status)
+	}()
+	return *job, nil
+}
+
+func (s *server) listPushes(r *http.Request) (any, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := []serveJob{}
+	for i := len(s.jobs) - 1; i >= 0; i-- {
+		res = append(res, s.progress(s.jobs[i]))
+	}
+	return res, nil
+}
+
+func (s *server) pushStatus(r *http.Request) (any, error) {
+	id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/api/v1/pushes/"))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil || id < 1 || id > len(s.jobs) {
+		return nil, apiError{http.StatusNotFound, "no such push"}
+	}
+	job := s.progress(s.jobs[id-1])
+	job.Output = s.output[id-1].String()
+	return job, nil
+}
+
+// journalPath returns the path of the journal of the push with the given ID.
+// Pushes to several targets keep a journal per target next to it.
+func (s *server) journalPath(id int) string {
+	return filepath.Join(s.journals, fmt.Sprintf("push-%d.jsonl", id))
+}
+
+// progress returns a copy of `job` with the packages it published so far, as
+// recorded in its journals.
+func (s *server) progress(job *serveJob) serveJob {
+	res := *job
+	path := s.journalPath(job.ID)
+	paths, _ := filepath.Glob(strings.TrimSuffix(path, ".jsonl") + ".*.jsonl")
+	for _, path := range append(paths, path) {
+		entries, err := push.ReadJournal(path)
+		if err != nil {
+			continue
+		}
+		res.Published += len(entries)
+		if len(entries) != 0 && (res.Latest == nil || entries[len(entries)-1].Time.After(res.Latest.Time)) {
+			res.Latest = &entries[len(entries)-1]
+		}
+	}
+	return res
+}
+
+// lockedWriter writes to `w` while holding `mu`.
+type lockedWriter struct {
+	mu *sync.Mutex
+	w  *bytes.Buffer
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
+}
+
+// newServer loads the served states, and keeps them loaded.
+func newServer() *server {
+	cache := &stateCache{states: make(map[string]cachedState), failures: make(map[string]int)}
+	for _, tpath := range serveStates {
+		if err := cache.load(tpath); err != nil {
+			waterlog.Fatalf("Failed to load state %s: %s\n", tpath, err)
+		}
+		waterlog.Goodf("Loaded state %s\n", tpath)
+	}
+	if serveRefresh > 0 {
+		go cache.refresh(serveRefresh)
+	}
+
+	s := &server{states: cache, metrics: &serveMetrics{diffs: make(map[[2]string]map[string]int)}, token: os.Getenv(serveTokenEnv)}
+	if serveProbe > 0 {
+		go s.metrics.probe(probeTargets(), serveProbe)
+	}
+	if s.token == "" {
+		waterlog.Warnf("%s is empty, pushes are disabled\n", serveTokenEnv)
+	}
+	journals, err := os.MkdirTemp("", "autobuild-serve-")
+	if err != nil {
+		waterlog.Fatalf("Failed to create the directory of the push journals: %s\n", err)
+	}
+	s.journals = journals
+	return s
+}
+
+// routes returns the handler of the endpoints of the API.
+func (s *server) routes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/api/v1/states", s.handle(http.MethodGet, s.listStates))
+	mux.Handle("/api/v1/query", s.handle(http.MethodGet, s.query))
+	mux.Handle("/api/v1/search", s.handle(http.MethodGet, s.search))
+	mux.Handle("/api/v1/graph", s.handle(http.MethodGet, s.graph))
+	mux.Handle("/api/v1/order", s.handle(http.MethodGet, s.order))
+	mux.Handle("/api/v1/rdeps", s.handle(http.MethodGet, s.rdeps))
+	mux.Handle("/api/v1/diff", s.handle(http.MethodGet, s.diff))
+	listPushes, startPush := s.handle(http.MethodGet, s.listPushes), s.handle(http.MethodPost, s.push)
+	mux.HandleFunc("/api/v1/pushes", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			listPushes(w, r)
+		} else {
+			startPush(w, r)
+		}
+	})
+	mux.Handle("/api/v1/pushes/", s.handle(http.MethodGet, s.pushStatus))
+	mux.HandleFunc("/metrics", s.writeMetrics)
+	return mux
+}
+
+// listen serves `handler` on the address given with --listen.
+func listen(handler http.Handler) {
+	waterlog.Goodf("Listening on %s\n", serveListen)
+	if err := http.ListenAndServe(serveListen, handler); err != nil {
+		waterlog.Fatalf("Failed to serve: %s\n", err)
+	}
+}
+
+func runServe(cmd *cobra.Command, args []string) {
+	listen(newServer().routes())
+}
@@ -0,0 +1,126 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package cmd
+
+import (
+	"os"
+
+	"github.com/DataDrake/waterlog"
+	st "github.com/GZGavinZhao/autobuild/state"
+	"github.com/GZGavinZhao/autobuild/utils"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	simBumps    []string
+	simDepth    int
+	simCosts    string
+	cmdSimulate = &cobra.Command{
+		Use:   "simulate --bump pkgA,pkgB [src|bin|repo:path]",
+		Short: "Simulate the rebuilds caused by bumping the given packages",
+		Long: `Pretend that the given packages were bumped, and print the packages that have to
+be rebuilt as a result, the waves they can be built in, and an estimated cost.
+For example: autobuild simulate --bump icu src:../packages
+
+The cost of each package defaults to 1, and can be overridden with a YAML file
+mapping package names to their cost (e.g. build time in minutes) via --costs.`,
+		Run:  runSimulate,
+		Args: cobra.ExactArgs(1),
+	}
+)
+
+func init() {
+	cmdSimulate.Flags().StringSliceVarP(&simBumps, "bump", "b", nil, "packages to pretend were bumped")
+	cmdSimulate.MarkFlagRequired("bump")
+	cmdSimulate.RegisterFlagCompletionFunc("bump", completePackageList)
+	cmdSimulate.Flags().IntVarP(&simDepth, "depth", "d", 1, "level(s) of reverse dependencies to rebuild, negative for all of them")
+	cmdSimulate.Flags().StringVar(&simCosts, "costs", "", "YAML file mapping package names to their build cost")
+}
+
+func loadCosts(path string) (costs map[string]float64, err error) {
+	raw, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer raw.Close()
+
+	dec := yaml.NewDecoder(raw)
+	err = dec.Decode(&costs)
+	return
+}
+
+func runSimulate(cmd *cobra.Command, args []string) {
+	tpath := args[0]
+
+	state, err := st.LoadState(tpath)
+	if err != nil {
+		waterlog.Fatalf("Failed to parse state: %s\n", err)
+	}
+	waterlog.Goodln(msg("state.parsed", "tpath", tpath))
+
+	costs := map[string]float64{}
+	if simCosts != "" {
+		if costs, err = loadCosts(simCosts); err != nil {
+			waterlog.Fatalf("Failed to load costs from %s: %s\n", simCosts, err)
+		}
+	}
+	cost := func(name string) float64 {
+		if c, ok := costs[name]; ok {
+			return c
+		}
+		return 1
+	}
+
+	depGraph := state.DepGraph()
+	if depGraph == nil {
+		waterlog.Fatalf("Failed to obtain dependency graph of state %s\n", tpath)
+	}
+
+	rset := map[int]bool{}
+	for _, idx := range packageIdxs(state, simBumps) {
+		utils.BFSWithDepth(depGraph, idx, func(node int, depth int) bool {
+			if simDepth >= 0 && depth > simDepth {
+				return true
+			}
+			rset[node] = true
+			return false
+		})
+	}
+
+	lifted := utils.LiftSelection(depGraph, utils.SortedKeys(rset))
+	waves := tieredOrder(state, lifted)
+
+	pkgName := func(liftedIdx int) string { return state.Packages()[lifted.Nodes[liftedIdx]].Name }
+
+	waterlog.Goodf("Rebuild set (%d packages):", len(lifted.Nodes))
+	for liftedIdx := range lifted.Nodes {
+		waterlog.Printf(" %s", pkgName(liftedIdx))
+	}
+	waterlog.Println()
+
+	// The critical path is the most expensive chain of packages that have to
+	// be built one after another, i.e. the cost with unlimited builders.
+	var total, critical float64
+	finish := make([]float64, len(lifted.Nodes))
+	for wIdx, wave := range waves {
+		waterlog.Goodf("Wave %d:", wIdx+1)
+		for _, liftedIdx := range wave {
+			waterlog.Printf(" %s", pkgName(liftedIdx))
+
+			c := cost(pkgName(liftedIdx))
+			total += c
+			finish[liftedIdx] += c
+			critical = max(critical, finish[liftedIdx])
+			lifted.Visit(liftedIdx, func(w int, _ int64) (skip bool) {
+				finish[w] = max(finish[w], finish[liftedIdx])
+				return
+			})
+		}
+		waterlog.Println()
+	}
+
+	waterlog.Infof("Estimated cost: %g in total, %g on the critical path over %d waves\n", total, critical, len(waves))
+}
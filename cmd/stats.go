@@ -0,0 +1,124 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/DataDrake/waterlog"
+	st "github.com/GZGavinZhao/autobuild/state"
+	"github.com/GZGavinZhao/autobuild/utils"
+	"github.com/spf13/cobra"
+)
+
+var (
+	statsOutput string
+	statsTop    int
+	cmdStats    = &cobra.Command{
+		Use:   "stats [src|bin|repo:path]",
+		Short: "Print statistics about the packages of a state",
+		Long: `Print statistics about the packages of a state: the number of packages of every
+component, how many dependencies and dependents packages have, the largest
+dependency cycles, the packages nothing depends on and the longest chain of
+packages that have to be built one after another. For example:
+autobuild stats src:../packages --format json
+
+Binary states have no dependency graph, so only their components are counted.`,
+		Run:  runStats,
+		Args: cobra.ExactArgs(1),
+	}
+)
+
+func init() {
+	formatFlag(cmdStats, withReports("text")...)
+	cmdStats.Flags().StringVarP(&statsOutput, "output", "o", "", "write the statistics to the given file instead of stdout")
+	cmdStats.Flags().IntVar(&statsTop, "top", 10, "number of packages and cycles to list in rankings")
+}
+
+func runStats(cmd *cobra.Command, args []string) {
+	tpath := args[0]
+
+	// Keep stdout clean for the statistics themselves.
+	if statsOutput == "" {
+		setLogOutput(os.Stderr)
+	}
+
+	format := getFormat(cmd)
+
+	state, err := st.LoadState(tpath)
+	if err != nil {
+		waterlog.Fatalf("Failed to parse state: %s\n", err)
+	}
+	waterlog.Goodln(msg("state.parsed", "tpath", tpath))
+
+	stats := st.StatsOf(state, statsTop)
+
+	var w io.Writer = os.Stdout
+	if statsOutput != "" {
+		f, err := os.Create(statsOutput)
+		if err != nil {
+			waterlog.Fatalf("Failed to create %s: %s\n", statsOutput, err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	if format != "text" {
+		err = writeReport(w, format, "stats", stats)
+	} else {
+		err = writeStatsText(w, stats, state.DepGraph() != nil)
+	}
+	if err != nil {
+		waterlog.Fatalf("Failed to write statistics: %s\n", err)
+	}
+}
+
+// writeStatsText writes `stats` for humans, leaving out the statistics of the
+// dependency graph if the state has none.
+func writeStatsText(w io.Writer, stats st.Stats, hasGraph bool) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(tw, "Packages:\t%d\n", stats.Packages)
+	if hasGraph {
+		fmt.Fprintf(tw, "Dependencies:\t%d\n", stats.Edges)
+		fmt.Fprintf(tw, "Fan-in:\taverage %.2f, max %d\n", stats.FanIn.Average, stats.FanIn.Max)
+		fmt.Fprintf(tw, "Fan-out:\taverage %.2f, max %d\n", stats.FanOut.Average, stats.FanOut.Max)
+		fmt.Fprintf(tw, "Orphans:\t%d\n", len(stats.Orphans))
+		fmt.Fprintf(tw, "Longest chain:\t%d (%s)\n", len(stats.LongestChain), strings.Join(stats.LongestChain, " -> "))
+	}
+
+	fmt.Fprintln(tw, "\nCOMPONENT\tPACKAGES")
+	for _, component := range utils.SortedKeys(stats.Components) {
+		name := component
+		if name == "" {
+			name = "(none)"
+		}
+		fmt.Fprintf(tw, "%s\t%d\n", name, stats.Components[component])
+	}
+
+	for _, ranking := range []struct {
+		title string
+		top   []st.PackageCount
+	}{{"MOST DEPENDENCIES", stats.FanIn.Top}, {"MOST DEPENDENTS", stats.FanOut.Top}} {
+		if len(ranking.top) == 0 {
+			continue
+		}
+		fmt.Fprintf(tw, "\n%s\tCOUNT\n", ranking.title)
+		for _, pkg := range ranking.top {
+			fmt.Fprintf(tw, "%s\t%d\n", pkg.Name, pkg.Count)
+		}
+	}
+
+	if len(stats.Cycles) != 0 {
+		fmt.Fprintln(tw, "\nLARGEST CYCLES\tPACKAGES")
+		for _, cycle := range stats.Cycles {
+			fmt.Fprintf(tw, "%d\t%s\n", len(cycle), strings.Join(cycle, " "))
+		}
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,84 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+
+	"github.com/DataDrake/waterlog"
+	"github.com/GZGavinZhao/autobuild/common"
+	"github.com/GZGavinZhao/autobuild/push"
+	"github.com/GZGavinZhao/autobuild/state"
+)
+
+// runStreamDiff diffs the binary packages of two indices while reading them,
+// and writes every change in `format` as soon as it is found. Impacts are unknown, since
+// there is no dependency graph. It returns the number of changes.
+func runStreamDiff(oldTPath string, newTPath string, format string, filter pushFilter) (changed int) {
+	if format == "html" || format == "yaml" {
+		waterlog.Fatalf("--stream doesn't support the %s format\n", format)
+	}
+
+	old, err := state.OpenIndexStream(oldTPath)
+	if err != nil {
+		waterlog.Fatalf("Failed to open old index %s: %s\n", oldTPath, err)
+	}
+	defer old.Close()
+	cur, err := state.OpenIndexStream(newTPath)
+	if err != nil {
+		waterlog.Fatalf("Failed to open new index %s: %s\n", newTPath, err)
+	}
+	defer cur.Close()
+
+	out, done := diffWriter()
+	defer done()
+	w := bufio.NewWriter(out)
+	defer w.Flush()
+
+	if format == "md" {
+		fmt.Fprintf(w, "## Changes from `%s` to `%s`\n\n", oldTPath, newTPath)
+		fmt.Fprintln(w, "| Package | Change | Old | New |")
+		fmt.Fprintln(w, "| --- | --- | --- | --- |")
+	}
+	enc := json.NewEncoder(w)
+
+	waterlog.Infoln(msg("diff.diffing"))
+	err = state.StreamChanged(old, cur, func(pkg common.Package, diff state.Diff) error {
+		if !filter.match(pkg) {
+			return nil
+		}
+
+		entry := diffPackage{Name: pkg.Name, Kind: diff.Kind().String(), Reason: diff.Reason(), Component: pkg.Component}
+		if !diff.IsNew() {
+			entry.Old = &push.PlanVersion{Version: diff.OldVer, Release: diff.OldRelNum}
+		}
+		if !diff.IsRemoved() {
+			entry.New = &push.PlanVersion{Version: diff.Ver, Release: diff.RelNum}
+			entry.Changelog = push.Changelog(pkg, entry.Old)
+		}
+
+		changed++
+		var err error
+		switch format {
+		case "json":
+			err = enc.Encode(entry)
+		case "md":
+			_, err = fmt.Fprintf(w, "| %s | %s | %s | %s |\n", entry.Name, entry.Title(), versionString(entry.Old), versionString(entry.New))
+		default:
+			_, err = fmt.Fprintf(w, "%s: %s: %s -> %s\n", entry.Title(), entry.Name, versionString(entry.Old), versionString(entry.New))
+		}
+		if err == nil {
+			// Results should show up while the indices are being read.
+			err = w.Flush()
+		}
+		return err
+	})
+	if err != nil {
+		waterlog.Fatalf("Failed to diff: %s\n", err)
+	}
+	return
+}
@@ -0,0 +1,145 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/DataDrake/waterlog"
+	"github.com/GZGavinZhao/autobuild/common"
+	st "github.com/GZGavinZhao/autobuild/state"
+	"github.com/spf13/cobra"
+)
+
+var (
+	syncOutput string
+	syncMinAge time.Duration
+	cmdSync    = &cobra.Command{
+		Use:   "sync-check [stable] [unstable]",
+		Short: "List the packages of unstable that can be synced to stable",
+		Long: `Diff the binary indexes of the stable and unstable repositories, by default
+repo:shannon and repo:unstable, and list the packages with a new release in
+unstable that can be synced, the ones whose sync is blocked, e.g. because their
+runtime dependencies have a new release that isn't synced along, and the binary
+packages of stable that are gone from unstable and that syncing leaves behind.
+
+The list format prints the names of the packages that can be synced, one per
+line.`,
+		Run: runSyncCheck,
+		Args: cobra.MatchAll(cobra.MaximumNArgs(2), func(cmd *cobra.Command, args []string) error {
+			if len(args) == 1 {
+				return fmt.Errorf("requires either no or both states")
+			}
+			return nil
+		}),
+	}
+)
+
+func init() {
+	formatFlag(cmdSync, "text", "json", "list")
+	cmdSync.Flags().StringVarP(&syncOutput, "output", "o", "", "write the report to the given file instead of stdout")
+	cmdSync.Flags().DurationVar(&syncMinAge, "min-age", 0, "block packages updated more recently than this in unstable, e.g. 168h")
+	filterFlags(cmdSync)
+}
+
+func runSyncCheck(cmd *cobra.Command, args []string) {
+	stableTPath, unstableTPath := "repo:shannon", "repo:unstable"
+	if len(args) == 2 {
+		stableTPath, unstableTPath = args[0], args[1]
+	}
+
+	// Keep stdout clean for the report itself.
+	if syncOutput == "" {
+		setLogOutput(os.Stderr)
+	}
+
+	format := getFormat(cmd)
+	filter := getFilter(cmd)
+
+	var include func(common.Package) bool
+	if !filter.empty() {
+		include = filter.match
+	}
+
+	var states [2]*st.BinaryState
+	for i, tpath := range []string{stableTPath, unstableTPath} {
+		state, err := st.LoadState(tpath)
+		if err != nil {
+			waterlog.Fatalf("Failed to parse state %s: %s\n", tpath, err)
+		}
+		binState, ok := state.(*st.BinaryState)
+		if !ok {
+			waterlog.Fatalf("Can only compare binary states, not %s\n", tpath)
+		}
+		states[i] = binState
+	}
+	waterlog.Goodln("Successfully parsed states!")
+
+	report := st.SyncCheck(states[0], states[1], include, syncMinAge, time.Now())
+
+	var w io.Writer = os.Stdout
+	if syncOutput != "" {
+		f, err := os.Create(syncOutput)
+		if err != nil {
+			waterlog.Fatalf("Failed to create %s: %s\n", syncOutput, err)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	var err error
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(report)
+	case "list":
+		var b strings.Builder
+		for _, candidate := range report.Eligible {
+			fmt.Fprintln(&b, candidate.Name)
+		}
+		_, err = io.WriteString(w, b.String())
+	default:
+		_, err = io.WriteString(w, syncText(report))
+	}
+	if err != nil {
+		waterlog.Fatalf("Failed to write report: %s\n", err)
+	}
+
+	waterlog.Goodf("%d packages can be synced, %d are blocked and %d binary packages are orphaned\n", len(report.Eligible), len(report.Blocked), len(report.Orphans))
+}
+
+// syncText formats the report of sync-check for humans.
+func syncText(report st.SyncReport) string {
+	var b strings.Builder
+	change := func(c st.SyncCandidate) string {
+		if c.OldVersion == "" {
+			return fmt.Sprintf("%s: %s-%d (%s)", c.Name, c.Version, c.Release, c.Kind)
+		}
+		return fmt.Sprintf("%s: %s-%d -> %s-%d (%s)", c.Name, c.OldVersion, c.OldRelease, c.Version, c.Release, c.Kind)
+	}
+
+	fmt.Fprintf(&b, "Eligible for sync (%d):\n", len(report.Eligible))
+	for _, candidate := range report.Eligible {
+		fmt.Fprintf(&b, "  %s\n", change(candidate))
+	}
+	fmt.Fprintf(&b, "\nBlocked (%d):\n", len(report.Blocked))
+	for _, candidate := range report.Blocked {
+		fmt.Fprintf(&b, "  %s\n", change(candidate))
+		for _, blocker := range candidate.Blockers {
+			fmt.Fprintf(&b, "    %s\n", blocker)
+		}
+	}
+	fmt.Fprintf(&b, "\nOrphaned binaries in stable (%d):\n", len(report.Orphans))
+	for _, orphan := range report.Orphans {
+		fmt.Fprintf(&b, "  %s (from %s)\n", orphan.Name, orphan.Source)
+	}
+	return b.String()
+}
@@ -0,0 +1,101 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/DataDrake/waterlog"
+	"github.com/GZGavinZhao/autobuild/push"
+	"github.com/fatih/color"
+)
+
+// The colors of the rows of package tables, by how the change is judged.
+var (
+	bumpColor      = color.New(color.FgGreen)
+	downgradeColor = color.New(color.FgYellow)
+	badColor       = color.New(color.FgRed)
+)
+
+// packageRow is a row of the table of logPackages.
+type packageRow struct {
+	manifestPackage
+	// note is what else there is to tell about the package, if anything.
+	note  string
+	color *color.Color
+	// removed is set for packages that are gone from the new state, whose
+	// version is the old one.
+	removed bool
+}
+
+// versions returns the old and new versions of the package, see
+// versionString.
+func (r packageRow) versions() (string, string) {
+	cur := &push.PlanVersion{Version: r.Version, Release: r.Release}
+	if r.removed {
+		return versionString(cur), versionString(nil)
+	}
+	return versionString(r.Old), versionString(cur)
+}
+
+// packageRows returns the rows of `pkgs`, all colored with `c`.
+func packageRows(pkgs []manifestPackage, c *color.Color) []packageRow {
+	rows := make([]packageRow, len(pkgs))
+	for idx, pkg := range pkgs {
+		rows[idx] = packageRow{manifestPackage: pkg, color: c}
+	}
+	return rows
+}
+
+// logPackages logs `m` with `log`, followed by a table of the packages of
+// `rows` with their old and new versions. Unlike the names of hundreds of
+// packages in a row, a table stays readable when it doesn't fit on a line.
+func logPackages(log func(...any), m message, rows []packageRow) {
+	if len(rows) == 0 {
+		return
+	}
+	// JSON logs are one message per line.
+	if logFormat == "json" {
+		var entries []string
+		for _, row := range rows {
+			old, cur := row.versions()
+			entry := fmt.Sprintf("%s %s → %s", row.Name, old, cur)
+			if row.note != "" {
+				entry += fmt.Sprintf(" (%s)", row.note)
+			}
+			entries = append(entries, entry)
+		}
+		m.fields["packages"] = entries
+		m.suffix = " " + strings.Join(entries, ", ")
+		log(m)
+		return
+	}
+
+	header := "PACKAGE\tOLD\t\tNEW"
+	if slices.ContainsFunc(rows, func(row packageRow) bool { return row.note != "" }) {
+		header += "\tNOTES"
+	}
+	var b bytes.Buffer
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, header)
+	for _, row := range rows {
+		old, cur := row.versions()
+		fmt.Fprintf(w, "%s\t%s\t→\t%s\t%s\n", row.Name, old, cur, row.note)
+	}
+	w.Flush()
+
+	log(m)
+	waterlog.Println()
+	lines := strings.Split(strings.TrimSuffix(b.String(), "\n"), "\n")
+	waterlog.Printf("    %s\n", strings.TrimRight(lines[0], " "))
+	for idx, line := range lines[1:] {
+		// Coloring whole lines keeps the columns aligned.
+		waterlog.Printf("    %s\n", rows[idx].color.Sprint(strings.TrimRight(line, " ")))
+	}
+}
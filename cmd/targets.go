@@ -0,0 +1,124 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/DataDrake/waterlog"
+	"github.com/GZGavinZhao/autobuild/config"
+	"github.com/GZGavinZhao/autobuild/push"
+	"github.com/spf13/cobra"
+)
+
+// pushTarget is a build server that packages are published to.
+type pushTarget struct {
+	// name is the name of the target in the configuration, or empty when
+	// publishing to a single build server chosen by --backend.
+	name    string
+	builder push.Builder
+}
+
+// label returns the prefix of messages about the target.
+func (t pushTarget) label() string {
+	if t.name == "" {
+		return ""
+	}
+	return fmt.Sprintf("[%s] ", t.name)
+}
+
+// path returns the path of a file of the target, such as its journal, derived
+// from the path of the file for a single build server.
+func (t pushTarget) path(path string) string {
+	if t.name == "" || path == "" {
+		return path
+	}
+	ext := filepath.Ext(path)
+	return fmt.Sprintf("%s.%s%s", strings.TrimSuffix(path, ext), t.name, ext)
+}
+
+// targetFlag adds the flag to choose the configured targets to publish to to
+// `cmd`.
+func targetFlag(cmd *cobra.Command) {
+	cmd.Flags().StringSlice("target", nil, "publish to these targets of the configuration at once, instead of a single backend")
+	cmd.MarkFlagsMutuallyExclusive("backend", "target")
+}
+
+// pushTargets sets up the build servers selected by the flags of `cmd`.
+func pushTargets(cmd *cobra.Command, userConfig config.UserConfig) (targets []pushTarget) {
+	backend, _ := cmd.Flags().GetString("backend")
+	names, _ := cmd.Flags().GetStringSlice("target")
+
+	if len(names) == 0 {
+		builder, err := singleBuilder(resolveBackend(backend, userConfig), userConfig.Push)
+		if err != nil {
+			waterlog.Fatalf("Failed to set up build server backend: %s\n", err)
+		}
+		return []pushTarget{{builder: builder}}
+	}
+	if os.Getenv(config.ServerEnv) != "" {
+		waterlog.Warnf("$%s is ignored, targets are only published to the build servers of their configuration\n", config.ServerEnv)
+	}
+
+	tokenUsed := false
+	for _, name := range names {
+		idx := -1
+		for i, target := range userConfig.Push.Targets {
+			if target.Name == name {
+				idx = i
+			}
+		}
+		if idx < 0 {
+			waterlog.Fatalf("Unknown target %s, it isn't in the push.targets of the configuration\n", name)
+		}
+
+		target := userConfig.Push.Targets[idx]
+		if target.Backend == "" {
+			waterlog.Fatalf("Target %s has no backend\n", name)
+		}
+		builder, err := push.NewBuilder(target.Backend, target.PushConfig(userConfig.Push))
+		if err != nil {
+			waterlog.Fatalf("Failed to set up build server backend of target %s: %s\n", name, err)
+		}
+		targets = append(targets, pushTarget{name: name, builder: builder})
+		tokenUsed = tokenUsed || slices.Contains(config.TokenEnvs(target.Backend), config.TokenAnyEnv)
+	}
+	if os.Getenv(config.TokenAnyEnv) != "" && !tokenUsed {
+		waterlog.Warnf("$%s is ignored, since none of the targets has the backend that $%s selects: set the $AUTOBUILD_<BACKEND>_TOKEN of their backends instead\n", config.TokenAnyEnv, config.BackendEnv)
+	}
+	return
+}
+
+// printMatrix prints the status of every package on every target.
+func printMatrix(targets []pushTarget, order pushOrder, results []push.Result) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprint(w, "PACKAGE")
+	for _, target := range targets {
+		fmt.Fprintf(w, "\t%s", strings.ToUpper(target.name))
+	}
+	fmt.Fprintln(w)
+
+	for idx, pkg := range order.packages {
+		fmt.Fprint(w, pkg.Name)
+		for tIdx := range targets {
+			job := results[tIdx].Jobs[idx]
+			switch results[tIdx].Outcomes[idx] {
+			case push.Pending:
+				fmt.Fprint(w, "\tnot published")
+			case push.Blocked:
+				fmt.Fprint(w, "\tblocked")
+			default:
+				fmt.Fprintf(w, "\t%s (%d)", job.Phase(), job.ID)
+			}
+		}
+		fmt.Fprintln(w)
+	}
+	w.Flush()
+}
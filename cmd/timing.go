@@ -0,0 +1,201 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/GZGavinZhao/autobuild/state"
+	"golang.org/x/term"
+)
+
+// showTimings prints how long every phase took once the command is done.
+var showTimings bool
+
+// timings times the phases of the command.
+var timings = &phaseTimer{started: time.Now()}
+
+// phaseTime is how long a phase took.
+type phaseTime struct {
+	name    string
+	elapsed time.Duration
+}
+
+// phaseTimer times the long phases of a command, such as parsing recipes or
+// submitting jobs, and shows the current one on the last line of stderr, so
+// that a command that seems stuck tells what it is waiting for.
+type phaseTimer struct {
+	mu      sync.Mutex
+	started time.Time
+	phases  []phaseTime
+	// current is the name of the current phase, or empty between phases.
+	current string
+	since   time.Time
+	// show tells whether to draw the current phase, and status whether
+	// the current phase is drawn.
+	show   bool
+	status bool
+	// count is the number of recipes parsed in the current phase.
+	count int
+	drawn bool
+	last  time.Time
+}
+
+// setupTimings starts timing the command, and showing its phases if stderr is
+// a terminal.
+func setupTimings() {
+	timings.mu.Lock()
+	// JSON logs are parsed by programs, not read.
+	timings.show = term.IsTerminal(int(os.Stderr.Fd())) && logFormat != "json" && !quiet
+	timings.mu.Unlock()
+
+	state.Progress.Phase = func(name string) {
+		if name == "" {
+			timings.end()
+		} else {
+			timings.start(name, true)
+		}
+	}
+	state.Progress.Parsed = timings.parsed
+	state.Progress.Timed = timings.record
+
+	// Keep the elapsed time of slow phases ticking.
+	go func() {
+		for range time.Tick(time.Second) {
+			timings.mu.Lock()
+			timings.redraw()
+			timings.mu.Unlock()
+		}
+	}()
+}
+
+// start ends the current phase if any, and starts the one called `name`. It is
+// drawn if `status` is set, which phases that draw their own progress or print
+// to stdout unset.
+func (t *phaseTimer) start(name string, status bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stop()
+	t.current, t.since, t.status, t.count = name, time.Now(), status, 0
+	t.redraw()
+}
+
+// end ends the current phase, if any.
+func (t *phaseTimer) end() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stop()
+}
+
+// record records that the step `name` of the current phase took `elapsed`.
+// It is listed on its own, before the phase.
+func (t *phaseTimer) record(name string, elapsed time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.phases = append(t.phases, phaseTime{name, elapsed})
+}
+
+// parsed records that `count` recipes were parsed in the current phase.
+func (t *phaseTimer) parsed(count int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.count = count
+	// Recipes are parsed far faster than the terminal can be redrawn.
+	if time.Since(t.last) >= 100*time.Millisecond {
+		t.redraw()
+	}
+}
+
+// finish ends the current phase, and prints the timings if --timings was
+// given.
+func (t *phaseTimer) finish() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stop()
+	if !showTimings {
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stderr, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PHASE\tTOOK")
+	for _, p := range t.phases {
+		fmt.Fprintf(w, "%s\t%s\n", p.name, p.elapsed.Round(time.Millisecond))
+	}
+	fmt.Fprintf(w, "total\t%s\n", time.Since(t.started).Round(time.Millisecond))
+	if peak, ok := peakMemory(); ok {
+		fmt.Fprintf(w, "peak memory\t%.1f MiB\n", float64(peak)/(1<<20))
+	}
+	w.Flush()
+	showTimings = false
+}
+
+// peakMemory returns the most memory that the process held at once, in
+// bytes, to keep an eye on commands such as diffing two whole repositories.
+func peakMemory() (int64, bool) {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		return 0, false
+	}
+	// Linux counts it in kilobytes.
+	return int64(usage.Maxrss) * 1024, true
+}
+
+func (t *phaseTimer) stop() {
+	t.clear()
+	if t.current != "" {
+		t.phases = append(t.phases, phaseTime{t.current, time.Since(t.since)})
+		t.current = ""
+	}
+}
+
+func (t *phaseTimer) clear() {
+	if t.drawn {
+		fmt.Fprint(os.Stderr, "\r\033[K")
+		t.drawn = false
+	}
+}
+
+func (t *phaseTimer) redraw() {
+	t.clear()
+	if !t.show || !t.status || t.current == "" {
+		return
+	}
+	line := fmt.Sprintf("%s...", t.current)
+	if t.count != 0 {
+		line += fmt.Sprintf(" %d recipes", t.count)
+	}
+	if elapsed := time.Since(t.since); elapsed >= time.Second {
+		line += fmt.Sprintf(" (%s)", elapsed.Round(time.Second))
+	}
+
+	// A wrapped line can't be cleared anymore.
+	if width, _, err := term.GetSize(int(os.Stderr.Fd())); err == nil && width > 1 {
+		if runes := []rune(line); len(runes) >= width {
+			line = string(runes[:width-2]) + "…"
+		}
+	}
+	fmt.Fprint(os.Stderr, line)
+	t.drawn, t.last = true, time.Now()
+}
+
+// statusWriter clears the current phase off the terminal before log messages
+// are written, for them not to end up on the same line. It is drawn again
+// with the next update.
+type statusWriter struct {
+	w io.Writer
+}
+
+func (s statusWriter) Write(p []byte) (int, error) {
+	timings.mu.Lock()
+	defer timings.mu.Unlock()
+	timings.clear()
+	return s.w.Write(p)
+}
@@ -0,0 +1,424 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/DataDrake/waterlog"
+	"github.com/GZGavinZhao/autobuild/push"
+	"github.com/GZGavinZhao/autobuild/state"
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+)
+
+var (
+	cmdTUI = &cobra.Command{
+		Use:   "tui <[src|bin|repo]:path-to-old> <[src|bin|repo]:path-to-new>",
+		Short: "Review and push package changes interactively",
+		Long: `Show the packages that push would publish in an interactive terminal UI, with
+their version change, their impact and the wave they would be built in. Packages
+can be deselected, and their dependencies inspected, before pushing the
+selected ones. It takes the same flags as push.
+
+Keys: up/down or j/k to move, space to (de)select the package, a to (de)select
+all of them, enter to show the dependencies of the package, p to push the
+selected packages and q to quit without pushing. Selected packages marked with
+[!] depend on deselected ones, and would be built against their old version.`,
+		Run:  runTUI,
+		Args: defaultStatesArgs(2),
+	}
+)
+
+func init() {
+	cmdTUI.Flags().BoolP("force", "f", false, "whether to ignore safety checks")
+	backendFlag(cmdTUI)
+	targetFlag(cmdTUI)
+	filterFlags(cmdTUI)
+	commitFlags(cmdTUI)
+	downgradeFlags(cmdTUI)
+	checkFlags(cmdTUI)
+	publishFlags(cmdTUI)
+	pinFlag(cmdTUI)
+}
+
+// tuiModel is the state of the terminal UI, over the packages of a push.
+type tuiModel struct {
+	order    pushOrder
+	selected []bool
+	kinds    []string
+	// impacts holds, for every package, how many packages of the push depend
+	// on it, directly or not.
+	impacts []int
+	cursor  int
+	offset  int
+	details bool
+}
+
+func newTUIModel(order pushOrder) *tuiModel {
+	m := &tuiModel{
+		order:    order,
+		selected: make([]bool, len(order.packages)),
+		kinds:    make([]string, len(order.packages)),
+		impacts:  make([]int, len(order.packages)),
+	}
+	for idx, pkg := range order.packages {
+		m.selected[idx] = true
+		diff := state.Diff{Idx: idx, OldIdx: -1, Ver: pkg.Version, RelNum: pkg.Release}
+		if old := order.old[idx]; old != nil {
+			diff.OldIdx, diff.OldVer, diff.OldRelNum = idx, old.Version, old.Release
+		}
+		m.kinds[idx] = diff.Kind().Title()
+	}
+
+	// Packages only depend on earlier packages, so the dependents of a
+	// package are all known once the later ones were visited.
+	dependents := make([]map[int]bool, len(order.packages))
+	for idx := len(order.packages) - 1; idx >= 0; idx-- {
+		if dependents[idx] == nil {
+			dependents[idx] = map[int]bool{}
+		}
+		m.impacts[idx] = len(dependents[idx])
+		for _, dep := range order.deps[idx] {
+			if dependents[dep] == nil {
+				dependents[dep] = map[int]bool{}
+			}
+			dependents[dep][idx] = true
+			for dependent := range dependents[idx] {
+				dependents[dep][dependent] = true
+			}
+		}
+	}
+	return m
+}
+
+// selectedDeps returns the selected packages among the dependencies of the
+// package at `idx`.
+func (m *tuiModel) selectedDeps(idx int) (deps []int) {
+	for _, dep := range m.order.deps[idx] {
+		if m.selected[dep] {
+			deps = append(deps, dep)
+		}
+	}
+	return
+}
+
+// waves returns the wave of every selected package, see push.Waves, and 0 for
+// the others.
+func (m *tuiModel) waves() []int {
+	deps := make([][]int, len(m.order.packages))
+	for idx := range deps {
+		deps[idx] = m.selectedDeps(idx)
+	}
+	waves := push.Waves(deps)
+	for idx := range waves {
+		if !m.selected[idx] {
+			waves[idx] = 0
+		}
+	}
+	return waves
+}
+
+// chain returns the longest chain of selected packages that the package at
+// `idx` has to wait for, ending with it.
+func (m *tuiModel) chain(idx int) []int {
+	length := make([]int, idx+1)
+	prev := make([]int, idx+1)
+	for i := 0; i <= idx; i++ {
+		length[i], prev[i] = 1, -1
+		for _, dep := range m.selectedDeps(i) {
+			if length[dep]+1 > length[i] {
+				length[i], prev[i] = length[dep]+1, dep
+			}
+		}
+	}
+
+	var chain []int
+	for i := idx; i >= 0; i = prev[i] {
+		chain = append([]int{i}, chain...)
+	}
+	return chain
+}
+
+// selection returns the selected packages of the push.
+func (m *tuiModel) selection() (res pushOrder) {
+	res.oldTPath, res.newTPath = m.order.oldTPath, m.order.newTPath
+	pos := make([]int, len(m.order.packages))
+	for idx, pkg := range m.order.packages {
+		if !m.selected[idx] {
+			continue
+		}
+		pos[idx] = len(res.packages)
+		res.packages = append(res.packages, pkg)
+		res.old = append(res.old, m.order.old[idx])
+		var deps []int
+		for _, dep := range m.selectedDeps(idx) {
+			deps = append(deps, pos[dep])
+		}
+		res.deps = append(res.deps, deps)
+	}
+
+	// Deselected packages may have split streams apart, so find them again
+	// by merging the streams of dependencies.
+	stream := make([]int, len(res.packages))
+	var find func(int) int
+	find = func(idx int) int {
+		if stream[idx] != idx {
+			stream[idx] = find(stream[idx])
+		}
+		return stream[idx]
+	}
+	for idx := range res.packages {
+		stream[idx] = idx
+		for _, dep := range res.deps[idx] {
+			stream[find(dep)] = find(idx)
+		}
+	}
+	numbers := map[int]int{}
+	for idx := range res.packages {
+		root := find(idx)
+		if _, ok := numbers[root]; !ok {
+			numbers[root] = len(numbers)
+		}
+		res.streams = append(res.streams, numbers[root])
+	}
+	return
+}
+
+// handle updates the model for `key`, and reports whether the UI should quit,
+// and whether to push then.
+func (m *tuiModel) handle(key string) (quit bool, publish bool) {
+	switch key {
+	case "q", "\x03":
+		return true, false
+	case "p":
+		return true, true
+	case "up", "k":
+		m.cursor = max(m.cursor-1, 0)
+	case "down", "j":
+		m.cursor = min(m.cursor+1, len(m.order.packages)-1)
+	case " ":
+		m.selected[m.cursor] = !m.selected[m.cursor]
+	case "a":
+		all := true
+		for _, selected := range m.selected {
+			all = all && selected
+		}
+		for idx := range m.selected {
+			m.selected[idx] = !all
+		}
+	case "enter":
+		m.details = !m.details
+	}
+	return false, false
+}
+
+// render draws the model in a terminal of the given size.
+func (m *tuiModel) render(w io.Writer, width int, height int) {
+	waves := m.waves()
+	numSelected, numWaves := 0, 0
+	for idx, wave := range waves {
+		if m.selected[idx] {
+			numSelected++
+		}
+		numWaves = max(numWaves, wave)
+	}
+
+	var lines []string
+	lines = append(lines, fmt.Sprintf("%s -> %s: %d packages, %d selected in %d waves", m.order.oldTPath, m.order.newTPath, len(m.order.packages), numSelected, numWaves))
+	lines = append(lines, fmt.Sprintf("    %-30s %-20s %-20s %6s %4s", "PACKAGE", "CHANGE", "VERSION", "IMPACT", "WAVE"))
+
+	var footer []string
+	if m.details {
+		footer = m.detailLines()
+	}
+	footer = append(footer, "[!]: depends on deselected packages  space: select  a: all  enter: dependencies  p: push selected  q: quit")
+
+	rows := max(height-len(lines)-len(footer), 1)
+	if m.cursor < m.offset {
+		m.offset = m.cursor
+	} else if m.cursor >= m.offset+rows {
+		m.offset = m.cursor - rows + 1
+	}
+	for idx := m.offset; idx < min(m.offset+rows, len(m.order.packages)); idx++ {
+		pkg := m.order.packages[idx]
+		cursor, check, wave := " ", "[ ]", "-"
+		if idx == m.cursor {
+			cursor = ">"
+		}
+		if m.selected[idx] {
+			check, wave = "[x]", fmt.Sprint(waves[idx])
+			// The package would be built against a dependency that isn't
+			// pushed.
+			if len(m.selectedDeps(idx)) != len(m.order.deps[idx]) {
+				check = "[!]"
+			}
+		}
+		version := fmt.Sprintf("%s -> %s-%d", versionString(m.order.old[idx]), pkg.Version, pkg.Release)
+		lines = append(lines, fmt.Sprintf("%s%s %-30s %-20s %-20s %6d %4s", cursor, check, pkg.Name, m.kinds[idx], version, m.impacts[idx], wave))
+	}
+	for len(lines) < height-len(footer) {
+		lines = append(lines, "")
+	}
+	lines = append(lines, footer...)
+
+	var b strings.Builder
+	b.WriteString("\033[H\033[2J")
+	for idx, line := range lines {
+		if runes := []rune(line); width > 1 && len(runes) >= width {
+			line = string(runes[:width-2]) + "…"
+		}
+		if idx > 0 {
+			b.WriteString("\r\n")
+		}
+		b.WriteString(line)
+	}
+	io.WriteString(w, b.String())
+}
+
+// detailLines describes the dependencies of the package under the cursor.
+func (m *tuiModel) detailLines() []string {
+	names := func(idxs []int) string {
+		var res []string
+		for _, idx := range idxs {
+			name := m.order.packages[idx].Name
+			if !m.selected[idx] {
+				name += " (deselected)"
+			}
+			res = append(res, name)
+		}
+		if len(res) == 0 {
+			return "none"
+		}
+		return strings.Join(res, ", ")
+	}
+
+	var dependents []int
+	for idx := m.cursor + 1; idx < len(m.order.packages); idx++ {
+		for _, dep := range m.order.deps[idx] {
+			if dep == m.cursor {
+				dependents = append(dependents, idx)
+			}
+		}
+	}
+	lines := []string{
+		"",
+		fmt.Sprintf("%s depends on: %s", m.order.packages[m.cursor].Name, names(m.order.deps[m.cursor])),
+		fmt.Sprintf("Needed by: %s", names(dependents)),
+	}
+	if m.selected[m.cursor] {
+		var chain []string
+		for _, idx := range m.chain(m.cursor) {
+			chain = append(chain, m.order.packages[idx].Name)
+		}
+		lines = append(lines, fmt.Sprintf("Longest chain: %s", strings.Join(chain, " -> ")))
+	}
+	return append(lines, "")
+}
+
+// readKey reads a key press, with the arrow keys and enter named.
+func readKey(r *bufio.Reader) (string, error) {
+	c, err := r.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	switch c {
+	case '\r', '\n':
+		return "enter", nil
+	case '\033':
+		if r.Buffered() < 2 {
+			return "esc", nil
+		}
+		seq := make([]byte, 2)
+		if _, err = io.ReadFull(r, seq); err != nil {
+			return "", err
+		}
+		switch string(seq) {
+		case "[A":
+			return "up", nil
+		case "[B":
+			return "down", nil
+		}
+		return "esc", nil
+	}
+	return string(c), nil
+}
+
+// runUI runs the terminal UI until it quits, and reports whether to push.
+func (m *tuiModel) runUI() (publish bool, err error) {
+	stdin, stdout := int(os.Stdin.Fd()), int(os.Stdout.Fd())
+	oldState, err := term.MakeRaw(stdin)
+	if err != nil {
+		return
+	}
+	defer term.Restore(stdin, oldState)
+
+	// Use the alternate screen without a cursor, and leave the terminal as
+	// it was.
+	fmt.Print("\033[?1049h\033[?25l")
+	defer fmt.Print("\033[?25h\033[?1049l")
+
+	r := bufio.NewReader(os.Stdin)
+	for {
+		width, height, err := term.GetSize(stdout)
+		if err != nil {
+			width, height = 80, 24
+		}
+		m.render(os.Stdout, width, height)
+
+		key, err := readKey(r)
+		if err != nil {
+			return false, err
+		}
+		if quit, publish := m.handle(key); quit {
+			return publish, nil
+		}
+	}
+}
+
+func runTUI(cmd *cobra.Command, args []string) {
+	args = defaultStates(cmd, args)
+	checkoutOnly(args[1])
+	force, _ := cmd.Flags().GetBool("force")
+	opts := diffOptions{filter: getFilter(cmd), downgrades: getDowngradePolicy(cmd), checks: getChecks(cmd), pins: getPins(cmd)}
+
+	if !term.IsTerminal(int(os.Stdin.Fd())) || !term.IsTerminal(int(os.Stdout.Fd())) {
+		waterlog.Fatalln("The TUI needs a terminal, use push instead")
+	}
+
+	order, ok := changedOrder(args[0], args[1], force, opts)
+	if !ok {
+		return
+	}
+	order.oldTPath, order.newTPath = args[0], args[1]
+
+	// Fail before showing anything if there is nowhere to push to.
+	userConfig, err := loadConfig()
+	if err != nil {
+		waterlog.Fatalf("Failed to load configuration: %s\n", err)
+	}
+	targets := pushTargets(cmd, userConfig)
+
+	m := newTUIModel(order)
+	publish, err := m.runUI()
+	if err != nil {
+		waterlog.Fatalf("Failed to run the TUI: %s\n", err)
+	}
+	if !publish {
+		return
+	}
+
+	selection := m.selection()
+	if len(selection.packages) == 0 {
+		waterlog.Infoln("No packages were selected. Exiting...")
+		return
+	}
+	printOrder(selection)
+	publishOrder(cmd, targets, userConfig, selection)
+}
@@ -0,0 +1,71 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package cmd
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DataDrake/waterlog"
+	"github.com/GZGavinZhao/autobuild/common"
+	st "github.com/GZGavinZhao/autobuild/state"
+)
+
+// indexWaiter waits, with --wait-index, for the binary state of the
+// repository to hold the packages of a wave before the next wave is published,
+// so that dependents never build against a stale repository.
+type indexWaiter struct {
+	tpath    string
+	interval time.Duration
+	timeout  time.Duration
+	log      func(fn func())
+
+	// mu makes the pipelines of several targets wait one at a time, as they
+	// poll the same repository.
+	mu sync.Mutex
+}
+
+// stale returns the packages of `pkgs` whose release isn't in `state` yet.
+func stale(state st.State, pkgs []common.Package) (res []string) {
+	for _, pkg := range pkgs {
+		idx, ok := state.NameToSrcIdx()[pkg.Name]
+		if !ok || state.Packages()[idx].Release < pkg.Release {
+			res = append(res, fmt.Sprintf("%s (%d)", pkg.Name, pkg.Release))
+		}
+	}
+	return
+}
+
+// wait polls the repository until it holds the releases of `pkgs`, and fails
+// once the timeout is over. Failing to load the repository is retried, as it
+// may be in the middle of being re-indexed.
+func (w *indexWaiter) wait(pkgs []common.Package) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	deadline := time.Now().Add(w.timeout)
+	for logged := false; ; logged = true {
+		state, err := st.LoadState(w.tpath)
+		var missing []string
+		if err == nil {
+			if missing = stale(state, pkgs); len(missing) == 0 {
+				return nil
+			}
+			err = fmt.Errorf("%s doesn't hold %s", w.tpath, strings.Join(missing, ", "))
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("the repository wasn't re-indexed within %s: %w", w.timeout, err)
+		}
+		if !logged {
+			w.log(func() {
+				waterlog.Infof("Waiting for %s to index %d package(s)\n", w.tpath, len(pkgs))
+			})
+		}
+		waterlog.Debugf("Still waiting for the index: %s\n", err)
+		time.Sleep(w.interval)
+	}
+}
@@ -0,0 +1,43 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package cmd
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+
+	"github.com/spf13/cobra"
+)
+
+//go:embed web
+var webFiles embed.FS
+
+var cmdWeb = &cobra.Command{
+	Use:   "web --state [src|bin|repo:path]...",
+	Short: "Serve a web dashboard of the states and the pushes",
+	Long: `Run "autobuild serve", along with a web dashboard on the same address that
+searches the packages of the served states, draws the dependencies and
+dependents of a package, shows the diff between two states, and follows the
+progress of the pushes started over the API, e.g. to keep a team up to date
+during large rebuilds. For example:
+autobuild web --state repo:unstable --state src:../packages
+
+The dashboard only reads from the API, and pushes are still started with
+"POST /api/v1/pushes".`,
+	Run:  runWeb,
+	Args: cobra.NoArgs,
+}
+
+func init() {
+	serverFlags(cmdWeb)
+}
+
+func runWeb(cmd *cobra.Command, args []string) {
+	mux := newServer().routes()
+	files, _ := fs.Sub(webFiles, "web")
+	mux.Handle("/", http.FileServer(http.FS(files)))
+	listen(mux)
+}
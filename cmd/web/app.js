@@ -0,0 +1,271 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+"use strict";
+
+const $ = (id) => document.getElementById(id);
+const SVG = "http://www.w3.org/2000/svg";
+
+let selected = null;
+let shownPush = null;
+let diffPackages = [];
+
+async function api(path, params = {}) {
+  const query = new URLSearchParams();
+  for (const [key, value] of Object.entries(params)) {
+    for (const v of [].concat(value)) {
+      query.append(key, v);
+    }
+  }
+  const res = await fetch(`/api/v1/${path}?${query}`);
+  const body = await res.json();
+  if (!res.ok) {
+    throw new Error(body.error);
+  }
+  return body;
+}
+
+function el(tag, text, attrs = {}) {
+  const node = document.createElement(tag);
+  if (text !== undefined) {
+    node.textContent = text;
+  }
+  Object.assign(node, attrs);
+  return node;
+}
+
+function version(v) {
+  return v ? `${v.version}-${v.release}` : "";
+}
+
+function duration(from, to) {
+  const secs = Math.round((to - from) / 1000);
+  const h = Math.floor(secs / 3600), m = Math.floor(secs / 60) % 60, s = secs % 60;
+  return h ? `${h}h${m}m` : m ? `${m}m${s}s` : `${s}s`;
+}
+
+async function loadStates() {
+  const states = await api("states");
+  for (const id of ["old", "new"]) {
+    const select = $(id);
+    const current = select.value;
+    select.replaceChildren(...states.map((s) => el("option", s.state, { value: s.state })));
+    // Diff the first state against the last one by default.
+    select.value = current || states[id === "old" ? 0 : states.length - 1].state;
+  }
+  $("loaded").textContent = states.map((s) => `${s.state}: ${s.packages} packages, loaded ${new Date(s.loaded).toLocaleTimeString()}`).join(" | ");
+}
+
+async function search() {
+  const q = $("search").value.trim();
+  if (!q) {
+    $("results").replaceChildren();
+    return;
+  }
+  try {
+    const results = await api("search", { state: $("new").value, q });
+    $("results").replaceChildren(...results.map((pkg) => {
+      const li = el("li", `${pkg.name} ${pkg.version}-${pkg.release}`);
+      if (pkg.component) {
+        li.append(el("small", ` (${pkg.component})`));
+      }
+      li.onclick = () => selectPackage(pkg.name);
+      return li;
+    }));
+  } catch (err) {
+    $("results").replaceChildren(el("li", err.message));
+  }
+}
+
+async function selectPackage(name) {
+  selected = name;
+  const state = $("new").value;
+  try {
+    const pkg = await api("query", { state, package: name });
+    const info = $("package");
+    info.replaceChildren(el("h3", `${pkg.name} ${pkg.version}-${pkg.release}`));
+    if (pkg.component) {
+      info.append(el("p", `Component: ${pkg.component}`));
+    }
+    if (pkg.path) {
+      info.append(el("p", `Path: ${pkg.path}`));
+    }
+    if (pkg.unresolved && pkg.unresolved.length) {
+      info.append(el("p", `Unresolved: ${pkg.unresolved.map((d) => d.name).join(", ")}`, { className: "failed" }));
+    }
+    $("graph-controls").hidden = false;
+    await drawGraph();
+  } catch (err) {
+    $("package").replaceChildren(el("p", err.message, { className: "failed" }));
+  }
+}
+
+// drawGraph draws the dependencies of the selected package on its left, and its
+// dependents on its right, one column per distance.
+async function drawGraph() {
+  const svg = $("graph");
+  let graph;
+  try {
+    graph = await api("graph", { state: $("new").value, package: selected, depth: $("depth").value });
+  } catch (err) {
+    svg.replaceChildren();
+    svg.style.height = "0";
+    $("package").append(el("p", err.message));
+    return;
+  }
+
+  const columns = new Map();
+  for (const node of graph.nodes) {
+    if (!columns.has(node.distance)) {
+      columns.set(node.distance, []);
+    }
+    columns.get(node.distance).push(node);
+  }
+  const distances = [...columns.keys()].sort((a, b) => a - b);
+  const width = 150, height = 28, gap = 60;
+  const pos = new Map();
+  distances.forEach((d, x) => {
+    columns.get(d).forEach((node, y) => pos.set(node.name, { x: x * (width + gap) + width / 2 + 5, y: y * (height + 8) + height / 2 + 5 }));
+  });
+  const rows = Math.max(...[...columns.values()].map((c) => c.length));
+  svg.setAttribute("viewBox", `0 0 ${distances.length * (width + gap)} ${rows * (height + 8) + 10}`);
+  svg.style.height = `${Math.min(rows * (height + 8) + 10, 600)}px`;
+
+  const marker = document.createElementNS(SVG, "marker");
+  Object.entries({ id: "arrow", viewBox: "0 0 10 10", refX: "10", refY: "5", markerWidth: "6", markerHeight: "6", orient: "auto" }).forEach(([k, v]) => marker.setAttribute(k, v));
+  const arrow = document.createElementNS(SVG, "path");
+  arrow.setAttribute("d", "M 0 0 L 10 5 L 0 10 z");
+  marker.append(arrow);
+  const defs = document.createElementNS(SVG, "defs");
+  defs.append(marker);
+  svg.replaceChildren(defs);
+
+  for (const edge of graph.edges) {
+    const from = pos.get(edge.from), to = pos.get(edge.to);
+    const line = document.createElementNS(SVG, "line");
+    const dir = to.x >= from.x ? 1 : -1;
+    line.setAttribute("x1", from.x + dir * width / 2);
+    line.setAttribute("y1", from.y);
+    line.setAttribute("x2", to.x - dir * width / 2);
+    line.setAttribute("y2", to.y);
+    line.setAttribute("class", edge.kind);
+    line.append(document.createElementNS(SVG, "title"));
+    line.firstChild.textContent = `${edge.to} ${edge.kind}-depends on ${edge.from}`;
+    svg.append(line);
+  }
+  for (const node of graph.nodes) {
+    const { x, y } = pos.get(node.name);
+    const g = document.createElementNS(SVG, "g");
+    if (node.name === selected) {
+      g.setAttribute("class", "selected");
+    }
+    const rect = document.createElementNS(SVG, "rect");
+    Object.entries({ x: x - width / 2, y: y - height / 2, width, height, rx: 4 }).forEach(([k, v]) => rect.setAttribute(k, v));
+    const text = document.createElementNS(SVG, "text");
+    text.setAttribute("x", x);
+    text.setAttribute("y", y);
+    text.textContent = node.name.length > 22 ? `${node.name.slice(0, 21)}…` : node.name;
+    const title = document.createElementNS(SVG, "title");
+    title.textContent = `${node.name} ${node.version}-${node.release}`;
+    g.append(rect, text, title);
+    g.onclick = () => selectPackage(node.name);
+    svg.append(g);
+  }
+  if (graph.truncated) {
+    $("package").append(el("p", "The graph is too large and was truncated, lower the depth."));
+  }
+}
+
+async function loadDiff() {
+  try {
+    const diff = await api("diff", { old: $("old").value, new: $("new").value });
+    diffPackages = diff.packages;
+    const counts = {};
+    for (const pkg of diffPackages) {
+      counts[pkg.kind] = (counts[pkg.kind] || 0) + 1;
+    }
+    $("diff-summary").textContent = Object.entries(counts).map(([kind, n]) => `${n} ${kind}`).join(", ");
+  } catch (err) {
+    diffPackages = [];
+    $("diff-summary").textContent = err.message;
+  }
+  showDiff();
+}
+
+function showDiff() {
+  const filter = $("diff-filter").value.trim().toLowerCase();
+  $("diff-rows").replaceChildren(...diffPackages
+    .filter((pkg) => !filter || pkg.name.toLowerCase().includes(filter) || pkg.kind.includes(filter) || (pkg.component || "").includes(filter))
+    .map((pkg) => {
+      const tr = el("tr");
+      const name = el("td", pkg.name, { title: pkg.reason });
+      name.onclick = () => selectPackage(pkg.name);
+      tr.append(name, el("td", pkg.kind), el("td", version(pkg.old)), el("td", version(pkg.new)), el("td", pkg.component || ""), el("td", pkg.impact));
+      return tr;
+    }));
+}
+
+async function loadPushes() {
+  let pushes;
+  try {
+    pushes = await api("pushes");
+  } catch (err) {
+    return;
+  }
+  const now = new Date();
+  $("push-rows").replaceChildren(...pushes.map((job) => {
+    const tr = el("tr");
+    const started = new Date(job.started);
+    const latest = job.latest ? `${job.latest.package} ${job.latest.version}-${job.latest.release} (job ${job.latest.job_id})` : "";
+    tr.append(
+      el("td", job.id),
+      el("td", job.status, { className: job.status }),
+      el("td", job.published),
+      el("td", latest),
+      el("td", started.toLocaleString()),
+      el("td", duration(started, job.finished ? new Date(job.finished) : now)),
+    );
+    tr.title = `autobuild ${job.args.join(" ")}`;
+    tr.onclick = () => {
+      shownPush = shownPush === job.id ? null : job.id;
+      loadOutput();
+    };
+    return tr;
+  }));
+  loadOutput();
+}
+
+async function loadOutput() {
+  const pre = $("push-output");
+  pre.hidden = shownPush === null;
+  if (shownPush === null) {
+    return;
+  }
+  const res = await fetch(`/api/v1/pushes/${shownPush}`);
+  const job = await res.json();
+  const follow = pre.scrollTop + pre.clientHeight >= pre.scrollHeight - 5;
+  pre.textContent = job.output || "No output yet.";
+  if (follow) {
+    pre.scrollTop = pre.scrollHeight;
+  }
+}
+
+async function refresh() {
+  await loadStates();
+  await loadDiff();
+}
+
+$("search").oninput = search;
+$("depth").onchange = drawGraph;
+$("diff-filter").oninput = showDiff;
+$("old").onchange = loadDiff;
+$("new").onchange = () => {
+  loadDiff();
+  search();
+};
+
+refresh().catch((err) => $("loaded").textContent = err.message);
+loadPushes();
+setInterval(loadPushes, 5000);
+setInterval(() => refresh().catch(() => {}), 60000);
@@ -0,0 +1,89 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package common
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/getsolus/libeopkg/shared"
+)
+
+var dependencyRe = regexp.MustCompile(`<Dependency[^>]*>([^<]*)</Dependency>`)
+
+// DepKind describes why a package depends on another package. The values are
+// ordered by strength, so when the same dependency is pulled in for multiple
+// reasons the smallest value wins.
+type DepKind int64
+
+const (
+	BuildDep DepKind = iota + 1
+	CheckDep
+	RunDep
+)
+
+func (k DepKind) String() string {
+	switch k {
+	case BuildDep:
+		return "build"
+	case CheckDep:
+		return "check"
+	case RunDep:
+		return "run"
+	}
+	return "unknown"
+}
+
+// AddDeps appends `deps` to the dependencies of the package, recording `kind`
+// as the reason for each of them.
+func (p *Package) AddDeps(kind DepKind, deps ...string) {
+	if p.DepKinds == nil {
+		p.DepKinds = make(map[string]DepKind)
+	}
+
+	for _, dep := range deps {
+		p.BuildDeps = append(p.BuildDeps, dep)
+		if old, ok := p.DepKinds[dep]; !ok || kind < old {
+			p.DepKinds[dep] = kind
+		}
+	}
+}
+
+// DepKind returns the reason the package depends on `dep`. Dependencies whose
+// kind was never recorded are treated as build dependencies.
+func (p *Package) DepKind(dep string) DepKind {
+	if kind, ok := p.DepKinds[dep]; ok {
+		return kind
+	}
+	return BuildDep
+}
+
+// DependencyNames returns the names of the runtime dependencies of a binary
+// package, from an index or pspec_x86_64.xml.
+func DependencyNames(deps []shared.Dependency) (names []string) {
+	for _, dep := range deps {
+		// libeopkg decodes the whole RuntimeDependencies element as one
+		// dependency, whose name is the XML of all of them.
+		if !strings.Contains(dep.Name, "<") {
+			if name := strings.TrimSpace(dep.Name); name != "" {
+				names = append(names, name)
+			}
+			continue
+		}
+		for _, match := range dependencyRe.FindAllStringSubmatch(dep.Name, -1) {
+			names = append(names, strings.TrimSpace(match[1]))
+		}
+	}
+	return
+}
+
+// UnresolvedDep is a build dependency of a package that no package provides.
+type UnresolvedDep struct {
+	Name string
+	Kind DepKind
+	// Closest is the name that a package provides which is the closest to
+	// Name, as a suggestion for a typo, or empty if none is close.
+	Closest string
+}
@@ -47,7 +47,7 @@ func CheckSrcPkgsSynced(indexPath string, srcPkgs []Package, nameToSrcIdx map[st
 			waterlog.Warnf("Package %s has the same release number but has version mismatch between source %s and binary %s\n", pkgName, srcVer, binVer)
 		} else if binRelNum < srcRelNum {
 			srcPkg.Synced = false
-			waterlog.Infof("%s: %s (%d) -> %s (%d)\n", pkgName, binVer, binRelNum, srcVer, srcRelNum)
+			waterlog.Debugf("%s: %s (%d) -> %s (%d)\n", pkgName, binVer, binRelNum, srcVer, srcRelNum)
 		}
 	}
 
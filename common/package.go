@@ -12,7 +12,6 @@ import (
 	"slices"
 	"strings"
 
-	"github.com/DataDrake/waterlog"
 	"github.com/GZGavinZhao/autobuild/config"
 	"github.com/GZGavinZhao/autobuild/utils"
 	"github.com/GZGavinZhao/autobuild/ypkg"
@@ -25,27 +24,90 @@ var (
 	// pcre = regexp.MustCompile(`/usr/(lib|lib64|lib32|share)/[^/]+\.pc`)
 	pcre    = regexp.MustCompile(`/usr/(lib|lib64|lib32|share)/.+\.pc$`)
 	oldpcre = regexp.MustCompile(`/usr/(lib|lib64|lib32|share)/.+\.pc`)
+	cvere   = regexp.MustCompile(`CVE-\d{4}-\d+`)
 )
 
 type Package struct {
 	Path      string
 	Name      string
 	Version   string
+	Component string
 	Root      string
 	Release   int
 	Provides  []string
 	BuildDeps []string
+	DepKinds  map[string]DepKind
 	Ignores   []string
 	Resolved  bool
 	Built     bool
 	Synced    bool
+	// Security is set when the current release is a security update, i.e. it
+	// is marked as one in the history of pspec_x86_64.xml or mentions a CVE.
+	Security bool
+	// History holds the updates of the package, newest first, from
+	// pspec_x86_64.xml or the index.
+	History []Update
+	// Sources holds the sources of the recipe as "url hash", for source
+	// states.
+	Sources []string
+	// Licenses holds the licenses of the main package.
+	Licenses []string
+	// Subpackages holds the names of the binary packages built from this
+	// package, from pspec_x86_64.xml or the index, sorted.
+	Subpackages []string
+	// Links holds the runtime dependencies of the binary packages recorded in
+	// pspec_x86_64.xml, which ypkg finds from what they actually link
+	// against, for source states.
+	Links []string
+}
+
+// Update is an entry of the history of a package.
+type Update struct {
+	Release int    `json:"release"`
+	Version string `json:"version"`
+	Date    string `json:"date,omitempty"`
+	// Type is "security" for security fixes.
+	Type    string `json:"type,omitempty"`
+	Comment string `json:"comment"`
+}
+
+// Changes returns the updates of the history of the package since, but not
+// including, release `since`.
+func (p *Package) Changes(since int) (res []Update) {
+	for _, update := range p.History {
+		if update.Release > since {
+			res = append(res, update)
+		}
+	}
+	return
+}
+
+// Intern replaces the strings of the package that packages share, such as
+// the names of their dependencies, with the copies held by `strs`.
+func (p *Package) Intern(strs *utils.StringTable) {
+	p.Name = strs.Intern(p.Name)
+	p.Version = strs.Intern(p.Version)
+	p.Component = strs.Intern(p.Component)
+	p.Provides = strs.InternAll(p.Provides)
+	p.BuildDeps = strs.InternAll(p.BuildDeps)
+	p.Licenses = strs.InternAll(p.Licenses)
+	p.Subpackages = strs.InternAll(p.Subpackages)
+	p.Links = strs.InternAll(p.Links)
+	for idx := range p.History {
+		update := &p.History[idx]
+		update.Version = strs.Intern(update.Version)
+		update.Date = strs.Intern(update.Date)
+		update.Type = strs.Intern(update.Type)
+	}
 }
 
 func (p *Package) Resolve(nameToSrcIdx map[string]int, pkgs []Package) (res []string) {
 	if !p.Resolved {
 		p.Resolved = true
+		kinds := make(map[string]DepKind)
 
 		for idx, dep := range p.BuildDeps {
+			kind := p.DepKind(dep)
 			srcIdx, ok := nameToSrcIdx[dep]
 
 			if !ok {
@@ -54,7 +116,12 @@ func (p *Package) Resolve(nameToSrcIdx map[string]int, pkgs []Package) (res []st
 			} else {
 				p.BuildDeps[idx] = pkgs[srcIdx].Name
 			}
+
+			if old, ok := kinds[p.BuildDeps[idx]]; !ok || kind < old {
+				kinds[p.BuildDeps[idx]] = kind
+			}
 		}
+		p.DepKinds = kinds
 
 		slices.Sort(p.BuildDeps)
 		p.BuildDeps = utils.Uniq(p.BuildDeps)
@@ -66,7 +133,7 @@ func (p *Package) Resolve(nameToSrcIdx map[string]int, pkgs []Package) (res []st
 		p.BuildDeps = utils.Filter(p.BuildDeps, func(dep string) bool {
 			for _, regex := range ignoreRegexes {
 				if regex.FindString(dep) == dep {
-					waterlog.Debugf("Package.Resolve: Dropping builddep %s from %s due to ignore regex %s\n", dep, p.Name, regex.String())
+					utils.Tracef("Package.Resolve: Dropping builddep %s from %s due to ignore regex %s\n", dep, p.Name, regex.String())
 					return false
 				}
 			}
@@ -77,6 +144,15 @@ func (p *Package) Resolve(nameToSrcIdx map[string]int, pkgs []Package) (res []st
 	return
 }
 
+// ContentHash returns the hash of the package.yml of the source package and of
+// its files directory, which holds the patches, see utils.HashDir. Generated
+// files such as pspec_x86_64.xml don't contribute to it.
+func (p *Package) ContentHash() (string, error) {
+	return utils.HashDir(p.Path, func(rel string) bool {
+		return rel == "package.yml" || strings.HasPrefix(rel, "files/")
+	})
+}
+
 // ParsePackage parses a source package that is within the given `dir`
 // directory. In other words, a `package.yml` file must be located at
 // `dir/package.yml`.
@@ -97,9 +173,16 @@ func ParsePackage(dir string) (pkg Package, err error) {
 		Name:      ypkgYml.Name,
 		Version:   ypkgYml.Version,
 		Release:   ypkgYml.Release,
-		BuildDeps: ypkgYml.BuildDeps,
+		Component: mainComponent(&ypkgYml.Component),
+		Licenses:  scalars(&ypkgYml.License),
 		Synced:    false,
 	}
+	pkg.AddDeps(BuildDep, ypkgYml.BuildDeps...)
+	for _, source := range ypkgYml.Source {
+		for _, url := range utils.SortedKeys(source) {
+			pkg.Sources = append(pkg.Sources, url+" "+source[url])
+		}
+	}
 
 	// Combine the rundeps of all subpackages into a single list
 	// Note to self: this website can inspect yaml ast nodes:
@@ -108,7 +191,7 @@ func ParsePackage(dir string) (pkg Package, err error) {
 	if rundeps.Kind == yaml.SequenceNode {
 		for _, children := range rundeps.Content {
 			if children.Kind == yaml.ScalarNode {
-				pkg.BuildDeps = append(pkg.BuildDeps, children.Value)
+				pkg.AddDeps(RunDep, children.Value)
 			} else if children.Kind == yaml.MappingNode {
 				for _, subpkg := range children.Content {
 					for _, rundep := range subpkg.Content {
@@ -116,7 +199,7 @@ func ParsePackage(dir string) (pkg Package, err error) {
 							continue
 						}
 
-						pkg.BuildDeps = append(pkg.BuildDeps, rundep.Value)
+						pkg.AddDeps(RunDep, rundep.Value)
 					}
 				}
 			}
@@ -126,7 +209,7 @@ func ParsePackage(dir string) (pkg Package, err error) {
 	}
 
 	if ypkgYml.Clang {
-		pkg.BuildDeps = append(pkg.BuildDeps, "llvm-clang-devel")
+		pkg.AddDeps(BuildDep, "llvm-clang-devel")
 	}
 
 	if !utils.PathExists(pspecFile) {
@@ -138,8 +221,22 @@ func ParsePackage(dir string) (pkg Package, err error) {
 		err = errors.New(fmt.Sprintf("Failed to load pspec_x86_64.xml for %s: %s", dir, err))
 		return
 	}
+	for _, update := range pspecXml.History {
+		if update.Release == pkg.Release {
+			pkg.Security = update.Type == "security" || cvere.MatchString(update.Comment)
+		}
+		pkg.History = append(pkg.History, Update{
+			Release: update.Release,
+			Version: update.Version,
+			Date:    update.Date,
+			Type:    update.Type,
+			Comment: strings.TrimSpace(update.Comment),
+		})
+	}
 	for _, subPkg := range pspecXml.Packages {
 		pkg.Provides = append(pkg.Provides, subPkg.Name)
+		pkg.Subpackages = append(pkg.Subpackages, subPkg.Name)
+		pkg.Links = append(pkg.Links, DependencyNames(subPkg.RuntimeDependencies)...)
 
 		for _, pcProvide := range getPcProvides(&subPkg) {
 			pkg.Provides = append(pkg.Provides, pcProvide)
@@ -172,7 +269,41 @@ func ParsePackage(dir string) (pkg Package, err error) {
 
 	slices.Sort(pkg.BuildDeps)
 	slices.Sort(pkg.Provides)
+	slices.Sort(pkg.Subpackages)
+
+	return
+}
+
+// mainComponent returns the component of the main package from the
+// `component` field of a `package.yml`, which is either a single component or
+// a list of components where subpackages are given as `^name: component`.
+func mainComponent(node *yaml.Node) string {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		return node.Value
+	case yaml.SequenceNode:
+		for _, child := range node.Content {
+			if child.Kind == yaml.ScalarNode {
+				return child.Value
+			}
+		}
+	}
+	return ""
+}
 
+// scalars returns the values of a `package.yml` field that is either a single
+// value or a list of values.
+func scalars(node *yaml.Node) (res []string) {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		res = append(res, node.Value)
+	case yaml.SequenceNode:
+		for _, child := range node.Content {
+			if child.Kind == yaml.ScalarNode {
+				res = append(res, child.Value)
+			}
+		}
+	}
 	return
 }
 
@@ -206,10 +337,22 @@ func getPcProvides(pkg *pspec.Package) []string {
 
 func ParseIndexPackage(ipkg index.Package) (pkg Package, err error) {
 	pkg.Name = ipkg.Source.Name
+	pkg.Component = ipkg.PartOf
+	pkg.Licenses = ipkg.Licenses
 
 	latest := ipkg.History[0]
 	pkg.Release = latest.Release
 	pkg.Version = latest.Version
 
+	for _, update := range ipkg.History {
+		pkg.History = append(pkg.History, Update{
+			Release: update.Release,
+			Version: update.Version,
+			Date:    update.Date,
+			Type:    update.Type,
+			Comment: strings.TrimSpace(update.Comment.Value),
+		})
+	}
+
 	return
 }
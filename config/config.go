@@ -13,6 +13,16 @@ import (
 type AutobuildConfig struct {
 	Ignore bool         `yaml:"ignore"`
 	Solver SolverConfig `yaml:"solver"`
+	// OSV names the package in the vulnerability database of osv.dev, for
+	// packages whose name there can't be guessed.
+	OSV *OSVConfig `yaml:"osv"`
+}
+
+// OSVConfig is a package in an ecosystem of osv.dev, e.g. PyPI, or GIT with the
+// URL of the repository as the name.
+type OSVConfig struct {
+	Ecosystem string `yaml:"ecosystem"`
+	Name      string `yaml:"name"`
 }
 
 func Load(path string) (cfg AutobuildConfig, err error) {
@@ -0,0 +1,182 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const keyringService = "autobuild"
+
+// Credentials maps the name of a push backend to its API token.
+type Credentials map[string]string
+
+// CredentialsPath returns the path to the file that API tokens are stored in
+// when no keyring is available, usually `~/.config/autobuild/credentials.yaml`.
+func CredentialsPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "autobuild", "credentials.yaml"), nil
+}
+
+// LoadCredentials loads the credentials file. A missing file results in no
+// credentials.
+func LoadCredentials() (creds Credentials, err error) {
+	creds = make(Credentials)
+
+	path, err := CredentialsPath()
+	if err != nil {
+		return
+	}
+
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		err = nil
+		return
+	} else if err != nil {
+		return
+	}
+
+	if err = yaml.Unmarshal(raw, &creds); err != nil {
+		err = fmt.Errorf("config.LoadCredentials: failed to parse %s: %w", path, err)
+	}
+	if creds == nil {
+		creds = make(Credentials)
+	}
+	return
+}
+
+// Save writes the credentials file, readable only by the current user.
+func (c Credentials) Save() error {
+	path, err := CredentialsPath()
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("config.Credentials.Save: %w", err)
+	}
+
+	raw, err := yaml.Marshal(c)
+	if err != nil {
+		return err
+	}
+	if err = os.WriteFile(path, raw, 0600); err != nil {
+		return fmt.Errorf("config.Credentials.Save: failed to write %s: %w", path, err)
+	}
+	// WriteFile doesn't change the mode of an existing file.
+	return os.Chmod(path, 0600)
+}
+
+// TokenEnv returns the environment variable that overrides the API token of
+// `backend`, e.g. `AUTOBUILD_SUMMIT_TOKEN`.
+func TokenEnv(backend string) string {
+	return fmt.Sprintf("AUTOBUILD_%s_TOKEN", strings.ToUpper(backend))
+}
+
+// selectedBackend is the backend that TokenAnyEnv belongs to, see
+// SelectBackend.
+var selectedBackend string
+
+// SelectBackend makes TokenAnyEnv the API token of `backend`, the single
+// backend that a command talks to, whether a flag, BackendEnv or the
+// configuration file picked it. Until then, TokenAnyEnv belongs to the backend
+// that BackendEnv selects.
+func SelectBackend(backend string) {
+	selectedBackend = backend
+}
+
+// TokenEnvs returns the environment variables that hold the API token of
+// `backend`, in order: TokenEnv, and TokenAnyEnv if `backend` is the selected
+// one, see SelectBackend, so that a token meant for one build server is never
+// sent to the others, such as those of targets.
+func TokenEnvs(backend string) []string {
+	envs := []string{TokenEnv(backend)}
+	selected := selectedBackend
+	if selected == "" {
+		selected = os.Getenv(BackendEnv)
+	}
+	if backend == selected {
+		envs = append(envs, TokenAnyEnv)
+	}
+	return envs
+}
+
+// LookupToken returns the API token of `backend`, and where it was found.
+// The environment, see TokenEnvs, takes precedence over the OS keyring, which
+// takes precedence over the credentials file. An empty token means that none
+// was found.
+func LookupToken(backend string) (token string, source string, err error) {
+	for _, env := range TokenEnvs(backend) {
+		if token = os.Getenv(env); token != "" {
+			return token, env, nil
+		}
+	}
+
+	if token, err = keyringLookup(backend); err == nil && token != "" {
+		return token, "keyring", nil
+	}
+
+	creds, err := LoadCredentials()
+	if err != nil {
+		return "", "", err
+	}
+	if token = creds[backend]; token != "" {
+		source, _ = CredentialsPath()
+	}
+	return
+}
+
+// StoreToken stores the API token of `backend` in the OS keyring, or in the
+// credentials file if `useKeyring` is false or no keyring is available. It
+// returns where the token was stored.
+func StoreToken(backend string, token string, useKeyring bool) (string, error) {
+	if useKeyring {
+		if err := keyringStore(backend, token); err == nil {
+			return "keyring", nil
+		}
+	}
+
+	creds, err := LoadCredentials()
+	if err != nil {
+		return "", err
+	}
+	creds[backend] = token
+	if err = creds.Save(); err != nil {
+		return "", err
+	}
+	return CredentialsPath()
+}
+
+// The keyring is accessed through `secret-tool` from libsecret, which works
+// with any keyring implementing the freedesktop.org Secret Service API (e.g.
+// GNOME Keyring and KWallet).
+
+func keyringLookup(backend string) (string, error) {
+	cmd := exec.Command("secret-tool", "lookup", "service", keyringService, "backend", backend)
+	output, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+func keyringStore(backend string, token string) error {
+	cmd := exec.Command("secret-tool", "store", "--label", fmt.Sprintf("autobuild %s token", backend), "service", keyringService, "backend", backend)
+	cmd.Stdin = bytes.NewBufferString(token)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("config.keyringStore: %w: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
@@ -0,0 +1,36 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTokenEnvs(t *testing.T) {
+	defer SelectBackend("")
+	tests := []struct {
+		env      string
+		selected string
+		backend  string
+		want     []string
+	}{
+		{"", "", "summit", []string{"AUTOBUILD_SUMMIT_TOKEN"}},
+		{"summit", "", "summit", []string{"AUTOBUILD_SUMMIT_TOKEN", "AUTOBUILD_TOKEN"}},
+		{"summit", "", "webhook", []string{"AUTOBUILD_WEBHOOK_TOKEN"}},
+		{"github", "", "gitlab", []string{"AUTOBUILD_GITLAB_TOKEN"}},
+		// The backend of --backend or of the configuration file.
+		{"", "summit", "summit", []string{"AUTOBUILD_SUMMIT_TOKEN", "AUTOBUILD_TOKEN"}},
+		{"webhook", "summit", "summit", []string{"AUTOBUILD_SUMMIT_TOKEN", "AUTOBUILD_TOKEN"}},
+		{"webhook", "summit", "webhook", []string{"AUTOBUILD_WEBHOOK_TOKEN"}},
+	}
+	for _, tt := range tests {
+		t.Setenv(BackendEnv, tt.env)
+		SelectBackend(tt.selected)
+		if got := TokenEnvs(tt.backend); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("TokenEnvs(%s) with $%s=%s and %s selected = %q, want %q", tt.backend, BackendEnv, tt.env, tt.selected, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The environment variables that configure autobuild, for CI jobs that have
+// neither configuration files nor command lines to keep secrets out of. They
+// take precedence over the configuration files, but not over flags.
+const (
+	// ConfigEnv is the path to the configuration file, see UserConfigPath.
+	ConfigEnv = "AUTOBUILD_CONFIG"
+	// CacheDirEnv is the directory of cached data, see CacheDir.
+	CacheDirEnv = "AUTOBUILD_CACHE_DIR"
+	// ProfileEnv selects a profile, like --profile.
+	ProfileEnv = "AUTOBUILD_PROFILE"
+	// BackendEnv overrides push.backend.
+	BackendEnv = "AUTOBUILD_BACKEND"
+	// ServerEnv overrides the build server of the backend, see WithServer.
+	ServerEnv = "AUTOBUILD_SERVER"
+	// TokenAnyEnv is the API token of the backend that BackendEnv selects,
+	// when its own variable isn't set, see TokenEnvs.
+	TokenAnyEnv = "AUTOBUILD_TOKEN"
+	// JobsEnv is the default of --submit-concurrency.
+	JobsEnv = "AUTOBUILD_JOBS"
+)
+
+// CacheDir returns the directory that autobuild caches data in, usually
+// `~/.cache/autobuild`.
+func CacheDir() (string, error) {
+	if dir := os.Getenv(CacheDirEnv); dir != "" {
+		return dir, nil
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "autobuild"), nil
+}
+
+// WithServer returns `cfg` with the build server of `backend` set to `server`:
+// the URL of summit and webhook, the [user@]host of solus, the repository
+// of local builds, and the repository that runs the builds of github and
+// gitlab. An empty `server` changes nothing.
+func (cfg PushConfig) WithServer(backend string, server string) PushConfig {
+	if server == "" {
+		return cfg
+	}
+	switch backend {
+	case "solus":
+		if user, host, ok := strings.Cut(server, "@"); ok {
+			cfg.Solus.User, cfg.Solus.Host = user, host
+		} else {
+			cfg.Solus.Host = server
+		}
+	case "summit":
+		cfg.Summit.URL = server
+	case "webhook":
+		cfg.Webhook.URL = server
+	case "local":
+		cfg.Local.Repo = server
+	case "github":
+		cfg.GitHub.Repository = server
+	case "gitlab":
+		cfg.GitLab.Repository = server
+	}
+	return cfg
+}
@@ -0,0 +1,507 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+)
+
+// UserConfig is the configuration of autobuild itself, as opposed to the
+// configuration of a package in AutobuildConfig.
+type UserConfig struct {
+	Defaults DefaultsConfig `yaml:"defaults"`
+	Push     PushConfig     `yaml:"push"`
+	// Profiles are named repositories, for selecting their states and build
+	// server at once with `--profile`.
+	Profiles []ProfileConfig `yaml:"profiles"`
+	// Messages reword the user-facing messages, by ID, with Go templates.
+	Messages map[string]string `yaml:"messages"`
+	// Locales translate the messages, by locale and ID, like Messages.
+	Locales map[string]map[string]string `yaml:"locales"`
+	// Locale is the locale whose translations are used, instead of the one
+	// of the environment.
+	Locale     string           `yaml:"locale"`
+	SelfUpdate SelfUpdateConfig `yaml:"self-update"`
+	IndexCache IndexCacheConfig `yaml:"index-cache"`
+}
+
+// DefaultIndexCacheSize is the size in MiB of the cache of parsed indexes
+// when the configuration sets none.
+const DefaultIndexCacheSize = 512
+
+// IndexCacheConfig configures the cache of parsed eopkg indexes, which lets
+// commands comparing against an index that didn't change skip parsing it.
+type IndexCacheConfig struct {
+	// Dir is the directory of the cache, by default indexes in CacheDir.
+	Dir string `yaml:"dir"`
+	// MaxSize is the size in MiB that the cache is kept under, by dropping
+	// the indexes used the least recently. 0 means DefaultIndexCacheSize,
+	// and a negative size disables the cache.
+	MaxSize int `yaml:"max-size"`
+}
+
+// SelfUpdateConfig configures where `self-update` finds releases of autobuild.
+type SelfUpdateConfig struct {
+	// Channel is the default of --channel, stable or edge.
+	Channel string `yaml:"channel"`
+	// Feed is the URL of the releases, in the format of the GitHub API, for
+	// mirrors and forks.
+	Feed string `yaml:"feed"`
+	// AllowedSigners is the file of the SSH keys that may sign releases, in
+	// the format of ssh-keygen. Signatures aren't checked without it.
+	AllowedSigners string `yaml:"allowed-signers"`
+}
+
+// DefaultsConfig holds the defaults of the command line. Flags given on the
+// command line always take precedence.
+type DefaultsConfig struct {
+	// Old and New are the states that push, plan, diff and tui compare when
+	// none are given.
+	Old string `yaml:"old"`
+	New string `yaml:"new"`
+	// Force and DryRun are the defaults of --force and --dry-run of push,
+	// and Force that of plan and tui as well.
+	Force  *bool `yaml:"force"`
+	DryRun *bool `yaml:"dry-run"`
+	// Exclude and IgnoreFile are the defaults of --exclude and --ignore-file
+	// of the commands comparing states.
+	Exclude    []string `yaml:"exclude"`
+	IgnoreFile string   `yaml:"ignore-file"`
+}
+
+type PushConfig struct {
+	// Backend is the name of the build server backend to publish to.
+	Backend string            `yaml:"backend"`
+	Solus   SolusConfig       `yaml:"solus"`
+	Summit  HTTPBackendConfig `yaml:"summit"`
+	Webhook HTTPBackendConfig `yaml:"webhook"`
+	Local   LocalConfig       `yaml:"local"`
+	GitHub  CIConfig          `yaml:"github"`
+	GitLab  CIConfig          `yaml:"gitlab"`
+	Retry   RetryConfig       `yaml:"retry"`
+	Hooks   HooksConfig       `yaml:"hooks"`
+	// Arch is the architecture that packages are built for, sent to the build
+	// server along with every job. By default, the build server decides.
+	Arch string `yaml:"arch"`
+	// SigningKey is the SSH key that `push --sign` signs provenances with.
+	SigningKey string `yaml:"signing-key"`
+	// Targets are named build servers, for publishing to several of them at
+	// once with `push --target`.
+	Targets []TargetConfig `yaml:"targets"`
+	// Notify are the chat rooms that pushes are summarized in.
+	Notify []NotifyConfig `yaml:"notify"`
+}
+
+// NotifyConfig is a chat room that pushes post summaries and failures to.
+// Failing to post only warns, unlike hooks.
+type NotifyConfig struct {
+	// Kind is slack, matrix or irc.
+	Kind string `yaml:"kind"`
+	// URL is the incoming webhook of Slack, the homeserver of Matrix, or the
+	// IRC server as irc://host:port, or ircs://host:port over TLS.
+	URL string `yaml:"url"`
+	// Room is the ID of the Matrix room, or the IRC channel.
+	Room string `yaml:"room"`
+	// Nick is the nickname on IRC, autobuild by default.
+	Nick string `yaml:"nick"`
+	// TokenEnv names the environment variable holding the access token of
+	// Matrix, AUTOBUILD_MATRIX_TOKEN by default.
+	TokenEnv string `yaml:"token-env"`
+	// Events are what to post about, of push, batch and failure. By default,
+	// the summary of every push and every failure are posted.
+	Events []string `yaml:"events"`
+}
+
+// HooksConfig lists the hooks to run around publishing. Hooks receive a JSON
+// payload describing the event, and a failing hook stops the push.
+type HooksConfig struct {
+	// PrePublish hooks run before every package is published, and can
+	// prevent it from being published by failing.
+	PrePublish  []HookConfig `yaml:"pre-publish"`
+	PostPublish []HookConfig `yaml:"post-publish"`
+	// BatchStart and BatchEnd hooks run before the first package of a push is
+	// published, and once the push is done.
+	BatchStart []HookConfig `yaml:"batch-start"`
+	BatchEnd   []HookConfig `yaml:"batch-end"`
+	// WaveEnd hooks run in wait mode once all the packages of a wave are
+	// built, before the next wave is published, e.g. to have the repository
+	// manager re-index the repository.
+	WaveEnd []HookConfig `yaml:"wave-end"`
+}
+
+// HookConfig is either a shell command, which receives the payload on stdin,
+// or an URL that the payload is POSTed to.
+type HookConfig struct {
+	Command string            `yaml:"command"`
+	URL     string            `yaml:"url"`
+	Headers map[string]string `yaml:"headers"`
+}
+
+// TargetConfig configures the backend of one of several build servers to
+// publish to.
+type TargetConfig struct {
+	Name    string            `yaml:"name"`
+	Backend string            `yaml:"backend"`
+	Solus   SolusConfig       `yaml:"solus"`
+	Summit  HTTPBackendConfig `yaml:"summit"`
+	Webhook HTTPBackendConfig `yaml:"webhook"`
+	Local   LocalConfig       `yaml:"local"`
+	GitHub  CIConfig          `yaml:"github"`
+	GitLab  CIConfig          `yaml:"gitlab"`
+}
+
+// PushConfig returns `push` with the backend of the target.
+func (t TargetConfig) PushConfig(push PushConfig) PushConfig {
+	push.Backend = t.Backend
+	push.Solus, push.Summit, push.Webhook, push.Local = t.Solus, t.Summit, t.Webhook, t.Local
+	push.GitHub, push.GitLab = t.GitHub, t.GitLab
+	push.Targets = nil
+	return push
+}
+
+// ProfileConfig bundles the states and the build server of a repository.
+type ProfileConfig struct {
+	// Source is the TPath of the recipes, or their path. Index is the TPath
+	// of the binary repository they are compared to, or the name or URL of
+	// its index.
+	Source string `yaml:"source"`
+	Index  string `yaml:"index"`
+	Arch   string `yaml:"arch"`
+	// Notify, if set, replaces the chat rooms of `push`.
+	Notify []NotifyConfig `yaml:"notify"`
+	// TargetConfig names the profile and configures its build server. An
+	// unset backend keeps the build server of `push`.
+	TargetConfig `yaml:",inline"`
+}
+
+// WithProfile returns the configuration with the states and the build server
+// of the profile `name`.
+func (cfg UserConfig) WithProfile(name string) (UserConfig, error) {
+	idx := slices.IndexFunc(cfg.Profiles, func(p ProfileConfig) bool { return p.Name == name })
+	if idx < 0 {
+		return cfg, fmt.Errorf("config.UserConfig.WithProfile: unknown profile %s", name)
+	}
+	profile := cfg.Profiles[idx]
+
+	if profile.Source != "" {
+		cfg.Defaults.New = profileTPath(profile.Source, "src")
+	}
+	if profile.Index != "" {
+		cfg.Defaults.Old = profileTPath(profile.Index, "repo")
+	}
+	if profile.Backend != "" {
+		cfg.Push = profile.TargetConfig.PushConfig(cfg.Push)
+	}
+	if profile.Arch != "" {
+		cfg.Push.Arch = profile.Arch
+	}
+	if profile.Notify != nil {
+		cfg.Push.Notify = profile.Notify
+	}
+	return cfg, nil
+}
+
+// profileTPath returns `value` if it is a TPath, or else the TPath of the given
+// kind to it.
+func profileTPath(value string, kind string) string {
+	prefix, _, _ := strings.Cut(value, ":")
+	if slices.Contains([]string{"src", "bin", "repo"}, prefix) {
+		return value
+	}
+	return kind + ":" + value
+}
+
+// RetryConfig overrides how transient errors are retried. Unset values keep
+// the defaults.
+type RetryConfig struct {
+	// Retries is the number of retries after the first attempt.
+	Retries    *int          `yaml:"retries"`
+	Backoff    time.Duration `yaml:"backoff"`
+	MaxBackoff time.Duration `yaml:"max-backoff"`
+}
+
+type SolusConfig struct {
+	User string `yaml:"user"`
+	Host string `yaml:"host"`
+	// Identity is the SSH private key to authenticate with, overridden by
+	// the `AUTOBUILD_SSHKEY` environment variable. By default, ssh picks the
+	// key itself.
+	Identity string `yaml:"identity"`
+}
+
+type HTTPBackendConfig struct {
+	URL     string            `yaml:"url"`
+	Headers map[string]string `yaml:"headers"`
+}
+
+// CIConfig configures the github and gitlab backends, which build every
+// package in a run of a workflow of GitHub Actions, or in a pipeline of GitLab
+// CI.
+type CIConfig struct {
+	// URL is the API, https://api.github.com or https://gitlab.com by
+	// default.
+	URL string `yaml:"url"`
+	// Repository runs the builds, as owner/name on GitHub, or the path of
+	// the project on GitLab.
+	Repository string `yaml:"repository"`
+	// Workflow is the file name of the workflow that GitHub dispatches,
+	// build.yml by default.
+	Workflow string `yaml:"workflow"`
+	// Ref is the branch that runs the workflow or the pipeline, main by
+	// default.
+	Ref     string            `yaml:"ref"`
+	Headers map[string]string `yaml:"headers"`
+}
+
+type LocalConfig struct {
+	// Repo is the directory that built packages are collected and indexed in.
+	// The solbuild and boulder profiles must use it as a local repository.
+	Repo string `yaml:"repo"`
+	// Logs is the directory that build logs are written to.
+	Logs            string `yaml:"logs"`
+	SolbuildProfile string `yaml:"solbuild-profile"`
+	BoulderProfile  string `yaml:"boulder-profile"`
+}
+
+// UserConfigPath returns the path to the configuration file of autobuild,
+// $AUTOBUILD_CONFIG if set, or else usually `~/.config/autobuild/config.yaml`.
+func UserConfigPath() (string, error) {
+	if path := os.Getenv(ConfigEnv); path != "" {
+		return path, nil
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "autobuild", "config.yaml"), nil
+}
+
+// RepoConfigName is the name of the configuration file of a repository of
+// recipes, which overrides the configuration file of autobuild.
+const RepoConfigName = ".autobuild.yaml"
+
+// RepoConfigPath returns the path to the configuration file of the repository
+// that the working directory is in, looked up in the working directory and its
+// parents up to the root of the git tree. It returns an empty string if there
+// is none.
+func RepoConfigPath() string {
+	dir, err := os.Getwd()
+	if err != nil {
+		return ""
+	}
+	for {
+		path := filepath.Join(dir, RepoConfigName)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+		if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+			return ""
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// LoadUser loads the configuration file of autobuild, and the one of the
+// repository on top of it, see RepoConfigPath, and then the environment, see
+// BackendEnv. Missing files are not an error, and result in the default
+// configuration.
+//
+// Recipes are seldom trusted as much as the machine they are built on, so the
+// repository only gets to set what RepoConfig holds.
+func LoadUser() (cfg UserConfig, err error) {
+	path, err := UserConfigPath()
+	if err != nil {
+		return
+	}
+	// The repository can't set the backend, so the environment may as well
+	// override it along with the file.
+	v := newViper()
+	v.BindEnv("push::backend", BackendEnv)
+	if err = decodeFile(v, path, &cfg); err != nil {
+		return
+	}
+
+	if repoPath := RepoConfigPath(); repoPath != "" {
+		var repo RepoConfig
+		if err = decodeFile(newViper(), repoPath, &repo); err != nil {
+			return cfg, fmt.Errorf("config.LoadUser: failed to parse %s: %w", repoPath, err)
+		}
+		cfg.mergeRepo(repo)
+	}
+	return
+}
+
+// RepoConfig is what the configuration file of a repository of recipes can
+// set, see RepoConfigPath: the defaults of the command line, the states of the
+// profiles and the wording and translations of the messages. Everything else
+// is ignored, since
+// the repository could otherwise run any command on push, hand the tokens of
+// the environment to any server, or delete files.
+type RepoConfig struct {
+	Defaults DefaultsConfig               `yaml:"defaults"`
+	Profiles []RepoProfileConfig          `yaml:"profiles"`
+	Messages map[string]string            `yaml:"messages"`
+	Locales  map[string]map[string]string `yaml:"locales"`
+}
+
+// RepoProfileConfig is what a repository can set of a profile, its states.
+// The build server of a profile is only set by the configuration file of
+// autobuild.
+type RepoProfileConfig struct {
+	Name   string `yaml:"name"`
+	Source string `yaml:"source"`
+	Index  string `yaml:"index"`
+}
+
+// RepoProtectedMessages are the messages that a repository can't reword, as
+// they tell where packages are about to be published.
+var RepoProtectedMessages = []string{"push.confirm"}
+
+// repoKeys are the keys of RepoConfig, and repoProfileKeys those of
+// RepoProfileConfig, see RepoIgnoredKeys.
+var (
+	repoKeys        = []string{"defaults", "profiles", "messages", "locales"}
+	repoProfileKeys = []string{"name", "source", "index"}
+)
+
+// mergeRepo overrides `cfg` with the values that `repo` sets. Profiles are
+// matched by name, and those that `cfg` doesn't have are added without a
+// build server.
+func (cfg *UserConfig) mergeRepo(repo RepoConfig) {
+	defaults := repo.Defaults
+	if defaults.Old != "" {
+		cfg.Defaults.Old = defaults.Old
+	}
+	if defaults.New != "" {
+		cfg.Defaults.New = defaults.New
+	}
+	if defaults.Force != nil {
+		cfg.Defaults.Force = defaults.Force
+	}
+	if defaults.DryRun != nil {
+		cfg.Defaults.DryRun = defaults.DryRun
+	}
+	if defaults.Exclude != nil {
+		cfg.Defaults.Exclude = defaults.Exclude
+	}
+	if defaults.IgnoreFile != "" {
+		cfg.Defaults.IgnoreFile = defaults.IgnoreFile
+	}
+
+	for _, profile := range repo.Profiles {
+		idx := slices.IndexFunc(cfg.Profiles, func(p ProfileConfig) bool { return p.Name == profile.Name })
+		if idx < 0 {
+			cfg.Profiles = append(cfg.Profiles, ProfileConfig{TargetConfig: TargetConfig{Name: profile.Name}})
+			idx = len(cfg.Profiles) - 1
+		}
+		if profile.Source != "" {
+			cfg.Profiles[idx].Source = profile.Source
+		}
+		if profile.Index != "" {
+			cfg.Profiles[idx].Index = profile.Index
+		}
+	}
+
+	cfg.Messages = mergeMessages(cfg.Messages, repo.Messages)
+	for locale, messages := range repo.Locales {
+		if cfg.Locales == nil {
+			cfg.Locales = make(map[string]map[string]string, len(repo.Locales))
+		}
+		cfg.Locales[locale] = mergeMessages(cfg.Locales[locale], messages)
+	}
+}
+
+// mergeMessages returns `messages` overridden by the messages of a repository,
+// `repo`, except for RepoProtectedMessages.
+func mergeMessages(messages map[string]string, repo map[string]string) map[string]string {
+	for id, text := range repo {
+		if slices.Contains(RepoProtectedMessages, id) {
+			continue
+		}
+		if messages == nil {
+			messages = make(map[string]string, len(repo))
+		}
+		messages[id] = text
+	}
+	return messages
+}
+
+// RepoIgnoredKeys returns the keys of the configuration file of a repository,
+// `raw`, that LoadUser ignores, since RepoConfig doesn't hold them.
+func RepoIgnoredKeys(raw []byte) (keys []string, err error) {
+	var doc map[string]yaml.Node
+	if err = yaml.Unmarshal(raw, &doc); err != nil {
+		return nil, fmt.Errorf("config.RepoIgnoredKeys: %w", err)
+	}
+	for key, value := range doc {
+		if !slices.Contains(repoKeys, key) {
+			keys = append(keys, key)
+			continue
+		}
+		if key != "profiles" || value.Kind != yaml.SequenceNode {
+			continue
+		}
+		for idx, profile := range value.Content {
+			for i := 0; profile.Kind == yaml.MappingNode && i+1 < len(profile.Content); i += 2 {
+				if name := profile.Content[i].Value; !slices.Contains(repoProfileKeys, name) {
+					keys = append(keys, fmt.Sprintf("profiles[%d].%s", idx, name))
+				}
+			}
+		}
+	}
+	protected := func(prefix string, messages yaml.Node) {
+		for i := 0; messages.Kind == yaml.MappingNode && i+1 < len(messages.Content); i += 2 {
+			if id := messages.Content[i].Value; slices.Contains(RepoProtectedMessages, id) {
+				keys = append(keys, prefix+id)
+			}
+		}
+	}
+	protected("messages.", doc["messages"])
+	if locales := doc["locales"]; locales.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(locales.Content); i += 2 {
+			protected("locales."+locales.Content[i].Value+".", *locales.Content[i+1])
+		}
+	}
+	slices.Sort(keys)
+	return
+}
+
+// newViper returns the viper instance that loads a configuration file. Keys
+// are only split at ::, since the IDs of messages contain dots.
+func newViper() *viper.Viper {
+	v := viper.NewWithOptions(viper.KeyDelimiter("::"))
+	v.SetConfigType("yaml")
+	return v
+}
+
+// decodeFile decodes the YAML file at `path` into `cfg` with `v`, keeping the
+// values that neither the file nor the environment bound to `v` set. A missing
+// or empty file is not an error. Viper lowercases the keys of maps, so the
+// headers and locales that they name are matched case-insensitively.
+func decodeFile(v *viper.Viper, path string, cfg any) error {
+	v.SetConfigFile(path)
+	if err := v.ReadInConfig(); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return v.Unmarshal(cfg, func(dc *mapstructure.DecoderConfig) {
+		dc.TagName = "yaml"
+		// Embedded structs are inlined, like ,inline does for yaml.
+		dc.Squash = true
+	})
+}
@@ -0,0 +1,247 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// loadUserIn runs LoadUser in a git tree whose configuration file is `user`,
+// and whose repository's `.autobuild.yaml` is `repo`.
+func loadUserIn(t *testing.T, user string, repo string) UserConfig {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, ".git"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	userPath := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(userPath, []byte(user), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, RepoConfigName), []byte(repo), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(ConfigEnv, userPath)
+	t.Setenv(BackendEnv, "")
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	cfg, err := LoadUser()
+	if err != nil {
+		t.Fatalf("LoadUser: %s", err)
+	}
+	return cfg
+}
+
+const testUserConfig = `
+defaults:
+  old: repo:unstable
+  new: src:.
+  exclude: [haskell-*]
+push:
+  backend: summit
+  summit:
+    url: https://summit.example.com
+  webhook:
+    url: https://hooks.example.com
+  solus:
+    host: build.example.com
+  github:
+    repository: example/recipes
+  hooks:
+    pre-publish:
+      - command: "true"
+  targets:
+    - name: mirror
+      backend: webhook
+      webhook:
+        url: https://mirror.example.com
+profiles:
+  - name: volatile
+    source: ../recipes
+    index: volatile
+    backend: summit
+    summit:
+      url: https://volatile.example.com
+index-cache:
+  dir: /var/cache/autobuild
+messages:
+  push.updated: "Updating:"
+`
+
+func TestLoadUserRepoCannotChangeServers(t *testing.T) {
+	repo := `
+push:
+  backend: webhook
+  summit:
+    url: https://evil.example.com
+  webhook:
+    url: https://evil.example.com
+  solus:
+    host: evil.example.com
+  github:
+    url: https://evil.example.com
+    repository: evil/recipes
+  gitlab:
+    url: https://evil.example.com
+    repository: evil/recipes
+  hooks:
+    pre-publish:
+      - command: rm -rf /
+  targets:
+    - name: evil
+      backend: summit
+      summit:
+        url: https://evil.example.com
+profiles:
+  - name: volatile
+    backend: webhook
+    webhook:
+      url: https://evil.example.com
+  - name: evil
+    backend: summit
+    summit:
+      url: https://evil.example.com
+index-cache:
+  dir: /home
+self-update:
+  feed: https://evil.example.com
+messages:
+  push.confirm: "Continue? "
+locale: fr
+`
+	cfg := loadUserIn(t, testUserConfig, repo)
+	want := loadUserIn(t, testUserConfig, "")
+	// The profile that the user file doesn't have is added, without its
+	// build server.
+	want.Profiles = append(want.Profiles, ProfileConfig{TargetConfig: TargetConfig{Name: "evil"}})
+	if !reflect.DeepEqual(cfg, want) {
+		t.Errorf("LoadUser() = %+v, want %+v", cfg, want)
+	}
+}
+
+func TestLoadUserRepoMerge(t *testing.T) {
+	force := true
+	tests := []struct {
+		name  string
+		repo  string
+		check func(cfg UserConfig) bool
+	}{
+		{
+			name:  "no repository file",
+			repo:  "",
+			check: func(cfg UserConfig) bool { return cfg.Defaults.Old == "repo:unstable" && cfg.Defaults.New == "src:." },
+		},
+		{
+			name: "defaults",
+			repo: "defaults: {old: repo:stable, force: true, ignore-file: .ignore}",
+			check: func(cfg UserConfig) bool {
+				d := cfg.Defaults
+				return d.Old == "repo:stable" && d.New == "src:." && reflect.DeepEqual(d.Force, &force) && d.IgnoreFile == ".ignore"
+			},
+		},
+		{
+			name:  "exclude replaces",
+			repo:  "defaults: {exclude: [rust-*]}",
+			check: func(cfg UserConfig) bool { return reflect.DeepEqual(cfg.Defaults.Exclude, []string{"rust-*"}) },
+		},
+		{
+			name: "profile states keep the build server",
+			repo: "profiles: [{name: volatile, index: https://example.com/eopkg-index.xml.xz}]",
+			check: func(cfg UserConfig) bool {
+				p := cfg.Profiles[0]
+				return len(cfg.Profiles) == 1 && p.Source == "../recipes" && p.Index == "https://example.com/eopkg-index.xml.xz" && p.Summit.URL == "https://volatile.example.com"
+			},
+		},
+		{
+			name: "messages",
+			repo: `messages: {push.nothing: "Nothing to do", push.confirm: "Continue? "}`,
+			check: func(cfg UserConfig) bool {
+				return cfg.Messages["push.nothing"] == "Nothing to do" && cfg.Messages["push.updated"] == "Updating:" && cfg.Messages["push.confirm"] == ""
+			},
+		},
+		{
+			name: "locales",
+			repo: `locales: {de: {push.nothing: "Nichts zu tun", push.confirm: "Weiter? "}}`,
+			check: func(cfg UserConfig) bool {
+				de := cfg.Locales["de"]
+				return len(de) == 1 && de["push.nothing"] == "Nichts zu tun" && cfg.Messages["push.nothing"] == ""
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if cfg := loadUserIn(t, testUserConfig, tt.repo); !tt.check(cfg) {
+				t.Errorf("LoadUser() = %+v", cfg)
+			}
+		})
+	}
+}
+
+func TestRepoIgnoredKeys(t *testing.T) {
+	tests := []struct {
+		repo string
+		want []string
+	}{
+		{"", nil},
+		{"defaults: {old: repo:unstable}\nmessages: {push.nothing: Done}", nil},
+		{"push: {backend: summit}\nindex-cache: {dir: /tmp}", []string{"index-cache", "push"}},
+		{"profiles: [{name: a, source: .}, {name: b, backend: summit}]", []string{"profiles[1].backend"}},
+		{"messages: {push.confirm: Continue}", []string{"messages.push.confirm"}},
+		{"locales: {de: {push.nothing: Fertig, push.confirm: Weiter}}", []string{"locales.de.push.confirm"}},
+	}
+	for _, tt := range tests {
+		got, err := RepoIgnoredKeys([]byte(tt.repo))
+		if err != nil {
+			t.Errorf("RepoIgnoredKeys(%q): %s", tt.repo, err)
+		} else if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("RepoIgnoredKeys(%q) = %q, want %q", tt.repo, got, tt.want)
+		}
+	}
+}
+
+func TestLoadUserValues(t *testing.T) {
+	user := testUserConfig + `
+locales:
+  de_AT: {push.nothing: "Nichts zu tun"}
+`
+	user = strings.Replace(user, "push:\n", "push:\n  retry: {retries: 2, backoff: 3s}\n", 1)
+	cfg := loadUserIn(t, user, "")
+	retries := 2
+	tests := []struct {
+		name string
+		got  any
+		want any
+	}{
+		{"durations", cfg.Push.Retry, RetryConfig{Retries: &retries, Backoff: 3 * time.Second}},
+		{"messages with dots", cfg.Messages, map[string]string{"push.updated": "Updating:"}},
+		{"lowercased locales", cfg.Locales, map[string]map[string]string{"de_at": {"push.nothing": "Nichts zu tun"}}},
+		{"inline build servers", cfg.Profiles[0].Summit.URL, "https://volatile.example.com"},
+		{"slices", cfg.Defaults.Exclude, []string{"haskell-*"}},
+		{"hooks", cfg.Push.Hooks.PrePublish, []HookConfig{{Command: "true"}}},
+	}
+	for _, tt := range tests {
+		if !reflect.DeepEqual(tt.got, tt.want) {
+			t.Errorf("LoadUser() %s = %+v, want %+v", tt.name, tt.got, tt.want)
+		}
+	}
+
+	t.Setenv(BackendEnv, "webhook")
+	if cfg, err := LoadUser(); err != nil || cfg.Push.Backend != "webhook" {
+		t.Errorf("LoadUser() with $%s = %q, %v, want webhook", BackendEnv, cfg.Push.Backend, err)
+	}
+}
@@ -0,0 +1,76 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package synthetic
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The options of the repository of Fixture, which benchmarks take after -args,
+// e.g. go test -bench . ./state -args -synthetic.packages 20000.
+var (
+	packagesFlag = flag.Int("synthetic.packages", 5000, "number of source packages of the synthetic repository")
+	densityFlag  = flag.Float64("synthetic.density", 4, "average number of build dependencies of a synthetic package")
+	changedFlag  = flag.Float64("synthetic.changed", 0.05, "fraction of the synthetic packages that the new side bumps")
+	seedFlag     = flag.Int64("synthetic.seed", 1, "seed of the synthetic repository")
+)
+
+// fixtureDone marks the fixtures that were generated in full.
+const fixtureDone = ".done"
+
+// Fixture returns the directory of the repository that the flags describe,
+// under the testdata directory of the package being tested, generating it
+// with WriteFixture the first time. Fixtures are kept, so that later runs
+// compare on the same repository without generating it again.
+func Fixture(tb testing.TB) string {
+	tb.Helper()
+	opts := Options{Packages: *packagesFlag, Density: *densityFlag, Changed: *changedFlag, Seed: *seedFlag}
+	dir := filepath.Join("testdata", fmt.Sprintf("synthetic-%d-%g-%g-%d", opts.Packages, opts.Density, opts.Changed, opts.Seed))
+	if _, err := os.Stat(filepath.Join(dir, fixtureDone)); err == nil {
+		return dir
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		tb.Fatal(err)
+	}
+	err := Generate(opts).WriteFixture(dir)
+	if err == nil {
+		err = os.WriteFile(filepath.Join(dir, fixtureDone), nil, 0o644)
+	}
+	if err != nil {
+		tb.Fatalf("failed to generate the synthetic repository in %s: %s", dir, err)
+	}
+	return dir
+}
+
+// WriteFixture writes both sides of the repository to `dir`: the source trees
+// old/src and new/src, the indexes old/eopkg-index.xml and
+// new/eopkg-index.xml along with their .xz, and their packages in
+// old/packages and new/packages.
+func (repo *Repo) WriteFixture(dir string) error {
+	for _, side := range []struct {
+		name string
+		side Side
+	}{{"old", Old}, {"new", New}} {
+		sideDir := filepath.Join(dir, side.name)
+		err := repo.WriteSource(filepath.Join(sideDir, "src"), side.side)
+		for _, index := range []string{"eopkg-index.xml", "eopkg-index.xml.xz"} {
+			if err == nil {
+				err = repo.WriteIndex(filepath.Join(sideDir, index), side.side)
+			}
+		}
+		if err == nil {
+			err = repo.WritePackages(filepath.Join(sideDir, "packages"), side.side)
+		}
+		if err != nil {
+			return fmt.Errorf("synthetic.Repo.WriteFixture: failed to write the %s side: %w", side.name, err)
+		}
+	}
+	return nil
+}
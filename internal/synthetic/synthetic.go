@@ -0,0 +1,381 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+// Package synthetic generates repositories of made-up packages, as source
+// trees and eopkg indexes, of any size and density of dependencies, to
+// measure autobuild on repositories as large as the real ones without having
+// them at hand.
+package synthetic
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/getsolus/libeopkg/archive"
+	"github.com/getsolus/libeopkg/index"
+	"github.com/getsolus/libeopkg/pspec"
+	"github.com/getsolus/libeopkg/shared"
+	"github.com/ulikunitz/xz"
+)
+
+// Options describe the repository to generate.
+type Options struct {
+	// Packages is the number of source packages.
+	Packages int
+	// Density is the average number of build dependencies of a package.
+	Density float64
+	// Changed is the fraction of the packages whose release the new side of
+	// the repository bumps.
+	Changed float64
+	// Seed seeds the choices of the generator, which generates the same
+	// repository from the same options.
+	Seed int64
+}
+
+// Side is one of the two versions of a generated repository.
+type Side int
+
+const (
+	Old Side = iota
+	New
+)
+
+var components = []string{"system.base", "system.devel", "desktop.library", "programming.library", "multimedia.library", "network.util"}
+
+// pkg is a source package of the repository, with a main package and, for
+// some, a -devel package that ships a pkg-config file.
+type pkg struct {
+	name      string
+	version   string
+	release   int
+	bumped    bool
+	devel     bool
+	component string
+	// buildDeps are the names of the packages, the -devel packages or the
+	// pkg-config files that the package builds against.
+	buildDeps []string
+	// runDeps are the binary packages that the main package depends on.
+	runDeps []string
+}
+
+// Repo is a generated repository.
+type Repo struct {
+	pkgs []pkg
+}
+
+// Generate generates the repository that `opts` describe. Packages only
+// depend on packages that come before them, so that there is always a build
+// order.
+func Generate(opts Options) *Repo {
+	r := rand.New(rand.NewSource(opts.Seed))
+	repo := &Repo{pkgs: make([]pkg, opts.Packages)}
+	for idx := range repo.pkgs {
+		p := &repo.pkgs[idx]
+		p.name = fmt.Sprintf("pkg%05d", idx)
+		p.version = fmt.Sprintf("%d.%d.%d", 1+r.Intn(9), r.Intn(30), r.Intn(10))
+		p.release = 1 + r.Intn(40)
+		p.bumped = r.Float64() < opts.Changed
+		p.devel = r.Intn(3) != 0
+		p.component = components[r.Intn(len(components))]
+		if idx == 0 {
+			continue
+		}
+
+		// Dependencies lean towards the first packages, like the toolchain
+		// and the base libraries everything builds against.
+		count := int(r.ExpFloat64() * opts.Density)
+		seen := make(map[int]bool)
+		for i := 0; i < count && len(seen) < idx; i++ {
+			depIdx := int(float64(idx) * r.Float64() * r.Float64())
+			if seen[depIdx] {
+				continue
+			}
+			seen[depIdx] = true
+			dep := &repo.pkgs[depIdx]
+			switch {
+			case !dep.devel:
+				p.buildDeps = append(p.buildDeps, dep.name)
+			case r.Intn(2) == 0:
+				p.buildDeps = append(p.buildDeps, dep.name+"-devel")
+			default:
+				p.buildDeps = append(p.buildDeps, fmt.Sprintf("pkgconfig(%s)", dep.name))
+			}
+			if r.Intn(2) == 0 {
+				p.runDeps = append(p.runDeps, dep.name)
+			}
+		}
+	}
+	return repo
+}
+
+// Len returns the number of source packages of the repository.
+func (repo *Repo) Len() int {
+	return len(repo.pkgs)
+}
+
+func (p *pkg) releaseOf(side Side) int {
+	if side == New && p.bumped {
+		return p.release + 1
+	}
+	return p.release
+}
+
+// history returns the updates of the package on `side`, newest first.
+func (p *pkg) history(side Side) (res []pspec.Update) {
+	latest := p.releaseOf(side)
+	for release := latest; release > 0 && release > latest-3; release-- {
+		res = append(res, pspec.Update{
+			Release: release,
+			Date:    fmt.Sprintf("2024-%02d-%02d", 1+release%12, 1+release%28),
+			Version: p.version,
+			Comment: fmt.Sprintf("Update %s to release %d", p.name, release),
+			Name:    "Synthetic Packager",
+			Email:   "packager@example.com",
+		})
+	}
+	return
+}
+
+// binaries returns the binary packages of the package, the main one first.
+func (p *pkg) binaries() []pspec.Package {
+	main := pspec.Package{
+		Name:     p.name,
+		Summary:  shared.LocalisedField{Value: "The " + p.name + " package", Lang: "en"},
+		PartOf:   p.component,
+		Licenses: []string{"GPL-2.0-or-later"},
+		Files:    []pspec.Path{{Value: "/usr/bin/" + p.name}},
+	}
+	for _, dep := range p.runDeps {
+		main.RuntimeDependencies = append(main.RuntimeDependencies, shared.Dependency{Name: dep})
+	}
+	if !p.devel {
+		return []pspec.Package{main}
+	}
+	devel := pspec.Package{
+		Name:                p.name + "-devel",
+		Summary:             shared.LocalisedField{Value: "Development files for " + p.name, Lang: "en"},
+		PartOf:              "programming.devel",
+		Licenses:            main.Licenses,
+		RuntimeDependencies: []shared.Dependency{{Name: p.name}},
+		Files:               []pspec.Path{{Value: fmt.Sprintf("/usr/lib64/pkgconfig/%s.pc", p.name)}},
+	}
+	return []pspec.Package{main, devel}
+}
+
+// WriteSource writes `side` of the repository to `dir` as a source tree, with
+// a directory holding the package.yml and pspec_x86_64.xml of every package.
+func (repo *Repo) WriteSource(dir string, side Side) error {
+	for idx := range repo.pkgs {
+		p := &repo.pkgs[idx]
+		pkgDir := filepath.Join(dir, p.name)
+		if err := os.MkdirAll(pkgDir, 0o755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(pkgDir, "package.yml"), p.packageYML(side), 0o644); err != nil {
+			return err
+		}
+
+		spec := pspec.PSpec{
+			Source:   shared.Source{Name: p.name, Packager: shared.Packager{Name: "Synthetic Packager", Email: "packager@example.com"}},
+			Packages: p.binaries(),
+			History:  p.history(side),
+		}
+		if err := writeXML(filepath.Join(pkgDir, "pspec_x86_64.xml"), spec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *pkg) packageYML(side Side) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "name       : %s\nversion    : %s\nrelease    : %d\n", p.name, p.version, p.releaseOf(side))
+	fmt.Fprintf(&b, "source     :\n    - https://example.com/%s-%s.tar.xz : %064x\n", p.name, p.version, len(p.name)+p.release)
+	b.WriteString("license    : GPL-2.0-or-later\n")
+	if p.devel {
+		fmt.Fprintf(&b, "component  :\n    - %s\n    - ^%s-devel : programming.devel\n", p.component, p.name)
+	} else {
+		fmt.Fprintf(&b, "component  : %s\n", p.component)
+	}
+	fmt.Fprintf(&b, "summary    : The %s package\ndescription: |\n    The %s package, made up to measure autobuild.\n", p.name, p.name)
+	if len(p.buildDeps) != 0 {
+		b.WriteString("builddeps  :\n")
+		for _, dep := range p.buildDeps {
+			fmt.Fprintf(&b, "    - %s\n", dep)
+		}
+	}
+	// ypkg recipes always have rundeps, if only an empty list.
+	if len(p.runDeps) == 0 {
+		b.WriteString("rundeps    : []\n")
+	} else {
+		b.WriteString("rundeps    :\n")
+		for _, dep := range p.runDeps {
+			fmt.Fprintf(&b, "    - %s\n", dep)
+		}
+	}
+	b.WriteString("setup      : |\n    %configure\nbuild      : |\n    %make\ninstall    : |\n    %make_install\n")
+	return []byte(b.String())
+}
+
+// WriteIndex writes `side` of the repository to `path` as an eopkg index, which
+// is compressed with xz if `path` ends with .xz, like the indexes that
+// repositories serve.
+func (repo *Repo) WriteIndex(path string, side Side) error {
+	var idx index.Index
+	idx.Distribution.SourceName = "Synthetic"
+	for pkgIdx := range repo.pkgs {
+		p := &repo.pkgs[pkgIdx]
+		var history []shared.Update
+		for _, update := range p.history(side) {
+			u := shared.Update{Release: update.Release, Date: update.Date, Version: update.Version, Email: update.Email}
+			u.Comment.Value, u.Name.Value = update.Comment, update.Name
+			history = append(history, u)
+		}
+		for _, bin := range p.binaries() {
+			idx.Packages = append(idx.Packages, index.Package{
+				Name:                bin.Name,
+				Summary:             bin.Summary,
+				PartOf:              bin.PartOf,
+				Licenses:            bin.Licenses,
+				RuntimeDependencies: bin.RuntimeDependencies,
+				History:             history,
+				Architecture:        "x86_64",
+				PackageURI:          fmt.Sprintf("%c/%s/%s-%s-%d-1-x86_64.eopkg", p.name[0], p.name, bin.Name, p.version, p.releaseOf(side)),
+				PackageFormat:       "1.2",
+				Source:              shared.Source{Name: p.name},
+			})
+		}
+	}
+	return writeXML(path, idx)
+}
+
+// WritePackages writes `side` of the repository to `dir` as .eopkg files, laid
+// out like the pool of a repository, as the PackageURI of WriteIndex. Their
+// install.tar.xz is a placeholder, since only their metadata is ever read.
+func (repo *Repo) WritePackages(dir string, side Side) error {
+	for pkgIdx := range repo.pkgs {
+		p := &repo.pkgs[pkgIdx]
+		source := shared.Source{Name: p.name, Packager: shared.Packager{Name: "Synthetic Packager", Email: "packager@example.com"}}
+		var history []shared.Update
+		for _, update := range p.history(side) {
+			u := shared.Update{Release: update.Release, Date: update.Date, Version: update.Version, Email: update.Email}
+			u.Comment.Value, u.Name.Value = update.Comment, update.Name
+			history = append(history, u)
+		}
+		for _, bin := range p.binaries() {
+			meta := archive.Package{
+				Name:                bin.Name,
+				Summary:             shared.LocalisedFields{bin.Summary},
+				PartOf:              bin.PartOf,
+				License:             bin.Licenses,
+				RuntimeDependencies: &bin.RuntimeDependencies,
+				History:             history,
+				Architecture:        "x86_64",
+				PackageFormat:       "1.2",
+			}
+			path := filepath.Join(dir, fmt.Sprintf("%c/%s/%s-%s-%d-1-x86_64.eopkg", p.name[0], p.name, bin.Name, p.version, p.releaseOf(side)))
+			if err := writePackage(path, source, meta, bin.Files); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writePackage writes the .eopkg file of the binary package `meta` of `source`,
+// which ships `files`, to `path`.
+func writePackage(path string, source shared.Source, meta archive.Package, files []pspec.Path) (err error) {
+	if err = os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	zw := zip.NewWriter(f)
+	var list archive.Files
+	for _, file := range files {
+		list.File = append(list.File, &archive.File{Path: strings.TrimPrefix(file.Value, "/"), Type: shared.FileExecutable})
+	}
+	entries := []struct {
+		name string
+		v    any
+	}{
+		{"metadata.xml", struct {
+			XMLName xml.Name `xml:"PISI"`
+			Source  shared.Source
+			Package archive.Package
+		}{Source: source, Package: meta}},
+		{"files.xml", list},
+	}
+	for _, entry := range entries {
+		w, err := zw.Create(entry.name)
+		if err != nil {
+			return err
+		}
+		enc := xml.NewEncoder(w)
+		enc.Indent("", "    ")
+		if err = enc.Encode(entry.v); err != nil {
+			return err
+		}
+	}
+	w, err := zw.Create("install.tar.xz")
+	if err != nil {
+		return err
+	}
+	if _, err = io.WriteString(w, "placeholder"); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// writeXML writes `v` to `path` as XML, compressed with xz if `path` ends with
+// .xz.
+func writeXML(path string, v any) (err error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	buf := bufio.NewWriter(f)
+	var w io.Writer = buf
+	var xzw *xz.Writer
+	if strings.HasSuffix(path, ".xz") {
+		if xzw, err = xz.NewWriter(buf); err != nil {
+			return err
+		}
+		w = xzw
+	}
+
+	io.WriteString(w, xml.Header)
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "    ")
+	if err = enc.Encode(v); err != nil {
+		return err
+	}
+	if xzw != nil {
+		if err = xzw.Close(); err != nil {
+			return err
+		}
+	}
+	return buf.Flush()
+}
@@ -0,0 +1,41 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package push
+
+import (
+	"github.com/GZGavinZhao/autobuild/common"
+)
+
+// Batcher is implemented by builders that can register all the jobs of a push
+// as one batch before they are published, so that the build server can track
+// them together.
+type Batcher interface {
+	// RegisterBatch registers the batch `id`, made of `pkgs` in build order.
+	// `maxFailures` is the fraction of its jobs that may fail before the batch
+	// is abandoned, or 0 for no limit. `attestation`, if not nil, is the
+	// signed provenance of the batch, which its jobs then go without.
+	RegisterBatch(id string, pkgs []common.Package, maxFailures float64, attestation *Attestation) error
+}
+
+type batchRequest struct {
+	ID          string         `json:"id"`
+	Packages    []batchPackage `json:"packages"`
+	MaxFailures float64        `json:"max_failures,omitempty"`
+	Attestation *Attestation   `json:"attestation,omitempty"`
+}
+
+type batchPackage struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Release int    `json:"release"`
+}
+
+func newBatchRequest(id string, pkgs []common.Package, maxFailures float64, attestation *Attestation) batchRequest {
+	req := batchRequest{ID: id, MaxFailures: maxFailures, Attestation: attestation, Packages: []batchPackage{}}
+	for _, pkg := range pkgs {
+		req.Packages = append(req.Packages, batchPackage{Name: pkg.Name, Version: pkg.Version, Release: pkg.Release})
+	}
+	return req
+}
@@ -0,0 +1,78 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package push
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/GZGavinZhao/autobuild/config"
+)
+
+func TestRegisterBatch(t *testing.T) {
+	attestation := &Attestation{Provenance: `{"version":1}`, Signature: "-----BEGIN SSH SIGNATURE-----"}
+	tests := []struct {
+		name        string
+		maxFailures float64
+		attestation *Attestation
+		want        map[string]any
+	}{
+		{"transaction", 0.2, nil, map[string]any{"max_failures": 0.2}},
+		{"signed", 0, attestation, map[string]any{"attestation": map[string]any{"provenance": attestation.Provenance, "signature": attestation.Signature}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got map[string]any
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodPost || r.URL.Path != "/batches" {
+					t.Errorf("%s %s, want POST /batches", r.Method, r.URL.Path)
+				}
+				if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+					t.Error(err)
+				}
+				w.Write([]byte("{}"))
+			}))
+			defer server.Close()
+
+			t.Setenv(config.TokenEnv("webhook"), "token")
+			builder, err := NewBuilder("webhook", config.PushConfig{Webhook: config.HTTPBackendConfig{URL: server.URL}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = builder.(Batcher).RegisterBatch("b1", testPackages("a"), tt.maxFailures, tt.attestation); err != nil {
+				t.Fatalf("RegisterBatch(): %s", err)
+			}
+
+			want := map[string]any{"id": "b1", "packages": []any{map[string]any{"name": "a", "version": "1.0", "release": 1.0}}}
+			for key, value := range tt.want {
+				want[key] = value
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("registered %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestForwardsAttestations(t *testing.T) {
+	tests := []struct {
+		builder Builder
+		want    bool
+	}{
+		{&WebhookBuilder{}, true},
+		{&SummitBuilder{}, true},
+		{&GitHubBuilder{}, true},
+		{&SolusBuilder{}, false},
+		{&LocalBuilder{}, false},
+	}
+	for _, tt := range tests {
+		if got := ForwardsAttestations(tt.builder); got != tt.want {
+			t.Errorf("ForwardsAttestations(%T) = %t, want %t", tt.builder, got, tt.want)
+		}
+	}
+}
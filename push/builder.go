@@ -0,0 +1,205 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package push
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/GZGavinZhao/autobuild/common"
+	"github.com/GZGavinZhao/autobuild/config"
+	"github.com/go-git/go-git/v5"
+	// "github.com/go-git/go-git/v5/config"
+	// "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+)
+
+// Builder is a build server that packages can be published to.
+type Builder interface {
+	// Name returns the name of the backend.
+	Name() string
+	// Target identifies the build server that packages are published to, such
+	// as its host or URL.
+	Target() string
+	// Publish submits a build of `pkg` to the build server, along with
+	// metadata describing why it exists.
+	Publish(pkg common.Package, meta Metadata) (Job, error)
+	// Query returns the current state of the job with the given ID.
+	Query(jobid int) (Job, error)
+}
+
+// Canceller is implemented by builders that can cancel jobs.
+type Canceller interface {
+	Cancel(jobid int) (Job, error)
+}
+
+// Requeuer is implemented by builders that can build a job again, e.g. after
+// it failed or was cancelled.
+type Requeuer interface {
+	// Requeue returns the new state of the job, which may have a new ID.
+	Requeue(jobid int) (Job, error)
+}
+
+// Queuer is implemented by builders that can list the jobs that are queued
+// or building on the build server.
+type Queuer interface {
+	Queue() ([]Job, error)
+}
+
+// Backends lists the names of all the supported build server backends.
+var Backends = []string{"solus", "summit", "webhook", "local", "github", "gitlab"}
+
+// NewBuilder creates the backend called `name`, configured by `cfg`.
+func NewBuilder(name string, cfg config.PushConfig) (Builder, error) {
+	switch name {
+	case "solus":
+		b := &SolusBuilder{User: cfg.Solus.User, Host: cfg.Solus.Host, Identity: cfg.Solus.Identity}
+		if b.User == "" {
+			b.User = DefaultSolusUser
+		}
+		if b.Host == "" {
+			b.Host = DefaultSolusHost
+		}
+		if key, ok := os.LookupEnv("AUTOBUILD_SSHKEY"); ok {
+			b.Identity = key
+		}
+		return b, nil
+	case "summit":
+		if cfg.Summit.URL == "" {
+			return nil, errors.New("push.NewBuilder: the summit backend requires push.summit.url to be configured")
+		}
+		client, err := newHTTPClient(name, cfg.Summit)
+		if err != nil {
+			return nil, err
+		}
+		return &SummitBuilder{client: client}, nil
+	case "webhook":
+		if cfg.Webhook.URL == "" {
+			return nil, errors.New("push.NewBuilder: the webhook backend requires push.webhook.url to be configured")
+		}
+		client, err := newHTTPClient(name, cfg.Webhook)
+		if err != nil {
+			return nil, err
+		}
+		return &WebhookBuilder{client: client}, nil
+	case "local":
+		return NewLocalBuilder(cfg.Local)
+	case "github":
+		return newGitHubBuilder(cfg.GitHub)
+	case "gitlab":
+		return newGitLabBuilder(cfg.GitLab)
+	}
+	return nil, fmt.Errorf("push.NewBuilder: unknown backend %s, must be one of %q", name, Backends)
+}
+
+// Source identifies the exact recipe that a package is built from.
+type Source struct {
+	// Tag is the name, version and release of the package.
+	Tag string
+	// Path is the path to the recipe relative to the root of the repository.
+	Path string
+	// Ref is the git commit of the recipe.
+	Ref string
+}
+
+// SourceTag returns the git tag of the current release of `pkg`.
+func SourceTag(pkg common.Package) string {
+	return fmt.Sprintf("%s-%s-%d", pkg.Name, pkg.Version, pkg.Release)
+}
+
+func resolveSource(pkg common.Package) (src Source, err error) {
+	root := pkg.Root
+	src.Tag = SourceTag(pkg)
+	src.Path, err = filepath.Rel(root, pkg.Path)
+	if err != nil {
+		err = fmt.Errorf("push.resolveSource: unable to convert %s to relative path to %s: %w", pkg.Path, pkg.Root, err)
+		return
+	}
+
+	// Open the repository
+	repo, err := git.PlainOpen(root)
+	if err != nil {
+		return
+	}
+
+	ref, err := repo.Head()
+	if err != nil {
+		return
+	}
+
+	if ref.Name().String() != "refs/heads/main" {
+		err = errors.New("push.resolveSource: not on main branch!")
+		return
+	}
+
+	src.Ref = ref.Hash().String()
+	return
+}
+
+// GitCommit commits the changes to `paths`, relative to the git repository at
+// `root`, with the given message.
+func GitCommit(root string, message string, paths ...string) error {
+	commitCmd := exec.Command("git", append([]string{"commit", "-m", message, "--"}, paths...)...)
+	commitCmd.Dir = root
+	if output, err := commitCmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("push.GitCommit: failed to commit: %w, stderr: %s", err, string(output))
+	}
+	return nil
+}
+
+// GitPush pushes the git repository at `root` to its remote.
+func GitPush(root string) error {
+	// br, err := repo.Branch(ref.Name().Short())
+	// if err != nil {
+	// 	err = fmt.Errorf("push.Publish: failed to get branch of HEAD: %w", err)
+	// 	return
+	// }
+
+	// rm, err := repo.Remote(br.Remote)
+	// if err != nil {
+	// 	err = fmt.Errorf("push.Publish: failed to get remote of branch %s: %w", br.Name, err)
+	// 	return
+	// }
+
+	// localRef := ref.Name().String()
+	// remoteRef := fmt.Sprintf("refs/remotes/%s/%s", rm.Config().Name, br.Name)
+	// refspec := config.RefSpec(fmt.Sprintf("+%s:%s", localRef, remoteRef))
+	// if err = refspec.Validate(); err != nil {
+	// 	err = fmt.Errorf("push.Publish: failed to validate refspec %s: %w", refspec.String(), err)
+	// 	return
+	// }
+
+	// sshKeyPath, ok := os.LookupEnv("AUTOBUILD_SSHKEY")
+	// var auth *ssh.PublicKeys
+	// if ok {
+	// 	auth, err = ssh.NewPublicKeysFromFile("git", sshKeyPath, "")
+	// 	if err != nil {
+	// 		err = fmt.Errorf("push.Publish: failed to obtain ssh private key from %s: %w", sshKeyPath, err)
+	// 		return
+	// 	}
+	// 	println("Picked up key", sshKeyPath, auth.String())
+	// }
+
+	// println("Pushing to remote", rm.Config().Name, rm.Config().URLs)
+	// err = rm.Push(&git.PushOptions{
+	// 	RemoteName: rm.Config().Name,
+	// 	RefSpecs:   []config.RefSpec{refspec},
+	// 	Auth:       auth,
+	// })
+	// if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+	// 	err = fmt.Errorf("push.Publish: failed to push to remote %s: %w", rm.Config().Name, err)
+	// 	return
+	// }
+
+	// go-git cannot pick up the correct user/SSH public key to push! Bruh!
+	pushCmd := exec.Command("git", "push")
+	pushCmd.Dir = root
+	if output, err := pushCmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("push.GitPush: failed to push to remote: %w, stderr: %s", err, string(output))
+	}
+	return nil
+}
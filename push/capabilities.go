@@ -0,0 +1,81 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package push
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// APIVersion is the version of the build server API that autobuild speaks.
+// Servers that report another version are incompatible.
+const APIVersion = 1
+
+// Capabilities are the optional features of the API of a build server.
+type Capabilities struct {
+	APIVersion int `json:"api_version"`
+	// Unreported is set if the server predates capabilities, and is assumed
+	// to have none of them.
+	Unreported bool `json:"-"`
+	// Batches is set if the server accepts batch registrations, see Batcher.
+	// Jobs are still submitted one at a time, since packages are only
+	// submitted once their dependencies are published, or built with --wait:
+	// there is never a whole batch of jobs to submit at once.
+	Batches bool `json:"batches"`
+	Cancel  bool `json:"cancel"`
+	Retry   bool `json:"retry"`
+	// Queue is set if the server lists its queued jobs, see Queuer.
+	Queue bool `json:"queue"`
+	// Remove is set if the server drops removed packages, see Remover.
+	Remove bool `json:"remove"`
+	// Priorities is set if the server orders its queue by Metadata.Priority.
+	Priorities bool `json:"priorities"`
+	// WaveHints is set if the server makes use of Metadata.Wave.
+	WaveHints bool `json:"wave_hints"`
+	// Attestations is set if the server verifies Metadata.Attestation.
+	Attestations bool `json:"attestations"`
+}
+
+// Negotiator is implemented by builders whose servers report their
+// capabilities.
+type Negotiator interface {
+	Capabilities() (Capabilities, error)
+}
+
+// QueryCapabilities returns the capabilities of the build server of `b`, and
+// fails if autobuild can't talk to it. Builders that aren't Negotiators have
+// the capabilities of the interfaces they implement.
+func QueryCapabilities(b Builder) (caps Capabilities, err error) {
+	if n, ok := b.(Negotiator); ok {
+		if caps, err = n.Capabilities(); err != nil {
+			return caps, fmt.Errorf("push.QueryCapabilities: failed to query the capabilities of %s: %w", b.Target(), err)
+		}
+		if caps.APIVersion != APIVersion {
+			return caps, fmt.Errorf("push.QueryCapabilities: %s speaks version %d of the build server API, but autobuild only speaks version %d", b.Target(), caps.APIVersion, APIVersion)
+		}
+		return caps, nil
+	}
+
+	caps.APIVersion = APIVersion
+	_, caps.Batches = b.(Batcher)
+	_, caps.Cancel = b.(Canceller)
+	_, caps.Retry = b.(Requeuer)
+	_, caps.Queue = b.(Queuer)
+	_, caps.Remove = b.(Remover)
+	return caps, nil
+}
+
+// queryCapabilities GETs the capabilities at `path` of `client`. Servers that
+// predate capabilities don't have the endpoint, and have none of them, see
+// Capabilities.Unreported.
+func queryCapabilities(client *httpClient, path string) (caps Capabilities, err error) {
+	err = client.get(path, &caps)
+	var status *StatusError
+	if errors.As(err, &status) && status.StatusCode == http.StatusNotFound {
+		return Capabilities{APIVersion: APIVersion, Unreported: true}, nil
+	}
+	return
+}
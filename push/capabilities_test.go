@@ -0,0 +1,53 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package push
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/GZGavinZhao/autobuild/config"
+)
+
+func TestQueryCapabilities(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		want    Capabilities
+		wantErr bool
+	}{
+		{"reported", http.StatusOK, `{"api_version": 1, "batches": true, "queue": true}`, Capabilities{APIVersion: 1, Batches: true, Queue: true}, false},
+		{"unreported", http.StatusNotFound, ``, Capabilities{APIVersion: 1, Unreported: true}, false},
+		{"other version", http.StatusOK, `{"api_version": 2}`, Capabilities{}, true},
+		{"server error", http.StatusInternalServerError, ``, Capabilities{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/capabilities" {
+					t.Errorf("GET %s, want /capabilities", r.URL.Path)
+				}
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+
+			t.Setenv(config.TokenEnv("webhook"), "token")
+			builder, err := NewBuilder("webhook", config.PushConfig{Webhook: config.HTTPBackendConfig{URL: server.URL}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			caps, err := QueryCapabilities(builder)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("QueryCapabilities() = %s, want an error: %t", err, tt.wantErr)
+			}
+			if !tt.wantErr && caps != tt.want {
+				t.Errorf("QueryCapabilities() = %+v, want %+v", caps, tt.want)
+			}
+		})
+	}
+}
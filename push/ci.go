@@ -0,0 +1,300 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package push
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/GZGavinZhao/autobuild/common"
+	"gopkg.in/yaml.v3"
+)
+
+// CIProviders lists the CI services that CIPipeline writes pipelines for.
+var CIProviders = []string{"github", "gitlab"}
+
+// Default builds that CI pipelines run for every package, see CIPipeline.Build.
+const (
+	DefaultGitHubBuild = "./.github/workflows/build.yml"
+	DefaultGitLabBuild = ".gitlab/autobuild.yml"
+)
+
+// GitLabBuildJob is the hidden job that the jobs of GitLab pipelines extend,
+// which builds the package of its AUTOBUILD_* variables.
+const GitLabBuildJob = ".autobuild-build"
+
+// Matrices of GitHub have up to 256 jobs, and those of GitLab up to 200, so
+// larger waves are split into several jobs.
+const (
+	githubMaxMatrix = 256
+	gitlabMaxMatrix = 200
+)
+
+// ciInputs returns what describes `pkg`, whose recipe is at `path` in its
+// repository, to the CI jobs that build it, named like the inputs of GitHub
+// workflows.
+func ciInputs(pkg common.Package, path string) [][2]string {
+	return [][2]string{
+		{"package", pkg.Name},
+		{"version", pkg.Version},
+		{"release", strconv.Itoa(pkg.Release)},
+		{"tag", SourceTag(pkg)},
+		{"path", path},
+	}
+}
+
+// ciVariables returns ciInputs as the AUTOBUILD_* variables of GitLab.
+func ciVariables(pkg common.Package, path string) [][2]string {
+	res := ciInputs(pkg, path)
+	for idx := range res {
+		res[idx][0] = "AUTOBUILD_" + strings.ToUpper(res[idx][0])
+	}
+	return res
+}
+
+// tagPackage returns the name of the package of the tag `tag`, see SourceTag.
+func tagPackage(tag string) string {
+	parts := strings.Split(tag, "-")
+	if len(parts) < 3 {
+		return tag
+	}
+	return strings.Join(parts[:len(parts)-2], "-")
+}
+
+// ciMap is a YAML mapping that keeps its keys in order.
+type ciMap []ciItem
+
+type ciItem struct {
+	key   string
+	value any
+}
+
+func (m ciMap) MarshalYAML() (any, error) {
+	node := &yaml.Node{Kind: yaml.MappingNode}
+	for _, item := range m {
+		var key, value yaml.Node
+		if err := key.Encode(item.key); err != nil {
+			return nil, err
+		}
+		if err := value.Encode(item.value); err != nil {
+			return nil, err
+		}
+		node.Content = append(node.Content, &key, &value)
+	}
+	return node, nil
+}
+
+// pairs returns `pairs` as a mapping.
+func pairs(pairs [][2]string) (m ciMap) {
+	for _, pair := range pairs {
+		m = append(m, ciItem{pair[0], pair[1]})
+	}
+	return
+}
+
+var badJobChars = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// CIPipeline is a pipeline of GitHub Actions or GitLab CI that builds
+// packages, with the jobs of packages needing the jobs of the packages they
+// depend on.
+type CIPipeline struct {
+	// Provider is one of CIProviders.
+	Provider string
+	// Build is what the jobs run to build a package: the reusable workflow
+	// that they call on GitHub, or the file that defines GitLabBuildJob on
+	// GitLab, which is included.
+	Build    string
+	Packages []common.Package
+	// Deps holds, for every package, the indices of the packages it depends
+	// on. Packages must be in build order.
+	Deps [][]int
+	// PerWave builds the packages of every wave in a matrix job, which needs
+	// the jobs of the wave before, instead of one job per package.
+	PerWave bool
+	// Comment, if not empty, heads the file.
+	Comment string
+}
+
+// Write writes the pipeline to `w` as YAML.
+func (p *CIPipeline) Write(w io.Writer) error {
+	var doc ciMap
+	var err error
+	switch p.Provider {
+	case "github":
+		doc, err = p.github()
+	case "gitlab":
+		doc, err = p.gitlab()
+	default:
+		err = fmt.Errorf("unknown provider %q, expected one of %q", p.Provider, CIProviders)
+	}
+	if err != nil {
+		return fmt.Errorf("push.CIPipeline.Write: %w", err)
+	}
+
+	if p.Comment != "" {
+		for _, line := range strings.Split(p.Comment, "\n") {
+			if _, err = fmt.Fprintf(w, "# %s\n", line); err != nil {
+				return fmt.Errorf("push.CIPipeline.Write: %w", err)
+			}
+		}
+	}
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err = enc.Encode(doc); err != nil {
+		return fmt.Errorf("push.CIPipeline.Write: %w", err)
+	}
+	return enc.Close()
+}
+
+// paths returns the path of the recipe of every package in its repository.
+func (p *CIPipeline) paths() ([]string, error) {
+	paths := make([]string, len(p.Packages))
+	for idx, pkg := range p.Packages {
+		path, err := filepath.Rel(pkg.Root, pkg.Path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to convert %s to relative path to %s: %w", pkg.Path, pkg.Root, err)
+		}
+		paths[idx] = filepath.ToSlash(path)
+	}
+	return paths, nil
+}
+
+// ciJob is a job of a pipeline, which builds one package, or a chunk of a
+// wave.
+type ciJob struct {
+	id       string
+	packages []int
+	needs    []string
+}
+
+// jobs returns the jobs of the pipeline, whose matrices have at most `size`
+// packages.
+func (p *CIPipeline) jobs(size int) (jobs []ciJob) {
+	if !p.PerWave {
+		taken := make(map[string]bool, len(p.Packages))
+		for idx, pkg := range p.Packages {
+			id := "build-" + badJobChars.ReplaceAllString(pkg.Name, "-")
+			for base, i := id, 2; taken[id]; i++ {
+				id = fmt.Sprintf("%s-%d", base, i)
+			}
+			taken[id] = true
+
+			job := ciJob{id: id, packages: []int{idx}, needs: []string{}}
+			for _, dep := range p.Deps[idx] {
+				job.needs = append(job.needs, jobs[dep].id)
+			}
+			jobs = append(jobs, job)
+		}
+		return
+	}
+
+	var byWave [][]int
+	for idx, wave := range Waves(p.Deps) {
+		for len(byWave) < wave {
+			byWave = append(byWave, nil)
+		}
+		byWave[wave-1] = append(byWave[wave-1], idx)
+	}
+	// Every wave needs the one before, which needs the ones before it.
+	prev := []string{}
+	for wIdx, members := range byWave {
+		var cur []string
+		for start := 0; start < len(members); start += size {
+			id := fmt.Sprintf("wave-%d", wIdx+1)
+			if len(members) > size {
+				id = fmt.Sprintf("%s-%d", id, start/size+1)
+			}
+			jobs = append(jobs, ciJob{id: id, packages: members[start:min(start+size, len(members))], needs: prev})
+			cur = append(cur, id)
+		}
+		prev = cur
+	}
+	return
+}
+
+func (p *CIPipeline) github() (ciMap, error) {
+	paths, err := p.paths()
+	if err != nil {
+		return nil, err
+	}
+	build := p.Build
+	if build == "" {
+		build = DefaultGitHubBuild
+	}
+
+	jobs := ciMap{}
+	for _, j := range p.jobs(githubMaxMatrix) {
+		var job ciMap
+		if len(j.needs) != 0 {
+			job = append(job, ciItem{"needs", j.needs})
+		}
+		if !p.PerWave {
+			idx := j.packages[0]
+			job = append(job,
+				ciItem{"uses", build},
+				ciItem{"with", pairs(ciInputs(p.Packages[idx], paths[idx]))},
+			)
+		} else {
+			var include []ciMap
+			var with [][2]string
+			for _, idx := range j.packages {
+				include = append(include, pairs(ciInputs(p.Packages[idx], paths[idx])))
+			}
+			for _, input := range ciInputs(common.Package{}, "") {
+				with = append(with, [2]string{input[0], fmt.Sprintf("${{ matrix.%s }}", input[0])})
+			}
+			// A failed package only fails its own job, and the waves after.
+			job = append(job,
+				ciItem{"strategy", ciMap{{"fail-fast", false}, {"matrix", ciMap{{"include", include}}}}},
+				ciItem{"uses", build},
+				ciItem{"with", pairs(with)},
+			)
+		}
+		job = append(job, ciItem{"secrets", "inherit"})
+		jobs = append(jobs, ciItem{j.id, job})
+	}
+
+	return ciMap{
+		{"name", "autobuild"},
+		{"on", ciMap{{"workflow_dispatch", ciMap{}}}},
+		{"jobs", jobs},
+	}, nil
+}
+
+func (p *CIPipeline) gitlab() (ciMap, error) {
+	paths, err := p.paths()
+	if err != nil {
+		return nil, err
+	}
+	build := p.Build
+	if build == "" {
+		build = DefaultGitLabBuild
+	}
+
+	doc := ciMap{{"include", []ciMap{{{"local", build}}}}}
+	for _, j := range p.jobs(gitlabMaxMatrix) {
+		job := ciMap{{"extends", GitLabBuildJob}}
+		// Waves of a single package don't need a matrix.
+		if len(j.packages) == 1 {
+			idx := j.packages[0]
+			job = append(job, ciItem{"variables", pairs(ciVariables(p.Packages[idx], paths[idx]))})
+		} else {
+			var matrix []ciMap
+			for _, idx := range j.packages {
+				matrix = append(matrix, pairs(ciVariables(p.Packages[idx], paths[idx])))
+			}
+			job = append(job, ciItem{"parallel", ciMap{{"matrix", matrix}}})
+		}
+		// Jobs without needs start right away instead of waiting for the
+		// stages before theirs.
+		job = append(job, ciItem{"needs", j.needs})
+		doc = append(doc, ciItem{j.id, job})
+	}
+	return doc, nil
+}
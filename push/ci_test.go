@@ -0,0 +1,73 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package push
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCIPipelineJobs(t *testing.T) {
+	tests := []struct {
+		name    string
+		pkgs    []string
+		deps    [][]int
+		perWave bool
+		size    int
+		// want holds every job as its ID, its packages, and the jobs it
+		// needs after the arrow.
+		want []string
+	}{
+		{
+			name: "per package",
+			pkgs: []string{"a", "b", "c", "d"},
+			deps: [][]int{nil, nil, {0}, {1, 2}},
+			size: 2,
+			want: []string{"build-a [a] <- []", "build-b [b] <- []", "build-c [c] <- [build-a]", "build-d [d] <- [build-b build-c]"},
+		},
+		{
+			name: "clashing names",
+			pkgs: []string{"g++", "g..", "python3.11"},
+			deps: [][]int{nil, {0}, {1}},
+			size: 2,
+			want: []string{"build-g- [g++] <- []", "build-g--2 [g..] <- [build-g-]", "build-python3-11 [python3.11] <- [build-g--2]"},
+		},
+		{
+			name:    "per wave",
+			pkgs:    []string{"a", "b", "c", "d"},
+			deps:    [][]int{nil, {0}, {1}, {0}},
+			perWave: true,
+			size:    2,
+			// Waves only need the wave right before them.
+			want: []string{"wave-1 [a] <- []", "wave-2 [b d] <- [wave-1]", "wave-3 [c] <- [wave-2]"},
+		},
+		{
+			name:    "split waves",
+			pkgs:    []string{"a", "b", "c", "d", "e"},
+			deps:    [][]int{nil, nil, nil, {0}, {2}},
+			perWave: true,
+			size:    2,
+			want:    []string{"wave-1-1 [a b] <- []", "wave-1-2 [c] <- []", "wave-2 [d e] <- [wave-1-1 wave-1-2]"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := CIPipeline{Packages: testPackages(tt.pkgs...), Deps: tt.deps, PerWave: tt.perWave}
+			var got []string
+			for _, job := range p.jobs(tt.size) {
+				var names []string
+				for _, idx := range job.packages {
+					names = append(names, p.Packages[idx].Name)
+				}
+				got = append(got, fmt.Sprintf("%s [%s] <- %v", job.id, strings.Join(names, " "), job.needs))
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("jobs(%d) = %q, want %q", tt.size, got, tt.want)
+			}
+		})
+	}
+}
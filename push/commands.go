@@ -5,133 +5,100 @@
 package push
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"os/exec"
-	"path/filepath"
+	"strings"
 
 	"github.com/GZGavinZhao/autobuild/common"
-	"github.com/go-git/go-git/v5"
-	// "github.com/go-git/go-git/v5/config"
-	// "github.com/go-git/go-git/v5/plumbing/transport/ssh"
 )
 
 const (
-	user = "build-controller"
-	host = "build.getsol.us"
+	DefaultSolusUser = "build-controller"
+	DefaultSolusHost = "build.getsol.us"
 )
 
-func Publish(pkg common.Package, prePush bool) (job Job, err error) {
-	root := pkg.Root
-	relp, err := filepath.Rel(root, pkg.Path)
-	if err != nil {
-		err = fmt.Errorf("push.Publish: unable to convert %s to relative path to %s: %w", pkg.Path, pkg.Root, err)
-		return
+// SolusBuilder publishes packages to the Solus build server over SSH.
+type SolusBuilder struct {
+	User string
+	Host string
+	// Identity, if not empty, is the SSH private key to authenticate with.
+	Identity string
+}
+
+// sshError marks errors of ssh itself as transient. ssh exits with 255 when
+// it fails to connect, while the build server never does.
+func sshError(err error) error {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 255 {
+		return &TransientError{Err: err}
 	}
+	return err
+}
 
-	// Open the repository
-	repo, err := git.PlainOpen(root)
-	if err != nil {
-		return
+func (b *SolusBuilder) sshArgs(args ...string) []string {
+	res := []string{}
+	if b.Identity != "" {
+		res = append(res, "-i", b.Identity)
 	}
+	return append(append(res, b.Target()), args...)
+}
 
-	ref, err := repo.Head()
+func (b *SolusBuilder) Name() string {
+	return "solus"
+}
+
+func (b *SolusBuilder) Target() string {
+	return fmt.Sprintf("%s@%s", b.User, b.Host)
+}
+
+func (b *SolusBuilder) Publish(pkg common.Package, meta Metadata) (job Job, err error) {
+	src, err := resolveSource(pkg)
 	if err != nil {
 		return
 	}
-
-	if ref.Name().String() != "refs/heads/main" {
-		err = errors.New("push.Publish: not on main branch!")
-		return
+	if meta.Commit == "" {
+		meta.Commit = src.Ref
 	}
 
-	// br, err := repo.Branch(ref.Name().Short())
-	// if err != nil {
-	// 	err = fmt.Errorf("push.Publish: failed to get branch of HEAD: %w", err)
-	// 	return
-	// }
-
-	// rm, err := repo.Remote(br.Remote)
-	// if err != nil {
-	// 	err = fmt.Errorf("push.Publish: failed to get remote of branch %s: %w", br.Name, err)
-	// 	return
-	// }
-
-	// localRef := ref.Name().String()
-	// remoteRef := fmt.Sprintf("refs/remotes/%s/%s", rm.Config().Name, br.Name)
-	// refspec := config.RefSpec(fmt.Sprintf("+%s:%s", localRef, remoteRef))
-	// if err = refspec.Validate(); err != nil {
-	// 	err = fmt.Errorf("push.Publish: failed to validate refspec %s: %w", refspec.String(), err)
-	// 	return
-	// }
-
-	// sshKeyPath, ok := os.LookupEnv("AUTOBUILD_SSHKEY")
-	// var auth *ssh.PublicKeys
-	// if ok {
-	// 	auth, err = ssh.NewPublicKeysFromFile("git", sshKeyPath, "")
-	// 	if err != nil {
-	// 		err = fmt.Errorf("push.Publish: failed to obtain ssh private key from %s: %w", sshKeyPath, err)
-	// 		return
-	// 	}
-	// 	println("Picked up key", sshKeyPath, auth.String())
-	// }
-
-	// println("Pushing to remote", rm.Config().Name, rm.Config().URLs)
-	// err = rm.Push(&git.PushOptions{
-	// 	RemoteName: rm.Config().Name,
-	// 	RefSpecs:   []config.RefSpec{refspec},
-	// 	Auth:       auth,
-	// })
-	// if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
-	// 	err = fmt.Errorf("push.Publish: failed to push to remote %s: %w", rm.Config().Name, err)
-	// 	return
-	// }
-
-	// go-git cannot pick up the correct user/SSH public key to push! Bruh!
-	var output []byte
-	if prePush {
-		pushCmd := exec.Command("git", "push")
-		pushCmd.Dir = pkg.Root
-		if output, err = pushCmd.CombinedOutput(); err != nil {
-			err = fmt.Errorf("push.Publish: failed to push to remote: %w, stderr: %s", err, string(output))
-			return
-		}
+	// The last argument is a base64-encoded message shown by the build
+	// server.
+	message := "by autobuild"
+	if details := meta.String(); details != "" {
+		message += "\n\n" + details
 	}
 
-	args := []string{
-		fmt.Sprintf("%s@%s", user, host),
+	args := b.sshArgs(
 		"build",
 		pkg.Name,
-		fmt.Sprintf("%s-%s-%d", pkg.Name, pkg.Version, pkg.Release),
-		relp,
-		ref.Hash().String(),
-		"YnkgYXV0b2J1aWxk", // "by autobuild"
-	}
+		src.Tag,
+		src.Path,
+		src.Ref,
+		base64.StdEncoding.EncodeToString([]byte(message)),
+	)
 	cmd := exec.Command("ssh", args...)
-	if output, err = cmd.Output(); err != nil {
-		err = fmt.Errorf("push.Publish: failed to publish package %s using args %q: %w", pkg.Name, args, err)
+	output, err := cmd.Output()
+	if err != nil {
+		err = sshError(fmt.Errorf("push.SolusBuilder.Publish: failed to publish package %s using args %q: %w", pkg.Name, args, err))
 		return
 	}
 
 	if err = json.Unmarshal(output, &job); err != nil {
-		err = fmt.Errorf("push.Publish: failed to unmarshall json output to job: %w", err)
+		err = fmt.Errorf("push.SolusBuilder.Publish: failed to unmarshall json output to job: %w", err)
 		return
 	}
 
 	return
 }
 
-func Query(jobid int) (job Job, err error) {
-	args := []string{
-		fmt.Sprintf("%s@%s", user, host),
-		"query",
-		fmt.Sprint(jobid),
-	}
+func (b *SolusBuilder) Query(jobid int) (job Job, err error) {
+	args := b.sshArgs("query", fmt.Sprint(jobid))
 	cmd := exec.Command("ssh", args...)
 	output, err := cmd.Output()
 	if err != nil {
-		err = fmt.Errorf("Failed to query job %d using args %q: %w", jobid, args, err)
+		err = sshError(fmt.Errorf("Failed to query job %d using args %q: %w", jobid, args, err))
 		return
 	}
 
@@ -143,3 +110,18 @@ func Query(jobid int) (job Job, err error) {
 
 	return
 }
+
+// Ping checks that the build server can be reached, and accepts the SSH key.
+// The command it runs doesn't matter, since only failures of ssh itself exit
+// with 255.
+func (b *SolusBuilder) Ping() error {
+	args := append([]string{"-o", "BatchMode=yes", "-o", "ConnectTimeout=10"}, b.sshArgs("query", "0")...)
+	output, err := exec.Command("ssh", args...).CombinedOutput()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 255 {
+		return fmt.Errorf("push.SolusBuilder.Ping: failed to connect to %s: %s", b.Target(), strings.TrimSpace(string(output)))
+	} else if err != nil && exitErr == nil {
+		return fmt.Errorf("push.SolusBuilder.Ping: failed to run ssh: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,234 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package push
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/GZGavinZhao/autobuild/common"
+	"github.com/GZGavinZhao/autobuild/config"
+)
+
+const (
+	DefaultGitHubURL      = "https://api.github.com"
+	DefaultGitHubWorkflow = "build.yml"
+	DefaultCIRef          = "main"
+)
+
+// githubFindAttempts and githubFindDelay are how many times, and how often,
+// the runs of the workflow are listed to find a dispatched run, which GitHub
+// creates asynchronously.
+const (
+	githubFindAttempts = 10
+	githubFindDelay    = 3 * time.Second
+)
+
+// GitHubBuilder builds every package in a run of a workflow of GitHub Actions,
+// dispatched with the package as its inputs. The workflow must name its runs
+// after the tag and the dispatch ID of the package, so that they can be found
+// once dispatched.
+type GitHubBuilder struct {
+	client   *httpClient
+	workflow string
+	ref      string
+}
+
+func newGitHubBuilder(cfg config.CIConfig) (*GitHubBuilder, error) {
+	if cfg.Repository == "" {
+		return nil, errors.New("push.NewBuilder: the github backend requires push.github.repository to be configured")
+	}
+	b := &GitHubBuilder{workflow: cfg.Workflow, ref: cfg.Ref}
+	if cfg.URL == "" {
+		cfg.URL = DefaultGitHubURL
+	}
+	if b.workflow == "" {
+		b.workflow = DefaultGitHubWorkflow
+	}
+	if b.ref == "" {
+		b.ref = DefaultCIRef
+	}
+
+	client, err := newHTTPClient("github", config.HTTPBackendConfig{URL: cfg.URL, Headers: cfg.Headers})
+	if err != nil {
+		return nil, err
+	}
+	client.url += "/repos/" + cfg.Repository
+	b.client = client
+	return b, nil
+}
+
+type githubDispatch struct {
+	Ref    string            `json:"ref"`
+	Inputs map[string]string `json:"inputs"`
+	// ReturnRunDetails asks GitHub to respond with the run, instead of
+	// having to find it.
+	ReturnRunDetails bool `json:"return_run_details"`
+}
+
+type githubDispatchResult struct {
+	WorkflowRunID int `json:"workflow_run_id"`
+}
+
+type githubRun struct {
+	ID           int    `json:"id"`
+	DisplayTitle string `json:"display_title"`
+	Status       string `json:"status"`
+	Conclusion   string `json:"conclusion"`
+}
+
+type githubRuns struct {
+	WorkflowRuns []githubRun `json:"workflow_runs"`
+}
+
+// job converts a run to a job, mapping the statuses and conclusions of GitHub
+// to the statuses of the Solus build server. Runs are named after the tag of
+// their package.
+func (r githubRun) job() Job {
+	job := Job{ID: r.ID}
+	if fields := strings.Fields(r.DisplayTitle); len(fields) != 0 {
+		job.Tag = fields[0]
+		job.Pkg = tagPackage(job.Tag)
+	}
+
+	switch r.Status {
+	case "requested", "queued", "pending", "waiting":
+		job.Status = StatusUnclaimed
+	case "in_progress":
+		job.Status = StatusBuilding
+	case "completed":
+		switch r.Conclusion {
+		case "success":
+			job.Status = StatusOK
+		case "cancelled":
+			job.Status = StatusCancelled
+		default:
+			job.Status = StatusFailed
+		}
+	default:
+		job.Status = strings.ToUpper(r.Status)
+	}
+	return job
+}
+
+// newDispatchID returns a random ID that tells dispatched runs apart.
+func newDispatchID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (b *GitHubBuilder) Name() string {
+	return "github"
+}
+
+func (b *GitHubBuilder) Target() string {
+	return b.client.url
+}
+
+func (b *GitHubBuilder) Publish(pkg common.Package, meta Metadata) (job Job, err error) {
+	src, err := resolveSource(pkg)
+	if err != nil {
+		return
+	}
+	if meta.Commit == "" {
+		meta.Commit = src.Ref
+	}
+	rawMeta, err := json.Marshal(meta)
+	if err != nil {
+		return
+	}
+
+	dispatchID := newDispatchID()
+	req := githubDispatch{Ref: b.ref, Inputs: make(map[string]string), ReturnRunDetails: true}
+	for _, input := range ciInputs(pkg, src.Path) {
+		req.Inputs[input[0]] = input[1]
+	}
+	req.Inputs["commit"], req.Inputs["metadata"], req.Inputs["dispatch_id"] = src.Ref, string(rawMeta), dispatchID
+	dispatched := time.Now()
+	var res githubDispatchResult
+	if err = b.client.post(fmt.Sprintf("/actions/workflows/%s/dispatches", url.PathEscape(b.workflow)), "", req, &res); err != nil {
+		err = fmt.Errorf("push.GitHubBuilder.Publish: failed to dispatch %s for package %s: %w", b.workflow, pkg.Name, err)
+		return
+	}
+	if res.WorkflowRunID != 0 {
+		return b.Query(res.WorkflowRunID)
+	}
+
+	run, err := b.findRun(dispatchID, dispatched)
+	if err != nil {
+		err = fmt.Errorf("push.GitHubBuilder.Publish: dispatched %s for package %s, but: %w", b.workflow, pkg.Name, err)
+		return
+	}
+	return run.job(), nil
+}
+
+// findRun returns the run of the workflow whose name holds `dispatchID`,
+// dispatched at `dispatched`.
+func (b *GitHubBuilder) findRun(dispatchID string, dispatched time.Time) (run githubRun, err error) {
+	// The clocks of GitHub and ours may be a bit apart.
+	created := url.QueryEscape(">=" + dispatched.UTC().Add(-time.Minute).Format(time.RFC3339))
+	path := fmt.Sprintf("/actions/workflows/%s/runs?event=workflow_dispatch&branch=%s&created=%s&per_page=100", url.PathEscape(b.workflow), url.QueryEscape(b.ref), created)
+	for attempt := 0; attempt < githubFindAttempts; attempt++ {
+		time.Sleep(githubFindDelay)
+		var runs githubRuns
+		if err = b.client.get(path, &runs); err != nil {
+			return
+		}
+		for _, run := range runs.WorkflowRuns {
+			if strings.Contains(run.DisplayTitle, dispatchID) {
+				return run, nil
+			}
+		}
+	}
+	err = fmt.Errorf("no run is named after dispatch %s, does the run-name of the workflow hold inputs.dispatch_id?", dispatchID)
+	return
+}
+
+func (b *GitHubBuilder) Query(jobid int) (job Job, err error) {
+	var run githubRun
+	if err = b.client.get(fmt.Sprintf("/actions/runs/%d", jobid), &run); err != nil {
+		err = fmt.Errorf("push.GitHubBuilder.Query: failed to query run %d: %w", jobid, err)
+		return
+	}
+	return run.job(), nil
+}
+
+func (b *GitHubBuilder) Cancel(jobid int) (job Job, err error) {
+	if err = b.client.post(fmt.Sprintf("/actions/runs/%d/cancel", jobid), "", nil, nil); err != nil {
+		err = fmt.Errorf("push.GitHubBuilder.Cancel: failed to cancel run %d: %w", jobid, err)
+		return
+	}
+	return b.Query(jobid)
+}
+
+// Requeue runs all the jobs of the run again, which keeps its ID.
+func (b *GitHubBuilder) Requeue(jobid int) (job Job, err error) {
+	if err = b.client.post(fmt.Sprintf("/actions/runs/%d/rerun", jobid), "", nil, nil); err != nil {
+		err = fmt.Errorf("push.GitHubBuilder.Requeue: failed to re-run run %d: %w", jobid, err)
+		return
+	}
+	return b.Query(jobid)
+}
+
+func (b *GitHubBuilder) Queue() (jobs []Job, err error) {
+	for _, status := range []string{"queued", "in_progress"} {
+		var runs githubRuns
+		if err = b.client.get(fmt.Sprintf("/actions/workflows/%s/runs?status=%s&per_page=100", url.PathEscape(b.workflow), status), &runs); err != nil {
+			err = fmt.Errorf("push.GitHubBuilder.Queue: failed to list %s runs: %w", status, err)
+			return
+		}
+		for _, run := range runs.WorkflowRuns {
+			jobs = append(jobs, run.job())
+		}
+	}
+	return
+}
@@ -0,0 +1,172 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package push
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/GZGavinZhao/autobuild/common"
+	"github.com/GZGavinZhao/autobuild/config"
+)
+
+const DefaultGitLabURL = "https://gitlab.com"
+
+// GitLabBuilder builds every package in a pipeline of GitLab CI, created with
+// the package in AUTOBUILD_* variables. Pipelines should be named after the
+// tag of their package, with `workflow:name`, for their jobs to be recognized
+// in the queue.
+type GitLabBuilder struct {
+	client *httpClient
+	ref    string
+}
+
+func newGitLabBuilder(cfg config.CIConfig) (*GitLabBuilder, error) {
+	if cfg.Repository == "" {
+		return nil, errors.New("push.NewBuilder: the gitlab backend requires push.gitlab.repository to be configured")
+	}
+	b := &GitLabBuilder{ref: cfg.Ref}
+	if cfg.URL == "" {
+		cfg.URL = DefaultGitLabURL
+	}
+	if b.ref == "" {
+		b.ref = DefaultCIRef
+	}
+
+	client, err := newHTTPClient("gitlab", config.HTTPBackendConfig{URL: cfg.URL, Headers: cfg.Headers})
+	if err != nil {
+		return nil, err
+	}
+	client.url += "/api/v4/projects/" + url.PathEscape(cfg.Repository)
+	b.client = client
+	return b, nil
+}
+
+type gitlabVariable struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type gitlabPipelineRequest struct {
+	Ref       string           `json:"ref"`
+	Variables []gitlabVariable `json:"variables"`
+}
+
+type gitlabPipeline struct {
+	ID     int    `json:"id"`
+	Name   string `json:"name"`
+	Status string `json:"status"`
+}
+
+// job converts a pipeline to a job, mapping the statuses of GitLab to the
+// ones of the Solus build server.
+func (p gitlabPipeline) job() Job {
+	job := Job{ID: p.ID, Tag: p.Name, Pkg: tagPackage(p.Name)}
+
+	switch p.Status {
+	case "created", "waiting_for_resource", "preparing", "pending", "scheduled", "manual":
+		job.Status = StatusUnclaimed
+	case "running":
+		job.Status = StatusBuilding
+	case "success":
+		job.Status = StatusOK
+	case "failed", "skipped":
+		job.Status = StatusFailed
+	case "canceled", "canceling":
+		job.Status = StatusCancelled
+	default:
+		job.Status = strings.ToUpper(p.Status)
+	}
+	return job
+}
+
+func (b *GitLabBuilder) Name() string {
+	return "gitlab"
+}
+
+func (b *GitLabBuilder) Target() string {
+	return b.client.url
+}
+
+func (b *GitLabBuilder) Publish(pkg common.Package, meta Metadata) (job Job, err error) {
+	src, err := resolveSource(pkg)
+	if err != nil {
+		return
+	}
+	if meta.Commit == "" {
+		meta.Commit = src.Ref
+	}
+	rawMeta, err := json.Marshal(meta)
+	if err != nil {
+		return
+	}
+
+	req := gitlabPipelineRequest{Ref: b.ref}
+	for _, variable := range ciVariables(pkg, src.Path) {
+		req.Variables = append(req.Variables, gitlabVariable{Key: variable[0], Value: variable[1]})
+	}
+	req.Variables = append(req.Variables,
+		gitlabVariable{Key: "AUTOBUILD_COMMIT", Value: src.Ref},
+		gitlabVariable{Key: "AUTOBUILD_METADATA", Value: string(rawMeta)},
+	)
+
+	var pipeline gitlabPipeline
+	if err = b.client.post("/pipeline", "", req, &pipeline); err != nil {
+		err = fmt.Errorf("push.GitLabBuilder.Publish: failed to create a pipeline for package %s: %w", pkg.Name, err)
+		return
+	}
+	// The name is only set once the pipeline is configured.
+	if pipeline.Name == "" {
+		pipeline.Name = src.Tag
+	}
+	return pipeline.job(), nil
+}
+
+func (b *GitLabBuilder) Query(jobid int) (job Job, err error) {
+	var pipeline gitlabPipeline
+	if err = b.client.get("/pipelines/"+strconv.Itoa(jobid), &pipeline); err != nil {
+		err = fmt.Errorf("push.GitLabBuilder.Query: failed to query pipeline %d: %w", jobid, err)
+		return
+	}
+	return pipeline.job(), nil
+}
+
+func (b *GitLabBuilder) Cancel(jobid int) (job Job, err error) {
+	var pipeline gitlabPipeline
+	if err = b.client.post(fmt.Sprintf("/pipelines/%d/cancel", jobid), "", nil, &pipeline); err != nil {
+		err = fmt.Errorf("push.GitLabBuilder.Cancel: failed to cancel pipeline %d: %w", jobid, err)
+		return
+	}
+	return pipeline.job(), nil
+}
+
+// Requeue retries the failed and cancelled jobs of the pipeline, which keeps
+// its ID.
+func (b *GitLabBuilder) Requeue(jobid int) (job Job, err error) {
+	var pipeline gitlabPipeline
+	if err = b.client.post(fmt.Sprintf("/pipelines/%d/retry", jobid), "", nil, &pipeline); err != nil {
+		err = fmt.Errorf("push.GitLabBuilder.Requeue: failed to retry pipeline %d: %w", jobid, err)
+		return
+	}
+	return pipeline.job(), nil
+}
+
+func (b *GitLabBuilder) Queue() (jobs []Job, err error) {
+	for _, scope := range []string{"pending", "running"} {
+		var pipelines []gitlabPipeline
+		if err = b.client.get(fmt.Sprintf("/pipelines?scope=%s&ref=%s&per_page=100", scope, url.QueryEscape(b.ref)), &pipelines); err != nil {
+			err = fmt.Errorf("push.GitLabBuilder.Queue: failed to list %s pipelines: %w", scope, err)
+			return
+		}
+		for _, pipeline := range pipelines {
+			jobs = append(jobs, pipeline.job())
+		}
+	}
+	return
+}
@@ -0,0 +1,174 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package push
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// HistoryRecord records a push once it is done.
+type HistoryRecord struct {
+	Batch    string    `json:"batch"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	User     string    `json:"user"`
+	// Old and New are the TPaths that were diffed.
+	Old string `json:"old"`
+	New string `json:"new"`
+	// Targets are the build servers that were published to.
+	Targets  []HistoryTarget  `json:"targets"`
+	Packages []HistoryPackage `json:"packages"`
+}
+
+type HistoryTarget struct {
+	// Name is the name of the target in the configuration, if any.
+	Name    string `json:"name,omitempty"`
+	Backend string `json:"backend"`
+	Target  string `json:"target"`
+	// Error is why publishing to the target stopped early, if it did.
+	Error string `json:"error,omitempty"`
+}
+
+type HistoryPackage struct {
+	Name    string       `json:"name"`
+	Version string       `json:"version"`
+	Release int          `json:"release"`
+	Old     *PlanVersion `json:"old,omitempty"`
+	// Jobs holds the job of the package on every target, in the order of
+	// HistoryRecord.Targets.
+	Jobs []HistoryJob `json:"jobs"`
+}
+
+type HistoryJob struct {
+	// ID is 0 if the package wasn't published.
+	ID      int    `json:"id,omitempty"`
+	Status  string `json:"status,omitempty"`
+	Outcome string `json:"outcome"`
+}
+
+// HistoryPath returns the path to the push history, usually
+// `~/.local/share/autobuild/history.jsonl`.
+func HistoryPath() (string, error) {
+	dir := os.Getenv("XDG_DATA_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(home, ".local", "share")
+	}
+	return filepath.Join(dir, "autobuild", "history.jsonl"), nil
+}
+
+// AppendHistory appends `record` to the history at `path`, creating it if
+// needed.
+//
+// The history is a JSON Lines file rather than a database such as SQLite or
+// bbolt: a push only ever appends one record, and every reader (history,
+// bisect-rebuild, repush) reads all of it, so a database would only add a
+// dependency, and cgo for SQLite, in exchange for a file that jq and grep can't
+// read. Concurrent pushes are serialized by an exclusive flock on the file, as
+// records of large pushes don't fit in one atomic write, and readers take a
+// shared one, so that they never see half a record.
+func AppendHistory(path string, record HistoryRecord) error {
+	raw, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("push.AppendHistory: failed to create history directory: %w", err)
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("push.AppendHistory: failed to open history %s: %w", path, err)
+	}
+	defer file.Close()
+	if err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
+		return fmt.Errorf("push.AppendHistory: failed to lock history %s: %w", path, err)
+	}
+
+	// A push that died while writing its record left half a line, which is
+	// dropped rather than appended to.
+	end, err := historyEnd(file)
+	if err == nil {
+		err = file.Truncate(end)
+	}
+	if err != nil {
+		return fmt.Errorf("push.AppendHistory: failed to repair history %s: %w", path, err)
+	}
+
+	if _, err = file.Write(append(raw, '\n')); err != nil {
+		return fmt.Errorf("push.AppendHistory: failed to write history %s: %w", path, err)
+	}
+	if err = file.Sync(); err != nil {
+		return fmt.Errorf("push.AppendHistory: failed to sync history %s: %w", path, err)
+	}
+	return nil
+}
+
+// historyEnd returns the offset in `file` right after its last complete line.
+func historyEnd(file *os.File) (int64, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	buf := make([]byte, 64*1024)
+	for end := info.Size(); end > 0; end -= int64(len(buf)) {
+		start := max(end-int64(len(buf)), 0)
+		chunk := buf[:end-start]
+		if _, err = file.ReadAt(chunk, start); err != nil {
+			return 0, err
+		}
+		if idx := bytes.LastIndexByte(chunk, '\n'); idx >= 0 {
+			return start + int64(idx) + 1, nil
+		}
+	}
+	return 0, nil
+}
+
+// LoadHistory loads the history at `path`, oldest push first. A missing
+// history is empty. A truncated last record, from a push that died while
+// writing it, is ignored.
+func LoadHistory(path string) (records []HistoryRecord, err error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("push.LoadHistory: failed to open history %s: %w", path, err)
+	}
+	defer file.Close()
+	if err = syscall.Flock(int(file.Fd()), syscall.LOCK_SH); err != nil {
+		return nil, fmt.Errorf("push.LoadHistory: failed to lock history %s: %w", path, err)
+	}
+
+	raw, err := io.ReadAll(file)
+	if err != nil {
+		return nil, fmt.Errorf("push.LoadHistory: failed to read history %s: %w", path, err)
+	}
+	lines := bytes.Split(raw, []byte("\n"))
+	for lineNo, line := range lines {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var record HistoryRecord
+		if err = json.Unmarshal(line, &record); err != nil {
+			if lineNo == len(lines)-1 {
+				break
+			}
+			return nil, fmt.Errorf("push.LoadHistory: failed to parse line %d of history %s: %w", lineNo+1, path, err)
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
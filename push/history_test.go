@@ -0,0 +1,88 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package push
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// bigRecord returns a record of a push of `n` packages, whose JSON is much
+// larger than what one write is guaranteed to append atomically.
+func bigRecord(batch string, n int) HistoryRecord {
+	record := HistoryRecord{Batch: batch}
+	for i := 0; i < n; i++ {
+		record.Packages = append(record.Packages, HistoryPackage{Name: fmt.Sprintf("%s-%d", batch, i), Version: "1.0", Release: 1, Jobs: []HistoryJob{{ID: i, Outcome: "succeeded"}}})
+	}
+	return record
+}
+
+func TestAppendHistoryConcurrent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := AppendHistory(path, bigRecord(fmt.Sprintf("b%d", i), 2000)); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	records, err := LoadHistory(path)
+	if err != nil {
+		t.Fatalf("LoadHistory(): %s", err)
+	}
+	if len(records) != 8 {
+		t.Fatalf("LoadHistory() has %d records, want 8", len(records))
+	}
+	for _, record := range records {
+		if len(record.Packages) != 2000 {
+			t.Errorf("record %s has %d packages, want 2000", record.Batch, len(record.Packages))
+		}
+	}
+}
+
+func TestHistoryTruncatedRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	if err := AppendHistory(path, HistoryRecord{Batch: "b1"}); err != nil {
+		t.Fatal(err)
+	}
+	// The push of b2 died while writing its record.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"batch":"b2","packages":[{"na`)
+	f.Close()
+
+	batches := func() string {
+		t.Helper()
+		records, err := LoadHistory(path)
+		if err != nil {
+			t.Fatalf("LoadHistory(): %s", err)
+		}
+		var res []string
+		for _, record := range records {
+			res = append(res, record.Batch)
+		}
+		return strings.Join(res, ",")
+	}
+	if got := batches(); got != "b1" {
+		t.Errorf("LoadHistory() with a truncated record = %s, want b1", got)
+	}
+	if err = AppendHistory(path, HistoryRecord{Batch: "b3"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := batches(); got != "b1,b3" {
+		t.Errorf("LoadHistory() after appending = %s, want b1,b3", got)
+	}
+}
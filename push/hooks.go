@@ -0,0 +1,240 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package push
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"slices"
+	"time"
+
+	"github.com/GZGavinZhao/autobuild/common"
+	"github.com/GZGavinZhao/autobuild/config"
+)
+
+// Events that hooks run on.
+const (
+	HookPrePublish  = "pre-publish"
+	HookPostPublish = "post-publish"
+	HookBatchStart  = "batch-start"
+	HookBatchEnd    = "batch-end"
+	HookWaveEnd     = "wave-end"
+)
+
+// HookPayload is the JSON document that hooks receive.
+type HookPayload struct {
+	Event   string `json:"event"`
+	Backend string `json:"backend"`
+	Target  string `json:"target"`
+	Batch   string `json:"batch,omitempty"`
+	// Package and Metadata are set for the publish events.
+	Package  *HookPackage `json:"package,omitempty"`
+	Metadata *Metadata    `json:"metadata,omitempty"`
+	// Job is set after a package was published, and Error after it failed to
+	// publish.
+	Job   *Job   `json:"job,omitempty"`
+	Error string `json:"error,omitempty"`
+	// Packages is set for the batch events, in build order, and for
+	// wave-end, with the packages of the wave.
+	Packages []HookPackage `json:"packages,omitempty"`
+	// Wave is the 1-based wave that ended, for wave-end.
+	Wave int `json:"wave,omitempty"`
+	// Targets is set for the batch events, which run once for all the build
+	// servers of a push. Backend and Target are only set along with it when
+	// there is a single one.
+	Targets []HookTarget `json:"targets,omitempty"`
+}
+
+// HookTarget is a build server that a batch is published to.
+type HookTarget struct {
+	Backend string `json:"backend"`
+	Target  string `json:"target"`
+	// Error is the error that stopped the push to the build server, at
+	// batch-end.
+	Error string `json:"error,omitempty"`
+}
+
+type HookPackage struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Release int    `json:"release"`
+	Path    string `json:"path"`
+	// Outcome is the outcome of the package at the end of the batch or the
+	// wave. At the end of a batch published to several build servers, it is
+	// the worst of its outcomes, see worseOutcome.
+	Outcome string `json:"outcome,omitempty"`
+}
+
+func newHookPackage(pkg common.Package) HookPackage {
+	return HookPackage{Name: pkg.Name, Version: pkg.Version, Release: pkg.Release, Path: pkg.Path}
+}
+
+// Hook is a command or an HTTP endpoint that is notified of an event.
+type Hook interface {
+	Run(payload HookPayload) error
+}
+
+// CommandHook runs a shell command, with the payload on its stdin and the
+// event in the `AUTOBUILD_HOOK_EVENT` environment variable. Its output goes to
+// stderr, and it fails if the command exits with a non-zero status.
+type CommandHook struct {
+	Command string
+}
+
+func (h *CommandHook) Run(payload HookPayload) error {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command("sh", "-c", h.Command)
+	cmd.Stdin = bytes.NewReader(raw)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), "AUTOBUILD_HOOK_EVENT="+payload.Event)
+	if err = cmd.Run(); err != nil {
+		return fmt.Errorf("%s hook %q failed: %w", payload.Event, h.Command, err)
+	}
+	return nil
+}
+
+// HTTPHook POSTs the payload to an URL. It fails if the response status isn't
+// successful.
+type HTTPHook struct {
+	client *httpClient
+}
+
+func (h *HTTPHook) Run(payload HookPayload) error {
+	if err := h.client.post("", "", payload, nil); err != nil {
+		return fmt.Errorf("%s hook %s failed: %w", payload.Event, h.client.url, err)
+	}
+	return nil
+}
+
+// Hooks holds the hooks of every event.
+type Hooks struct {
+	PrePublish  []Hook
+	PostPublish []Hook
+	BatchStart  []Hook
+	BatchEnd    []Hook
+	WaveEnd     []Hook
+}
+
+// NewHooks creates the hooks configured by `cfg`.
+func NewHooks(cfg config.HooksConfig) (hooks Hooks, err error) {
+	for _, event := range []struct {
+		hooks *[]Hook
+		cfgs  []config.HookConfig
+	}{
+		{&hooks.PrePublish, cfg.PrePublish},
+		{&hooks.PostPublish, cfg.PostPublish},
+		{&hooks.BatchStart, cfg.BatchStart},
+		{&hooks.BatchEnd, cfg.BatchEnd},
+		{&hooks.WaveEnd, cfg.WaveEnd},
+	} {
+		for _, hookCfg := range event.cfgs {
+			switch {
+			case hookCfg.Command != "" && hookCfg.URL != "":
+				return hooks, errors.New("push.NewHooks: a hook can't have both a command and a url")
+			case hookCfg.Command != "":
+				*event.hooks = append(*event.hooks, &CommandHook{Command: hookCfg.Command})
+			case hookCfg.URL != "":
+				client := &httpClient{
+					url:     hookCfg.URL,
+					headers: make(map[string]string, len(hookCfg.Headers)),
+					client:  &http.Client{Timeout: 30 * time.Second},
+				}
+				for k, v := range hookCfg.Headers {
+					client.headers[http.CanonicalHeaderKey(k)] = v
+				}
+				*event.hooks = append(*event.hooks, &HTTPHook{client: client})
+			default:
+				return hooks, errors.New("push.NewHooks: a hook needs either a command or a url")
+			}
+		}
+	}
+	return
+}
+
+// runHooks runs `hooks` in order, and stops at the first one that fails.
+func runHooks(hooks []Hook, payload HookPayload) error {
+	for _, hook := range hooks {
+		if err := hook.Run(payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// batchPayload returns the payload of the batch event `event` of a push of
+// `pkgs` to `builders`.
+func batchPayload(event string, batch string, builders []Builder, pkgs []common.Package) HookPayload {
+	payload := HookPayload{Event: event, Batch: batch}
+	for _, builder := range builders {
+		payload.Targets = append(payload.Targets, HookTarget{Backend: builder.Name(), Target: builder.Target()})
+	}
+	if len(builders) == 1 {
+		payload.Backend, payload.Target = builders[0].Name(), builders[0].Target()
+	}
+	for _, pkg := range pkgs {
+		payload.Packages = append(payload.Packages, newHookPackage(pkg))
+	}
+	return payload
+}
+
+// StartBatch runs the batch-start hooks once for a push of `pkgs` to all of
+// `builders`. Nothing should be published if it fails.
+func (h Hooks) StartBatch(batch string, builders []Builder, pkgs []common.Package) error {
+	if err := runHooks(h.BatchStart, batchPayload(HookBatchStart, batch, builders, pkgs)); err != nil {
+		return fmt.Errorf("push.Hooks.StartBatch: not publishing: %w", err)
+	}
+	return nil
+}
+
+// EndBatch runs the batch-end hooks once the pipelines of all of `builders`
+// ended, with their results and errors.
+func (h Hooks) EndBatch(batch string, builders []Builder, pkgs []common.Package, results []Result, errs []error) error {
+	payload := batchPayload(HookBatchEnd, batch, builders, pkgs)
+	outcomes := make([]Outcome, len(pkgs))
+	for tIdx, result := range results {
+		for idx, outcome := range result.Outcomes {
+			if tIdx == 0 {
+				outcomes[idx] = outcome
+			} else {
+				outcomes[idx] = worseOutcome(outcomes[idx], outcome)
+			}
+		}
+		if errs[tIdx] != nil {
+			payload.Targets[tIdx].Error = errs[tIdx].Error()
+		}
+	}
+	for idx := range payload.Packages {
+		payload.Packages[idx].Outcome = outcomes[idx].String()
+	}
+	if err := errors.Join(errs...); err != nil {
+		payload.Error = err.Error()
+	}
+	if err := runHooks(h.BatchEnd, payload); err != nil {
+		return fmt.Errorf("push.Hooks.EndBatch: %w", err)
+	}
+	return nil
+}
+
+// worseOutcome returns the worse of two outcomes of a package: failing to
+// build is worse than being blocked, which is worse than not being built yet.
+func worseOutcome(a Outcome, b Outcome) Outcome {
+	rank := func(o Outcome) int {
+		return slices.Index([]Outcome{Succeeded, Published, Pending, Blocked, Failed}, o)
+	}
+	if rank(b) > rank(a) {
+		return b
+	}
+	return a
+}
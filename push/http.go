@@ -0,0 +1,257 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package push
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/GZGavinZhao/autobuild/common"
+	"github.com/GZGavinZhao/autobuild/config"
+)
+
+// StatusError is the error of an HTTP request that the server responded to
+// with an unsuccessful status.
+type StatusError struct {
+	StatusCode int
+	Err        error
+}
+
+func (e *StatusError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *StatusError) Unwrap() error {
+	return e.Err
+}
+
+// httpClient talks JSON to the HTTP API of a build server.
+type httpClient struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+}
+
+// newHTTPClient creates a client for the API of `backend`. Its token, if any,
+// is sent as a bearer token unless the configuration already sets the
+// Authorization header.
+func newHTTPClient(backend string, cfg config.HTTPBackendConfig) (*httpClient, error) {
+	c := &httpClient{
+		url:     strings.TrimSuffix(cfg.URL, "/"),
+		headers: make(map[string]string, len(cfg.Headers)+1),
+		client:  &http.Client{Timeout: 30 * time.Second},
+	}
+	for k, v := range cfg.Headers {
+		c.headers[http.CanonicalHeaderKey(k)] = v
+	}
+
+	if _, ok := c.headers["Authorization"]; !ok {
+		token, _, err := config.LookupToken(backend)
+		if err != nil {
+			return nil, fmt.Errorf("push.newHTTPClient: failed to look up the token of %s: %w", backend, err)
+		}
+		if token != "" {
+			c.headers["Authorization"] = "Bearer " + token
+		}
+	}
+	return c, nil
+}
+
+// post submits `in` (if not nil) as JSON to `path`, with the given
+// idempotency key (if not empty), and decodes the JSON response into `out`
+// (if not nil).
+func (c *httpClient) post(path string, key string, in any, out any) error {
+	var headers map[string]string
+	if key != "" {
+		headers = map[string]string{"Idempotency-Key": key}
+	}
+	return c.do(http.MethodPost, path, headers, in, out)
+}
+
+// get decodes the JSON response of `path` into `out`.
+func (c *httpClient) get(path string, out any) error {
+	return c.do(http.MethodGet, path, nil, nil, out)
+}
+
+// do sends `in` (if not nil) as the JSON body of a `method` request to `path`,
+// and decodes the JSON response into `out`. Network errors, server errors and
+// rate limiting are transient.
+func (c *httpClient) do(method string, path string, headers map[string]string, in any, out any) error {
+	var body io.Reader
+	if in != nil {
+		raw, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(raw)
+	}
+
+	url := c.url + path
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for k, v := range c.headers {
+		req.Header.Set(k, v)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return &TransientError{Err: fmt.Errorf("%s %s failed: %w", method, url, err)}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		err = &StatusError{
+			StatusCode: resp.StatusCode,
+			Err:        fmt.Errorf("%s %s failed with status %s: %s", method, url, resp.Status, strings.TrimSpace(string(msg))),
+		}
+		if resp.StatusCode == http.StatusTooManyRequests {
+			return &TransientError{Err: err, RateLimited: true, RetryAfter: retryAfter(resp.Header.Get("Retry-After"))}
+		} else if resp.StatusCode >= 500 {
+			return &TransientError{Err: err}
+		}
+		return err
+	}
+
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	if err = json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode response of %s %s: %w", method, url, err)
+	}
+	return nil
+}
+
+// retryAfter parses the value of a Retry-After header, which is either a
+// number of seconds or a date.
+func retryAfter(value string) time.Duration {
+	if secs, err := strconv.Atoi(value); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(time.Until(date), 0)
+	}
+	return 0
+}
+
+// WebhookBuilder publishes packages to a generic HTTP endpoint. Builds are
+// submitted by POSTing a JSON object describing the package to the configured
+// URL, and jobs are queried with a GET to `<url>/<job id>`. Both must respond
+// with a job in the same JSON format as the Solus build server. The jobs that
+// are queued or building are listed with a GET to `<url>?status=active`, and
+// removed packages are POSTed to `<url>/removals`.
+type WebhookBuilder struct {
+	client *httpClient
+}
+
+type webhookRequest struct {
+	Package        string   `json:"package"`
+	Version        string   `json:"version"`
+	Release        int      `json:"release"`
+	Tag            string   `json:"tag"`
+	Path           string   `json:"path"`
+	Ref            string   `json:"ref"`
+	IdempotencyKey string   `json:"idempotency_key"`
+	Metadata       Metadata `json:"metadata"`
+}
+
+func (b *WebhookBuilder) Name() string {
+	return "webhook"
+}
+
+func (b *WebhookBuilder) Target() string {
+	return b.client.url
+}
+
+func (b *WebhookBuilder) Idempotent() bool {
+	return true
+}
+
+func (b *WebhookBuilder) Publish(pkg common.Package, meta Metadata) (job Job, err error) {
+	src, err := resolveSource(pkg)
+	if err != nil {
+		return
+	}
+	if meta.Commit == "" {
+		meta.Commit = src.Ref
+	}
+
+	req := webhookRequest{
+		Package: pkg.Name,
+		Version: pkg.Version,
+		Release: pkg.Release,
+		Tag:     src.Tag,
+		Path:    src.Path,
+		Ref:     src.Ref,
+
+		IdempotencyKey: IdempotencyKey(pkg),
+		Metadata:       meta,
+	}
+	if err = b.client.post("", req.IdempotencyKey, req, &job); err != nil {
+		err = fmt.Errorf("push.WebhookBuilder.Publish: failed to publish package %s: %w", pkg.Name, err)
+	}
+	return
+}
+
+func (b *WebhookBuilder) Query(jobid int) (job Job, err error) {
+	if err = b.client.get(fmt.Sprintf("/%d", jobid), &job); err != nil {
+		err = fmt.Errorf("push.WebhookBuilder.Query: failed to query job %d: %w", jobid, err)
+	}
+	return
+}
+
+func (b *WebhookBuilder) Cancel(jobid int) (job Job, err error) {
+	if err = b.client.post(fmt.Sprintf("/%d/cancel", jobid), "", nil, &job); err != nil {
+		err = fmt.Errorf("push.WebhookBuilder.Cancel: failed to cancel job %d: %w", jobid, err)
+	}
+	return
+}
+
+func (b *WebhookBuilder) Requeue(jobid int) (job Job, err error) {
+	if err = b.client.post(fmt.Sprintf("/%d/retry", jobid), "", nil, &job); err != nil {
+		err = fmt.Errorf("push.WebhookBuilder.Requeue: failed to retry job %d: %w", jobid, err)
+	}
+	return
+}
+
+func (b *WebhookBuilder) RegisterBatch(id string, pkgs []common.Package, maxFailures float64, attestation *Attestation) error {
+	if err := b.client.post("/batches", id, newBatchRequest(id, pkgs, maxFailures, attestation), nil); err != nil {
+		return fmt.Errorf("push.WebhookBuilder.RegisterBatch: failed to register batch %s: %w", id, err)
+	}
+	return nil
+}
+
+func (b *WebhookBuilder) Capabilities() (Capabilities, error) {
+	return queryCapabilities(b.client, "/capabilities")
+}
+
+func (b *WebhookBuilder) Queue() (jobs []Job, err error) {
+	if err = b.client.get("?status=active", &jobs); err != nil {
+		err = fmt.Errorf("push.WebhookBuilder.Queue: failed to list active jobs: %w", err)
+	}
+	return
+}
+
+func (b *WebhookBuilder) Remove(pkg common.Package) error {
+	if err := b.client.post("/removals", "", newRemovalRequest(pkg), nil); err != nil {
+		return fmt.Errorf("push.WebhookBuilder.Remove: failed to remove package %s: %w", pkg.Name, err)
+	}
+	return nil
+}
@@ -5,9 +5,20 @@
 package push
 
 import (
+	"strings"
 	"time"
 )
 
+// Statuses of a job as reported by the build server.
+const (
+	StatusUnclaimed = "UNCLAIMED"
+	StatusClaimed   = "CLAIMED"
+	StatusBuilding  = "BUILDING"
+	StatusOK        = "OK"
+	StatusFailed    = "FAILED"
+	StatusCancelled = "CANCELLED"
+)
+
 type Job struct {
 	ID       int        `json:"id"`
 	Pkg      string     `json:"pkg"`
@@ -18,3 +29,38 @@ type Job struct {
 	Path     *string    `json:"path,omitempty"`
 	Ref      *string    `json:"ref,omitempty"`
 }
+
+// Indexed returns whether the job was built successfully and its packages
+// were indexed into the repository.
+func (j Job) Indexed() bool {
+	return j.Status == StatusOK
+}
+
+// Failed returns whether the job failed to build, or ended up in a status that
+// autobuild doesn't know about.
+func (j Job) Failed() bool {
+	switch j.Status {
+	case StatusUnclaimed, StatusClaimed, StatusBuilding, StatusOK:
+		return false
+	}
+	return true
+}
+
+// Phase returns a human-readable name of the status of the job.
+func (j Job) Phase() string {
+	switch j.Status {
+	case StatusUnclaimed:
+		return "queued"
+	case StatusClaimed:
+		return "claimed"
+	case StatusBuilding:
+		return "building"
+	case StatusOK:
+		return "indexed"
+	case StatusFailed:
+		return "failed"
+	case StatusCancelled:
+		return "cancelled"
+	}
+	return strings.ToLower(j.Status)
+}
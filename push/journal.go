@@ -0,0 +1,262 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package push
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/GZGavinZhao/autobuild/common"
+)
+
+// JournalEntry records a package that was published, and the job it was
+// published as.
+type JournalEntry struct {
+	Package string    `json:"package"`
+	Version string    `json:"version"`
+	Release int       `json:"release"`
+	JobID   int       `json:"job_id"`
+	Batch   string    `json:"batch,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// Journal records every package published by a push, one JSON object per
+// line, so that an interrupted push can be resumed from where it stopped.
+// Once the push is done, Finish appends a line without a package, see
+// journalMarker.
+type Journal struct {
+	mu      sync.Mutex
+	file    *os.File
+	entries []JournalEntry
+}
+
+// journalMarker is the line that Journal.Finish appends.
+type journalMarker struct {
+	Finished time.Time `json:"finished"`
+}
+
+// CreateJournal creates a new, empty journal at `path`.
+func CreateJournal(path string) (*Journal, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("push.CreateJournal: failed to create journal %s: %w", path, err)
+	}
+	return &Journal{file: file}, nil
+}
+
+// LoadJournal loads the journal at `path`. New entries are appended to it.
+func LoadJournal(path string) (*Journal, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("push.LoadJournal: failed to open journal %s: %w", path, err)
+	}
+
+	raw, err := io.ReadAll(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("push.LoadJournal: failed to read journal %s: %w", path, err)
+	}
+
+	j := &Journal{file: file}
+	offset := 0
+	for lineNo := 1; offset < len(raw); lineNo++ {
+		line := raw[offset:]
+		end := bytes.IndexByte(line, '\n')
+		if end >= 0 {
+			line = line[:end]
+		}
+
+		var entry JournalEntry
+		if len(bytes.TrimSpace(line)) > 0 {
+			if err := json.Unmarshal(line, &entry); err != nil {
+				// The last line may be truncated if autobuild died while
+				// writing it, in which case the package was never recorded as
+				// published. Drop it so new entries start on a fresh line.
+				if end < 0 {
+					if err = file.Truncate(int64(offset)); err == nil {
+						break
+					}
+				}
+				file.Close()
+				return nil, fmt.Errorf("push.LoadJournal: malformed entry at %s:%d: %w", path, lineNo, err)
+			}
+			// Markers have no package, see journalMarker.
+			if entry.Package != "" {
+				j.entries = append(j.entries, entry)
+			}
+		}
+
+		if end < 0 {
+			// A complete last entry that lacks its newline.
+			if _, err = file.Write([]byte("\n")); err != nil {
+				file.Close()
+				return nil, fmt.Errorf("push.LoadJournal: failed to write journal %s: %w", path, err)
+			}
+			break
+		}
+		offset += end + 1
+	}
+
+	return j, nil
+}
+
+// ReadJournal reads the entries of the journal at `path` without opening it
+// for writing, e.g. to follow the progress of a push that is still running. A
+// truncated last entry is ignored, since it is still being written.
+func ReadJournal(path string) (res []JournalEntry, err error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("push.ReadJournal: failed to read journal %s: %w", path, err)
+	}
+	res, _, err = parseJournal(path, raw)
+	return
+}
+
+// JournalUnfinished reports whether the journal at `path` records packages of
+// a push that never finished, i.e. that died or failed halfway through and is
+// to be resumed, see Journal.Finish. A journal that doesn't exist isn't.
+func JournalUnfinished(path string) (bool, error) {
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("push.JournalUnfinished: failed to read journal %s: %w", path, err)
+	}
+	entries, finished, err := parseJournal(path, raw)
+	return len(entries) != 0 && !finished, err
+}
+
+// parseJournal parses the journal `raw` read from `path`, ignoring a
+// truncated last entry, and reports whether it ends with a marker.
+func parseJournal(path string, raw []byte) (res []JournalEntry, finished bool, err error) {
+	lines := bytes.Split(raw, []byte("\n"))
+	for lineNo, line := range lines {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var entry JournalEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			if lineNo == len(lines)-1 {
+				break
+			}
+			return nil, false, fmt.Errorf("push.ReadJournal: malformed entry at %s:%d: %w", path, lineNo+1, err)
+		}
+		if finished = entry.Package == ""; !finished {
+			res = append(res, entry)
+		}
+	}
+	return
+}
+
+// Record appends an entry for `pkg` published as `job` in `batch` to the
+// journal, and syncs it to disk.
+func (j *Journal) Record(pkg common.Package, job Job, batch string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	entry := JournalEntry{
+		Package: pkg.Name,
+		Version: pkg.Version,
+		Release: pkg.Release,
+		JobID:   job.ID,
+		Batch:   batch,
+		Time:    time.Now(),
+	}
+
+	raw, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err = j.file.Write(append(raw, '\n')); err != nil {
+		return fmt.Errorf("push.Journal.Record: failed to write entry for %s: %w", pkg.Name, err)
+	}
+	if err = j.file.Sync(); err != nil {
+		return fmt.Errorf("push.Journal.Record: failed to sync journal: %w", err)
+	}
+
+	j.entries = append(j.entries, entry)
+	return nil
+}
+
+// Finish records that the push is done with the journal, so that the next
+// push may replace it, see JournalUnfinished. Resuming from the journal
+// afterwards still works, and makes it unfinished again once it records a
+// package.
+func (j *Journal) Finish() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	raw, err := json.Marshal(journalMarker{Finished: time.Now()})
+	if err != nil {
+		return err
+	}
+	if _, err = j.file.Write(append(raw, '\n')); err != nil {
+		return fmt.Errorf("push.Journal.Finish: failed to write the marker: %w", err)
+	}
+	if err = j.file.Sync(); err != nil {
+		return fmt.Errorf("push.Journal.Finish: failed to sync journal: %w", err)
+	}
+	return nil
+}
+
+// Published returns the latest entry of `pkg` if this exact version and
+// release of it was already published.
+func (j *Journal) Published(pkg common.Package) (JournalEntry, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	for i := len(j.entries) - 1; i >= 0; i-- {
+		entry := j.entries[i]
+		if entry.Package == pkg.Name && entry.Version == pkg.Version && entry.Release == pkg.Release {
+			return entry, true
+		}
+	}
+	return JournalEntry{}, false
+}
+
+// FindJob returns the entry of the job with the given ID.
+func (j *Journal) FindJob(jobid int) (JournalEntry, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	for _, entry := range j.entries {
+		if entry.JobID == jobid {
+			return entry, true
+		}
+	}
+	return JournalEntry{}, false
+}
+
+// Batch returns the entries of the jobs published in `batch`.
+func (j *Journal) Batch(batch string) (res []JournalEntry) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	for _, entry := range j.entries {
+		if entry.Batch == batch {
+			res = append(res, entry)
+		}
+	}
+	return
+}
+
+// Entries returns all the entries of the journal.
+func (j *Journal) Entries() []JournalEntry {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return append([]JournalEntry(nil), j.entries...)
+}
+
+func (j *Journal) Close() error {
+	return j.file.Close()
+}
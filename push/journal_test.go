@@ -0,0 +1,62 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package push
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestJournalUnfinished(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "journal.jsonl")
+	unfinished := func(want bool) {
+		t.Helper()
+		if got, err := JournalUnfinished(path); err != nil || got != want {
+			t.Errorf("JournalUnfinished() = %t, %v, want %t", got, err, want)
+		}
+	}
+
+	unfinished(false)
+	journal, err := CreateJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unfinished(false)
+	pkgs := testPackages("a", "b")
+	if err = journal.Record(pkgs[0], Job{ID: 1}, "batch"); err != nil {
+		t.Fatal(err)
+	}
+	unfinished(true)
+	if err = journal.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	journal.Close()
+	unfinished(false)
+
+	// Resuming keeps the entries and not the marker, and recording another
+	// package makes the journal unfinished again.
+	if journal, err = LoadJournal(path); err != nil {
+		t.Fatal(err)
+	}
+	defer journal.Close()
+	if entries := journal.Entries(); len(entries) != 1 || entries[0].Package != "a" {
+		t.Errorf("LoadJournal() entries = %+v, want a", entries)
+	}
+	if err = journal.Record(pkgs[1], Job{ID: 2}, "batch"); err != nil {
+		t.Fatal(err)
+	}
+	unfinished(true)
+	if entries, err := ReadJournal(path); err != nil || len(entries) != 2 {
+		t.Errorf("ReadJournal() = %+v, %v, want a and b", entries, err)
+	}
+
+	// Journals of older versions have no marker.
+	if err = os.WriteFile(path, []byte(`{"package":"a","version":"1.0","release":1,"job_id":1}`+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	unfinished(true)
+}
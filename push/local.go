@@ -0,0 +1,220 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package push
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DataDrake/waterlog"
+	"github.com/GZGavinZhao/autobuild/common"
+	"github.com/GZGavinZhao/autobuild/config"
+)
+
+const (
+	DefaultLocalRepo = "/var/lib/solbuild/local"
+	DefaultLocalLogs = "local-builds"
+)
+
+// LocalBuilder builds packages on this machine with solbuild or boulder,
+// instead of publishing them to a remote build server. Builds run one at a
+// time, and their artifacts are collected into a local repository that
+// subsequent builds pick up, so dependents always build against the freshly
+// built dependencies.
+//
+// Publish only returns once the build has finished. Jobs are saved next to
+// their build logs, so they can still be queried when resuming a push.
+type LocalBuilder struct {
+	Repo            string
+	Logs            string
+	SolbuildProfile string
+	BoulderProfile  string
+
+	lastID int
+}
+
+// NewLocalBuilder creates a LocalBuilder configured by `cfg`, creating its
+// repository and log directories if needed.
+func NewLocalBuilder(cfg config.LocalConfig) (b *LocalBuilder, err error) {
+	b = &LocalBuilder{
+		Repo:            cfg.Repo,
+		Logs:            cfg.Logs,
+		SolbuildProfile: cfg.SolbuildProfile,
+		BoulderProfile:  cfg.BoulderProfile,
+	}
+	if b.Repo == "" {
+		b.Repo = DefaultLocalRepo
+	}
+	if b.Logs == "" {
+		b.Logs = DefaultLocalLogs
+	}
+
+	if b.Repo, err = filepath.Abs(b.Repo); err != nil {
+		return nil, fmt.Errorf("push.NewLocalBuilder: %w", err)
+	}
+	for _, dir := range []string{b.Repo, b.Logs} {
+		if err = os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("push.NewLocalBuilder: failed to create %s: %w", dir, err)
+		}
+	}
+
+	// Continue numbering after the jobs of previous pushes.
+	saved, err := filepath.Glob(filepath.Join(b.Logs, "*.json"))
+	if err != nil {
+		return nil, fmt.Errorf("push.NewLocalBuilder: %w", err)
+	}
+	for _, path := range saved {
+		if id, err := strconv.Atoi(strings.TrimSuffix(filepath.Base(path), ".json")); err == nil {
+			b.lastID = max(b.lastID, id)
+		}
+	}
+
+	return b, nil
+}
+
+func (b *LocalBuilder) Name() string {
+	return "local"
+}
+
+func (b *LocalBuilder) Target() string {
+	return b.Repo
+}
+
+func (b *LocalBuilder) Publish(pkg common.Package, meta Metadata) (job Job, err error) {
+	b.lastID++
+	path := pkg.Path
+	job = Job{
+		ID:      b.lastID,
+		Pkg:     pkg.Name,
+		Tag:     fmt.Sprintf("%s-%s-%d", pkg.Name, pkg.Version, pkg.Release),
+		Status:  StatusBuilding,
+		Builder: b.Name(),
+		Path:    &path,
+	}
+	if job, err = b.run(job, meta); err != nil {
+		err = fmt.Errorf("push.LocalBuilder.Publish: %w", err)
+	}
+	return
+}
+
+// Requeue builds the package of a previous job again, as a new job.
+func (b *LocalBuilder) Requeue(jobid int) (job Job, err error) {
+	if job, err = b.Query(jobid); err != nil {
+		return
+	}
+	if job.Path == nil {
+		err = fmt.Errorf("push.LocalBuilder.Requeue: job %d has no recipe path", jobid)
+		return
+	}
+
+	b.lastID++
+	job.ID = b.lastID
+	job.Status = StatusBuilding
+	job.Finished = nil
+	if job, err = b.run(job, Metadata{Reason: fmt.Sprintf("requeue of job %d", jobid)}); err != nil {
+		err = fmt.Errorf("push.LocalBuilder.Requeue: %w", err)
+	}
+	return
+}
+
+// run builds the recipe of `job`, and saves the finished job.
+func (b *LocalBuilder) run(job Job, meta Metadata) (Job, error) {
+	logPath := filepath.Join(b.Logs, fmt.Sprintf("%d.log", job.ID))
+	log, err := os.Create(logPath)
+	if err != nil {
+		return job, fmt.Errorf("failed to create build log for %s: %w", job.Pkg, err)
+	}
+	defer log.Close()
+	if details := meta.String(); details != "" {
+		fmt.Fprintf(log, "%s\n\n", details)
+	}
+
+	waterlog.Infof("Building %s locally, logging to %s\n", job.Tag, logPath)
+	if buildErr := b.build(*job.Path, log); buildErr != nil {
+		fmt.Fprintf(log, "\nautobuild: %s\n", buildErr)
+		waterlog.Warnf("Failed to build %s: %s\n", job.Tag, buildErr)
+		job.Status = StatusFailed
+	} else {
+		job.Status = StatusOK
+	}
+	finished := time.Now()
+	job.Finished = &finished
+
+	return job, b.save(job)
+}
+
+// build builds the recipe at `path` and adds its artifacts to the local
+// repository.
+func (b *LocalBuilder) build(path string, log io.Writer) error {
+	// The builds run in the local repository.
+	recipe, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+
+	var cmds []*exec.Cmd
+	if filepath.Base(recipe) == "stone.yaml" {
+		args := []string{"build", "-o", b.Repo}
+		if b.BoulderProfile != "" {
+			args = append(args, "-p", b.BoulderProfile)
+		}
+		args = append(args, recipe)
+		cmds = append(cmds, exec.Command("boulder", args...), exec.Command("moss", "index", b.Repo))
+	} else {
+		// solbuild puts the built packages in the current directory, and
+		// indexes local repositories itself before every build.
+		args := []string{"build"}
+		if b.SolbuildProfile != "" {
+			args = append(args, "-p", b.SolbuildProfile)
+		}
+		args = append(args, filepath.Join(recipe, "package.yml"))
+		if os.Geteuid() == 0 {
+			cmds = append(cmds, exec.Command("solbuild", args...))
+		} else {
+			cmds = append(cmds, exec.Command("sudo", append([]string{"solbuild"}, args...)...))
+		}
+	}
+
+	for _, cmd := range cmds {
+		cmd.Dir = b.Repo
+		cmd.Stdout = log
+		cmd.Stderr = log
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("`%s` failed: %w", strings.Join(cmd.Args, " "), err)
+		}
+	}
+	return nil
+}
+
+func (b *LocalBuilder) save(job Job) error {
+	raw, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(b.Logs, fmt.Sprintf("%d.json", job.ID))
+	if err = os.WriteFile(path, raw, 0644); err != nil {
+		return fmt.Errorf("failed to save job %d: %w", job.ID, err)
+	}
+	return nil
+}
+
+func (b *LocalBuilder) Query(jobid int) (job Job, err error) {
+	raw, err := os.ReadFile(filepath.Join(b.Logs, fmt.Sprintf("%d.json", jobid)))
+	if err != nil {
+		err = fmt.Errorf("push.LocalBuilder.Query: failed to load job %d: %w", jobid, err)
+		return
+	}
+	if err = json.Unmarshal(raw, &job); err != nil {
+		err = fmt.Errorf("push.LocalBuilder.Query: failed to unmarshall job %d: %w", jobid, err)
+	}
+	return
+}
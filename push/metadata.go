@@ -0,0 +1,118 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package push
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/GZGavinZhao/autobuild/common"
+	"github.com/GZGavinZhao/autobuild/state"
+)
+
+// Metadata describes why a job exists, for the build queue to show.
+type Metadata struct {
+	// Commit is the git commit of the recipe. Builders fill it in if empty.
+	Commit string `json:"commit,omitempty"`
+	// MergeRequest is the URL of the merge request the build originates from.
+	MergeRequest string `json:"merge_request,omitempty"`
+	Reason       string `json:"reason,omitempty"`
+	// Batch identifies the push that published the job.
+	Batch string `json:"batch,omitempty"`
+	// Priority is one of Priorities, to build urgent fixes first.
+	Priority string `json:"priority,omitempty"`
+	// Arch is the architecture to build for, if not the default of the build
+	// server.
+	Arch string `json:"arch,omitempty"`
+	// Wave is the 1-based index of the wave of the package, where packages of
+	// a wave only depend on packages of earlier waves, if the build server
+	// supports wave hints.
+	Wave int `json:"wave,omitempty"`
+	// Attestation, if not nil, is the signed provenance of the push, for
+	// build servers that it couldn't be registered with along with the
+	// batch, see Batcher.
+	Attestation *Attestation `json:"attestation,omitempty"`
+	// Changelog holds the new entries of the history of the package since
+	// its old release.
+	Changelog []common.Update `json:"changelog,omitempty"`
+	// Fixes are the known vulnerabilities that the new version of the
+	// package fixes, by CVE where they have one.
+	Fixes []string `json:"fixes,omitempty"`
+}
+
+// Priorities of jobs, from highest to lowest.
+const (
+	PrioritySecurity    = "security"
+	PriorityRegular     = "regular"
+	PriorityMassRebuild = "mass-rebuild"
+)
+
+var Priorities = []string{PrioritySecurity, PriorityRegular, PriorityMassRebuild}
+
+// priorityRank returns the position of `priority` in Priorities, where jobs
+// without a known priority are regular.
+func priorityRank(priority string) int {
+	if rank := slices.Index(Priorities, priority); rank >= 0 {
+		return rank
+	}
+	return slices.Index(Priorities, PriorityRegular)
+}
+
+// NewBatchID returns a new, unique ID for a push.
+func NewBatchID() string {
+	suffix := make([]byte, 3)
+	rand.Read(suffix)
+	return fmt.Sprintf("%s-%s", time.Now().UTC().Format("20060102T150405Z"), hex.EncodeToString(suffix))
+}
+
+// BumpReason describes the change from `old` to the current version of
+// `pkg`, where `old` is nil for new packages, see state.Diff.Reason.
+func BumpReason(pkg common.Package, old *PlanVersion) string {
+	// Only whether the package exists in the old state matters, not where.
+	diff := state.Diff{OldIdx: -1, RelNum: pkg.Release, Ver: pkg.Version}
+	if old != nil {
+		diff.OldIdx, diff.OldRelNum, diff.OldVer = 0, old.Release, old.Version
+	}
+	return diff.Reason()
+}
+
+// Changelog returns the entries of the history of `pkg` since `old`, or all of
+// them if `old` is nil.
+func Changelog(pkg common.Package, old *PlanVersion) []common.Update {
+	if old == nil {
+		return pkg.History
+	}
+	return pkg.Changes(old.Release)
+}
+
+// String formats the metadata as a message, one field per line.
+func (m Metadata) String() string {
+	var lines []string
+	for _, field := range []struct{ name, value string }{
+		{"Reason", m.Reason},
+		{"Commit", m.Commit},
+		{"Merge request", m.MergeRequest},
+		{"Batch", m.Batch},
+		{"Priority", m.Priority},
+		{"Architecture", m.Arch},
+		{"Fixes", strings.Join(m.Fixes, ", ")},
+	} {
+		if field.value != "" {
+			lines = append(lines, fmt.Sprintf("%s: %s", field.name, field.value))
+		}
+	}
+	if len(m.Changelog) != 0 {
+		lines = append(lines, "Changes:")
+		for _, update := range m.Changelog {
+			comment := strings.ReplaceAll(update.Comment, "\n", "\n    ")
+			lines = append(lines, fmt.Sprintf("  %s-%d: %s", update.Version, update.Release, comment))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,206 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package push
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/GZGavinZhao/autobuild/config"
+)
+
+// Events that notifiers are posted about.
+const (
+	// NotifyPush is the summary of a push once it is done.
+	NotifyPush = "push"
+	// NotifyBatch is the summary of the batch of a target once it is done.
+	NotifyBatch = "batch"
+	// NotifyFailure is a package that failed to build, or a target that
+	// failed to publish.
+	NotifyFailure = "failure"
+)
+
+// NotifyEvents lists the events that notifiers can be posted about.
+var NotifyEvents = []string{NotifyPush, NotifyBatch, NotifyFailure}
+
+// NotifyKinds lists the kinds of chat rooms that notifiers post to.
+var NotifyKinds = []string{"slack", "matrix", "irc"}
+
+// Notifier posts messages to a chat room.
+type Notifier interface {
+	Notify(message string) error
+}
+
+// NewNotifier creates the notifier configured by `cfg`.
+func NewNotifier(cfg config.NotifyConfig) (Notifier, error) {
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("push.NewNotifier: the %s notifier requires a url", cfg.Kind)
+	}
+	switch cfg.Kind {
+	case "slack":
+		return &SlackNotifier{client: &httpClient{url: cfg.URL, client: &http.Client{Timeout: 30 * time.Second}}}, nil
+	case "matrix":
+		if cfg.Room == "" {
+			return nil, errors.New("push.NewNotifier: the matrix notifier requires the ID of a room")
+		}
+		tokenEnv := cfg.TokenEnv
+		if tokenEnv == "" {
+			tokenEnv = config.TokenEnv("matrix")
+		}
+		token := os.Getenv(tokenEnv)
+		if token == "" {
+			return nil, fmt.Errorf("push.NewNotifier: the matrix notifier requires an access token in %s", tokenEnv)
+		}
+		client := &httpClient{
+			url:     strings.TrimSuffix(cfg.URL, "/"),
+			headers: map[string]string{"Authorization": "Bearer " + token},
+			client:  &http.Client{Timeout: 30 * time.Second},
+		}
+		return &MatrixNotifier{client: client, room: cfg.Room}, nil
+	case "irc":
+		if cfg.Room == "" {
+			return nil, errors.New("push.NewNotifier: the irc notifier requires a channel")
+		}
+		u, err := url.Parse(cfg.URL)
+		if err != nil || (u.Scheme != "irc" && u.Scheme != "ircs") || u.Host == "" {
+			return nil, fmt.Errorf("push.NewNotifier: the irc notifier requires a url like irc://host:port or ircs://host:port, got %s", cfg.URL)
+		}
+		n := &IRCNotifier{Addr: u.Host, TLS: u.Scheme == "ircs", Nick: cfg.Nick, Channel: cfg.Room}
+		if u.Port() == "" && n.TLS {
+			n.Addr = net.JoinHostPort(u.Hostname(), "6697")
+		} else if u.Port() == "" {
+			n.Addr = net.JoinHostPort(u.Hostname(), "6667")
+		}
+		if n.Nick == "" {
+			n.Nick = "autobuild"
+		}
+		return n, nil
+	}
+	return nil, fmt.Errorf("push.NewNotifier: unknown kind %q of notifier, expected one of %q", cfg.Kind, NotifyKinds)
+}
+
+// SlackNotifier posts messages to an incoming webhook of Slack, or of any chat
+// that accepts the same payload, such as Mattermost.
+type SlackNotifier struct {
+	client *httpClient
+}
+
+func (n *SlackNotifier) Notify(message string) error {
+	if err := n.client.post("", "", map[string]string{"text": message}, nil); err != nil {
+		return fmt.Errorf("push.SlackNotifier: %w", err)
+	}
+	return nil
+}
+
+// MatrixNotifier posts messages to a room of Matrix as notices, which bots are
+// expected to send.
+type MatrixNotifier struct {
+	client *httpClient
+	room   string
+}
+
+// matrixTxn numbers the messages sent to Matrix, for the homeserver not to
+// mistake two of them for the retry of one.
+var matrixTxn atomic.Int64
+
+func (n *MatrixNotifier) Notify(message string) error {
+	txn := fmt.Sprintf("autobuild-%d-%d", time.Now().UnixNano(), matrixTxn.Add(1))
+	path := fmt.Sprintf("/_matrix/client/v3/rooms/%s/send/m.room.message/%s", url.PathEscape(n.room), txn)
+	if err := n.client.do(http.MethodPut, path, nil, map[string]string{"msgtype": "m.notice", "body": message}, nil); err != nil {
+		return fmt.Errorf("push.MatrixNotifier: %w", err)
+	}
+	return nil
+}
+
+// IRCNotifier posts messages to a channel of IRC, connecting for every message
+// and disconnecting once it is sent, so that pushes don't keep a client
+// connected.
+type IRCNotifier struct {
+	// Addr is the host:port of the server.
+	Addr string
+	TLS  bool
+	Nick string
+	// Channel is joined to post the messages to it.
+	Channel string
+}
+
+// ircTimeout is how long posting a message to IRC may take, connecting
+// included.
+const ircTimeout = time.Minute
+
+func (n *IRCNotifier) Notify(message string) (err error) {
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	var conn net.Conn
+	if n.TLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", n.Addr, nil)
+	} else {
+		conn, err = dialer.Dial("tcp", n.Addr)
+	}
+	if err != nil {
+		return fmt.Errorf("push.IRCNotifier: failed to connect to %s: %w", n.Addr, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(ircTimeout))
+
+	send := func(format string, args ...any) {
+		if err == nil {
+			_, err = fmt.Fprintf(conn, format+"\r\n", args...)
+		}
+	}
+	nick := n.Nick
+	send("NICK %s", nick)
+	send("USER %s 0 * :autobuild", nick)
+
+	// Messages are only accepted once the server welcomes the client.
+	lines := bufio.NewScanner(conn)
+	for welcomed := false; err == nil && !welcomed; {
+		if !lines.Scan() {
+			err = lines.Err()
+			if err == nil {
+				err = errors.New("the server closed the connection")
+			}
+			break
+		}
+		line := lines.Text()
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) >= 1 && fields[0] == "PING":
+			send("PONG %s", strings.TrimPrefix(line, "PING "))
+		case len(fields) >= 2 && fields[1] == "001":
+			welcomed = true
+		case len(fields) >= 2 && fields[1] == "433":
+			// The nickname is taken, e.g. by a push running at the same
+			// time.
+			nick += "_"
+			send("NICK %s", nick)
+		case len(fields) >= 1 && fields[0] == "ERROR":
+			err = errors.New(line)
+		}
+	}
+	send("JOIN %s", n.Channel)
+	for _, line := range strings.Split(message, "\n") {
+		if line != "" {
+			send("PRIVMSG %s :%s", n.Channel, line)
+		}
+	}
+	send("QUIT :done")
+	if err != nil {
+		return fmt.Errorf("push.IRCNotifier: failed to post to %s on %s: %w", n.Channel, n.Addr, err)
+	}
+	// Waiting for the server to close the connection makes sure that the
+	// messages were read before leaving.
+	for lines.Scan() {
+	}
+	return nil
+}
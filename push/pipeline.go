@@ -0,0 +1,420 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package push
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/GZGavinZhao/autobuild/common"
+)
+
+const DefaultPollInterval = 10 * time.Second
+
+// Pipeline publishes a list of packages, which must be in build order. In wait
+// mode, a package is only published once all of its dependencies have been
+// indexed, so independent packages are built concurrently while dependents
+// never build against stale dependencies.
+type Pipeline struct {
+	Builder  Builder
+	Packages []common.Package
+	// Deps holds, for every package, the indices of the packages it depends on.
+	Deps [][]int
+	Wait bool
+	// Journal, if not nil, records every published package. Packages it
+	// already records are not published again.
+	Journal *Journal
+	// Existing holds the jobs that are already queued on the build server
+	// for some packages, which are tracked instead of publishing the packages
+	// again.
+	Existing map[int]Job
+	// Metadata, if not nil, holds the metadata to publish every package with.
+	Metadata     []Metadata
+	PollInterval time.Duration
+	// Retry is how transient errors are retried. Publishing is only retried
+	// if the Builder is an IdempotentBuilder.
+	Retry RetryPolicy
+	// SubmitRate, if not zero, limits how often packages are published.
+	SubmitRate Rate
+	// Concurrency, if not zero, is the maximum number of jobs that are
+	// published but not finished at any time.
+	Concurrency int
+	// MaxFailures, if not zero, is the fraction of packages that may fail to
+	// build before the pipeline stops publishing. It requires Wait.
+	MaxFailures float64
+	// Hooks run around publishing every package, and at the end of every
+	// wave. A failing hook stops the pipeline. The batch hooks aren't run by
+	// the pipeline, but once for all the pipelines of a push, see
+	// Hooks.StartBatch.
+	Hooks Hooks
+	// WaitIndexed, if not nil, is called in wait mode once all the packages
+	// of a wave finished, after the wave-end hooks, with the packages of the
+	// wave that succeeded. It waits for the repository to index them, and
+	// fails if it doesn't in time, which stops the pipeline.
+	WaitIndexed func(pkgs []common.Package) error
+	// OnStatus, if not nil, is called whenever a package is published or the
+	// status of its job changes.
+	OnStatus func(pkg common.Package, job Job)
+	// OnRetry, if not nil, is called before retrying after a transient error.
+	OnRetry func(pkg common.Package, attempt int, delay time.Duration, err error)
+	// OnProgress, if not nil, is called whenever the progress of the pipeline
+	// changes.
+	OnProgress func(progress Progress)
+
+	limiter limiter
+}
+
+func (p *Pipeline) notify(idx int, job Job) {
+	if p.OnStatus != nil {
+		p.OnStatus(p.Packages[idx], job)
+	}
+}
+
+// retry calls `fn` until it succeeds, fails with an error that isn't
+// transient, or runs out of attempts.
+func (p *Pipeline) retry(idx int, fn func() error) (err error) {
+	for attempt := 1; ; attempt++ {
+		if err = fn(); err == nil || !IsTransient(err) || attempt >= p.Retry.Attempts {
+			return
+		}
+
+		delay := p.Retry.delay(attempt)
+		var transient *TransientError
+		if errors.As(err, &transient) && transient.RateLimited {
+			delay = max(delay, transient.RetryAfter)
+			p.limiter.pause(delay)
+		}
+		if p.OnRetry != nil {
+			p.OnRetry(p.Packages[idx], attempt, delay, err)
+		}
+		time.Sleep(delay)
+	}
+}
+
+func (p *Pipeline) query(idx int, jobid int) (job Job, err error) {
+	err = p.retry(idx, func() (err error) {
+		job, err = p.Builder.Query(jobid)
+		return
+	})
+	return
+}
+
+// payload returns the payload of hooks for `event`.
+func (p *Pipeline) payload(event string) HookPayload {
+	payload := HookPayload{Event: event, Backend: p.Builder.Name(), Target: p.Builder.Target()}
+	if len(p.Metadata) != 0 {
+		payload.Batch = p.Metadata[0].Batch
+	}
+	return payload
+}
+
+func (p *Pipeline) publish(idx int) (job Job, err error) {
+	var meta Metadata
+	if p.Metadata != nil {
+		meta = p.Metadata[idx]
+	}
+
+	pkg := newHookPackage(p.Packages[idx])
+	payload := p.payload(HookPrePublish)
+	payload.Package, payload.Metadata = &pkg, &meta
+	if err = runHooks(p.Hooks.PrePublish, payload); err != nil {
+		return job, fmt.Errorf("push.Pipeline: not publishing %s: %w", pkg.Name, err)
+	}
+
+	p.limiter.wait()
+	if b, ok := p.Builder.(IdempotentBuilder); !ok || !b.Idempotent() {
+		job, err = p.Builder.Publish(p.Packages[idx], meta)
+	} else {
+		err = p.retry(idx, func() (err error) {
+			job, err = p.Builder.Publish(p.Packages[idx], meta)
+			return
+		})
+	}
+
+	payload.Event = HookPostPublish
+	if err != nil {
+		payload.Error = err.Error()
+	} else {
+		payload.Job = &job
+		// The job exists from now on, so it is journaled even if a hook
+		// fails, for resuming not to publish it again.
+		err = p.record(idx, job)
+	}
+	if hookErr := runHooks(p.Hooks.PostPublish, payload); hookErr != nil && err == nil {
+		err = fmt.Errorf("push.Pipeline: published %s as job %d, but: %w", pkg.Name, job.ID, hookErr)
+	}
+	return
+}
+
+// record records the job of the package `idx` in the journal, if any.
+func (p *Pipeline) record(idx int, job Job) error {
+	if p.Journal == nil {
+		return nil
+	}
+	var batch string
+	if p.Metadata != nil {
+		batch = p.Metadata[idx].Batch
+	}
+	return p.Journal.Record(p.Packages[idx], job, batch)
+}
+
+func (p *Pipeline) submit(idx int) (job Job, err error) {
+	pkg := p.Packages[idx]
+
+	if p.Journal != nil {
+		if entry, ok := p.Journal.Published(pkg); ok {
+			if job, err = p.query(idx, entry.JobID); err != nil {
+				err = fmt.Errorf("push.Pipeline: failed to query job %d of %s: %w", entry.JobID, pkg.Name, err)
+			}
+			return
+		}
+	}
+
+	if existing, ok := p.Existing[idx]; ok {
+		return existing, p.record(idx, existing)
+	}
+	return p.publish(idx)
+}
+
+// Outcome is what happened to a package in a pipeline.
+type Outcome int
+
+const (
+	// Pending packages were not published (yet).
+	Pending Outcome = iota
+	// Published packages were published, but their build has not finished.
+	Published
+	// Succeeded packages were built and indexed.
+	Succeeded
+	// Failed packages failed to build.
+	Failed
+	// Blocked packages were not published because one of their dependencies
+	// failed to build or was blocked itself.
+	Blocked
+)
+
+func (o Outcome) String() string {
+	switch o {
+	case Pending:
+		return "pending"
+	case Published:
+		return "published"
+	case Succeeded:
+		return "succeeded"
+	case Failed:
+		return "failed"
+	case Blocked:
+		return "blocked"
+	}
+	return fmt.Sprintf("Outcome(%d)", int(o))
+}
+
+// Result is the outcome of running a pipeline.
+type Result struct {
+	// Jobs holds the last known job of every package.
+	Jobs     []Job
+	Outcomes []Outcome
+	// Stopped is set when the pipeline stopped because too many packages
+	// failed, see Pipeline.MaxFailures. Packages that weren't published yet
+	// are still Pending, and the ones that were are still Published.
+	Stopped bool
+}
+
+// Select returns the indices of the packages with the given outcome.
+func (r *Result) Select(outcome Outcome) (res []int) {
+	for idx, o := range r.Outcomes {
+		if o == outcome {
+			res = append(res, idx)
+		}
+	}
+	return
+}
+
+// endWave runs the wave-end hooks of `wave`, and waits for its packages that
+// succeeded to be indexed.
+func (p *Pipeline) endWave(wave int, waves []int, outcomes []Outcome) error {
+	payload := p.payload(HookWaveEnd)
+	payload.Wave = wave
+	var succeeded []common.Package
+	for idx, pkg := range p.Packages {
+		if waves[idx] != wave {
+			continue
+		}
+		hookPkg := newHookPackage(pkg)
+		hookPkg.Outcome = outcomes[idx].String()
+		payload.Packages = append(payload.Packages, hookPkg)
+		if outcomes[idx] == Succeeded {
+			succeeded = append(succeeded, pkg)
+		}
+	}
+	// Nothing new was indexed if the whole wave failed.
+	if len(succeeded) == 0 {
+		return nil
+	}
+
+	if err := runHooks(p.Hooks.WaveEnd, payload); err != nil {
+		return fmt.Errorf("push.Pipeline: after wave %d: %w", wave, err)
+	}
+	if p.WaitIndexed != nil {
+		if err := p.WaitIndexed(succeeded); err != nil {
+			return fmt.Errorf("push.Pipeline: after wave %d: %w", wave, err)
+		}
+	}
+	return nil
+}
+
+// Run runs the pipeline. It stops at the first package that fails to publish,
+// once retries are exhausted. In wait mode, packages that fail to build only
+// block their dependents, and unaffected packages are still published unless
+// MaxFailures is reached. With wave-end hooks or WaitIndexed, packages are
+// published one wave at a time, and the next wave only once the previous one
+// ended.
+func (p *Pipeline) Run() (res Result, err error) {
+	res.Jobs = make([]Job, len(p.Packages))
+	res.Outcomes = make([]Outcome, len(p.Packages))
+	jobs, outcomes := res.Jobs, res.Outcomes
+
+	interval := p.PollInterval
+	if interval == 0 {
+		interval = DefaultPollInterval
+	}
+	p.limiter = limiter{interval: p.SubmitRate.Interval()}
+
+	// When waiting, packages only become ready once their dependencies
+	// succeeded, so ready packages can be submitted by priority instead of in
+	// build order.
+	visit := make([]int, len(p.Packages))
+	for idx := range visit {
+		visit[idx] = idx
+	}
+	if p.Wait && p.Metadata != nil {
+		slices.SortStableFunc(visit, func(a, b int) int {
+			return cmp.Compare(priorityRank(p.Metadata[a].Priority), priorityRank(p.Metadata[b].Priority))
+		})
+	}
+
+	waves := Waves(p.Deps)
+	var last Progress
+	report := func() {
+		if progress := newProgress(outcomes, waves); p.OnProgress != nil && progress != last {
+			last = progress
+			p.OnProgress(progress)
+		}
+	}
+
+	// ended is the last wave that ended, when waves are published one at a
+	// time.
+	byWave := p.Wait && (len(p.Hooks.WaveEnd) != 0 || p.WaitIndexed != nil)
+	ended, waveCount := 0, 0
+	for _, wave := range waves {
+		waveCount = max(waveCount, wave)
+	}
+
+	inFlight := 0
+	for {
+		// Packages are in build order, so dependencies are always visited
+		// before their dependents.
+		for idx := range p.Packages {
+			if p.Wait && outcomes[idx] == Pending && slices.ContainsFunc(p.Deps[idx], func(dep int) bool { return outcomes[dep] == Failed || outcomes[dep] == Blocked }) {
+				outcomes[idx] = Blocked
+			}
+		}
+
+		for _, idx := range visit {
+			if outcomes[idx] != Pending {
+				continue
+			}
+
+			if p.Wait {
+				if slices.ContainsFunc(p.Deps[idx], func(dep int) bool { return outcomes[dep] != Succeeded }) {
+					continue
+				}
+				if byWave && waves[idx] > ended+1 {
+					continue
+				}
+			}
+
+			if p.Concurrency > 0 && inFlight >= p.Concurrency {
+				// Without waiting, the build server relies on packages
+				// being published in build order.
+				if !p.Wait {
+					break
+				}
+				continue
+			}
+
+			if jobs[idx], err = p.submit(idx); err != nil {
+				return
+			}
+			outcomes[idx] = Published
+			inFlight++
+			p.notify(idx, jobs[idx])
+		}
+		report()
+
+		pending := slices.Contains(outcomes, Pending)
+		if !pending && (!p.Wait || !slices.Contains(outcomes, Published)) {
+			return
+		}
+
+		progressed := false
+		for idx := range p.Packages {
+			if outcomes[idx] != Published {
+				continue
+			}
+
+			job := jobs[idx]
+			if !job.Indexed() && !job.Failed() {
+				if job, err = p.query(idx, job.ID); err != nil {
+					return
+				}
+				if job.Status != jobs[idx].Status {
+					p.notify(idx, job)
+				}
+				jobs[idx] = job
+			}
+
+			if job.Failed() {
+				outcomes[idx] = Failed
+			} else if job.Indexed() {
+				outcomes[idx] = Succeeded
+			} else {
+				continue
+			}
+			inFlight--
+			progressed = true
+		}
+		report()
+
+		// A wave ends once none of its packages are left to build. Several
+		// waves may end at once when their packages are all blocked.
+		for byWave && ended < waveCount {
+			wave := ended + 1
+			if slices.ContainsFunc(visit, func(idx int) bool {
+				return waves[idx] == wave && (outcomes[idx] == Pending || outcomes[idx] == Published)
+			}) {
+				break
+			}
+			if err = p.endWave(wave, waves, outcomes); err != nil {
+				return
+			}
+			ended = wave
+			progressed = true
+		}
+
+		if p.MaxFailures > 0 && float64(len(res.Select(Failed))) >= p.MaxFailures*float64(len(p.Packages)) {
+			res.Stopped = true
+			return
+		}
+
+		// Finished jobs may unblock or block their dependents right away.
+		if !progressed {
+			time.Sleep(interval)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package push
+
+import (
+	"errors"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/GZGavinZhao/autobuild/common"
+)
+
+// fakeBuilder builds every package right away, and fails the ones in
+// `failing`.
+type fakeBuilder struct {
+	mu        sync.Mutex
+	failing   map[string]bool
+	jobs      []Job
+	published []string
+}
+
+func (b *fakeBuilder) Name() string   { return "fake" }
+func (b *fakeBuilder) Target() string { return "fake://" }
+
+func (b *fakeBuilder) Publish(pkg common.Package, meta Metadata) (Job, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	job := Job{ID: len(b.jobs) + 1, Pkg: pkg.Name, Tag: SourceTag(pkg), Status: StatusOK}
+	if b.failing[pkg.Name] {
+		job.Status = StatusFailed
+	}
+	b.jobs = append(b.jobs, job)
+	b.published = append(b.published, pkg.Name)
+	return job, nil
+}
+
+func (b *fakeBuilder) Query(jobid int) (Job, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if jobid < 1 || jobid > len(b.jobs) {
+		return Job{}, errors.New("no such job")
+	}
+	return b.jobs[jobid-1], nil
+}
+
+// funcHook is a hook that calls a function.
+type funcHook func(payload HookPayload) error
+
+func (h funcHook) Run(payload HookPayload) error { return h(payload) }
+
+func testPackages(names ...string) (pkgs []common.Package) {
+	for _, name := range names {
+		pkgs = append(pkgs, common.Package{Name: name, Version: "1.0", Release: 1})
+	}
+	return
+}
+
+func TestPipelinePostPublishHookJournals(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	journal, err := CreateJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	builder := &fakeBuilder{}
+	p := Pipeline{
+		Builder:      builder,
+		Packages:     testPackages("a"),
+		Deps:         [][]int{nil},
+		Journal:      journal,
+		PollInterval: time.Millisecond,
+		Hooks:        Hooks{PostPublish: []Hook{funcHook(func(HookPayload) error { return errors.New("nope") })}},
+	}
+	if _, err = p.Run(); err == nil {
+		t.Fatal("Run() didn't fail with a failing post-publish hook")
+	}
+	journal.Close()
+
+	// Resuming tracks the job instead of publishing the package again.
+	if p.Journal, err = LoadJournal(path); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Journal.Close()
+	p.Hooks = Hooks{}
+	res, err := p.Run()
+	if err != nil {
+		t.Fatalf("Run(): %s", err)
+	}
+	if !slices.Equal(builder.published, []string{"a"}) || res.Jobs[0].ID != 1 {
+		t.Errorf("published %q as job %d, want a once as job 1", builder.published, res.Jobs[0].ID)
+	}
+}
+
+func TestPipelineWaitIndexed(t *testing.T) {
+	// c depends on a, and d on c, so the waves are a b, c, and d.
+	deps := [][]int{nil, nil, {0}, {2}}
+	tests := []struct {
+		name    string
+		wait    bool
+		failing []string
+		waitErr bool
+		// calls holds the packages that every call of WaitIndexed waited
+		// for, and after the colon the ones published by then.
+		calls     []string
+		published []string
+		wantErr   bool
+	}{
+		{
+			name:      "all succeed",
+			wait:      true,
+			calls:     []string{"a b: a b", "c: a b c", "d: a b c d"},
+			published: []string{"a", "b", "c", "d"},
+		},
+		{
+			name:      "failures block their dependents",
+			wait:      true,
+			failing:   []string{"a"},
+			calls:     []string{"b: a b"},
+			published: []string{"a", "b"},
+		},
+		{
+			name:      "a wave that fails entirely isn't waited for",
+			wait:      true,
+			failing:   []string{"a", "b"},
+			published: []string{"a", "b"},
+		},
+		{
+			name:      "waiting fails",
+			wait:      true,
+			waitErr:   true,
+			calls:     []string{"a b: a b"},
+			published: []string{"a", "b"},
+			wantErr:   true,
+		},
+		{
+			name:      "without wait",
+			published: []string{"a", "b", "c", "d"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			builder := &fakeBuilder{failing: map[string]bool{}}
+			for _, name := range tt.failing {
+				builder.failing[name] = true
+			}
+			var calls []string
+			p := Pipeline{
+				Builder:      builder,
+				Packages:     testPackages("a", "b", "c", "d"),
+				Deps:         deps,
+				Wait:         tt.wait,
+				PollInterval: time.Millisecond,
+				WaitIndexed: func(pkgs []common.Package) error {
+					var names []string
+					for _, pkg := range pkgs {
+						names = append(names, pkg.Name)
+					}
+					calls = append(calls, strings.Join(names, " ")+": "+strings.Join(builder.published, " "))
+					if tt.waitErr {
+						return errors.New("not indexed in time")
+					}
+					return nil
+				},
+			}
+			if _, err := p.Run(); (err != nil) != tt.wantErr {
+				t.Fatalf("Run() = %v, want error %t", err, tt.wantErr)
+			}
+			if !slices.Equal(calls, tt.calls) {
+				t.Errorf("WaitIndexed calls = %q, want %q", calls, tt.calls)
+			}
+			if !slices.Equal(builder.published, tt.published) {
+				t.Errorf("published %q, want %q", builder.published, tt.published)
+			}
+		})
+	}
+}
+
+func TestHooksEndBatch(t *testing.T) {
+	pkgs := testPackages("a", "b", "c")
+	builders := []Builder{&fakeBuilder{}, &fakeBuilder{}}
+	results := []Result{
+		{Outcomes: []Outcome{Succeeded, Failed, Blocked}},
+		{Outcomes: []Outcome{Pending, Blocked, Succeeded}},
+	}
+	errs := []error{nil, errors.New("stopped")}
+
+	var payloads []HookPayload
+	hooks := Hooks{BatchEnd: []Hook{funcHook(func(payload HookPayload) error {
+		payloads = append(payloads, payload)
+		return nil
+	})}}
+	if err := hooks.EndBatch("batch", builders, pkgs, results, errs); err != nil {
+		t.Fatal(err)
+	}
+	if len(payloads) != 1 {
+		t.Fatalf("batch-end ran %d times, want once", len(payloads))
+	}
+
+	payload := payloads[0]
+	var outcomes []string
+	for _, pkg := range payload.Packages {
+		outcomes = append(outcomes, pkg.Outcome)
+	}
+	if want := []string{"pending", "failed", "blocked"}; !slices.Equal(outcomes, want) {
+		t.Errorf("outcomes = %q, want %q", outcomes, want)
+	}
+	if len(payload.Targets) != 2 || payload.Targets[0].Error != "" || payload.Targets[1].Error != "stopped" {
+		t.Errorf("targets = %+v", payload.Targets)
+	}
+	if payload.Backend != "" || payload.Error != "stopped" {
+		t.Errorf("backend = %q, error = %q", payload.Backend, payload.Error)
+	}
+}
+
+func TestWorseOutcome(t *testing.T) {
+	tests := []struct {
+		a, b, want Outcome
+	}{
+		{Succeeded, Succeeded, Succeeded},
+		{Succeeded, Published, Published},
+		{Pending, Published, Pending},
+		{Blocked, Pending, Blocked},
+		{Failed, Blocked, Failed},
+		{Succeeded, Failed, Failed},
+	}
+	for _, tt := range tests {
+		if got := worseOutcome(tt.a, tt.b); got != tt.want {
+			t.Errorf("worseOutcome(%s, %s) = %s, want %s", tt.a, tt.b, got, tt.want)
+		}
+		if got := worseOutcome(tt.b, tt.a); got != tt.want {
+			t.Errorf("worseOutcome(%s, %s) = %s, want %s", tt.b, tt.a, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package push
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// PlanSchemaVersion is bumped whenever the format of plans changes in an
+// incompatible way.
+const PlanSchemaVersion = 1
+
+// Plan records a push to be reviewed before it is applied: the packages that
+// changed, the order to build them in, and the build server to publish them
+// to.
+type Plan struct {
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+	// Old and New are the TPaths that were diffed.
+	Old     string `json:"old"`
+	New     string `json:"new"`
+	Backend string `json:"backend"`
+	// Target identifies the build server of the backend, see Builder.Target.
+	Target string `json:"target"`
+	// Packages are the packages to publish, in build order.
+	Packages []PlanPackage `json:"packages"`
+}
+
+type PlanPackage struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Release int    `json:"release"`
+	// Old is the version of the package in the old state, or nil if the
+	// package is new.
+	Old *PlanVersion `json:"old,omitempty"`
+	// Deps are the indices in Plan.Packages of the packages this one depends
+	// on.
+	Deps []int `json:"deps"`
+	// Stream is the index of the independent stream the package belongs to.
+	Stream int `json:"stream"`
+	// AutoBump is set when the recipe of the package changed without a new
+	// release, which is bumped to Release when the plan is applied.
+	AutoBump bool `json:"auto-bump,omitempty"`
+}
+
+type PlanVersion struct {
+	Version string `json:"version"`
+	Release int    `json:"release"`
+}
+
+// LoadPlan loads the plan at `path`.
+func LoadPlan(path string) (*Plan, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("push.LoadPlan: failed to read plan %s: %w", path, err)
+	}
+
+	var plan Plan
+	if err = json.Unmarshal(raw, &plan); err != nil {
+		return nil, fmt.Errorf("push.LoadPlan: failed to parse plan %s: %w", path, err)
+	}
+	if plan.Version != PlanSchemaVersion {
+		return nil, fmt.Errorf("push.LoadPlan: plan %s has version %d, but only version %d is supported", path, plan.Version, PlanSchemaVersion)
+	}
+
+	for idx, pkg := range plan.Packages {
+		for _, dep := range pkg.Deps {
+			if dep < 0 || dep >= idx {
+				return nil, fmt.Errorf("push.LoadPlan: %s in plan %s depends on a package that isn't built before it", pkg.Name, path)
+			}
+		}
+	}
+	return &plan, nil
+}
+
+// Save writes the plan to `path`.
+func (p *Plan) Save(path string) error {
+	raw, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.WriteFile(path, append(raw, '\n'), 0644); err != nil {
+		return fmt.Errorf("push.Plan.Save: failed to write plan %s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package push
+
+// Progress is how far a pipeline got.
+type Progress struct {
+	Total int
+	// Submitted counts the packages that were published, finished or not.
+	Submitted int
+	Succeeded int
+	Failed    int
+	Blocked   int
+	// Wave is the earliest wave with packages that haven't finished yet, or
+	// Waves once all of them did, see Waves.
+	Wave  int
+	Waves int
+}
+
+// Waves returns the 1-based wave of every package, given the indices of the
+// packages every package depends on. Packages only depend on packages of
+// earlier waves, so all the packages of a wave can be built at once. Packages
+// must be in build order.
+func Waves(deps [][]int) []int {
+	waves := make([]int, len(deps))
+	for idx := range deps {
+		waves[idx] = 1
+		for _, dep := range deps[idx] {
+			waves[idx] = max(waves[idx], waves[dep]+1)
+		}
+	}
+	return waves
+}
+
+// newProgress returns the progress of packages with the given outcomes and
+// waves.
+func newProgress(outcomes []Outcome, waves []int) (progress Progress) {
+	progress.Total = len(outcomes)
+	for _, wave := range waves {
+		progress.Waves = max(progress.Waves, wave)
+	}
+	progress.Wave = progress.Waves
+
+	for idx, outcome := range outcomes {
+		switch outcome {
+		case Pending, Published:
+			progress.Wave = min(progress.Wave, waves[idx])
+		case Succeeded:
+			progress.Succeeded++
+		case Failed:
+			progress.Failed++
+		case Blocked:
+			progress.Blocked++
+		}
+		if outcome != Pending && outcome != Blocked {
+			progress.Submitted++
+		}
+	}
+	return
+}
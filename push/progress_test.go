@@ -0,0 +1,30 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package push
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestWaves(t *testing.T) {
+	tests := []struct {
+		name string
+		deps [][]int
+		want []int
+	}{
+		{"empty", nil, []int{}},
+		{"independent", [][]int{nil, nil, nil}, []int{1, 1, 1}},
+		{"chain", [][]int{nil, {0}, {1}}, []int{1, 2, 3}},
+		{"diamond", [][]int{nil, {0}, {0}, {1, 2}}, []int{1, 2, 2, 3}},
+		// A package waits for its deepest dependency.
+		{"uneven", [][]int{nil, nil, {0}, {1, 2}, {1}}, []int{1, 1, 2, 3, 2}},
+	}
+	for _, tt := range tests {
+		if got := Waves(tt.deps); !slices.Equal(got, tt.want) {
+			t.Errorf("Waves(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
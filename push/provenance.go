@@ -0,0 +1,139 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package push
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/GZGavinZhao/autobuild/common"
+	"github.com/GZGavinZhao/autobuild/utils"
+	"github.com/go-git/go-git/v5"
+)
+
+// ProvenanceSchemaVersion is bumped whenever the format of provenances
+// changes in an incompatible way.
+const ProvenanceSchemaVersion = 1
+
+// SignatureNamespace is the namespace of the SSH signatures of provenances,
+// which verifiers must pass to `ssh-keygen -Y verify -n`.
+const SignatureNamespace = "autobuild-push"
+
+// Provenance records what a push requested to build, so that build servers
+// can verify who requested it once it is signed.
+type Provenance struct {
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+	Batch   string    `json:"batch"`
+	// Commit is the git commit of the recipes.
+	Commit   string              `json:"commit"`
+	Packages []ProvenancePackage `json:"packages"`
+}
+
+type ProvenancePackage struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Release int    `json:"release"`
+	// Hash is the RecipeHash of the package.
+	Hash string `json:"hash"`
+}
+
+// Attestation is a signed Provenance, published along with every job of the
+// push.
+type Attestation struct {
+	// Provenance is the provenance exactly as it was signed, in JSON.
+	Provenance string `json:"provenance"`
+	// Signature is the armored SSH signature of Provenance, which includes
+	// the public key of the signer.
+	Signature string `json:"signature"`
+}
+
+// NewProvenance returns the provenance of publishing `pkgs` in the batch
+// `batch`.
+func NewProvenance(pkgs []common.Package, batch string) (*Provenance, error) {
+	p := &Provenance{
+		Version:  ProvenanceSchemaVersion,
+		Created:  time.Now().UTC(),
+		Batch:    batch,
+		Packages: []ProvenancePackage{},
+	}
+
+	if len(pkgs) != 0 {
+		repo, err := git.PlainOpen(pkgs[0].Root)
+		if err != nil {
+			return nil, fmt.Errorf("push.NewProvenance: failed to open git repository %s: %w", pkgs[0].Root, err)
+		}
+		head, err := repo.Head()
+		if err != nil {
+			return nil, fmt.Errorf("push.NewProvenance: failed to resolve HEAD of %s: %w", pkgs[0].Root, err)
+		}
+		p.Commit = head.Hash().String()
+	}
+
+	for _, pkg := range pkgs {
+		hash, err := RecipeHash(pkg)
+		if err != nil {
+			return nil, fmt.Errorf("push.NewProvenance: %w", err)
+		}
+		p.Packages = append(p.Packages, ProvenancePackage{Name: pkg.Name, Version: pkg.Version, Release: pkg.Release, Hash: hash})
+	}
+	return p, nil
+}
+
+// RecipeHash returns the SHA-256 hash of the files in the recipe directory of
+// `pkg`, including patches and other files next to the recipe, see
+// utils.HashDir.
+func RecipeHash(pkg common.Package) (string, error) {
+	dir := pkg.Path
+	if info, err := os.Stat(dir); err != nil {
+		return "", fmt.Errorf("failed to hash recipe of %s: %w", pkg.Name, err)
+	} else if !info.IsDir() {
+		dir = filepath.Dir(dir)
+	}
+
+	hash, err := utils.HashDir(dir, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash recipe of %s: %w", pkg.Name, err)
+	}
+	return hash, nil
+}
+
+// Sign signs the provenance with the SSH key at `key`, with `ssh-keygen -Y
+// sign`. `key` is either a private key, or a public key whose private key is
+// held by the SSH agent.
+func (p *Provenance) Sign(key string) (*Attestation, error) {
+	raw, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("ssh-keygen", "-q", "-Y", "sign", "-n", SignatureNamespace, "-f", key)
+	cmd.Stdin = bytes.NewReader(raw)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err = cmd.Run(); err != nil {
+		return nil, fmt.Errorf("push.Provenance.Sign: failed to sign with %s: %w, stderr: %s", key, err, strings.TrimSpace(stderr.String()))
+	}
+	return &Attestation{Provenance: string(raw), Signature: stdout.String()}, nil
+}
+
+// ForwardsAttestations reports whether `b` publishes the attestation of the
+// metadata of jobs. The solus and local backends only pass on the message of
+// Metadata.String, which leaves it out: the provenance lists every package of
+// the push, which is too large for a message.
+func ForwardsAttestations(b Builder) bool {
+	switch b.(type) {
+	case *SolusBuilder, *LocalBuilder:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,85 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package push
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Rate is a maximum number of submissions per period of time.
+type Rate struct {
+	N   int
+	Per time.Duration
+}
+
+// ParseRate parses a rate of the form `<n>/<unit>`, where the unit is `s`, `m`,
+// `h`, or a duration such as `30s`. A plain number is per second.
+func ParseRate(s string) (r Rate, err error) {
+	n, per, found := strings.Cut(s, "/")
+	if r.N, err = strconv.Atoi(n); err != nil || r.N <= 0 {
+		return r, fmt.Errorf("push.ParseRate: invalid number of submissions in rate %q", s)
+	}
+
+	switch per {
+	case "s":
+		r.Per = time.Second
+	case "m":
+		r.Per = time.Minute
+	case "h":
+		r.Per = time.Hour
+	default:
+		if !found {
+			r.Per = time.Second
+		} else if r.Per, err = time.ParseDuration(per); err != nil || r.Per <= 0 {
+			return r, fmt.Errorf("push.ParseRate: invalid period in rate %q", s)
+		}
+	}
+	return r, nil
+}
+
+func (r Rate) String() string {
+	return fmt.Sprintf("%d/%s", r.N, r.Per)
+}
+
+// Interval returns the minimum delay between two submissions.
+func (r Rate) Interval() time.Duration {
+	if r.N <= 0 {
+		return 0
+	}
+	return r.Per / time.Duration(r.N)
+}
+
+// submitJitter is the fraction of the interval between two submissions that
+// is randomly added to it, so that several pushes don't submit in lockstep.
+const submitJitter = 0.2
+
+// limiter spaces out submissions, and pauses them when the build server asks
+// to slow down.
+type limiter struct {
+	interval time.Duration
+	next     time.Time
+}
+
+// wait blocks until the next submission is allowed.
+func (l *limiter) wait() {
+	if delay := time.Until(l.next); delay > 0 {
+		time.Sleep(delay)
+	}
+	if l.interval > 0 {
+		jitter := time.Duration(rand.Float64() * submitJitter * float64(l.interval))
+		l.next = time.Now().Add(l.interval + jitter)
+	}
+}
+
+// pause holds off submissions for at least `d`.
+func (l *limiter) pause(d time.Duration) {
+	if until := time.Now().Add(d); until.After(l.next) {
+		l.next = until
+	}
+}
@@ -0,0 +1,27 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package push
+
+import (
+	"github.com/GZGavinZhao/autobuild/common"
+)
+
+// Remover is implemented by builders that can drop packages that were removed
+// from the recipes, so that the build server stops building and indexing them.
+type Remover interface {
+	// Remove drops `pkg`, the last release of the package before it was
+	// removed.
+	Remove(pkg common.Package) error
+}
+
+type removalRequest struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Release int    `json:"release"`
+}
+
+func newRemovalRequest(pkg common.Package) removalRequest {
+	return removalRequest{Name: pkg.Name, Version: pkg.Version, Release: pkg.Release}
+}
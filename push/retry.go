@@ -0,0 +1,80 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package push
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/GZGavinZhao/autobuild/common"
+)
+
+// RetryPolicy configures how requests to the build server are retried after
+// transient errors.
+type RetryPolicy struct {
+	// Attempts is the maximum number of attempts, including the first one.
+	Attempts int
+	// Backoff is the delay before the first retry. It doubles after every
+	// attempt, up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	Attempts:   5,
+	Backoff:    2 * time.Second,
+	MaxBackoff: time.Minute,
+}
+
+// delay returns how long to wait after the given failed attempt, starting at 1.
+func (p RetryPolicy) delay(attempt int) time.Duration {
+	delay := p.Backoff
+	for i := 1; i < attempt && delay < p.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if p.MaxBackoff > 0 {
+		delay = min(delay, p.MaxBackoff)
+	}
+	return delay
+}
+
+// TransientError is an error that may go away by itself, such as a network
+// error or an overloaded build server.
+type TransientError struct {
+	Err error
+	// RateLimited is set when the build server asked to slow down, in which
+	// case all submissions are paused for at least RetryAfter.
+	RateLimited bool
+	RetryAfter  time.Duration
+}
+
+func (e *TransientError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *TransientError) Unwrap() error {
+	return e.Err
+}
+
+// IsTransient returns whether retrying may fix `err`.
+func IsTransient(err error) bool {
+	var transient *TransientError
+	return errors.As(err, &transient)
+}
+
+// IdempotencyKey returns the key that identifies the submission of this exact
+// release of `pkg`, so that a retried submission doesn't create another job.
+func IdempotencyKey(pkg common.Package) string {
+	return fmt.Sprintf("%s@%s-%d", pkg.Name, pkg.Version, pkg.Release)
+}
+
+// IdempotentBuilder is implemented by builders whose servers deduplicate
+// submissions with the same IdempotencyKey. Only their Publish is retried,
+// since retrying it on other builders could publish a package twice.
+type IdempotentBuilder interface {
+	Builder
+	Idempotent() bool
+}
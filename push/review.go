@@ -0,0 +1,226 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package push
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Review is a pull request on GitHub or a merge request on GitLab, that
+// reports are commented on.
+type Review struct {
+	// Forge is github or gitlab.
+	Forge string
+	// URL is the web page of the request.
+	URL    string
+	client *httpClient
+	// comments is the API path of the comments of the request, and comment
+	// the one of the comment with a given ID.
+	comments string
+	comment  func(id int) string
+}
+
+// reviewPageSize is the number of comments listed per request.
+const reviewPageSize = 100
+
+// ParseReview returns the request at `rawURL`, such as
+// https://github.com/owner/repo/pull/12 or
+// https://gitlab.com/group/project/-/merge_requests/34, which is commented on
+// with `token`. Hosts other than github.com are taken for GitHub Enterprise,
+// whose API is under /api/v3, and GitLab instances are told apart by the
+// paths of their merge requests.
+func ParseReview(rawURL string, token string) (*Review, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("push.ParseReview: %s isn't the URL of a pull or merge request", rawURL)
+	}
+	review := &Review{URL: rawURL}
+	client := &httpClient{headers: make(map[string]string), client: &http.Client{Timeout: 30 * time.Second}}
+	review.client = client
+
+	if project, iid, ok := strings.Cut(strings.Trim(u.Path, "/"), "/-/merge_requests/"); ok {
+		num, err := strconv.Atoi(strings.Split(iid, "/")[0])
+		if err != nil || project == "" {
+			return nil, fmt.Errorf("push.ParseReview: %s isn't the URL of a merge request", rawURL)
+		}
+		review.Forge = "gitlab"
+		client.url = fmt.Sprintf("%s://%s/api/v4", u.Scheme, u.Host)
+		client.headers["Private-Token"] = token
+		review.comments = fmt.Sprintf("/projects/%s/merge_requests/%d/notes", url.PathEscape(project), num)
+		review.comment = func(id int) string { return fmt.Sprintf("%s/%d", review.comments, id) }
+		return review, nil
+	}
+
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(parts) < 4 || parts[2] != "pull" {
+		return nil, fmt.Errorf("push.ParseReview: %s isn't the URL of a pull or merge request", rawURL)
+	}
+	num, err := strconv.Atoi(parts[3])
+	if err != nil {
+		return nil, fmt.Errorf("push.ParseReview: %s isn't the URL of a pull request", rawURL)
+	}
+	review.Forge = "github"
+	if u.Host == "github.com" {
+		client.url = "https://api.github.com"
+	} else {
+		client.url = fmt.Sprintf("%s://%s/api/v3", u.Scheme, u.Host)
+	}
+	client.headers["Accept"] = "application/vnd.github+json"
+	client.headers["Authorization"] = "Bearer " + token
+	repo := parts[0] + "/" + parts[1]
+	review.comments = fmt.Sprintf("/repos/%s/issues/%d/comments", repo, num)
+	review.comment = func(id int) string { return fmt.Sprintf("/repos/%s/issues/comments/%d", repo, id) }
+	return review, nil
+}
+
+// DetectReview returns the URL of the request that the CI job runs for, on
+// GitHub Actions or GitLab CI, if any.
+func DetectReview() (string, bool) {
+	if os.Getenv("GITHUB_ACTIONS") == "true" {
+		raw, err := os.ReadFile(os.Getenv("GITHUB_EVENT_PATH"))
+		if err != nil {
+			return "", false
+		}
+		var event struct {
+			PullRequest struct {
+				HTMLURL string `json:"html_url"`
+			} `json:"pull_request"`
+		}
+		if json.Unmarshal(raw, &event) != nil || event.PullRequest.HTMLURL == "" {
+			return "", false
+		}
+		return event.PullRequest.HTMLURL, true
+	}
+	if os.Getenv("GITLAB_CI") == "true" && os.Getenv("CI_MERGE_REQUEST_IID") != "" {
+		return os.Getenv("CI_MERGE_REQUEST_PROJECT_URL") + "/-/merge_requests/" + os.Getenv("CI_MERGE_REQUEST_IID"), true
+	}
+	return "", false
+}
+
+// reviewComment is a comment on a request, as listed by either forge.
+type reviewComment struct {
+	ID int `json:"id"`
+	// Body is the text of a comment on GitHub, and of a note on GitLab.
+	Body string `json:"body"`
+	// User is the author of a comment on GitHub, and Author the one of a
+	// note on GitLab.
+	User   reviewUser `json:"user"`
+	Author reviewUser `json:"author"`
+}
+
+// reviewUser is a user of either forge.
+type reviewUser struct {
+	ID    int    `json:"id"`
+	Login string `json:"login"`
+}
+
+// githubActionsBot is the user that the GITHUB_TOKEN of GitHub Actions
+// comments as.
+const githubActionsBot = "github-actions[bot]"
+
+// Comments longer than these many characters are rejected by GitHub and
+// GitLab respectively.
+const (
+	githubMaxComment = 65536
+	gitlabMaxComment = 1000000
+)
+
+// truncatedNotice ends comments that were too long for the forge.
+const truncatedNotice = "\n\n*The report is too long, and was truncated. Run `autobuild report` to see all of it.*\n"
+
+// self returns the user that the token comments as, for only its own comments
+// to be replaced.
+func (r *Review) self() (user reviewUser, err error) {
+	err = r.client.get("/user", &user)
+	var status *StatusError
+	// The installation token of GitHub Actions can't tell who it is, but
+	// always comments as its bot.
+	if r.Forge == "github" && errors.As(err, &status) && status.StatusCode == http.StatusForbidden && os.Getenv("GITHUB_ACTIONS") == "true" {
+		return reviewUser{Login: githubActionsBot}, nil
+	}
+	if err != nil {
+		err = fmt.Errorf("failed to find who the token belongs to: %w", err)
+	}
+	return
+}
+
+// ownedBy returns whether `user` wrote the comment.
+func (c reviewComment) ownedBy(forge string, user reviewUser) bool {
+	if forge == "gitlab" {
+		return c.Author.ID != 0 && c.Author.ID == user.ID
+	}
+	return c.User.Login != "" && strings.EqualFold(c.User.Login, user.Login)
+}
+
+// truncate returns `body` cut at a line to fit in a comment of the forge.
+func (r *Review) truncate(body string) string {
+	limit := githubMaxComment
+	if r.Forge == "gitlab" {
+		limit = gitlabMaxComment
+	}
+	if utf8.RuneCountInString(body) <= limit {
+		return body
+	}
+	runes := []rune(body)[:limit-utf8.RuneCountInString(truncatedNotice)]
+	cut := string(runes)
+	if idx := strings.LastIndexByte(cut, '\n'); idx > 0 {
+		cut = cut[:idx]
+	}
+	return cut + truncatedNotice
+}
+
+// Comment comments `body` on the request, or replaces the first comment of the
+// token's own user that contains `marker` with it, so that a report is kept up
+// to date as the request changes instead of piling up. Comments of others are
+// never replaced, even with the marker. Bodies too long for the forge are
+// truncated. It returns whether a comment was replaced.
+func (r *Review) Comment(marker string, body string) (updated bool, err error) {
+	self, err := r.self()
+	if err != nil {
+		return false, fmt.Errorf("push.Review.Comment: %w", err)
+	}
+	body = r.truncate(body)
+
+	for page := 1; ; page++ {
+		var comments []reviewComment
+		if err = r.client.get(fmt.Sprintf("%s?per_page=%d&page=%d", r.comments, reviewPageSize, page), &comments); err != nil {
+			return false, fmt.Errorf("push.Review.Comment: failed to list the comments of %s: %w", r.URL, err)
+		}
+		for _, comment := range comments {
+			if !comment.ownedBy(r.Forge, self) || !strings.Contains(comment.Body, marker) {
+				continue
+			}
+			method := http.MethodPatch
+			if r.Forge == "gitlab" {
+				method = http.MethodPut
+			}
+			if err = r.client.do(method, r.comment(comment.ID), nil, map[string]string{"body": body}, nil); err != nil {
+				return false, fmt.Errorf("push.Review.Comment: failed to update comment %d of %s: %w", comment.ID, r.URL, err)
+			}
+			return true, nil
+		}
+		if len(comments) < reviewPageSize {
+			break
+		}
+	}
+
+	if err = r.client.post(r.comments, "", map[string]string{"body": body}, nil); err != nil {
+		var status *StatusError
+		if errors.As(err, &status) && (status.StatusCode == http.StatusUnauthorized || status.StatusCode == http.StatusForbidden) {
+			err = fmt.Errorf("the token isn't allowed to comment: %w", err)
+		}
+		return false, fmt.Errorf("push.Review.Comment: failed to comment on %s: %w", r.URL, err)
+	}
+	return false, nil
+}
@@ -0,0 +1,135 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package push
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// fakeForge serves the comments of a pull request of GitHub, or a merge
+// request of GitLab, and records the ones that are updated or created.
+type fakeForge struct {
+	self     reviewUser
+	comments []reviewComment
+	updated  []string
+	created  []string
+}
+
+func (f *fakeForge) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/user"):
+		json.NewEncoder(w).Encode(f.self)
+	case r.Method == http.MethodGet:
+		json.NewEncoder(w).Encode(f.comments)
+	case r.Method == http.MethodPost:
+		f.created = append(f.created, r.URL.Path)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("{}"))
+	default:
+		f.updated = append(f.updated, r.URL.Path)
+		w.Write([]byte("{}"))
+	}
+}
+
+func TestReviewComment(t *testing.T) {
+	tests := []struct {
+		name     string
+		path     string
+		self     reviewUser
+		comments []reviewComment
+		updated  string
+	}{
+		{
+			name: "github, own comment",
+			path: "/owner/repo/pull/12",
+			self: reviewUser{Login: "autobuild-bot"},
+			comments: []reviewComment{
+				{ID: 1, Body: "<!-- marker --> planted", User: reviewUser{Login: "author"}},
+				{ID: 2, Body: "<!-- marker --> report", User: reviewUser{Login: "Autobuild-Bot"}},
+			},
+			updated: "/api/v3/repos/owner/repo/issues/comments/2",
+		},
+		{
+			name:     "github, only planted",
+			path:     "/owner/repo/pull/12",
+			self:     reviewUser{Login: "autobuild-bot"},
+			comments: []reviewComment{{ID: 1, Body: "<!-- marker -->", User: reviewUser{Login: "author"}}},
+		},
+		{
+			name: "gitlab, own note",
+			path: "/group/project/-/merge_requests/34",
+			self: reviewUser{ID: 7},
+			comments: []reviewComment{
+				{ID: 1, Body: "<!-- marker -->", Author: reviewUser{ID: 8}},
+				{ID: 2, Body: "<!-- marker -->", Author: reviewUser{ID: 7}},
+			},
+			updated: "/api/v4/projects/group/project/merge_requests/34/notes/2",
+		},
+		{
+			name:     "gitlab, without the marker",
+			path:     "/group/project/-/merge_requests/34",
+			self:     reviewUser{ID: 7},
+			comments: []reviewComment{{ID: 2, Body: "LGTM", Author: reviewUser{ID: 7}}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forge := &fakeForge{self: tt.self, comments: tt.comments}
+			server := httptest.NewServer(forge)
+			defer server.Close()
+
+			review, err := ParseReview(server.URL+tt.path, "token")
+			if err != nil {
+				t.Fatal(err)
+			}
+			updated, err := review.Comment("<!-- marker -->", "<!-- marker --> new")
+			if err != nil {
+				t.Fatalf("Comment(): %s", err)
+			}
+			if updated != (tt.updated != "") {
+				t.Errorf("Comment() = %t, want %t", updated, tt.updated != "")
+			}
+			if tt.updated != "" && (len(forge.updated) != 1 || forge.updated[0] != tt.updated) {
+				t.Errorf("updated %q, want %s", forge.updated, tt.updated)
+			}
+			if tt.updated == "" && (len(forge.created) != 1 || len(forge.updated) != 0) {
+				t.Errorf("created %q and updated %q, want a new comment", forge.created, forge.updated)
+			}
+		})
+	}
+}
+
+func TestReviewTruncate(t *testing.T) {
+	line := strings.Repeat("é", 99) + "\n"
+	tests := []struct {
+		forge string
+		body  string
+		limit int
+	}{
+		{"github", "short", githubMaxComment},
+		{"github", strings.Repeat(line, 1000), githubMaxComment},
+		{"gitlab", strings.Repeat(line, 1000), gitlabMaxComment},
+		{"gitlab", strings.Repeat(line, 20000), gitlabMaxComment},
+	}
+	for _, tt := range tests {
+		review := &Review{Forge: tt.forge}
+		got := review.truncate(tt.body)
+		if n := utf8.RuneCountInString(got); n > tt.limit {
+			t.Errorf("truncate() of %d characters for %s has %d characters", utf8.RuneCountInString(tt.body), tt.forge, n)
+		}
+		if truncated := utf8.RuneCountInString(tt.body) > tt.limit; truncated != strings.HasSuffix(got, truncatedNotice) {
+			t.Errorf("truncate() of %d characters for %s: truncated = %t", utf8.RuneCountInString(tt.body), tt.forge, !truncated)
+		} else if !truncated && got != tt.body {
+			t.Errorf("truncate() changed a body that fits")
+		} else if truncated && !strings.HasPrefix(tt.body, strings.TrimSuffix(got, truncatedNotice)+"\n") {
+			t.Errorf("truncate() didn't cut at a line")
+		}
+	}
+}
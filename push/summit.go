@@ -0,0 +1,158 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package push
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/GZGavinZhao/autobuild/common"
+)
+
+// SummitBuilder publishes packages to Serpent OS' summit, which dispatches the
+// builds to its avalanche builders and imports the results with vessel.
+type SummitBuilder struct {
+	client *httpClient
+}
+
+type summitBuildRequest struct {
+	Source   string   `json:"source"`
+	Version  string   `json:"version"`
+	Release  int      `json:"release"`
+	Path     string   `json:"path"`
+	Ref      string   `json:"ref"`
+	Metadata Metadata `json:"metadata"`
+}
+
+type summitBuild struct {
+	ID      int    `json:"id"`
+	Source  string `json:"source"`
+	Tag     string `json:"tag"`
+	Status  string `json:"status"`
+	Builder string `json:"builder"`
+}
+
+// job converts a summit build to a job, mapping summit's task statuses to the
+// ones of the Solus build server.
+func (b summitBuild) job() Job {
+	job := Job{
+		ID:      b.ID,
+		Pkg:     b.Source,
+		Tag:     b.Tag,
+		Builder: b.Builder,
+	}
+
+	switch strings.ToLower(b.Status) {
+	case "new", "queued", "blocked":
+		job.Status = StatusUnclaimed
+	case "allocated":
+		job.Status = StatusClaimed
+	case "building", "publishing":
+		job.Status = StatusBuilding
+	case "completed":
+		job.Status = StatusOK
+	case "failed":
+		job.Status = StatusFailed
+	case "cancelled", "canceled":
+		job.Status = StatusCancelled
+	default:
+		job.Status = strings.ToUpper(b.Status)
+	}
+	return job
+}
+
+func (b *SummitBuilder) Name() string {
+	return "summit"
+}
+
+func (b *SummitBuilder) Target() string {
+	return b.client.url
+}
+
+func (b *SummitBuilder) Idempotent() bool {
+	return true
+}
+
+func (b *SummitBuilder) Publish(pkg common.Package, meta Metadata) (job Job, err error) {
+	src, err := resolveSource(pkg)
+	if err != nil {
+		return
+	}
+	if meta.Commit == "" {
+		meta.Commit = src.Ref
+	}
+
+	req := summitBuildRequest{
+		Source:   pkg.Name,
+		Version:  pkg.Version,
+		Release:  pkg.Release,
+		Path:     src.Path,
+		Ref:      src.Ref,
+		Metadata: meta,
+	}
+	var build summitBuild
+	if err = b.client.post("/api/v1/builds", IdempotencyKey(pkg), req, &build); err != nil {
+		err = fmt.Errorf("push.SummitBuilder.Publish: failed to publish package %s: %w", pkg.Name, err)
+		return
+	}
+	return build.job(), nil
+}
+
+func (b *SummitBuilder) Query(jobid int) (job Job, err error) {
+	var build summitBuild
+	if err = b.client.get(fmt.Sprintf("/api/v1/builds/%d", jobid), &build); err != nil {
+		err = fmt.Errorf("push.SummitBuilder.Query: failed to query build %d: %w", jobid, err)
+		return
+	}
+	return build.job(), nil
+}
+
+func (b *SummitBuilder) Cancel(jobid int) (job Job, err error) {
+	var build summitBuild
+	if err = b.client.post(fmt.Sprintf("/api/v1/builds/%d/cancel", jobid), "", nil, &build); err != nil {
+		err = fmt.Errorf("push.SummitBuilder.Cancel: failed to cancel build %d: %w", jobid, err)
+		return
+	}
+	return build.job(), nil
+}
+
+func (b *SummitBuilder) Requeue(jobid int) (job Job, err error) {
+	var build summitBuild
+	if err = b.client.post(fmt.Sprintf("/api/v1/builds/%d/retry", jobid), "", nil, &build); err != nil {
+		err = fmt.Errorf("push.SummitBuilder.Requeue: failed to retry build %d: %w", jobid, err)
+		return
+	}
+	return build.job(), nil
+}
+
+func (b *SummitBuilder) RegisterBatch(id string, pkgs []common.Package, maxFailures float64, attestation *Attestation) error {
+	if err := b.client.post("/api/v1/batches", id, newBatchRequest(id, pkgs, maxFailures, attestation), nil); err != nil {
+		return fmt.Errorf("push.SummitBuilder.RegisterBatch: failed to register batch %s: %w", id, err)
+	}
+	return nil
+}
+
+func (b *SummitBuilder) Capabilities() (Capabilities, error) {
+	return queryCapabilities(b.client, "/api/v1/capabilities")
+}
+
+func (b *SummitBuilder) Queue() (jobs []Job, err error) {
+	var builds []summitBuild
+	if err = b.client.get("/api/v1/builds?status=active", &builds); err != nil {
+		err = fmt.Errorf("push.SummitBuilder.Queue: failed to list active builds: %w", err)
+		return
+	}
+	for _, build := range builds {
+		jobs = append(jobs, build.job())
+	}
+	return
+}
+
+func (b *SummitBuilder) Remove(pkg common.Package) error {
+	if err := b.client.post("/api/v1/removals", "", newRemovalRequest(pkg), nil); err != nil {
+		return fmt.Errorf("push.SummitBuilder.Remove: failed to remove package %s: %w", pkg.Name, err)
+	}
+	return nil
+}
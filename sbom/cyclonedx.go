@@ -0,0 +1,123 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package sbom
+
+import (
+	"strconv"
+	"time"
+)
+
+// cdxDocument is a bill of materials of CycloneDX 1.5, as JSON.
+type cdxDocument struct {
+	BOMFormat    string `json:"bomFormat"`
+	SpecVersion  string `json:"specVersion"`
+	SerialNumber string `json:"serialNumber"`
+	Version      int    `json:"version"`
+	Metadata     struct {
+		Timestamp string `json:"timestamp"`
+		Tools     struct {
+			Components []cdxComponent `json:"components"`
+		} `json:"tools"`
+		Component cdxComponent `json:"component"`
+	} `json:"metadata"`
+	Components   []cdxComponent  `json:"components"`
+	Dependencies []cdxDependency `json:"dependencies"`
+}
+
+type cdxComponent struct {
+	Type       string         `json:"type"`
+	BOMRef     string         `json:"bom-ref,omitempty"`
+	Name       string         `json:"name"`
+	Version    string         `json:"version,omitempty"`
+	Licenses   []cdxLicense   `json:"licenses,omitempty"`
+	References []cdxReference `json:"externalReferences,omitempty"`
+	Properties []cdxProperty  `json:"properties,omitempty"`
+}
+
+type cdxLicense struct {
+	License struct {
+		// ID is the identifier of SPDX licenses, Name the name of others.
+		ID   string `json:"id,omitempty"`
+		Name string `json:"name,omitempty"`
+	} `json:"license"`
+}
+
+type cdxReference struct {
+	Type   string    `json:"type"`
+	URL    string    `json:"url"`
+	Hashes []cdxHash `json:"hashes,omitempty"`
+}
+
+type cdxHash struct {
+	Alg     string `json:"alg"`
+	Content string `json:"content"`
+}
+
+type cdxProperty struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type cdxDependency struct {
+	Ref       string   `json:"ref"`
+	DependsOn []string `json:"dependsOn"`
+}
+
+func toCycloneDX(doc Document) cdxDocument {
+	res := cdxDocument{
+		BOMFormat:    "CycloneDX",
+		SpecVersion:  "1.5",
+		SerialNumber: "urn:uuid:" + newUUID(),
+		Version:      1,
+		Components:   []cdxComponent{},
+		Dependencies: []cdxDependency{},
+	}
+	res.Metadata.Timestamp = doc.Created.UTC().Format(time.RFC3339)
+	res.Metadata.Tools.Components = []cdxComponent{{Type: "application", Name: doc.Tool, Version: doc.ToolVersion}}
+	res.Metadata.Component = cdxComponent{Type: "platform", Name: doc.Name}
+
+	names := make(map[string]bool, len(doc.Components))
+	for _, c := range doc.Components {
+		names[c.Name] = true
+	}
+	for _, c := range doc.Components {
+		comp := cdxComponent{Type: "library", BOMRef: c.Name, Name: c.Name, Version: c.Version}
+		for _, name := range c.Licenses {
+			var license cdxLicense
+			if id, ok := licenseID(name); ok {
+				license.License.ID = id
+			} else {
+				license.License.Name = name
+			}
+			comp.Licenses = append(comp.Licenses, license)
+		}
+		for _, source := range c.Sources {
+			ref := cdxReference{Type: "distribution", URL: source.URL}
+			if source.Git {
+				ref.Type = "vcs"
+			}
+			if source.SHA256 != "" {
+				ref.Hashes = []cdxHash{{Alg: "SHA-256", Content: source.SHA256}}
+			}
+			comp.References = append(comp.References, ref)
+		}
+		if c.Release != 0 {
+			comp.Properties = append(comp.Properties, cdxProperty{Name: "autobuild:release", Value: strconv.Itoa(c.Release)})
+		}
+		if c.Component != "" {
+			comp.Properties = append(comp.Properties, cdxProperty{Name: "autobuild:component", Value: c.Component})
+		}
+		res.Components = append(res.Components, comp)
+
+		dep := cdxDependency{Ref: c.Name, DependsOn: []string{}}
+		for _, name := range c.DependsOn {
+			if names[name] {
+				dep.DependsOn = append(dep.DependsOn, name)
+			}
+		}
+		res.Dependencies = append(res.Dependencies, dep)
+	}
+	return res
+}
@@ -0,0 +1,106 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+// Package sbom writes software bills of materials of packages, as SPDX or
+// CycloneDX documents.
+package sbom
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Formats lists the formats that Write accepts.
+var Formats = []string{"spdx", "cyclonedx"}
+
+// Component is a package of a bill of materials.
+type Component struct {
+	Name    string
+	Version string
+	Release int
+	// Component is the component of the package in the repository, e.g.
+	// system.base.
+	Component string
+	Licenses  []string
+	Sources   []Source
+	// DependsOn holds the names of the components this one depends on.
+	DependsOn []string
+}
+
+// Source is where the sources of a component are downloaded from.
+type Source struct {
+	URL string
+	// SHA256 is the hash of the download, if known.
+	SHA256 string
+	// Git is set for git repositories, URL is then a repository and Ref the
+	// commit or tag of the sources.
+	Git bool
+	Ref string
+}
+
+var sha256re = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// ParseSource parses a source of a recipe as "url hash", where the URL of git
+// repositories is prefixed with git|, and their hash is a ref.
+func ParseSource(source string) Source {
+	url, hash, _ := strings.Cut(source, " ")
+	if repo, ok := strings.CutPrefix(url, "git|"); ok {
+		return Source{URL: repo, Git: true, Ref: hash}
+	}
+	if !sha256re.MatchString(hash) {
+		hash = ""
+	}
+	return Source{URL: url, SHA256: hash}
+}
+
+// Document is a bill of materials.
+type Document struct {
+	// Name describes what the document is about, e.g. the TPath of a state.
+	Name string
+	// Tool and ToolVersion name what created the document.
+	Tool        string
+	ToolVersion string
+	Created     time.Time
+	Components  []Component
+}
+
+// Write writes `doc` to `w` as JSON, in `format`, one of Formats.
+func Write(w io.Writer, format string, doc Document) error {
+	var out any
+	switch format {
+	case "spdx":
+		out = toSPDX(doc)
+	case "cyclonedx":
+		out = toCycloneDX(doc)
+	default:
+		return fmt.Errorf("sbom.Write: unknown format %q, expected one of %q", format, Formats)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(out); err != nil {
+		return fmt.Errorf("sbom.Write: %w", err)
+	}
+	return nil
+}
+
+// newUUID returns a random UUID, of version 4.
+func newUUID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	s := hex.EncodeToString(b)
+	return fmt.Sprintf("%s-%s-%s-%s-%s", s[:8], s[8:12], s[12:16], s[16:20], s[20:])
+}
+
+// badIDChars matches the characters that can't be part of the IDs of SPDX
+// elements and licenses.
+var badIDChars = regexp.MustCompile(`[^A-Za-z0-9.-]+`)
@@ -0,0 +1,185 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package sbom
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testDocument has two packages whose names only differ in characters that
+// SPDX IDs can't have, and licenses that are or aren't on the SPDX list.
+var testDocument = Document{
+	Name:        "src:.",
+	Tool:        "autobuild",
+	ToolVersion: "1.0",
+	Created:     time.Date(2023, 1, 2, 3, 4, 5, 0, time.UTC),
+	Components: []Component{
+		{
+			Name:      "zlib",
+			Version:   "1.3",
+			Release:   12,
+			Component: "system.base",
+			Licenses:  []string{"zlib"},
+			Sources:   []Source{{URL: "https://zlib.net/zlib-1.3.tar.xz", SHA256: "8a9ba2898e1d0d774eca6ba5b4627a11e5588ba85c8851336eb38de4683050a7"}},
+		},
+		{
+			Name:      "foo_bar",
+			Version:   "2.0",
+			Licenses:  []string{"gpl-2.0-or-later", "Custom License", "LicenseRef-Custom-License", "MIT-like"},
+			Sources:   []Source{{URL: "https://example.com/foo.git", Git: true, Ref: "v2.0"}},
+			DependsOn: []string{"zlib", "missing"},
+		},
+		{Name: "foo-bar", Version: "3.0"},
+	},
+}
+
+func TestLicenseID(t *testing.T) {
+	tests := []struct {
+		license string
+		want    string
+		ok      bool
+	}{
+		{"MIT", "MIT", true},
+		{"gpl-2.0-or-later", "GPL-2.0-or-later", true},
+		{"GPL-2.0+", "GPL-2.0+", true},
+		{"Zlib", "Zlib", true},
+		{"MIT-like", "", false},
+		{"BSD", "", false},
+		{"Public-Domain", "", false},
+		{"LicenseRef-Custom", "", false},
+	}
+	for _, tt := range tests {
+		if got, ok := licenseID(tt.license); got != tt.want || ok != tt.ok {
+			t.Errorf("licenseID(%q) = %q, %t, want %q, %t", tt.license, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestParseSource(t *testing.T) {
+	hash := "8a9ba2898e1d0d774eca6ba5b4627a11e5588ba85c8851336eb38de4683050a7"
+	tests := []struct {
+		source string
+		want   Source
+	}{
+		{"https://zlib.net/zlib-1.3.tar.xz " + hash, Source{URL: "https://zlib.net/zlib-1.3.tar.xz", SHA256: hash}},
+		{"https://example.com/foo.tar.gz md5", Source{URL: "https://example.com/foo.tar.gz"}},
+		{"git|https://example.com/foo.git v2.0", Source{URL: "https://example.com/foo.git", Git: true, Ref: "v2.0"}},
+	}
+	for _, tt := range tests {
+		if got := ParseSource(tt.source); got != tt.want {
+			t.Errorf("ParseSource(%q) = %+v, want %+v", tt.source, got, tt.want)
+		}
+	}
+}
+
+// writeTestDocument writes testDocument in `format`, and decodes it into
+// `doc`.
+func writeTestDocument(t *testing.T, format string, doc any) {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := Write(&buf, format, testDocument); err != nil {
+		t.Fatalf("Write(%s): %s", format, err)
+	}
+	if err := json.Unmarshal(buf.Bytes(), doc); err != nil {
+		t.Fatalf("Write(%s) isn't JSON: %s", format, err)
+	}
+}
+
+func TestWriteSPDX(t *testing.T) {
+	var doc spdxDocument
+	writeTestDocument(t, "spdx", &doc)
+
+	if doc.SPDXVersion != "SPDX-2.3" || doc.CreationInfo.Created != "2023-01-02T03:04:05Z" || doc.CreationInfo.Creators[0] != "Tool: autobuild-1.0" {
+		t.Errorf("document = %+v", doc)
+	}
+	ids := make([]string, 0, len(doc.Packages))
+	for _, pkg := range doc.Packages {
+		ids = append(ids, pkg.SPDXID)
+	}
+	if want := []string{"SPDXRef-Package-zlib", "SPDXRef-Package-foo-bar", "SPDXRef-Package-foo-bar-2"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("package IDs = %q, want %q", ids, want)
+	}
+
+	zlib, foo := doc.Packages[0], doc.Packages[1]
+	if zlib.LicenseDeclared != "Zlib" || zlib.DownloadLocation != "https://zlib.net/zlib-1.3.tar.xz" || len(zlib.Checksums) != 1 || zlib.Comment != "Release 12 in system.base" {
+		t.Errorf("zlib = %+v", zlib)
+	}
+	if want := "GPL-2.0-or-later AND LicenseRef-Custom-License AND LicenseRef-Custom-License AND LicenseRef-MIT-like"; foo.LicenseDeclared != want {
+		t.Errorf("licenseDeclared of foo_bar = %q, want %q", foo.LicenseDeclared, want)
+	}
+	if foo.DownloadLocation != "git+https://example.com/foo.git@v2.0" || foo.Checksums != nil {
+		t.Errorf("foo_bar = %+v", foo)
+	}
+	if bare := doc.Packages[2]; bare.LicenseDeclared != spdxNoAssertion || bare.DownloadLocation != spdxNoAssertion {
+		t.Errorf("foo-bar = %+v", bare)
+	}
+
+	wantLicenses := []spdxLicense{
+		{ID: "LicenseRef-Custom-License", Name: "Custom License", Text: spdxNoAssertion},
+		{ID: "LicenseRef-MIT-like", Name: "MIT-like", Text: spdxNoAssertion},
+	}
+	if !reflect.DeepEqual(doc.ExtractedLicenses, wantLicenses) {
+		t.Errorf("hasExtractedLicensingInfos = %+v, want %+v", doc.ExtractedLicenses, wantLicenses)
+	}
+
+	wantRelationships := []spdxRelationship{
+		{"SPDXRef-DOCUMENT", "DESCRIBES", "SPDXRef-Package-zlib"},
+		{"SPDXRef-DOCUMENT", "DESCRIBES", "SPDXRef-Package-foo-bar"},
+		{"SPDXRef-Package-foo-bar", "DEPENDS_ON", "SPDXRef-Package-zlib"},
+		{"SPDXRef-DOCUMENT", "DESCRIBES", "SPDXRef-Package-foo-bar-2"},
+	}
+	if !reflect.DeepEqual(doc.Relationships, wantRelationships) {
+		t.Errorf("relationships = %+v, want %+v", doc.Relationships, wantRelationships)
+	}
+}
+
+func TestWriteCycloneDX(t *testing.T) {
+	var doc cdxDocument
+	writeTestDocument(t, "cyclonedx", &doc)
+
+	if doc.BOMFormat != "CycloneDX" || doc.SpecVersion != "1.5" || doc.Metadata.Timestamp != "2023-01-02T03:04:05Z" || doc.Metadata.Component.Name != "src:." {
+		t.Errorf("document = %+v", doc)
+	}
+	if len(doc.Components) != 3 {
+		t.Fatalf("components = %+v, want 3", doc.Components)
+	}
+
+	var licenses [][2]string
+	for _, license := range doc.Components[1].Licenses {
+		licenses = append(licenses, [2]string{license.License.ID, license.License.Name})
+	}
+	wantLicenses := [][2]string{{"GPL-2.0-or-later", ""}, {"", "Custom License"}, {"", "LicenseRef-Custom-License"}, {"", "MIT-like"}}
+	if !reflect.DeepEqual(licenses, wantLicenses) {
+		t.Errorf("licenses of foo_bar = %q, want %q", licenses, wantLicenses)
+	}
+
+	zlib := doc.Components[0]
+	wantProperties := []cdxProperty{{"autobuild:release", "12"}, {"autobuild:component", "system.base"}}
+	if len(zlib.Licenses) != 1 || zlib.Licenses[0].License.ID != "Zlib" || !reflect.DeepEqual(zlib.Properties, wantProperties) {
+		t.Errorf("zlib = %+v", zlib)
+	}
+	if refs := doc.Components[1].References; len(refs) != 1 || refs[0].Type != "vcs" {
+		t.Errorf("externalReferences of foo_bar = %+v", refs)
+	}
+
+	wantDependencies := []cdxDependency{
+		{Ref: "zlib", DependsOn: []string{}},
+		{Ref: "foo_bar", DependsOn: []string{"zlib"}},
+		{Ref: "foo-bar", DependsOn: []string{}},
+	}
+	if !reflect.DeepEqual(doc.Dependencies, wantDependencies) {
+		t.Errorf("dependencies = %+v, want %+v", doc.Dependencies, wantDependencies)
+	}
+}
+
+func TestWriteUnknownFormat(t *testing.T) {
+	if err := Write(&bytes.Buffer{}, "swid", testDocument); err == nil {
+		t.Error("Write(swid) didn't fail")
+	}
+}
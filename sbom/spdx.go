@@ -0,0 +1,156 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package sbom
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// spdxDocument is a document of SPDX 2.3, as JSON.
+type spdxDocument struct {
+	SPDXVersion       string `json:"spdxVersion"`
+	DataLicense       string `json:"dataLicense"`
+	SPDXID            string `json:"SPDXID"`
+	Name              string `json:"name"`
+	DocumentNamespace string `json:"documentNamespace"`
+	CreationInfo      struct {
+		Created  string   `json:"created"`
+		Creators []string `json:"creators"`
+	} `json:"creationInfo"`
+	Packages      []spdxPackage      `json:"packages"`
+	Relationships []spdxRelationship `json:"relationships"`
+	// ExtractedLicenses describes the licenses that aren't known to SPDX.
+	ExtractedLicenses []spdxLicense `json:"hasExtractedLicensingInfos,omitempty"`
+}
+
+type spdxPackage struct {
+	SPDXID           string         `json:"SPDXID"`
+	Name             string         `json:"name"`
+	VersionInfo      string         `json:"versionInfo"`
+	DownloadLocation string         `json:"downloadLocation"`
+	FilesAnalyzed    bool           `json:"filesAnalyzed"`
+	LicenseConcluded string         `json:"licenseConcluded"`
+	LicenseDeclared  string         `json:"licenseDeclared"`
+	CopyrightText    string         `json:"copyrightText"`
+	Checksums        []spdxChecksum `json:"checksums,omitempty"`
+	Comment          string         `json:"comment,omitempty"`
+}
+
+type spdxChecksum struct {
+	Algorithm string `json:"algorithm"`
+	Value     string `json:"checksumValue"`
+}
+
+type spdxRelationship struct {
+	Element string `json:"spdxElementId"`
+	Type    string `json:"relationshipType"`
+	Related string `json:"relatedSpdxElement"`
+}
+
+type spdxLicense struct {
+	ID   string `json:"licenseId"`
+	Name string `json:"name"`
+	Text string `json:"extractedText"`
+}
+
+const spdxNoAssertion = "NOASSERTION"
+
+// spdxLocation returns where `source` is downloaded from, as SPDX spells it.
+func spdxLocation(source Source) string {
+	if source.Git {
+		location := "git+" + source.URL
+		if source.Ref != "" {
+			location += "@" + source.Ref
+		}
+		return location
+	}
+	return source.URL
+}
+
+func toSPDX(doc Document) spdxDocument {
+	res := spdxDocument{
+		SPDXVersion:       "SPDX-2.3",
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              doc.Name,
+		DocumentNamespace: fmt.Sprintf("https://spdx.org/spdxdocs/autobuild-%s-%s", url.PathEscape(badIDChars.ReplaceAllString(doc.Name, "-")), newUUID()),
+		Packages:          []spdxPackage{},
+		Relationships:     []spdxRelationship{},
+	}
+	res.CreationInfo.Created = doc.Created.UTC().Format(time.RFC3339)
+	res.CreationInfo.Creators = []string{"Tool: " + doc.Tool + "-" + doc.ToolVersion}
+
+	// ids maps the names of the components to the IDs of their packages,
+	// which must be unique after replacing the characters SPDX doesn't allow.
+	ids := make(map[string]string, len(doc.Components))
+	taken := make(map[string]bool, len(doc.Components))
+	for _, c := range doc.Components {
+		id := "SPDXRef-Package-" + badIDChars.ReplaceAllString(c.Name, "-")
+		for base, i := id, 2; taken[id]; i++ {
+			id = fmt.Sprintf("%s-%d", base, i)
+		}
+		ids[c.Name], taken[id] = id, true
+	}
+
+	extracted := make(map[string]bool)
+	for _, c := range doc.Components {
+		pkg := spdxPackage{
+			SPDXID:           ids[c.Name],
+			Name:             c.Name,
+			VersionInfo:      c.Version,
+			DownloadLocation: spdxNoAssertion,
+			LicenseConcluded: spdxNoAssertion,
+			LicenseDeclared:  spdxNoAssertion,
+			CopyrightText:    spdxNoAssertion,
+		}
+		// Only the first source is where the package comes from, the others
+		// are patches and extra files.
+		if len(c.Sources) != 0 {
+			pkg.DownloadLocation = spdxLocation(c.Sources[0])
+			if c.Sources[0].SHA256 != "" {
+				pkg.Checksums = []spdxChecksum{{Algorithm: "SHA256", Value: c.Sources[0].SHA256}}
+			}
+		}
+		if c.Release != 0 {
+			pkg.Comment = fmt.Sprintf("Release %d", c.Release)
+			if c.Component != "" {
+				pkg.Comment += " in " + c.Component
+			}
+		}
+
+		var licenses []string
+		for _, license := range c.Licenses {
+			if id, ok := licenseID(license); ok {
+				license = id
+			} else {
+				// Licenses that aren't on the SPDX license list are referred
+				// to by name, including the ones that recipes already spell
+				// as a LicenseRef-.
+				id := "LicenseRef-" + strings.Trim(badIDChars.ReplaceAllString(strings.TrimPrefix(license, "LicenseRef-"), "-"), "-")
+				if !extracted[id] {
+					extracted[id] = true
+					res.ExtractedLicenses = append(res.ExtractedLicenses, spdxLicense{ID: id, Name: license, Text: spdxNoAssertion})
+				}
+				license = id
+			}
+			licenses = append(licenses, license)
+		}
+		if len(licenses) != 0 {
+			pkg.LicenseDeclared = strings.Join(licenses, " AND ")
+		}
+		res.Packages = append(res.Packages, pkg)
+
+		res.Relationships = append(res.Relationships, spdxRelationship{Element: res.SPDXID, Type: "DESCRIBES", Related: pkg.SPDXID})
+		for _, dep := range c.DependsOn {
+			if depID, ok := ids[dep]; ok {
+				res.Relationships = append(res.Relationships, spdxRelationship{Element: pkg.SPDXID, Type: "DEPENDS_ON", Related: depID})
+			}
+		}
+	}
+	return res
+}
@@ -0,0 +1,299 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package state
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/GZGavinZhao/autobuild/utils"
+	"github.com/getsolus/libeopkg/archive"
+	"github.com/ulikunitz/xz"
+)
+
+// sonameRe matches shared libraries with a version after .so, and captures
+// their directory, and their name up to the major version, which is what the
+// soname usually is.
+var sonameRe = regexp.MustCompile(`^/?(usr/lib(?:32|64)?)/([^/]+\.so\.\d+)(?:\.\d+)*$`)
+
+// SonameChange describes the sonames that a bumped package stopped or started
+// shipping between two binary states.
+type SonameChange struct {
+	// Idx is the index of the package in the new state.
+	Idx     int
+	Removed []string
+	Added   []string
+}
+
+// Breaking reports whether packages linking against the old sonames of the
+// package need to be rebuilt.
+func (c SonameChange) Breaking() bool {
+	return len(c.Removed) != 0
+}
+
+// Sonames returns the sonames of the shared libraries shipped by the binary
+// packages of the source package at `idx`, sorted. The packages are read from
+// the repository of the state, and downloaded if it is remote. Debug info
+// packages are skipped.
+func (s *BinaryState) Sonames(idx int) (sonames []string, err error) {
+	for _, uri := range s.uris[idx] {
+		if strings.Contains(filepath.Base(uri), "-dbginfo-") {
+			continue
+		}
+
+		path, cleanup, err := s.fetch(uri)
+		if err != nil {
+			return nil, err
+		}
+		pkg, err := archive.Open(path)
+		if err == nil {
+			if err = pkg.ReadFiles(); err != nil {
+				pkg.Close()
+			}
+		}
+		if err != nil {
+			cleanup()
+			return nil, fmt.Errorf("state.BinaryState.Sonames: failed to read %s: %w", uri, err)
+		}
+		for _, file := range pkg.Files.File {
+			if match := sonameRe.FindStringSubmatch(file.Path); match != nil {
+				sonames = append(sonames, match[2])
+			}
+		}
+		pkg.Close()
+		cleanup()
+	}
+	slices.Sort(sonames)
+	return utils.Uniq(sonames), nil
+}
+
+// fetch returns the local path of the binary package at `uri`, and a function
+// to call once the package isn't needed anymore.
+func (s *BinaryState) fetch(uri string) (path string, cleanup func(), err error) {
+	if !strings.HasPrefix(s.base, "https://") && !strings.HasPrefix(s.base, "http://") {
+		return filepath.Join(s.base, uri), func() {}, nil
+	}
+
+	url := s.base + "/" + uri
+	resp, err := http.Get(url)
+	if err != nil {
+		return "", nil, fmt.Errorf("state.BinaryState.fetch: failed to download %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", nil, fmt.Errorf("state.BinaryState.fetch: failed to download %s: %s", url, resp.Status)
+	}
+
+	file, err := os.CreateTemp("", "autobuild-*.eopkg")
+	if err != nil {
+		return "", nil, fmt.Errorf("state.BinaryState.fetch: failed to create temporary file: %w", err)
+	}
+	defer file.Close()
+	cleanup = func() { os.Remove(file.Name()) }
+	if _, err = io.Copy(file, resp.Body); err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("state.BinaryState.fetch: failed to download %s: %w", url, err)
+	}
+	return file.Name(), cleanup, nil
+}
+
+// Dependents returns the indices of the source packages whose binary packages
+// depend at runtime on a binary package of the source package at `idx`. The
+// runtime dependencies of eopkg packages include the packages of the shared
+// libraries they link against.
+func (s *BinaryState) Dependents(idx int) (res []int) {
+	for dependent, deps := range s.runDeps {
+		if dependent != idx && slices.ContainsFunc(deps, func(dep int32) bool {
+			srcIdx, ok := s.binToSrcIdx[s.strs.String(dep)]
+			return ok && srcIdx == idx
+		}) {
+			res = append(res, dependent)
+		}
+	}
+	return
+}
+
+// SonameChanges compares the sonames shipped by the bumped packages of `diffs`
+// (see Changed) between the binary states `old` and `cur`, and returns the
+// packages whose sonames changed.
+func SonameChanges(old *BinaryState, cur *BinaryState, diffs []Diff) (res []SonameChange, err error) {
+	for _, diff := range diffs {
+		if kind := diff.Kind(); !kind.Bumped() || kind == KindNew {
+			continue
+		}
+
+		oldSonames, err := old.Sonames(diff.OldIdx)
+		if err != nil {
+			return nil, err
+		}
+		newSonames, err := cur.Sonames(diff.Idx)
+		if err != nil {
+			return nil, err
+		}
+
+		change := SonameChange{Idx: diff.Idx}
+		for _, soname := range oldSonames {
+			if _, found := slices.BinarySearch(newSonames, soname); !found {
+				change.Removed = append(change.Removed, soname)
+			}
+		}
+		for _, soname := range newSonames {
+			if _, found := slices.BinarySearch(oldSonames, soname); !found {
+				change.Added = append(change.Added, soname)
+			}
+		}
+		if len(change.Removed) != 0 || len(change.Added) != 0 {
+			res = append(res, change)
+		}
+	}
+	return
+}
+
+// ExtractLibraries extracts the shared libraries shipped by the binary
+// packages of the source package at `idx` into `dir`, and returns their paths
+// by library, i.e. directory and soname such as usr/lib32/libz.so.1, since the
+// 32-bit packages ship the same sonames as the 64-bit ones. Debug info
+// packages are skipped, like for Sonames: they are often larger than the
+// packages themselves, so ABIBreaks compares the libraries without them.
+func (s *BinaryState) ExtractLibraries(idx int, dir string) (libs map[string]string, err error) {
+	if err = os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("state.BinaryState.ExtractLibraries: %w", err)
+	}
+	libs = make(map[string]string)
+	for _, uri := range s.uris[idx] {
+		if strings.Contains(filepath.Base(uri), "-dbginfo-") {
+			continue
+		}
+
+		path, cleanup, err := s.fetch(uri)
+		if err != nil {
+			return nil, err
+		}
+		err = extractLibraries(path, dir, libs)
+		cleanup()
+		if err != nil {
+			return nil, fmt.Errorf("state.BinaryState.ExtractLibraries: failed to extract %s: %w", uri, err)
+		}
+	}
+	return libs, nil
+}
+
+// extractLibraries extracts the shared libraries of the install.tar.xz of the
+// .eopkg file at `path` into `dir`, under their library, and adds them to
+// `libs`. Symlinks are skipped, since they point to the library itself.
+func extractLibraries(path string, dir string, libs map[string]string) error {
+	pkg, err := archive.Open(path)
+	if err != nil {
+		return err
+	}
+	defer pkg.Close()
+	file := pkg.FindFile("install.tar.xz")
+	if file == nil {
+		return errors.New("no install.tar.xz")
+	}
+	rc, err := file.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	xr, err := xz.NewReader(rc)
+	if err != nil {
+		return err
+	}
+
+	tr := tar.NewReader(xr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		match := sonameRe.FindStringSubmatch(header.Name)
+		if match == nil || header.Typeflag != tar.TypeReg {
+			continue
+		}
+		lib := match[1] + "/" + match[2]
+		if _, ok := libs[lib]; ok {
+			continue
+		}
+		dst := filepath.Join(dir, lib)
+		if err = os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+			return err
+		}
+		f, err := os.Create(dst)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, tr)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+		libs[lib] = dst
+	}
+}
+
+// ABIDiff is the abidiff command of libabigail, which ABIBreaks compares
+// shared libraries with.
+var ABIDiff = "abidiff"
+
+// Bits of the exit status of abidiff.
+const (
+	abidiffError        = 1
+	abidiffUsageError   = 2
+	abidiffIncompatible = 8
+)
+
+// ABIBreak is a shared library whose ABI changed in ways that break the
+// packages linking against it.
+type ABIBreak struct {
+	// Library is the directory and soname of the library, see
+	// ExtractLibraries.
+	Library string
+	// Removed is set when the library isn't shipped anymore.
+	Removed bool
+	// Report is what abidiff found, if the library is still shipped.
+	Report string
+}
+
+// ABIBreaks compares the shared libraries `oldLibs` of a package with the ones
+// it ships now, `newLibs`, by library as extracted by ExtractLibraries, and
+// returns the libraries whose ABI changed incompatibly according to abidiff.
+// abidiff isn't given any debug info (--d1 and --d2), so it only compares the
+// symbols that the libraries export, not the types of their functions.
+func ABIBreaks(oldLibs map[string]string, newLibs map[string]string) (breaks []ABIBreak, err error) {
+	for _, lib := range utils.SortedKeys(oldLibs) {
+		newLib, ok := newLibs[lib]
+		if !ok {
+			breaks = append(breaks, ABIBreak{Library: lib, Removed: true})
+			continue
+		}
+		out, err := exec.Command(ABIDiff, "--no-added-syms", oldLibs[lib], newLib).CombinedOutput()
+		status := 0
+		if exitErr := (*exec.ExitError)(nil); errors.As(err, &exitErr) {
+			status = exitErr.ExitCode()
+		} else if err != nil {
+			return nil, fmt.Errorf("state.ABIBreaks: %w", err)
+		}
+		if status&(abidiffError|abidiffUsageError) != 0 {
+			return nil, fmt.Errorf("state.ABIBreaks: failed to compare %s: %s", lib, strings.TrimSpace(string(out)))
+		} else if status&abidiffIncompatible != 0 {
+			breaks = append(breaks, ABIBreak{Library: lib, Report: strings.TrimSpace(string(out))})
+		}
+	}
+	return
+}
@@ -0,0 +1,97 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package state
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ulikunitz/xz"
+)
+
+// writeInstallPackage writes an .eopkg file to `path` whose install.tar.xz has
+// the regular files `files`, by path, and the symlinks `links`.
+func writeInstallPackage(t *testing.T, path string, files map[string]string, links map[string]string) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zw := zip.NewWriter(f)
+	w, err := zw.Create("install.tar.xz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	xw, err := xz.NewWriter(w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tw := tar.NewWriter(xw)
+	for name, content := range files {
+		if err = tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0o755, Size: int64(len(content))}); err == nil {
+			_, err = tw.Write([]byte(content))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, target := range links {
+		if err = tw.WriteHeader(&tar.Header{Name: name, Typeflag: tar.TypeSymlink, Linkname: target}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, closer := range []interface{ Close() error }{tw, xw, zw} {
+		if err = closer.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestExtractLibraries(t *testing.T) {
+	dir := t.TempDir()
+	pkgs := []struct {
+		name  string
+		files map[string]string
+		links map[string]string
+	}{
+		{
+			name:  "zlib-1.3-1-1-x86_64.eopkg",
+			files: map[string]string{"usr/lib64/libz.so.1.3": "64", "usr/bin/minigzip": "bin"},
+			links: map[string]string{"usr/lib64/libz.so.1": "libz.so.1.3", "usr/lib64/libz.so": "libz.so.1"},
+		},
+		{
+			name:  "zlib-32bit-1.3-1-1-x86_64.eopkg",
+			files: map[string]string{"usr/lib32/libz.so.1.3": "32"},
+			links: map[string]string{"usr/lib32/libz.so.1": "libz.so.1.3"},
+		},
+	}
+	libs := make(map[string]string)
+	for _, pkg := range pkgs {
+		path := filepath.Join(dir, pkg.name)
+		writeInstallPackage(t, path, pkg.files, pkg.links)
+		if err := extractLibraries(path, filepath.Join(dir, "libs"), libs); err != nil {
+			t.Fatalf("extractLibraries(%s): %s", pkg.name, err)
+		}
+	}
+
+	want := map[string]string{"usr/lib64/libz.so.1": "64", "usr/lib32/libz.so.1": "32"}
+	if len(libs) != len(want) {
+		t.Errorf("extractLibraries() = %q, want the libraries %q", libs, want)
+	}
+	for lib, content := range want {
+		path, ok := libs[lib]
+		if !ok {
+			t.Errorf("extractLibraries() didn't extract %s", lib)
+			continue
+		}
+		if got, err := os.ReadFile(path); err != nil || string(got) != content {
+			t.Errorf("%s = %q (%v), want %q", path, got, err, content)
+		}
+	}
+}
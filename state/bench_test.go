@@ -0,0 +1,142 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package state
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/GZGavinZhao/autobuild/internal/synthetic"
+)
+
+// Benchmarks run on the synthetic repository of synthetic.Fixture, e.g.
+// go test -run - -bench . ./state -args -synthetic.packages 20000.
+
+func BenchmarkLoadSource(b *testing.B) {
+	src := filepath.Join(synthetic.Fixture(b), "new", "src")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := LoadSource(src); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkLoadBinary measures loading a large index, whose packages are
+// decoded one at a time and share their strings, see loadIndex.
+func BenchmarkLoadBinary(b *testing.B) {
+	index := filepath.Join(synthetic.Fixture(b), "new", "eopkg-index.xml")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := LoadBinary(index); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkLoadBinaryCached(b *testing.B) {
+	index := filepath.Join(synthetic.Fixture(b), "new", "eopkg-index.xml")
+	IndexCache = &BinaryCache{Dir: b.TempDir(), MaxSize: 1 << 30}
+	defer func() { IndexCache = nil }()
+	if _, err := LoadBinary(index); err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := LoadBinary(index); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// liveBinaryBudget is the memory, in bytes per binary package, that the two
+// states of a diff of two indexes may keep alive, about twice what they take
+// with interned strings.
+const liveBinaryBudget = 1536
+
+// BenchmarkDiffRepos measures diffing two indexes, like a diff of
+// repo:unstable and repo:stable, and fails if the states that it keeps
+// alive take more than liveBinaryBudget per binary package.
+func BenchmarkDiffRepos(b *testing.B) {
+	dir := synthetic.Fixture(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+
+		old, err := LoadBinary(filepath.Join(dir, "old", "eopkg-index.xml"))
+		if err != nil {
+			b.Fatal(err)
+		}
+		cur, err := LoadBinary(filepath.Join(dir, "new", "eopkg-index.xml"))
+		if err != nil {
+			b.Fatal(err)
+		}
+		var oldState, curState State = old, cur
+		Changed(&oldState, &curState)
+
+		b.StopTimer()
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		bins := len(old.binToSrcIdx) + len(cur.binToSrcIdx)
+		live := float64(after.HeapAlloc-min(after.HeapAlloc, before.HeapAlloc)) / float64(bins)
+		runtime.KeepAlive(oldState)
+		runtime.KeepAlive(curState)
+		b.ReportMetric(live, "live-B/bin")
+		if live > liveBinaryBudget {
+			b.Fatalf("the states keep %.0f bytes per binary package alive, over the budget of %d", live, liveBinaryBudget)
+		}
+		b.StartTimer()
+	}
+}
+
+func BenchmarkLoadPackageDir(b *testing.B) {
+	dir := filepath.Join(synthetic.Fixture(b), "new", "packages")
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := LoadPackageDir(dir); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkLoadEopkgRepo(b *testing.B) {
+	server := httptest.NewServer(http.FileServer(http.Dir(synthetic.Fixture(b))))
+	defer server.Close()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := LoadEopkgRepo(server.URL + "/new/eopkg-index.xml.xz"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkChanged(b *testing.B) {
+	dir := synthetic.Fixture(b)
+	old, err := LoadSource(filepath.Join(dir, "old", "src"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	cur, err := LoadSource(filepath.Join(dir, "new", "src"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	var oldState, curState State = old, cur
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		Changed(&oldState, &curState)
+	}
+}
@@ -0,0 +1,119 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package state
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"github.com/GZGavinZhao/autobuild/common"
+)
+
+// recipeFiles are the files of a recipe directory that parsing it reads, see
+// common.ParsePackage and stone.ParsePackage.
+var recipeFiles = []string{"package.yml", "pspec_x86_64.xml", "autobuild.yml", "autobuild.yaml", "stone.yaml", "manifest.x86_64.bin"}
+
+// ParseCache holds the parsed recipes of source states by the contents of
+// their files, so that loading two trees that mostly hold the same recipes,
+// such as checkouts of a repository at different refs, parses the unchanged
+// ones once. It is safe for concurrent use.
+type ParseCache struct {
+	mu   sync.Mutex
+	pkgs map[string]cachedRecipe
+	hits int
+}
+
+// cachedRecipe is a parsed recipe, and the directory it was parsed from.
+type cachedRecipe struct {
+	pkg common.Package
+	dir string
+}
+
+func NewParseCache() *ParseCache {
+	return &ParseCache{pkgs: make(map[string]cachedRecipe)}
+}
+
+// Hits returns how many recipes were found in the cache instead of parsed.
+func (c *ParseCache) Hits() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits
+}
+
+// parse returns the package of the recipe in `dir`, parsing it with `parse`
+// unless a recipe with the same files was parsed before.
+func (c *ParseCache) parse(dir string, parse func(string) (common.Package, error)) (common.Package, error) {
+	if c == nil {
+		return parse(dir)
+	}
+	key, err := recipeKey(dir)
+	if err != nil {
+		return common.Package{}, err
+	}
+
+	c.mu.Lock()
+	cached, ok := c.pkgs[key]
+	if ok {
+		c.hits++
+	}
+	c.mu.Unlock()
+	if ok {
+		pkg := clonePackage(cached.pkg)
+		// The path is the directory or the recipe file in it, depending on
+		// the kind of recipe.
+		if rel, err := filepath.Rel(cached.dir, pkg.Path); err == nil && pkg.Path != "" {
+			pkg.Path = filepath.Join(dir, rel)
+		}
+		return pkg, nil
+	}
+
+	pkg, err := parse(dir)
+	if err != nil {
+		return pkg, err
+	}
+	c.mu.Lock()
+	c.pkgs[key] = cachedRecipe{clonePackage(pkg), dir}
+	c.mu.Unlock()
+	return pkg, nil
+}
+
+// recipeKey returns the hash of the names and contents of the recipeFiles of
+// `dir`.
+func recipeKey(dir string) (string, error) {
+	h := sha256.New()
+	for _, name := range recipeFiles {
+		raw, err := os.ReadFile(filepath.Join(dir, name))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		sum := sha256.Sum256(raw)
+		h.Write([]byte(name + "\x00" + hex.EncodeToString(sum[:]) + "\n"))
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// clonePackage returns a copy of `pkg` that shares nothing with it, since
+// resolving the dependencies of a package rewrites them in place.
+func clonePackage(pkg common.Package) common.Package {
+	pkg.Provides = slices.Clone(pkg.Provides)
+	pkg.BuildDeps = slices.Clone(pkg.BuildDeps)
+	pkg.DepKinds = maps.Clone(pkg.DepKinds)
+	pkg.Ignores = slices.Clone(pkg.Ignores)
+	pkg.History = slices.Clone(pkg.History)
+	pkg.Sources = slices.Clone(pkg.Sources)
+	pkg.Licenses = slices.Clone(pkg.Licenses)
+	pkg.Subpackages = slices.Clone(pkg.Subpackages)
+	pkg.Links = slices.Clone(pkg.Links)
+	return pkg
+}
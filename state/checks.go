@@ -0,0 +1,58 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package state
+
+import (
+	"slices"
+
+	"github.com/GZGavinZhao/autobuild/common"
+	"github.com/GZGavinZhao/autobuild/version"
+)
+
+// A SameCheck compares packages with the same release number in two states,
+// and fails if they differ in a way that needs a new release.
+type SameCheck struct {
+	Name    string
+	differs func(old *common.Package, cur *common.Package) bool
+}
+
+// SameChecks are all the checks there are, see SameCheck.
+var SameChecks = []SameCheck{
+	{"version", func(old *common.Package, cur *common.Package) bool {
+		return version.Compare(old.Version, cur.Version) != 0
+	}},
+	{"sources", listDiffers(func(pkg *common.Package) []string { return pkg.Sources })},
+	{"subpackages", listDiffers(func(pkg *common.Package) []string { return pkg.Subpackages })},
+	{"licenses", listDiffers(func(pkg *common.Package) []string { return pkg.Licenses })},
+}
+
+// SameCheckNames returns the names of SameChecks.
+func SameCheckNames() (names []string) {
+	for _, check := range SameChecks {
+		names = append(names, check.Name)
+	}
+	return
+}
+
+// listDiffers returns a function that compares the lists `get` returns. A list
+// is only compared if both packages have one, since states don't all record
+// the same information, e.g. binary states have no sources.
+func listDiffers(get func(*common.Package) []string) func(*common.Package, *common.Package) bool {
+	return func(old *common.Package, cur *common.Package) bool {
+		a, b := get(old), get(cur)
+		return len(a) != 0 && len(b) != 0 && !slices.Equal(a, b)
+	}
+}
+
+// FailedChecks returns the names of the checks among `checks` that `old` and
+// `cur` fail, see SameCheck.
+func FailedChecks(old common.Package, cur common.Package, checks []string) (failed []string) {
+	for _, check := range SameChecks {
+		if slices.Contains(checks, check.Name) && check.differs(&old, &cur) {
+			failed = append(failed, check.Name)
+		}
+	}
+	return
+}
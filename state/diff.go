@@ -4,6 +4,76 @@
 
 package state
 
+import (
+	"fmt"
+
+	"github.com/GZGavinZhao/autobuild/version"
+)
+
+// Kind classifies the change of a package between two states.
+type Kind int
+
+const (
+	// KindNew packages only exist in the new state.
+	KindNew Kind = iota
+	// KindUpdate packages have a new release and a newer version.
+	KindUpdate
+	// KindRebuild packages have a new release of the same version.
+	KindRebuild
+	// KindDowngrade packages have a new release but an older version.
+	KindDowngrade
+	// KindBad packages have the same release but a different version.
+	KindBad
+	// KindUnbumped packages have the same version and release, but a changed
+	// recipe, see Unbumped.
+	KindUnbumped
+	// KindOutdated packages have an older release.
+	KindOutdated
+	// KindRemoved packages only exist in the old state.
+	KindRemoved
+)
+
+// Kinds are all the kinds, in the order they are usually reported in.
+var Kinds = []Kind{KindNew, KindUpdate, KindRebuild, KindDowngrade, KindBad, KindUnbumped, KindOutdated, KindRemoved}
+
+var kindNames = map[Kind]string{
+	KindNew:       "new",
+	KindUpdate:    "update",
+	KindRebuild:   "rebuild",
+	KindDowngrade: "downgrade",
+	KindBad:       "bad",
+	KindUnbumped:  "unbumped",
+	KindOutdated:  "outdated",
+	KindRemoved:   "removed",
+}
+
+var kindTitles = map[Kind]string{
+	KindNew:       "New",
+	KindUpdate:    "Update",
+	KindRebuild:   "Rebuild",
+	KindDowngrade: "Downgrade",
+	KindBad:       "Same release, different version",
+	KindUnbumped:  "Changed without a new release",
+	KindOutdated:  "Older release",
+	KindRemoved:   "Removed",
+}
+
+// String returns the name of the kind, as used in reports.
+func (k Kind) String() string {
+	return kindNames[k]
+}
+
+// Title describes the kind for humans.
+func (k Kind) Title() string {
+	return kindTitles[k]
+}
+
+// Bumped reports whether packages of the kind have a new release, i.e. are to
+// be built.
+func (k Kind) Bumped() bool {
+	return k == KindNew || k == KindUpdate || k == KindRebuild || k == KindDowngrade
+}
+
 type Diff struct {
 	Idx       int
 	OldIdx    int
@@ -13,22 +83,56 @@ type Diff struct {
 	OldVer    string
 }
 
-func (d Diff) IsSame() bool {
-	return d.RelNum == d.OldRelNum && d.Ver == d.OldVer
-}
-
-func (d Diff) IsSameRel() bool {
-	return d.RelNum == d.OldRelNum
+// IsNew reports whether the package doesn't exist in the old state.
+func (d Diff) IsNew() bool {
+	return d.OldIdx < 0
 }
 
-func (d Diff) IsNewRel() bool {
-	return d.RelNum > d.OldRelNum
+// IsRemoved reports whether the package only exists in the old state, in which
+// case Idx is -1.
+func (d Diff) IsRemoved() bool {
+	return d.Idx < 0
 }
 
-func (d Diff) IsUpdate() bool {
-	return d.IsNewRel() && d.RelNum != d.OldRelNum
+// Kind classifies the diff. Diffs of the same version and release are only
+// returned by Unbumped, so they are KindUnbumped.
+func (d Diff) Kind() Kind {
+	switch cmp := version.Compare(d.Ver, d.OldVer); {
+	case d.IsRemoved():
+		return KindRemoved
+	case d.IsNew():
+		return KindNew
+	case d.RelNum > d.OldRelNum && cmp > 0:
+		return KindUpdate
+	case d.RelNum > d.OldRelNum && cmp == 0:
+		return KindRebuild
+	case d.RelNum > d.OldRelNum:
+		return KindDowngrade
+	case d.RelNum == d.OldRelNum && cmp != 0:
+		return KindBad
+	case d.RelNum == d.OldRelNum:
+		return KindUnbumped
+	}
+	return KindOutdated
 }
 
-func (d Diff) IsDowngrade() bool {
-	return d.RelNum < d.OldRelNum
+// Reason describes the diff for humans.
+func (d Diff) Reason() string {
+	switch d.Kind() {
+	case KindNew:
+		return "new package"
+	case KindUpdate:
+		return fmt.Sprintf("update from %s-%d to %s-%d", d.OldVer, d.OldRelNum, d.Ver, d.RelNum)
+	case KindRebuild:
+		return fmt.Sprintf("rebuild from release %d to %d", d.OldRelNum, d.RelNum)
+	case KindDowngrade:
+		return fmt.Sprintf("downgrade from %s-%d to %s-%d", d.OldVer, d.OldRelNum, d.Ver, d.RelNum)
+	case KindBad:
+		return fmt.Sprintf("version changed from %s to %s while keeping release %d", d.OldVer, d.Ver, d.RelNum)
+	case KindUnbumped:
+		return fmt.Sprintf("recipe changed while keeping %s-%d", d.Ver, d.RelNum)
+	case KindOutdated:
+		return fmt.Sprintf("release went back from %d to %d", d.OldRelNum, d.RelNum)
+	}
+	return fmt.Sprintf("removed at %s-%d", d.OldVer, d.OldRelNum)
 }
@@ -0,0 +1,34 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package state
+
+import "testing"
+
+func TestDiffKind(t *testing.T) {
+	tests := []struct {
+		diff Diff
+		want Kind
+	}{
+		{Diff{Idx: 0, OldIdx: -1, RelNum: 1, Ver: "1.0"}, KindNew},
+		{Diff{Idx: -1, OldIdx: 0, OldRelNum: 1, OldVer: "1.0"}, KindRemoved},
+		{Diff{RelNum: 2, OldRelNum: 1, Ver: "1.1", OldVer: "1.0"}, KindUpdate},
+		{Diff{RelNum: 2, OldRelNum: 1, Ver: "1.10", OldVer: "1.9"}, KindUpdate},
+		{Diff{RelNum: 2, OldRelNum: 1, Ver: "1.0", OldVer: "1.0_rc1"}, KindUpdate},
+		{Diff{RelNum: 2, OldRelNum: 1, Ver: "1:0.9", OldVer: "1.0"}, KindUpdate},
+		{Diff{RelNum: 2, OldRelNum: 1, Ver: "1.0", OldVer: "1.0"}, KindRebuild},
+		// Versions that only differ in spelling are the same version.
+		{Diff{RelNum: 2, OldRelNum: 1, Ver: "1.0RC1", OldVer: "1.0_rc1"}, KindRebuild},
+		{Diff{RelNum: 2, OldRelNum: 1, Ver: "1.0", OldVer: "1.1"}, KindDowngrade},
+		{Diff{RelNum: 2, OldRelNum: 1, Ver: "1.0_rc1", OldVer: "1.0"}, KindDowngrade},
+		{Diff{RelNum: 1, OldRelNum: 1, Ver: "1.1", OldVer: "1.0"}, KindBad},
+		{Diff{RelNum: 1, OldRelNum: 1, Ver: "1.0", OldVer: "1.0"}, KindUnbumped},
+		{Diff{RelNum: 1, OldRelNum: 2, Ver: "1.1", OldVer: "1.0"}, KindOutdated},
+	}
+	for _, tt := range tests {
+		if got := tt.diff.Kind(); got != tt.want {
+			t.Errorf("%+v.Kind() = %s, want %s", tt.diff, got, tt.want)
+		}
+	}
+}
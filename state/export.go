@@ -0,0 +1,120 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package state
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/GZGavinZhao/autobuild/common"
+)
+
+// GraphSchemaVersion is the version of the JSON graph schema. It is bumped
+// whenever the schema changes in an incompatible way.
+const GraphSchemaVersion = 1
+
+// JSONGraph is the dependency graph of a state in the `json-adjacency` format.
+// Nodes are sorted by ID, and the ID of a node is its index in `Nodes`.
+type JSONGraph struct {
+	Version int        `json:"version"`
+	Nodes   []JSONNode `json:"nodes"`
+}
+
+// JSONNode is a source package in the JSON graph.
+type JSONNode struct {
+	ID        int        `json:"id"`
+	Name      string     `json:"name"`
+	Version   string     `json:"version"`
+	Release   int        `json:"release"`
+	Component string     `json:"component,omitempty"`
+	Deps      []JSONEdge `json:"deps"`
+}
+
+// JSONEdge is a dependency of a node on the node with the ID `To`. `Kind` is
+// one of "build", "check", or "run".
+type JSONEdge struct {
+	To   int    `json:"to"`
+	Kind string `json:"kind"`
+}
+
+// ExportGraph converts the dependency graph of `s` to the JSON graph schema.
+func ExportGraph(s State) JSONGraph {
+	res := JSONGraph{Version: GraphSchemaVersion}
+	visitNodes(s, func(node JSONNode) error {
+		res.Nodes = append(res.Nodes, node)
+		return nil
+	})
+	return res
+}
+
+// WriteGraph writes the dependency graph of `s` to `w` like ExportGraph, as
+// indented JSON, but one node at a time, so that the graph of a whole
+// repository is never held in memory as JSON.
+func WriteGraph(w io.Writer, s State) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "{\n  \"version\": %d,\n  \"nodes\": ", GraphSchemaVersion)
+	if len(s.Packages()) == 0 {
+		bw.WriteString("null")
+	} else {
+		bw.WriteString("[")
+		first := true
+		err := visitNodes(s, func(node JSONNode) error {
+			raw, err := json.MarshalIndent(node, "    ", "  ")
+			if err != nil {
+				return err
+			}
+			if !first {
+				bw.WriteString(",")
+			}
+			first = false
+			bw.WriteString("\n    ")
+			_, err = bw.Write(raw)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		bw.WriteString("\n  ]")
+	}
+	bw.WriteString("\n}\n")
+	return bw.Flush()
+}
+
+// visitNodes calls `do` with the nodes of the JSON graph of `s` in order,
+// until it fails.
+func visitNodes(s State, do func(JSONNode) error) error {
+	// Edges of the dependency graph go from a dependency to its dependent.
+	deps := make([][]int32, len(s.Packages()))
+	kinds := make([][]common.DepKind, len(s.Packages()))
+	if g := s.DepGraph(); g != nil {
+		for v := 0; v < g.Order(); v++ {
+			g.Visit(v, func(w int, c int64) (skip bool) {
+				deps[w] = append(deps[w], int32(v))
+				kinds[w] = append(kinds[w], common.DepKind(c))
+				return
+			})
+		}
+	}
+
+	for idx, pkg := range s.Packages() {
+		node := JSONNode{
+			ID:        idx,
+			Name:      pkg.Name,
+			Version:   pkg.Version,
+			Release:   pkg.Release,
+			Component: pkg.Component,
+			Deps:      make([]JSONEdge, len(deps[idx])),
+		}
+		for i, dep := range deps[idx] {
+			node.Deps[i] = JSONEdge{To: int(dep), Kind: kinds[idx][i].String()}
+		}
+		if err := do(node); err != nil {
+			return err
+		}
+	}
+	return nil
+}
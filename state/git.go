@@ -0,0 +1,324 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package state
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/GZGavinZhao/autobuild/common"
+	"github.com/GZGavinZhao/autobuild/config"
+	"github.com/GZGavinZhao/autobuild/stone"
+	"github.com/GZGavinZhao/autobuild/utils"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// SplitRevision splits the path of a source TPath like src:path@rev into the
+// path of the checkout and the git revision, if the path has one. Paths that
+// exist as they are are never split, even if they contain @.
+func SplitRevision(tpath string) (dir string, rev string, ok bool) {
+	i := strings.LastIndex(tpath, "@")
+	if i < 0 || utils.PathExists(tpath) {
+		return tpath, "", false
+	}
+	return tpath[:i], tpath[i+1:], true
+}
+
+// openRepo opens the git repository that the checkout at `dir` belongs to, and
+// returns the path of `dir` in it, in the form of git paths.
+func openRepo(dir string) (repo *git.Repository, prefix string, err error) {
+	repo, err = git.PlainOpenWithOptions(dir, &git.PlainOpenOptions{DetectDotGit: true})
+	if err != nil {
+		return nil, "", fmt.Errorf("%s isn't in a git repository: %w", dir, err)
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		return nil, "", err
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, "", err
+	}
+	// The root of the worktree is absolute, but may go through symlinks.
+	root, err := filepath.EvalSymlinks(wt.Filesystem.Root())
+	if err != nil {
+		return nil, "", err
+	}
+	if abs, err = filepath.EvalSymlinks(abs); err != nil {
+		return nil, "", err
+	}
+	rel, err := filepath.Rel(root, abs)
+	if err != nil {
+		return nil, "", err
+	}
+	return repo, filepath.ToSlash(rel), nil
+}
+
+// commitOf returns the commit that `rev` names in `repo`.
+func commitOf(repo *git.Repository, rev string) (*object.Commit, error) {
+	hash, err := repo.ResolveRevision(plumbing.Revision(rev))
+	if err != nil {
+		return nil, fmt.Errorf("unknown revision %s: %w", rev, err)
+	}
+	return repo.CommitObject(*hash)
+}
+
+// ResolveRevision returns the hash of the commit that `rev` names in the git
+// repository of the checkout at `dir`.
+func ResolveRevision(dir string, rev string) (string, error) {
+	repo, _, err := openRepo(dir)
+	if err != nil {
+		return "", fmt.Errorf("state.ResolveRevision: %w", err)
+	}
+	commit, err := commitOf(repo, rev)
+	if err != nil {
+		return "", fmt.Errorf("state.ResolveRevision: %w", err)
+	}
+	return commit.Hash.String(), nil
+}
+
+// MergeBase returns the hash of the best common ancestor of the commits `a`
+// and `b` in the git repository of the checkout at `dir`, which changes on a
+// branch are made since.
+func MergeBase(dir string, a string, b string) (string, error) {
+	repo, _, err := openRepo(dir)
+	if err != nil {
+		return "", fmt.Errorf("state.MergeBase: %w", err)
+	}
+	aCommit, err := commitOf(repo, a)
+	if err != nil {
+		return "", fmt.Errorf("state.MergeBase: %w", err)
+	}
+	bCommit, err := commitOf(repo, b)
+	if err != nil {
+		return "", fmt.Errorf("state.MergeBase: %w", err)
+	}
+	bases, err := aCommit.MergeBase(bCommit)
+	if err != nil {
+		return "", fmt.Errorf("state.MergeBase: %w", err)
+	} else if len(bases) == 0 {
+		return "", fmt.Errorf("state.MergeBase: %s and %s have no common ancestor", a, b)
+	}
+	return bases[0].Hash.String(), nil
+}
+
+// LoadSourceAt loads the source state of the checkout at `dir` as of the git
+// revision `rev`, without checking it out. The recipes that changed between
+// HEAD and `rev` are read from `rev`, and the others are taken from the
+// checkout, so that two revisions of a recipe monorepo are compared from a
+// single checkout, and only the recipes that changed are read from git.
+// Recipes read from git are kept in the cache directory, by the commit that
+// they are read from.
+func LoadSourceAt(dir string, rev string, cache *ParseCache) (state *SourceState, err error) {
+	base, err := LoadSourceCached(dir, cache)
+	if err != nil {
+		return
+	}
+
+	phase(fmt.Sprintf("reading the recipes changed at %s", rev))
+	defer phase("")
+	repo, prefix, err := openRepo(dir)
+	if err != nil {
+		return nil, fmt.Errorf("state.LoadSourceAt: %w", err)
+	}
+	head, err := commitOf(repo, "HEAD")
+	if err != nil {
+		return nil, fmt.Errorf("state.LoadSourceAt: %w", err)
+	}
+	target, err := commitOf(repo, rev)
+	if err != nil {
+		return nil, fmt.Errorf("state.LoadSourceAt: %w", err)
+	}
+	dirs, err := changedRecipes(base, head, target, prefix)
+	if err != nil {
+		return nil, fmt.Errorf("state.LoadSourceAt: failed to compare HEAD with %s: %w", rev, err)
+	}
+
+	cacheDir, err := config.CacheDir()
+	if err != nil {
+		return nil, fmt.Errorf("state.LoadSourceAt: %w", err)
+	}
+	root := filepath.Join(cacheDir, "git", target.Hash.String())
+	tree, err := target.Tree()
+	if err != nil {
+		return nil, fmt.Errorf("state.LoadSourceAt: %w", err)
+	}
+
+	state = &SourceState{path: dir + "@" + rev, isGit: base.isGit, nameToSrcIdx: make(map[string]int)}
+	for _, pkg := range base.packages {
+		if rel, ok := recipeDir(base, pkg); ok && slices.Contains(dirs, rel) {
+			continue
+		}
+		pkg.Resolved = false
+		pkg.BuildDeps = slices.Clone(pkg.BuildDeps)
+		state.packages = append(state.packages, pkg)
+	}
+	for _, rel := range dirs {
+		pkg, found, err := parseAt(tree, path.Join(prefix, rel), filepath.Join(root, filepath.FromSlash(rel)))
+		if err != nil {
+			return nil, fmt.Errorf("state.LoadSourceAt: failed to read %s at %s: %w", rel, rev, err)
+		}
+		if found {
+			pkg.Root = root
+			state.packages = append(state.packages, pkg)
+		}
+	}
+	state.index()
+	return
+}
+
+// recipeDir returns the directory of the recipe of `pkg`, relative to the
+// checkout of `s`, in the form of git paths.
+func recipeDir(s *SourceState, pkg common.Package) (string, bool) {
+	rel, err := filepath.Rel(s.path, pkg.Path)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
+
+// changedRecipes returns the directories of the recipes, relative to the
+// checkout of `base` at `prefix` in the repository, that differ between the
+// commits `from` and `to`: the directories of the recipes of `base` holding
+// files that changed, and the ones that a recipe was added to or removed from.
+func changedRecipes(base *SourceState, from *object.Commit, to *object.Commit, prefix string) (dirs []string, err error) {
+	fromTree, err := from.Tree()
+	if err != nil {
+		return
+	}
+	toTree, err := to.Tree()
+	if err != nil {
+		return
+	}
+	changes, err := object.DiffTree(fromTree, toTree)
+	if err != nil {
+		return
+	}
+
+	recipes := make(map[string]bool)
+	for _, pkg := range base.packages {
+		if rel, ok := recipeDir(base, pkg); ok {
+			recipes[rel] = true
+		}
+	}
+	seen := make(map[string]bool)
+	for _, change := range changes {
+		for _, name := range []string{change.From.Name, change.To.Name} {
+			if name == "" {
+				continue
+			}
+			if prefix != "." {
+				var ok bool
+				if name, ok = strings.CutPrefix(name, prefix+"/"); !ok {
+					continue
+				}
+			}
+			dir := path.Dir(name)
+			if base := path.Base(name); base != "package.yml" && base != "stone.yaml" {
+				// Other files belong to the recipe of a directory above
+				// them, if any.
+				for dir != "." && !recipes[dir] {
+					dir = path.Dir(dir)
+				}
+				if dir == "." {
+					continue
+				}
+			}
+			if !seen[dir] {
+				seen[dir] = true
+				dirs = append(dirs, dir)
+			}
+		}
+	}
+	slices.Sort(dirs)
+	return
+}
+
+// parseAt parses the recipe at `name` in `tree`, after writing it to `dst`
+// unless it already is there. It returns false if `tree` has no recipe
+// there, or an ignored one.
+func parseAt(tree *object.Tree, name string, dst string) (pkg common.Package, found bool, err error) {
+	recipe, err := tree.Tree(name)
+	if errors.Is(err, object.ErrDirectoryNotFound) {
+		return pkg, false, nil
+	} else if err != nil {
+		return
+	}
+	if !utils.PathExists(dst) {
+		if err = writeTree(recipe, dst); err != nil {
+			return
+		}
+	}
+
+	for _, cfgFile := range []string{"autobuild.yaml", "autobuild.yml"} {
+		if cfgFile = filepath.Join(dst, cfgFile); utils.PathExists(cfgFile) {
+			abConfig, err := config.Load(cfgFile)
+			if err != nil {
+				return pkg, false, err
+			} else if abConfig.Ignore {
+				return pkg, false, nil
+			}
+			break
+		}
+	}
+	if utils.PathExists(filepath.Join(dst, "package.yml")) {
+		pkg, err = common.ParsePackage(dst)
+	} else if utils.PathExists(filepath.Join(dst, "stone.yaml")) {
+		pkg, err = stone.ParsePackage(dst)
+	} else {
+		return pkg, false, nil
+	}
+	return pkg, err == nil, err
+}
+
+// writeTree writes the regular files of `tree` to the directory `dst`. They
+// are written next to it first, for pushes running at the same time to never
+// see a directory that is partly written.
+func writeTree(tree *object.Tree, dst string) error {
+	tmp := fmt.Sprintf("%s.tmp-%d", dst, os.Getpid())
+	defer os.RemoveAll(tmp)
+	err := tree.Files().ForEach(func(f *object.File) error {
+		if f.Mode != filemode.Regular && f.Mode != filemode.Executable {
+			return nil
+		}
+		file := filepath.Join(tmp, filepath.FromSlash(f.Name))
+		if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+			return err
+		}
+		r, err := f.Reader()
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		w, err := os.Create(file)
+		if err != nil {
+			return err
+		}
+		if _, err = io.Copy(w, r); err != nil {
+			w.Close()
+			return err
+		}
+		return w.Close()
+	})
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(tmp, 0o755); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, dst); err != nil && !utils.PathExists(dst) {
+		return err
+	}
+	return nil
+}
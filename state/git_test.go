@@ -0,0 +1,113 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package state
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/GZGavinZhao/autobuild/common"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// commitFiles writes `files` to the worktree of `repo` at `dir`, removing the
+// ones that are empty, and commits them.
+func commitFiles(t *testing.T, repo *git.Repository, dir string, files map[string]string) *object.Commit {
+	t.Helper()
+	for name, content := range files {
+		file := filepath.Join(dir, filepath.FromSlash(name))
+		var err error
+		if content == "" {
+			err = os.Remove(file)
+		} else if err = os.MkdirAll(filepath.Dir(file), 0o755); err == nil {
+			err = os.WriteFile(file, []byte(content), 0o644)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	wt, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = wt.AddWithOptions(&git.AddOptions{All: true}); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := wt.Commit("change", &git.CommitOptions{Author: &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit, err := repo.CommitObject(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return commit
+}
+
+func TestChangedRecipes(t *testing.T) {
+	// The recipes of the checkout, and the other files of the repository.
+	recipes := []string{"a", "b", "py/requests"}
+	files := map[string]string{
+		"a/package.yml":                 "name: a",
+		"a/files/fix.patch":             "patch",
+		"b/package.yml":                 "name: b",
+		"py/requests/package.yml":       "name: requests",
+		"py/requests/files/fix.patch":   "patch",
+		"README.md":                     "readme",
+		"unrelated/files/notes.txt":     "notes",
+		"unrelated/nested/package.json": "{}",
+	}
+	tests := []struct {
+		name   string
+		prefix string
+		// changes are relative to the root of the repository, unlike files.
+		changes map[string]string
+		want    []string
+	}{
+		{"recipe", ".", map[string]string{"a/package.yml": "name: a\nrelease: 2"}, []string{"a"}},
+		{"file of a recipe", ".", map[string]string{"a/files/fix.patch": "new patch"}, []string{"a"}},
+		{"file of a nested recipe", ".", map[string]string{"py/requests/files/fix.patch": "new patch"}, []string{"py/requests"}},
+		{"files outside recipes", ".", map[string]string{"README.md": "new", "unrelated/files/notes.txt": "new"}, nil},
+		{"added recipe", ".", map[string]string{"c/package.yml": "name: c", "c/files/fix.patch": "patch"}, []string{"c"}},
+		{"added stone recipe", ".", map[string]string{"d/stone.yaml": "name: d"}, []string{"d"}},
+		{"removed recipe", ".", map[string]string{"b/package.yml": ""}, []string{"b"}},
+		{"several", ".", map[string]string{"b/package.yml": "name: b\nrelease: 2", "a/files/fix.patch": "new patch"}, []string{"a", "b"}},
+		{"under a prefix", "recipes", map[string]string{"recipes/a/package.yml": "name: a\nrelease: 2", "recipes/c/package.yml": "name: c"}, []string{"a", "c"}},
+		{"outside the prefix", "recipes", map[string]string{"a/package.yml": "name: a", "recipes-old/b/package.yml": "name: b"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			repo, err := git.PlainInit(dir, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkout := filepath.Join(dir, filepath.FromSlash(tt.prefix))
+			initial := make(map[string]string)
+			for name, content := range files {
+				initial[path.Join(tt.prefix, name)] = content
+			}
+			from := commitFiles(t, repo, dir, initial)
+			to := commitFiles(t, repo, dir, tt.changes)
+
+			base := &SourceState{path: checkout}
+			for _, recipe := range recipes {
+				base.packages = append(base.packages, common.Package{Name: path.Base(recipe), Path: filepath.Join(checkout, filepath.FromSlash(recipe))})
+			}
+			got, err := changedRecipes(base, from, to, tt.prefix)
+			if err != nil {
+				t.Fatalf("changedRecipes(): %s", err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("changedRecipes() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
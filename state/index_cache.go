@@ -0,0 +1,186 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package state
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/DataDrake/waterlog"
+	"github.com/GZGavinZhao/autobuild/common"
+	"github.com/GZGavinZhao/autobuild/utils"
+	"github.com/klauspost/compress/zstd"
+)
+
+// IndexCache is the cache of parsed indexes that LoadBinary and LoadEopkgRepo
+// look indexes up in before parsing them, or nil to always parse them.
+var IndexCache *BinaryCache
+
+// indexCacheVersion is bumped whenever cachedIndex changes, for older caches
+// to be parsed again rather than misread.
+const indexCacheVersion = 1
+
+// BinaryCache caches the binary states of parsed eopkg indexes on disk, by the
+// SHA-256 of the index as read, so that loading an index that didn't change
+// since it was last parsed skips parsing its XML.
+type BinaryCache struct {
+	// Dir is the directory holding the cached states.
+	Dir string
+	// MaxSize is the size in bytes that the cache is kept under, by dropping
+	// the states used the least recently.
+	MaxSize int64
+}
+
+// cachedIndex is what the cache holds of a binary state.
+type cachedIndex struct {
+	Packages []common.Package
+	RunDeps  [][]int32
+	URIs     [][]string
+	Strs     *utils.StringTable
+}
+
+// indexSum returns the key in the cache of the index read from `r`.
+func indexSum(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (c *BinaryCache) path(sum string) string {
+	return filepath.Join(c.Dir, fmt.Sprintf("%s.v%d.gob.zst", sum, indexCacheVersion))
+}
+
+// load returns the state of the index whose key is `sum`, if it is cached.
+// `name` names the index in the timings.
+func (c *BinaryCache) load(name string, sum string) (*BinaryState, bool) {
+	path := c.path(sum)
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, false
+	}
+	defer f.Close()
+	dec, err := zstd.NewReader(f)
+	if err != nil {
+		return nil, false
+	}
+	defer dec.Close()
+
+	var cached cachedIndex
+	if err = gob.NewDecoder(dec).Decode(&cached); err != nil || cached.Strs == nil {
+		utils.Tracef("BinaryCache.load: ignoring %s: %v\n", path, err)
+		return nil, false
+	}
+	// The modification time tells which states were used the least
+	// recently, see trim.
+	now := time.Now()
+	os.Chtimes(path, now, now)
+
+	state := &BinaryState{packages: cached.Packages, runDeps: cached.RunDeps, strs: cached.Strs, uris: cached.URIs}
+	for idx := range state.packages {
+		state.intern(&state.packages[idx])
+	}
+	start := time.Now()
+	state.buildMaps()
+	timed(fmt.Sprintf("building the lookup maps of %s", name), start)
+	return state, true
+}
+
+// store caches `state` as the state of the index whose key is `sum`, and trims
+// the cache.
+func (c *BinaryCache) store(sum string, state *BinaryState) error {
+	if err := os.MkdirAll(c.Dir, 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(c.Dir, ".index-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	enc, err := zstd.NewWriter(tmp)
+	if err == nil {
+		err = gob.NewEncoder(enc).Encode(cachedIndex{state.packages, state.runDeps, state.uris, state.strs})
+		if closeErr := enc.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	// Concurrent commands never see half a state.
+	if err = os.Rename(tmp.Name(), c.path(sum)); err != nil {
+		return err
+	}
+	return c.trim()
+}
+
+// trim removes the states used the least recently until the cache is no
+// larger than MaxSize.
+func (c *BinaryCache) trim() error {
+	entries, err := os.ReadDir(c.Dir)
+	if err != nil {
+		return err
+	}
+	var files []os.FileInfo
+	var size int64
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), ".gob.zst") {
+			continue
+		}
+		if info, err := entry.Info(); err == nil {
+			files = append(files, info)
+			size += info.Size()
+		}
+	}
+	slices.SortFunc(files, func(a, b os.FileInfo) int {
+		return cmp.Compare(a.ModTime().UnixNano(), b.ModTime().UnixNano())
+	})
+	for _, file := range files {
+		if size <= c.MaxSize {
+			break
+		}
+		if err = os.Remove(filepath.Join(c.Dir, file.Name())); err != nil {
+			return err
+		}
+		size -= file.Size()
+	}
+	return nil
+}
+
+// loadIndexCached returns the state of the index `name` whose key is `sum`
+// from IndexCache, or loads it with `load` and caches it.
+func loadIndexCached(name string, sum string, load func() (*BinaryState, error)) (*BinaryState, error) {
+	if IndexCache == nil {
+		return load()
+	}
+	if state, ok := IndexCache.load(name, sum); ok {
+		utils.Tracef("loadIndexCached: found index %s in the cache\n", sum)
+		return state, nil
+	}
+
+	state, err := load()
+	if err != nil {
+		return state, err
+	}
+	// A cache that can't be written to only makes the next command slower.
+	if err := IndexCache.store(sum, state); err != nil {
+		waterlog.Debugf("Failed to cache the parsed index in %s: %s\n", IndexCache.Dir, err)
+	}
+	return state, nil
+}
@@ -0,0 +1,161 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package state
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/GZGavinZhao/autobuild/common"
+	"github.com/GZGavinZhao/autobuild/utils"
+	"github.com/GZGavinZhao/autobuild/version"
+	"github.com/yourbasic/graph"
+)
+
+// Severity is how bad a Problem is.
+type Severity int
+
+const (
+	SeverityWarning Severity = iota
+	SeverityError
+)
+
+func (s Severity) String() string {
+	if s == SeverityError {
+		return "error"
+	}
+	return "warning"
+}
+
+// A Problem is a finding of a LintRule in a recipe.
+type Problem struct {
+	Rule     string
+	Severity Severity
+	// Idx is the index of the package in the source state.
+	Idx     int
+	Message string
+}
+
+// A LintRule finds problems in the recipes of a source state.
+type LintRule struct {
+	Name     string
+	Severity Severity
+	check    func(s *SourceState, report func(idx int, format string, args ...any))
+}
+
+// LintRules are all the rules there are, see LintRule.
+var LintRules = []LintRule{
+	{"duplicate-name", SeverityError, lintDuplicates},
+	{"unresolved-dep", SeverityError, lintUnresolved},
+	{"self-dep", SeverityWarning, lintSelfDeps},
+	{"missing-builddep", SeverityWarning, lintMissingDeps},
+	{"bad-version", SeverityError, lintVersions},
+}
+
+// LintRuleNames returns the names of LintRules.
+func LintRuleNames() (names []string) {
+	for _, rule := range LintRules {
+		names = append(names, rule.Name)
+	}
+	return
+}
+
+// Lint returns the problems the rules among `rules` find in `s`, by rule and
+// then by package.
+func Lint(s *SourceState, rules []string) (res []Problem) {
+	for _, rule := range LintRules {
+		if !slices.Contains(rules, rule.Name) {
+			continue
+		}
+		rule.check(s, func(idx int, format string, args ...any) {
+			res = append(res, Problem{
+				Rule:     rule.Name,
+				Severity: rule.Severity,
+				Idx:      idx,
+				Message:  fmt.Sprintf(format, args...),
+			})
+		})
+	}
+	return
+}
+
+// lintDuplicates reports packages defined in several directories. Only the
+// last of them can be looked up by name.
+func lintDuplicates(s *SourceState, report func(int, string, ...any)) {
+	// Packages are sorted by name.
+	for idx := 1; idx < len(s.packages); idx++ {
+		if prev := s.packages[idx-1]; prev.Name == s.packages[idx].Name {
+			report(idx, "%s is also defined in %s", prev.Name, prev.Path)
+		}
+	}
+}
+
+// lintUnresolved reports dependencies that no package provides.
+func lintUnresolved(s *SourceState, report func(int, string, ...any)) {
+	for idx, pkg := range s.packages {
+		for _, dep := range pkg.BuildDeps {
+			if _, ok := s.nameToSrcIdx[dep]; !ok {
+				report(idx, "no package provides the %s dependency %s", pkg.DepKind(dep), dep)
+			}
+		}
+	}
+}
+
+// lintSelfDeps reports packages that need themselves to build. Rundeps on the
+// package itself are fine, they are usually between its subpackages.
+func lintSelfDeps(s *SourceState, report func(int, string, ...any)) {
+	for idx, pkg := range s.packages {
+		if slices.Contains(pkg.BuildDeps, pkg.Name) && pkg.DepKind(pkg.Name) != common.RunDep {
+			report(idx, "%s has a %s dependency on itself", pkg.Name, pkg.DepKind(pkg.Name))
+		}
+	}
+}
+
+// lintMissingDeps reports packages whose binary packages depend on packages
+// they don't depend on in their recipe, nor through their dependencies, so
+// that nothing guarantees those are built first.
+func lintMissingDeps(s *SourceState, report func(int, string, ...any)) {
+	var revGraph *graph.Immutable
+	for idx, pkg := range s.packages {
+		var missing []int
+		for _, link := range pkg.Links {
+			depIdx, ok := s.nameToSrcIdx[link]
+			if !ok || depIdx == idx || slices.Contains(missing, depIdx) || slices.Contains(pkg.BuildDeps, s.packages[depIdx].Name) {
+				continue
+			}
+			missing = append(missing, depIdx)
+		}
+		if len(missing) == 0 {
+			continue
+		}
+
+		if revGraph == nil {
+			revGraph = graph.Transpose(s.DepGraph())
+		}
+		ancestors := map[int]bool{}
+		utils.BFSWithDepth(revGraph, idx, func(node int, _ int) bool {
+			ancestors[node] = true
+			return false
+		})
+		for _, depIdx := range missing {
+			if !ancestors[depIdx] {
+				report(idx, "%s links against %s, which is not a build dependency", pkg.Name, s.packages[depIdx].Name)
+			}
+		}
+	}
+}
+
+// lintVersions reports versions that aren't well-formed, see version.Valid,
+// and releases that aren't positive.
+func lintVersions(s *SourceState, report func(int, string, ...any)) {
+	for idx, pkg := range s.packages {
+		if !version.Valid(pkg.Version) {
+			report(idx, "version %q is malformed", pkg.Version)
+		}
+		if pkg.Release < 1 {
+			report(idx, "release %d is not positive", pkg.Release)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package state
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/GZGavinZhao/autobuild/common"
+)
+
+// Orphan is a binary package of a repository that nothing builds anymore.
+type Orphan struct {
+	Name string `json:"name"`
+	// Source is the name of the source package that built it.
+	Source string `json:"source"`
+}
+
+// Orphans returns the indices of the packages of `s` that no other package
+// depends on, to build, check or run. States without a dependency graph have
+// none.
+func Orphans(s State) (res []int) {
+	g := s.DepGraph()
+	if g == nil {
+		return
+	}
+
+	// Edges go from dependencies to their dependents.
+	for v := range s.Packages() {
+		dependents := 0
+		g.Visit(v, func(w int, _ int64) (skip bool) {
+			if v != w {
+				dependents++
+			}
+			return
+		})
+		if dependents == 0 {
+			res = append(res, v)
+		}
+	}
+	return
+}
+
+// StaleBinaries returns the binary packages of `bin` whose source package
+// doesn't exist in `src` anymore, or doesn't build them anymore if its
+// subpackages are known, sorted by name.
+func StaleBinaries(bin *BinaryState, src State) []Orphan {
+	sources := make(map[string]common.Package)
+	for _, pkg := range src.Packages() {
+		sources[pkg.Name] = pkg
+	}
+	return orphanedBinaries(bin, func(name string, pkg common.Package) bool {
+		source, ok := sources[pkg.Name]
+		return ok && (len(source.Subpackages) == 0 || slices.Contains(source.Subpackages, name))
+	})
+}
+
+// orphanedBinaries returns the binary packages of `s` that aren't `built`,
+// sorted by name.
+func orphanedBinaries(s *BinaryState, built func(bin string, pkg common.Package) bool) []Orphan {
+	res := []Orphan{}
+	for _, pkg := range s.packages {
+		for _, bin := range pkg.Subpackages {
+			if !built(bin, pkg) {
+				res = append(res, Orphan{Name: bin, Source: pkg.Name})
+			}
+		}
+	}
+	slices.SortFunc(res, func(a, b Orphan) int { return strings.Compare(a.Name, b.Name) })
+	return res
+}
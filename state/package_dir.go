@@ -0,0 +1,133 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package state
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/GZGavinZhao/autobuild/utils"
+	"github.com/getsolus/libeopkg/archive"
+	"github.com/getsolus/libeopkg/index"
+)
+
+// LoadPackageDir loads the binary state of the .eopkg files in `dir` and its
+// subdirectories, such as the output directory of builds, as if they were the
+// packages of an index. Only the central directory and metadata.xml of every
+// package are read, rather than extracting it, and packages are read in
+// parallel. Delta packages, named .delta.eopkg, only hold the files that
+// changed since an older release, so they are skipped. Of the packages with
+// the same name, the one with the highest release is kept.
+func LoadPackageDir(dir string) (state *BinaryState, err error) {
+	phase(fmt.Sprintf("scanning the packages in %s", dir))
+	defer phase("")
+
+	var paths []string
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && strings.HasSuffix(d.Name(), ".eopkg") && !strings.HasSuffix(d.Name(), ".delta.eopkg") {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("state.LoadPackageDir: failed to list the packages in %s: %w", dir, err)
+	}
+
+	ipkgs := make([]index.Package, len(paths))
+	errs := make([]error, len(paths))
+	utils.ParallelFor(len(paths), func(idx int) {
+		ipkgs[idx], errs[idx] = readPackageMetadata(paths[idx])
+	})
+
+	latest := make(map[string]int)
+	for idx, ipkg := range ipkgs {
+		if errs[idx] != nil {
+			return nil, fmt.Errorf("state.LoadPackageDir: failed to read %s: %w", paths[idx], errs[idx])
+		}
+		if len(ipkg.History) == 0 {
+			return nil, fmt.Errorf("state.LoadPackageDir: %s has no history", paths[idx])
+		}
+		if prev, ok := latest[ipkg.Name]; !ok || ipkgs[prev].History[0].Release < ipkg.History[0].Release {
+			latest[ipkg.Name] = idx
+		}
+	}
+
+	// The packages are added in the order of their names, for the state to
+	// be the same from one scan to the next.
+	kept := make([]int, 0, len(latest))
+	for _, idx := range latest {
+		kept = append(kept, idx)
+	}
+	slices.SortFunc(kept, func(a, b int) int { return strings.Compare(ipkgs[a].Name, ipkgs[b].Name) })
+
+	state = newBinaryState()
+	for _, idx := range kept {
+		ipkg := ipkgs[idx]
+		if ipkg.PackageURI, err = filepath.Rel(dir, paths[idx]); err != nil {
+			return nil, err
+		}
+		if err = state.add(ipkg); err != nil {
+			return nil, fmt.Errorf("state.LoadPackageDir: failed to load %s: %w", paths[idx], err)
+		}
+	}
+	state.base = dir
+	return state, nil
+}
+
+// readPackageMetadata reads the metadata.xml of the .eopkg file at `path`, as
+// the package of an index. The zip reader reads the central directory at the
+// end of the file and then only the metadata, leaving the files of the
+// package untouched.
+func readPackageMetadata(path string) (ipkg index.Package, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return
+	}
+	zr, err := zip.NewReader(f, info.Size())
+	if err != nil {
+		return
+	}
+	r, err := zr.Open("metadata.xml")
+	if err != nil {
+		return
+	}
+	defer r.Close()
+
+	var meta archive.Metadata
+	if err = xml.NewDecoder(r).Decode(&meta); err != nil {
+		return
+	}
+	if meta.Package == nil {
+		return ipkg, fmt.Errorf("metadata.xml has no package")
+	}
+
+	pkg := meta.Package
+	ipkg = index.Package{
+		Name:         pkg.Name,
+		PartOf:       pkg.PartOf,
+		Licenses:     pkg.License,
+		History:      pkg.History,
+		Architecture: pkg.Architecture,
+		Source:       meta.Source,
+	}
+	if pkg.RuntimeDependencies != nil {
+		ipkg.RuntimeDependencies = *pkg.RuntimeDependencies
+	}
+	return
+}
@@ -0,0 +1,38 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package state
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/GZGavinZhao/autobuild/internal/synthetic"
+)
+
+func TestLoadPackageDirSkipsDeltas(t *testing.T) {
+	dir := t.TempDir()
+	repo := synthetic.Generate(synthetic.Options{Packages: 10, Density: 1, Seed: 1})
+	if err := repo.WritePackages(dir, synthetic.New); err != nil {
+		t.Fatal(err)
+	}
+	want, err := LoadPackageDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Deltas aren't read at all, so that one that isn't even a package
+	// doesn't fail the scan.
+	if err = os.WriteFile(filepath.Join(dir, "pkg-1-2-1-x86_64.delta.eopkg"), []byte("not a zip"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := LoadPackageDir(dir)
+	if err != nil {
+		t.Fatalf("LoadPackageDir() with a delta: %s", err)
+	}
+	if len(got.Packages()) != len(want.Packages()) {
+		t.Errorf("LoadPackageDir() with a delta has %d packages, want %d", len(got.Packages()), len(want.Packages()))
+	}
+}
@@ -0,0 +1,40 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package state
+
+import "time"
+
+// Progress reports how loading a state progresses, for commands to show it
+// while it takes long. All functions are optional.
+var Progress struct {
+	// Phase is called as loading a state moves on to the phase described by
+	// `name`, and with an empty name once the state is loaded.
+	Phase func(name string)
+	// Parsed is called with the number of recipes that LoadSource parsed so
+	// far. It may be called concurrently.
+	Parsed func(count int)
+	// Timed is called with how long a step of loading a state that is too
+	// short to be a phase of its own took, such as setting up its lookup
+	// maps. It may be called concurrently.
+	Timed func(name string, elapsed time.Duration)
+}
+
+func phase(name string) {
+	if Progress.Phase != nil {
+		Progress.Phase(name)
+	}
+}
+
+func parsed(count int) {
+	if Progress.Parsed != nil {
+		Progress.Parsed(count)
+	}
+}
+
+func timed(name string, since time.Time) {
+	if Progress.Timed != nil {
+		Progress.Timed(name, time.Since(since))
+	}
+}
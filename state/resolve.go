@@ -0,0 +1,36 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package state
+
+import (
+	"sync"
+
+	"github.com/GZGavinZhao/autobuild/common"
+	"github.com/GZGavinZhao/autobuild/utils"
+)
+
+// Unresolved returns, for the package of `s` at every index of `idxs`, the
+// build dependencies that no package of `s` provides, along with the closest
+// name that one does. The packages are checked in parallel, and none of them
+// is modified.
+func Unresolved(s State, idxs []int) [][]common.UnresolvedDep {
+	nameToSrcIdx := s.NameToSrcIdx()
+	// The names are only listed, once, for the first dependency missing.
+	var names []string
+	var namesOnce sync.Once
+
+	res := make([][]common.UnresolvedDep, len(idxs))
+	utils.ParallelFor(len(idxs), func(i int) {
+		pkg := &s.Packages()[idxs[i]]
+		for _, dep := range pkg.BuildDeps {
+			if _, ok := nameToSrcIdx[dep]; ok {
+				continue
+			}
+			namesOnce.Do(func() { names = utils.SortedKeys(nameToSrcIdx) })
+			res[i] = append(res[i], common.UnresolvedDep{Name: dep, Kind: pkg.DepKind(dep), Closest: utils.Closest(dep, names)})
+		}
+	})
+	return res
+}
@@ -6,10 +6,16 @@ package state
 
 import (
 	"errors"
+	"fmt"
+	"path/filepath"
 	"slices"
 	"strings"
 
 	"github.com/GZGavinZhao/autobuild/common"
+	"github.com/GZGavinZhao/autobuild/stone"
+	"github.com/GZGavinZhao/autobuild/utils"
+	"github.com/GZGavinZhao/autobuild/version"
+	"github.com/GZGavinZhao/autobuild/ypkg"
 	"github.com/yourbasic/graph"
 )
 
@@ -26,8 +32,20 @@ type State interface {
 	// PackageExists(string) bool
 }
 
+// GetPackage returns the package named `name` and its index, or -1 if there
+// is none. `name` may also be the path to the recipe of the package, see
+// RecipeName.
 func GetPackage(s State, name string) (common.Package, int) {
 	idx, ok := s.NameToSrcIdx()[name]
+	if !ok {
+		if recipe, isRecipe := RecipeName(name); isRecipe {
+			idx, ok = s.NameToSrcIdx()[recipe]
+		}
+	}
+	if !ok {
+		idx = recipeIdx(s, name)
+		ok = idx >= 0
+	}
 	if !ok {
 		return common.Package{}, -1
 	} else {
@@ -35,6 +53,49 @@ func GetPackage(s State, name string) (common.Package, int) {
 	}
 }
 
+// RecipeName returns the name of the package whose recipe is at `path`, which
+// is either a recipe directory or its package.yml or stone.yaml, so that
+// commands accept paths wherever they take package names.
+func RecipeName(path string) (string, bool) {
+	if base := filepath.Base(path); base == "package.yml" || base == "stone.yaml" {
+		path = filepath.Dir(path)
+	}
+	if !utils.PathExists(path) {
+		return "", false
+	}
+
+	if ypkgFile := filepath.Join(path, "package.yml"); utils.PathExists(ypkgFile) {
+		recipe, err := ypkg.Load(ypkgFile)
+		return recipe.Name, err == nil && recipe.Name != ""
+	}
+	if stoneFile := filepath.Join(path, "stone.yaml"); utils.PathExists(stoneFile) {
+		recipe, err := stone.Load(stoneFile)
+		return recipe.Name, err == nil && recipe.Name != ""
+	}
+	return "", false
+}
+
+// recipeIdx returns the index of the package of `s` whose recipe is at `path`,
+// or -1 if there is none. Unlike RecipeName, it finds recipes by the
+// directory the state loaded them from, which doesn't need them to parse on
+// their own.
+func recipeIdx(s State, path string) int {
+	if base := filepath.Base(path); base == "package.yml" || base == "stone.yaml" {
+		path = filepath.Dir(path)
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil || !utils.PathExists(path) {
+		return -1
+	}
+	return slices.IndexFunc(s.Packages(), func(pkg common.Package) bool {
+		if pkg.Path == "" {
+			return false
+		}
+		pkgAbs, err := filepath.Abs(pkg.Path)
+		return err == nil && pkgAbs == abs
+	})
+}
+
 func GetPackageIdx(s State, name string) int {
 	return s.NameToSrcIdx()[name]
 }
@@ -44,25 +105,47 @@ func PackageExists(s State, name string) bool {
 	return ok
 }
 
+// DependencyGraph returns a dependency graph of `s` that has at least the
+// edges into `idxs` and the packages they depend on, directly or not, which is
+// all that lifting and sorting `idxs` looks at. Source states only find the
+// edges of these packages, rather than building the whole graph.
+func DependencyGraph(s State, idxs []int) *graph.Immutable {
+	if src, ok := s.(*SourceState); ok {
+		return src.dependencyGraph(idxs)
+	}
+	return s.DepGraph()
+}
+
 func ValidTPath(tpath string) bool {
-	splitted := strings.Split(tpath, ":")
+	kind, path, _ := strings.Cut(tpath, ":")
 
-	if len(splitted) > 2 {
+	// Only repositories may be given by URL, which has colons of its own.
+	if strings.Contains(path, ":") && !(kind == "repo" && IsIndexURL(path)) {
 		return false
 	}
 
-	return slices.Contains([]string{"src", "bin", "repo"}, splitted[0])
+	return slices.Contains([]string{"src", "bin", "repo"}, kind)
 }
 
 func LoadState(tpath string) (state State, err error) {
+	return LoadStateCached(tpath, nil)
+}
+
+// LoadStateCached is LoadState, but loads source states with
+// LoadSourceCached and `cache`.
+func LoadStateCached(tpath string, cache *ParseCache) (state State, err error) {
 	if !ValidTPath(tpath) {
 		err = InvalidTPathError
 		return
 	}
 
-	splitted := strings.Split(tpath, ":")
+	splitted := strings.SplitN(tpath, ":", 2)
 	if splitted[0] == "src" {
-		state, err = LoadSource(splitted[1])
+		if dir, rev, ok := SplitRevision(splitted[1]); ok {
+			state, err = LoadSourceAt(dir, rev, cache)
+		} else {
+			state, err = LoadSourceCached(splitted[1], cache)
+		}
 	} else if splitted[0] == "bin" {
 		state, err = LoadBinary(splitted[1])
 	} else {
@@ -72,6 +155,8 @@ func LoadState(tpath string) (state State, err error) {
 	return
 }
 
+// Changed returns the packages whose version or release differs between `old`
+// and `cur`, including the ones that were added or removed.
 func Changed(old *State, cur *State) (res []Diff) {
 	for idx, pkg := range (*cur).Packages() {
 		oldIdx, found := (*old).NameToSrcIdx()[pkg.Name]
@@ -79,6 +164,7 @@ func Changed(old *State, cur *State) (res []Diff) {
 		if !found {
 			res = append(res, Diff{
 				Idx:    idx,
+				OldIdx: -1,
 				RelNum: pkg.Release,
 				Ver:    pkg.Version,
 			})
@@ -86,7 +172,7 @@ func Changed(old *State, cur *State) (res []Diff) {
 		}
 
 		oldPkg := (*old).Packages()[oldIdx]
-		if oldPkg.Release != pkg.Release || oldPkg.Version != pkg.Version {
+		if oldPkg.Release != pkg.Release || version.Compare(oldPkg.Version, pkg.Version) != 0 {
 			res = append(res, Diff{
 				Idx:       idx,
 				OldIdx:    oldIdx,
@@ -98,5 +184,56 @@ func Changed(old *State, cur *State) (res []Diff) {
 		}
 	}
 
+	for oldIdx, oldPkg := range (*old).Packages() {
+		if _, found := (*cur).NameToSrcIdx()[oldPkg.Name]; !found {
+			res = append(res, Diff{
+				Idx:       -1,
+				OldIdx:    oldIdx,
+				OldRelNum: oldPkg.Release,
+				OldVer:    oldPkg.Version,
+			})
+		}
+	}
+
+	return
+}
+
+// Unbumped returns the packages of `cur` whose recipe changed since `old`,
+// without a new version or release, so that building them again would produce
+// packages that can't be told apart from the old ones. Only packages with
+// recipes on both sides, i.e. from source states, are compared, and only the
+// ones selected by `include` if it isn't nil.
+func Unbumped(old *State, cur *State, include func(common.Package) bool) (res []Diff, err error) {
+	for idx, pkg := range (*cur).Packages() {
+		oldIdx, found := (*old).NameToSrcIdx()[pkg.Name]
+		if !found || include != nil && !include(pkg) {
+			continue
+		}
+		oldPkg := (*old).Packages()[oldIdx]
+		if oldPkg.Release != pkg.Release || version.Compare(oldPkg.Version, pkg.Version) != 0 {
+			continue
+		}
+		if !utils.PathExists(filepath.Join(pkg.Path, "package.yml")) || !utils.PathExists(filepath.Join(oldPkg.Path, "package.yml")) {
+			continue
+		}
+
+		var hash, oldHash string
+		if hash, err = pkg.ContentHash(); err != nil {
+			return nil, fmt.Errorf("state.Unbumped: failed to hash recipe of %s: %w", pkg.Name, err)
+		}
+		if oldHash, err = oldPkg.ContentHash(); err != nil {
+			return nil, fmt.Errorf("state.Unbumped: failed to hash old recipe of %s: %w", pkg.Name, err)
+		}
+		if hash != oldHash {
+			res = append(res, Diff{
+				Idx:       idx,
+				OldIdx:    oldIdx,
+				RelNum:    pkg.Release,
+				OldRelNum: oldPkg.Release,
+				Ver:       pkg.Version,
+				OldVer:    oldPkg.Version,
+			})
+		}
+	}
 	return
 }
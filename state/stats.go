@@ -0,0 +1,174 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package state
+
+import (
+	"cmp"
+	"slices"
+
+	"github.com/GZGavinZhao/autobuild/utils"
+	"github.com/yourbasic/graph"
+)
+
+// Stats are statistics about the packages of a state and their dependency
+// graph. The graph statistics are zero for states without one.
+type Stats struct {
+	Packages int `json:"packages"`
+	// Components maps every component to its number of packages.
+	Components map[string]int `json:"components"`
+	Edges      int            `json:"edges"`
+	// FanIn counts the direct dependencies of packages, and FanOut their
+	// direct dependents.
+	FanIn  DegreeStats `json:"fan_in"`
+	FanOut DegreeStats `json:"fan_out"`
+	// Cycles holds the largest strongly connected components of the graph,
+	// largest first.
+	Cycles [][]string `json:"cycles"`
+	// Orphans holds the packages that no package depends on.
+	Orphans []string `json:"orphans"`
+	// LongestChain is the longest chain of packages that depend on each
+	// other, to build one after another. Packages in a cycle count once.
+	LongestChain []string `json:"longest_chain"`
+}
+
+// DegreeStats describe how many neighbours packages have in the graph.
+type DegreeStats struct {
+	Average float64 `json:"average"`
+	Max     int     `json:"max"`
+	// Top holds the packages with the most neighbours, most first.
+	Top []PackageCount `json:"top"`
+}
+
+type PackageCount struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// StatsOf computes the statistics of `s`, keeping the `top` first packages or
+// cycles of rankings.
+func StatsOf(s State, top int) (res Stats) {
+	pkgs := s.Packages()
+	res.Packages = len(pkgs)
+	res.Components = make(map[string]int)
+	for _, pkg := range pkgs {
+		res.Components[pkg.Component]++
+	}
+	res.Cycles, res.Orphans, res.LongestChain = [][]string{}, []string{}, []string{}
+	res.FanIn.Top, res.FanOut.Top = []PackageCount{}, []PackageCount{}
+
+	g := s.DepGraph()
+	if g == nil || len(pkgs) == 0 {
+		return
+	}
+
+	// Edges go from dependencies to their dependents, and self-dependencies
+	// don't count.
+	fanIn, fanOut := make([]int, len(pkgs)), make([]int, len(pkgs))
+	for v := range pkgs {
+		g.Visit(v, func(w int, _ int64) (skip bool) {
+			if v != w {
+				fanOut[v]++
+				fanIn[w]++
+				res.Edges++
+			}
+			return
+		})
+	}
+	res.FanIn = degreeStats(s, fanIn, top)
+	res.FanOut = degreeStats(s, fanOut, top)
+	for v := range pkgs {
+		if fanOut[v] == 0 {
+			res.Orphans = append(res.Orphans, pkgs[v].Name)
+		}
+	}
+
+	components := graph.StrongComponents(g)
+	slices.SortStableFunc(components, func(a, b []int) int { return cmp.Compare(len(b), len(a)) })
+	for _, component := range components {
+		if len(component) < 2 || len(res.Cycles) >= top {
+			break
+		}
+		var names []string
+		for _, v := range component {
+			names = append(names, pkgs[v].Name)
+		}
+		slices.Sort(names)
+		res.Cycles = append(res.Cycles, names)
+	}
+
+	res.LongestChain = longestChain(s, components)
+	return
+}
+
+func degreeStats(s State, degrees []int, top int) (res DegreeStats) {
+	var total int
+	for _, degree := range degrees {
+		total += degree
+		res.Max = max(res.Max, degree)
+	}
+	res.Average = float64(total) / float64(len(degrees))
+
+	idxs := make([]int, len(degrees))
+	for idx := range idxs {
+		idxs[idx] = idx
+	}
+	slices.SortStableFunc(idxs, func(a, b int) int { return cmp.Compare(degrees[b], degrees[a]) })
+	res.Top = []PackageCount{}
+	for _, idx := range idxs[:min(top, len(idxs))] {
+		if degrees[idx] != 0 {
+			res.Top = append(res.Top, PackageCount{Name: s.Packages()[idx].Name, Count: degrees[idx]})
+		}
+	}
+	return
+}
+
+// longestChain returns the longest path in the graph of the strongly
+// connected `components` of the dependency graph of `s`, with the first
+// package of every component.
+func longestChain(s State, components [][]int) (res []string) {
+	g := s.DepGraph()
+	compOf := make([]int, g.Order())
+	for cIdx, component := range components {
+		for _, v := range component {
+			compOf[v] = cIdx
+		}
+	}
+	condensed := graph.New(len(components))
+	for v := 0; v < g.Order(); v++ {
+		g.Visit(v, func(w int, _ int64) (skip bool) {
+			if compOf[v] != compOf[w] {
+				condensed.Add(compOf[v], compOf[w])
+			}
+			return
+		})
+	}
+
+	// The condensed graph has no cycles, and edges go from earlier to later
+	// tiers.
+	tiers, _ := utils.TieredTopSort(condensed)
+	length, prev := make([]int, len(components)), make([]int, len(components))
+	end := -1
+	for _, c := range utils.Flatten(tiers) {
+		if length[c] == 0 {
+			length[c], prev[c] = 1, -1
+		}
+		if end < 0 || length[c] > length[end] {
+			end = c
+		}
+		condensed.Visit(c, func(w int, _ int64) (skip bool) {
+			if length[c]+1 > length[w] {
+				length[w], prev[w] = length[c]+1, c
+			}
+			return
+		})
+	}
+
+	for c := end; c >= 0; c = prev[c] {
+		members := slices.Clone(components[c])
+		slices.Sort(members)
+		res = append([]string{s.Packages()[members[0]].Name}, res...)
+	}
+	return
+}
@@ -0,0 +1,159 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package state
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/GZGavinZhao/autobuild/common"
+	"github.com/getsolus/libeopkg/index"
+	"github.com/ulikunitz/xz"
+)
+
+// IndexStream reads the binary packages of an eopkg index one at a time,
+// without loading the whole index.
+type IndexStream struct {
+	dec    *xml.Decoder
+	closer io.Closer
+	// depth is the depth of the decoder in the XML tree.
+	depth int
+	// last is the name of the last package, to check that they are sorted.
+	last string
+}
+
+// OpenIndexStream opens the index of a bin or repo TPath for streaming.
+func OpenIndexStream(tpath string) (s *IndexStream, err error) {
+	kind, path, _ := strings.Cut(tpath, ":")
+	s = &IndexStream{}
+	switch kind {
+	case "bin":
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("state.OpenIndexStream: failed to open index %s: %w", path, err)
+		}
+		s.dec, s.closer = xml.NewDecoder(file), file
+	case "repo":
+		url := RepoIndexURL(path)
+		resp, err := http.Get(url)
+		if err != nil {
+			return nil, fmt.Errorf("state.OpenIndexStream: failed to fetch index from url %s: %w", url, err)
+		}
+		r, err := xz.NewReader(resp.Body)
+		if err != nil {
+			resp.Body.Close()
+			return nil, fmt.Errorf("state.OpenIndexStream: failed to create XZ reader with index from url %s: %w", url, err)
+		}
+		s.dec, s.closer = xml.NewDecoder(r), resp.Body
+	default:
+		return nil, fmt.Errorf("state.OpenIndexStream: %s isn't a binary TPath", tpath)
+	}
+	return
+}
+
+// Close closes the index.
+func (s *IndexStream) Close() error {
+	return s.closer.Close()
+}
+
+// Next returns the next binary package of the index, or io.EOF after the last
+// one. The name of the package is the one of the binary package, not of its
+// source package. Packages must be sorted by name, as in the indices eopkg
+// generates.
+func (s *IndexStream) Next() (pkg common.Package, err error) {
+	for {
+		token, err := s.dec.Token()
+		if err != nil {
+			return pkg, err
+		}
+		switch elem := token.(type) {
+		case xml.StartElement:
+			if s.depth != 1 || elem.Name.Local != "Package" {
+				s.depth++
+				continue
+			}
+
+			var ipkg index.Package
+			if err = s.dec.DecodeElement(&ipkg, &elem); err != nil {
+				return pkg, fmt.Errorf("state.IndexStream.Next: failed to decode package: %w", err)
+			}
+			if len(ipkg.History) == 0 {
+				return pkg, fmt.Errorf("state.IndexStream.Next: package %s has no history", ipkg.Name)
+			}
+			if ipkg.Name < s.last {
+				return pkg, fmt.Errorf("state.IndexStream.Next: packages aren't sorted, %s comes after %s", ipkg.Name, s.last)
+			}
+			s.last = ipkg.Name
+
+			if pkg, err = common.ParseIndexPackage(ipkg); err != nil {
+				return pkg, err
+			}
+			pkg.Name = ipkg.Name
+			return pkg, nil
+		case xml.EndElement:
+			s.depth--
+		}
+	}
+}
+
+// StreamChanged calls `fn` for every binary package whose version or release
+// differs between the indices `old` and `cur`, including the ones that were
+// added or removed, in the order of their names, like Changed does for whole
+// states. `pkg` is the package in `cur`, or in `old` if it was removed, and
+// the indices of `diff` are only meaningful to tell whether the package exists
+// in either index.
+func StreamChanged(old *IndexStream, cur *IndexStream, fn func(pkg common.Package, diff Diff) error) error {
+	next := func(s *IndexStream) (*common.Package, error) {
+		pkg, err := s.Next()
+		if errors.Is(err, io.EOF) {
+			return nil, nil
+		}
+		return &pkg, err
+	}
+
+	oldPkg, err := next(old)
+	if err != nil {
+		return err
+	}
+	pkg, err := next(cur)
+	if err != nil {
+		return err
+	}
+
+	for oldPkg != nil || pkg != nil {
+		switch {
+		case pkg == nil || oldPkg != nil && oldPkg.Name < pkg.Name:
+			err = fn(*oldPkg, Diff{Idx: -1, OldRelNum: oldPkg.Release, OldVer: oldPkg.Version})
+			if err == nil {
+				oldPkg, err = next(old)
+			}
+		case oldPkg == nil || pkg.Name < oldPkg.Name:
+			err = fn(*pkg, Diff{OldIdx: -1, RelNum: pkg.Release, Ver: pkg.Version})
+			if err == nil {
+				pkg, err = next(cur)
+			}
+		default:
+			diff := Diff{RelNum: pkg.Release, OldRelNum: oldPkg.Release, Ver: pkg.Version, OldVer: oldPkg.Version}
+			if diff.Kind() != KindUnbumped {
+				err = fn(*pkg, diff)
+			}
+			if err == nil {
+				oldPkg, err = next(old)
+			}
+			if err == nil {
+				pkg, err = next(cur)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
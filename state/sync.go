@@ -0,0 +1,143 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package state
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/GZGavinZhao/autobuild/common"
+	"github.com/GZGavinZhao/autobuild/utils"
+)
+
+// SyncCandidate is a package whose release in unstable differs from the one
+// in stable.
+type SyncCandidate struct {
+	Name       string `json:"name"`
+	Kind       string `json:"kind"`
+	OldVersion string `json:"old_version,omitempty"`
+	OldRelease int    `json:"old_release,omitempty"`
+	Version    string `json:"version"`
+	Release    int    `json:"release"`
+	// Blockers explain why the package can't be synced yet, and are empty if
+	// it can.
+	Blockers []string `json:"blockers,omitempty"`
+}
+
+// SyncReport tells which packages of unstable can be synced to stable.
+type SyncReport struct {
+	Eligible []SyncCandidate `json:"eligible"`
+	Blocked  []SyncCandidate `json:"blocked"`
+	// Orphans are the binary packages of stable that unstable doesn't have
+	// anymore, and that syncing leaves behind.
+	Orphans []Orphan `json:"orphans"`
+}
+
+// SyncCheck compares the binary states `stable` and `unstable`, and sorts the
+// packages with a new release in unstable into the ones that can be synced
+// and the ones that can't: packages whose runtime dependencies have a new
+// release that isn't synced along, or are missing, packages with an older
+// release than in stable, and packages updated less than `minAge` before
+// `now`. Only the packages selected by `include` are synced if it isn't nil,
+// the others are held back.
+func SyncCheck(stable *BinaryState, unstable *BinaryState, include func(common.Package) bool, minAge time.Duration, now time.Time) (res SyncReport) {
+	res.Eligible, res.Blocked, res.Orphans = []SyncCandidate{}, []SyncCandidate{}, []Orphan{}
+
+	var stableState, unstableState State = stable, unstable
+	candidates := make(map[int]*SyncCandidate)
+	// held holds the packages with a new release in unstable that aren't
+	// synced.
+	held := make(map[int]bool)
+	for _, diff := range Changed(&stableState, &unstableState) {
+		if diff.IsRemoved() {
+			continue
+		}
+		pkg := unstable.packages[diff.Idx]
+		if include != nil && !include(pkg) {
+			held[diff.Idx] = true
+			continue
+		}
+
+		kind := diff.Kind()
+		candidate := &SyncCandidate{Name: pkg.Name, Kind: kind.String(), Version: diff.Ver, Release: diff.RelNum}
+		if !diff.IsNew() {
+			candidate.OldVersion, candidate.OldRelease = diff.OldVer, diff.OldRelNum
+		}
+		if !kind.Bumped() {
+			candidate.Blockers = append(candidate.Blockers, fmt.Sprintf("%s in unstable", strings.ToLower(kind.Title())))
+		}
+		if minAge > 0 && len(pkg.History) != 0 {
+			if date, err := time.Parse("2006-01-02", pkg.History[0].Date); err == nil && now.Sub(date) < minAge {
+				candidate.Blockers = append(candidate.Blockers, fmt.Sprintf("updated on %s, less than %s ago", pkg.History[0].Date, minAge))
+			}
+		}
+		candidates[diff.Idx] = candidate
+	}
+
+	// deps holds the source packages that every candidate depends on, and
+	// that have to be synced as well.
+	deps := make(map[int][]int)
+	for idx, candidate := range candidates {
+		seen := make(map[int]bool)
+		for _, dep := range unstable.RunDeps(idx) {
+			depIdx, ok := unstable.binToSrcIdx[dep]
+			if !ok {
+				candidate.Blockers = append(candidate.Blockers, fmt.Sprintf("depends on %s, which isn't in unstable", dep))
+				continue
+			}
+			if depIdx == idx || seen[depIdx] {
+				continue
+			}
+			seen[depIdx] = true
+			if held[depIdx] {
+				candidate.Blockers = append(candidate.Blockers, fmt.Sprintf("depends on %s, whose new release isn't synced", unstable.packages[depIdx].Name))
+			} else if candidates[depIdx] != nil {
+				deps[idx] = append(deps[idx], depIdx)
+			}
+		}
+	}
+
+	// Packages are blocked by their blocked dependencies, until no more
+	// package gets blocked.
+	// They are visited in order, for a package with several blocked
+	// dependencies to name the same one every time.
+	idxs := utils.SortedKeys(candidates)
+	for changed := true; changed; {
+		changed = false
+		for _, idx := range idxs {
+			candidate := candidates[idx]
+			if len(candidate.Blockers) != 0 {
+				continue
+			}
+			for _, depIdx := range deps[idx] {
+				if len(candidates[depIdx].Blockers) != 0 {
+					candidate.Blockers = append(candidate.Blockers, fmt.Sprintf("depends on %s, which is blocked", unstable.packages[depIdx].Name))
+					changed = true
+					break
+				}
+			}
+		}
+	}
+
+	for _, candidate := range candidates {
+		if len(candidate.Blockers) == 0 {
+			res.Eligible = append(res.Eligible, *candidate)
+		} else {
+			res.Blocked = append(res.Blocked, *candidate)
+		}
+	}
+	byName := func(a, b SyncCandidate) int { return strings.Compare(a.Name, b.Name) }
+	slices.SortFunc(res.Eligible, byName)
+	slices.SortFunc(res.Blocked, byName)
+
+	// Binary packages that moved to another source package aren't orphaned.
+	res.Orphans = orphanedBinaries(stable, func(bin string, _ common.Package) bool {
+		_, ok := unstable.binToSrcIdx[bin]
+		return ok
+	})
+	return
+}
@@ -83,7 +83,7 @@ func ParseManifest(path string) (cpkg common.Package, err error) {
 				case payload.RecordTagRelease:
 					cpkg.Release = int(data.(uint64))
 				case payload.RecordTagDepends:
-					cpkg.BuildDeps = append(cpkg.BuildDeps, data.(string))
+					cpkg.AddDeps(common.BuildDep, data.(string))
 				case payload.RecordTagProvides:
 					cpkg.Provides = append(cpkg.Provides, data.(string))
 				case payload.RecordTagName:
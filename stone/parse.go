@@ -39,20 +39,21 @@ func ParsePackage(path string) (cpkg common.Package, err error) {
 		}
 
 		cpkg = common.Package{
-			Path:      stonePath,
-			Name:      spkg.Name,
-			Version:   spkg.Version,
-			Release:   spkg.Release,
-			BuildDeps: append(spkg.BuildDeps, spkg.CheckDeps...),
-			Synced:    false,
+			Path:    stonePath,
+			Name:    spkg.Name,
+			Version: spkg.Version,
+			Release: spkg.Release,
+			Synced:  false,
 		}
 
-		cpkg.BuildDeps = append(cpkg.BuildDeps, spkg.CollectRunDeps()...)
+		cpkg.AddDeps(common.BuildDep, spkg.BuildDeps...)
+		cpkg.AddDeps(common.CheckDep, spkg.CheckDeps...)
+		cpkg.AddDeps(common.RunDep, spkg.CollectRunDeps()...)
 
 		if spkg.Toolchain == "clang" {
-			cpkg.BuildDeps = append(cpkg.BuildDeps, "llvm-clang-devel")
+			cpkg.AddDeps(common.BuildDep, "llvm-clang-devel")
 		} else if spkg.Toolchain == "gnu" {
-			cpkg.BuildDeps = append(cpkg.BuildDeps, "gcc-devel")
+			cpkg.AddDeps(common.BuildDep, "gcc-devel")
 		}
 	}
 
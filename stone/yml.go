@@ -8,6 +8,7 @@ import (
 	"github.com/deckarep/golang-set/v2"
 	"gopkg.in/yaml.v3"
 	"os"
+	"slices"
 )
 
 type SubPackage struct {
@@ -50,7 +51,9 @@ func (s *StoneYML) CollectRunDeps() (res []string) {
 		}
 	}
 
-	return set.ToSlice()
+	res = set.ToSlice()
+	slices.Sort(res)
+	return res
 }
 
 func Load(path string) (pkg StoneYML, err error) {
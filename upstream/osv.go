@@ -0,0 +1,212 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package upstream
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/GZGavinZhao/autobuild/common"
+	"github.com/GZGavinZhao/autobuild/config"
+	"github.com/GZGavinZhao/autobuild/utils"
+)
+
+// OSV looks up the known vulnerabilities of packages in the database of
+// osv.dev. It is safe for concurrent use.
+type OSV struct {
+	URL    string
+	client *http.Client
+}
+
+// NewOSV returns the database of osv.dev at `baseURL`, or at api.osv.dev if
+// empty.
+func NewOSV(baseURL string) *OSV {
+	if baseURL == "" {
+		baseURL = "https://api.osv.dev"
+	}
+	return &OSV{URL: strings.TrimSuffix(baseURL, "/"), client: &http.Client{Timeout: time.Minute}}
+}
+
+// osvBatchSize is the number of queries that a request of querybatch may hold.
+const osvBatchSize = 1000
+
+// Query is a package at a version, in an ecosystem of osv.dev.
+type Query struct {
+	Ecosystem string `json:"ecosystem"`
+	Name      string `json:"name"`
+	// Versions are the spellings of the version that the ecosystem may use,
+	// such as the tags v1.2 and 1.2 of a git repository.
+	Versions []string `json:"-"`
+}
+
+// Ecosystems of osv.dev that the names of packages map to, by prefix.
+var ecosystemPrefixes = []struct{ prefix, ecosystem string }{
+	{"python-", "PyPI"},
+	{"rubygem-", "RubyGems"},
+	{"haskell-", "Hackage"},
+}
+
+// QueryOf returns the query of `pkg` at `version`: the package given by the osv
+// section of its autobuild.yaml, or else the one of an ecosystem that its name
+// belongs to, or else the git repository of GitHub or GitLab that it is
+// downloaded from. It returns false if the package can't be named in osv.dev.
+func QueryOf(pkg common.Package, version string) (Query, bool) {
+	if pkg.Path != "" {
+		for _, cfgFile := range []string{"autobuild.yaml", "autobuild.yml"} {
+			cfgFile = filepath.Join(pkg.Path, cfgFile)
+			if !utils.PathExists(cfgFile) {
+				continue
+			}
+			if abConfig, err := config.Load(cfgFile); err == nil && abConfig.OSV != nil {
+				return newQuery(abConfig.OSV.Ecosystem, abConfig.OSV.Name, version), true
+			}
+			break
+		}
+	}
+	for _, eco := range ecosystemPrefixes {
+		if name, ok := strings.CutPrefix(pkg.Name, eco.prefix); ok {
+			return newQuery(eco.ecosystem, name, version), true
+		}
+	}
+	for _, source := range pkg.Sources {
+		if repo, ok := gitRepository(strings.Fields(source)[0]); ok {
+			return newQuery("GIT", repo, version), true
+		}
+	}
+	return Query{}, false
+}
+
+// newQuery returns the query of the package `name` of `ecosystem` at
+// `version`. Tags of git repositories are tried with a v in front too.
+func newQuery(ecosystem string, name string, version string) Query {
+	q := Query{Ecosystem: ecosystem, Name: name, Versions: []string{version}}
+	if ecosystem == "GIT" {
+		q.Versions = append(q.Versions, "v"+version)
+	}
+	return q
+}
+
+// gitRepository returns the repository of GitHub or GitLab that the source
+// `rawURL` of a recipe is downloaded from, as osv.dev names it.
+func gitRepository(rawURL string) (string, bool) {
+	rawURL = strings.TrimPrefix(rawURL, "git|")
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Host != "github.com" && u.Host != "gitlab.com") {
+		return "", false
+	}
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	if len(parts) < 2 {
+		return "", false
+	}
+	return fmt.Sprintf("https://%s/%s/%s", u.Host, parts[0], strings.TrimSuffix(parts[1], ".git")), true
+}
+
+// Vulnerabilities returns the IDs of the known vulnerabilities of the package
+// of every query, at any spelling of its version, sorted.
+func (o *OSV) Vulnerabilities(queries []Query) ([][]string, error) {
+	type batchQuery struct {
+		Package Query  `json:"package"`
+		Version string `json:"version"`
+	}
+	var batch []batchQuery
+	// owners maps the queries of the batch back to `queries`.
+	var owners []int
+	for i, q := range queries {
+		for _, version := range q.Versions {
+			batch = append(batch, batchQuery{Package: q, Version: version})
+			owners = append(owners, i)
+		}
+	}
+
+	res := make([][]string, len(queries))
+	for start := 0; start < len(batch); start += osvBatchSize {
+		end := min(start+osvBatchSize, len(batch))
+		var answer struct {
+			Results []struct {
+				Vulns []struct {
+					ID string `json:"id"`
+				} `json:"vulns"`
+			} `json:"results"`
+		}
+		req := map[string]any{"queries": batch[start:end]}
+		if err := requestJSON(o.client, http.MethodPost, o.URL+"/v1/querybatch", req, &answer); err != nil {
+			return nil, fmt.Errorf("upstream.OSV.Vulnerabilities: %w", err)
+		}
+		if len(answer.Results) != end-start {
+			return nil, fmt.Errorf("upstream.OSV.Vulnerabilities: %d results for %d queries", len(answer.Results), end-start)
+		}
+		for j, result := range answer.Results {
+			owner := owners[start+j]
+			for _, vuln := range result.Vulns {
+				res[owner] = append(res[owner], vuln.ID)
+			}
+		}
+	}
+	for i := range res {
+		slices.Sort(res[i])
+		res[i] = slices.Compact(res[i])
+	}
+	return res, nil
+}
+
+// Vulnerability is a known vulnerability, as described by osv.dev.
+type Vulnerability struct {
+	ID string `json:"id"`
+	// Aliases are the IDs of the vulnerability in other databases, such as
+	// its CVE.
+	Aliases []string `json:"aliases,omitempty"`
+	Summary string   `json:"summary,omitempty"`
+	// Severity is the severity given by the database, e.g. HIGH, or else the
+	// CVSS vector of the vulnerability, if any.
+	Severity string `json:"severity,omitempty"`
+	URL      string `json:"url"`
+}
+
+// CVE returns the CVE of the vulnerability, or its ID if it has none.
+func (v Vulnerability) CVE() string {
+	if strings.HasPrefix(v.ID, "CVE-") {
+		return v.ID
+	}
+	for _, alias := range v.Aliases {
+		if strings.HasPrefix(alias, "CVE-") {
+			return alias
+		}
+	}
+	return v.ID
+}
+
+// Vulnerability returns the vulnerability with the ID `id`.
+func (o *OSV) Vulnerability(id string) (Vulnerability, error) {
+	var answer struct {
+		ID       string   `json:"id"`
+		Aliases  []string `json:"aliases"`
+		Summary  string   `json:"summary"`
+		Severity []struct {
+			Score string `json:"score"`
+		} `json:"severity"`
+		DatabaseSpecific struct {
+			Severity string `json:"severity"`
+		} `json:"database_specific"`
+	}
+	if err := getJSON(o.client, o.URL+"/v1/vulns/"+url.PathEscape(id), &answer); err != nil {
+		return Vulnerability{}, fmt.Errorf("upstream.OSV.Vulnerability: %w", err)
+	}
+	vuln := Vulnerability{
+		ID:       answer.ID,
+		Aliases:  answer.Aliases,
+		Summary:  answer.Summary,
+		Severity: answer.DatabaseSpecific.Severity,
+		URL:      "https://osv.dev/vulnerability/" + url.PathEscape(answer.ID),
+	}
+	if vuln.Severity == "" && len(answer.Severity) != 0 {
+		vuln.Severity = answer.Severity[0].Score
+	}
+	return vuln, nil
+}
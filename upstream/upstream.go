@@ -0,0 +1,294 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+// Package upstream looks up what is known of packages upstream: their latest
+// releases, on release-monitoring.org (Anitya) or Repology, and their known
+// vulnerabilities, on osv.dev.
+package upstream
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GZGavinZhao/autobuild/common"
+	"github.com/GZGavinZhao/autobuild/version"
+	"gopkg.in/yaml.v3"
+)
+
+// UserAgent is sent with every request, which Repology requires to tell
+// clients apart.
+var UserAgent = "autobuild"
+
+// Release is the latest release of a package upstream.
+type Release struct {
+	Version string
+	// URL is the page of the project on the monitor.
+	URL string
+}
+
+// Monitor looks up the latest releases of packages. It is safe for concurrent
+// use.
+type Monitor interface {
+	// Name is the name of the monitor, e.g. for reports.
+	Name() string
+	// Latest returns the latest release of `pkg`, or false if the monitor
+	// doesn't know the package.
+	Latest(pkg common.Package) (Release, bool, error)
+}
+
+// Monitors lists the names of the monitors that New accepts.
+var Monitors = []string{"anitya", "repology"}
+
+// New returns the monitor called `name`, one of Monitors, at `baseURL`, or at
+// its public instance if empty.
+func New(name string, baseURL string) (Monitor, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	baseURL = strings.TrimSuffix(baseURL, "/")
+	switch name {
+	case "anitya":
+		if baseURL == "" {
+			baseURL = "https://release-monitoring.org"
+		}
+		return &Anitya{URL: baseURL, Distribution: "Solus", client: client}, nil
+	case "repology":
+		if baseURL == "" {
+			baseURL = "https://repology.org"
+		}
+		return &Repology{URL: baseURL, Repo: "solus", client: client}, nil
+	}
+	return nil, fmt.Errorf("upstream.New: unknown monitor %q, expected one of %q", name, Monitors)
+}
+
+// getJSON gets `rawURL` with `client`, and decodes the JSON it answers into
+// `out`.
+func getJSON(client *http.Client, rawURL string, out any) error {
+	return requestJSON(client, http.MethodGet, rawURL, nil, out)
+}
+
+// requestJSON sends `in` as JSON, unless nil, to `rawURL` with `client`, and
+// decodes the JSON it answers into `out`.
+func requestJSON(client *http.Client, method string, rawURL string, in any, out any) error {
+	var body io.Reader
+	if in != nil {
+		raw, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(raw)
+	}
+	req, err := http.NewRequest(method, rawURL, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("User-Agent", UserAgent)
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s %s: %s: %s", method, rawURL, resp.Status, strings.TrimSpace(string(body)))
+	}
+	if err = json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("%s %s: invalid response: %w", method, rawURL, err)
+	}
+	return nil
+}
+
+// MonitoringID returns the ID of the project of the package on Anitya, from
+// the monitoring.yaml of its recipe, if it has one.
+func MonitoringID(pkg common.Package) (int, bool) {
+	raw, err := os.ReadFile(filepath.Join(pkg.Path, "monitoring.yaml"))
+	if err != nil {
+		return 0, false
+	}
+	var monitoring struct {
+		Releases struct {
+			ID *int `yaml:"id"`
+		} `yaml:"releases"`
+	}
+	if yaml.Unmarshal(raw, &monitoring) != nil || monitoring.Releases.ID == nil {
+		return 0, false
+	}
+	return *monitoring.Releases.ID, true
+}
+
+// Anitya looks packages up on release-monitoring.org, by the ID of their
+// project in monitoring.yaml, or else by their name in the distribution.
+type Anitya struct {
+	URL          string
+	Distribution string
+	client       *http.Client
+}
+
+func (a *Anitya) Name() string {
+	return "anitya"
+}
+
+func (a *Anitya) Latest(pkg common.Package) (Release, bool, error) {
+	id, ok := MonitoringID(pkg)
+	if !ok {
+		var packages struct {
+			Items []struct {
+				Project       string `json:"project"`
+				Version       string `json:"version"`
+				StableVersion string `json:"stable_version"`
+			} `json:"items"`
+		}
+		query := url.Values{"name": {pkg.Name}, "distribution": {a.Distribution}}
+		if err := getJSON(a.client, a.URL+"/api/v2/packages/?"+query.Encode(), &packages); err != nil {
+			return Release{}, false, fmt.Errorf("upstream.Anitya: %w", err)
+		}
+		if len(packages.Items) == 0 {
+			return Release{}, false, nil
+		}
+		item := packages.Items[0]
+		latest := item.StableVersion
+		if latest == "" {
+			latest = item.Version
+		}
+		if latest == "" {
+			return Release{}, false, nil
+		}
+		return Release{Version: latest, URL: a.URL + "/projects/search/?pattern=" + url.QueryEscape(item.Project)}, true, nil
+	}
+
+	var versions struct {
+		LatestVersion  string   `json:"latest_version"`
+		StableVersions []string `json:"stable_versions"`
+	}
+	if err := getJSON(a.client, fmt.Sprintf("%s/api/v2/versions/?project_id=%d", a.URL, id), &versions); err != nil {
+		return Release{}, false, fmt.Errorf("upstream.Anitya: project %d: %w", id, err)
+	}
+	// Pre-releases are only the latest when there are no stable releases.
+	latest := versions.LatestVersion
+	if len(versions.StableVersions) != 0 {
+		latest = versions.StableVersions[0]
+	}
+	if latest == "" {
+		return Release{}, false, nil
+	}
+	return Release{Version: latest, URL: a.URL + "/project/" + strconv.Itoa(id)}, true, nil
+}
+
+// Repology looks packages up on repology.org, by their name in the repository
+// of the distribution. The projects of the repository are all listed the first
+// time a package is looked up, which takes a request per 200 projects rather
+// than one per package.
+type Repology struct {
+	URL string
+	// Repo is the name of the repository of the distribution on Repology.
+	Repo   string
+	client *http.Client
+
+	once sync.Once
+	// releases maps the names of the source packages of the repository to
+	// the newest release of their project.
+	releases map[string]Release
+	err      error
+}
+
+// repologyInterval is the time between the requests of a listing, as asked by
+// the API of Repology.
+const repologyInterval = time.Second
+
+// repologyPackage is the package of a project in a repository.
+type repologyPackage struct {
+	Repo    string `json:"repo"`
+	SrcName string `json:"srcname"`
+	Version string `json:"version"`
+	// Status is newest for the packages at the newest version of the
+	// project.
+	Status string `json:"status"`
+}
+
+func (r *Repology) Name() string {
+	return "repology"
+}
+
+func (r *Repology) Latest(pkg common.Package) (Release, bool, error) {
+	r.once.Do(func() { r.releases, r.err = r.list() })
+	if r.err != nil {
+		return Release{}, false, r.err
+	}
+	release, ok := r.releases[pkg.Name]
+	return release, ok, nil
+}
+
+// list lists the projects of the repository, a page at a time. Every page
+// starts with the last project of the previous one.
+func (r *Repology) list() (map[string]Release, error) {
+	releases := make(map[string]Release)
+	for start := ""; ; time.Sleep(repologyInterval) {
+		path := "/api/v1/projects/"
+		if start != "" {
+			path += url.PathEscape(start) + "/"
+		}
+		var projects map[string][]repologyPackage
+		if err := getJSON(r.client, r.URL+path+"?inrepo="+url.QueryEscape(r.Repo), &projects); err != nil {
+			return nil, fmt.Errorf("upstream.Repology: failed to list the projects of %s: %w", r.Repo, err)
+		}
+
+		names := make([]string, 0, len(projects))
+		for name := range projects {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+		for _, name := range names {
+			var newest string
+			for _, p := range projects[name] {
+				if p.Status == "newest" && (newest == "" || version.Compare(p.Version, newest) > 0) {
+					newest = p.Version
+				}
+			}
+			if newest == "" {
+				continue
+			}
+			for _, p := range projects[name] {
+				if p.Repo == r.Repo && p.SrcName != "" {
+					releases[p.SrcName] = Release{Version: newest, URL: r.URL + "/project/" + url.PathEscape(name) + "/versions"}
+				}
+			}
+		}
+		if len(names) == 0 || names[len(names)-1] == start {
+			return releases, nil
+		}
+		start = names[len(names)-1]
+	}
+}
+
+// ErrUnknown is returned by Compare for versions that can't be compared.
+var ErrUnknown = errors.New("upstream: the version can't be compared")
+
+// Compare compares the version of a recipe with the release upstream, like
+// version.Compare. Upstream versions are often prefixed with a v, or use
+// another separator than dots, which is undone first.
+func Compare(recipe string, release Release) (int, error) {
+	latest := strings.TrimPrefix(strings.TrimPrefix(release.Version, "v"), "V")
+	if !version.Valid(latest) {
+		if alt := strings.NewReplacer("_", ".", "-", ".").Replace(latest); version.Valid(alt) {
+			latest = alt
+		} else {
+			return 0, ErrUnknown
+		}
+	}
+	return version.Compare(recipe, latest), nil
+}
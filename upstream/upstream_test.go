@@ -0,0 +1,38 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package upstream
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCompare(t *testing.T) {
+	tests := []struct {
+		recipe   string
+		upstream string
+		want     int
+		wantErr  error
+	}{
+		{"1.2.3", "1.2.3", 0, nil},
+		{"1.2.3", "1.2.4", -1, nil},
+		{"1.10", "1.9", 1, nil},
+		{"1.2.3", "v1.2.3", 0, nil},
+		{"1.2.3", "V1.2.4", -1, nil},
+		{"1.2.3", "1-2-4", -1, nil},
+		{"2.0", "v1-9", 1, nil},
+		{"1.0", "1.0-rc1", 1, nil},
+		{"1.0_rc1", "v1.0", -1, nil},
+		{"5.0", "release-5.0", 0, ErrUnknown},
+		{"5.0", "", 0, ErrUnknown},
+		{"5.0", "vv5.0", 0, ErrUnknown},
+	}
+	for _, tt := range tests {
+		got, err := Compare(tt.recipe, Release{Version: tt.upstream})
+		if !errors.Is(err, tt.wantErr) || got != tt.want {
+			t.Errorf("Compare(%q, %q) = %d, %v, want %d, %v", tt.recipe, tt.upstream, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
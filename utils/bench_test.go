@@ -0,0 +1,68 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package utils_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/GZGavinZhao/autobuild/internal/synthetic"
+	"github.com/GZGavinZhao/autobuild/state"
+	"github.com/GZGavinZhao/autobuild/utils"
+)
+
+// changedGraph returns the dependency graph of the new side of the synthetic
+// repository of synthetic.Fixture, and the packages that changed in it.
+func changedGraph(b *testing.B) (newState state.State, changed []int) {
+	dir := synthetic.Fixture(b)
+	old, err := state.LoadSource(filepath.Join(dir, "old", "src"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	cur, err := state.LoadSource(filepath.Join(dir, "new", "src"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	var oldState state.State = old
+	newState = cur
+	for _, diff := range state.Changed(&oldState, &newState) {
+		if !diff.IsRemoved() {
+			changed = append(changed, diff.Idx)
+		}
+	}
+	return
+}
+
+func BenchmarkLiftGraph(b *testing.B) {
+	newState, changed := changedGraph(b)
+	chosen := make(map[int]bool, len(changed))
+	for _, idx := range changed {
+		chosen[idx] = true
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		utils.LiftGraph(newState.DepGraph(), func(v int) bool { return chosen[v] })
+	}
+}
+
+func BenchmarkLiftSelection(b *testing.B) {
+	newState, changed := changedGraph(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		utils.LiftSelection(newState.DepGraph(), changed)
+	}
+}
+
+func BenchmarkTopologicalSort(b *testing.B) {
+	newState, changed := changedGraph(b)
+	lifted := utils.LiftSelection(newState.DepGraph(), changed)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		utils.TieredTopSort(lifted)
+	}
+}
@@ -0,0 +1,49 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package utils
+
+// Closest returns the string of `candidates` with the smallest edit distance
+// to `s`, the first of them on a tie, or an empty string if none is within a
+// third of the length of `s`, which is too far apart for a typo.
+func Closest(s string, candidates []string) (res string) {
+	best := len(s)/3 + 1
+	for _, candidate := range candidates {
+		// The distance is at least the difference in length.
+		if diff := len(candidate) - len(s); diff >= best || -diff >= best {
+			continue
+		}
+		if dist := editDistance(s, candidate, best); dist < best {
+			res, best = candidate, dist
+		}
+	}
+	return
+}
+
+// editDistance returns the Levenshtein distance between `a` and `b`, or
+// `limit` if it is at least `limit`.
+func editDistance(a string, b string, limit int) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		rowMin := cur[0]
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			rowMin = min(rowMin, cur[j])
+		}
+		if rowMin >= limit {
+			return limit
+		}
+		prev, cur = cur, prev
+	}
+	return min(prev[len(b)], limit)
+}
@@ -0,0 +1,52 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package utils
+
+import "testing"
+
+func TestClosest(t *testing.T) {
+	tests := []struct {
+		s          string
+		candidates []string
+		want       string
+	}{
+		{"glibc-devel", []string{"glib2-devel", "glibc-devel"}, "glibc-devel"},
+		{"glibc-devl", []string{"glib2-devel", "glibc-devel"}, "glibc-devel"},
+		{"libxml-devel", []string{"libxml2-devel", "libxslt-devel"}, "libxml2-devel"},
+		// The first candidate wins a tie.
+		{"cat", []string{"cut", "bat"}, "cut"},
+		{"python", []string{"perl", "pythonic-long-name"}, ""},
+		// Short names only allow as many edits as their length can take.
+		{"ab", []string{"cd", "ax"}, ""},
+		{"abc", []string{"abd"}, "abd"},
+		{"", []string{"a"}, ""},
+		{"zlib", nil, ""},
+	}
+	for _, tt := range tests {
+		if got := Closest(tt.s, tt.candidates); got != tt.want {
+			t.Errorf("Closest(%q, %q) = %q, want %q", tt.s, tt.candidates, got, tt.want)
+		}
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		a, b  string
+		limit int
+		want  int
+	}{
+		{"kitten", "sitting", 10, 3},
+		{"kitten", "sitting", 2, 2},
+		{"", "abc", 10, 3},
+		{"abc", "", 10, 3},
+		{"same", "same", 1, 0},
+		{"flaw", "lawn", 10, 2},
+	}
+	for _, tt := range tests {
+		if got := editDistance(tt.a, tt.b, tt.limit); got != tt.want {
+			t.Errorf("editDistance(%q, %q, %d) = %d, want %d", tt.a, tt.b, tt.limit, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package utils
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/yourbasic/graph"
+)
+
+// DOTAttrs holds the attributes of a node or an edge in a DOT file.
+type DOTAttrs map[string]string
+
+func (a DOTAttrs) String() string {
+	if len(a) == 0 {
+		return ""
+	}
+
+	keys := make([]string, 0, len(a))
+	for k := range a {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	attrs := make([]string, len(keys))
+	for i, k := range keys {
+		attrs[i] = fmt.Sprintf("%s=%q", k, a[k])
+	}
+	return " [" + strings.Join(attrs, ", ") + "]"
+}
+
+// WriteDOT writes the subgraph of `g` induced by the vertices for which
+// `include` returns true in the DOT format. `node` and `edge` may be nil, or
+// return the attributes of the given node or edge. Edges for which `edge`
+// returns nil are omitted.
+func WriteDOT(w io.Writer, g graph.Iterator, include func(int) bool, node func(int) DOTAttrs, edge func(int, int, int64) DOTAttrs) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "strict digraph {")
+
+	for v := 0; v < g.Order(); v++ {
+		if !include(v) {
+			continue
+		}
+
+		var attrs DOTAttrs
+		if node != nil {
+			attrs = node(v)
+		}
+		fmt.Fprintf(bw, "\t%d%s;\n", v, attrs)
+	}
+
+	for v := 0; v < g.Order(); v++ {
+		if !include(v) {
+			continue
+		}
+
+		g.Visit(v, func(adj int, c int64) (skip bool) {
+			if !include(adj) {
+				return
+			}
+
+			attrs := DOTAttrs{}
+			if edge != nil {
+				if attrs = edge(v, adj, c); attrs == nil {
+					return
+				}
+			}
+			fmt.Fprintf(bw, "\t%d -> %d%s;\n", v, adj, attrs)
+			return
+		})
+	}
+
+	fmt.Fprintln(bw, "}")
+	return bw.Flush()
+}
+
+// EdgeCost returns the cost of the edge from `v` to `w`, and whether such an
+// edge exists at all.
+func EdgeCost(g graph.Iterator, v, w int) (cost int64, ok bool) {
+	g.Visit(v, func(adj int, c int64) (skip bool) {
+		if adj == w {
+			cost, ok = c, true
+			return true
+		}
+		return false
+	})
+	return
+}
@@ -74,8 +74,13 @@ func TieredTopSort(g graph.Iterator) ([][]int, bool) {
 	return res, vertexCount == g.Order()
 }
 
+// LiftGraph returns the graph of the vertices of `g` that `choose` accepts,
+// with an edge from every chosen vertex to the chosen vertices that it reaches
+// through unchosen ones only. Every chosen vertex is searched from on its own,
+// since paths from different vertices may share unchosen ones.
 func LiftGraph(g graph.Iterator, choose func(int) bool) (res *graph.Mutable) {
-	visited := make(map[int]bool)
+	visited := make([]bool, g.Order())
+	var touched []int
 	res = graph.New(g.Order())
 
 	// // The deterministic node traversal
@@ -106,34 +111,37 @@ func LiftGraph(g graph.Iterator, choose func(int) bool) (res *graph.Mutable) {
 	for node := 0; node < g.Order(); node++ {
 		if choose(node) {
 			g.Visit(node, func(adj int, _ int64) (skip bool) {
-				liftDfs(adj, node, choose, g, visited, res)
+				liftDfs(adj, node, choose, g, visited, &touched, res)
 				return false
 			})
+			for _, v := range touched {
+				visited[v] = false
+			}
+			touched = touched[:0]
 		}
 	}
 
 	return
 }
 
-func liftDfs(node int, parent int, choose func(int) bool, g graph.Iterator, visited map[int]bool, res *graph.Mutable) {
-	if node == parent {
+// liftDfs adds an edge from `root` to the chosen vertices that `node` is or
+// reaches through unchosen vertices that the search from `root` didn't visit
+// yet, and marks them in `visited` and `touched`.
+func liftDfs(node int, root int, choose func(int) bool, g graph.Iterator, visited []bool, touched *[]int, res *graph.Mutable) {
+	if node == root || visited[node] {
 		return
 	}
+	visited[node] = true
+	*touched = append(*touched, node)
 
-	nextp := parent
+	// The paths through chosen vertices are lifted by their own search.
 	if choose(node) {
-		// println(parent, "->", node)
-		res.Add(parent, node)
-		nextp = node
-	}
-
-	if visited[node] {
+		res.Add(root, node)
 		return
 	}
-	visited[node] = true
 
 	g.Visit(node, func(adj int, _ int64) (skip bool) {
-		liftDfs(adj, nextp, choose, g, visited, res)
+		liftDfs(adj, root, choose, g, visited, touched, res)
 		return false
 	})
 }
@@ -292,7 +300,219 @@ func BFSWithDepth(g *graph.Immutable, start int, visit func(int, int) bool) {
 	}
 }
 
+// Subgraph is a graph whose vertices [0, len(Nodes)) correspond to the
+// vertices `Nodes` of a larger graph.
+type Subgraph struct {
+	*graph.Immutable
+	Nodes []int
+}
+
+// InducedSubgraph returns the subgraph of `g` induced by `nodes`, which must be
+// sorted in ascending order. Edge costs are preserved.
+func InducedSubgraph(g graph.Iterator, nodes []int) *Subgraph {
+	index := make(map[int]int, len(nodes))
+	for i, v := range nodes {
+		index[v] = i
+	}
+
+	res := graph.New(len(nodes))
+	for i, v := range nodes {
+		g.Visit(v, func(w int, c int64) (skip bool) {
+			if j, ok := index[w]; ok {
+				res.AddCost(i, j, c)
+			}
+			return
+		})
+	}
+
+	return &Subgraph{Immutable: graph.Sort(res), Nodes: nodes}
+}
+
+// reachable returns the set of vertices reachable from any of `starts`,
+// including `starts` themselves.
+func reachable(g graph.Iterator, starts []int) []bool {
+	seen := make([]bool, g.Order())
+	queue := []int{}
+	for _, v := range starts {
+		if !seen[v] {
+			seen[v] = true
+			queue = append(queue, v)
+		}
+	}
+
+	for len(queue) > 0 {
+		v := queue[0]
+		queue = queue[1:]
+
+		g.Visit(v, func(w int, _ int64) (skip bool) {
+			if !seen[w] {
+				seen[w] = true
+				queue = append(queue, w)
+			}
+			return
+		})
+	}
+
+	return seen
+}
+
+// Neighborhood returns, in ascending order, every vertex of `g` that lies on a
+// path between two vertices of `selection`, including the selection itself.
+// These are the only vertices that lifting the selection ever needs to look
+// at.
+func Neighborhood(g *graph.Immutable, selection []int) (res []int) {
+	forward := reachable(g, selection)
+	reverse := reachable(graph.Transpose(g), selection)
+
+	for v := range forward {
+		if forward[v] && reverse[v] {
+			res = append(res, v)
+		}
+	}
+	return
+}
+
+// LiftSelection lifts `selection` out of `g` like LiftGraph, but restricts all
+// graph work to the neighborhood of the selection. The returned subgraph only
+// contains the vertices of `selection`.
+func LiftSelection(g *graph.Immutable, selection []int) *Subgraph {
+	nodes := Neighborhood(g, selection)
+	sub := InducedSubgraph(g, nodes)
+
+	chosen := make(map[int]bool, len(selection))
+	for _, v := range selection {
+		chosen[v] = true
+	}
+
+	var chosenIdx []int
+	for i, v := range nodes {
+		if chosen[v] {
+			chosenIdx = append(chosenIdx, i)
+		}
+	}
+
+	lifted := InducedSubgraph(LiftGraph(sub, func(i int) bool { return chosen[nodes[i]] }), chosenIdx)
+	for i, v := range lifted.Nodes {
+		lifted.Nodes[i] = nodes[v]
+	}
+	return lifted
+}
+
+// Components returns the weakly connected components of `g`. Each component
+// is sorted, and the components are ordered by their smallest vertex.
+func Components(g graph.Iterator) [][]int {
+	components := graph.Components(g)
+	for _, component := range components {
+		slices.Sort(component)
+	}
+	slices.SortFunc(components, func(a, b []int) int { return a[0] - b[0] })
+	return components
+}
+
 func GraphHash(g *graph.Immutable) string {
 	hashBytes := blake3.Sum256([]byte(g.String()))
 	return base64.StdEncoding.EncodeToString(hashBytes[:])
 }
+
+// Paths returns the simple paths of `g` from any of the `from` vertices to any
+// of the `to` vertices, shortest first, following only the edges that `follow`
+// accepts if it isn't nil. Paths don't go through other `from` or `to`
+// vertices, since those paths contain shorter ones. At most `k` paths are
+// returned, or all of them if `k` isn't positive.
+func Paths(g graph.Iterator, from []int, to []int, k int, follow func(v, w int, cost int64) bool) (res [][]int) {
+	n := g.Order()
+	isFrom, isTo := make([]bool, n), make([]bool, n)
+	for _, v := range from {
+		isFrom[v] = true
+	}
+	for _, v := range to {
+		isTo[v] = true
+	}
+
+	// dist holds the length of the shortest path from every vertex to the
+	// closest `to` vertex, or -1 if there is none, to prune the search. It
+	// may go through `from` vertices, so it is only a lower bound.
+	reverse := make([][]int, n)
+	for v := 0; v < n; v++ {
+		g.Visit(v, func(w int, c int64) (skip bool) {
+			if follow == nil || follow(v, w, c) {
+				reverse[w] = append(reverse[w], v)
+			}
+			return
+		})
+	}
+	dist := make([]int, n)
+	for v := range dist {
+		dist[v] = -1
+	}
+	queue := []int{}
+	for _, v := range to {
+		if dist[v] < 0 {
+			dist[v] = 0
+			queue = append(queue, v)
+		}
+	}
+	for len(queue) > 0 {
+		w := queue[0]
+		queue = queue[1:]
+		for _, v := range reverse[w] {
+			if dist[v] < 0 {
+				dist[v] = dist[w] + 1
+				queue = append(queue, v)
+			}
+		}
+	}
+
+	// Paths are searched by increasing length, until there are enough of
+	// them, or no path was cut short so there are no longer ones.
+	onPath := make([]bool, n)
+	var path []int
+	var cut bool
+	var search func(v int, length int)
+	search = func(v int, length int) {
+		if isTo[v] && len(path) > 1 {
+			if len(path)-1 == length {
+				res = append(res, slices.Clone(path))
+			}
+			return
+		}
+		g.Visit(v, func(w int, c int64) (skip bool) {
+			if k > 0 && len(res) >= k {
+				return true
+			}
+			if onPath[w] || isFrom[w] && !isTo[w] || dist[w] < 0 || follow != nil && !follow(v, w, c) {
+				return
+			}
+			if len(path)+dist[w] > length {
+				cut = true
+				return
+			}
+			onPath[w] = true
+			path = append(path, w)
+			search(w, length)
+			path = path[:len(path)-1]
+			onPath[w] = false
+			return
+		})
+	}
+
+	for length := 1; length < n; length++ {
+		cut = false
+		for _, v := range from {
+			if dist[v] < 0 {
+				continue
+			}
+			onPath[v] = true
+			path = append(path[:0], v)
+			search(v, length)
+			onPath[v] = false
+		}
+		if !cut || k > 0 && len(res) >= k {
+			break
+		}
+	}
+	if k > 0 && len(res) > k {
+		res = res[:k]
+	}
+	return
+}
@@ -0,0 +1,152 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package utils
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/yourbasic/graph"
+)
+
+// testVertices names the vertices of the test graphs.
+const testVertices = "ABCDEFXYZ"
+
+// testGraph returns the graph with the edges `edges`, such as "A->X", between
+// the vertices of testVertices.
+func testGraph(edges ...string) *graph.Immutable {
+	g := graph.New(len(testVertices))
+	for _, edge := range edges {
+		v, w, _ := strings.Cut(edge, "->")
+		g.Add(strings.Index(testVertices, v), strings.Index(testVertices, w))
+	}
+	return graph.Sort(g)
+}
+
+// testSelection returns the vertices of testVertices named in `names`.
+func testSelection(names string) (res []int) {
+	for _, name := range names {
+		res = append(res, strings.IndexRune(testVertices, name))
+	}
+	slices.Sort(res)
+	return
+}
+
+// vertexNames names the vertices `vs` of testVertices.
+func vertexNames(vs []int) string {
+	var b strings.Builder
+	for _, v := range vs {
+		b.WriteByte(testVertices[v])
+	}
+	return b.String()
+}
+
+func TestNeighborhood(t *testing.T) {
+	tests := []struct {
+		name      string
+		edges     []string
+		selection string
+		want      string
+	}{
+		{"chain", []string{"A->X", "X->B", "B->Y"}, "AB", "ABX"},
+		{"shared intermediate", []string{"A->X", "D->B", "B->X", "X->C"}, "ABCD", "ABCDX"},
+		{"dead ends", []string{"Y->A", "A->X", "A->B", "B->Z"}, "AB", "AB"},
+		{"unconnected", []string{"X->Y"}, "AB", "AB"},
+	}
+	for _, tt := range tests {
+		got := vertexNames(Neighborhood(testGraph(tt.edges...), testSelection(tt.selection)))
+		if got != tt.want {
+			t.Errorf("Neighborhood(%s) = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLiftSelection(t *testing.T) {
+	tests := []struct {
+		name      string
+		edges     []string
+		selection string
+		want      []string
+		tiers     string
+	}{
+		{
+			name:      "direct",
+			edges:     []string{"A->B", "B->C"},
+			selection: "ABC",
+			want:      []string{"A->B", "B->C"},
+			tiers:     "[A B C]",
+		},
+		{
+			name:      "through unselected",
+			edges:     []string{"A->X", "X->Y", "Y->B"},
+			selection: "AB",
+			want:      []string{"A->B"},
+			tiers:     "[A B]",
+		},
+		{
+			// Both A and B reach C through X, so C comes after B.
+			name:      "shared intermediate",
+			edges:     []string{"A->X", "D->B", "B->X", "X->C"},
+			selection: "ABCD",
+			want:      []string{"A->C", "B->C", "D->B"},
+			tiers:     "[AD B C]",
+		},
+		{
+			name:      "diamond",
+			edges:     []string{"A->X", "A->Y", "X->B", "Y->C", "B->Z", "C->Z", "Z->D"},
+			selection: "ABCD",
+			want:      []string{"A->B", "A->C", "B->D", "C->D"},
+			tiers:     "[A BC D]",
+		},
+		{
+			// Paths through selected vertices are only kept as their steps.
+			name:      "through selected",
+			edges:     []string{"A->B", "B->X", "X->C"},
+			selection: "ABC",
+			want:      []string{"A->B", "B->C"},
+			tiers:     "[A B C]",
+		},
+		{
+			name:      "cycle through unselected",
+			edges:     []string{"A->X", "X->A", "X->B"},
+			selection: "AB",
+			want:      []string{"A->B"},
+			tiers:     "[A B]",
+		},
+	}
+	for _, tt := range tests {
+		lifted := LiftSelection(testGraph(tt.edges...), testSelection(tt.selection))
+		if got := vertexNames(lifted.Nodes); got != tt.selection {
+			t.Errorf("LiftSelection(%s).Nodes = %s, want %s", tt.name, got, tt.selection)
+		}
+		var edges []string
+		for v := range lifted.Nodes {
+			lifted.Visit(v, func(w int, _ int64) (skip bool) {
+				edges = append(edges, vertexNames([]int{lifted.Nodes[v]})+"->"+vertexNames([]int{lifted.Nodes[w]}))
+				return
+			})
+		}
+		slices.Sort(edges)
+		if !slices.Equal(edges, tt.want) {
+			t.Errorf("LiftSelection(%s) has edges %q, want %q", tt.name, edges, tt.want)
+		}
+
+		tiers, ok := TieredTopSort(lifted)
+		var names []string
+		for _, tier := range tiers {
+			var vs []int
+			for _, v := range tier {
+				vs = append(vs, lifted.Nodes[v])
+			}
+			slices.Sort(vs)
+			names = append(names, vertexNames(vs))
+		}
+		if got := fmt.Sprint(names); !ok || got != tt.tiers {
+			t.Errorf("TieredTopSort(LiftSelection(%s)) = %s, %t, want %s", tt.name, got, ok, tt.tiers)
+		}
+	}
+}
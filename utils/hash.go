@@ -0,0 +1,55 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// HashDir returns the SHA-256 hash of the files in `dir` whose slash-separated
+// paths relative to it are selected by `include`, or of all of them if it is
+// nil. Every file contributes its relative path and the hash of its contents,
+// in lexical order of the paths, so the hash doesn't depend on timestamps or
+// the order of directory entries.
+func HashDir(dir string, include func(rel string) bool) (string, error) {
+	var lines []string
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if include != nil && !include(rel) {
+			return nil
+		}
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(raw)
+		lines = append(lines, fmt.Sprintf("%s\x00%s\n", rel, hex.EncodeToString(sum[:])))
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	slices.Sort(lines)
+	sum := sha256.Sum256([]byte(strings.Join(lines, "")))
+	return "sha256:" + hex.EncodeToString(sum[:]), nil
+}
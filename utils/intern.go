@@ -0,0 +1,97 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package utils
+
+import (
+	"bytes"
+	"encoding/gob"
+)
+
+// StringTable interns strings, so that the many copies of the same names,
+// versions and components in an index share their memory, and numbers them,
+// so that lists of them can be stored as indexes into the table. It isn't
+// safe for concurrent use.
+type StringTable struct {
+	strs []string
+	ids  map[string]int32
+}
+
+func NewStringTable() *StringTable {
+	return &StringTable{ids: make(map[string]int32)}
+}
+
+// ID returns the index of `s` in the table, adding it if it isn't in it.
+func (t *StringTable) ID(s string) int32 {
+	if id, ok := t.ids[s]; ok {
+		return id
+	}
+	id := int32(len(t.strs))
+	t.strs = append(t.strs, s)
+	t.ids[s] = id
+	return id
+}
+
+// IDs returns the indexes of `strs`, see ID.
+func (t *StringTable) IDs(strs []string) []int32 {
+	if len(strs) == 0 {
+		return nil
+	}
+	ids := make([]int32, len(strs))
+	for idx, s := range strs {
+		ids[idx] = t.ID(s)
+	}
+	return ids
+}
+
+// String returns the string at index `id` of the table.
+func (t *StringTable) String(id int32) string {
+	return t.strs[id]
+}
+
+// Strings returns the strings at the indexes `ids` of the table.
+func (t *StringTable) Strings(ids []int32) []string {
+	if len(ids) == 0 {
+		return nil
+	}
+	strs := make([]string, len(ids))
+	for idx, id := range ids {
+		strs[idx] = t.strs[id]
+	}
+	return strs
+}
+
+// Intern returns the copy of `s` held by the table.
+func (t *StringTable) Intern(s string) string {
+	return t.strs[t.ID(s)]
+}
+
+// InternAll replaces the strings of `strs` with the copies held by the table,
+// in place, and returns `strs`.
+func (t *StringTable) InternAll(strs []string) []string {
+	for idx, s := range strs {
+		strs[idx] = t.Intern(s)
+	}
+	return strs
+}
+
+// GobEncode encodes the strings of the table, in the order of their indexes.
+func (t *StringTable) GobEncode() ([]byte, error) {
+	var b bytes.Buffer
+	err := gob.NewEncoder(&b).Encode(t.strs)
+	return b.Bytes(), err
+}
+
+// GobDecode decodes the strings of a table encoded by GobEncode, which keep
+// their indexes.
+func (t *StringTable) GobDecode(raw []byte) error {
+	if err := gob.NewDecoder(bytes.NewReader(raw)).Decode(&t.strs); err != nil {
+		return err
+	}
+	t.ids = make(map[string]int32, len(t.strs))
+	for id, s := range t.strs {
+		t.ids[s] = int32(id)
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package utils
+
+import (
+	"github.com/DataDrake/waterlog"
+	"github.com/DataDrake/waterlog/level"
+)
+
+// TraceLevel is the log level enabling Tracef, one above level.Debug.
+const TraceLevel = level.Debug + 1
+
+// Tracef logs a debug message like waterlog.Debugf, but only at TraceLevel,
+// for details too fine-grained for most debugging, such as every dependency
+// of every package.
+func Tracef(format string, a ...any) {
+	if waterlog.Level() >= TraceLevel {
+		waterlog.Debugf(format, a...)
+	}
+}
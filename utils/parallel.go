@@ -0,0 +1,55 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package utils
+
+import (
+	"runtime"
+	"sync"
+)
+
+// ParallelFor calls `do` with every index from 0 to `n`, spread over as many
+// goroutines as there are CPUs to run them. Every goroutine takes a range of
+// consecutive indexes, so `do` may write to the elements of a slice by index
+// without locking.
+func ParallelFor(n int, do func(idx int)) {
+	workers := min(runtime.GOMAXPROCS(0), n)
+	if workers <= 1 {
+		for idx := 0; idx < n; idx++ {
+			do(idx)
+		}
+		return
+	}
+
+	var wg sync.WaitGroup
+	chunk := (n + workers - 1) / workers
+	for start := 0; start < n; start += chunk {
+		wg.Add(1)
+		go func(start, end int) {
+			defer wg.Done()
+			for idx := start; idx < end; idx++ {
+				do(idx)
+			}
+		}(start, min(start+chunk, n))
+	}
+	wg.Wait()
+}
+
+// ParallelForLimit calls `do` with every index from 0 to `n`, with at most
+// `limit` calls running at the same time. Unlike ParallelFor, it suits calls
+// that wait on the network rather than on CPUs, such as requests.
+func ParallelForLimit(n int, limit int, do func(idx int)) {
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, max(limit, 1))
+	for idx := 0; idx < n; idx++ {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(idx int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			do(idx)
+		}(idx)
+	}
+	wg.Wait()
+}
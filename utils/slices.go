@@ -1,5 +1,10 @@
 package utils
 
+import (
+	"cmp"
+	"slices"
+)
+
 func Filter[T any](a []T, test func(T) bool) []T {
 	b := a[:0]
 
@@ -13,7 +18,7 @@ func Filter[T any](a []T, test func(T) bool) []T {
 }
 
 func Uniq[T comparable](a []T) []T {
-	if (len(a) == 0) {
+	if len(a) == 0 {
 		return a
 	}
 
@@ -23,7 +28,7 @@ func Uniq[T comparable](a []T) []T {
 			continue
 		}
 
-		if b[len(b) - 1] != x {
+		if b[len(b)-1] != x {
 			b = append(b, x)
 		}
 	}
@@ -41,3 +46,13 @@ func Flatten[T any](a [][]T) []T {
 
 	return res
 }
+
+// SortedKeys returns the keys of `m` in ascending order.
+func SortedKeys[K cmp.Ordered, V any](m map[K]V) []K {
+	res := make([]K, 0, len(m))
+	for k := range m {
+		res = append(res, k)
+	}
+	slices.Sort(res)
+	return res
+}
@@ -0,0 +1,148 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+// Package version compares package versions the way eopkg does.
+package version
+
+import (
+	"cmp"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// kind orders the kinds of segments of a version against each other, and
+// against the end of a version.
+type kind int
+
+const (
+	// preRelease segments are the alpha, beta, pre and rc keywords, which
+	// make a version older than the same version without them.
+	preRelease kind = iota
+	end
+	// word segments are any other letters, such as the p of 1.2p1, which make
+	// a version newer than the same version without them.
+	word
+	number
+)
+
+// validRe matches the versions eopkg can handle, see Valid.
+var validRe = regexp.MustCompile(`^(\d+:)?\d[0-9A-Za-z._+~]*$`)
+
+// preReleases are the pre-release keywords, oldest first.
+var preReleases = []string{"alpha", "beta", "pre", "rc"}
+
+type segment struct {
+	kind kind
+	// rank is the index of preRelease keywords in preReleases.
+	rank  int
+	value string
+}
+
+// Compare compares the versions `a` and `b`, and returns -1 if `a` is older,
+// 1 if it is newer, and 0 if they are the same version.
+//
+// Versions may start with an epoch, as in 1:2.0, which takes precedence over
+// the rest. The rest is split into runs of digits, which are compared as
+// numbers, and runs of letters, while any other character only separates them.
+// 1.0_alpha < 1.0_beta < 1.0_pre < 1.0_rc1 < 1.0 < 1.0p1 < 1.0.1, and letters
+// are compared without regard to case.
+func Compare(a, b string) int {
+	epochA, restA := splitEpoch(a)
+	epochB, restB := splitEpoch(b)
+	if c := cmp.Compare(epochA, epochB); c != 0 {
+		return c
+	}
+
+	segsA, segsB := split(restA), split(restB)
+	for i := 0; i < max(len(segsA), len(segsB)); i++ {
+		segA, segB := segment{kind: end}, segment{kind: end}
+		if i < len(segsA) {
+			segA = segsA[i]
+		}
+		if i < len(segsB) {
+			segB = segsB[i]
+		}
+		if c := compareSegments(segA, segB); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
+
+// Valid reports whether `v` is a well-formed version: it starts with a digit,
+// after an optional epoch, and only has letters, digits and the . _ + ~
+// separators. In particular, it has no dashes, which separate the version from
+// the release in package file names.
+func Valid(v string) bool {
+	return validRe.MatchString(v)
+}
+
+// Less reports whether `a` is an older version than `b`.
+func Less(a, b string) bool {
+	return Compare(a, b) < 0
+}
+
+func compareSegments(a, b segment) int {
+	if a.kind != b.kind {
+		return cmp.Compare(a.kind, b.kind)
+	}
+	switch a.kind {
+	case preRelease:
+		return cmp.Compare(a.rank, b.rank)
+	case number:
+		// Numbers may not fit in an int, but without leading zeros, longer
+		// numbers are larger.
+		x, y := strings.TrimLeft(a.value, "0"), strings.TrimLeft(b.value, "0")
+		if c := cmp.Compare(len(x), len(y)); c != 0 {
+			return c
+		}
+		return strings.Compare(x, y)
+	}
+	return strings.Compare(a.value, b.value)
+}
+
+// splitEpoch splits the epoch off `v`, which is 0 if there is none.
+func splitEpoch(v string) (epoch int, rest string) {
+	prefix, rest, found := strings.Cut(v, ":")
+	if !found {
+		return 0, v
+	}
+	epoch, err := strconv.Atoi(prefix)
+	if err != nil {
+		return 0, v
+	}
+	return epoch, rest
+}
+
+// split splits `v` into its segments.
+func split(v string) (segs []segment) {
+	runes := []rune(strings.ToLower(v))
+	for i := 0; i < len(runes); {
+		j := i
+		switch {
+		case unicode.IsDigit(runes[i]):
+			for j < len(runes) && unicode.IsDigit(runes[j]) {
+				j++
+			}
+			segs = append(segs, segment{kind: number, value: string(runes[i:j])})
+		case unicode.IsLetter(runes[i]):
+			for j < len(runes) && unicode.IsLetter(runes[j]) {
+				j++
+			}
+			seg := segment{kind: word, value: string(runes[i:j])}
+			for rank, keyword := range preReleases {
+				if seg.value == keyword {
+					seg.kind, seg.rank = preRelease, rank
+				}
+			}
+			segs = append(segs, seg)
+		default:
+			j++
+		}
+		i = j
+	}
+	return
+}
@@ -0,0 +1,76 @@
+// SPDX-FileCopyrightText: Copyright © 2020-2023 Serpent OS Developers
+//
+// SPDX-License-Identifier: MPL-2.0
+
+package version
+
+import "testing"
+
+func TestCompare(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		// Plain versions, which compared as strings before.
+		{"1.0", "1.0", 0},
+		{"1.0", "1.1", -1},
+		{"1.2", "1.10", -1},
+		{"1.0", "1.0.1", -1},
+		{"2.0", "1.99.99", 1},
+		{"1.01", "1.1", 0},
+		{"20230101", "20221231", 1},
+		{"123456789012345678901234567890", "123456789012345678901234567891", -1},
+		// Pre-releases are older than the release, other words newer.
+		{"1.0_alpha", "1.0_beta", -1},
+		{"1.0_beta", "1.0_pre", -1},
+		{"1.0_pre", "1.0_rc1", -1},
+		{"1.0_rc1", "1.0_rc2", -1},
+		{"1.0_rc1", "1.0", -1},
+		{"1.0", "1.0p1", -1},
+		{"1.0p1", "1.0.1", -1},
+		{"1.0_alpha", "0.9", 1},
+		{"1.0a", "1.0b", -1},
+		{"1.0RC1", "1.0_rc1", 0},
+		{"1.0B", "1.0a", 1},
+		// Separators only separate.
+		{"1.0", "1_0", 0},
+		{"1.0+git", "1.0.git", 0},
+		// Epochs.
+		{"1:1.0", "2.0", 1},
+		{"1:1.0", "2:0.1", -1},
+		{"0:1.0", "1.0", 0},
+		// An invalid epoch is part of the version, and letters sort before digits.
+		{"a:1.0", "1.0", -1},
+	}
+	for _, tt := range tests {
+		if got := Compare(tt.a, tt.b); got != tt.want {
+			t.Errorf("Compare(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+		if got := Compare(tt.b, tt.a); got != -tt.want {
+			t.Errorf("Compare(%q, %q) = %d, want %d", tt.b, tt.a, got, -tt.want)
+		}
+		if got := Less(tt.a, tt.b); got != (tt.want < 0) {
+			t.Errorf("Less(%q, %q) = %t, want %t", tt.a, tt.b, got, tt.want < 0)
+		}
+	}
+}
+
+func TestValid(t *testing.T) {
+	tests := []struct {
+		v    string
+		want bool
+	}{
+		{"1.0", true},
+		{"1.0_rc1", true},
+		{"2:1.0+git20230101~1", true},
+		{"", false},
+		{"v1.0", false},
+		{"1.0-1", false},
+		{"a:1.0", false},
+	}
+	for _, tt := range tests {
+		if got := Valid(tt.v); got != tt.want {
+			t.Errorf("Valid(%q) = %t, want %t", tt.v, got, tt.want)
+		}
+	}
+}
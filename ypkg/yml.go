@@ -5,25 +5,37 @@
 package ypkg
 
 import (
-	"gopkg.in/yaml.v3"
+	"bytes"
+	"errors"
+	"fmt"
 	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v3"
 )
 
+var releaseRe = regexp.MustCompile(`(?m)^(release\s*:\s*)(\d+)`)
+
 type PackageYML struct {
-	Name        string    `yaml:"name"`
-	Version     string    `yaml:"version"`
-	Release     int       `yaml:"release"`
-	Component   yaml.Node `yaml:"component"`
-	Patterns    yaml.Node `yaml:"patterns"`
-	RunDeps     yaml.Node `yaml:"rundeps"`
-	BuildDeps   []string  `yaml:"builddeps"`
-	CheckDeps   []string  `yaml:"checkdeps"`
-	Environment string    `yaml:"environment"`
-	Setup       string    `yaml:"setup"`
-	Build       string    `yaml:"build"`
-	Install     string    `yaml:"install"`
-	Networking  bool      `yaml:"networking"`
-	Clang       bool      `yaml:"clang"`
+	Name        string              `yaml:"name"`
+	Version     string              `yaml:"version"`
+	Release     int                 `yaml:"release"`
+	Source      []map[string]string `yaml:"source"`
+	License     yaml.Node           `yaml:"license"`
+	Component   yaml.Node           `yaml:"component"`
+	Patterns    yaml.Node           `yaml:"patterns"`
+	RunDeps     yaml.Node           `yaml:"rundeps"`
+	BuildDeps   []string            `yaml:"builddeps"`
+	CheckDeps   []string            `yaml:"checkdeps"`
+	Environment string              `yaml:"environment"`
+	Setup       string              `yaml:"setup"`
+	Build       string              `yaml:"build"`
+	Install     string              `yaml:"install"`
+	Networking  bool                `yaml:"networking"`
+	Clang       bool                `yaml:"clang"`
 }
 
 func Load(path string) (pkg PackageYML, err error) {
@@ -36,3 +48,128 @@ func Load(path string) (pkg PackageYML, err error) {
 	err = dec.Decode(&pkg)
 	return
 }
+
+// BumpRelease increments the release number of the package.yml at `path` in
+// place, keeping the rest of the file as it is, and returns the new release.
+func BumpRelease(path string) (release int, err error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+
+	match := releaseRe.FindSubmatchIndex(raw)
+	if match == nil {
+		return 0, errors.New("no release field in " + path)
+	}
+	if release, err = strconv.Atoi(string(raw[match[4]:match[5]])); err != nil {
+		return
+	}
+	release++
+
+	bumped := append([]byte{}, raw[:match[4]]...)
+	bumped = append(bumped, strconv.Itoa(release)...)
+	bumped = append(bumped, raw[match[5]:]...)
+	err = os.WriteFile(path, bumped, 0644)
+	return
+}
+
+// RenameDep renames the dependency `old` to `new` in the lists under the
+// top-level `keys` of the package.yml at `path`, e.g. "builddeps", in place,
+// keeping the rest of the file as it is. It returns how many entries were
+// renamed, and leaves the file untouched if there are none.
+func RenameDep(path string, keys []string, old string, new string) (renamed int, err error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+
+	var doc yaml.Node
+	if err = yaml.Unmarshal(raw, &doc); err != nil {
+		return
+	}
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return 0, fmt.Errorf("ypkg.RenameDep: %s isn't a mapping", path)
+	}
+
+	// Collect the entries to rename. Keys of nested mappings, like the names
+	// of subpackages in rundeps, aren't dependencies.
+	var entries []*yaml.Node
+	var collect func(node *yaml.Node)
+	collect = func(node *yaml.Node) {
+		switch node.Kind {
+		case yaml.ScalarNode:
+			if node.Value == old {
+				entries = append(entries, node)
+			}
+		case yaml.SequenceNode:
+			for _, child := range node.Content {
+				collect(child)
+			}
+		case yaml.MappingNode:
+			for i := 1; i < len(node.Content); i += 2 {
+				collect(node.Content[i])
+			}
+		}
+	}
+	root := doc.Content[0]
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if slices.Contains(keys, root.Content[i].Value) {
+			collect(root.Content[i+1])
+		}
+	}
+	if len(entries) == 0 {
+		return
+	}
+
+	lines := bytes.SplitAfter(raw, []byte("\n"))
+	// Rewrite the entries from the last one, so that the offsets of the
+	// others stay valid.
+	var offsets []int
+	for _, entry := range entries {
+		offset, ok := entryOffset(lines, entry, old)
+		if !ok {
+			return 0, fmt.Errorf("ypkg.RenameDep: unable to rewrite %s at %s:%d", old, path, entry.Line)
+		}
+		offsets = append(offsets, offset)
+	}
+	slices.Sort(offsets)
+
+	renamedRaw := slices.Clone(raw)
+	for i := len(offsets) - 1; i >= 0; i-- {
+		renamedRaw = slices.Replace(renamedRaw, offsets[i], offsets[i]+len(old), []byte(new)...)
+	}
+	if err = os.WriteFile(path, renamedRaw, 0644); err != nil {
+		return
+	}
+	return len(offsets), nil
+}
+
+// entryOffset returns the offset in the file of the value `old` of the scalar
+// `entry`, given the `lines` of the file, after its quote if it is quoted.
+func entryOffset(lines [][]byte, entry *yaml.Node, old string) (int, bool) {
+	if entry.Line < 1 || entry.Line > len(lines) {
+		return 0, false
+	}
+	offset := 0
+	for _, line := range lines[:entry.Line-1] {
+		offset += len(line)
+	}
+	// Columns count characters, not bytes.
+	line := lines[entry.Line-1]
+	for col := 1; col < entry.Column && len(line) > 0; col++ {
+		_, size := utf8.DecodeRune(line)
+		line, offset = line[size:], offset+size
+	}
+
+	switch entry.Style {
+	case 0:
+	case yaml.DoubleQuotedStyle, yaml.SingleQuotedStyle:
+		if len(line) == 0 {
+			return 0, false
+		}
+		line, offset = line[1:], offset+1
+	default:
+		return 0, false
+	}
+	return offset, bytes.HasPrefix(line, []byte(old))
+}